@@ -2,21 +2,34 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/hackclub/format/internal/assets"
 	"github.com/hackclub/format/internal/auth"
+	"github.com/hackclub/format/internal/campaign"
 	"github.com/hackclub/format/internal/config"
+	"github.com/hackclub/format/internal/db"
+	"github.com/hackclub/format/internal/dedup"
+	"github.com/hackclub/format/internal/gc"
+	"github.com/hackclub/format/internal/gmail"
+	"github.com/hackclub/format/internal/health"
 	"github.com/hackclub/format/internal/html"
 	httphandler "github.com/hackclub/format/internal/http"
 	"github.com/hackclub/format/internal/imageproc"
+	"github.com/hackclub/format/internal/integrity"
+	"github.com/hackclub/format/internal/malware"
+	"github.com/hackclub/format/internal/moderation"
 	"github.com/hackclub/format/internal/session"
+	"github.com/hackclub/format/internal/signedurl"
 	"github.com/hackclub/format/internal/storage"
+	"github.com/hackclub/format/internal/web"
+	"github.com/hackclub/format/internal/webhook"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
@@ -53,51 +66,476 @@ func main() {
 	// Initialize session manager
 	sessionManager := session.NewManager(cfg.SessionSecret, cfg.AppBaseURL)
 
-	// Initialize OIDC provider
-	redirectURL := fmt.Sprintf("%s/api/auth/callback", cfg.AppBaseURL)
-	oidcProvider, err := auth.NewOIDCProvider(ctx, cfg.GoogleOAuthClientID, cfg.GoogleOAuthClientSecret, redirectURL, cfg.AllowedDomains)
+	// Identity providers, Google first as the default
+	providers := auth.NewRegistry()
+	callbackURL := func(name string) string { return cfg.AppBaseURL + auth.CallbackPath(name) }
+	oidcProvider, err := auth.NewOIDCProvider(ctx, cfg.GoogleOAuthClientID, cfg.GoogleOAuthClientSecret, callbackURL(auth.ProviderGoogle), cfg.AllowedDomains, cfg.AllowedEmails)
 	if err != nil {
 		logger.Fatal().Err(err).Msg("failed to initialize OIDC provider")
 	}
+	providers.Register(oidcProvider)
+	if len(cfg.AllowedEmails) > 0 {
+		logger.Info().Int("emails", len(cfg.AllowedEmails)).Msg("ALLOWED_EMAILS can sign in with Google outside ALLOWED_DOMAINS")
+	}
+	// Only members of Workspace groups, checked in the directory at login
+	if len(cfg.AllowedGroups) > 0 {
+		if cfg.GoogleGroupsCredentialsFile == "" || cfg.GoogleGroupsAdminEmail == "" {
+			logger.Fatal().Msg("GOOGLE_GROUPS_CREDENTIALS_FILE and GOOGLE_GROUPS_ADMIN_EMAIL are required with ALLOWED_GROUPS")
+		}
+		groups, err := auth.NewGroupChecker(ctx, cfg.GoogleGroupsCredentialsFile, cfg.GoogleGroupsAdminEmail, cfg.AllowedGroups)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("failed to initialize group checker")
+		}
+		oidcProvider.RequireGroups(groups)
+		logger.Info().Strs("groups", cfg.AllowedGroups).Msg("Google sign-in limited to ALLOWED_GROUPS")
+	}
 
-	// Initialize R2 storage client
-	r2Client, err := storage.NewR2Client(
-		ctx,
-		cfg.R2AccountID,
-		cfg.R2AccessKeyID,
-		cfg.R2SecretAccessKey,
-		cfg.R2Bucket,
-		cfg.R2S3Endpoint,
-		cfg.R2PublicBaseURL,
-	)
+	// Sign in with Slack as an alternative, off unless configured
+	if cfg.SlackClientID != "" {
+		if cfg.SlackClientSecret == "" || len(cfg.SlackAllowedTeams) == 0 {
+			logger.Fatal().Msg("SLACK_CLIENT_SECRET and SLACK_ALLOWED_TEAMS are required with SLACK_CLIENT_ID")
+		}
+		slackProvider, err := auth.NewSlackProvider(ctx, cfg.SlackClientID, cfg.SlackClientSecret, callbackURL(auth.ProviderSlack), cfg.SlackAllowedTeams)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("failed to initialize Slack provider")
+		}
+		providers.Register(slackProvider)
+		logger.Info().Strs("teams", cfg.SlackAllowedTeams).Msg("Slack sign-in enabled")
+	}
+
+	// Sign in with GitHub for contributors without a Workspace account,
+	// off unless configured
+	if cfg.GitHubClientID != "" {
+		if cfg.GitHubClientSecret == "" || len(cfg.GitHubAllowedOrgs) == 0 {
+			logger.Fatal().Msg("GITHUB_CLIENT_SECRET and GITHUB_ALLOWED_ORGS are required with GITHUB_CLIENT_ID")
+		}
+		githubProvider, err := auth.NewGitHubProvider(cfg.GitHubClientID, cfg.GitHubClientSecret, callbackURL(auth.ProviderGitHub), cfg.GitHubAllowedOrgs)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("failed to initialize GitHub provider")
+		}
+		providers.Register(githubProvider)
+		logger.Info().Strs("orgs", cfg.GitHubAllowedOrgs).Msg("GitHub sign-in enabled")
+	}
+
+	// Any other OpenID Connect provider, off unless configured
+	if cfg.OIDCIssuerURL != "" {
+		if cfg.OIDCClientID == "" || len(cfg.OIDCAllowedDomains) == 0 {
+			logger.Fatal().Msg("OIDC_CLIENT_ID and OIDC_ALLOWED_DOMAINS are required with OIDC_ISSUER_URL")
+		}
+		genericProvider, err := auth.NewGenericOIDCProvider(ctx, cfg.OIDCIssuerURL, cfg.OIDCClientID, cfg.OIDCClientSecret, callbackURL(auth.ProviderOIDC), cfg.OIDCDisplayName, cfg.OIDCAllowedDomains)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("failed to initialize OIDC provider")
+		}
+		providers.Register(genericProvider)
+		logger.Info().Str("issuer", cfg.OIDCIssuerURL).Msg("OpenID Connect sign-in enabled")
+	}
+
+	// SAML identity providers of larger organizations, off unless configured
+	if cfg.SAMLIDPMetadataURL != "" {
+		if len(cfg.SAMLAllowedDomains) == 0 {
+			logger.Fatal().Msg("SAML_ALLOWED_DOMAINS is required with SAML_IDP_METADATA_URL")
+		}
+		if (cfg.SAMLCertFile == "") != (cfg.SAMLKeyFile == "") {
+			logger.Fatal().Msg("SAML_CERT_FILE and SAML_KEY_FILE must be set together")
+		}
+		samlProvider, err := auth.NewSAMLProvider(ctx, auth.SAMLConfig{
+			IDPMetadataURL: cfg.SAMLIDPMetadataURL,
+			EntityID:       cfg.SAMLEntityID,
+			MetadataURL:    cfg.AppBaseURL + "/api/auth/saml/metadata",
+			ACSURL:         callbackURL(auth.ProviderSAML),
+			CertFile:       cfg.SAMLCertFile,
+			KeyFile:        cfg.SAMLKeyFile,
+			EmailAttribute: cfg.SAMLEmailAttribute,
+			NameAttribute:  cfg.SAMLNameAttribute,
+			DisplayName:    cfg.SAMLDisplayName,
+			AllowedDomains: cfg.SAMLAllowedDomains,
+		})
+		if err != nil {
+			logger.Fatal().Err(err).Msg("failed to initialize SAML provider")
+		}
+		providers.Register(samlProvider)
+		logger.Info().Str("metadata", cfg.SAMLIDPMetadataURL).Msg("SAML sign-in enabled")
+	}
+
+	// Other services calling the API on their own behalf, off unless
+	// configured
+	var services *auth.ServiceAuthenticator
+	if len(cfg.ServiceHMACSecrets) > 0 || cfg.ServiceJWTIssuer != "" {
+		secrets := make(map[string]string)
+		for _, pair := range cfg.ServiceHMACSecrets {
+			name, secret, _ := strings.Cut(pair, ":")
+			if name == "" || len(secret) < 32 {
+				logger.Fatal().Msg("SERVICE_HMAC_SECRETS must be name:secret pairs with secrets of at least 32 characters")
+			}
+			secrets[name] = secret
+		}
+		services = auth.NewServiceAuthenticator(secrets)
+		if cfg.ServiceJWTIssuer != "" {
+			if err := services.TrustIssuer(ctx, cfg.ServiceJWTIssuer, cfg.ServiceJWTAudiences, cfg.ServiceJWTSubjects); err != nil {
+				logger.Fatal().Err(err).Msg("failed to initialize service JWT issuer")
+			}
+		}
+		logger.Info().Int("hmac_services", len(secrets)).Str("jwt_issuer", cfg.ServiceJWTIssuer).Msg("service-to-service authentication enabled")
+	}
+
+	// Bearer mode: logins mint short-lived JWTs the API accepts without
+	// session state, off unless configured
+	var bearer *auth.JWTIssuer
+	if len(cfg.JWTSigningKeys) > 0 {
+		if cfg.JWTTTLMinutes <= 0 || time.Duration(cfg.JWTTTLMinutes)*time.Minute > sessionManager.MaxAge() {
+			logger.Fatal().Msg("JWT_TTL_MINUTES must be between 1 and 720 (the session lifetime)")
+		}
+		bearer, err = auth.NewJWTIssuer(cfg.AppBaseURL, cfg.JWTSigningKeys, time.Duration(cfg.JWTTTLMinutes)*time.Minute)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("failed to initialize JWT issuer")
+		}
+		logger.Info().Int("keys", len(cfg.JWTSigningKeys)).Int("ttl_minutes", cfg.JWTTTLMinutes).Msg("JWT bearer authentication enabled")
+	}
+
+	// Initialize the storage client, R2 unless configured otherwise
+	if !storage.IsValidBackend(cfg.StorageBackend) {
+		logger.Fatal().Msgf("invalid STORAGE_BACKEND %q, expected r2, s3, gcs, minio or local", cfg.StorageBackend)
+	}
+	if cfg.PresignedURLTTLMinutes < 0 || time.Duration(cfg.PresignedURLTTLMinutes)*time.Minute > storage.MaxPresignTTL {
+		logger.Fatal().Msg("PRESIGNED_URL_TTL_MINUTES must be between 0 and 10080 (7 days)")
+	}
+	if cfg.PresignedURLTTLMinutes > 0 && cfg.SignedURLSecret != "" {
+		// Extra query parameters would break the presigned signature
+		logger.Fatal().Msg("PRESIGNED_URL_TTL_MINUTES and SIGNED_URL_SECRET can't be combined")
+	}
+	storageConfig := storage.Config{
+		Backend:         cfg.StorageBackend,
+		AccountID:       cfg.R2AccountID,
+		AccessKeyID:     cfg.R2AccessKeyID,
+		SecretAccessKey: cfg.R2SecretAccessKey,
+		Bucket:          cfg.R2Bucket,
+		Endpoint:        cfg.R2S3Endpoint,
+		Region:          cfg.StorageRegion,
+		PublicBaseURL:   cfg.R2PublicBaseURL,
+		LocalDir:        cfg.LocalStorageDir,
+		InsecureTLS:     cfg.StorageInsecureTLS,
+		PresignTTL:      time.Duration(cfg.PresignedURLTTLMinutes) * time.Minute,
+		Cache: storage.CachePolicy{
+			ImageMaxAge:     cfg.CacheMaxAgeImages,
+			DocumentMaxAge:  cfg.CacheMaxAgeDocuments,
+			EphemeralMaxAge: cfg.CacheMaxAgeEphemeral,
+		},
+		Policy: storage.UploadPolicy{
+			Encryption: cfg.StorageSSE,
+			KMSKeyID:   cfg.StorageSSEKMSKeyID,
+			LockMode:   cfg.StorageObjectLockMode,
+			LockDays:   cfg.StorageObjectLockDays,
+			Tagging:    cfg.StorageObjectTagging,
+		},
+	}
+	storageClient, err := storage.New(ctx, storageConfig)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to initialize storage client")
+	}
+	// Retained originals still have their metadata and quarantined images
+	// were flagged, both go to a bucket of their own that's never served
+	var privateStorage storage.R2ClientInterface
+	if cfg.RetainOriginals || (cfg.ModerationURL != "" && cfg.ModerationAction == moderation.ActionQuarantine) {
+		privateConfig := storageConfig
+		privateConfig.Bucket = cfg.PrivateBucket
+		privateConfig.LocalDir = cfg.LocalPrivateDir
+		privateConfig.PublicBaseURL = ""
+		privateConfig.PresignTTL = 0
+		if cfg.StorageBackend == storage.BackendLocal {
+			if filepath.Clean(cfg.LocalPrivateDir) == filepath.Clean(cfg.LocalStorageDir) {
+				logger.Fatal().Msg("LOCAL_PRIVATE_DIR must not be LOCAL_STORAGE_DIR")
+			}
+		} else if cfg.PrivateBucket == "" || cfg.PrivateBucket == cfg.R2Bucket {
+			logger.Fatal().Msg("RETAIN_ORIGINALS and MODERATION_ACTION=quarantine need a PRIVATE_BUCKET other than R2_BUCKET")
+		}
+		privateStorage, err = storage.New(ctx, privateConfig)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("failed to initialize private storage client")
+		}
+	}
+	if cfg.StorageBackend == storage.BackendLocal || cfg.StorageBackend == storage.BackendMinIO {
+		logger.Warn().Str("dir", cfg.LocalStorageDir).Msgf("storing assets in %s storage, for development only", cfg.StorageBackend)
+	}
+
+	// Open the asset metadata store
+	database, err := db.Open(ctx, cfg.DatabaseURL)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to open database")
+	}
+	defer database.Close()
+	sessionManager.SetStore(database)
+
+	// Google OAuth tokens stay server-side, Gmail is called through the
+	// backend
+	tokenStore, err := gmail.NewTokenStore(database, oidcProvider, cfg.SessionSecret, sessionManager.MaxAge())
 	if err != nil {
-		logger.Fatal().Err(err).Msg("failed to initialize R2 client")
+		logger.Fatal().Err(err).Msg("failed to initialize token store")
+	}
+	// Refreshes happen within requests AuthMiddleware has put the client in
+	tokenStore.OnRefresh(func(ctx context.Context, user string, refreshErr error) {
+		detail := "gmail"
+		if refreshErr != nil {
+			detail = "gmail refused: " + refreshErr.Error()
+		}
+		ip, _ := ctx.Value("client_ip").(string)
+		userAgent, _ := ctx.Value("user_agent").(string)
+		if err := sessionManager.RecordEvent(ctx, &db.AuthEvent{
+			Event:     db.AuthEventTokenRefresh,
+			User:      user,
+			Provider:  auth.ProviderGoogle,
+			IP:        ip,
+			UserAgent: userAgent,
+			Detail:    detail,
+		}); err != nil {
+			logger.Error().Err(err).Str("email", user).Msg("failed to record auth event")
+		}
+	})
+	gmailClient := gmail.NewClient(tokenStore, logger)
+
+	// Webhooks for asset events
+	if len(cfg.WebhookURLs) > 0 && cfg.WebhookSecret == "" {
+		logger.Fatal().Msg("WEBHOOK_SECRET is required with WEBHOOK_URLS")
+	}
+	notifier := webhook.NewNotifier(cfg.WebhookURLs, cfg.WebhookSecret, logger)
+
+	// Garbage collection of unreferenced assets, off unless a retention is set
+	var collector *gc.Collector
+	gcCtx, stopGC := context.WithCancel(ctx)
+	defer stopGC()
+	if cfg.GCRetentionDays < 0 {
+		logger.Fatal().Msg("GC_RETENTION_DAYS must not be negative")
+	}
+	if cfg.GCRetentionDays > 0 {
+		if cfg.GCIntervalHours <= 0 {
+			logger.Fatal().Msg("GC_INTERVAL_HOURS must be positive")
+		}
+		collector = gc.NewCollector(storageClient, privateStorage, database, notifier, time.Duration(cfg.GCRetentionDays)*24*time.Hour, logger)
+		go collector.Start(gcCtx, time.Duration(cfg.GCIntervalHours)*time.Hour)
+		logger.Info().Int("retention_days", cfg.GCRetentionDays).Int("interval_hours", cfg.GCIntervalHours).Msg("asset garbage collection enabled")
+	}
+
+	// Load the optional watermark
+	watermark := imageproc.WatermarkConfig{
+		Text:     cfg.WatermarkText,
+		Position: cfg.WatermarkPosition,
+		Opacity:  float32(cfg.WatermarkOpacity),
+	}
+	if cfg.WatermarkImage != "" {
+		watermark.Image, err = os.ReadFile(cfg.WatermarkImage)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("failed to read WATERMARK_IMAGE")
+		}
+	}
+	if !imageproc.IsValidWatermarkPosition(cfg.WatermarkPosition) {
+		logger.Fatal().Msgf("invalid WATERMARK_POSITION %q", cfg.WatermarkPosition)
+	}
+	if cfg.WatermarkOpacity < 0 || cfg.WatermarkOpacity > 1 {
+		logger.Fatal().Msg("WATERMARK_OPACITY must be between 0 and 1")
 	}
 
 	// Initialize image processor
-	processor := imageproc.NewProcessor(
-		cfg.JPEGQuality,
-		cfg.JPEGProgressive,
-		cfg.PNGStrip,
-	)
+	if cfg.MaxImageDimension <= 0 {
+		logger.Fatal().Msg("MAX_IMAGE_DIMENSION must be positive")
+	}
+	if cfg.SkipProcessingBytes < 0 {
+		logger.Fatal().Msg("SKIP_PROCESSING_BYTES must not be negative")
+	}
+	if cfg.ProcessingWorkers <= 0 {
+		logger.Fatal().Msg("PROCESSING_WORKERS must be positive")
+	}
+	if cfg.ProcessingMemoryBudgetMB < 0 {
+		logger.Fatal().Msg("PROCESSING_MEMORY_BUDGET_MB must not be negative")
+	}
+	if cfg.ProcessingTimeoutSeconds < 0 {
+		logger.Fatal().Msg("PROCESSING_TIMEOUT_SECONDS must not be negative")
+	}
+	if !imageproc.IsValidPreset(cfg.DefaultPreset) {
+		logger.Fatal().Str("preset", cfg.DefaultPreset).Msg("DEFAULT_PRESET must be email, web or archive")
+	}
+	if cfg.PNGLevel < 0 || cfg.PNGLevel > 6 {
+		logger.Fatal().Msg("PNG_OPTIMIZATION_LEVEL must be between 0 and 6")
+	}
+	if cfg.QuantizeQuality < 0 || cfg.QuantizeQuality > 100 {
+		logger.Fatal().Msg("PNG_QUANTIZE_MIN_QUALITY must be between 0 and 100")
+	}
+	if cfg.WebPQuality < 0 || cfg.WebPQuality > 100 {
+		logger.Fatal().Msg("WEBP_QUALITY must be between 0 and 100")
+	}
+	if cfg.PDFDPI <= 0 {
+		logger.Fatal().Msg("PDF_DPI must be positive")
+	}
+	processor := imageproc.NewProcessor(imageproc.Config{
+		JPEGQuality:     cfg.JPEGQuality,
+		WebPQuality:     cfg.WebPQuality,
+		JPEGProgressive: cfg.JPEGProgressive,
+		MaxDimension:    cfg.MaxImageDimension,
+		SkipThreshold:   cfg.SkipProcessingBytes,
+		Workers:         cfg.ProcessingWorkers,
+		PDFDPI:          cfg.PDFDPI,
+		PNGStrip:        cfg.PNGStrip,
+		PNGLevel:        cfg.PNGLevel,
+		PNGInterlace:    cfg.PNGInterlace,
+		PNGQuantize:     cfg.PNGQuantize,
+		QuantizeQuality: cfg.QuantizeQuality,
+		AnimatedWebP:    cfg.GIFToWebP,
+		MemoryBudget:    int64(cfg.ProcessingMemoryBudgetMB) << 20,
+		Timeout:         time.Duration(cfg.ProcessingTimeoutSeconds) * time.Second,
+		DefaultPreset:   cfg.DefaultPreset,
+		Metadata: imageproc.MetadataPolicy{
+			KeepICC:       cfg.MetadataKeepICC,
+			KeepCopyright: cfg.MetadataKeepCopyright,
+		},
+		Watermark: watermark,
+	})
+
+	// Content moderation of uploads, off without a provider
+	moderationPolicy := moderation.Policy{Action: cfg.ModerationAction, FailOpen: cfg.ModerationFailOpen}
+	if !moderation.IsValidAction(cfg.ModerationAction) {
+		logger.Fatal().Msgf("invalid MODERATION_ACTION %q, expected reject or quarantine", cfg.ModerationAction)
+	}
+	if cfg.ModerationURL != "" {
+		moderationPolicy.Scanner = moderation.NewHTTPScanner(cfg.ModerationURL, cfg.ModerationToken, 30*time.Second)
+	}
+
+	// Polyglot checks always run, ClamAV only with an address
+	malwareScanner := malware.NewScanner(cfg.ClamAVAddress, 30*time.Second)
+
+	// Time-limited asset URLs, permanent without a secret
+	var signer *signedurl.Signer
+	if cfg.SignedURLSecret != "" {
+		if cfg.SignedURLTTLHours <= 0 {
+			logger.Fatal().Msg("SIGNED_URL_TTL_HOURS must be positive")
+		}
+		signer = signedurl.NewSigner(cfg.SignedURLSecret, time.Duration(cfg.SignedURLTTLHours)*time.Hour)
+	}
 
 	// Initialize asset service
-	assetService := assets.NewService(processor, r2Client, logger)
+	if !assets.IsValidNamespace(cfg.KeyNamespace) {
+		logger.Fatal().Msgf("invalid KEY_NAMESPACE %q, expected user, team or empty", cfg.KeyNamespace)
+	}
+	// Recently stored keys skip the existence check, shared through Redis
+	// when configured
+	var dedupIndex dedup.Index
+	if cfg.DedupCacheSize < 0 {
+		logger.Fatal().Msg("DEDUP_CACHE_SIZE must not be negative")
+	}
+	if cfg.DedupCacheSize > 0 || cfg.RedisURL != "" {
+		if cfg.DedupCacheTTLMinutes <= 0 {
+			logger.Fatal().Msg("DEDUP_CACHE_TTL_MINUTES must be positive")
+		}
+		dedupTTL := time.Duration(cfg.DedupCacheTTLMinutes) * time.Minute
+		// GC deletes objects without going through the index, so an entry
+		// must expire before its object can be collected
+		if cfg.GCRetentionDays > 0 && dedupTTL >= time.Duration(cfg.GCRetentionDays)*24*time.Hour {
+			logger.Fatal().Msg("DEDUP_CACHE_TTL_MINUTES must be shorter than GC_RETENTION_DAYS")
+		}
+		if cfg.RedisURL != "" {
+			redisIndex, err := dedup.NewRedis(ctx, cfg.RedisURL, dedupTTL, 2*time.Second)
+			if err != nil {
+				logger.Fatal().Err(err).Msg("failed to connect to Redis")
+			}
+			dedupIndex = redisIndex
+			logger.Info().Int("ttl_minutes", cfg.DedupCacheTTLMinutes).Msg("dedup index in Redis")
+		} else {
+			dedupIndex = dedup.NewLRU(cfg.DedupCacheSize, dedupTTL)
+			logger.Info().Int("size", cfg.DedupCacheSize).Int("ttl_minutes", cfg.DedupCacheTTLMinutes).Msg("dedup index in memory")
+		}
+	}
+
+	assetService := assets.NewService(processor, storageClient, privateStorage, database, notifier, malwareScanner, moderationPolicy, signer, cfg.KeyNamespace, cfg.RetainOriginals, dedupIndex, logger)
+
+	// Assets uploaded with a TTL are deleted once it passes
+	if cfg.ExpirySweepMinutes <= 0 {
+		logger.Fatal().Msg("EXPIRY_SWEEP_INTERVAL_MINUTES must be positive")
+	}
+	go assetService.StartExpirySweeper(gcCtx, time.Duration(cfg.ExpirySweepMinutes)*time.Minute)
 
 	// Initialize asset handler
-	assetHandler := assets.NewHandler(assetService, logger)
+	assetHandler := assets.NewHandler(assetService, cfg.AdminEmails, cfg.ImageSizes, logger)
 
 	// Initialize HTML transformer (use configured CDN base)
-	htmlTransformer := html.NewTransformer(assetService, cfg.R2PublicBaseURL)
+	htmlTransformer := html.NewTransformer(assetService, storageClient.BaseURL(), html.FooterConfig{
+		Template:       cfg.FooterTemplate,
+		OrgName:        cfg.FooterOrgName,
+		Address:        cfg.FooterAddress,
+		UnsubscribeURL: cfg.FooterUnsubscribeURL,
+	}, cfg.AllowedClasses)
+
+	// Drafts given a label are formatted on Gmail push notifications
+	var watcher *gmail.Watcher
+	if cfg.GmailPubSubTopic != "" {
+		audience := cfg.GmailPushAudience
+		if audience == "" {
+			audience = strings.TrimSuffix(cfg.AppBaseURL, "/") + "/api/gmail/push"
+		}
+		watcher, err = gmail.NewWatcher(ctx, gmailClient, database, htmlTransformer, gmail.WatchConfig{
+			Topic:              cfg.GmailPubSubTopic,
+			Label:              cfg.GmailWatchLabel,
+			PushAudience:       audience,
+			PushServiceAccount: cfg.GmailPushServiceAccount,
+		}, logger)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("failed to initialize gmail watcher")
+		}
+		// Watches of mailboxes without notifications would lapse after 7
+		// days
+		go watcher.StartRenewal(gcCtx, time.Hour)
+		logger.Info().Str("topic", cfg.GmailPubSubTopic).Str("label", watcher.Label()).Msg("formatting labeled gmail drafts")
+	}
+
+	// Mail merges are sent from the owner's mailbox, paced; those a restart
+	// interrupted wait for their owners to resume them
+	campaigns := campaign.NewService(database, gmailClient, htmlTransformer, campaign.Config{
+		Interval:      time.Duration(cfg.CampaignSendIntervalSeconds) * time.Second,
+		DailyLimit:    cfg.CampaignDailyLimit,
+		MaxRecipients: cfg.CampaignMaxRecipients,
+	}, logger)
+	if err := campaigns.Recover(ctx); err != nil {
+		logger.Error().Err(err).Msg("failed to pause interrupted campaigns")
+	}
+
+	// Lifecycle rules are managed through the admin API where supported
+	lifecycle, _ := storageClient.(storage.LifecycleManager)
+
+	// Checksums recorded at upload are audited on demand
+	auditor := integrity.NewAuditor(storageClient, database, logger)
+
+	// Storage and the database are checked by /readyz, cached so frequent
+	// probes don't each reach the bucket. The server works without Redis,
+	// which only degrades readiness.
+	checker := health.NewChecker(15*time.Second, 5*time.Second, logger)
+	checker.Add("storage", storageClient.Ping)
+	checker.Add("database", database.Ping)
+	if redisIndex, ok := dedupIndex.(*dedup.Redis); ok {
+		checker.AddOptional("redis", redisIndex.Ping)
+	}
+
+	// The frontend is embedded in the binary unless FRONTEND_DIR points at a
+	// build
+	frontend, source, err := web.Open(cfg.FrontendDir)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to open frontend")
+	}
+	logger.Info().Str("source", source).Msg("serving frontend")
 
 	// Initialize HTTP server
 	server := httphandler.NewServer(
 		cfg,
 		logger,
 		sessionManager,
-		oidcProvider,
+		providers,
+		services,
+		bearer,
+		gmailClient,
+		watcher,
+		campaigns,
 		assetHandler,
 		htmlTransformer,
+		collector,
+		lifecycle,
+		auditor,
+		checker,
+		frontend,
 	)
 
 	// Create HTTP server
@@ -124,6 +562,7 @@ func main() {
 	<-quit
 
 	logger.Info().Msg("server shutting down")
+	stopGC()
 
 	// Create shutdown context with timeout
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
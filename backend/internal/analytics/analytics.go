@@ -0,0 +1,96 @@
+// Package analytics counts asset views from CDN access logs
+package analytics
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/hackclub/format/internal/db"
+	"github.com/hackclub/format/internal/util"
+)
+
+// logpushRecord holds the fields used of a Cloudflare Logpush HTTP requests
+// record
+type logpushRecord struct {
+	ClientRequestMethod string          `json:"ClientRequestMethod"`
+	ClientRequestPath   string          `json:"ClientRequestPath"`
+	EdgeResponseStatus  int             `json:"EdgeResponseStatus"`
+	EdgeStartTimestamp  json.RawMessage `json:"EdgeStartTimestamp"`
+}
+
+// maxLogLine is the longest log record read
+const maxLogLine = 1 << 20
+
+// ParseLogpush counts the views per asset and day in newline-delimited JSON
+// Logpush records. Successful GETs of an asset or any of its variants count
+// as views of the base asset, everything else is skipped.
+func ParseLogpush(r io.Reader) ([]db.ViewCount, error) {
+	type bucket struct {
+		key string
+		day time.Time
+	}
+	counts := map[bucket]int{}
+	var order []bucket
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLogLine)
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var record logpushRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("invalid log record on line %d: %v", line, err)
+		}
+		if record.ClientRequestMethod != "" && record.ClientRequestMethod != "GET" {
+			continue
+		}
+		if record.EdgeResponseStatus != 200 && record.EdgeResponseStatus != 304 {
+			continue
+		}
+		key := strings.TrimPrefix(record.ClientRequestPath, "/")
+		if !util.IsAssetKey(key) {
+			continue
+		}
+		at, err := parseTimestamp(record.EdgeStartTimestamp)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp on line %d: %v", line, err)
+		}
+
+		b := bucket{util.BaseKey(key), at.UTC().Truncate(24 * time.Hour)}
+		if _, ok := counts[b]; !ok {
+			order = append(order, b)
+		}
+		counts[b]++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read logs: %v", err)
+	}
+
+	views := make([]db.ViewCount, len(order))
+	for i, b := range order {
+		views[i] = db.ViewCount{Key: b.key, Day: b.day, Views: counts[b]}
+	}
+	return views, nil
+}
+
+// parseTimestamp reads a Logpush timestamp in any of its formats: RFC 3339,
+// Unix seconds or Unix nanoseconds
+func parseTimestamp(raw json.RawMessage) (time.Time, error) {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return time.Parse(time.RFC3339Nano, s)
+	}
+	var n int64
+	if err := json.Unmarshal(raw, &n); err != nil {
+		return time.Time{}, fmt.Errorf("expected RFC 3339 or Unix time, got %s", raw)
+	}
+	if n > 1e12 {
+		return time.Unix(0, n), nil
+	}
+	return time.Unix(n, 0), nil
+}
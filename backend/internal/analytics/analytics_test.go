@@ -0,0 +1,39 @@
+package analytics
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hackclub/format/internal/db"
+)
+
+func TestParseLogpush(t *testing.T) {
+	key := "ab/abcdefghijklmnopqrstuvwx.jpg"
+	logs := strings.Join([]string{
+		`{"ClientRequestMethod":"GET","ClientRequestPath":"/` + key + `","EdgeResponseStatus":200,"EdgeStartTimestamp":"2024-05-01T10:00:00Z"}`,
+		`{"ClientRequestMethod":"GET","ClientRequestPath":"/ab/abcdefghijklmnopqrstuvwx_w600.jpg","EdgeResponseStatus":304,"EdgeStartTimestamp":1714561200}`,
+		`{"ClientRequestMethod":"GET","ClientRequestPath":"/` + key + `","EdgeResponseStatus":200,"EdgeStartTimestamp":1714647600000000000}`,
+		``,
+		`{"ClientRequestMethod":"GET","ClientRequestPath":"/` + key + `","EdgeResponseStatus":404,"EdgeStartTimestamp":"2024-05-01T10:00:00Z"}`,
+		`{"ClientRequestMethod":"HEAD","ClientRequestPath":"/` + key + `","EdgeResponseStatus":200,"EdgeStartTimestamp":"2024-05-01T10:00:00Z"}`,
+		`{"ClientRequestMethod":"GET","ClientRequestPath":"/favicon.ico","EdgeResponseStatus":200,"EdgeStartTimestamp":"2024-05-01T10:00:00Z"}`,
+	}, "\n")
+
+	views, err := ParseLogpush(strings.NewReader(logs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []db.ViewCount{
+		{Key: key, Day: time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC), Views: 2},
+		{Key: key, Day: time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC), Views: 1},
+	}
+	if !reflect.DeepEqual(views, want) {
+		t.Errorf("ParseLogpush() = %+v, want %+v", views, want)
+	}
+
+	if _, err := ParseLogpush(strings.NewReader("not json")); err == nil {
+		t.Error("ParseLogpush(invalid) succeeded, want error")
+	}
+}
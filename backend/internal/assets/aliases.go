@@ -0,0 +1,97 @@
+package assets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/hackclub/format/internal/db"
+)
+
+// aliasRegex matches valid aliases like "logo-2024"
+var aliasRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,63}$`)
+
+// ErrInvalidAlias is returned for aliases aliasRegex doesn't match
+var ErrInvalidAlias = errors.New("alias must be 1-64 lowercase letters, digits, '.', '_' or '-', starting with a letter or digit")
+
+// SetAlias points alias at the asset at key, creating the alias or, for its
+// owner or an admin, repointing it. It returns db.ErrNotFound for unknown
+// assets and ErrForbidden for someone else's alias.
+func (s *Service) SetAlias(ctx context.Context, alias, key string, admin bool) (*db.Alias, error) {
+	if !aliasRegex.MatchString(alias) {
+		return nil, ErrInvalidAlias
+	}
+	if _, err := s.db.GetAsset(ctx, key); err != nil {
+		return nil, err
+	}
+
+	user := uploaderFromContext(ctx)
+	owner := user
+	if admin {
+		owner = ""
+	}
+	// Creating and repointing are each a single statement, so a concurrent
+	// request can't take over an alias between checking its owner and
+	// writing it. One deleted in between is created on the second try.
+	for attempt := 0; attempt < 2; attempt++ {
+		record := &db.Alias{Alias: alias, Key: key, Owner: user}
+		created, err := s.db.CreateAlias(ctx, record)
+		if err != nil {
+			return nil, err
+		}
+		if !created {
+			err = s.db.RepointAlias(ctx, alias, key, owner)
+			if errors.Is(err, db.ErrNotFound) {
+				if _, err := s.db.GetAlias(ctx, alias); err == nil {
+					return nil, ErrForbidden
+				} else if !errors.Is(err, db.ErrNotFound) {
+					return nil, err
+				}
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			if record, err = s.db.GetAlias(ctx, alias); err != nil {
+				return nil, err
+			}
+		}
+		s.logger.Info().Str("alias", alias).Str("key", key).Str("user", user).Msg("set asset alias")
+		return record, nil
+	}
+	return nil, fmt.Errorf("failed to set alias %s: it was deleted while being set", alias)
+}
+
+// GetAlias returns alias, db.ErrNotFound if there's no such alias
+func (s *Service) GetAlias(ctx context.Context, alias string) (*db.Alias, error) {
+	return s.db.GetAlias(ctx, alias)
+}
+
+// ResolveAlias returns the URL of the asset alias points at
+func (s *Service) ResolveAlias(ctx context.Context, alias string) (string, error) {
+	record, err := s.db.GetAlias(ctx, alias)
+	if err != nil {
+		return "", err
+	}
+	return s.publicURL(record.Key), nil
+}
+
+// DeleteAlias removes an alias of the requesting user, or anyone's for
+// admins. The asset stays.
+func (s *Service) DeleteAlias(ctx context.Context, alias string, admin bool) error {
+	existing, err := s.db.GetAlias(ctx, alias)
+	if err != nil {
+		return err
+	}
+	user := uploaderFromContext(ctx)
+	if !admin && !strings.EqualFold(user, existing.Owner) {
+		return ErrForbidden
+	}
+	if err := s.db.DeleteAlias(ctx, alias); err != nil {
+		return fmt.Errorf("failed to delete alias: %w", err)
+	}
+	s.logger.Info().Str("alias", alias).Str("user", user).Msg("deleted asset alias")
+	return nil
+}
@@ -0,0 +1,186 @@
+package assets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"net/url"
+	"path"
+	"strings"
+	"unicode"
+
+	"github.com/hackclub/format/internal/db"
+	"github.com/hackclub/format/internal/storage"
+	"github.com/hackclub/format/internal/util"
+	"github.com/hackclub/format/internal/webhook"
+)
+
+// maxDocumentBytes matches the limit on fetched files
+const maxDocumentBytes = util.MaxFileSize
+
+var (
+	// ErrUnsupportedDocument is returned for files that aren't an allowed
+	// document type, or don't look like the type they claim
+	ErrUnsupportedDocument = errors.New("unsupported document type, expected PDF, Office, OpenDocument, RTF, text or CSV")
+	// ErrDocumentTooLarge is returned for documents over maxDocumentBytes
+	ErrDocumentTooLarge = fmt.Errorf("document larger than %d MB", maxDocumentBytes>>20)
+)
+
+// DocumentInput is a document to rehost as it is
+type DocumentInput struct {
+	Data []byte
+	// Filename is shown when the document is downloaded, its extension
+	// decides the type before ContentType does
+	Filename    string
+	ContentType string
+	SourceURL   string
+}
+
+// ProcessDocumentFromURL rehosts the document at documentURL
+func (s *Service) ProcessDocumentFromURL(ctx context.Context, documentURL string) (*Asset, error) {
+	s.logger.Info().Str("url", documentURL).Msg("processing document from URL")
+
+	data, contentType, err := s.fetcher.FetchURL(ctx, documentURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch document: %v", err)
+	}
+
+	filename := ""
+	if u, err := url.Parse(documentURL); err == nil {
+		filename = path.Base(u.Path)
+	}
+	return s.ProcessDocument(ctx, &DocumentInput{
+		Data:        data,
+		Filename:    filename,
+		ContentType: contentType,
+		SourceURL:   documentURL,
+	})
+}
+
+// ProcessDocument rehosts a PDF or other allowed document byte for byte,
+// without image processing or moderation, for links rather than inline
+// images. Its key is content-addressed like an image's, so the filename of
+// the first upload of the same bytes wins.
+func (s *Service) ProcessDocument(ctx context.Context, input *DocumentInput) (*Asset, error) {
+	if len(input.Data) > maxDocumentBytes {
+		return nil, ErrDocumentTooLarge
+	}
+	contentType := documentType(input.Filename, input.ContentType)
+	if contentType == "" || !util.IsDocumentData(contentType, input.Data) {
+		return nil, ErrUnsupportedDocument
+	}
+	ext := util.GetDocumentExtension(contentType)
+	filename := documentFilename(input.Filename, ext)
+
+	hashStr := util.HashBytes(input.Data)
+	namespace, err := s.namespaceFor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	key := util.Base32Key(input.Data, ext)
+	if namespace != "" {
+		key = namespace + "/" + key
+	}
+
+	ctx = storage.WithTags(ctx, s.objectTags(ctx, namespace, input.SourceURL, 0))
+
+	if err := s.malware.CheckDocument(ctx, input.Data, contentType); err != nil {
+		s.logger.Warn().Err(err).Str("key", key).Msg("rejected unsafe document")
+		return nil, err
+	}
+
+	publicURL, deduped, err := s.storeDocument(ctx, key, input.Data, contentType, filename)
+	if err != nil {
+		return nil, err
+	}
+	s.logger.Info().Str("key", key).Str("content_type", contentType).Int("bytes", len(input.Data)).Msg("stored document")
+
+	record := &db.Asset{
+		Key:           key,
+		Namespace:     namespace,
+		Hash:          "sha256:" + hashStr,
+		MIME:          contentType,
+		Bytes:         len(input.Data),
+		OriginalBytes: len(input.Data),
+		Uploader:      uploaderFromContext(ctx),
+		SourceURL:     input.SourceURL,
+	}
+	if err := s.db.SaveAsset(ctx, record); err != nil {
+		// The document itself is stored, only its metadata is missing
+		s.logger.Error().Err(err).Str("key", key).Msg("failed to record document metadata")
+	} else {
+		s.addRef(ctx, key)
+	}
+
+	asset := &Asset{
+		URL:           publicURL,
+		MIME:          contentType,
+		Bytes:         len(input.Data),
+		OriginalBytes: len(input.Data),
+		Hash:          "sha256:" + hashStr,
+		Deduped:       deduped,
+		Key:           key,
+		Filename:      filename,
+	}
+	s.audit(ctx, asset, input.SourceURL)
+	event := webhook.EventUploaded
+	if deduped {
+		event = webhook.EventDeduplicated
+	}
+	s.notifier.Notify(event, record.Uploader, asset)
+	return asset, nil
+}
+
+// storeDocument is store for documents, which carry a Content-Disposition
+func (s *Service) storeDocument(ctx context.Context, key string, data []byte, contentType, filename string) (string, bool, error) {
+	exists, err := s.objectStored(ctx, key)
+	if err != nil {
+		return "", false, err
+	}
+	if exists {
+		return s.publicURL(key), true, nil
+	}
+
+	uploadType := contentType
+	if strings.HasPrefix(contentType, "text/") {
+		uploadType += "; charset=utf-8"
+	}
+	if _, err := s.storage.UploadDocument(ctx, key, data, uploadType, filename); err != nil {
+		return "", false, fmt.Errorf("failed to upload to storage: %v", err)
+	}
+	s.rememberStored(ctx, key)
+	return s.publicURL(key), false, nil
+}
+
+// documentType returns the allowed document type of a file by its
+// extension, falling back to its content type, empty if it isn't allowed
+func documentType(filename, contentType string) string {
+	if documentType := util.GetDocumentMIME(path.Ext(filename)); documentType != "" {
+		return documentType
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if util.GetDocumentExtension(mediaType) != "" {
+		return mediaType
+	}
+	return ""
+}
+
+// documentFilename cleans up the name a document is downloaded as and makes
+// sure it ends in ext
+func documentFilename(filename, ext string) string {
+	filename = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == '/' || r == '\\' || r == '"' {
+			return -1
+		}
+		return r
+	}, path.Base(filename))
+	filename = strings.TrimSpace(filename)
+	if filename == "" || filename == "." {
+		filename = "document"
+	}
+	if !strings.EqualFold(path.Ext(filename), ext) {
+		filename += ext
+	}
+	return filename
+}
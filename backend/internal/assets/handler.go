@@ -1,31 +1,66 @@
 package assets
 
 import (
+	"compress/gzip"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/hackclub/format/internal/analytics"
+	"github.com/hackclub/format/internal/auth"
+	"github.com/hackclub/format/internal/db"
+	"github.com/hackclub/format/internal/imageproc"
+	"github.com/hackclub/format/internal/malware"
+	"github.com/hackclub/format/internal/moderation"
+	"github.com/hackclub/format/internal/problem"
 	"github.com/hackclub/format/internal/session"
+	"github.com/hackclub/format/internal/storage"
+	"github.com/hackclub/format/internal/util"
 	"github.com/rs/zerolog"
 )
 
 const maxUploadBytes = 128 << 20 // 128MB request body limit
 
+const maxLogBatchBytes = 64 << 20 // 64MB compressed Logpush batch limit
+
+// Stats periods in days
+const (
+	defaultStatsDays = 30
+	maxStatsDays     = 365
+)
+
 type Handler struct {
 	service *Service
+	admins  []string // emails allowed to delete anyone's assets
+	sizes   []int    // widths and heights rendered without a signed URL
 	logger  zerolog.Logger
+	// idempotencyLocks serializes requests with the same Idempotency-Key
+	idempotencyLocks keyLocks
 }
 
-func NewHandler(service *Service, logger zerolog.Logger) *Handler {
+func NewHandler(service *Service, admins []string, sizes []int, logger zerolog.Logger) *Handler {
 	return &Handler{
 		service: service,
+		admins:  admins,
+		sizes:   sizes,
 		logger:  logger,
 	}
 }
 
+// Service is the asset service the handler serves
+func (h *Handler) Service() *Service {
+	return h.service
+}
+
 // HandleUpload handles single file upload or URL/data URI processing
 func (h *Handler) HandleUpload(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
@@ -37,33 +72,41 @@ func (h *Handler) HandleUpload(w http.ResponseWriter, r *http.Request) {
 	if strings.Contains(contentType, "multipart/form-data") {
 		if err := r.ParseMultipartForm(32 << 20); err != nil { // 32MB in-memory
 			h.logger.Error().Err(err).Msg("failed to parse multipart form")
-			http.Error(w, "Failed to parse form", http.StatusBadRequest)
+			problem.Error(w, r, "Failed to parse form", http.StatusBadRequest)
 			return
 		}
 		file, _, err := r.FormFile("file")
 		if err != nil {
-			http.Error(w, "No file provided", http.StatusBadRequest)
+			problem.Error(w, r, "No file provided", http.StatusBadRequest)
 			return
 		}
 		defer file.Close()
 
 		data, err := io.ReadAll(io.LimitReader(file, maxUploadBytes))
 		if err != nil {
-			http.Error(w, "Failed to read file", http.StatusBadRequest)
+			problem.Error(w, r, "Failed to read file", http.StatusBadRequest)
+			return
+		}
+
+		opts, err := parseProcessOptions(r)
+		if err != nil {
+			problem.Invalid(w, r, err)
 			return
 		}
 
 		asset, err := h.service.ProcessFromData(ctx, &ProcessInput{
 			Data:        data,
-			ContentType: http.DetectContentType(data),
+			ContentType: util.DetectContentType(data),
 			SourceURL:   "upload",
+			Options:     opts,
 		})
 		if err != nil {
 			h.logger.Error().Err(err).Msg("failed to process uploaded file")
-			http.Error(w, fmt.Sprintf("Failed to process image: %v", err), http.StatusInternalServerError)
+			problem.Error(w, r, fmt.Sprintf("Failed to process image: %v", err), ProcessErrorStatus(err))
 			return
 		}
 
+		setExpiryHeader(w, asset)
 		h.writeJSONResponse(w, asset)
 		return
 	}
@@ -73,9 +116,15 @@ func (h *Handler) HandleUpload(w http.ResponseWriter, r *http.Request) {
 	var req struct {
 		URL     string `json:"url,omitempty"`
 		DataURI string `json:"dataUri,omitempty"`
+		imageproc.ProcessOptions
 	}
 	if err := dec.Decode(&req); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		problem.Error(w, r, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if err := req.ProcessOptions.Validate(); err != nil {
+		problem.Invalid(w, r, err)
 		return
 	}
 
@@ -84,76 +133,974 @@ func (h *Handler) HandleUpload(w http.ResponseWriter, r *http.Request) {
 
 	switch {
 	case req.URL != "":
-		asset, err = h.service.ProcessFromURL(ctx, req.URL)
+		asset, err = h.service.ProcessFromURL(ctx, req.URL, req.ProcessOptions)
 	case req.DataURI != "":
-		asset, err = h.service.ProcessFromDataURI(ctx, req.DataURI)
+		asset, err = h.service.ProcessFromDataURI(ctx, req.DataURI, req.ProcessOptions)
 	default:
-		http.Error(w, "Either 'url' or 'dataUri' must be provided", http.StatusBadRequest)
+		problem.Error(w, r, "Either 'url' or 'dataUri' must be provided", http.StatusBadRequest)
 		return
 	}
 
 	if err != nil {
 		h.logger.Error().Err(err).Str("url", req.URL).Msg("failed to process image")
-		http.Error(w, fmt.Sprintf("Failed to process image: %v", err), http.StatusInternalServerError)
+		problem.Error(w, r, fmt.Sprintf("Failed to process image: %v", err), ProcessErrorStatus(err))
 		return
 	}
 
+	setExpiryHeader(w, asset)
 	h.writeJSONResponse(w, asset)
 }
 
+// setExpiryHeader tells callers when an asset uploaded with a TTL disappears
+func setExpiryHeader(w http.ResponseWriter, asset *Asset) {
+	if asset.ExpiresAt != nil {
+		w.Header().Set("X-Asset-Expires-At", asset.ExpiresAt.Format(time.RFC3339))
+	}
+}
+
+// ProcessErrorStatus returns the HTTP status for a failed upload
+func ProcessErrorStatus(err error) int {
+	if errors.Is(err, moderation.ErrFlagged) || errors.Is(err, malware.ErrPolyglot) || errors.Is(err, malware.ErrInfected) || errors.Is(err, malware.ErrActiveContent) {
+		return http.StatusUnprocessableEntity
+	}
+	if errors.Is(err, ErrUnsupportedDocument) {
+		return http.StatusUnsupportedMediaType
+	}
+	if errors.Is(err, ErrDocumentTooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusInternalServerError
+}
+
+// parseProcessOptions reads processing options from multipart form fields
+func parseProcessOptions(r *http.Request) (imageproc.ProcessOptions, error) {
+	var opts imageproc.ProcessOptions
+	if v := r.FormValue("rasterizeSvg"); v != "" {
+		rasterize, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid rasterizeSvg: %q", v)
+		}
+		opts.RasterizeSVG = rasterize
+	}
+	if v := r.FormValue("width"); v != "" {
+		width, err := strconv.Atoi(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid width: %q", v)
+		}
+		opts.Width = width
+	}
+	if v := r.FormValue("force"); v != "" {
+		force, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid force: %q", v)
+		}
+		opts.Force = force
+	}
+	if v := r.FormValue("lossless"); v != "" {
+		lossless, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid lossless: %q", v)
+		}
+		opts.Lossless = lossless
+	}
+	if v := r.FormValue("keepJpeg"); v != "" {
+		keepJPEG, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid keepJpeg: %q", v)
+		}
+		opts.KeepJPEG = keepJPEG
+	}
+	if v := r.FormValue("maxDimension"); v != "" {
+		maxDimension, err := strconv.Atoi(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid maxDimension: %q", v)
+		}
+		opts.MaxDimension = maxDimension
+	}
+	if v := r.FormValue("quality"); v != "" {
+		quality, err := strconv.Atoi(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid quality: %q", v)
+		}
+		opts.Quality = quality
+	}
+	if v := r.FormValue("progressive"); v != "" {
+		progressive, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid progressive: %q", v)
+		}
+		opts.Progressive = &progressive
+	}
+	if v := r.FormValue("pngInterlace"); v != "" {
+		interlace, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid pngInterlace: %q", v)
+		}
+		opts.PNGInterlace = &interlace
+	}
+	if v := r.FormValue("pngLevel"); v != "" {
+		level, err := strconv.Atoi(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid pngLevel: %q", v)
+		}
+		opts.PNGLevel = &level
+	}
+	if v := r.FormValue("quantize"); v != "" {
+		quantize, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid quantize: %q", v)
+		}
+		opts.Quantize = &quantize
+	}
+	if v := r.FormValue("watermark"); v != "" {
+		watermark, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid watermark: %q", v)
+		}
+		opts.Watermark = watermark
+	}
+	if v := r.FormValue("crop"); v != "" {
+		var c imageproc.CropRect
+		if _, err := fmt.Sscanf(v, "%d,%d,%d,%d", &c.X, &c.Y, &c.Width, &c.Height); err != nil {
+			return opts, fmt.Errorf("invalid crop: %q, expected x,y,width,height", v)
+		}
+		opts.Crop = &c
+	}
+	opts.Preset = r.FormValue("preset")
+	opts.CropAspect = r.FormValue("cropAspect")
+	opts.CropStrategy = r.FormValue("cropStrategy")
+	if v := r.FormValue("variants"); v != "" {
+		for _, name := range strings.Split(v, ",") {
+			opts.Variants = append(opts.Variants, strings.TrimSpace(name))
+		}
+	}
+	if v := r.FormValue("ttl"); v != "" {
+		ttl, err := strconv.Atoi(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid ttl: %q", v)
+		}
+		opts.TTL = ttl
+	}
+	return opts, opts.Validate()
+}
+
+// BatchRequest is the body of a batch upload
+type BatchRequest struct {
+	Items []BatchInput `json:"items"`
+}
+
+// BatchResponse is what came of each item of a batch upload, in order
+type BatchResponse struct {
+	Results   []*BatchResult `json:"results"`
+	Succeeded int            `json:"succeeded"`
+	Failed    int            `json:"failed"`
+}
+
+// AssetList is a page of recorded assets
+type AssetList struct {
+	Assets     []*StoredAsset `json:"assets"`
+	NextCursor string         `json:"next_cursor"`
+}
+
 func (h *Handler) HandleBatch(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	r.Body = http.MaxBytesReader(w, r.Body, maxUploadBytes)
 
-	var req struct {
-		Items []BatchInput `json:"items"`
-	}
+	var req BatchRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		problem.Error(w, r, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
 
 	if len(req.Items) == 0 {
-		http.Error(w, "No items provided", http.StatusBadRequest)
+		problem.Error(w, r, "No items provided", http.StatusBadRequest)
 		return
 	}
 
 	// Limit batch size
 	maxBatchSize := 20
 	if len(req.Items) > maxBatchSize {
-		http.Error(w, fmt.Sprintf("Batch size too large (max %d)", maxBatchSize), http.StatusBadRequest)
+		problem.Error(w, r, fmt.Sprintf("Batch size too large (max %d)", maxBatchSize), http.StatusBadRequest)
 		return
 	}
 
-	assets, err := h.service.ProcessBatch(ctx, req.Items)
+	for i, item := range req.Items {
+		if err := item.ProcessOptions.Validate(); err != nil {
+			problem.Invalid(w, r, fmt.Errorf("invalid options for item %d: %w", i, err))
+			return
+		}
+	}
+
+	results := h.service.ProcessBatch(ctx, req.Items)
+	failed := 0
+	for _, result := range results {
+		if result.Error != "" {
+			failed++
+		}
+	}
+	if failed > 0 {
+		h.logger.Warn().Int("batch_size", len(req.Items)).Int("failed", failed).Msg("batch partially failed")
+		// Retries with the same Idempotency-Key should get another go at them
+		skipReplay(ctx)
+	}
+
+	h.writeJSONResponse(w, BatchResponse{
+		Results:   results,
+		Succeeded: len(results) - failed,
+		Failed:    failed,
+	})
+}
+
+// HandleFromPage rehosts the images of a public web page (JSON {"url"} plus
+// processing options) and returns the mapping of original to rehosted URLs
+func (h *Handler) HandleFromPage(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		URL string `json:"url"`
+		imageproc.ProcessOptions
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		problem.Error(w, r, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.URL == "" {
+		problem.Error(w, r, "url is required", http.StatusBadRequest)
+		return
+	}
+	if err := req.ProcessOptions.Validate(); err != nil {
+		problem.Invalid(w, r, err)
+		return
+	}
+
+	result, err := h.service.ProcessFromPage(r.Context(), req.URL, req.ProcessOptions)
 	if err != nil {
-		h.logger.Error().Err(err).Int("batch_size", len(req.Items)).Msg("failed to process batch")
-		http.Error(w, fmt.Sprintf("Failed to process batch: %v", err), http.StatusInternalServerError)
+		h.logger.Error().Err(err).Str("url", req.URL).Msg("failed to rehost page images")
+		problem.Error(w, r, fmt.Sprintf("Failed to rehost page images: %v", err), http.StatusBadGateway)
 		return
 	}
 
-	h.writeJSONResponse(w, map[string]interface{}{
-		"assets": assets,
-		"count":  len(assets),
+	h.writeJSONResponse(w, result)
+}
+
+// HandleDocument rehosts a PDF or other document for linking, from a
+// multipart "file" or JSON {"url"}
+func (h *Handler) HandleDocument(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadBytes)
+
+	var asset *Asset
+	var err error
+	if strings.Contains(r.Header.Get("Content-Type"), "multipart/form-data") {
+		if err := r.ParseMultipartForm(32 << 20); err != nil { // 32MB in-memory
+			problem.Error(w, r, "Failed to parse form", http.StatusBadRequest)
+			return
+		}
+		file, header, formErr := r.FormFile("file")
+		if formErr != nil {
+			problem.Error(w, r, "No file provided", http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		data, readErr := io.ReadAll(io.LimitReader(file, maxUploadBytes))
+		if readErr != nil {
+			problem.Error(w, r, "Failed to read file", http.StatusBadRequest)
+			return
+		}
+		asset, err = h.service.ProcessDocument(ctx, &DocumentInput{
+			Data:        data,
+			Filename:    header.Filename,
+			ContentType: header.Header.Get("Content-Type"),
+			SourceURL:   "upload",
+		})
+	} else {
+		var req struct {
+			URL string `json:"url"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			problem.Error(w, r, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if req.URL == "" {
+			problem.Error(w, r, "Either 'url' or a file upload must be provided", http.StatusBadRequest)
+			return
+		}
+		asset, err = h.service.ProcessDocumentFromURL(ctx, req.URL)
+	}
+	if err != nil {
+		h.logger.Error().Err(err).Msg("failed to rehost document")
+		problem.Error(w, r, fmt.Sprintf("Failed to rehost document: %v", err), ProcessErrorStatus(err))
+		return
+	}
+
+	h.writeJSONResponse(w, asset)
+}
+
+// HandleConvert converts a stored asset (JSON {"key", "format", "quality"})
+// or an uploaded file (multipart "file", "format", "quality") to a specific
+// format and returns the new asset
+func (h *Handler) HandleConvert(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadBytes)
+
+	var input ConvertInput
+	if strings.Contains(r.Header.Get("Content-Type"), "multipart/form-data") {
+		if err := r.ParseMultipartForm(32 << 20); err != nil { // 32MB in-memory
+			problem.Error(w, r, "Failed to parse form", http.StatusBadRequest)
+			return
+		}
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			problem.Error(w, r, "No file provided", http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		if input.Data, err = io.ReadAll(io.LimitReader(file, maxUploadBytes)); err != nil {
+			problem.Error(w, r, "Failed to read file", http.StatusBadRequest)
+			return
+		}
+		input.Format = r.FormValue("format")
+		if v := r.FormValue("quality"); v != "" {
+			if input.Quality, err = strconv.Atoi(v); err != nil {
+				problem.Error(w, r, fmt.Sprintf("invalid quality: %q", v), http.StatusBadRequest)
+				return
+			}
+		}
+	} else {
+		var req struct {
+			Key     string `json:"key"`
+			Format  string `json:"format"`
+			Quality int    `json:"quality,omitempty"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			problem.Error(w, r, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if req.Key == "" {
+			problem.Error(w, r, "Either 'key' or a file upload must be provided", http.StatusBadRequest)
+			return
+		}
+		input = ConvertInput{Key: req.Key, Format: req.Format, Quality: req.Quality}
+	}
+
+	if !imageproc.IsValidFormat(input.Format) {
+		problem.Error(w, r, "Invalid format, expected jpeg, png, webp or avif", http.StatusBadRequest)
+		return
+	}
+	if input.Quality < 0 || input.Quality > 100 {
+		problem.Error(w, r, "quality must be between 1 and 100", http.StatusBadRequest)
+		return
+	}
+
+	asset, err := h.service.Convert(r.Context(), &input)
+	if errors.Is(err, storage.ErrObjectNotFound) {
+		problem.Error(w, r, "Asset not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		h.logger.Error().Err(err).Str("key", input.Key).Str("format", input.Format).Msg("failed to convert image")
+		problem.Error(w, r, fmt.Sprintf("Failed to convert image: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	h.writeJSONResponse(w, asset)
+}
+
+// HandleAssetAction handles POSTs to an asset, {key}/reprocess
+func (h *Handler) HandleAssetAction(w http.ResponseWriter, r *http.Request) {
+	key, ok := strings.CutSuffix(chi.URLParam(r, "*"), "/reprocess")
+	if !ok || key == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Options are optional, the current defaults apply without them
+	var opts imageproc.ProcessOptions
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&opts); err != nil && err != io.EOF {
+			problem.Error(w, r, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+	}
+	if err := opts.Validate(); err != nil {
+		problem.Invalid(w, r, err)
+		return
+	}
+
+	asset, err := h.service.Reprocess(r.Context(), key, opts)
+	if errors.Is(err, db.ErrNotFound) {
+		problem.Error(w, r, "Asset not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, ErrNoOriginal) {
+		problem.Error(w, r, "The original of this asset wasn't retained, upload it again instead", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		h.logger.Error().Err(err).Str("key", key).Msg("failed to reprocess asset")
+		problem.Error(w, r, fmt.Sprintf("Failed to reprocess image: %v", err), ProcessErrorStatus(err))
+		return
+	}
+
+	h.writeJSONResponse(w, asset)
+}
+
+// maxRefreshURLs bounds the URLs of one refresh
+const maxRefreshURLs = 1000
+
+// HandleRefreshURLs re-signs asset URLs, for signed or presigned URLs that
+// expired in documents sent earlier
+func (h *Handler) HandleRefreshURLs(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 4_000_000)
+	var req struct {
+		URLs []string `json:"urls"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.URLs) == 0 {
+		problem.Error(w, r, "Invalid request body, expected {\"urls\": [...]}", http.StatusBadRequest)
+		return
+	}
+	if len(req.URLs) > maxRefreshURLs {
+		problem.Error(w, r, fmt.Sprintf("At most %d URLs per request", maxRefreshURLs), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]map[string]string{
+		"urls": h.service.RefreshURLs(r.Context(), req.URLs),
 	})
 }
 
-// HandleGetAsset handles retrieving asset metadata by ID/key
+// HandleGetAsset handles retrieving asset metadata by ID/key, and its view
+// stats under {key}/stats
 func (h *Handler) HandleGetAsset(w http.ResponseWriter, r *http.Request) {
 	key := chi.URLParam(r, "*")
 	if key == "" {
-		http.Error(w, "Asset ID required", http.StatusBadRequest)
+		problem.Error(w, r, "Asset ID required", http.StatusBadRequest)
+		return
+	}
+	if key, ok := strings.CutSuffix(key, "/stats"); ok {
+		h.handleAssetStats(w, r, key)
+		return
+	}
+
+	asset, err := h.service.GetAsset(r.Context(), key)
+	if errors.Is(err, db.ErrNotFound) {
+		problem.Error(w, r, "Asset not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		h.logger.Error().Err(err).Str("key", key).Msg("failed to get asset")
+		problem.Error(w, r, "Failed to get asset", http.StatusInternalServerError)
+		return
+	}
+
+	h.writeJSONResponse(w, asset)
+}
+
+// handleAssetStats returns the daily CDN views of an asset over the last
+// days query parameter days
+func (h *Handler) handleAssetStats(w http.ResponseWriter, r *http.Request, key string) {
+	days := defaultStatsDays
+	if v := r.URL.Query().Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxStatsDays {
+			problem.Error(w, r, fmt.Sprintf("Invalid days, expected 1 to %d", maxStatsDays), http.StatusBadRequest)
+			return
+		}
+		days = n
+	}
+
+	stats, err := h.service.Stats(r.Context(), key, days)
+	if errors.Is(err, db.ErrNotFound) {
+		problem.Error(w, r, "Asset not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		h.logger.Error().Err(err).Str("key", key).Msg("failed to get asset stats")
+		problem.Error(w, r, "Failed to get asset stats", http.StatusInternalServerError)
+		return
+	}
+
+	h.writeJSONResponse(w, stats)
+}
+
+// HandleIngestLogs records asset views from a batch of Cloudflare Logpush
+// HTTP request logs, gzipped or not
+func (h *Handler) HandleIngestLogs(w http.ResponseWriter, r *http.Request) {
+	var body io.Reader = http.MaxBytesReader(w, r.Body, maxLogBatchBytes)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			problem.Error(w, r, "Invalid gzip body", http.StatusBadRequest)
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	views, err := analytics.ParseLogpush(body)
+	if err != nil {
+		problem.Error(w, r, fmt.Sprintf("Invalid logs: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := h.service.RecordViews(r.Context(), views); err != nil {
+		h.logger.Error().Err(err).Msg("failed to record asset views")
+		problem.Error(w, r, "Failed to record views", http.StatusInternalServerError)
+		return
+	}
+
+	h.logger.Info().Int("assets", len(views)).Msg("ingested CDN logs")
+	h.writeJSONResponse(w, map[string]interface{}{"recorded": len(views)})
+}
+
+// HandleDeleteAsset deletes an asset uploaded by the requesting user, or by
+// anyone if they're an admin
+func (h *Handler) HandleDeleteAsset(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "*")
+	if key == "" {
+		problem.Error(w, r, "Asset ID required", http.StatusBadRequest)
 		return
 	}
 
-	// For now, just return a simple response
-	// In a full implementation, you'd look up the asset metadata from storage
-	h.writeJSONResponse(w, map[string]string{
-		"message": "Asset metadata endpoint - not fully implemented",
-		"id":      key,
+	err := h.service.DeleteAsset(r.Context(), key, h.isAdmin(r))
+	switch {
+	case errors.Is(err, db.ErrNotFound):
+		problem.Error(w, r, "Asset not found", http.StatusNotFound)
+	case errors.Is(err, ErrForbidden):
+		problem.Error(w, r, "You can only delete assets you uploaded", http.StatusForbidden)
+	case err != nil:
+		h.logger.Error().Err(err).Str("key", key).Msg("failed to delete asset")
+		problem.Error(w, r, "Failed to delete asset", http.StatusInternalServerError)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// maxBulkDeleteKeys bounds the keys of one bulk delete
+const maxBulkDeleteKeys = 1000
+
+// HandleBulkDelete deletes many assets for admins, batching their storage
+// deletes. It reports the deleted keys and why the others weren't.
+func (h *Handler) HandleBulkDelete(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 1_000_000)
+	var req struct {
+		Keys []string `json:"keys"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Keys) == 0 {
+		problem.Error(w, r, "Invalid request body, expected {\"keys\": [...]}", http.StatusBadRequest)
+		return
+	}
+	if len(req.Keys) > maxBulkDeleteKeys {
+		problem.Error(w, r, fmt.Sprintf("At most %d keys per request", maxBulkDeleteKeys), http.StatusBadRequest)
+		return
+	}
+
+	failed := h.service.DeleteAssets(r.Context(), req.Keys, true)
+	resp := struct {
+		Deleted []string          `json:"deleted"`
+		Failed  map[string]string `json:"failed"`
+	}{Deleted: []string{}, Failed: make(map[string]string)}
+	for _, key := range req.Keys {
+		err, ok := failed[key]
+		switch {
+		case !ok:
+			resp.Deleted = append(resp.Deleted, key)
+		case errors.Is(err, db.ErrNotFound):
+			resp.Failed[key] = "not found"
+		default:
+			h.logger.Error().Err(err).Str("key", key).Msg("failed to delete asset")
+			resp.Failed[key] = "failed to delete"
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// isAdmin reports whether the requesting user is one of the admins. Services
+// never are.
+func (h *Handler) isAdmin(r *http.Request) bool {
+	user := h.getUserFromSession(r)
+	if user == nil || user.Provider == auth.ProviderService {
+		return false
+	}
+	for _, admin := range h.admins {
+		if strings.EqualFold(admin, user.Email) {
+			return true
+		}
+	}
+	return false
+}
+
+// HandleListAssets lists recorded assets, newest first, filtered by the
+// uploader (an email, or "me"), namespace and since (RFC 3339) query
+// parameters and paginated with cursor and limit
+func (h *Handler) HandleListAssets(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := db.AssetFilter{
+		Uploader:  query.Get("uploader"),
+		Namespace: query.Get("namespace"),
+		Cursor:    query.Get("cursor"),
+	}
+	// Users only see their own uploads, admins anyone's
+	user := uploaderFromContext(r.Context())
+	if filter.Uploader == "me" {
+		filter.Uploader = user
+	}
+	if !h.isAdmin(r) {
+		if user == "" || (filter.Uploader != "" && !strings.EqualFold(filter.Uploader, user)) {
+			problem.Error(w, r, "You can only list your own assets", http.StatusForbidden)
+			return
+		}
+		filter.Uploader = user
+	}
+	if v := query.Get("since"); v != "" {
+		since, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			problem.Error(w, r, "Invalid since, expected an RFC 3339 timestamp", http.StatusBadRequest)
+			return
+		}
+		filter.Since = since
+	}
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > db.MaxListLimit {
+			problem.Error(w, r, fmt.Sprintf("Invalid limit, expected 1 to %d", db.MaxListLimit), http.StatusBadRequest)
+			return
+		}
+		filter.Limit = limit
+	}
+
+	assets, next, err := h.service.ListAssets(r.Context(), filter)
+	if errors.Is(err, db.ErrInvalidCursor) {
+		problem.Error(w, r, "Invalid cursor", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		h.logger.Error().Err(err).Msg("failed to list assets")
+		problem.Error(w, r, "Failed to list assets", http.StatusInternalServerError)
+		return
+	}
+
+	h.writeJSONResponse(w, AssetList{
+		Assets:     assets,
+		NextCursor: next,
 	})
 }
 
+// HandleAuditLog lists the upload audit log for admins, newest first,
+// filtered by the key, user, ip and since (RFC 3339) query parameters and
+// paginated with cursor and limit
+func (h *Handler) HandleAuditLog(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := db.AuditFilter{
+		Key:    query.Get("key"),
+		User:   query.Get("user"),
+		IP:     query.Get("ip"),
+		Cursor: query.Get("cursor"),
+	}
+	if v := query.Get("since"); v != "" {
+		since, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			problem.Error(w, r, "Invalid since, expected an RFC 3339 timestamp", http.StatusBadRequest)
+			return
+		}
+		filter.Since = since
+	}
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > db.MaxListLimit {
+			problem.Error(w, r, fmt.Sprintf("Invalid limit, expected 1 to %d", db.MaxListLimit), http.StatusBadRequest)
+			return
+		}
+		filter.Limit = limit
+	}
+
+	entries, next, err := h.service.ListAuditEntries(r.Context(), filter)
+	if errors.Is(err, db.ErrInvalidCursor) {
+		problem.Error(w, r, "Invalid cursor", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		h.logger.Error().Err(err).Msg("failed to list audit entries")
+		problem.Error(w, r, "Failed to list audit entries", http.StatusInternalServerError)
+		return
+	}
+
+	h.writeJSONResponse(w, map[string]interface{}{
+		"entries":     entries,
+		"next_cursor": next,
+	})
+}
+
+// HandleSetAlias points the alias in the URL at the asset {"key"}
+func (h *Handler) HandleSetAlias(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Key string `json:"key"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil || req.Key == "" {
+		problem.Error(w, r, "Invalid JSON, expected {\"key\"}", http.StatusBadRequest)
+		return
+	}
+
+	alias, err := h.service.SetAlias(r.Context(), chi.URLParam(r, "alias"), req.Key, h.isAdmin(r))
+	switch {
+	case errors.Is(err, ErrInvalidAlias):
+		problem.Invalid(w, r, err)
+	case errors.Is(err, db.ErrNotFound):
+		problem.Error(w, r, "Asset not found", http.StatusNotFound)
+	case errors.Is(err, ErrForbidden):
+		problem.Error(w, r, "Alias belongs to someone else", http.StatusForbidden)
+	case err != nil:
+		h.logger.Error().Err(err).Msg("failed to set alias")
+		problem.Error(w, r, "Failed to set alias", http.StatusInternalServerError)
+	default:
+		h.writeJSONResponse(w, alias)
+	}
+}
+
+// HandleGetAlias returns an alias and the key it points at
+func (h *Handler) HandleGetAlias(w http.ResponseWriter, r *http.Request) {
+	alias, err := h.service.GetAlias(r.Context(), chi.URLParam(r, "alias"))
+	if errors.Is(err, db.ErrNotFound) {
+		problem.Error(w, r, "Alias not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		h.logger.Error().Err(err).Msg("failed to get alias")
+		problem.Error(w, r, "Failed to get alias", http.StatusInternalServerError)
+		return
+	}
+	h.writeJSONResponse(w, alias)
+}
+
+// HandleDeleteAlias removes an alias, leaving its asset
+func (h *Handler) HandleDeleteAlias(w http.ResponseWriter, r *http.Request) {
+	err := h.service.DeleteAlias(r.Context(), chi.URLParam(r, "alias"), h.isAdmin(r))
+	switch {
+	case errors.Is(err, db.ErrNotFound):
+		problem.Error(w, r, "Alias not found", http.StatusNotFound)
+	case errors.Is(err, ErrForbidden):
+		problem.Error(w, r, "Alias belongs to someone else", http.StatusForbidden)
+	case err != nil:
+		h.logger.Error().Err(err).Msg("failed to delete alias")
+		problem.Error(w, r, "Failed to delete alias", http.StatusInternalServerError)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// HandleResolveAlias redirects an alias to its asset. It's public so alias
+// URLs can be used in emails, and only briefly cached as aliases can move.
+func (h *Handler) HandleResolveAlias(w http.ResponseWriter, r *http.Request) {
+	target, err := h.service.ResolveAlias(r.Context(), chi.URLParam(r, "alias"))
+	if errors.Is(err, db.ErrNotFound) {
+		problem.Error(w, r, "Alias not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		h.logger.Error().Err(err).Msg("failed to resolve alias")
+		problem.Error(w, r, "Failed to resolve alias", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// HandleResize serves an asset resized according to the w, h and fit query
+// parameters. It's public so the URLs can be used in emails, and only
+// renders the configured sizes unless the URL is signed for its size.
+func (h *Handler) HandleResize(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "*")
+	width, height, fit, err := parseSize(r.URL.Query())
+	if err != nil {
+		problem.Invalid(w, r, err)
+		return
+	}
+	if width == 0 && height == 0 {
+		problem.Error(w, r, "Either 'w' or 'h' must be provided", http.StatusBadRequest)
+		return
+	}
+	cacheControl, ok := h.checkSize(w, r, key, width, height, fit)
+	if !ok {
+		return
+	}
+
+	data, contentType, err := h.service.Resized(r.Context(), key, width, height, fit)
+	if errors.Is(err, storage.ErrObjectNotFound) {
+		problem.Error(w, r, "Asset not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		h.logger.Error().Err(err).Str("key", key).Msg("failed to resize asset")
+		problem.Error(w, r, fmt.Sprintf("Failed to resize image: %v", err), http.StatusUnprocessableEntity)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", cacheControl)
+	w.Write(data)
+}
+
+// HandleImage serves an asset from storage for deployments that don't expose
+// the bucket publicly. With w or h it's resized like HandleResize, at the
+// same sizes, and JPEGs and PNGs are served as WebP to clients accepting it.
+// Renders are cached in storage.
+func (h *Handler) HandleImage(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "*")
+	width, height, fit, err := parseSize(r.URL.Query())
+	if err != nil {
+		problem.Invalid(w, r, err)
+		return
+	}
+
+	cacheControl, ok := h.checkSize(w, r, key, width, height, fit)
+	if !ok {
+		return
+	}
+
+	var format string
+	switch path.Ext(key) {
+	case ".jpg", ".png":
+		w.Header().Set("Vary", "Accept")
+		if strings.Contains(r.Header.Get("Accept"), "image/webp") {
+			format = imageproc.FormatWebP
+		}
+	}
+
+	if width == 0 && height == 0 && format == "" {
+		object, err := h.service.OpenAsset(r.Context(), key)
+		if errors.Is(err, storage.ErrObjectNotFound) {
+			problem.Error(w, r, "Asset not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			h.logger.Error().Err(err).Str("key", key).Msg("failed to open asset")
+			problem.Error(w, r, "Failed to get asset", http.StatusInternalServerError)
+			return
+		}
+		defer object.Body.Close()
+
+		// Unsigned URLs are cached as long as the object was uploaded for
+		if cacheControl == immutableCacheControl && object.CacheControl != "" {
+			cacheControl = object.CacheControl
+		}
+		if object.ETag != "" {
+			w.Header().Set("ETag", object.ETag)
+			if r.Header.Get("If-None-Match") == object.ETag {
+				w.Header().Set("Cache-Control", cacheControl)
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+		// Served as stored, so a sanitized SVG is still kept from running
+		// anything on this origin
+		w.Header().Set("Content-Type", object.ContentType)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Content-Security-Policy", "sandbox")
+		w.Header().Set("Cache-Control", cacheControl)
+		if object.ContentDisposition != "" {
+			w.Header().Set("Content-Disposition", object.ContentDisposition)
+		}
+		if object.Size > 0 {
+			w.Header().Set("Content-Length", strconv.FormatInt(object.Size, 10))
+		}
+		io.Copy(w, object.Body)
+		return
+	}
+
+	data, contentType, err := h.service.Rendered(r.Context(), key, width, height, fit, format)
+	if errors.Is(err, storage.ErrObjectNotFound) {
+		problem.Error(w, r, "Asset not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		h.logger.Error().Err(err).Str("key", key).Msg("failed to render asset")
+		problem.Error(w, r, fmt.Sprintf("Failed to render image: %v", err), http.StatusUnprocessableEntity)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", cacheControl)
+	w.Write(data)
+}
+
+// immutableCacheControl caches a content-addressed asset for good
+const immutableCacheControl = "public, max-age=31536000, immutable"
+
+// checkSignature rejects requests for key without a valid signed URL when
+// signed URLs are on. It returns the Cache-Control of the response: keys are
+// content-addressed, so a given URL always serves the same, but not after it
+// expires.
+func (h *Handler) checkSignature(w http.ResponseWriter, r *http.Request, key string) (string, bool) {
+	expiry, err := h.service.CheckSignature(key, r.URL.Query())
+	return signedCacheControl(w, r, expiry, err)
+}
+
+// checkSize is checkSignature for renders of key at a size. Sizes other
+// than the configured ones need a URL signed for the size, so that public
+// URLs can't render and store any number of variants.
+func (h *Handler) checkSize(w http.ResponseWriter, r *http.Request, key string, width, height int, fit string) (string, bool) {
+	if h.allowedSize(width) && h.allowedSize(height) {
+		return h.checkSignature(w, r, key)
+	}
+	expiry, err := h.service.CheckSizeSignature(key, width, height, fit, r.URL.Query())
+	if errors.Is(err, ErrSizeNotAllowed) {
+		problem.Error(w, r, fmt.Sprintf("Size not allowed, w and h must be one of %s", joinInts(h.sizes)), http.StatusBadRequest)
+		return "", false
+	}
+	return signedCacheControl(w, r, expiry, err)
+}
+
+// allowedSize reports whether a width or height, 0 when missing, is
+// rendered without a signed URL
+func (h *Handler) allowedSize(n int) bool {
+	return n == 0 || slices.Contains(h.sizes, n)
+}
+
+// signedCacheControl rejects a request whose signature didn't verify and
+// returns the Cache-Control of the response otherwise
+func signedCacheControl(w http.ResponseWriter, r *http.Request, expiry time.Time, err error) (string, bool) {
+	if err != nil {
+		problem.Error(w, r, fmt.Sprintf("Forbidden: %v", err), http.StatusForbidden)
+		return "", false
+	}
+	if expiry.IsZero() {
+		return immutableCacheControl, true
+	}
+	return fmt.Sprintf("public, max-age=%d", int(time.Until(expiry).Seconds())), true
+}
+
+func joinInts(values []int) string {
+	strs := make([]string, len(values))
+	for i, v := range values {
+		strs[i] = strconv.Itoa(v)
+	}
+	return strings.Join(strs, ", ")
+}
+
+// parseSize reads the w, h and fit query parameters of resized images, 0 for
+// missing dimensions
+func parseSize(query url.Values) (int, int, string, error) {
+	var width, height int
+	for _, dim := range []struct {
+		name  string
+		value *int
+	}{{"w", &width}, {"h", &height}} {
+		v := query.Get(dim.name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return 0, 0, "", fmt.Errorf("Invalid %s", dim.name)
+		}
+		*dim.value = n
+	}
+	fit := query.Get("fit")
+	if !imageproc.IsValidFit(fit) {
+		return 0, 0, "", fmt.Errorf("Invalid fit, expected contain, cover or fill")
+	}
+	return width, height, fit, nil
+}
+
 func (h *Handler) writeJSONResponse(w http.ResponseWriter, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(data); err != nil {
@@ -161,13 +1108,6 @@ func (h *Handler) writeJSONResponse(w http.ResponseWriter, data interface{}) {
 	}
 }
 
-// Middleware for rate limiting (simple in-memory implementation)
-func (h *Handler) RateLimit(next http.Handler) http.Handler {
-	// This is a placeholder for rate limiting
-	// In production, you'd use a proper rate limiter like golang.org/x/time/rate
-	return next
-}
-
 // getUserFromSession is a helper to get user from session
 func (h *Handler) getUserFromSession(r *http.Request) *session.User {
 	ctx := r.Context()
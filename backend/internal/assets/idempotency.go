@@ -0,0 +1,178 @@
+package assets
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hackclub/format/internal/db"
+	"github.com/hackclub/format/internal/problem"
+)
+
+// idempotencyWindow is how long the response to a request with an
+// Idempotency-Key is replayed to retries
+const idempotencyWindow = 24 * time.Hour
+
+// maxIdempotencyKeyLength bounds Idempotency-Key headers, UUIDs fit easily
+const maxIdempotencyKeyLength = 255
+
+// keyLocks serializes requests per idempotency key, so a retry sent while
+// the original is still processing waits for its response instead of
+// processing again. It only covers this process.
+type keyLocks struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// lock locks key and returns the function unlocking it
+func (l *keyLocks) lock(key string) func() {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*keyLock)
+	}
+	kl, ok := l.locks[key]
+	if !ok {
+		kl = &keyLock{}
+		l.locks[key] = kl
+	}
+	kl.refs++
+	l.mu.Unlock()
+
+	kl.mu.Lock()
+	return func() {
+		kl.mu.Unlock()
+		l.mu.Lock()
+		if kl.refs--; kl.refs == 0 {
+			delete(l.locks, key)
+		}
+		l.mu.Unlock()
+	}
+}
+
+// responseRecorder passes a response through while keeping a copy
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+type idempotentRequestKey struct{}
+
+// idempotentRequest is what a handler behind Idempotent tells it about its
+// response
+type idempotentRequest struct {
+	partial bool
+}
+
+// skipReplay keeps the response to ctx's request from being replayed to
+// retries although it's successful, for batches with failed items a retry
+// should process again
+func skipReplay(ctx context.Context) {
+	if req, ok := ctx.Value(idempotentRequestKey{}).(*idempotentRequest); ok {
+		req.partial = true
+	}
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(data []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	r.body.Write(data)
+	return r.ResponseWriter.Write(data)
+}
+
+// Idempotent replays the response to an earlier request of the signed-in
+// user with the same Idempotency-Key header, made within idempotencyWindow,
+// instead of fetching and processing again. Only successful responses are
+// stored, failed requests and batches with failed items can be retried
+// with the same key. A key reused on
+// another endpoint is rejected with 422; the request bodies aren't compared
+// since multipart boundaries differ between retries.
+func (h *Handler) Idempotent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			problem.Error(w, r, "Idempotency-Key is too long", http.StatusBadRequest)
+			return
+		}
+
+		ctx := r.Context()
+		owner := uploaderFromContext(ctx)
+		fingerprint := r.Method + " " + r.URL.Path
+		unlock := h.idempotencyLocks.lock(owner + "\n" + key)
+		defer unlock()
+
+		stored, err := h.service.GetIdempotentResponse(ctx, owner, key)
+		if err != nil && !errors.Is(err, db.ErrNotFound) {
+			h.logger.Error().Err(err).Msg("failed to look up idempotency key")
+			problem.Error(w, r, "Failed to look up Idempotency-Key", http.StatusInternalServerError)
+			return
+		}
+		if stored != nil {
+			if stored.Fingerprint != fingerprint {
+				problem.Error(w, r, "Idempotency-Key was already used for another request", http.StatusUnprocessableEntity)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(stored.Status)
+			w.Write(stored.Body)
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: w}
+		state := &idempotentRequest{}
+		next.ServeHTTP(recorder, r.WithContext(context.WithValue(ctx, idempotentRequestKey{}, state)))
+		if recorder.status < 200 || recorder.status >= 300 || state.partial {
+			return
+		}
+		if err := h.service.SaveIdempotentResponse(ctx, &db.IdempotentResponse{
+			Owner:       owner,
+			Key:         key,
+			Fingerprint: fingerprint,
+			Status:      recorder.status,
+			Body:        recorder.body.Bytes(),
+		}); err != nil {
+			// Retries are processed again, which is only wasteful
+			h.logger.Error().Err(err).Msg("failed to store idempotent response")
+		}
+	})
+}
+
+// GetIdempotentResponse returns the response stored for the user's key
+// within idempotencyWindow, db.ErrNotFound if there's none
+func (s *Service) GetIdempotentResponse(ctx context.Context, owner, key string) (*db.IdempotentResponse, error) {
+	return s.db.GetIdempotentResponse(ctx, owner, key, time.Now().Add(-idempotencyWindow))
+}
+
+// SaveIdempotentResponse stores the response to a request with an
+// Idempotency-Key
+func (s *Service) SaveIdempotentResponse(ctx context.Context, r *db.IdempotentResponse) error {
+	return s.db.SaveIdempotentResponse(ctx, r)
+}
+
+// purgeIdempotentResponses deletes responses past idempotencyWindow
+func (s *Service) purgeIdempotentResponses(ctx context.Context) {
+	if _, err := s.db.DeleteIdempotentResponses(ctx, time.Now().Add(-idempotencyWindow)); err != nil {
+		s.logger.Error().Err(err).Msg("failed to purge idempotency keys")
+	}
+}
@@ -0,0 +1,231 @@
+package assets
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"mime"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/hackclub/format/internal/imageproc"
+)
+
+// maxPageImages bounds how many images of a page are rehosted
+const maxPageImages = 50
+
+var (
+	pageImageTagRegex  = regexp.MustCompile(`(?i)<(?:img|source)\s[^>]*>`)
+	pageImageAttrRegex = regexp.MustCompile(`(?i)\s(data-srcset|data-src|srcset|src)=["']([^"']+)["']`)
+	pageMetaRegex      = regexp.MustCompile(`(?i)<meta\s[^>]*(?:property|name)=["'](?:og:image|twitter:image)["'][^>]*>`)
+	pageContentRegex   = regexp.MustCompile(`(?i)\scontent=["']([^"']+)["']`)
+	pageBaseRegex      = regexp.MustCompile(`(?i)<base\s[^>]*href=["']([^"']+)["']`)
+)
+
+// pageImageAttrs are the attributes an img or source tag's image is taken
+// from, first one set first. Lazy-loading scripts keep the real image in the
+// data- attributes and a placeholder in src or srcset.
+var pageImageAttrs = []string{"data-srcset", "data-src", "srcset", "src"}
+
+// PageImage is the outcome of rehosting one image found on a page
+type PageImage struct {
+	URL   string `json:"url"`
+	Asset *Asset `json:"asset,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// PageResult lists the images of a page with their rehosted assets
+type PageResult struct {
+	PageURL string       `json:"page_url"`
+	Images  []*PageImage `json:"images"`
+	// Mapping maps the original image URLs to their rehosted URLs
+	Mapping map[string]string `json:"mapping"`
+	// Truncated is set when the page had more than maxPageImages images
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// ProcessFromPage fetches a public web page, extracts its images and rehosts
+// them like a batch, for turning an article into an email
+func (s *Service) ProcessFromPage(ctx context.Context, pageURL string, opts imageproc.ProcessOptions) (*PageResult, error) {
+	s.logger.Info().Str("url", pageURL).Msg("rehosting images of page")
+
+	body, contentType, err := s.fetcher.FetchURL(ctx, pageURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch page: %v", err)
+	}
+	if mediaType, _, _ := mime.ParseMediaType(contentType); mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return nil, fmt.Errorf("not an HTML page: %s", contentType)
+	}
+	base, err := url.Parse(pageURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL: %v", err)
+	}
+
+	result := &PageResult{PageURL: pageURL, Images: []*PageImage{}, Mapping: map[string]string{}}
+	imageURLs := extractPageImages(string(body), base)
+	if len(imageURLs) > maxPageImages {
+		imageURLs = imageURLs[:maxPageImages]
+		result.Truncated = true
+	}
+
+	inputs := make([]BatchInput, len(imageURLs))
+	for i, imageURL := range imageURLs {
+		inputs[i] = BatchInput{URL: imageURL, ProcessOptions: opts}
+	}
+	for i, batchResult := range s.ProcessBatch(ctx, inputs) {
+		image := &PageImage{URL: imageURLs[i], Asset: batchResult.Asset, Error: batchResult.Error}
+		if image.Asset != nil {
+			result.Mapping[image.URL] = image.Asset.URL
+		}
+		result.Images = append(result.Images, image)
+	}
+	return result, nil
+}
+
+// extractPageImages returns the absolute URLs of the images of a page in
+// order of appearance, without duplicates: one per img and picture source
+// (the lazy-loaded image over its placeholder, the largest srcset
+// candidate) and the og:image/twitter:image previews
+func extractPageImages(page string, base *url.URL) []string {
+	if match := pageBaseRegex.FindStringSubmatch(page); match != nil {
+		if href, err := base.Parse(html.UnescapeString(match[1])); err == nil {
+			base = href
+		}
+	}
+
+	var candidates []string
+	for _, tag := range pageImageTagRegex.FindAllString(page, -1) {
+		attrs := map[string]string{}
+		for _, match := range pageImageAttrRegex.FindAllStringSubmatch(tag, -1) {
+			attrs[strings.ToLower(match[1])] = match[2]
+		}
+		for _, name := range pageImageAttrs {
+			src := attrs[name]
+			if strings.HasSuffix(name, "srcset") {
+				src = largestSrcsetCandidate(src)
+			}
+			// Inline placeholders don't count, the next attribute may have the image
+			if src != "" && !strings.HasPrefix(strings.ToLower(strings.TrimSpace(src)), "data:") {
+				candidates = append(candidates, src)
+				break
+			}
+		}
+	}
+	for _, tag := range pageMetaRegex.FindAllString(page, -1) {
+		if match := pageContentRegex.FindStringSubmatch(tag); match != nil {
+			candidates = append(candidates, match[1])
+		}
+	}
+
+	seen := map[string]bool{}
+	var images []string
+	for _, candidate := range candidates {
+		u, err := base.Parse(strings.TrimSpace(html.UnescapeString(candidate)))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			continue // data URIs, placeholders and the like
+		}
+		u.Fragment = ""
+		if abs := u.String(); !seen[abs] {
+			seen[abs] = true
+			images = append(images, abs)
+		}
+	}
+	return images
+}
+
+// largestSrcsetCandidate returns the URL of the srcset candidate with the
+// largest width or density descriptor
+func largestSrcsetCandidate(srcset string) string {
+	best, bestSize := "", -1.0
+	for _, candidate := range parseSrcset(srcset) {
+		size := 1.0 // a candidate without descriptors is 1x
+		for _, descriptor := range candidate.descriptors {
+			if unit := descriptor[len(descriptor)-1]; unit == 'w' || unit == 'x' {
+				if n, err := strconv.ParseFloat(descriptor[:len(descriptor)-1], 64); err == nil {
+					size = n
+				}
+			}
+		}
+		if size > bestSize {
+			best, bestSize = candidate.url, size
+		}
+	}
+	return best
+}
+
+// srcsetCandidate is an image candidate of a srcset attribute
+type srcsetCandidate struct {
+	url         string
+	descriptors []string
+}
+
+// parseSrcset splits a srcset attribute into its candidates the way the
+// HTML standard does: a URL runs to the next whitespace, so CDN URLs with
+// commas in them stay whole, and only a comma at the end of a URL or after
+// its descriptors, outside parentheses, separates candidates
+func parseSrcset(srcset string) []srcsetCandidate {
+	var candidates []srcsetCandidate
+	pos := 0
+	for {
+		for pos < len(srcset) && (isHTMLSpace(srcset[pos]) || srcset[pos] == ',') {
+			pos++
+		}
+		if pos == len(srcset) {
+			return candidates
+		}
+		start := pos
+		for pos < len(srcset) && !isHTMLSpace(srcset[pos]) {
+			pos++
+		}
+		candidate := srcsetCandidate{url: srcset[start:pos]}
+		if strings.HasSuffix(candidate.url, ",") {
+			candidate.url = strings.TrimRight(candidate.url, ",")
+		} else {
+			candidate.descriptors, pos = parseSrcsetDescriptors(srcset, pos)
+		}
+		if candidate.url != "" {
+			candidates = append(candidates, candidate)
+		}
+	}
+}
+
+// parseSrcsetDescriptors reads the descriptors following a srcset URL at
+// pos, returning them and the position after the comma ending the candidate
+func parseSrcsetDescriptors(srcset string, pos int) ([]string, int) {
+	var descriptors []string
+	var current strings.Builder
+	flush := func() {
+		if current.Len() > 0 {
+			descriptors = append(descriptors, current.String())
+			current.Reset()
+		}
+	}
+	inParens := false
+	for ; pos < len(srcset); pos++ {
+		c := srcset[pos]
+		switch {
+		case inParens:
+			current.WriteByte(c)
+			inParens = c != ')'
+		case c == '(':
+			current.WriteByte(c)
+			inParens = true
+		case c == ',':
+			flush()
+			return descriptors, pos + 1
+		case isHTMLSpace(c):
+			flush()
+		default:
+			current.WriteByte(c)
+		}
+	}
+	flush()
+	return descriptors, pos
+}
+
+// isHTMLSpace reports whether c is ASCII whitespace as HTML defines it
+func isHTMLSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\f' || c == '\r'
+}
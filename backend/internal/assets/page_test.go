@@ -0,0 +1,60 @@
+package assets
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestExtractPageImages(t *testing.T) {
+	page := `<html><head>
+<meta property="og:image" content="https://cdn.example.com/cover.jpg">
+</head><body>
+<img src="/images/a.png" alt="a">
+<img src="data:image/gif;base64,R0lGOD" data-src="lazy.jpg">
+<picture><source srcset="b-400.webp 400w, b-1200.webp 1200w"><img src="b.jpg"></picture>
+<img srcset="c.png 1x, c@2x.png 2x">
+<img src="/spinner.gif" data-src="/images/real.jpg" class="lazyload">
+<img src="placeholder.svg" data-srcset="https://res.example.com/w_400,c_fill/d.jpg 400w,https://res.example.com/w_800,c_fill/d.jpg 800w">
+<img src="/images/a.png?x=1&amp;y=2">
+<img src="/images/a.png">
+</body></html>`
+	base, _ := url.Parse("https://blog.example.com/posts/hello")
+
+	got := extractPageImages(page, base)
+	want := []string{
+		"https://blog.example.com/images/a.png",
+		"https://blog.example.com/posts/lazy.jpg",
+		"https://blog.example.com/posts/b-1200.webp",
+		"https://blog.example.com/posts/b.jpg",
+		"https://blog.example.com/posts/c@2x.png",
+		"https://blog.example.com/images/real.jpg",
+		"https://res.example.com/w_800,c_fill/d.jpg",
+		"https://blog.example.com/images/a.png?x=1&y=2",
+		"https://cdn.example.com/cover.jpg",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("extractPageImages() =\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestLargestSrcsetCandidate(t *testing.T) {
+	tests := []struct {
+		srcset, want string
+	}{
+		{"a.jpg", "a.jpg"},
+		{"a.jpg 1x, b.jpg 2x", "b.jpg"},
+		{"a.jpg 2x,b.jpg 1x", "a.jpg"},
+		// CDN URLs with commas in their path stay whole
+		{"https://cdn.example.com/w_400,h_300/a.jpg 400w, https://cdn.example.com/w_1200,h_900/a.jpg 1200w", "https://cdn.example.com/w_1200,h_900/a.jpg"},
+		{"a.jpg,b.jpg 3x", "a.jpg,b.jpg"},
+		{"a.jpg, b.jpg 3x", "b.jpg"},
+		{"  ,a.jpg 100w (extra, stuff), b.jpg 50w", "a.jpg"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := largestSrcsetCandidate(tt.srcset); got != tt.want {
+			t.Errorf("largestSrcsetCandidate(%q) = %q, want %q", tt.srcset, got, tt.want)
+		}
+	}
+}
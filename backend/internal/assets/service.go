@@ -4,53 +4,133 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/url"
+	"path"
+	"slices"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/hackclub/format/internal/db"
+	"github.com/hackclub/format/internal/dedup"
 	"github.com/hackclub/format/internal/imageproc"
+	"github.com/hackclub/format/internal/malware"
+	"github.com/hackclub/format/internal/moderation"
+	"github.com/hackclub/format/internal/session"
+	"github.com/hackclub/format/internal/signedurl"
 	"github.com/hackclub/format/internal/storage"
 	"github.com/hackclub/format/internal/util"
+	"github.com/hackclub/format/internal/webhook"
 	"github.com/rs/zerolog"
 )
 
 type Service struct {
-	processor *imageproc.Processor
-	storage   *storage.R2Client
-	fetcher   *util.HTTPFetcher
-	logger    zerolog.Logger
+	processor  *imageproc.Processor
+	storage    storage.R2ClientInterface
+	// private holds retained originals and quarantined images, never served.
+	// It's nil when neither is kept.
+	private    storage.R2ClientInterface
+	db         *db.DB
+	notifier   *webhook.Notifier
+	malware    *malware.Scanner
+	moderation moderation.Policy
+	signer     *signedurl.Signer // nil when URLs are permanent
+	namespace  string // NamespaceUser, NamespaceTeam or empty for one shared namespace
+	// retainOriginals keeps the untouched upload of every asset under
+	// util.OriginalsPrefix in private
+	retainOriginals bool
+	dedup      dedup.Index // nil when every store checks storage
+	fetcher    *util.HTTPFetcher
+	logger     zerolog.Logger
 }
 
 type Asset struct {
-	URL         string `json:"url"`
-	MIME        string `json:"mime"`
-	Width       int    `json:"width"`
-	Height      int    `json:"height"`
-	Bytes       int    `json:"bytes"`
-	Hash        string `json:"hash"`
-	Deduped     bool   `json:"deduped"`
-	Key         string `json:"key,omitempty"`
+	URL           string `json:"url"`
+	MIME          string `json:"mime"`
+	Width         int    `json:"width"`
+	Height        int    `json:"height"`
+	Bytes         int    `json:"bytes"`
+	OriginalBytes int    `json:"original_bytes"`
+	Frames        int    `json:"frames,omitempty"`
+	Hash          string `json:"hash"`
+	Deduped       bool   `json:"deduped"`
+	Key           string `json:"key,omitempty"`
+	BlurHash      string `json:"blurhash,omitempty"`
+	// Filename is what a document is downloaded as, empty for images
+	Filename string `json:"filename,omitempty"`
+	// Capture is the upload's camera, capture time, format and color space,
+	// read before metadata was stripped
+	Capture *imageproc.CaptureMetadata `json:"capture,omitempty"`
+	// ExpiresAt is when the asset gets deleted, for uploads with a TTL
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// Variants maps variant names to their renders, when requested
+	Variants map[string]*Variant `json:"variants,omitempty"`
+}
+
+type Variant struct {
+	URL    string `json:"url"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Bytes  int    `json:"bytes"`
+	Key    string `json:"key"`
+}
+
+// Key namespacing modes
+const (
+	NamespaceUser = "user" // keys are prefixed per uploader, with a random ID
+	NamespaceTeam = "team" // keys are prefixed per Google Workspace domain
+)
+
+// IsValidNamespace reports whether mode is a namespacing mode, or empty for
+// none
+func IsValidNamespace(mode string) bool {
+	return mode == "" || mode == NamespaceUser || mode == NamespaceTeam
 }
 
 type ProcessInput struct {
 	Data        []byte
 	ContentType string
 	SourceURL   string
+	Options     imageproc.ProcessOptions
 }
 
-func NewService(processor *imageproc.Processor, storage *storage.R2Client, logger zerolog.Logger) *Service {
+func NewService(processor *imageproc.Processor, storage, private storage.R2ClientInterface, db *db.DB, notifier *webhook.Notifier, malware *malware.Scanner, moderation moderation.Policy, signer *signedurl.Signer, namespace string, retainOriginals bool, dedup dedup.Index, logger zerolog.Logger) *Service {
 	return &Service{
-		processor: processor,
-		storage:   storage,
-		fetcher:   util.NewHTTPFetcher(),
-		logger:    logger,
+		processor:  processor,
+		storage:    storage,
+		private:    private,
+		db:         db,
+		notifier:   notifier,
+		malware:    malware,
+		moderation: moderation,
+		signer:     signer,
+		namespace:  namespace,
+		retainOriginals: retainOriginals,
+		dedup:      dedup,
+		fetcher:    util.NewHTTPFetcher(),
+		logger:     logger,
 	}
 }
 
 // ProcessFromURL processes an image from a URL
-func (s *Service) ProcessFromURL(ctx context.Context, imageURL string) (*Asset, error) {
+func (s *Service) ProcessFromURL(ctx context.Context, imageURL string, opts imageproc.ProcessOptions) (*Asset, error) {
 	s.logger.Info().Str("url", imageURL).Msg("processing image from URL")
 
+	// A URL processed recently with the same options isn't fetched again.
+	// What it serves may change, so older records are fetched again, and
+	// the bytes looked up in the source index.
+	namespace, err := s.namespaceFor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if asset := s.lookupSource(ctx, urlSource(namespace, imageURL, opts), time.Now().Add(-urlSourceTTL), opts); asset != nil {
+		s.audit(ctx, asset, imageURL)
+		return asset, nil
+	}
+
 	// Fetch the image
 	data, contentType, err := s.fetcher.FetchURL(ctx, imageURL)
 	if err != nil {
@@ -61,11 +141,12 @@ func (s *Service) ProcessFromURL(ctx context.Context, imageURL string) (*Asset,
 		Data:        data,
 		ContentType: contentType,
 		SourceURL:   imageURL,
+		Options:     opts,
 	})
 }
 
 // ProcessFromDataURI processes an image from a data URI
-func (s *Service) ProcessFromDataURI(ctx context.Context, dataURI string) (*Asset, error) {
+func (s *Service) ProcessFromDataURI(ctx context.Context, dataURI string, opts imageproc.ProcessOptions) (*Asset, error) {
 	s.logger.Info().Str("dataURI", dataURI[:min(100, len(dataURI))]).Msg("processing image from data URI")
 
 	// Parse data URI
@@ -77,103 +158,1119 @@ func (s *Service) ProcessFromDataURI(ctx context.Context, dataURI string) (*Asse
 	return s.ProcessFromData(ctx, &ProcessInput{
 		Data:        data,
 		ContentType: contentType,
-		SourceURL:   "data:",
+		SourceURL:   "data:" + contentType,
+		Options:     opts,
 	})
 }
 
 // ProcessFromData processes raw image data
 func (s *Service) ProcessFromData(ctx context.Context, input *ProcessInput) (*Asset, error) {
+	// The same bytes processed before with the same options aren't processed
+	// again
+	namespace, err := s.namespaceFor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	source := dataSource(namespace, input.Data, input.Options)
+	if asset := s.lookupSource(ctx, source, time.Time{}, input.Options); asset != nil {
+		s.audit(ctx, asset, input.SourceURL)
+		// A URL fetched again because its record went stale is trusted
+		// for another while
+		if isHTTPURL(input.SourceURL) {
+			s.saveSource(ctx, urlSource(namespace, input.SourceURL, input.Options), asset)
+		}
+		return asset, nil
+	}
+
 	// Process the image
-	result, err := s.processor.Process(input.Data, input.ContentType)
+	result, err := s.processor.Process(ctx, input.Data, input.ContentType, input.Options)
+	if err != nil {
+		return nil, fmt.Errorf("failed to process image: %v", err)
+	}
+
+	asset, err := s.saveResult(ctx, result, input.Data, input.Options, input.SourceURL)
+	if err != nil {
+		return nil, err
+	}
+
+	s.audit(ctx, asset, input.SourceURL)
+	s.saveSource(ctx, source, asset)
+	if isHTTPURL(input.SourceURL) {
+		s.saveSource(ctx, urlSource(namespace, input.SourceURL, input.Options), asset)
+	}
+	return asset, nil
+}
+
+// ErrNoOriginal is returned when reprocessing an asset whose original wasn't
+// retained
+var ErrNoOriginal = errors.New("asset has no retained original")
+
+// Reprocess runs the retained original of the asset at key through the
+// current pipeline with opts, for example after the quality was raised, and
+// uploads the result as a new asset. The old asset stays available at its
+// URL, later uploads of the same source get the new one. It returns
+// db.ErrNotFound for unknown assets and ErrNoOriginal when there's no
+// original to start from.
+func (s *Service) Reprocess(ctx context.Context, key string, opts imageproc.ProcessOptions) (*Asset, error) {
+	record, err := s.db.GetAsset(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	data, contentType, err := s.original(ctx, record)
+	if err != nil {
+		return nil, err
+	}
+
+	s.logger.Info().Str("key", key).Int("bytes", len(data)).Msg("reprocessing asset")
+	result, err := s.processor.Process(ctx, data, contentType, opts)
 	if err != nil {
 		return nil, fmt.Errorf("failed to process image: %v", err)
 	}
+	asset, err := s.saveResult(ctx, result, data, opts, record.SourceURL)
+	if err != nil {
+		return nil, err
+	}
+
+	s.audit(ctx, asset, record.SourceURL)
+	namespace, err := s.namespaceFor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.saveSource(ctx, dataSource(namespace, data, opts), asset)
+	if isHTTPURL(record.SourceURL) {
+		s.saveSource(ctx, urlSource(namespace, record.SourceURL, opts), asset)
+	}
+	return asset, nil
+}
+
+// original returns the retained original of an asset. The stored asset
+// isn't a substitute, processing it again would compound lossy encodings,
+// and neither is its source URL, which may serve another image by now.
+func (s *Service) original(ctx context.Context, record *db.Asset) ([]byte, string, error) {
+	if record.OriginalKey == "" || s.private == nil {
+		return nil, "", ErrNoOriginal
+	}
+	data, contentType, err := s.private.Download(ctx, record.OriginalKey)
+	if errors.Is(err, storage.ErrObjectNotFound) {
+		return nil, "", ErrNoOriginal
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to download original: %v", err)
+	}
+	return data, contentType, nil
+}
+
+// isHTTPURL reports whether source is a web URL rather than an upload
+func isHTTPURL(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+// dataSource identifies original bytes processed with opts in the source
+// index of namespace
+func dataSource(namespace string, data []byte, opts imageproc.ProcessOptions) string {
+	return fmt.Sprintf("%s/sha256:%x|%s", namespace, sha256.Sum256(data), optionsDigest(opts))
+}
+
+// urlSourceTTL is how long a URL's record in the source index is trusted
+// before the URL is fetched again
+const urlSourceTTL = 24 * time.Hour
+
+// urlSource identifies a URL processed with opts in the source index of
+// namespace
+func urlSource(namespace, imageURL string, opts imageproc.ProcessOptions) string {
+	return namespace + "/url:" + imageURL + "|" + optionsDigest(opts)
+}
+
+// optionsDigest fingerprints processing options, the same source processed
+// differently is a different asset
+func optionsDigest(opts imageproc.ProcessOptions) string {
+	encoded, _ := json.Marshal(opts)
+	return fmt.Sprintf("%x", sha256.Sum256(encoded))[:16]
+}
+
+// lookupSource returns the asset a source recorded since a time already
+// produced, nil if there's none or the lookup fails
+func (s *Service) lookupSource(ctx context.Context, source string, since time.Time, opts imageproc.ProcessOptions) *Asset {
+	key, encoded, err := s.db.LookupSource(ctx, source, since)
+	if err != nil {
+		if !errors.Is(err, db.ErrNotFound) {
+			s.logger.Error().Err(err).Msg("failed to look up source")
+		}
+		return nil
+	}
+
+	var asset Asset
+	if err := json.Unmarshal(encoded, &asset); err != nil {
+		s.logger.Error().Err(err).Str("key", key).Msg("failed to decode recorded asset")
+		return nil
+	}
+	asset.Deduped = true
+	// Recorded URLs may have been signed long ago
+	asset.URL = s.publicURL(asset.Key)
+	for _, v := range asset.Variants {
+		v.URL = s.publicURL(v.Key)
+	}
+	// This upload's TTL may keep the asset longer
+	record, err := s.db.GetAsset(ctx, key)
+	if err != nil {
+		if !errors.Is(err, db.ErrNotFound) {
+			s.logger.Error().Err(err).Str("key", key).Msg("failed to get recorded asset")
+		}
+		return nil
+	}
+	// Sources recorded before capture metadata was kept lack it
+	if asset.Capture == nil {
+		asset.Capture = s.decodeCapture(record)
+	}
+	if asset.ExpiresAt, err = s.db.ExtendExpiry(ctx, key, expiresAt(opts)); err != nil {
+		s.logger.Error().Err(err).Str("key", key).Msg("failed to extend asset expiry")
+		return nil
+	}
+	if !sameExpiry(record.ExpiresAt, asset.ExpiresAt) {
+		s.retagExpiry(ctx, objectKeys(&asset), record.CreatedAt, asset.ExpiresAt)
+	}
+	s.logger.Info().Str("key", key).Msg("source already processed, using existing asset")
+	s.addRef(ctx, key)
+	s.TouchAssets(ctx, []string{key})
+	s.notifier.Notify(webhook.EventDeduplicated, uploaderFromContext(ctx), &asset)
+	return &asset
+}
+
+// addRef records that the signed-in user uploaded the asset at key, so
+// deleting it doesn't take it from the others who did. Failing to is
+// logged.
+func (s *Service) addRef(ctx context.Context, key string) {
+	user := uploaderFromContext(ctx)
+	if user == "" {
+		return
+	}
+	if err := s.db.AddAssetRef(ctx, key, user); err != nil {
+		s.logger.Error().Err(err).Str("key", key).Msg("failed to record asset reference")
+	}
+}
+
+// saveSource records which asset a source produced. Failing to is logged,
+// the source just gets processed again next time.
+func (s *Service) saveSource(ctx context.Context, source string, asset *Asset) {
+	encoded, err := json.Marshal(asset)
+	if err == nil {
+		err = s.db.SaveSource(ctx, source, asset.Key, encoded)
+	}
+	if err != nil {
+		s.logger.Error().Err(err).Str("key", asset.Key).Msg("failed to record asset source")
+	}
+}
+
+// saveResult stores a processed image and its variants, and the original it
+// was processed from when originals are retained, and records its metadata,
+// returning the asset. original is nil when there's nothing to retain.
+func (s *Service) saveResult(ctx context.Context, result *imageproc.ProcessResult, original []byte, opts imageproc.ProcessOptions, sourceURL string) (*Asset, error) {
+	variantNames := opts.Variants
 
 	// Calculate hash for deduplication
 	hash := sha256.Sum256(result.Data)
 	hashStr := fmt.Sprintf("%x", hash)
 
-	// Generate key
+	// Generate key, content-addressed within the namespace
 	ext := util.GetImageExtension(result.ContentType)
+	namespace, err := s.namespaceFor(ctx)
+	if err != nil {
+		return nil, err
+	}
 	key := util.Base32Key(result.Data, ext)
+	if namespace != "" {
+		key = namespace + "/" + key
+	}
 
+	ctx = storage.WithTags(ctx, s.objectTags(ctx, namespace, sourceURL, opts.TTL))
+	ctx = storage.WithTTL(ctx, time.Duration(opts.TTL)*time.Second)
+
+	timings := zerolog.Dict()
+	for stage, elapsed := range result.Timings {
+		timings.Dur(stage, elapsed)
+	}
 	s.logger.Info().
 		Str("hash", hashStr[:16]).
 		Str("key", key).
+		Str("content_type", result.ContentType).
 		Int("original_size", result.OriginalSize).
 		Int("compressed_size", result.CompressedSize).
+		Dict("timings_ms", timings).
 		Msg("processed image")
 
-	// Check if object already exists (deduplication)
-	exists, err := s.storage.ObjectExists(ctx, key)
+	// Nothing is published before the malware scan and moderation passed,
+	// the CDN caches these bytes for a year
+	if err := s.malware.Check(ctx, result.Data, result.ContentType); err != nil {
+		s.logger.Warn().Err(err).Str("key", key).Msg("rejected unsafe file")
+		return nil, err
+	}
+	if err := s.moderate(ctx, key, result); err != nil {
+		return nil, err
+	}
+
+	publicURL, deduped, err := s.store(ctx, key, result.Data, result.ContentType)
 	if err != nil {
-		return nil, fmt.Errorf("failed to check if object exists: %v", err)
+		return nil, err
 	}
 
-	var publicURL string
-	deduped := false
+	// Variants live next to the full image under derived keys
+	var variants map[string]*Variant
+	if len(variantNames) > 0 {
+		variants = map[string]*Variant{
+			imageproc.VariantFull: {URL: publicURL, Width: result.Width, Height: result.Height, Bytes: result.CompressedSize, Key: key},
+		}
+		for _, v := range result.Variants {
+			variantKey := strings.TrimSuffix(key, ext) + "_" + v.Name + ext
+			variantURL, _, err := s.store(ctx, variantKey, v.Data, v.ContentType)
+			if err != nil {
+				return nil, fmt.Errorf("failed to store %s variant: %v", v.Name, err)
+			}
+			variants[v.Name] = &Variant{URL: variantURL, Width: v.Width, Height: v.Height, Bytes: len(v.Data), Key: variantKey}
+		}
+		// Sizes that weren't rendered are served by the full image
+		for _, name := range variantNames {
+			if _, ok := variants[name]; !ok {
+				variants[name] = variants[imageproc.VariantFull]
+			}
+		}
+	}
 
-	if exists {
-		// Object already exists, just return the URL
-		publicURL = s.storage.GetPublicURL(key)
-		deduped = true
-		s.logger.Info().Str("key", key).Str("public_url", publicURL).Msg("object already exists, using existing")
+	originalKey := s.retainOriginal(ctx, namespace, original)
+
+	// An object that was there without a record, like an upload from before
+	// records were kept, may be linked from anywhere: a TTL never makes it
+	// expire. A permanent record stays permanent when it's saved.
+	expires := expiresAt(opts)
+	var existing *db.Asset
+	if deduped {
+		if existing, err = s.db.GetAsset(ctx, key); err != nil {
+			existing, expires = nil, nil
+		}
+	}
+
+	record := &db.Asset{
+		Key:           key,
+		Namespace:     namespace,
+		Hash:          "sha256:" + hashStr,
+		MIME:          result.ContentType,
+		Width:         result.Width,
+		Height:        result.Height,
+		Bytes:         result.CompressedSize,
+		OriginalBytes: result.OriginalSize,
+		Uploader:      uploaderFromContext(ctx),
+		SourceURL:     sourceURL,
+		ExpiresAt:     expires,
+		OriginalKey:   originalKey,
+		Capture:       encodeCapture(result.Capture),
+	}
+	if err := s.db.SaveAsset(ctx, record); err != nil {
+		// The asset itself is stored, only its metadata is missing
+		s.logger.Error().Err(err).Str("key", key).Msg("failed to record asset metadata")
 	} else {
-		// Upload new object
-		uploadResult, err := s.storage.Upload(ctx, key, result.Data, result.ContentType)
+		s.addRef(ctx, key)
+		if existing != nil && !sameExpiry(existing.ExpiresAt, record.ExpiresAt) {
+			s.retagExpiry(ctx, objectKeys(&Asset{Key: key, Variants: variants}), existing.CreatedAt, record.ExpiresAt)
+		}
+	}
+
+	asset := &Asset{
+		URL:           publicURL,
+		MIME:          result.ContentType,
+		Width:         result.Width,
+		Height:        result.Height,
+		Bytes:         result.CompressedSize,
+		OriginalBytes: result.OriginalSize,
+		Frames:        result.Frames,
+		Hash:          "sha256:" + hashStr,
+		Deduped:       deduped,
+		Key:           key,
+		BlurHash:      result.BlurHash,
+		Capture:       result.Capture,
+		Variants:      variants,
+		ExpiresAt:     record.ExpiresAt,
+	}
+	if asset.Capture == nil && existing != nil {
+		asset.Capture = s.decodeCapture(existing)
+	}
+	event := webhook.EventUploaded
+	if deduped {
+		event = webhook.EventDeduplicated
+	}
+	s.notifier.Notify(event, record.Uploader, asset)
+	return asset, nil
+}
+
+// retainOriginal stores original in the private store under
+// util.OriginalsPrefix, within the namespace, and returns its key. It
+// returns "" when originals aren't retained or storing failed, which is only
+// logged: the asset is published either way.
+func (s *Service) retainOriginal(ctx context.Context, namespace string, original []byte) string {
+	if !s.retainOriginals || s.private == nil || len(original) == 0 {
+		return ""
+	}
+	contentType := util.DetectContentType(original)
+	ext := util.GetDocumentExtension(contentType)
+	if ext == "" {
+		ext = util.GetImageExtension(contentType)
+	}
+	key := util.Base32Key(original, ext)
+	if namespace != "" {
+		key = namespace + "/" + key
+	}
+	key = util.OriginalsPrefix + key
+	// Keys are content hashes, an existing original is the same upload
+	exists, err := s.private.ObjectExists(ctx, key)
+	if err == nil && !exists {
+		_, err = s.private.Upload(ctx, key, original, contentType)
+	}
+	if err != nil {
+		s.logger.Error().Err(err).Str("key", key).Msg("failed to retain original")
+		return ""
+	}
+	return key
+}
+
+// objectTags are the storage tags of an upload's objects, for lifecycle
+// rules and cost reports per tag: its uploader, by the random ID of
+// db.UserNamespace rather than email, namespace, source host (or "upload")
+// and TTL in days
+func (s *Service) objectTags(ctx context.Context, namespace, sourceURL string, ttl int) map[string]string {
+	tags := map[string]string{"source": "upload"}
+	if u, err := url.Parse(sourceURL); err == nil && u.Hostname() != "" {
+		tags["source"] = u.Hostname()
+	}
+	if uploader := uploaderFromContext(ctx); uploader != "" {
+		if id, err := s.db.UserNamespace(ctx, uploader); err == nil {
+			tags["uploader"] = id
+		} else {
+			s.logger.Error().Err(err).Msg("failed to get uploader ID for object tags")
+		}
+	}
+	if namespace != "" {
+		tags["namespace"] = namespace
+	}
+	if ttl > 0 {
+		tags["ttl"] = ttlTag(time.Duration(ttl) * time.Second)
+	}
+	return tags
+}
+
+// ttlTag is the value of the ttl tag of objects kept for ttl, in days
+// rounded up
+func ttlTag(ttl time.Duration) string {
+	return fmt.Sprintf("%dd", (ttl+24*time.Hour-1)/(24*time.Hour))
+}
+
+// retagExpiry updates the ttl tag of an asset's objects, stored at
+// storedAt, after an upload that deduplicated onto them changed its expiry:
+// lifecycle rules on the tag would otherwise delete a permanent asset, or
+// one kept longer. Failing to is only logged.
+func (s *Service) retagExpiry(ctx context.Context, keys []string, storedAt time.Time, expiresAt *time.Time) {
+	tagger, ok := s.storage.(storage.Tagger)
+	if !ok {
+		return
+	}
+	ttl := ""
+	if expiresAt != nil {
+		// Lifecycle rules count whole days, a request's latency doesn't add one
+		ttl = ttlTag(expiresAt.Sub(storedAt).Truncate(time.Minute))
+	}
+	for _, key := range keys {
+		if err := tagger.SetTag(ctx, key, "ttl", ttl); err != nil {
+			s.logger.Error().Err(err).Str("key", key).Msg("failed to update ttl tag")
+		}
+	}
+}
+
+// objectKeys returns the keys of an asset's objects, itself and its
+// variants
+func objectKeys(asset *Asset) []string {
+	keys := []string{asset.Key}
+	for _, v := range asset.Variants {
+		if !slices.Contains(keys, v.Key) {
+			keys = append(keys, v.Key)
+		}
+	}
+	return keys
+}
+
+// sameExpiry reports whether two expiries are the same, nil for none
+func sameExpiry(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
+// expiresAt returns when an asset uploaded now with opts expires, nil for
+// no TTL
+func expiresAt(opts imageproc.ProcessOptions) *time.Time {
+	if opts.TTL == 0 {
+		return nil
+	}
+	t := time.Now().Add(time.Duration(opts.TTL) * time.Second).UTC().Truncate(time.Microsecond)
+	return &t
+}
+
+// expirySweepBatch is how many expired assets SweepExpired deletes per query
+const expirySweepBatch = 100
+
+// SweepExpired deletes the assets whose TTL has passed and returns how many
+// it deleted
+func (s *Service) SweepExpired(ctx context.Context) (int, error) {
+	deleted := 0
+	for {
+		expired, err := s.db.ListExpiredAssets(ctx, time.Now(), expirySweepBatch)
 		if err != nil {
-			return nil, fmt.Errorf("failed to upload to storage: %v", err)
+			return deleted, err
+		}
+		keys := make([]string, len(expired))
+		for i, record := range expired {
+			keys[i] = record.Key
+		}
+		errs := s.DeleteAssets(ctx, keys, true)
+		for key, err := range errs {
+			s.logger.Error().Err(err).Str("key", key).Msg("failed to delete expired asset")
+		}
+		failed := len(errs)
+		deleted += len(expired) - failed
+		// Failed ones are retried next sweep, not in a loop now
+		if len(expired) < expirySweepBatch || failed == len(expired) {
+			return deleted, nil
 		}
-		publicURL = uploadResult.URL
-		s.logger.Info().Str("key", key).Str("upload_url", uploadResult.URL).Str("public_url", publicURL).Msg("uploaded new object")
 	}
+}
 
-	return &Asset{
-		URL:     publicURL,
-		MIME:    result.ContentType,
-		Width:   result.Width,
-		Height:  result.Height,
-		Bytes:   result.CompressedSize,
-		Hash:    "sha256:" + hashStr,
-		Deduped: deduped,
-		Key:     key,
-	}, nil
+// StartExpirySweeper deletes expired assets, and stored responses to
+// idempotent requests, every interval until ctx is done
+func (s *Service) StartExpirySweeper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			deleted, err := s.SweepExpired(ctx)
+			if err != nil {
+				s.logger.Error().Err(err).Msg("expired asset sweep failed")
+			}
+			if deleted > 0 {
+				s.logger.Info().Int("deleted", deleted).Msg("deleted expired assets")
+			}
+			s.purgeIdempotentResponses(ctx)
+		}
+	}
 }
 
-// ProcessBatch processes multiple images
-func (s *Service) ProcessBatch(ctx context.Context, inputs []BatchInput) ([]*Asset, error) {
-	assets := make([]*Asset, 0, len(inputs))
-	
-	for i, input := range inputs {
-		s.logger.Info().Int("index", i).Msg("processing batch item")
-		
-		var asset *Asset
+// moderate scans a processed image before it's published. Flagged images are
+// rejected, quarantined ones are stored under the quarantine prefix for
+// review first.
+func (s *Service) moderate(ctx context.Context, key string, result *imageproc.ProcessResult) error {
+	if s.moderation.Scanner == nil {
+		return nil
+	}
+
+	verdict, err := s.moderation.Scanner.Scan(ctx, result.Data, result.ContentType)
+	if err != nil {
+		if s.moderation.FailOpen {
+			s.logger.Warn().Err(err).Str("key", key).Msg("content moderation failed, publishing unscanned")
+			return nil
+		}
+		return fmt.Errorf("content moderation unavailable: %v", err)
+	}
+	if !verdict.Flagged {
+		return nil
+	}
+
+	s.logger.Warn().
+		Str("key", key).
+		Str("user", uploaderFromContext(ctx)).
+		Strs("categories", verdict.Categories).
+		Str("action", s.moderation.Action).
+		Msg("image flagged by content moderation")
+	if s.moderation.Action == moderation.ActionQuarantine && s.private != nil {
+		if _, err := s.private.Upload(ctx, moderation.QuarantinePrefix+key, result.Data, result.ContentType); err != nil {
+			s.logger.Error().Err(err).Str("key", key).Msg("failed to quarantine flagged image")
+		}
+	}
+	return fmt.Errorf("%w (%s)", moderation.ErrFlagged, strings.Join(verdict.Categories, ", "))
+}
+
+// ConvertInput is the source of a format conversion, either the key of a
+// stored asset or uploaded data
+type ConvertInput struct {
+	Key     string
+	Data    []byte
+	Format  string
+	Quality int
+}
+
+// Convert re-encodes a stored asset or uploaded image in a specific format
+// and stores the result as a new asset
+func (s *Service) Convert(ctx context.Context, input *ConvertInput) (*Asset, error) {
+	data := input.Data
+	if input.Key != "" {
+		if !util.IsBaseKey(input.Key) {
+			return nil, storage.ErrObjectNotFound
+		}
 		var err error
-		
-		switch {
-		case input.URL != "":
-			asset, err = s.ProcessFromURL(ctx, input.URL)
-		case input.DataURI != "":
-			asset, err = s.ProcessFromDataURI(ctx, input.DataURI)
-		case len(input.Data) > 0:
-			asset, err = s.ProcessFromData(ctx, &ProcessInput{
-				Data:        input.Data,
-				ContentType: input.ContentType,
-				SourceURL:   "upload",
-			})
-		default:
-			err = fmt.Errorf("no valid input provided for batch item %d", i)
-		}
-		
+		if data, _, err = s.storage.Download(ctx, input.Key); err != nil {
+			return nil, err
+		}
+	}
+
+	result, err := s.processor.Convert(ctx, data, input.Format, input.Quality)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert image: %v", err)
+	}
+	source := "upload"
+	if input.Key != "" {
+		source = s.storage.GetPublicURL(input.Key)
+	}
+	asset, err := s.saveResult(ctx, result, input.Data, imageproc.ProcessOptions{}, source)
+	if err != nil {
+		return nil, err
+	}
+	s.audit(ctx, asset, source)
+	return asset, nil
+}
+
+// StoredAsset is the recorded metadata of an asset and its public URL
+type StoredAsset struct {
+	URL string `json:"url"`
+	*db.Asset
+	// Capture is the first upload's capture metadata, when recorded
+	Capture *imageproc.CaptureMetadata `json:"capture,omitempty"`
+}
+
+// storedAsset returns the metadata of record for clients
+func (s *Service) storedAsset(record *db.Asset) *StoredAsset {
+	return &StoredAsset{URL: s.publicURL(record.Key), Asset: record, Capture: s.decodeCapture(record)}
+}
+
+// encodeCapture encodes capture metadata for an asset record
+func encodeCapture(capture *imageproc.CaptureMetadata) []byte {
+	if capture == nil {
+		return nil
+	}
+	encoded, _ := json.Marshal(capture)
+	return encoded
+}
+
+// decodeCapture returns the capture metadata recorded with an asset, nil
+// if there's none
+func (s *Service) decodeCapture(record *db.Asset) *imageproc.CaptureMetadata {
+	if len(record.Capture) == 0 {
+		return nil
+	}
+	var capture imageproc.CaptureMetadata
+	if err := json.Unmarshal(record.Capture, &capture); err != nil {
+		s.logger.Error().Err(err).Str("key", record.Key).Msg("failed to decode recorded capture metadata")
+		return nil
+	}
+	return &capture
+}
+
+// GetAsset returns the recorded metadata of the asset at key
+func (s *Service) GetAsset(ctx context.Context, key string) (*StoredAsset, error) {
+	record, err := s.db.GetAsset(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return s.storedAsset(record), nil
+}
+
+// ListAssets returns a page of recorded assets, newest first, and the cursor
+// of the next page
+func (s *Service) ListAssets(ctx context.Context, filter db.AssetFilter) ([]*StoredAsset, string, error) {
+	records, next, err := s.db.ListAssets(ctx, filter)
+	if err != nil {
+		return nil, "", err
+	}
+	assets := make([]*StoredAsset, len(records))
+	for i, record := range records {
+		assets[i] = s.storedAsset(record)
+	}
+	return assets, next, nil
+}
+
+// ErrForbidden is returned when deleting someone else's asset
+var ErrForbidden = errors.New("asset belongs to another user")
+
+// DeleteAsset removes the asset at key, its variants and cached renders from
+// storage and tombstones its record. Only its uploaders or an admin may; an
+// uploader of bytes others uploaded too only drops their reference to it.
+func (s *Service) DeleteAsset(ctx context.Context, key string, admin bool) error {
+	return s.DeleteAssets(ctx, []string{key}, admin)[key]
+}
+
+// DeleteAssets is DeleteAsset for many keys, deleting all their objects in as
+// few storage requests as possible. It returns the errors of the keys that
+// weren't deleted.
+func (s *Service) DeleteAssets(ctx context.Context, keys []string, admin bool) map[string]error {
+	failed := make(map[string]error)
+	user := uploaderFromContext(ctx)
+	records := make(map[string]*db.Asset)
+	released := make(map[string]bool)
+	var objects []string
+	owners := make(map[string]string) // object key to asset key
+	for _, key := range keys {
+		if _, ok := records[key]; ok || released[key] {
+			continue
+		}
+		record, err := s.db.GetAsset(ctx, key)
 		if err != nil {
-			s.logger.Error().Err(err).Int("index", i).Msg("failed to process batch item")
-			return nil, fmt.Errorf("failed to process item %d: %v", i, err)
+			failed[key] = err
+			continue
+		}
+		if !admin {
+			// Identical uploads share a key: a user deletes their upload,
+			// the asset goes with the last one
+			refs, err := s.db.AssetRefs(ctx, key)
+			if err != nil {
+				failed[key] = err
+				continue
+			}
+			// Records whose references failed to be saved have their
+			// first uploader
+			owned := user != "" && (slices.Contains(refs, strings.ToLower(user)) || (len(refs) == 0 && strings.EqualFold(user, record.Uploader)))
+			if !owned {
+				failed[key] = ErrForbidden
+				continue
+			}
+			if slices.ContainsFunc(refs, func(ref string) bool { return !strings.EqualFold(ref, user) }) {
+				if err := s.db.RemoveAssetRef(ctx, key, user); err != nil {
+					failed[key] = err
+					continue
+				}
+				released[key] = true
+				s.logger.Info().Str("key", key).Str("user", user).Msg("released asset, others uploaded it too")
+				continue
+			}
+		}
+		records[key] = record
+		objects = append(objects, key)
+		owners[key] = key
+
+		// Variants and renders are stored as <key without extension>_<suffix>
+		derived, err := s.storage.ListObjects(ctx, strings.TrimSuffix(key, path.Ext(key))+"_", 1000)
+		if err != nil {
+			s.logger.Error().Err(err).Str("key", key).Msg("failed to list derived objects")
+		}
+		for _, obj := range derived {
+			objects = append(objects, *obj.Key)
+			owners[*obj.Key] = key
+		}
+	}
+
+	for _, object := range objects {
+		s.forgetStored(ctx, object)
+	}
+	for object, err := range s.storage.DeleteMany(ctx, objects) {
+		key := owners[object]
+		if object == key {
+			failed[key] = err
+			continue
+		}
+		s.logger.Error().Err(err).Str("key", object).Msg("failed to delete derived object")
+	}
+
+	for _, key := range keys {
+		record, ok := records[key]
+		if !ok || failed[key] != nil {
+			continue
 		}
-		
-		assets = append(assets, asset)
+		if err := s.db.DeleteAsset(ctx, key); err != nil {
+			failed[key] = err
+			continue
+		}
+		// Only the first of duplicate keys does the rest
+		delete(records, key)
+		s.deleteOriginal(ctx, record.OriginalKey)
+		s.notifier.Notify(webhook.EventDeleted, user, s.storedAsset(record))
+		s.logger.Info().Str("key", key).Str("user", user).Bool("admin", admin).Msg("deleted asset")
+	}
+	return failed
+}
+
+// deleteOriginal deletes a retained original once no live asset was
+// processed from it. Failing to is only logged.
+func (s *Service) deleteOriginal(ctx context.Context, originalKey string) {
+	if originalKey == "" || s.private == nil {
+		return
+	}
+	inUse, err := s.db.OriginalInUse(ctx, originalKey)
+	if err != nil {
+		s.logger.Error().Err(err).Str("key", originalKey).Msg("failed to check original references")
+		return
+	}
+	if inUse {
+		return
+	}
+	if err := s.private.Delete(ctx, originalKey); err != nil {
+		s.logger.Error().Err(err).Str("key", originalKey).Msg("failed to delete original")
+	}
+}
+
+// TouchAssets marks the assets at keys, or derived from them, as referenced
+// so garbage collection keeps them. Failing to is only logged.
+func (s *Service) TouchAssets(ctx context.Context, keys []string) {
+	bases := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if util.IsAssetKey(key) {
+			bases = append(bases, util.BaseKey(key))
+		}
+	}
+	if err := s.db.TouchAssets(ctx, bases); err != nil {
+		s.logger.Error().Err(err).Msg("failed to mark assets as referenced")
+	}
+}
+
+// AssetStats is the view history of an asset
+type AssetStats struct {
+	Key   string          `json:"key"`
+	Total int             `json:"total"`
+	Days  []db.DailyViews `json:"days"`
+}
+
+// RecordViews adds view counts ingested from CDN logs
+func (s *Service) RecordViews(ctx context.Context, views []db.ViewCount) error {
+	return s.db.RecordViews(ctx, views)
+}
+
+// Stats returns the daily views of the asset at key over the last days days,
+// including today. It returns db.ErrNotFound for unknown assets.
+func (s *Service) Stats(ctx context.Context, key string, days int) (*AssetStats, error) {
+	if _, err := s.db.GetAsset(ctx, key); err != nil {
+		return nil, err
+	}
+	since := time.Now().UTC().AddDate(0, 0, 1-days)
+	views, err := s.db.AssetViews(ctx, key, since)
+	if err != nil {
+		return nil, err
+	}
+	stats := &AssetStats{Key: key, Days: views}
+	for _, v := range views {
+		stats.Total += v.Views
+	}
+	return stats, nil
+}
+
+// namespaceFor returns the key namespace of the signed-in user, empty when
+// namespacing is off
+func (s *Service) namespaceFor(ctx context.Context) (string, error) {
+	user, ok := ctx.Value("user").(*session.User)
+	if !ok {
+		return "", nil
+	}
+	switch s.namespace {
+	case NamespaceUser:
+		namespace, err := s.db.UserNamespace(ctx, user.Email)
+		if err != nil {
+			return "", err
+		}
+		return namespace, nil
+	case NamespaceTeam:
+		if user.HD != "" {
+			return util.Namespace(user.HD), nil
+		}
+		// Personal accounts have no Workspace domain
+		_, domain, _ := strings.Cut(user.Email, "@")
+		return util.Namespace(domain), nil
+	default:
+		return "", nil
+	}
+}
+
+// audit appends an upload to the audit log, with the client the request
+// came from. Failing to is only logged.
+func (s *Service) audit(ctx context.Context, asset *Asset, source string) {
+	entry := &db.AuditEntry{
+		Key:     asset.Key,
+		User:    uploaderFromContext(ctx),
+		Source:  source,
+		Deduped: asset.Deduped,
+	}
+	entry.IP, _ = ctx.Value("client_ip").(string)
+	entry.UserAgent, _ = ctx.Value("user_agent").(string)
+	if err := s.db.SaveAuditEntry(ctx, entry); err != nil {
+		s.logger.Error().Err(err).Str("key", asset.Key).Msg("failed to record upload audit entry")
+	}
+}
+
+// ListAuditEntries returns a page of the upload audit log, newest first, and
+// the cursor of the next page
+func (s *Service) ListAuditEntries(ctx context.Context, filter db.AuditFilter) ([]*db.AuditEntry, string, error) {
+	return s.db.ListAuditEntries(ctx, filter)
+}
+
+// uploaderFromContext returns the email of the signed-in user, if any
+func uploaderFromContext(ctx context.Context) string {
+	if user, ok := ctx.Value("user").(*session.User); ok {
+		return user.Email
+	}
+	return ""
+}
+
+// Resized returns the asset at key rendered at the given size, rendering it
+// from the stored asset on first request and caching the render in storage
+func (s *Service) Resized(ctx context.Context, key string, width, height int, fit string) ([]byte, string, error) {
+	return s.Rendered(ctx, key, width, height, fit, "")
+}
+
+// Rendered is Resized with an output format, jpeg, png or webp, or empty to
+// keep the asset's. Without dimensions the asset is only converted. Sizes
+// are clamped to the processor's max dimension and the asset's own size
+// before renders are keyed, so that larger sizes don't store more copies of
+// the same render.
+func (s *Service) Rendered(ctx context.Context, key string, width, height int, fit, format string) ([]byte, string, error) {
+	if !util.IsBaseKey(key) {
+		return nil, "", storage.ErrObjectNotFound
+	}
+	if fit == "" {
+		fit = imageproc.FitContain
+	}
+
+	ext := path.Ext(key)
+	outputExt := ext
+	if format != "" {
+		outputExt = util.GetImageExtension("image/" + format)
+	}
+	maxDimension := s.processor.MaxDimension()
+	width, height = min(width, maxDimension), min(height, maxDimension)
+	derivedKey := renderKey(key, width, height, fit, outputExt)
+
+	data, contentType, err := s.storage.Download(ctx, derivedKey)
+	if err == nil {
+		return data, contentType, nil
+	}
+	if !errors.Is(err, storage.ErrObjectNotFound) {
+		return nil, "", err
+	}
+
+	original, _, err := s.storage.Download(ctx, key)
+	if err != nil {
+		return nil, "", err
+	}
+	// Images are never enlarged, so sizes past the asset's own render the same
+	if originalWidth, originalHeight, err := imageproc.ImageSize(original); err == nil && (width > originalWidth || height > originalHeight) {
+		width, height = min(width, originalWidth), min(height, originalHeight)
+		derivedKey = renderKey(key, width, height, fit, outputExt)
+		if data, contentType, err := s.storage.Download(ctx, derivedKey); err == nil {
+			return data, contentType, nil
+		}
+	}
+	result, err := s.processor.Render(ctx, original, width, height, fit, format)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if _, _, err := s.store(ctx, derivedKey, result.Data, result.ContentType); err != nil {
+		// Still serve the render, it'll be cached next time
+		s.logger.Error().Err(err).Str("key", derivedKey).Msg("failed to cache resized image")
+	}
+	s.logger.Info().Str("key", derivedKey).Int("bytes", len(result.Data)).Msg("rendered image variant")
+	return result.Data, result.ContentType, nil
+}
+
+// renderKey is the key a render of the asset at key is cached at
+func renderKey(key string, width, height int, fit, outputExt string) string {
+	return fmt.Sprintf("%s_w%d_h%d_%s%s", strings.TrimSuffix(key, path.Ext(key)), width, height, fit, outputExt)
+}
+
+// OpenAsset starts reading a stored asset or one of its variants
+func (s *Service) OpenAsset(ctx context.Context, key string) (*storage.Object, error) {
+	if !util.IsAssetKey(key) {
+		return nil, storage.ErrObjectNotFound
+	}
+	return s.storage.Open(ctx, key)
+}
+
+// store uploads data under key unless an object with that key already
+// exists, which, with content-addressed keys, means it's the same data
+func (s *Service) store(ctx context.Context, key string, data []byte, contentType string) (string, bool, error) {
+	exists, err := s.objectStored(ctx, key)
+	if err != nil {
+		return "", false, err
+	}
+
+	if exists {
+		publicURL := s.publicURL(key)
+		s.logger.Info().Str("key", key).Str("public_url", publicURL).Msg("object already exists, using existing")
+		return publicURL, true, nil
+	}
+
+	uploadResult, err := s.storage.Upload(ctx, key, data, contentType)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to upload to storage: %v", err)
+	}
+	s.rememberStored(ctx, key)
+	s.logger.Info().Str("key", key).Str("upload_url", uploadResult.URL).Msg("uploaded new object")
+	return s.publicURL(key), false, nil
+}
+
+// objectStored reports whether an object exists at key, answering from the
+// dedup index when it was stored or found recently
+func (s *Service) objectStored(ctx context.Context, key string) (bool, error) {
+	if s.dedup != nil && s.dedup.Contains(ctx, key) {
+		return true, nil
+	}
+	exists, err := s.storage.ObjectExists(ctx, key)
+	if err != nil {
+		return false, fmt.Errorf("failed to check if object exists: %v", err)
+	}
+	if exists {
+		s.rememberStored(ctx, key)
+	}
+	return exists, nil
+}
+
+// rememberStored adds key to the dedup index, if there is one
+func (s *Service) rememberStored(ctx context.Context, key string) {
+	if s.dedup != nil {
+		s.dedup.Add(ctx, key)
+	}
+}
+
+// forgetStored removes key from the dedup index before its object is
+// deleted, so that it's uploaded again rather than assumed to exist
+func (s *Service) forgetStored(ctx context.Context, key string) {
+	if s.dedup != nil {
+		s.dedup.Remove(ctx, key)
+	}
+}
+
+// publicURL returns the URL the object at key is served at, signed when
+// signed URLs are on
+func (s *Service) publicURL(key string) string {
+	publicURL := s.storage.GetPublicURL(key)
+	if s.signer != nil {
+		return s.signer.Sign(publicURL, key)
+	}
+	return publicURL
+}
+
+// KeyFromURL returns the key of an asset URL handed out by this service,
+// whether its signature is valid, expired or missing
+func (s *Service) KeyFromURL(rawURL string) (string, bool) {
+	base, err := url.Parse(s.storage.BaseURL())
+	if err != nil {
+		return "", false
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host != base.Host || !strings.HasPrefix(u.Path, base.Path) {
+		return "", false
+	}
+	key := strings.TrimPrefix(u.Path, base.Path)
+	return key, util.IsAssetKey(key)
+}
+
+// RefreshURLs returns newly signed URLs for asset URLs that expired or are
+// about to, keyed by the URLs given. URLs of unknown assets are left out.
+func (s *Service) RefreshURLs(ctx context.Context, urls []string) map[string]string {
+	fresh := make(map[string]string)
+	for _, rawURL := range urls {
+		key, ok := s.KeyFromURL(rawURL)
+		if !ok {
+			continue
+		}
+		if _, err := s.db.GetAsset(ctx, util.BaseKey(key)); err != nil {
+			if !errors.Is(err, db.ErrNotFound) {
+				s.logger.Error().Err(err).Str("key", key).Msg("failed to look up asset to refresh")
+			}
+			continue
+		}
+		fresh[rawURL] = s.publicURL(key)
+	}
+	return fresh
+}
+
+// CheckSignature verifies the signed URL query of a request for key and
+// returns when the URL expires. Without signed URLs every request passes and
+// the time is zero.
+func (s *Service) CheckSignature(key string, query url.Values) (time.Time, error) {
+	if s.signer == nil {
+		return time.Time{}, nil
+	}
+	return s.signer.Verify(key, query)
+}
+
+// ErrSizeNotAllowed is returned for renders at sizes other than the
+// configured ones without a URL signed for the size
+var ErrSizeNotAllowed = errors.New("size not allowed")
+
+// CheckSizeSignature verifies the signed URL query of a request rendering
+// key at a size other than the configured ones, which must be signed for
+// "<key>?w=<w>&h=<h>&fit=<fit>" rather than the key, and returns when the
+// URL expires. Without signed URLs such sizes are refused.
+func (s *Service) CheckSizeSignature(key string, width, height int, fit string, query url.Values) (time.Time, error) {
+	if s.signer == nil {
+		return time.Time{}, ErrSizeNotAllowed
+	}
+	if fit == "" {
+		fit = imageproc.FitContain
+	}
+	return s.signer.Verify(fmt.Sprintf("%s?w=%d&h=%d&fit=%s", key, width, height, fit), query)
+}
+
+// batchConcurrency bounds the items of a batch in flight at once. Image
+// processing itself is further limited by the processor's worker pool.
+const batchConcurrency = 4
+
+// BatchResult is the outcome of one batch item, its asset or its error
+type BatchResult struct {
+	Index int    `json:"index"`
+	Asset *Asset `json:"asset,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// ProcessBatch processes multiple images concurrently. A failing item
+// doesn't affect the others, each gets its own result, in input order.
+func (s *Service) ProcessBatch(ctx context.Context, inputs []BatchInput) []*BatchResult {
+	results := make([]*BatchResult, len(inputs))
+	sem := make(chan struct{}, batchConcurrency)
+	var wg sync.WaitGroup
+
+	for i, input := range inputs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			s.logger.Info().Int("index", i).Msg("processing batch item")
+			asset, err := s.processBatchItem(ctx, i, input)
+			if err != nil {
+				s.logger.Error().Err(err).Int("index", i).Msg("failed to process batch item")
+				results[i] = &BatchResult{Index: i, Error: err.Error()}
+				return
+			}
+			results[i] = &BatchResult{Index: i, Asset: asset}
+		}()
+	}
+
+	wg.Wait()
+	return results
+}
+
+// processBatchItem processes whichever source a batch item provides
+func (s *Service) processBatchItem(ctx context.Context, i int, input BatchInput) (*Asset, error) {
+	switch {
+	case input.URL != "":
+		return s.ProcessFromURL(ctx, input.URL, input.ProcessOptions)
+	case input.DataURI != "":
+		return s.ProcessFromDataURI(ctx, input.DataURI, input.ProcessOptions)
+	case len(input.Data) > 0:
+		return s.ProcessFromData(ctx, &ProcessInput{
+			Data:        input.Data,
+			ContentType: input.ContentType,
+			SourceURL:   "upload",
+			Options:     input.ProcessOptions,
+		})
+	default:
+		return nil, fmt.Errorf("no valid input provided for batch item %d", i)
 	}
-	
-	return assets, nil
 }
 
 type BatchInput struct {
@@ -181,6 +1278,7 @@ type BatchInput struct {
 	DataURI     string `json:"dataUri,omitempty"`
 	Data        []byte `json:"-"` // For file uploads
 	ContentType string `json:"-"`
+	imageproc.ProcessOptions
 }
 
 func (s *Service) parseDataURI(dataURI string) ([]byte, string, error) {
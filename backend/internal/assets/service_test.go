@@ -0,0 +1,579 @@
+package assets
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/hackclub/format/internal/auth"
+	"github.com/hackclub/format/internal/db"
+	"github.com/hackclub/format/internal/dedup"
+	"github.com/hackclub/format/internal/imageproc"
+	"github.com/hackclub/format/internal/malware"
+	"github.com/hackclub/format/internal/moderation"
+	"github.com/hackclub/format/internal/session"
+	"github.com/hackclub/format/internal/signedurl"
+	"github.com/hackclub/format/internal/storage"
+	"github.com/hackclub/format/internal/util"
+	"github.com/rs/zerolog"
+)
+
+func newTestService(t *testing.T) (*Service, *storage.MockR2Client) {
+	dir := t.TempDir()
+	database, err := db.Open(context.Background(), filepath.Join(dir, "format.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+	mock := storage.NewMockR2Client(filepath.Join(dir, "assets"), "http://localhost:8080/img")
+	return NewService(nil, mock, nil, database, nil, malware.NewScanner("", time.Second), moderation.Policy{}, nil, "", false, dedup.NewLRU(100, time.Hour), zerolog.Nop()), mock
+}
+
+func TestServiceWithMockStorage(t *testing.T) {
+	ctx := context.Background()
+	s, mock := newTestService(t)
+
+	input := &DocumentInput{Data: []byte("%PDF-1.4\n%%EOF\n"), Filename: "notes.pdf"}
+	first, err := s.ProcessDocument(ctx, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Deduped || first.URL != "http://localhost:8080/img/"+first.Key {
+		t.Errorf("first upload = %+v", first)
+	}
+	if exists, _ := mock.ObjectExists(ctx, first.Key); !exists {
+		t.Fatal("document not stored")
+	}
+
+	second, err := s.ProcessDocument(ctx, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !second.Deduped || second.Key != first.Key {
+		t.Errorf("second upload = %+v, want deduplicated", second)
+	}
+
+	// Deleting forgets the key, so the next upload stores it again
+	if err := s.DeleteAsset(ctx, first.Key, true); err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := mock.ObjectExists(ctx, first.Key); exists {
+		t.Fatal("document not deleted")
+	}
+	third, err := s.ProcessDocument(ctx, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third.Deduped {
+		t.Error("upload after deletion deduplicated against the deleted object")
+	}
+}
+
+func TestDeleteAssets(t *testing.T) {
+	ctx := context.Background()
+	s, mock := newTestService(t)
+
+	var keys []string
+	for _, data := range []string{"%PDF-1.4\none\n", "%PDF-1.4\ntwo\n"} {
+		asset, err := s.ProcessDocument(ctx, &DocumentInput{Data: []byte(data), Filename: "doc.pdf"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, asset.Key)
+		// A cached render, deleted with its asset
+		if _, err := mock.Upload(ctx, strings.TrimSuffix(asset.Key, ".pdf")+"_w200.webp", []byte("render"), "image/webp"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	failed := s.DeleteAssets(ctx, append(keys, "zz/missing.pdf"), true)
+	if len(failed) != 1 || !errors.Is(failed["zz/missing.pdf"], db.ErrNotFound) {
+		t.Errorf("DeleteAssets failures = %v, want only the missing key", failed)
+	}
+	if objects, _ := mock.ListObjects(ctx, "", 10); len(objects) != 0 {
+		t.Errorf("%d objects left after deleting every asset", len(objects))
+	}
+}
+
+func TestDeleteSharedAsset(t *testing.T) {
+	s, mock := newTestService(t)
+	as := func(email string) context.Context {
+		return context.WithValue(context.Background(), "user", &session.User{Email: email, Provider: "google"})
+	}
+
+	// Identical uploads of two users share a key
+	input := &DocumentInput{Data: []byte("%PDF-1.4\nshared\n"), Filename: "doc.pdf"}
+	first, err := s.ProcessDocument(as("a@hackclub.com"), input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := s.ProcessDocument(as("B@hackclub.com"), input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Key != second.Key {
+		t.Fatalf("keys %s and %s, want shared", first.Key, second.Key)
+	}
+
+	if err := s.DeleteAsset(as("c@hackclub.com"), first.Key, false); !errors.Is(err, ErrForbidden) {
+		t.Errorf("DeleteAsset(someone else) = %v, want ErrForbidden", err)
+	}
+	// The first uploader's delete leaves it to the second
+	if err := s.DeleteAsset(as("a@hackclub.com"), first.Key, false); err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := mock.ObjectExists(context.Background(), first.Key); !exists {
+		t.Fatal("asset deleted while another user uploaded it")
+	}
+	if err := s.DeleteAsset(as("a@hackclub.com"), first.Key, false); !errors.Is(err, ErrForbidden) {
+		t.Errorf("DeleteAsset(again) = %v, want ErrForbidden", err)
+	}
+	if err := s.DeleteAsset(as("b@hackclub.com"), first.Key, false); err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := mock.ObjectExists(context.Background(), first.Key); exists {
+		t.Error("asset kept after its last uploader deleted it")
+	}
+	if _, err := s.db.GetAsset(context.Background(), first.Key); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("GetAsset(deleted) error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestSetAlias(t *testing.T) {
+	s, _ := newTestService(t)
+	as := func(email string) context.Context {
+		return context.WithValue(context.Background(), "user", &session.User{Email: email, Provider: "google"})
+	}
+	var keys []string
+	for _, body := range []string{"one", "two", "three"} {
+		result, err := s.ProcessDocument(as("a@hackclub.com"), &DocumentInput{Data: []byte("%PDF-1.4\n" + body + "\n"), Filename: "doc.pdf"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, result.Key)
+	}
+
+	if _, err := s.SetAlias(as("a@hackclub.com"), "logo", keys[0], false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.SetAlias(as("b@hackclub.com"), "logo", keys[1], false); !errors.Is(err, ErrForbidden) {
+		t.Errorf("SetAlias(someone else's) = %v, want ErrForbidden", err)
+	}
+	got, err := s.SetAlias(as("A@hackclub.com"), "logo", keys[1], false)
+	if err != nil || got.Key != keys[1] || got.Owner != "a@hackclub.com" {
+		t.Errorf("SetAlias(owner) = %+v, %v", got, err)
+	}
+	got, err = s.SetAlias(as("admin@hackclub.com"), "logo", keys[2], true)
+	if err != nil || got.Key != keys[2] || got.Owner != "a@hackclub.com" {
+		t.Errorf("SetAlias(admin) = %+v, %v, want repointed keeping the owner", got, err)
+	}
+}
+
+func TestKeyFromURL(t *testing.T) {
+	s, _ := newTestService(t)
+	key := util.Base32Key([]byte("image"), ".jpg")
+	render := strings.TrimSuffix(key, ".jpg") + "_w200.webp"
+	tests := map[string]string{
+		"http://localhost:8080/img/" + key:                        key,
+		"http://localhost:8080/img/" + render + "?exp=1&sig=0":    render,
+		"http://localhost:8080/i/" + key:                          "",
+		"https://example.com/img/" + key:                          "",
+		"http://localhost:8080/img/" + util.OriginalsPrefix + key: "",
+		"http://localhost:8080/img/not-a-key.jpg":                 "",
+	}
+	for rawURL, want := range tests {
+		got, ok := s.KeyFromURL(rawURL)
+		if ok != (want != "") || (ok && got != want) {
+			t.Errorf("KeyFromURL(%q) = %q, %v, want %q", rawURL, got, ok, want)
+		}
+	}
+}
+
+func TestCheckSizeSignature(t *testing.T) {
+	s, _ := newTestService(t)
+	key := util.Base32Key([]byte("image"), ".jpg")
+	if _, err := s.CheckSizeSignature(key, 3841, 0, "", url.Values{}); !errors.Is(err, ErrSizeNotAllowed) {
+		t.Fatalf("without signed URLs got %v, want ErrSizeNotAllowed", err)
+	}
+
+	s.signer = signedurl.NewSigner("secret", time.Hour)
+	signed := mustQuery(t, s.signer.Sign("http://localhost:8080/i/"+key+"?w=3841", key+"?w=3841&h=0&fit=contain"))
+	if _, err := s.CheckSizeSignature(key, 3841, 0, "", signed); err != nil {
+		t.Fatalf("URL signed for the size got %v", err)
+	}
+	if _, err := s.CheckSizeSignature(key, 3842, 0, "", signed); !errors.Is(err, signedurl.ErrInvalid) {
+		t.Errorf("URL signed for another size got %v, want ErrInvalid", err)
+	}
+	if _, err := s.CheckSizeSignature(key, 3841, 0, "", mustQuery(t, s.publicURL(key))); !errors.Is(err, signedurl.ErrInvalid) {
+		t.Errorf("URL signed for the key got %v, want ErrInvalid", err)
+	}
+}
+
+func TestRendersRejectUnlistedSizes(t *testing.T) {
+	s, _ := newTestService(t)
+	handler := NewHandler(s, nil, []int{320, 640}, zerolog.Nop())
+	router := chi.NewRouter()
+	router.Get("/i/*", handler.HandleResize)
+	router.Get("/img/*", handler.HandleImage)
+	key := util.Base32Key([]byte("image"), ".jpg")
+	for _, route := range []string{"/i/", "/img/"} {
+		for _, query := range []string{"w=3841", "w=320&h=3842", "h=1"} {
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, route+key+"?"+query, nil))
+			if rec.Code != http.StatusBadRequest {
+				t.Errorf("%s%s: got %d, want 400", route, query, rec.Code)
+			}
+		}
+	}
+}
+
+func TestServedSVGsAreSandboxed(t *testing.T) {
+	s, mock := newTestService(t)
+	handler := NewHandler(s, nil, nil, zerolog.Nop())
+	router := chi.NewRouter()
+	router.Get("/img/*", handler.HandleImage)
+	svg := []byte(`<svg xmlns="http://www.w3.org/2000/svg"><rect width="1" height="1"/></svg>`)
+	key := util.Base32Key(svg, ".svg")
+	if _, err := mock.Upload(context.Background(), key, svg, "image/svg+xml"); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/img/"+key, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body)
+	}
+	if csp := rec.Header().Get("Content-Security-Policy"); csp != "sandbox" {
+		t.Errorf("Content-Security-Policy = %q, want sandbox", csp)
+	}
+	if rec.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Error("SVG served without nosniff")
+	}
+}
+
+func TestServicesAreNeverAdmins(t *testing.T) {
+	s, _ := newTestService(t)
+	handler := NewHandler(s, []string{"service:mailer", "orpheus@hackclub.com"}, nil, zerolog.Nop())
+	for _, tt := range []struct {
+		user *session.User
+		want bool
+	}{
+		{&session.User{Email: "orpheus@hackclub.com", Provider: "google"}, true},
+		{&session.User{Email: "service:mailer", Provider: auth.ProviderService}, false},
+		{&session.User{Email: "heidi@hackclub.com", Provider: "google"}, false},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/api/assets", nil)
+		r = r.WithContext(context.WithValue(r.Context(), "user", tt.user))
+		if got := handler.isAdmin(r); got != tt.want {
+			t.Errorf("isAdmin(%s) = %v, want %v", tt.user.Email, got, tt.want)
+		}
+	}
+}
+
+func mustQuery(t *testing.T, rawURL string) url.Values {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.Query()
+}
+
+func TestOriginalsStayPrivate(t *testing.T) {
+	ctx := context.Background()
+	s, mock := newTestService(t)
+	private := storage.NewMockR2Client(filepath.Join(t.TempDir(), "private"), "")
+	s.private, s.retainOriginals = private, true
+
+	original := []byte("\x89PNG\r\n\x1a\nwith its metadata")
+	result := &imageproc.ProcessResult{Data: []byte("RIFF....WEBPprocessed"), ContentType: "image/webp", Width: 1, Height: 1}
+	asset, err := s.saveResult(ctx, result, original, imageproc.ProcessOptions{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := s.GetAsset(ctx, asset.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	originalKey := stored.OriginalKey
+	if !strings.HasPrefix(originalKey, util.OriginalsPrefix) {
+		t.Fatalf("OriginalKey = %q, want one under %s", originalKey, util.OriginalsPrefix)
+	}
+	if exists, _ := private.ObjectExists(ctx, originalKey); !exists {
+		t.Error("original isn't in the private store")
+	}
+	if exists, _ := mock.ObjectExists(ctx, originalKey); exists {
+		t.Error("original is in the public bucket")
+	}
+	body, _ := json.Marshal(stored)
+	if bytes.Contains(body, []byte(util.OriginalsPrefix)) {
+		t.Errorf("response exposes the original: %s", body)
+	}
+
+	if err := s.DeleteAsset(ctx, asset.Key, true); err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := private.ObjectExists(ctx, originalKey); exists {
+		t.Error("original outlived its asset")
+	}
+}
+
+func TestCaptureIsRecorded(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newTestService(t)
+
+	capture := &imageproc.CaptureMetadata{Format: "image/jpeg", Camera: "Canon EOS R5", CapturedAt: "2024-05-01T12:00:00", Width: 8192, Height: 5464}
+	result := &imageproc.ProcessResult{Data: []byte("RIFF....WEBPprocessed"), ContentType: "image/webp", Width: 1, Height: 1, Capture: capture}
+	asset, err := s.saveResult(ctx, result, nil, imageproc.ProcessOptions{}, "upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := s.GetAsset(ctx, asset.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Capture == nil || *stored.Capture != *capture {
+		t.Errorf("GetAsset capture = %+v, want %+v", stored.Capture, capture)
+	}
+	body, _ := json.Marshal(stored)
+	if !strings.Contains(string(body), `"camera":"Canon EOS R5"`) {
+		t.Errorf("response lacks the capture metadata: %s", body)
+	}
+
+	// A dedup hit whose result has none gets the recorded metadata
+	again, err := s.saveResult(ctx, &imageproc.ProcessResult{Data: result.Data, ContentType: "image/webp", Width: 1, Height: 1}, nil, imageproc.ProcessOptions{}, "upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !again.Deduped || again.Capture == nil || *again.Capture != *capture {
+		t.Errorf("deduplicated capture = %+v, want %+v", again.Capture, capture)
+	}
+
+	// So does a source recorded before capture metadata was kept
+	if err := s.db.SaveSource(ctx, "source", asset.Key, []byte(`{"key":"`+asset.Key+`"}`)); err != nil {
+		t.Fatal(err)
+	}
+	found := s.lookupSource(ctx, "source", time.Time{}, imageproc.ProcessOptions{})
+	if found == nil || found.Capture == nil || *found.Capture != *capture {
+		t.Errorf("source lookup = %+v, want the recorded capture", found)
+	}
+}
+
+func TestReprocessNeedsOriginal(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newTestService(t)
+	private := storage.NewMockR2Client(filepath.Join(t.TempDir(), "private"), "")
+	s.private = private
+
+	if _, err := s.Reprocess(ctx, "ab/unknown.webp", imageproc.ProcessOptions{}); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("Reprocess(unknown) = %v, want ErrNotFound", err)
+	}
+
+	// Without a retained original the stored asset isn't processed again
+	result := &imageproc.ProcessResult{Data: []byte("RIFF....WEBPprocessed"), ContentType: "image/webp", Width: 1, Height: 1}
+	asset, err := s.saveResult(ctx, result, nil, imageproc.ProcessOptions{}, "https://example.com/image.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Reprocess(ctx, asset.Key, imageproc.ProcessOptions{}); !errors.Is(err, ErrNoOriginal) {
+		t.Errorf("Reprocess(without original) = %v, want ErrNoOriginal", err)
+	}
+
+	// Nor when the original is gone from the private store
+	s.retainOriginals = true
+	result = &imageproc.ProcessResult{Data: []byte("RIFF....WEBPretained"), ContentType: "image/webp", Width: 1, Height: 1}
+	asset, err = s.saveResult(ctx, result, []byte("\x89PNG\r\n\x1a\noriginal"), imageproc.ProcessOptions{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := s.GetAsset(ctx, asset.Key)
+	if err != nil || stored.OriginalKey == "" {
+		t.Fatalf("GetAsset = %+v, %v, want an original", stored, err)
+	}
+	if err := private.Delete(ctx, stored.OriginalKey); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Reprocess(ctx, asset.Key, imageproc.ProcessOptions{}); !errors.Is(err, ErrNoOriginal) {
+		t.Errorf("Reprocess(original deleted) = %v, want ErrNoOriginal", err)
+	}
+}
+
+// flagAll flags every image
+type flagAll struct{}
+
+func (flagAll) Scan(ctx context.Context, data []byte, contentType string) (*moderation.Verdict, error) {
+	return &moderation.Verdict{Flagged: true, Categories: []string{"test"}}, nil
+}
+
+func TestQuarantineStaysPrivate(t *testing.T) {
+	ctx := context.Background()
+	s, mock := newTestService(t)
+	private := storage.NewMockR2Client(filepath.Join(t.TempDir(), "private"), "")
+	s.private = private
+	s.moderation = moderation.Policy{Scanner: flagAll{}, Action: moderation.ActionQuarantine}
+
+	result := &imageproc.ProcessResult{Data: []byte("RIFF....WEBPflagged"), ContentType: "image/webp"}
+	if err := s.moderate(ctx, "ab/flagged.webp", result); !errors.Is(err, moderation.ErrFlagged) {
+		t.Fatalf("moderate = %v, want ErrFlagged", err)
+	}
+	if exists, _ := private.ObjectExists(ctx, moderation.QuarantinePrefix+"ab/flagged.webp"); !exists {
+		t.Error("flagged image isn't quarantined in the private store")
+	}
+	if objects, _ := mock.ListObjects(ctx, "", 10); len(objects) != 0 {
+		t.Errorf("%d objects in the public bucket after quarantining", len(objects))
+	}
+}
+
+func TestTTLNeverExpiresExistingObjects(t *testing.T) {
+	ctx := context.Background()
+	s, mock := newTestService(t)
+	ttl := imageproc.ProcessOptions{TTL: 3600}
+	process := func(data string, opts imageproc.ProcessOptions) *Asset {
+		t.Helper()
+		asset, err := s.saveResult(ctx, &imageproc.ProcessResult{Data: []byte(data), ContentType: "image/webp"}, nil, opts, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return asset
+	}
+
+	// An object stored before records were kept
+	legacy := []byte("RIFF....WEBPlegacy")
+	if _, err := mock.Upload(ctx, util.Base32Key(legacy, ".webp"), legacy, "image/webp"); err != nil {
+		t.Fatal(err)
+	}
+	if asset := process(string(legacy), ttl); asset.ExpiresAt != nil {
+		t.Errorf("TTL upload of an unrecorded object expires at %v", asset.ExpiresAt)
+	}
+
+	process("RIFF....WEBPpermanent", imageproc.ProcessOptions{})
+	if asset := process("RIFF....WEBPpermanent", ttl); asset.ExpiresAt != nil {
+		t.Errorf("TTL upload of a permanent asset expires at %v", asset.ExpiresAt)
+	}
+
+	if asset := process("RIFF....WEBPephemeral", ttl); asset.ExpiresAt == nil {
+		t.Error("new TTL upload doesn't expire")
+	}
+}
+
+// taggingStore records the tags SetTag sets
+type taggingStore struct {
+	*storage.MockR2Client
+	tags map[string]string
+}
+
+func (s *taggingStore) SetTag(ctx context.Context, key, name, value string) error {
+	s.tags[key+" "+name] = value
+	return nil
+}
+
+func TestDedupRetagsExpiry(t *testing.T) {
+	ctx := context.WithValue(context.Background(), "user", &session.User{Email: "orpheus@hackclub.com"})
+	s, mock := newTestService(t)
+	store := &taggingStore{MockR2Client: mock, tags: make(map[string]string)}
+	s.storage = store
+	process := func(opts imageproc.ProcessOptions) *Asset {
+		t.Helper()
+		asset, err := s.saveResult(ctx, &imageproc.ProcessResult{Data: []byte("RIFF....WEBPtagged"), ContentType: "image/webp"}, nil, opts, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return asset
+	}
+
+	asset := process(imageproc.ProcessOptions{TTL: 86400})
+	if len(store.tags) != 0 {
+		t.Errorf("new upload was retagged: %v", store.tags)
+	}
+	process(imageproc.ProcessOptions{TTL: 3 * 86400})
+	if got := store.tags[asset.Key+" ttl"]; got != "3d" {
+		t.Errorf("ttl tag after a longer TTL = %q, want 3d", got)
+	}
+	process(imageproc.ProcessOptions{})
+	if got, ok := store.tags[asset.Key+" ttl"]; !ok || got != "" {
+		t.Errorf("ttl tag of a permanent asset = %q, want it removed", got)
+	}
+
+	tags := s.objectTags(ctx, "", "", 0)
+	if strings.Contains(tags["uploader"], "@") || tags["uploader"] == "" {
+		t.Errorf("uploader tag = %q, want an opaque ID", tags["uploader"])
+	}
+}
+
+func TestIdempotentSkipsFailedBatches(t *testing.T) {
+	s, _ := newTestService(t)
+	handler := NewHandler(s, nil, nil, zerolog.Nop())
+	user := &session.User{Email: "a@hackclub.com", Provider: "google"}
+	post := func(h http.Handler, path, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		r.Header.Set("Idempotency-Key", "retry-"+path)
+		r = r.WithContext(context.WithValue(r.Context(), "user", user))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		return rec
+	}
+
+	// A batch whose item fails is processed again on retry
+	batch := handler.Idempotent(http.HandlerFunc(handler.HandleBatch))
+	for i := 0; i < 2; i++ {
+		rec := post(batch, "/api/assets/batch", `{"items":[{"dataUri":"not a data URI"}]}`)
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"failed":1`) {
+			t.Fatalf("batch = %d %s", rec.Code, rec.Body)
+		}
+		if rec.Header().Get("Idempotent-Replayed") != "" {
+			t.Fatalf("attempt %d replayed a batch with failed items", i+1)
+		}
+	}
+
+	// Successful responses are still replayed
+	calls := 0
+	ok := handler.Idempotent(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Write([]byte(`{"failed":0}`))
+	}))
+	post(ok, "/api/assets", "")
+	if rec := post(ok, "/api/assets", ""); rec.Header().Get("Idempotent-Replayed") != "true" || rec.Body.String() != `{"failed":0}` || calls != 1 {
+		t.Errorf("retry = %q %s after %d calls, want a replay", rec.Header().Get("Idempotent-Replayed"), rec.Body, calls)
+	}
+}
+
+func TestParseProcessOptions(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    func(imageproc.ProcessOptions) bool
+		wantErr bool
+	}{
+		{"lossless=true", func(o imageproc.ProcessOptions) bool { return o.Lossless }, false},
+		{"lossless=0", func(o imageproc.ProcessOptions) bool { return !o.Lossless }, false},
+		{"lossless=maybe", nil, true},
+		{"pngInterlace=true&pngLevel=2", func(o imageproc.ProcessOptions) bool {
+			return o.PNGInterlace != nil && *o.PNGInterlace && o.PNGLevel != nil && *o.PNGLevel == 2
+		}, false},
+		{"pngInterlace=false", func(o imageproc.ProcessOptions) bool {
+			return o.PNGInterlace != nil && !*o.PNGInterlace && o.PNGLevel == nil
+		}, false},
+		{"pngLevel=max", nil, true},
+		{"quantize=true", func(o imageproc.ProcessOptions) bool { return o.Quantize != nil && *o.Quantize }, false},
+		{"quantize=nah", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			opts, err := parseProcessOptions(httptest.NewRequest(http.MethodPost, "/api/assets?"+tt.query, nil))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseProcessOptions = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && !tt.want(opts) {
+				t.Errorf("options = %+v", opts)
+			}
+		})
+	}
+}
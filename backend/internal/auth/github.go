@@ -0,0 +1,190 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/github"
+)
+
+// githubAPI is the GitHub REST API users and memberships are read from
+const githubAPI = "https://api.github.com"
+
+// GitHubProvider signs users in with GitHub OAuth, restricted to members of
+// allowed organizations. GitHub has no ID tokens, the user is read from the
+// API with the access token.
+type GitHubProvider struct {
+	config      *oauth2.Config
+	allowedOrgs []string
+	apiURL      string
+	client      *http.Client
+}
+
+// GitHubUser is a GitHub user with a verified email
+type GitHubUser struct {
+	ID        int64
+	Login     string
+	Name      string
+	Email     string
+	AvatarURL string
+	// Org is the allowed organization the user is an active member of
+	Org string
+}
+
+func NewGitHubProvider(clientID, clientSecret, redirectURL string, allowedOrgs []string) (*GitHubProvider, error) {
+	var orgs []string
+	for _, o := range allowedOrgs {
+		o = strings.ToLower(strings.TrimSpace(o))
+		if o != "" {
+			orgs = append(orgs, o)
+		}
+	}
+	if len(orgs) == 0 {
+		return nil, fmt.Errorf("at least one allowed GitHub organization is required")
+	}
+
+	return &GitHubProvider{
+		config: &oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			RedirectURL:  redirectURL,
+			Endpoint:     github.Endpoint,
+			// read:org lets memberships of private orgs be checked
+			Scopes: []string{"read:user", "user:email", "read:org"},
+		},
+		allowedOrgs: orgs,
+		apiURL:      githubAPI,
+		client:      &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (p *GitHubProvider) GetAuthURL(state, codeChallenge string) string {
+	return p.config.AuthCodeURL(state,
+		oauth2.SetAuthURLParam("code_challenge", codeChallenge), // PKCE
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"), // PKCE
+		oauth2.SetAuthURLParam("allow_signup", "false"),
+	)
+}
+
+func (p *GitHubProvider) Name() string        { return ProviderGitHub }
+func (p *GitHubProvider) DisplayName() string { return "GitHub" }
+
+// Authenticate exchanges code and verifies that its user is in an allowed
+// organization
+func (p *GitHubProvider) Authenticate(ctx context.Context, code, codeVerifier string) (*Identity, *oauth2.Token, error) {
+	token, err := p.ExchangeCode(ctx, code, codeVerifier)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to exchange code: %w", err)
+	}
+	user, err := p.VerifyUser(ctx, token)
+	if err != nil {
+		return nil, nil, deny(err)
+	}
+	return &Identity{
+		Provider: ProviderGitHub,
+		Sub:      fmt.Sprintf("github:%d", user.ID),
+		Email:    user.Email,
+		Name:     user.Name,
+		Picture:  user.AvatarURL,
+		Group:    user.Org,
+	}, token, nil
+}
+
+func (p *GitHubProvider) ExchangeCode(ctx context.Context, code string, codeVerifier string) (*oauth2.Token, error) {
+	return p.config.Exchange(ctx, code, oauth2.SetAuthURLParam("code_verifier", codeVerifier))
+}
+
+// VerifyUser reads the user of token and checks that they have a verified
+// primary email and are an active member of an allowed organization
+func (p *GitHubProvider) VerifyUser(ctx context.Context, token *oauth2.Token) (*GitHubUser, error) {
+	var profile struct {
+		ID        int64  `json:"id"`
+		Login     string `json:"login"`
+		Name      string `json:"name"`
+		AvatarURL string `json:"avatar_url"`
+	}
+	if err := p.get(ctx, token, "/user", &profile); err != nil {
+		return nil, err
+	}
+
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	if err := p.get(ctx, token, "/user/emails", &emails); err != nil {
+		return nil, err
+	}
+	user := &GitHubUser{
+		ID:        profile.ID,
+		Login:     profile.Login,
+		Name:      profile.Name,
+		AvatarURL: profile.AvatarURL,
+	}
+	for _, e := range emails {
+		if e.Primary && e.Verified {
+			user.Email = e.Email
+		}
+	}
+	if user.Email == "" {
+		return nil, fmt.Errorf("email not verified")
+	}
+	if user.Name == "" {
+		user.Name = user.Login
+	}
+
+	for _, org := range p.allowedOrgs {
+		var membership struct {
+			State string `json:"state"`
+		}
+		err := p.get(ctx, token, "/user/memberships/orgs/"+url.PathEscape(org), &membership)
+		if errors.Is(err, errGitHubNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if membership.State == "active" {
+			user.Org = org
+			return user, nil
+		}
+	}
+	return nil, &NotAllowedError{Email: user.Email, Reason: fmt.Sprintf("github user %s is not a member of an allowed organization", user.Login)}
+}
+
+// errGitHubNotFound is returned for 404s, which is also how GitHub answers
+// for organizations the user isn't in
+var errGitHubNotFound = errors.New("not found on GitHub")
+
+// get decodes the JSON of a GitHub API path read with token
+func (p *GitHubProvider) get(ctx context.Context, token *oauth2.Token, path string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.apiURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call GitHub: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return errGitHubNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GitHub %s returned %d", path, resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode GitHub %s: %v", path, err)
+	}
+	return nil
+}
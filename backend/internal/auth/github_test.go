@@ -0,0 +1,62 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func TestGitHubVerifyUser(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/user":
+			json.NewEncoder(w).Encode(map[string]interface{}{"id": 42, "login": "orpheus", "avatar_url": "https://avatars/42"})
+		case "/user/emails":
+			json.NewEncoder(w).Encode([]map[string]interface{}{
+				{"email": "old@example.com", "primary": false, "verified": true},
+				{"email": "orpheus@hackclub.com", "primary": true, "verified": true},
+			})
+		case "/user/memberships/orgs/hackclub":
+			json.NewEncoder(w).Encode(map[string]string{"state": "active"})
+		case "/user/memberships/orgs/invited":
+			json.NewEncoder(w).Encode(map[string]string{"state": "pending"})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	newProvider := func(orgs ...string) *GitHubProvider {
+		p, err := NewGitHubProvider("id", "secret", "http://localhost/callback", orgs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.apiURL = server.URL
+		return p
+	}
+	ctx := context.Background()
+	token := &oauth2.Token{AccessToken: "token"}
+
+	user, err := newProvider("elsewhere", "HackClub").VerifyUser(ctx, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Email != "orpheus@hackclub.com" || user.Name != "orpheus" || user.Org != "hackclub" {
+		t.Errorf("VerifyUser = %+v", user)
+	}
+
+	if _, err := newProvider("elsewhere", "invited").VerifyUser(ctx, token); err == nil {
+		t.Error("expected an error for a user outside the allowed organizations")
+	}
+	if _, err := NewGitHubProvider("id", "secret", "http://localhost/callback", nil); err == nil {
+		t.Error("expected an error without allowed organizations")
+	}
+}
@@ -0,0 +1,69 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/oauth2/google"
+	admin "google.golang.org/api/admin/directory/v1"
+	"google.golang.org/api/option"
+)
+
+// GroupChecker restricts Google sign-ins to members of Workspace groups,
+// looked up with the Admin SDK Directory API. Groups are read as a
+// Workspace admin through a service account with domain-wide delegation.
+type GroupChecker struct {
+	members *admin.MembersService
+	groups  []string
+}
+
+// NewGroupChecker reads the service account key of credentialsFile, which
+// acts as adminEmail, to check membership of groups (their emails)
+func NewGroupChecker(ctx context.Context, credentialsFile, adminEmail string, groups []string) (*GroupChecker, error) {
+	data, err := os.ReadFile(credentialsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read service account key: %w", err)
+	}
+	config, err := google.JWTConfigFromJSON(data, admin.AdminDirectoryGroupMemberReadonlyScope)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse service account key: %w", err)
+	}
+	// Only admins may list members, the service account acts as one
+	config.Subject = adminEmail
+	service, err := admin.NewService(ctx, option.WithHTTPClient(config.Client(ctx)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create directory client: %w", err)
+	}
+	return newGroupChecker(service, groups)
+}
+
+func newGroupChecker(service *admin.Service, groups []string) (*GroupChecker, error) {
+	g := &GroupChecker{members: service.Members}
+	for _, group := range groups {
+		group = strings.ToLower(strings.TrimSpace(group))
+		if group != "" {
+			g.groups = append(g.groups, group)
+		}
+	}
+	if len(g.groups) == 0 {
+		return nil, fmt.Errorf("at least one group is required")
+	}
+	return g, nil
+}
+
+// IsMember reports whether email is a direct or nested member of one of the
+// groups
+func (g *GroupChecker) IsMember(ctx context.Context, email string) (bool, error) {
+	for _, group := range g.groups {
+		result, err := g.members.HasMember(group, email).Context(ctx).Do()
+		if err != nil {
+			return false, fmt.Errorf("failed to check membership of %s: %w", group, err)
+		}
+		if result.IsMember {
+			return true, nil
+		}
+	}
+	return false, nil
+}
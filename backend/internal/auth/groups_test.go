@@ -0,0 +1,55 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	admin "google.golang.org/api/admin/directory/v1"
+	"google.golang.org/api/option"
+)
+
+func TestGroupChecker(t *testing.T) {
+	// engineering@ has orpheus, staff@ has heidi through a nested group
+	members := map[string]bool{
+		"/admin/directory/v1/groups/engineering@hackclub.com/hasMember/orpheus@hackclub.com": true,
+		"/admin/directory/v1/groups/staff@hackclub.com/hasMember/heidi@hackclub.com":         true,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/admin/directory/v1/groups/staff@hackclub.com/hasMember/broken@hackclub.com" {
+			http.Error(w, `{"error": {"code": 500, "message": "backend error"}}`, http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]bool{"isMember": members[r.URL.Path]})
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	service, err := admin.NewService(ctx, option.WithEndpoint(server.URL), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checker, err := newGroupChecker(service, []string{" Engineering@hackclub.com", "staff@hackclub.com", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for email, want := range map[string]bool{
+		"orpheus@hackclub.com": true,
+		"heidi@hackclub.com":   true,
+		"zach@hackclub.com":    false,
+	} {
+		if got, err := checker.IsMember(ctx, email); err != nil || got != want {
+			t.Errorf("IsMember(%s) = %v, %v, want %v", email, got, err, want)
+		}
+	}
+	if _, err := checker.IsMember(ctx, "broken@hackclub.com"); err == nil {
+		t.Error("IsMember(directory error) succeeded, want an error")
+	}
+
+	if _, err := newGroupChecker(service, []string{" "}); err == nil {
+		t.Error("newGroupChecker(no groups) succeeded")
+	}
+}
@@ -0,0 +1,188 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	jose "github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+)
+
+// ErrForeignToken is returned for bearer tokens another issuer signed, like
+// those of services, which other authenticators may accept
+var ErrForeignToken = errors.New("token was not issued by us")
+
+// JWTIssuer mints the short-lived JWTs users authenticate with in bearer
+// mode, where API servers need no shared session state. Tokens are signed
+// with the first key and verified with any of them, which are all published
+// as a JWKS: a key is rotated by putting the new one first, and dropping the
+// old one once the tokens it signed have expired.
+type JWTIssuer struct {
+	issuer   string
+	ttl      time.Duration
+	signer   jose.Signer
+	keys     jose.JSONWebKeySet
+	verifier *oidc.IDTokenVerifier
+}
+
+// jwtClaims are the claims of our tokens besides the registered ones
+type jwtClaims struct {
+	jwt.Claims
+	Email    string `json:"email"`
+	Name     string `json:"name,omitempty"`
+	Picture  string `json:"picture,omitempty"`
+	HD       string `json:"hd,omitempty"`
+	Provider string `json:"provider"`
+	// AuthTime is when the user signed in, tokens aren't minted again past
+	// the session lifetime
+	AuthTime int64 `json:"auth_time"`
+}
+
+// NewJWTIssuer loads the PEM private keys (P-256 ECDSA or RSA) of keyFiles.
+// Tokens are valid for ttl, for issuer only.
+func NewJWTIssuer(issuer string, keyFiles []string, ttl time.Duration) (*JWTIssuer, error) {
+	if len(keyFiles) == 0 {
+		return nil, fmt.Errorf("at least one signing key is required")
+	}
+	i := &JWTIssuer{issuer: issuer, ttl: ttl}
+	var publicKeys []crypto.PublicKey
+	var algs []string
+	for n, file := range keyFiles {
+		key, alg, err := loadSigningKey(file)
+		if err != nil {
+			return nil, err
+		}
+		jwk := jose.JSONWebKey{Key: key, Algorithm: string(alg), Use: "sig"}
+		public := jwk.Public()
+		thumbprint, err := public.Thumbprint(crypto.SHA256)
+		if err != nil {
+			return nil, fmt.Errorf("failed to identify key %s: %w", file, err)
+		}
+		jwk.KeyID = fmt.Sprintf("%x", thumbprint[:8])
+		if n == 0 {
+			signer, err := jose.NewSigner(jose.SigningKey{Algorithm: alg, Key: jwk}, (&jose.SignerOptions{}).WithType("JWT"))
+			if err != nil {
+				return nil, fmt.Errorf("failed to create signer: %w", err)
+			}
+			i.signer = signer
+		}
+		public.KeyID = jwk.KeyID
+		i.keys.Keys = append(i.keys.Keys, public)
+		publicKeys = append(publicKeys, public.Key)
+		algs = append(algs, string(alg))
+	}
+	i.verifier = oidc.NewVerifier(issuer, &oidc.StaticKeySet{PublicKeys: publicKeys}, &oidc.Config{
+		ClientID:             issuer,
+		SupportedSigningAlgs: algs,
+	})
+	return i, nil
+}
+
+// loadSigningKey reads a PEM private key and the algorithm it signs with
+func loadSigningKey(file string) (crypto.Signer, jose.SignatureAlgorithm, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read signing key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, "", fmt.Errorf("no PEM key in %s", file)
+	}
+	var key interface{}
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to parse signing key %s: %w", file, err)
+	}
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			return nil, "", fmt.Errorf("signing key %s: only P-256 ECDSA keys are supported", file)
+		}
+		return k, jose.ES256, nil
+	case *rsa.PrivateKey:
+		if k.N.BitLen() < 2048 {
+			return nil, "", fmt.Errorf("signing key %s: RSA keys must be at least 2048 bits", file)
+		}
+		return k, jose.RS256, nil
+	}
+	return nil, "", fmt.Errorf("signing key %s must be an ECDSA or RSA key", file)
+}
+
+// Mint returns a token for identity, who signed in at authTime, and when it
+// expires
+func (i *JWTIssuer) Mint(identity *Identity, authTime time.Time) (string, time.Time, error) {
+	now := time.Now()
+	expiry := now.Add(i.ttl)
+	claims := jwtClaims{
+		Claims: jwt.Claims{
+			Issuer:   i.issuer,
+			Subject:  identity.Sub,
+			Audience: jwt.Audience{i.issuer},
+			IssuedAt: jwt.NewNumericDate(now),
+			Expiry:   jwt.NewNumericDate(expiry),
+		},
+		Email:    identity.Email,
+		Name:     identity.Name,
+		Picture:  identity.Picture,
+		HD:       identity.HD,
+		Provider: identity.Provider,
+		AuthTime: authTime.Unix(),
+	}
+	token, err := jwt.Signed(i.signer).Claims(claims).CompactSerialize()
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to sign token: %w", err)
+	}
+	return token, expiry, nil
+}
+
+// Verify checks a token we minted and returns who it's for and when they
+// signed in. It's ErrForeignToken for tokens of other issuers.
+func (i *JWTIssuer) Verify(ctx context.Context, raw string) (*Identity, time.Time, error) {
+	parsed, err := jwt.ParseSigned(raw)
+	if err != nil {
+		return nil, time.Time{}, ErrForeignToken
+	}
+	var unverified jwt.Claims
+	if err := parsed.UnsafeClaimsWithoutVerification(&unverified); err != nil || unverified.Issuer != i.issuer {
+		return nil, time.Time{}, ErrForeignToken
+	}
+
+	token, err := i.verifier.Verify(ctx, raw)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("invalid token: %w", err)
+	}
+	var claims jwtClaims
+	if err := token.Claims(&claims); err != nil {
+		return nil, time.Time{}, fmt.Errorf("invalid token claims: %w", err)
+	}
+	return &Identity{
+		Provider: claims.Provider,
+		Sub:      claims.Subject,
+		Email:    claims.Email,
+		Name:     claims.Name,
+		Picture:  claims.Picture,
+		HD:       claims.HD,
+	}, time.Unix(claims.AuthTime, 0), nil
+}
+
+// JWKS is the key set tokens are verified with, for other servers
+func (i *JWTIssuer) JWKS() jose.JSONWebKeySet {
+	return i.keys
+}
@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeSigningKey(t *testing.T, name string) string {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestJWTIssuer(t *testing.T) {
+	ctx := context.Background()
+	oldKey, newKey := writeSigningKey(t, "old.pem"), writeSigningKey(t, "new.pem")
+	before, err := NewJWTIssuer("https://format.hackclub.com", []string{oldKey}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Rotated: the new key signs, the old one still verifies
+	after, err := NewJWTIssuer("https://format.hackclub.com", []string{newKey, oldKey}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := after.JWKS().Keys; len(keys) != 2 || keys[0].KeyID == "" || keys[0].KeyID == keys[1].KeyID || !keys[0].IsPublic() {
+		t.Errorf("JWKS = %+v, want both public keys with distinct IDs", keys)
+	}
+
+	signedIn := time.Now().Add(-time.Hour).Truncate(time.Second)
+	token, expiry, err := before.Mint(&Identity{Provider: ProviderGoogle, Sub: "123", Email: "orpheus@hackclub.com", Name: "Orpheus"}, signedIn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Until(expiry) > time.Minute {
+		t.Errorf("expiry = %v, want within a minute", expiry)
+	}
+	identity, authTime, err := after.Verify(ctx, token)
+	if err != nil {
+		t.Fatalf("Verify(token of the old key) = %v", err)
+	}
+	if identity.Sub != "123" || identity.Email != "orpheus@hackclub.com" || identity.Provider != ProviderGoogle || !authTime.Equal(signedIn) {
+		t.Errorf("Verify = %+v, %v", identity, authTime)
+	}
+
+	// Tokens of the new key don't verify before the rotation
+	token, _, err = after.Mint(identity, signedIn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := before.Verify(ctx, token); err == nil || errors.Is(err, ErrForeignToken) {
+		t.Errorf("Verify(unknown key) error = %v, want invalid", err)
+	}
+
+	other, err := NewJWTIssuer("https://other.example.org", []string{oldKey}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _, err = other.Mint(identity, signedIn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, raw := range []string{token, "not-a-jwt"} {
+		if _, _, err := after.Verify(ctx, raw); !errors.Is(err, ErrForeignToken) {
+			t.Errorf("Verify(%.20s) error = %v, want ErrForeignToken", raw, err)
+		}
+	}
+}
@@ -14,11 +14,37 @@ import (
 	"golang.org/x/oauth2/google"
 )
 
+// Identity providers users can sign in with
+const (
+	ProviderGoogle = "google"
+	ProviderSlack  = "slack"
+	ProviderGitHub = "github"
+	ProviderOIDC   = "oidc"
+)
+
+// Gmail scopes, only asked for when a Gmail feature is first used, not at
+// login. GmailReadonlyScope lets the backend read messages and attachments,
+// GmailComposeScope create drafts, GmailSettingsScope set signatures,
+// GmailInsertScope import messages. The contacts scopes let the People API
+// suggest recipients.
+const (
+	GmailReadonlyScope = "https://www.googleapis.com/auth/gmail.readonly"
+	GmailComposeScope  = "https://www.googleapis.com/auth/gmail.compose"
+	GmailSettingsScope = "https://www.googleapis.com/auth/gmail.settings.basic"
+	GmailInsertScope   = "https://www.googleapis.com/auth/gmail.insert"
+	ContactsScope      = "https://www.googleapis.com/auth/contacts.readonly"
+	OtherContactsScope = "https://www.googleapis.com/auth/contacts.other.readonly"
+)
+
 type OIDCProvider struct {
 	config         *oauth2.Config
 	verifier       *oidc.IDTokenVerifier
 	allowedDomains map[string]bool
-	firstDomain    string // used for Google hd hint
+	// allowedEmails are let in whatever their domain, even personal accounts
+	allowedEmails map[string]bool
+	firstDomain   string // used for Google hd hint
+	// groups further restricts domain users to group members, if set
+	groups *GroupChecker
 }
 
 type Claims struct {
@@ -28,9 +54,14 @@ type Claims struct {
 	Name          string `json:"name"`
 	Picture       string `json:"picture"`
 	HD            string `json:"hd"` // hosted domain
+	// Allowlisted is set when the email was let in by ALLOWED_EMAILS rather
+	// than its domain
+	Allowlisted bool `json:"-"`
 }
 
-func NewOIDCProvider(ctx context.Context, clientID, clientSecret, redirectURL string, allowedDomains []string) (*OIDCProvider, error) {
+// NewOIDCProvider lets in verified Workspace users of allowedDomains and the
+// verified addresses of allowedEmails
+func NewOIDCProvider(ctx context.Context, clientID, clientSecret, redirectURL string, allowedDomains, allowedEmails []string) (*OIDCProvider, error) {
 	provider, err := oidc.NewProvider(ctx, "https://accounts.google.com")
 	if err != nil {
 		return nil, fmt.Errorf("failed to get provider: %w", err)
@@ -41,10 +72,7 @@ func NewOIDCProvider(ctx context.Context, clientID, clientSecret, redirectURL st
 		ClientSecret: clientSecret,
 		RedirectURL:  redirectURL,
 		Endpoint:     google.Endpoint,
-		Scopes: []string{
-			oidc.ScopeOpenID, "profile", "email",
-			"https://www.googleapis.com/auth/gmail.readonly",
-		},
+		Scopes:       []string{oidc.ScopeOpenID, "profile", "email"},
 	}
 
 	verifier := provider.Verifier(&oidc.Config{ClientID: clientID})
@@ -56,6 +84,13 @@ func NewOIDCProvider(ctx context.Context, clientID, clientSecret, redirectURL st
 			domainMap[d] = true
 		}
 	}
+	emailMap := make(map[string]bool)
+	for _, e := range allowedEmails {
+		e = strings.ToLower(strings.TrimSpace(e))
+		if e != "" {
+			emailMap[e] = true
+		}
+	}
 	// choose a stable first domain for hd hint
 	var keys []string
 	for k := range domainMap {
@@ -63,7 +98,9 @@ func NewOIDCProvider(ctx context.Context, clientID, clientSecret, redirectURL st
 	}
 	sort.Strings(keys)
 	first := ""
-	if len(keys) > 0 {
+	if len(keys) > 0 && len(emailMap) == 0 {
+		// The hint limits the account chooser to the domain, allowlisted
+		// collaborators elsewhere couldn't pick their account
 		first = keys[0]
 	}
 
@@ -71,6 +108,7 @@ func NewOIDCProvider(ctx context.Context, clientID, clientSecret, redirectURL st
 		config:         config,
 		verifier:       verifier,
 		allowedDomains: domainMap,
+		allowedEmails:  emailMap,
 		firstDomain:    first,
 	}, nil
 }
@@ -78,7 +116,7 @@ func NewOIDCProvider(ctx context.Context, clientID, clientSecret, redirectURL st
 func (p *OIDCProvider) GetAuthURL(state, codeChallenge string) string {
 	params := []oauth2.AuthCodeOption{
 		oauth2.SetAuthURLParam("access_type", "offline"),             // allow refresh tokens (server-side)
-		oauth2.SetAuthURLParam("prompt", "consent"),                  // consistent scope grant
+		oauth2.SetAuthURLParam("include_granted_scopes", "true"),     // Gmail access granted before comes along
 		oauth2.SetAuthURLParam("code_challenge", codeChallenge),      // PKCE
 		oauth2.SetAuthURLParam("code_challenge_method", "S256"),      // PKCE
 	}
@@ -88,6 +126,32 @@ func (p *OIDCProvider) GetAuthURL(state, codeChallenge string) string {
 	return p.config.AuthCodeURL(state, params...)
 }
 
+// GetGrantURL asks a signed-in user for Gmail scopes on top of the ones
+// they already granted. Its callback is the login's.
+func (p *OIDCProvider) GetGrantURL(state, codeChallenge, loginHint string, scopes ...string) string {
+	config := *p.config
+	config.Scopes = append(append([]string{}, scopes...), p.config.Scopes...)
+	return config.AuthCodeURL(state,
+		oauth2.SetAuthURLParam("access_type", "offline"),         // allow refresh tokens (server-side)
+		oauth2.SetAuthURLParam("prompt", "consent"),              // a refresh token even if granted before
+		oauth2.SetAuthURLParam("include_granted_scopes", "true"), // incremental authorization
+		oauth2.SetAuthURLParam("login_hint", loginHint),
+		oauth2.SetAuthURLParam("code_challenge", codeChallenge), // PKCE
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"), // PKCE
+	)
+}
+
+// HasScope reports whether Google granted scope with token
+func HasScope(token *oauth2.Token, scope string) bool {
+	granted, _ := token.Extra("scope").(string)
+	for _, s := range strings.Fields(granted) {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
 func (p *OIDCProvider) VerifyIDToken(ctx context.Context, idToken string) (*Claims, error) {
 	token, err := p.verifier.Verify(ctx, idToken)
 	if err != nil {
@@ -98,26 +162,95 @@ func (p *OIDCProvider) VerifyIDToken(ctx context.Context, idToken string) (*Clai
 	if err := token.Claims(&claims); err != nil {
 		return nil, fmt.Errorf("failed to parse claims: %w", err)
 	}
+	if err := p.checkClaims(&claims); err != nil {
+		return nil, err
+	}
+	return &claims, nil
+}
 
+// checkClaims lets in verified emails on ALLOWED_EMAILS first, whatever
+// their domain, then verified Workspace users of ALLOWED_DOMAINS
+func (p *OIDCProvider) checkClaims(claims *Claims) error {
 	if !claims.EmailVerified {
-		return nil, fmt.Errorf("email not verified")
+		return &NotAllowedError{Email: claims.Email, Reason: "email not verified"}
+	}
+
+	if p.allowedEmails[strings.ToLower(claims.Email)] {
+		claims.Allowlisted = true
+		return nil
 	}
 
 	if claims.HD == "" {
-		return nil, fmt.Errorf("no hosted domain found in token - personal accounts not allowed")
+		return &NotAllowedError{Email: claims.Email, Reason: "no hosted domain found in token - personal accounts not allowed"}
 	}
 
 	if !p.allowedDomains[strings.ToLower(claims.HD)] {
-		return nil, fmt.Errorf("domain %s is not allowed", claims.HD)
+		return &NotAllowedError{Email: claims.Email, Reason: fmt.Sprintf("domain %s is not allowed", claims.HD)}
 	}
 
-	return &claims, nil
+	return nil
+}
+
+// RequireGroups only lets in domain users who are members of one of the
+// groups of checker. Emails on ALLOWED_EMAILS are let in regardless.
+func (p *OIDCProvider) RequireGroups(checker *GroupChecker) {
+	p.groups = checker
+}
+
+func (p *OIDCProvider) Name() string        { return ProviderGoogle }
+func (p *OIDCProvider) DisplayName() string { return "Google" }
+
+// Authenticate exchanges code and verifies the ID token of a Workspace user
+// on an allowed domain
+func (p *OIDCProvider) Authenticate(ctx context.Context, code, codeVerifier string) (*Identity, *oauth2.Token, error) {
+	token, err := p.ExchangeCode(ctx, code, codeVerifier)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to exchange code: %w", err)
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, nil, fmt.Errorf("no id_token in response")
+	}
+	claims, err := p.VerifyIDToken(ctx, rawIDToken)
+	if err != nil {
+		return nil, nil, deny(err)
+	}
+	if p.groups != nil && !claims.Allowlisted {
+		member, err := p.groups.IsMember(ctx, claims.Email)
+		if err != nil {
+			// Fails closed, the directory is the only source of membership
+			return nil, nil, err
+		}
+		if !member {
+			return nil, nil, &NotAllowedError{Email: claims.Email, Reason: fmt.Sprintf("%s is not a member of an allowed group", claims.Email)}
+		}
+	}
+	group := claims.HD
+	if claims.Allowlisted {
+		group = "allowed-emails"
+	}
+	return &Identity{
+		Provider:    ProviderGoogle,
+		Sub:         claims.Sub,
+		Email:       claims.Email,
+		Name:        claims.Name,
+		Picture:     claims.Picture,
+		HD:          claims.HD,
+		Group:       group,
+		Allowlisted: claims.Allowlisted,
+	}, token, nil
 }
 
 func (p *OIDCProvider) ExchangeCode(ctx context.Context, code string, codeVerifier string) (*oauth2.Token, error) {
 	return p.config.Exchange(ctx, code, oauth2.SetAuthURLParam("code_verifier", codeVerifier))
 }
 
+// TokenSource returns token while it's valid, then new access tokens
+// obtained with its refresh token
+func (p *OIDCProvider) TokenSource(ctx context.Context, token *oauth2.Token) oauth2.TokenSource {
+	return p.config.TokenSource(ctx, token)
+}
+
 func GenerateState() string {
 	b := make([]byte, 32)
 	_, _ = rand.Read(b)
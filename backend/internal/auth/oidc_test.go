@@ -0,0 +1,58 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func TestOIDCCheckClaims(t *testing.T) {
+	p := &OIDCProvider{
+		allowedDomains: map[string]bool{"hackclub.com": true},
+		allowedEmails:  map[string]bool{"friend@gmail.com": true, "partner@example.org": true},
+	}
+
+	tests := []struct {
+		name        string
+		claims      Claims
+		allowed     bool
+		allowlisted bool
+	}{
+		{"workspace user", Claims{Email: "orpheus@hackclub.com", EmailVerified: true, HD: "hackclub.com"}, true, false},
+		{"personal account on the allowlist", Claims{Email: "Friend@gmail.com", EmailVerified: true}, true, true},
+		{"other workspace on the allowlist", Claims{Email: "partner@example.org", EmailVerified: true, HD: "example.org"}, true, true},
+		{"other workspace", Claims{Email: "someone@example.org", EmailVerified: true, HD: "example.org"}, false, false},
+		{"personal account", Claims{Email: "stranger@gmail.com", EmailVerified: true}, false, false},
+		{"unverified allowlisted email", Claims{Email: "friend@gmail.com"}, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := tt.claims
+			err := p.checkClaims(&claims)
+			if (err == nil) != tt.allowed {
+				t.Fatalf("checkClaims = %v, want allowed %v", err, tt.allowed)
+			}
+			// Denials carry the email for the auth log
+			var denied *NotAllowedError
+			if err != nil && (!errors.As(deny(err), &denied) || denied.Email != tt.claims.Email || !errors.Is(err, ErrNotAllowed)) {
+				t.Errorf("denial %v doesn't carry %s", err, tt.claims.Email)
+			}
+			if claims.Allowlisted != tt.allowlisted {
+				t.Errorf("Allowlisted = %v, want %v", claims.Allowlisted, tt.allowlisted)
+			}
+		})
+	}
+}
+
+func TestHasScope(t *testing.T) {
+	token := (&oauth2.Token{AccessToken: "access"}).WithExtra(map[string]interface{}{
+		"scope": "openid " + GmailReadonlyScope + " email",
+	})
+	if !HasScope(token, GmailReadonlyScope) {
+		t.Error("granted Gmail scope not found")
+	}
+	if HasScope(token, "profile") || HasScope(&oauth2.Token{}, GmailReadonlyScope) {
+		t.Error("scope not granted found")
+	}
+}
@@ -0,0 +1,117 @@
+package auth
+
+import (
+	"context"
+	"errors"
+
+	"golang.org/x/oauth2"
+)
+
+// ErrNotAllowed is wrapped by Authenticate errors of users who may not sign
+// in or whose identity couldn't be verified, as opposed to failed requests
+var ErrNotAllowed = errors.New("not allowed to sign in")
+
+// NotAllowedError is the ErrNotAllowed error of a sign-in, with the email
+// that was rejected when the provider got as far as telling it, so the
+// auth log records who tried
+type NotAllowedError struct {
+	Email  string
+	Reason string
+}
+
+func (e *NotAllowedError) Error() string {
+	return ErrNotAllowed.Error() + ": " + e.Reason
+}
+
+// Is makes errors.Is(err, ErrNotAllowed) hold
+func (e *NotAllowedError) Is(target error) bool {
+	return target == ErrNotAllowed
+}
+
+// deny returns err, a failed verification, as a NotAllowedError, keeping
+// the email of one it already is
+func deny(err error) error {
+	var denied *NotAllowedError
+	if errors.As(err, &denied) {
+		return denied
+	}
+	return &NotAllowedError{Reason: err.Error()}
+}
+
+// Identity is a user a provider verified
+type Identity struct {
+	Provider string
+	Sub      string
+	Email    string
+	Name     string
+	Picture  string
+	HD       string // Google Workspace domain, empty for other providers
+	// Group is what let the user in, a domain, Slack workspace or GitHub
+	// organization, for logs
+	Group string
+	// Allowlisted is set for users let in by their email alone, whom logs
+	// call out
+	Allowlisted bool
+}
+
+// Provider signs users in through an OAuth 2.0 or OpenID Connect identity
+// provider
+type Provider interface {
+	// Name identifies the provider in ?provider= and its callback route
+	Name() string
+	// DisplayName is shown on the login screen
+	DisplayName() string
+	GetAuthURL(state, codeChallenge string) string
+	// Authenticate exchanges an authorization code and verifies that the
+	// user it was issued for may sign in
+	Authenticate(ctx context.Context, code, codeVerifier string) (*Identity, *oauth2.Token, error)
+}
+
+// Registry holds the providers users can sign in with. The first one
+// registered is the default.
+type Registry struct {
+	providers map[string]Provider
+	names     []string
+}
+
+func NewRegistry() *Registry {
+	return &Registry{providers: make(map[string]Provider)}
+}
+
+// Register adds p, replacing a provider of the same name in place
+func (r *Registry) Register(p Provider) {
+	if _, ok := r.providers[p.Name()]; !ok {
+		r.names = append(r.names, p.Name())
+	}
+	r.providers[p.Name()] = p
+}
+
+// Get returns the provider called name, the default one for an empty name
+func (r *Registry) Get(name string) (Provider, bool) {
+	if name == "" {
+		if len(r.names) == 0 {
+			return nil, false
+		}
+		name = r.names[0]
+	}
+	p, ok := r.providers[name]
+	return p, ok
+}
+
+// List returns the providers in the order they were registered
+func (r *Registry) List() []Provider {
+	providers := make([]Provider, 0, len(r.names))
+	for _, name := range r.names {
+		providers = append(providers, r.providers[name])
+	}
+	return providers
+}
+
+// CallbackPath is where provider name redirects back to after login. Google
+// keeps the original /api/auth/callback so existing OAuth clients work.
+func CallbackPath(name string) string {
+	if name == ProviderGoogle {
+		return "/api/auth/callback"
+	}
+	return "/api/auth/callback/" + name
+}
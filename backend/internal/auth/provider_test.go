@@ -0,0 +1,42 @@
+package auth
+
+import (
+	"context"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+// fakeProvider is a Provider that's only named
+type fakeProvider string
+
+func (p fakeProvider) Name() string                                  { return string(p) }
+func (p fakeProvider) DisplayName() string                           { return string(p) }
+func (p fakeProvider) GetAuthURL(state, codeChallenge string) string { return "" }
+func (p fakeProvider) Authenticate(ctx context.Context, code, codeVerifier string) (*Identity, *oauth2.Token, error) {
+	return nil, nil, ErrNotAllowed
+}
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	if _, ok := r.Get(""); ok {
+		t.Error("empty registry has a default provider")
+	}
+
+	r.Register(fakeProvider(ProviderGoogle))
+	r.Register(fakeProvider(ProviderSlack))
+	r.Register(fakeProvider(ProviderGoogle))
+	if p, ok := r.Get(""); !ok || p.Name() != ProviderGoogle {
+		t.Errorf("default provider = %v, want google", p)
+	}
+	if _, ok := r.Get(ProviderGitHub); ok {
+		t.Error("unregistered provider found")
+	}
+	if list := r.List(); len(list) != 2 || list[1].Name() != ProviderSlack {
+		t.Errorf("List = %v, want google and slack", list)
+	}
+
+	if CallbackPath(ProviderGoogle) != "/api/auth/callback" || CallbackPath(ProviderSlack) != "/api/auth/callback/slack" {
+		t.Error("unexpected callback paths")
+	}
+}
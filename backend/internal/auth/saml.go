@@ -0,0 +1,294 @@
+package auth
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/crewjam/saml"
+	"golang.org/x/oauth2"
+)
+
+// ProviderSAML signs users in with a SAML 2.0 identity provider
+const ProviderSAML = "saml"
+
+// Attributes the email and name of users are commonly released as, by
+// Okta, Azure AD, ADFS and Shibboleth
+var (
+	samlEmailAttributes = []string{
+		"email",
+		"mail",
+		"emailaddress",
+		"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/emailaddress",
+		"urn:oid:0.9.2342.19200300.100.1.3",
+	}
+	samlNameAttributes = []string{
+		"name",
+		"displayName",
+		"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/name",
+		"urn:oid:2.16.840.1.113730.3.1.241",
+	}
+)
+
+// SAMLConfig configures the service provider
+type SAMLConfig struct {
+	// IDPMetadataURL is where the identity provider's metadata is fetched
+	// from, or the path of a file holding it
+	IDPMetadataURL string
+	// EntityID identifies us to the identity provider, MetadataURL if empty
+	EntityID    string
+	MetadataURL string
+	// ACSURL is the assertion consumer service the identity provider posts
+	// its responses to, our callback
+	ACSURL string
+	// CertFile and KeyFile are the RSA key pair authentication requests are
+	// signed with and assertions encrypted to, optional
+	CertFile string
+	KeyFile  string
+	// EmailAttribute and NameAttribute override the attributes the user's
+	// email and name are read from
+	EmailAttribute string
+	NameAttribute  string
+	DisplayName    string
+	AllowedDomains []string
+}
+
+// SAMLProvider signs users in as a SAML service provider, restricted to
+// users whose email is on an allowed domain. Its callback is the assertion
+// consumer service, which the identity provider posts its response to.
+type SAMLProvider struct {
+	sp             *saml.ServiceProvider
+	displayName    string
+	emailAttribute string
+	nameAttribute  string
+	allowedDomains map[string]bool
+}
+
+func NewSAMLProvider(ctx context.Context, cfg SAMLConfig) (*SAMLProvider, error) {
+	metadata, err := fetchIDPMetadata(ctx, cfg.IDPMetadataURL)
+	if err != nil {
+		return nil, err
+	}
+	metadataURL, err := url.Parse(cfg.MetadataURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata URL: %w", err)
+	}
+	acsURL, err := url.Parse(cfg.ACSURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ACS URL: %w", err)
+	}
+
+	sp := &saml.ServiceProvider{
+		EntityID:          cfg.EntityID,
+		MetadataURL:       *metadataURL,
+		AcsURL:            *acsURL,
+		IDPMetadata:       metadata,
+		AuthnNameIDFormat: saml.UnspecifiedNameIDFormat,
+	}
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		keyPair, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load SAML key pair: %w", err)
+		}
+		key, ok := keyPair.PrivateKey.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("SAML key must be an RSA key")
+		}
+		cert, err := x509.ParseCertificate(keyPair.Certificate[0])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse SAML certificate: %w", err)
+		}
+		sp.Key, sp.Certificate = key, cert
+		sp.SignatureMethod = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+	}
+	if sp.GetSSOBindingLocation(saml.HTTPRedirectBinding) == "" {
+		return nil, fmt.Errorf("identity provider has no HTTP-Redirect single sign-on service")
+	}
+
+	domainMap := make(map[string]bool)
+	for _, d := range cfg.AllowedDomains {
+		d = strings.ToLower(strings.TrimSpace(d))
+		if d != "" {
+			domainMap[d] = true
+		}
+	}
+	if len(domainMap) == 0 {
+		return nil, fmt.Errorf("at least one allowed email domain is required")
+	}
+	displayName := cfg.DisplayName
+	if displayName == "" {
+		displayName = "SAML SSO"
+	}
+
+	return &SAMLProvider{
+		sp:             sp,
+		displayName:    displayName,
+		emailAttribute: cfg.EmailAttribute,
+		nameAttribute:  cfg.NameAttribute,
+		allowedDomains: domainMap,
+	}, nil
+}
+
+// fetchIDPMetadata reads the metadata of an identity provider from a URL
+// or a file
+func fetchIDPMetadata(ctx context.Context, location string) (*saml.EntityDescriptor, error) {
+	var data []byte
+	if strings.HasPrefix(location, "https://") || strings.HasPrefix(location, "http://") {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch IdP metadata: %w", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("failed to fetch IdP metadata: %s", resp.Status)
+		}
+		if data, err = io.ReadAll(io.LimitReader(resp.Body, 1<<20)); err != nil {
+			return nil, fmt.Errorf("failed to read IdP metadata: %w", err)
+		}
+	} else {
+		var err error
+		if data, err = os.ReadFile(location); err != nil {
+			return nil, fmt.Errorf("failed to read IdP metadata: %w", err)
+		}
+	}
+
+	var entity saml.EntityDescriptor
+	if err := xml.Unmarshal(data, &entity); err == nil && len(entity.IDPSSODescriptors) > 0 {
+		return &entity, nil
+	}
+	// Federations publish several entities, use the first identity provider
+	var entities saml.EntitiesDescriptor
+	if err := xml.Unmarshal(data, &entities); err != nil {
+		return nil, fmt.Errorf("failed to parse IdP metadata: %w", err)
+	}
+	for i := range entities.EntityDescriptors {
+		if len(entities.EntityDescriptors[i].IDPSSODescriptors) > 0 {
+			return &entities.EntityDescriptors[i], nil
+		}
+	}
+	return nil, fmt.Errorf("IdP metadata describes no identity provider")
+}
+
+func (p *SAMLProvider) Name() string        { return ProviderSAML }
+func (p *SAMLProvider) DisplayName() string { return p.displayName }
+
+// Metadata is our service provider metadata, for the identity provider
+func (p *SAMLProvider) Metadata() ([]byte, error) {
+	return xml.MarshalIndent(p.sp.Metadata(), "", "  ")
+}
+
+// samlRequestID is the ID of the authentication request of a login, from
+// its PKCE challenge, so its response is matched to the login's verifier
+// without storing anything else in the session
+func samlRequestID(codeChallenge string) string {
+	return "id-" + codeChallenge
+}
+
+// GetAuthURL returns the identity provider's single sign-on URL with an
+// authentication request, relaying state back to the callback
+func (p *SAMLProvider) GetAuthURL(state, codeChallenge string) string {
+	req, err := p.sp.MakeAuthenticationRequest(p.sp.GetSSOBindingLocation(saml.HTTPRedirectBinding), saml.HTTPRedirectBinding, saml.HTTPPostBinding)
+	if err == nil {
+		req.ID = samlRequestID(codeChallenge)
+		var redirect *url.URL
+		if redirect, err = req.Redirect(state, p.sp); err == nil {
+			return redirect.String()
+		}
+	}
+	// Only signing can fail, the identity provider will report the
+	// request as missing
+	return p.sp.GetSSOBindingLocation(saml.HTTPRedirectBinding)
+}
+
+// Authenticate verifies the SAMLResponse the identity provider posted, in
+// place of an authorization code, and that the user it asserts may sign
+// in. There's no OAuth token.
+func (p *SAMLProvider) Authenticate(ctx context.Context, code, codeVerifier string) (*Identity, *oauth2.Token, error) {
+	response, err := base64.StdEncoding.DecodeString(code)
+	if err != nil {
+		return nil, nil, deny(fmt.Errorf("SAMLResponse is not base64: %v", err))
+	}
+	assertion, err := p.sp.ParseXMLResponse(response, []string{samlRequestID(PKCEChallengeS256(codeVerifier))})
+	if err != nil {
+		if invalid, ok := err.(*saml.InvalidResponseError); ok {
+			err = invalid.PrivateErr
+		}
+		return nil, nil, deny(fmt.Errorf("invalid SAML response: %v", err))
+	}
+
+	identity := p.identity(assertion)
+	if identity.Email == "" {
+		return nil, nil, &NotAllowedError{Reason: "SAML assertion has no email"}
+	}
+	_, domain, _ := strings.Cut(strings.ToLower(identity.Email), "@")
+	if !p.allowedDomains[domain] {
+		return nil, nil, &NotAllowedError{Email: identity.Email, Reason: fmt.Sprintf("domain %s is not allowed", domain)}
+	}
+	identity.Group = domain
+	return identity, nil, nil
+}
+
+// identity maps the subject and attributes of an assertion to a user
+func (p *SAMLProvider) identity(assertion *saml.Assertion) *Identity {
+	identity := &Identity{Provider: ProviderSAML}
+	var nameID, nameIDFormat string
+	if assertion.Subject != nil && assertion.Subject.NameID != nil {
+		nameID, nameIDFormat = assertion.Subject.NameID.Value, assertion.Subject.NameID.Format
+	}
+
+	emailAttributes, nameAttributes := samlEmailAttributes, samlNameAttributes
+	if p.emailAttribute != "" {
+		emailAttributes = []string{p.emailAttribute}
+	}
+	if p.nameAttribute != "" {
+		nameAttributes = []string{p.nameAttribute}
+	}
+	identity.Email = samlAttribute(assertion, emailAttributes)
+	if identity.Email == "" && nameIDFormat == string(saml.EmailAddressNameIDFormat) {
+		identity.Email = nameID
+	}
+	identity.Name = samlAttribute(assertion, nameAttributes)
+	if identity.Name == "" {
+		identity.Name = strings.TrimSpace(samlAttribute(assertion, []string{"givenName", "urn:oid:2.5.4.42"}) + " " + samlAttribute(assertion, []string{"sn", "surname", "urn:oid:2.5.4.4"}))
+	}
+
+	// Transient name IDs change every login, the email is steadier
+	identity.Sub = nameID
+	if identity.Sub == "" || nameIDFormat == string(saml.TransientNameIDFormat) {
+		identity.Sub = identity.Email
+	}
+	return identity
+}
+
+// samlAttribute returns the first value of the first of names the assertion
+// has, matched against attribute names and friendly names
+func samlAttribute(assertion *saml.Assertion, names []string) string {
+	for _, name := range names {
+		for _, statement := range assertion.AttributeStatements {
+			for _, attr := range statement.Attributes {
+				if !strings.EqualFold(attr.Name, name) && !strings.EqualFold(attr.FriendlyName, name) {
+					continue
+				}
+				for _, value := range attr.Values {
+					if v := strings.TrimSpace(value.Value); v != "" {
+						return v
+					}
+				}
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/crewjam/saml"
+)
+
+func TestSAMLIdentity(t *testing.T) {
+	attributes := func(pairs ...string) []saml.AttributeStatement {
+		var attrs []saml.Attribute
+		for i := 0; i < len(pairs); i += 2 {
+			attrs = append(attrs, saml.Attribute{Name: pairs[i], Values: []saml.AttributeValue{{Value: pairs[i+1]}}})
+		}
+		return []saml.AttributeStatement{{Attributes: attrs}}
+	}
+	subject := func(format, value string) *saml.Subject {
+		return &saml.Subject{NameID: &saml.NameID{Format: format, Value: value}}
+	}
+
+	tests := []struct {
+		name      string
+		provider  SAMLProvider
+		assertion saml.Assertion
+		want      Identity
+	}{
+		{
+			"Azure AD claims",
+			SAMLProvider{},
+			saml.Assertion{
+				Subject: subject(string(saml.PersistentNameIDFormat), "abc123"),
+				AttributeStatements: attributes(
+					"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/emailaddress", "orpheus@hackclub.com",
+					"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/name", "Orpheus",
+				),
+			},
+			Identity{Provider: ProviderSAML, Sub: "abc123", Email: "orpheus@hackclub.com", Name: "Orpheus"},
+		},
+		{
+			"email name ID, given name and surname",
+			SAMLProvider{},
+			saml.Assertion{
+				Subject:             subject(string(saml.EmailAddressNameIDFormat), "heidi@hackclub.com"),
+				AttributeStatements: attributes("givenName", "Heidi", "sn", "Hacker"),
+			},
+			Identity{Provider: ProviderSAML, Sub: "heidi@hackclub.com", Email: "heidi@hackclub.com", Name: "Heidi Hacker"},
+		},
+		{
+			"transient name ID and configured attributes",
+			SAMLProvider{emailAttribute: "corpMail", nameAttribute: "cn"},
+			saml.Assertion{
+				Subject:             subject(string(saml.TransientNameIDFormat), "_f00"),
+				AttributeStatements: attributes("email", "ignored@example.org", "corpMail", "zach@hackclub.com", "cn", "Zach"),
+			},
+			Identity{Provider: ProviderSAML, Sub: "zach@hackclub.com", Email: "zach@hackclub.com", Name: "Zach"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.provider.identity(&tt.assertion)
+			if *got != tt.want {
+				t.Errorf("identity = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
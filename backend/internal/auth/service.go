@@ -0,0 +1,224 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+)
+
+// ProviderService is the provider of identities of other services calling
+// the API on their own behalf
+const ProviderService = "service"
+
+// ServiceHMACScheme is the Authorization scheme of requests signed with a
+// shared secret:
+//
+//	Authorization: HMAC <service>:<unix time>:<signature>
+//
+// where signature is the hex HMAC-SHA256 of "<METHOD>\n<request URI>\n<unix
+// time>\n<hex SHA-256 of the body>" with the service's secret. Each signature
+// is only accepted once.
+const ServiceHMACScheme = "HMAC"
+
+// serviceMaxSkew is how far the time of a signed request may be from ours
+const serviceMaxSkew = 5 * time.Minute
+
+// serviceMaxBody is the largest body a signed request may have, the upload
+// limit
+const serviceMaxBody = 128 << 20
+
+var (
+	// ErrNoServiceCredentials is returned for requests without service
+	// credentials, which may still have a session
+	ErrNoServiceCredentials = errors.New("no service credentials")
+	// ErrInvalidServiceCredentials is returned for service credentials that
+	// don't verify
+	ErrInvalidServiceCredentials = errors.New("invalid service credentials")
+)
+
+// ServiceAuthenticator verifies requests other services make on their own
+// behalf, signed with a shared secret or bearing a JWT from a trusted
+// issuer for one of the allowed audiences and subjects
+type ServiceAuthenticator struct {
+	secrets   map[string][]byte
+	verifier  *oidc.IDTokenVerifier
+	audiences map[string]bool
+	subjects  map[string]bool
+	now       func() time.Time
+
+	// seen holds the signatures accepted within the skew window, with
+	// when they expire, so none is accepted twice
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+// NewServiceAuthenticator accepts requests signed with secrets, a map of
+// service names to their shared secret
+func NewServiceAuthenticator(secrets map[string]string) *ServiceAuthenticator {
+	a := &ServiceAuthenticator{
+		secrets: make(map[string][]byte),
+		now:     time.Now,
+		seen:    make(map[string]time.Time),
+	}
+	for name, secret := range secrets {
+		a.secrets[name] = []byte(secret)
+	}
+	return a
+}
+
+// TrustIssuer also accepts JWTs signed by the OpenID Connect issuer at
+// issuerURL whose audience is one of audiences and subject one of subjects.
+// The service is the token's subject. Issuers like cloud providers sign
+// tokens for every workload, so the subjects are required.
+func (a *ServiceAuthenticator) TrustIssuer(ctx context.Context, issuerURL string, audiences, subjects []string) error {
+	if len(audiences) == 0 {
+		return fmt.Errorf("at least one allowed audience is required")
+	}
+	if len(subjects) == 0 {
+		return fmt.Errorf("at least one allowed subject is required")
+	}
+	provider, err := oidc.NewProvider(ctx, issuerURL)
+	if err != nil {
+		return fmt.Errorf("failed to get issuer %s: %w", issuerURL, err)
+	}
+	a.verifier = provider.Verifier(&oidc.Config{SkipClientIDCheck: true})
+	a.audiences = make(map[string]bool)
+	for _, aud := range audiences {
+		a.audiences[aud] = true
+	}
+	a.subjects = make(map[string]bool)
+	for _, sub := range subjects {
+		a.subjects[sub] = true
+	}
+	return nil
+}
+
+// Authenticate returns the service that made r, ErrNoServiceCredentials if
+// r has no service credentials
+func (a *ServiceAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	scheme, credentials, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	switch {
+	case strings.EqualFold(scheme, ServiceHMACScheme) && len(a.secrets) > 0:
+		return a.verifySignature(r, credentials)
+	case strings.EqualFold(scheme, "Bearer") && a.verifier != nil:
+		return a.verifyToken(r.Context(), credentials)
+	default:
+		return nil, ErrNoServiceCredentials
+	}
+}
+
+func (a *ServiceAuthenticator) verifySignature(r *http.Request, credentials string) (*Identity, error) {
+	parts := strings.Split(strings.TrimSpace(credentials), ":")
+	if len(parts) != 3 {
+		return nil, ErrInvalidServiceCredentials
+	}
+	name, ts, signature := parts[0], parts[1], parts[2]
+	secret, ok := a.secrets[name]
+	if !ok {
+		return nil, ErrInvalidServiceCredentials
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return nil, ErrInvalidServiceCredentials
+	}
+	if skew := a.now().Sub(time.Unix(unix, 0)); skew > serviceMaxSkew || skew < -serviceMaxSkew {
+		return nil, fmt.Errorf("%w: request time is off by %v", ErrInvalidServiceCredentials, skew.Round(time.Second))
+	}
+	body, err := readBody(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidServiceCredentials, err)
+	}
+	want := SignServiceRequest(secret, r.Method, r.URL.RequestURI(), unix, body)
+	if !hmac.Equal([]byte(signature), []byte(want)) {
+		return nil, ErrInvalidServiceCredentials
+	}
+	if !a.firstUse(name+":"+signature, time.Unix(unix, 0).Add(serviceMaxSkew)) {
+		return nil, fmt.Errorf("%w: signature already used", ErrInvalidServiceCredentials)
+	}
+	return serviceIdentity(name, "hmac"), nil
+}
+
+// firstUse records a signature until it expires, reporting whether it's the
+// first time it's seen
+func (a *ServiceAuthenticator) firstUse(key string, expires time.Time) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := a.now()
+	for k, exp := range a.seen {
+		if now.After(exp) {
+			delete(a.seen, k)
+		}
+	}
+	if _, ok := a.seen[key]; ok {
+		return false
+	}
+	a.seen[key] = expires
+	return true
+}
+
+// readBody reads the body of r to be signed, leaving it in place for the
+// handler
+func readBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, serviceMaxBody+1))
+	r.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read body: %v", err)
+	}
+	if len(body) > serviceMaxBody {
+		return nil, fmt.Errorf("body is over %d bytes", serviceMaxBody)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+func (a *ServiceAuthenticator) verifyToken(ctx context.Context, rawToken string) (*Identity, error) {
+	token, err := a.verifier.Verify(ctx, strings.TrimSpace(rawToken))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidServiceCredentials, err)
+	}
+	if !a.subjects[token.Subject] {
+		return nil, fmt.Errorf("%w: subject %q is not allowed", ErrInvalidServiceCredentials, token.Subject)
+	}
+	for _, aud := range token.Audience {
+		if a.audiences[aud] {
+			return serviceIdentity(token.Subject, "jwt"), nil
+		}
+	}
+	return nil, fmt.Errorf("%w: audience %v is not allowed", ErrInvalidServiceCredentials, token.Audience)
+}
+
+// SignServiceRequest returns the signature of a request with body for the
+// HMAC scheme, for clients and tests
+func SignServiceRequest(secret []byte, method, requestURI string, unix int64, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%s\n%d\n%x", strings.ToUpper(method), requestURI, unix, bodyHash)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// serviceIdentity is the identity of service name. Its email is a
+// pseudo-address so uploads are attributed and rate limited per service.
+func serviceIdentity(name, method string) *Identity {
+	return &Identity{
+		Provider: ProviderService,
+		Sub:      ProviderService + ":" + name,
+		Email:    ProviderService + ":" + name,
+		Name:     name,
+		Group:    method,
+	}
+}
@@ -0,0 +1,122 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	jose "github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+)
+
+func TestServiceAuthenticatorHMAC(t *testing.T) {
+	a := NewServiceAuthenticator(map[string]string{"mailer": "mailer-secret"})
+	now := time.Unix(1700000000, 0)
+	a.now = func() time.Time { return now }
+
+	sign := func(name, secret, method, uri, body string, at time.Time) string {
+		return fmt.Sprintf("HMAC %s:%d:%s", name, at.Unix(), SignServiceRequest([]byte(secret), method, uri, at.Unix(), []byte(body)))
+	}
+	valid := sign("mailer", "mailer-secret", "POST", "/api/assets?preset=web", "image", now)
+
+	// Cases run in order, so "replayed" follows the valid request it repeats
+	tests := []struct {
+		name              string
+		method, uri, body string
+		authorization     string
+		want              error
+	}{
+		{"valid", "POST", "/api/assets?preset=web", "image", valid, nil},
+		{"clock skew", "POST", "/api/assets", "", sign("mailer", "mailer-secret", "POST", "/api/assets", "", now.Add(-2*time.Minute)), nil},
+		{"same time, other request", "GET", "/api/assets", "", sign("mailer", "mailer-secret", "GET", "/api/assets", "", now), nil},
+		{"replayed", "POST", "/api/assets?preset=web", "image", valid, ErrInvalidServiceCredentials},
+		{"no credentials", "POST", "/api/assets", "", "", ErrNoServiceCredentials},
+		{"bearer without issuer", "POST", "/api/assets", "", "Bearer token", ErrNoServiceCredentials},
+		{"other path", "POST", "/api/html/transform", "", sign("mailer", "mailer-secret", "POST", "/api/assets", "", now), ErrInvalidServiceCredentials},
+		{"other method", "DELETE", "/api/assets", "", sign("mailer", "mailer-secret", "POST", "/api/assets", "", now), ErrInvalidServiceCredentials},
+		{"other body", "POST", "/api/assets", "tampered", sign("mailer", "mailer-secret", "POST", "/api/assets", "image", now), ErrInvalidServiceCredentials},
+		{"wrong secret", "POST", "/api/assets", "", sign("mailer", "guess", "POST", "/api/assets", "", now), ErrInvalidServiceCredentials},
+		{"unknown service", "POST", "/api/assets", "", sign("other", "mailer-secret", "POST", "/api/assets", "", now), ErrInvalidServiceCredentials},
+		{"expired", "POST", "/api/assets", "", sign("mailer", "mailer-secret", "POST", "/api/assets", "", now.Add(-time.Hour)), ErrInvalidServiceCredentials},
+		{"malformed", "POST", "/api/assets", "", "HMAC mailer", ErrInvalidServiceCredentials},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.uri, strings.NewReader(tt.body))
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			identity, err := a.Authenticate(r)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("Authenticate = %v, want %v", err, tt.want)
+			}
+			if err == nil && (identity.Provider != ProviderService || identity.Email != "service:mailer") {
+				t.Errorf("identity = %+v", identity)
+			}
+			// The handler still gets the body
+			if body, _ := io.ReadAll(r.Body); string(body) != tt.body {
+				t.Errorf("body after Authenticate = %q, want %q", body, tt.body)
+			}
+		})
+	}
+}
+
+func TestServiceAuthenticatorJWT(t *testing.T) {
+	const issuer = "https://issuer.example.com"
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: key}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewServiceAuthenticator(nil)
+	a.verifier = oidc.NewVerifier(issuer, &oidc.StaticKeySet{PublicKeys: []crypto.PublicKey{&key.PublicKey}}, &oidc.Config{SkipClientIDCheck: true, SupportedSigningAlgs: []string{oidc.ES256}})
+	a.audiences = map[string]bool{"format": true}
+	a.subjects = map[string]bool{"mailer": true}
+
+	token := func(subject, audience string) string {
+		raw, err := jwt.Signed(signer).Claims(jwt.Claims{
+			Issuer:   issuer,
+			Subject:  subject,
+			Audience: jwt.Audience{audience},
+			Expiry:   jwt.NewNumericDate(time.Now().Add(time.Minute)),
+		}).CompactSerialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return raw
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{"valid", token("mailer", "format"), nil},
+		{"other subject", token("some-other-workload", "format"), ErrInvalidServiceCredentials},
+		{"other audience", token("mailer", "elsewhere"), ErrInvalidServiceCredentials},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			identity, err := a.verifyToken(context.Background(), tt.token)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("verifyToken = %v, want %v", err, tt.want)
+			}
+			if err == nil && identity.Email != "service:mailer" {
+				t.Errorf("identity = %+v", identity)
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// slackIssuer is the OpenID Connect issuer of Sign in with Slack
+const slackIssuer = "https://slack.com"
+
+// SlackProvider signs users in with Slack's OpenID Connect, restricted to
+// members of allowed workspaces
+type SlackProvider struct {
+	config       *oauth2.Config
+	verifier     *oidc.IDTokenVerifier
+	allowedTeams map[string]bool
+	firstTeam    string // used for Slack team hint
+}
+
+// SlackClaims are the claims of a Slack ID token. The workspace is in
+// namespaced claims.
+type SlackClaims struct {
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Sub           string `json:"sub"`
+	Name          string `json:"name"`
+	Picture       string `json:"picture"`
+	TeamID        string `json:"https://slack.com/team_id"`
+	TeamDomain    string `json:"https://slack.com/team_domain"`
+}
+
+// NewSlackProvider discovers Slack's OpenID configuration. allowedTeams are
+// workspace IDs (T0123ABCD), which unlike workspace domains can't be renamed.
+func NewSlackProvider(ctx context.Context, clientID, clientSecret, redirectURL string, allowedTeams []string) (*SlackProvider, error) {
+	provider, err := oidc.NewProvider(ctx, slackIssuer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get Slack provider: %w", err)
+	}
+
+	config := &oauth2.Config{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		RedirectURL:  redirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       []string{oidc.ScopeOpenID, "profile", "email"},
+	}
+
+	teamMap := make(map[string]bool)
+	for _, t := range allowedTeams {
+		t = strings.ToUpper(strings.TrimSpace(t))
+		if t != "" {
+			teamMap[t] = true
+		}
+	}
+	if len(teamMap) == 0 {
+		return nil, fmt.Errorf("at least one allowed Slack workspace is required")
+	}
+	var keys []string
+	for k := range teamMap {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return &SlackProvider{
+		config:       config,
+		verifier:     provider.Verifier(&oidc.Config{ClientID: clientID}),
+		allowedTeams: teamMap,
+		firstTeam:    keys[0],
+	}, nil
+}
+
+func (p *SlackProvider) GetAuthURL(state, codeChallenge string) string {
+	return p.config.AuthCodeURL(state,
+		oauth2.SetAuthURLParam("code_challenge", codeChallenge), // PKCE
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"), // PKCE
+		oauth2.SetAuthURLParam("team", p.firstTeam),             // skips the workspace picker
+	)
+}
+
+func (p *SlackProvider) Name() string        { return ProviderSlack }
+func (p *SlackProvider) DisplayName() string { return "Slack" }
+
+// Authenticate exchanges code and verifies the ID token of a member of an
+// allowed workspace
+func (p *SlackProvider) Authenticate(ctx context.Context, code, codeVerifier string) (*Identity, *oauth2.Token, error) {
+	token, err := p.ExchangeCode(ctx, code, codeVerifier)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to exchange code: %w", err)
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, nil, fmt.Errorf("no id_token in response")
+	}
+	claims, err := p.VerifyIDToken(ctx, rawIDToken)
+	if err != nil {
+		return nil, nil, deny(err)
+	}
+	return &Identity{
+		Provider: ProviderSlack,
+		Sub:      claims.Sub,
+		Email:    claims.Email,
+		Name:     claims.Name,
+		Picture:  claims.Picture,
+		Group:    claims.TeamID,
+	}, token, nil
+}
+
+func (p *SlackProvider) ExchangeCode(ctx context.Context, code string, codeVerifier string) (*oauth2.Token, error) {
+	return p.config.Exchange(ctx, code, oauth2.SetAuthURLParam("code_verifier", codeVerifier))
+}
+
+// VerifyIDToken checks the token's signature and that its user belongs to
+// an allowed workspace
+func (p *SlackProvider) VerifyIDToken(ctx context.Context, idToken string) (*SlackClaims, error) {
+	token, err := p.verifier.Verify(ctx, idToken)
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify ID token: %w", err)
+	}
+
+	var claims SlackClaims
+	if err := token.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("failed to parse claims: %w", err)
+	}
+
+	if !claims.EmailVerified {
+		return nil, &NotAllowedError{Email: claims.Email, Reason: "email not verified"}
+	}
+
+	if !p.allowedTeams[strings.ToUpper(claims.TeamID)] {
+		return nil, &NotAllowedError{Email: claims.Email, Reason: fmt.Sprintf("slack workspace %s (%s) is not allowed", claims.TeamID, claims.TeamDomain)}
+	}
+
+	return &claims, nil
+}
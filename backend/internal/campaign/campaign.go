@@ -0,0 +1,453 @@
+// Package campaign sends mail merges: a formatted message whose
+// {{placeholders}} are filled in from the rows of a CSV, sent through the
+// Gmail API one recipient at a time.
+package campaign
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hackclub/format/internal/db"
+	"github.com/hackclub/format/internal/gmail"
+	"github.com/hackclub/format/internal/html"
+	"github.com/hackclub/format/internal/session"
+	"github.com/rs/zerolog"
+)
+
+var (
+	// ErrInvalid is wrapped by the errors of campaigns that can't be saved
+	// or sent as they are
+	ErrInvalid = errors.New("invalid campaign")
+	// ErrSending is returned for changes to campaigns being sent
+	ErrSending = errors.New("the campaign is being sent, pause it first")
+	// ErrDailyLimit pauses campaigns whose mailbox has sent its messages
+	// for the day
+	ErrDailyLimit = errors.New("the mailbox has sent its daily limit of campaign messages, resume tomorrow")
+)
+
+// Sender sends messages from a session's mailbox, the Gmail client
+type Sender interface {
+	Send(ctx context.Context, sessionID string, message []byte) (string, error)
+}
+
+// Exporter builds email messages of transformed HTML, the HTML transformer
+type Exporter interface {
+	Export(ctx context.Context, req *html.ExportRequest) ([]byte, error)
+}
+
+// Config paces and bounds campaigns
+type Config struct {
+	// Interval is the pause between two messages of a mailbox, Gmail
+	// rejects bursts
+	Interval time.Duration
+	// DailyLimit is how many messages a mailbox may send in 24 hours,
+	// across its campaigns
+	DailyLimit    int
+	MaxRecipients int
+	// Backoff is the first wait after Gmail asks to slow down, doubled
+	// while it keeps asking up to maxBackoff
+	Backoff time.Duration
+}
+
+// maxBackoff is the longest a mailbox waits for Gmail to be available again
+const maxBackoff = time.Hour
+
+// mailbox is the queue of the messages a mailbox sends, whichever of its
+// campaigns they're of
+type mailbox struct {
+	// turn is held while a message is sent
+	turn chan struct{}
+	// next is when the next message may be sent, and backoff the wait
+	// after Gmail last asked to slow down
+	next    time.Time
+	backoff time.Duration
+}
+
+// Message is a campaign's message as a recipient gets it
+type Message struct {
+	Row     int    `json:"row"`
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+	HTML    string `json:"html"`
+	Error   string `json:"error,omitempty"` // why it can't be sent
+}
+
+// Service stores campaigns and sends them in the background
+type Service struct {
+	db       *db.DB
+	sender   Sender
+	exporter Exporter
+	cfg      Config
+	logger   zerolog.Logger
+
+	// running holds the cancel of each campaign being sent, and mailboxes
+	// the queue of each owner's mailbox
+	mu        sync.Mutex
+	running   map[string]context.CancelFunc
+	mailboxes map[string]*mailbox
+}
+
+func NewService(database *db.DB, sender Sender, exporter Exporter, cfg Config, logger zerolog.Logger) *Service {
+	if cfg.MaxRecipients <= 0 {
+		cfg.MaxRecipients = 500
+	}
+	if cfg.DailyLimit <= 0 {
+		cfg.DailyLimit = 400
+	}
+	if cfg.Backoff <= 0 {
+		cfg.Backoff = 30 * time.Second
+	}
+	return &Service{db: database, sender: sender, exporter: exporter, cfg: cfg, logger: logger, running: map[string]context.CancelFunc{}, mailboxes: map[string]*mailbox{}}
+}
+
+// Create stores c with the rows of a CSV as its recipients. The column of
+// their addresses and those of the placeholders are guessed from the header
+// unless c sets them.
+func (s *Service) Create(ctx context.Context, c *db.Campaign, r io.Reader) error {
+	columns, rows, err := parseCSV(r, s.cfg.MaxRecipients)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	c.ID = ""
+	c.Columns = columns
+	c.Status = db.CampaignDraft
+	if c.EmailColumn == "" {
+		c.EmailColumn = guessEmailColumn(columns, rows[0])
+	}
+	if c.Mapping == nil {
+		c.Mapping = guessMapping(Placeholders(c.Subject, c.HTML), columns)
+	}
+	if err := validate(c); err != nil {
+		return err
+	}
+	if err := s.db.SaveCampaign(ctx, c); err != nil {
+		return err
+	}
+	recipients := make([]*db.CampaignRecipient, len(rows))
+	for i, row := range rows {
+		recipients[i] = &db.CampaignRecipient{Row: i + 1, Fields: row}
+	}
+	if err := s.db.AddCampaignRecipients(ctx, c.ID, recipients); err != nil {
+		s.db.DeleteCampaign(ctx, c.ID)
+		return err
+	}
+	return nil
+}
+
+// Update saves changes to the message, name or mapping of c
+func (s *Service) Update(ctx context.Context, c *db.Campaign) error {
+	if s.isRunning(c.ID) {
+		return ErrSending
+	}
+	if err := validate(c); err != nil {
+		return err
+	}
+	return s.db.SaveCampaign(ctx, c)
+}
+
+// Delete removes a campaign that isn't being sent
+func (s *Service) Delete(ctx context.Context, c *db.Campaign) error {
+	if s.isRunning(c.ID) {
+		return ErrSending
+	}
+	return s.db.DeleteCampaign(ctx, c.ID)
+}
+
+// validate checks that the columns c refers to exist
+func validate(c *db.Campaign) error {
+	if strings.TrimSpace(c.Subject) == "" || strings.TrimSpace(c.HTML) == "" {
+		return fmt.Errorf("%w: a subject and HTML are required", ErrInvalid)
+	}
+	known := map[string]bool{}
+	for _, column := range c.Columns {
+		known[column] = true
+	}
+	if c.EmailColumn != "" && !known[c.EmailColumn] {
+		return fmt.Errorf("%w: no column %q for the email addresses", ErrInvalid, c.EmailColumn)
+	}
+	for name, column := range c.Mapping {
+		if !known[column] {
+			return fmt.Errorf("%w: no column %q for {{%s}}", ErrInvalid, column, name)
+		}
+	}
+	return nil
+}
+
+// Unmapped returns the placeholders of c that no column fills in
+func Unmapped(c *db.Campaign) []string {
+	unmapped := []string{}
+	for _, name := range Placeholders(c.Subject, c.HTML) {
+		if _, ok := c.Mapping[name]; !ok {
+			unmapped = append(unmapped, name)
+		}
+	}
+	return unmapped
+}
+
+// Render fills in the message of c for recipient r
+func Render(c *db.Campaign, r *db.CampaignRecipient) *Message {
+	values := make(map[string]string, len(c.Mapping))
+	for name, column := range c.Mapping {
+		values[name] = r.Fields[column]
+	}
+	m := &Message{
+		Row:     r.Row,
+		Subject: fill(c.Subject, values, false),
+		HTML:    fill(c.HTML, values, true),
+	}
+	address, err := mail.ParseAddress(r.Fields[c.EmailColumn])
+	switch {
+	case c.EmailColumn == "":
+		m.Error = "no column of email addresses"
+	case err != nil:
+		m.Error = fmt.Sprintf("invalid email address %q", r.Fields[c.EmailColumn])
+	default:
+		m.To = address.String()
+	}
+	return m
+}
+
+// Preview renders the message of c for its first limit recipients
+func (s *Service) Preview(ctx context.Context, c *db.Campaign, limit int) ([]*Message, error) {
+	recipients, err := s.db.ListCampaignRecipients(ctx, c.ID, "")
+	if err != nil {
+		return nil, err
+	}
+	if len(recipients) > limit {
+		recipients = recipients[:limit]
+	}
+	messages := make([]*Message, len(recipients))
+	for i, r := range recipients {
+		messages[i] = Render(c, r)
+	}
+	return messages, nil
+}
+
+// Start sends c from the mailbox of sessionID to the recipients it hasn't
+// been sent to, in the background, as from
+func (s *Service) Start(ctx context.Context, c *db.Campaign, sessionID, from string) error {
+	if unmapped := Unmapped(c); len(unmapped) > 0 {
+		return fmt.Errorf("%w: no column for {{%s}}", ErrInvalid, strings.Join(unmapped, "}}, {{"))
+	}
+	if c.EmailColumn == "" {
+		return fmt.Errorf("%w: no column for the email addresses", ErrInvalid)
+	}
+
+	s.mu.Lock()
+	if _, ok := s.running[c.ID]; ok {
+		s.mu.Unlock()
+		return ErrSending
+	}
+	runCtx, cancel := context.WithCancel(context.WithValue(context.Background(), "user", &session.User{Email: c.Owner, Provider: "google"}))
+	s.running[c.ID] = cancel
+	s.mu.Unlock()
+
+	c.SessionID = sessionID
+	c.Status = db.CampaignSending
+	c.Error = ""
+	if err := s.db.SaveCampaign(ctx, c); err != nil {
+		s.finish(c.ID)
+		return err
+	}
+	// The handler still reads c
+	sending := *c
+	go func() {
+		defer s.finish(sending.ID)
+		s.run(runCtx, &sending, from)
+	}()
+	return nil
+}
+
+// Pause stops sending c after the message being sent, if it's being sent
+func (s *Service) Pause(ctx context.Context, c *db.Campaign) error {
+	s.mu.Lock()
+	cancel, ok := s.running[c.ID]
+	s.mu.Unlock()
+	if ok {
+		// run saves the campaign paused when it stops
+		cancel()
+		c.Status = db.CampaignPaused
+		return nil
+	}
+	if c.Status != db.CampaignSending {
+		return nil
+	}
+	c.Status = db.CampaignPaused
+	return s.db.SaveCampaign(ctx, c)
+}
+
+// Recover pauses the campaigns that were being sent when the server last
+// stopped, their owners resume them
+func (s *Service) Recover(ctx context.Context) error {
+	campaigns, err := s.db.ListCampaigns(ctx, "")
+	if err != nil {
+		return err
+	}
+	for _, c := range campaigns {
+		if c.Status != db.CampaignSending || s.isRunning(c.ID) {
+			continue
+		}
+		c.Status = db.CampaignPaused
+		c.Error = "interrupted by a restart"
+		if err := s.db.SaveCampaign(ctx, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Service) isRunning(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.running[id]
+	return ok
+}
+
+func (s *Service) finish(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cancel, ok := s.running[id]; ok {
+		cancel()
+		delete(s.running, id)
+	}
+}
+
+// run sends c to its pending recipients through its owner's mailbox queue,
+// until they're all done or ctx is canceled. Recipients Gmail turned away
+// for being busy stay pending, and are sent once the mailbox has backed off.
+func (s *Service) run(ctx context.Context, c *db.Campaign, from string) {
+	logger := s.logger.With().Str("campaign", c.ID).Str("email", c.Owner).Logger()
+	// A pause waits for the message being sent, and its bookkeeping
+	save := context.WithoutCancel(ctx)
+
+	status, reason := db.CampaignSent, ""
+	recipients, err := s.db.ListCampaignRecipients(ctx, c.ID, db.RecipientPending)
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to list campaign recipients")
+		status, reason = db.CampaignPaused, "failed to list recipients"
+	}
+	for i := 0; i < len(recipients); {
+		r := recipients[i]
+		err := s.inTurn(ctx, c.Owner, func() error {
+			return s.deliver(save, c, r, from)
+		})
+		if ctx.Err() != nil {
+			status = db.CampaignPaused
+			break
+		}
+		if errors.Is(err, gmail.ErrUnavailable) {
+			logger.Warn().Err(err).Int("row", r.Row).Msg("gmail busy, backing off")
+			continue
+		}
+		if errors.Is(err, gmail.ErrNotConnected) || errors.Is(err, gmail.ErrTokenExpired) || errors.Is(err, gmail.ErrNoAccess) {
+			// Nothing more can be sent until Gmail access is granted again,
+			// the recipient stays pending
+			logger.Warn().Err(err).Msg("campaign paused, gmail access lost")
+			status, reason = db.CampaignPaused, err.Error()
+			break
+		}
+		if err != nil {
+			logger.Warn().Err(err).Msg("campaign paused")
+			status, reason = db.CampaignPaused, err.Error()
+			break
+		}
+		i++
+	}
+
+	c.Status, c.Error = status, reason
+	if err := s.db.SaveCampaign(save, c); err != nil {
+		logger.Error().Err(err).Msg("failed to save campaign")
+	}
+	logger.Info().Str("status", status).Msg("campaign stopped")
+}
+
+// inTurn runs send once it's the turn of owner's mailbox: no other message
+// of it is being sent, the interval since the last one has passed and it's
+// under its daily limit. It returns ctx's error if ctx is canceled first.
+func (s *Service) inTurn(ctx context.Context, owner string, send func() error) error {
+	s.mu.Lock()
+	mb, ok := s.mailboxes[owner]
+	if !ok {
+		mb = &mailbox{turn: make(chan struct{}, 1)}
+		s.mailboxes[owner] = mb
+	}
+	s.mu.Unlock()
+
+	select {
+	case mb.turn <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-mb.turn }()
+
+	if wait := time.Until(mb.next); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	sent, err := s.db.CountCampaignMessages(ctx, owner, time.Now().Add(-24*time.Hour))
+	if err != nil {
+		return err
+	}
+	if sent >= s.cfg.DailyLimit {
+		return ErrDailyLimit
+	}
+
+	err = send()
+	if errors.Is(err, gmail.ErrUnavailable) {
+		mb.backoff = min(max(mb.backoff*2, s.cfg.Backoff), maxBackoff)
+		mb.next = time.Now().Add(mb.backoff)
+		return err
+	}
+	mb.backoff = 0
+	mb.next = time.Now().Add(s.cfg.Interval)
+	return err
+}
+
+// deliver sends the message of c to r and records what came of it, unless
+// it may be sent later: Gmail access was lost or Gmail is busy, whose
+// errors it returns
+func (s *Service) deliver(ctx context.Context, c *db.Campaign, r *db.CampaignRecipient, from string) error {
+	err := s.send(ctx, c, r, from)
+	if errors.Is(err, gmail.ErrNotConnected) || errors.Is(err, gmail.ErrTokenExpired) || errors.Is(err, gmail.ErrNoAccess) || errors.Is(err, gmail.ErrUnavailable) {
+		return err
+	}
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	r.Status, r.Error, r.SentAt = db.RecipientSent, "", &now
+	if err != nil {
+		r.Status, r.Error, r.SentAt = db.RecipientFailed, err.Error(), nil
+		s.logger.Warn().Err(err).Str("campaign", c.ID).Int("row", r.Row).Msg("failed to send campaign message")
+	}
+	if err := s.db.UpdateCampaignRecipient(ctx, r); err != nil {
+		s.logger.Error().Err(err).Str("campaign", c.ID).Int("row", r.Row).Msg("failed to record campaign message")
+	}
+	return nil
+}
+
+// send renders the message of c for r and sends it, recording its Gmail ID
+func (s *Service) send(ctx context.Context, c *db.Campaign, r *db.CampaignRecipient, from string) error {
+	m := Render(c, r)
+	if m.Error != "" {
+		return errors.New(m.Error)
+	}
+	message, err := s.exporter.Export(ctx, &html.ExportRequest{HTML: m.HTML, Subject: m.Subject, From: from, To: m.To})
+	if err != nil {
+		return fmt.Errorf("failed to build email: %w", err)
+	}
+	id, err := s.sender.Send(ctx, c.SessionID, message)
+	if err != nil {
+		return err
+	}
+	r.MessageID = id
+	return nil
+}
@@ -0,0 +1,232 @@
+package campaign
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hackclub/format/internal/db"
+	"github.com/hackclub/format/internal/gmail"
+	"github.com/hackclub/format/internal/html"
+	"github.com/rs/zerolog"
+)
+
+type fakeExporter struct{}
+
+func (fakeExporter) Export(ctx context.Context, req *html.ExportRequest) ([]byte, error) {
+	return []byte("To: " + req.To + "\r\nSubject: " + req.Subject + "\r\n\r\n" + req.HTML), nil
+}
+
+// fakeSender records the messages sent, failing for those to fail
+type fakeSender struct {
+	mu   sync.Mutex
+	sent []string
+	fail map[string]error
+}
+
+func (f *fakeSender) Send(ctx context.Context, sessionID string, message []byte) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for to, err := range f.fail {
+		if strings.Contains(string(message), "To: <"+to+">") {
+			return "", err
+		}
+	}
+	f.sent = append(f.sent, string(message))
+	return "msg-" + sessionID, nil
+}
+
+func TestCampaign(t *testing.T) {
+	ctx := context.Background()
+	database, err := db.Open(ctx, filepath.Join(t.TempDir(), "format.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	sender := &fakeSender{fail: map[string]error{"heidi@hackclub.com": errors.New("rate limited")}}
+	service := NewService(database, sender, fakeExporter{}, Config{Interval: time.Millisecond, MaxRecipients: 3}, zerolog.Nop())
+
+	csv := "\ufeffName,E-mail,Team\n" +
+		"Orpheus,orpheus@hackclub.com,<Dinos>\n" +
+		"\n" +
+		"Heidi,heidi@hackclub.com,Hedgehogs\n" +
+		"Nobody,not-an-address,\n"
+	c := &db.Campaign{Owner: "zach@hackclub.com", SessionID: "session-1", Subject: "Hi {{name}}", HTML: "<p>Go {{ Team }}, {{rank}}!</p>"}
+	if err := service.Create(ctx, c, strings.NewReader(csv)); err != nil {
+		t.Fatal(err)
+	}
+	if c.EmailColumn != "E-mail" || c.Mapping["name"] != "Name" || c.Mapping["Team"] != "Team" {
+		t.Errorf("guessed email column %q, mapping %v", c.EmailColumn, c.Mapping)
+	}
+	if got := Unmapped(c); len(got) != 1 || got[0] != "rank" {
+		t.Errorf("Unmapped = %v, want [rank]", got)
+	}
+	if err := service.Start(ctx, c, "session-1", "zach@hackclub.com"); !errors.Is(err, ErrInvalid) {
+		t.Errorf("Start(unmapped) error = %v, want ErrInvalid", err)
+	}
+
+	c.Mapping["rank"] = "Name"
+	if err := service.Update(ctx, c); err != nil {
+		t.Fatal(err)
+	}
+	messages, err := service.Preview(ctx, c, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 3 {
+		t.Fatalf("Preview = %d messages, want 3", len(messages))
+	}
+	if m := messages[0]; m.To != "<orpheus@hackclub.com>" || m.Subject != "Hi Orpheus" || m.HTML != "<p>Go &lt;Dinos&gt;, Orpheus!</p>" {
+		t.Errorf("Preview[0] = %+v", m)
+	}
+	if m := messages[2]; m.To != "" || m.Error == "" {
+		t.Errorf("Preview[2] = %+v, want an invalid address", m)
+	}
+
+	if err := service.Start(ctx, c, "session-2", "zach@hackclub.com"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, service, c.ID)
+	got, err := database.GetCampaign(ctx, c.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != db.CampaignSent || got.SessionID != "session-2" {
+		t.Errorf("campaign = %+v, want sent with the new session", got)
+	}
+	recipients, err := database.ListCampaignRecipients(ctx, c.ID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var statuses []string
+	for _, r := range recipients {
+		statuses = append(statuses, r.Status)
+	}
+	if strings.Join(statuses, ",") != "sent,failed,failed" || recipients[0].MessageID != "msg-session-2" || recipients[0].SentAt == nil {
+		t.Errorf("recipients = %v, first %+v", statuses, recipients[0])
+	}
+	if len(sender.sent) != 1 {
+		t.Errorf("sent %d messages, want 1", len(sender.sent))
+	}
+
+	// Losing Gmail access pauses the campaign, leaving the recipient pending
+	sender.fail = map[string]error{"orpheus@hackclub.com": gmail.ErrTokenExpired}
+	recipients[0].Status = db.RecipientPending
+	if err := database.UpdateCampaignRecipient(ctx, recipients[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := service.Start(ctx, c, "session-2", "zach@hackclub.com"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, service, c.ID)
+	got, _ = database.GetCampaign(ctx, c.ID)
+	pending, _ := database.ListCampaignRecipients(ctx, c.ID, db.RecipientPending)
+	if got.Status != db.CampaignPaused || got.Error == "" || len(pending) != 1 {
+		t.Errorf("campaign = %+v with %d pending, want paused with 1", got, len(pending))
+	}
+
+	if err := service.Create(ctx, &db.Campaign{Subject: "s", HTML: "h"}, strings.NewReader("email\na@b.c\nd@e.f\ng@h.i\nj@k.l\n")); !errors.Is(err, ErrInvalid) {
+		t.Errorf("Create(too many rows) error = %v, want ErrInvalid", err)
+	}
+}
+
+// waitFor waits until the campaign is no longer being sent
+func waitFor(t *testing.T, s *Service, id string) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); s.isRunning(id); {
+		if time.Now().After(deadline) {
+			t.Fatal("campaign still sending")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// pacedSender records when messages are sent, turning the first busy ones
+// away
+type pacedSender struct {
+	mu   sync.Mutex
+	sent []time.Time
+	busy int
+}
+
+func (f *pacedSender) Send(ctx context.Context, sessionID string, message []byte) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.busy > 0 {
+		f.busy--
+		return "", fmt.Errorf("%w: rate limited", gmail.ErrUnavailable)
+	}
+	f.sent = append(f.sent, time.Now())
+	return "msg", nil
+}
+
+func TestCampaignMailboxQueue(t *testing.T) {
+	ctx := context.Background()
+	database, err := db.Open(ctx, filepath.Join(t.TempDir(), "format.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	const interval = 20 * time.Millisecond
+	sender := &pacedSender{busy: 2}
+	service := NewService(database, sender, fakeExporter{}, Config{Interval: interval, DailyLimit: 3, Backoff: time.Millisecond}, zerolog.Nop())
+
+	// Two campaigns of one mailbox, sent at once
+	var campaigns []*db.Campaign
+	for _, name := range []string{"first", "second"} {
+		c := &db.Campaign{Owner: "zach@hackclub.com", Name: name, Subject: "Hi", HTML: "<p>Hi</p>"}
+		if err := service.Create(ctx, c, strings.NewReader("email\na@hackclub.com\nb@hackclub.com\n")); err != nil {
+			t.Fatal(err)
+		}
+		campaigns = append(campaigns, c)
+	}
+	for _, c := range campaigns {
+		if err := service.Start(ctx, c, "session-1", "zach@hackclub.com"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, c := range campaigns {
+		waitFor(t, service, c.ID)
+	}
+
+	// Gmail being busy left the recipients pending, and the daily limit
+	// counts both campaigns
+	if len(sender.sent) != 3 {
+		t.Fatalf("sent %d messages, want the daily limit of 3", len(sender.sent))
+	}
+	for i := 1; i < len(sender.sent); i++ {
+		if gap := sender.sent[i].Sub(sender.sent[i-1]); gap < interval {
+			t.Errorf("messages %d and %d sent %v apart, want at least %v", i-1, i, gap, interval)
+		}
+	}
+	var pending, failed int
+	var limited *db.Campaign
+	for _, c := range campaigns {
+		recipients, err := database.ListCampaignRecipients(ctx, c.ID, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range recipients {
+			switch r.Status {
+			case db.RecipientPending:
+				pending++
+			case db.RecipientFailed:
+				failed++
+			}
+		}
+		got, _ := database.GetCampaign(ctx, c.ID)
+		if got.Status == db.CampaignPaused && got.Error == ErrDailyLimit.Error() {
+			limited = got
+		}
+	}
+	if pending != 1 || failed != 0 || limited == nil {
+		t.Errorf("%d pending, %d failed, paused for the limit %v, want 1 pending and a campaign paused", pending, failed, limited)
+	}
+}
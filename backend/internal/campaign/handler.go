@@ -0,0 +1,298 @@
+package campaign
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/hackclub/format/internal/db"
+	"github.com/hackclub/format/internal/session"
+	"github.com/rs/zerolog"
+)
+
+// maxUploadBytes bounds a campaign's CSV and HTML
+const maxUploadBytes = 4 << 20
+
+// Handler serves the campaigns of the signed-in user under /api/campaigns
+type Handler struct {
+	service  *Service
+	sessions *session.Manager
+	logger   zerolog.Logger
+}
+
+func NewHandler(service *Service, sessions *session.Manager, logger zerolog.Logger) *Handler {
+	return &Handler{service: service, sessions: sessions, logger: logger}
+}
+
+// summary is a campaign with where its sending stands
+type summary struct {
+	*db.Campaign
+	Placeholders []string       `json:"placeholders"`
+	Unmapped     []string       `json:"unmapped"`
+	Recipients   map[string]int `json:"recipients"` // by status, and the total
+}
+
+func (h *Handler) summarize(r *http.Request, c *db.Campaign) (*summary, error) {
+	recipients, err := h.service.db.ListCampaignRecipients(r.Context(), c.ID, "")
+	if err != nil {
+		return nil, err
+	}
+	counts := map[string]int{db.RecipientPending: 0, db.RecipientSent: 0, db.RecipientFailed: 0, "total": len(recipients)}
+	for _, recipient := range recipients {
+		counts[recipient.Status]++
+	}
+	return &summary{Campaign: c, Placeholders: Placeholders(c.Subject, c.HTML), Unmapped: Unmapped(c), Recipients: counts}, nil
+}
+
+// campaign loads the campaign of the URL, writing an error unless the user
+// owns it
+func (h *Handler) campaign(w http.ResponseWriter, r *http.Request) *db.Campaign {
+	user, _ := r.Context().Value("user").(*session.User)
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil
+	}
+	c, err := h.service.db.GetCampaign(r.Context(), chi.URLParam(r, "id"))
+	if errors.Is(err, db.ErrNotFound) || (err == nil && !strings.EqualFold(c.Owner, user.Email)) {
+		http.Error(w, "Campaign not found", http.StatusNotFound)
+		return nil
+	}
+	if err != nil {
+		h.logger.Error().Err(err).Msg("failed to get campaign")
+		http.Error(w, "Failed to get campaign", http.StatusInternalServerError)
+		return nil
+	}
+	return c
+}
+
+// HandleList lists the user's campaigns, newest first
+func (h *Handler) HandleList(w http.ResponseWriter, r *http.Request) {
+	user, _ := r.Context().Value("user").(*session.User)
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	campaigns, err := h.service.db.ListCampaigns(r.Context(), strings.ToLower(user.Email))
+	if err != nil {
+		h.logger.Error().Err(err).Msg("failed to list campaigns")
+		http.Error(w, "Failed to list campaigns", http.StatusInternalServerError)
+		return
+	}
+	h.writeJSON(w, http.StatusOK, map[string]interface{}{"campaigns": campaigns})
+}
+
+// HandleCreate creates a campaign of a multipart form: the recipients' CSV
+// as "csv", with "subject", "html" (transformed), "name" and optionally
+// "email_column" and "mapping", a JSON object of placeholders to columns
+func (h *Handler) HandleCreate(w http.ResponseWriter, r *http.Request) {
+	user, _ := r.Context().Value("user").(*session.User)
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadBytes)
+	if err := r.ParseMultipartForm(maxUploadBytes); err != nil {
+		http.Error(w, "Invalid form, expected multipart/form-data", http.StatusBadRequest)
+		return
+	}
+	file, _, err := r.FormFile("csv")
+	if err != nil {
+		http.Error(w, "A CSV of recipients is required", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	c := &db.Campaign{
+		Owner:       strings.ToLower(user.Email),
+		SessionID:   h.sessions.SessionID(r),
+		Name:        r.FormValue("name"),
+		Subject:     r.FormValue("subject"),
+		HTML:        r.FormValue("html"),
+		EmailColumn: r.FormValue("email_column"),
+	}
+	if mapping := r.FormValue("mapping"); mapping != "" {
+		if err := json.Unmarshal([]byte(mapping), &c.Mapping); err != nil {
+			http.Error(w, "Invalid mapping, expected a JSON object of placeholders to columns", http.StatusBadRequest)
+			return
+		}
+	}
+	if c.Name == "" {
+		c.Name = c.Subject
+	}
+	if err := h.service.Create(r.Context(), c, file); err != nil {
+		h.writeError(w, err, "create")
+		return
+	}
+	h.logger.Info().Str("campaign", c.ID).Str("email", c.Owner).Int("columns", len(c.Columns)).Msg("campaign created")
+	h.writeSummary(w, r, http.StatusCreated, c)
+}
+
+// HandleGet returns a campaign, its placeholders and how many recipients
+// it's been sent to
+func (h *Handler) HandleGet(w http.ResponseWriter, r *http.Request) {
+	if c := h.campaign(w, r); c != nil {
+		h.writeSummary(w, r, http.StatusOK, c)
+	}
+}
+
+// HandleUpdate changes the name, subject, HTML, email column or mapping of
+// a campaign that isn't being sent. Fields left out are kept.
+func (h *Handler) HandleUpdate(w http.ResponseWriter, r *http.Request) {
+	c := h.campaign(w, r)
+	if c == nil {
+		return
+	}
+	var req struct {
+		Name        *string           `json:"name"`
+		Subject     *string           `json:"subject"`
+		HTML        *string           `json:"html"`
+		EmailColumn *string           `json:"email_column"`
+		Mapping     map[string]string `json:"mapping"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxUploadBytes)).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.Name != nil {
+		c.Name = *req.Name
+	}
+	if req.Subject != nil {
+		c.Subject = *req.Subject
+	}
+	if req.HTML != nil {
+		c.HTML = *req.HTML
+	}
+	if req.EmailColumn != nil {
+		c.EmailColumn = *req.EmailColumn
+	}
+	if req.Mapping != nil {
+		c.Mapping = req.Mapping
+	}
+	if err := h.service.Update(r.Context(), c); err != nil {
+		h.writeError(w, err, "update")
+		return
+	}
+	h.writeSummary(w, r, http.StatusOK, c)
+}
+
+// HandleDelete removes a campaign that isn't being sent
+func (h *Handler) HandleDelete(w http.ResponseWriter, r *http.Request) {
+	c := h.campaign(w, r)
+	if c == nil {
+		return
+	}
+	if err := h.service.Delete(r.Context(), c); err != nil {
+		h.writeError(w, err, "delete")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandlePreview renders the message of a campaign for its first ?limit=
+// recipients (3 by default)
+func (h *Handler) HandlePreview(w http.ResponseWriter, r *http.Request) {
+	limit := 3
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > 50 {
+			http.Error(w, "Invalid limit, expected 1 to 50", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	c := h.campaign(w, r)
+	if c == nil {
+		return
+	}
+	messages, err := h.service.Preview(r.Context(), c, limit)
+	if err != nil {
+		h.writeError(w, err, "preview")
+		return
+	}
+	h.writeJSON(w, http.StatusOK, map[string]interface{}{"messages": messages, "unmapped": Unmapped(c)})
+}
+
+// HandleRecipients lists the recipients of a campaign and what came of
+// sending to them, only those of ?status= if given
+func (h *Handler) HandleRecipients(w http.ResponseWriter, r *http.Request) {
+	c := h.campaign(w, r)
+	if c == nil {
+		return
+	}
+	status := r.URL.Query().Get("status")
+	switch status {
+	case "", db.RecipientPending, db.RecipientSent, db.RecipientFailed:
+	default:
+		http.Error(w, "Invalid status, expected pending, sent or failed", http.StatusBadRequest)
+		return
+	}
+	recipients, err := h.service.db.ListCampaignRecipients(r.Context(), c.ID, status)
+	if err != nil {
+		h.writeError(w, err, "list recipients of")
+		return
+	}
+	h.writeJSON(w, http.StatusOK, map[string]interface{}{"recipients": recipients})
+}
+
+// HandleSend starts sending a campaign to the recipients it hasn't been sent
+// to, from the user's mailbox. It needs the compose scope.
+func (h *Handler) HandleSend(w http.ResponseWriter, r *http.Request) {
+	c := h.campaign(w, r)
+	if c == nil {
+		return
+	}
+	user, _ := r.Context().Value("user").(*session.User)
+	from := (&mail.Address{Name: user.Name, Address: user.Email}).String()
+	if err := h.service.Start(r.Context(), c, h.sessions.SessionID(r), from); err != nil {
+		h.writeError(w, err, "send")
+		return
+	}
+	h.logger.Info().Str("campaign", c.ID).Str("email", c.Owner).Msg("campaign sending")
+	h.writeSummary(w, r, http.StatusAccepted, c)
+}
+
+// HandlePause stops sending a campaign, it's resumed by sending it again
+func (h *Handler) HandlePause(w http.ResponseWriter, r *http.Request) {
+	c := h.campaign(w, r)
+	if c == nil {
+		return
+	}
+	if err := h.service.Pause(r.Context(), c); err != nil {
+		h.writeError(w, err, "pause")
+		return
+	}
+	h.writeSummary(w, r, http.StatusOK, c)
+}
+
+func (h *Handler) writeSummary(w http.ResponseWriter, r *http.Request, status int, c *db.Campaign) {
+	s, err := h.summarize(r, c)
+	if err != nil {
+		h.writeError(w, err, "get")
+		return
+	}
+	h.writeJSON(w, status, s)
+}
+
+func (h *Handler) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (h *Handler) writeError(w http.ResponseWriter, err error, action string) {
+	switch {
+	case errors.Is(err, ErrInvalid):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrSending):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		h.logger.Error().Err(err).Msgf("failed to %s campaign", action)
+		http.Error(w, fmt.Sprintf("Failed to %s campaign", action), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,135 @@
+package campaign
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	stdhtml "html"
+	"io"
+	"net/mail"
+	"regexp"
+	"strings"
+)
+
+// placeholderRegex matches {{name}}, the placeholders of the footer too
+var placeholderRegex = regexp.MustCompile(`\{\{\s*([A-Za-z0-9_.-]+)\s*\}\}`)
+
+// Placeholders returns the names of the {{placeholders}} in texts, each once,
+// in order of appearance
+func Placeholders(texts ...string) []string {
+	seen := map[string]bool{}
+	names := []string{}
+	for _, text := range texts {
+		for _, m := range placeholderRegex.FindAllStringSubmatch(text, -1) {
+			if !seen[m[1]] {
+				seen[m[1]] = true
+				names = append(names, m[1])
+			}
+		}
+	}
+	return names
+}
+
+// fill replaces the placeholders of text with their values, HTML-escaped if
+// escape. Placeholders without a value are left as they are.
+func fill(text string, values map[string]string, escape bool) string {
+	return placeholderRegex.ReplaceAllStringFunc(text, func(m string) string {
+		value, ok := values[placeholderRegex.FindStringSubmatch(m)[1]]
+		if !ok {
+			return m
+		}
+		if escape {
+			return stdhtml.EscapeString(value)
+		}
+		return value
+	})
+}
+
+// parseCSV reads the header and up to max rows of a CSV, keyed by header.
+// Blank rows are skipped.
+func parseCSV(r io.Reader, max int) ([]string, []map[string]string, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if errors.Is(err, io.EOF) {
+		return nil, nil, fmt.Errorf("the CSV is empty")
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid CSV: %w", err)
+	}
+	seen := map[string]bool{}
+	for i, column := range header {
+		column = strings.TrimSpace(strings.TrimPrefix(column, "\ufeff"))
+		if column == "" {
+			return nil, nil, fmt.Errorf("column %d has no name", i+1)
+		}
+		if seen[column] {
+			return nil, nil, fmt.Errorf("duplicate column %q", column)
+		}
+		seen[column] = true
+		header[i] = column
+	}
+
+	var rows []map[string]string
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid CSV: %w", err)
+		}
+		if len(record) == 1 && strings.TrimSpace(record[0]) == "" {
+			continue
+		}
+		if len(rows) == max {
+			return nil, nil, fmt.Errorf("the CSV has more than %d rows", max)
+		}
+		row := make(map[string]string, len(header))
+		for i, column := range header {
+			if i < len(record) {
+				row[column] = strings.TrimSpace(record[i])
+			} else {
+				row[column] = ""
+			}
+		}
+		rows = append(rows, row)
+	}
+	if len(rows) == 0 {
+		return nil, nil, fmt.Errorf("the CSV has no rows")
+	}
+	return header, rows, nil
+}
+
+// guessEmailColumn returns the column named like an email address, or else
+// the first one the first row has an address in
+func guessEmailColumn(columns []string, first map[string]string) string {
+	for _, column := range columns {
+		switch strings.ToLower(strings.NewReplacer(" ", "", "-", "", "_", "").Replace(column)) {
+		case "email", "emailaddress", "mail":
+			return column
+		}
+	}
+	for _, column := range columns {
+		if _, err := mail.ParseAddress(first[column]); err == nil {
+			return column
+		}
+	}
+	return ""
+}
+
+// guessMapping maps each placeholder to the column of the same name, ignoring
+// case
+func guessMapping(placeholders, columns []string) map[string]string {
+	mapping := map[string]string{}
+	for _, name := range placeholders {
+		for _, column := range columns {
+			if strings.EqualFold(name, column) {
+				mapping[name] = column
+				break
+			}
+		}
+	}
+	return mapping
+}
@@ -1,8 +1,10 @@
 package config
 
 import (
+	"net/netip"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
 
@@ -16,15 +18,126 @@ type Config struct {
 	GoogleOAuthClientID string
 	GoogleOAuthClientSecret string
 	AllowedDomains  []string
+	AllowedEmails   []string
+	AllowedGroups   []string
+	GoogleGroupsCredentialsFile string
+	GoogleGroupsAdminEmail string
+	GmailPubSubTopic string // formats labeled drafts on push notifications when set
+	GmailWatchLabel string
+	GmailPushAudience string
+	GmailPushServiceAccount string
+	CampaignSendIntervalSeconds int // pause between two messages of a mailbox's mail merges
+	CampaignDailyLimit int // messages a mailbox's mail merges may send in 24 hours
+	CampaignMaxRecipients int
+	SlackClientID   string
+	SlackClientSecret string
+	SlackAllowedTeams []string
+	GitHubClientID  string
+	GitHubClientSecret string
+	GitHubAllowedOrgs []string
+	OIDCIssuerURL   string
+	OIDCClientID    string
+	OIDCClientSecret string
+	OIDCDisplayName string
+	OIDCAllowedDomains []string
+	SAMLIDPMetadataURL string
+	SAMLEntityID    string
+	SAMLCertFile    string
+	SAMLKeyFile     string
+	SAMLDisplayName string
+	SAMLAllowedDomains []string
+	SAMLEmailAttribute string
+	SAMLNameAttribute string
+	ServiceHMACSecrets []string // name:secret pairs
+	ServiceJWTIssuer string
+	ServiceJWTAudiences []string
+	ServiceJWTSubjects []string
+	JWTSigningKeys  []string // PEM key files, the first signs
+	JWTTTLMinutes   int
+	AdminEmails     []string
 	JPEGQuality     int
+	WebPQuality     int
+	MaxImageDimension int
+	SkipProcessingBytes int
+	ProcessingWorkers int
+	ProcessingMemoryBudgetMB int
+	PDFDPI          int
+	ProcessingTimeoutSeconds int
+	DefaultPreset   string
 	JPEGProgressive bool
 	PNGStrip        bool
+	PNGInterlace    bool
+	PNGLevel        int
+	PNGQuantize     bool
+	QuantizeQuality int
+	GIFToWebP       bool
+	MetadataKeepICC bool
+	MetadataKeepCopyright bool
+	WatermarkImage  string
+	WatermarkText   string
+	WatermarkPosition string
+	WatermarkOpacity float64
 	R2AccountID     string
 	R2AccessKeyID   string
 	R2SecretAccessKey string
 	R2Bucket        string
 	R2PublicBaseURL string
 	R2S3Endpoint    string
+	StorageBackend  string
+	StorageRegion   string
+	LocalStorageDir string
+	PrivateBucket   string // bucket of originals and quarantined images
+	LocalPrivateDir string
+	FrontendDir     string
+	StorageInsecureTLS bool
+	StorageSSE      string
+	StorageSSEKMSKeyID string
+	StorageObjectLockMode string
+	StorageObjectLockDays int
+	StorageObjectTagging bool
+	PresignedURLTTLMinutes int
+	CacheMaxAgeImages int
+	CacheMaxAgeDocuments int
+	CacheMaxAgeEphemeral int
+	SignedURLSecret string
+	SignedURLTTLHours int
+	ImageSizes      []int // widths and heights /i/ and /img/ render without a signed URL
+	DatabaseURL     string
+	RateLimitUploadsPerMinute int
+	RateLimitUploadsBurst int
+	RateLimitTransformsPerMinute int
+	RateLimitTransformsBurst int
+	RateLimitAPIPerMinute int
+	RateLimitAPIBurst int
+	RateLimitGmailPerMinute int
+	RateLimitGmailBurst int
+	RateLimitAuthPerMinute int
+	RateLimitAuthBurst int
+	RateLimitImagesPerMinute int
+	RateLimitImagesBurst int
+	TrustedProxies  []netip.Prefix // peers whose X-Forwarded-For/X-Real-IP are believed
+	GCRetentionDays int
+	GCIntervalHours int
+	ExpirySweepMinutes int
+	AnalyticsIngestToken string
+	MetricsToken    string // bearer token of /metrics, unserved without one
+	WebhookURLs     []string
+	WebhookSecret   string
+	KeyNamespace    string
+	RetainOriginals bool
+	DedupCacheSize  int
+	DedupCacheTTLMinutes int
+	RedisURL        string
+	ClamAVAddress   string
+	ModerationURL   string
+	ModerationToken string
+	ModerationAction string
+	ModerationFailOpen bool
+	FooterTemplate  string
+	FooterOrgName   string
+	FooterAddress   string
+	FooterUnsubscribeURL string
+	AllowedClasses  []string
 }
 
 func Load() *Config {
@@ -42,15 +155,126 @@ func Load() *Config {
 		GoogleOAuthClientID: getEnv("GOOGLE_OAUTH_CLIENT_ID", ""),
 		GoogleOAuthClientSecret: getEnv("GOOGLE_OAUTH_CLIENT_SECRET", ""),
 		AllowedDomains:  strings.Split(getEnv("ALLOWED_DOMAINS", "hackclub.com"), ","),
+		AllowedEmails:   getEnvList("ALLOWED_EMAILS", ""),
+		AllowedGroups:   getEnvList("ALLOWED_GROUPS", ""),
+		GoogleGroupsCredentialsFile: getEnv("GOOGLE_GROUPS_CREDENTIALS_FILE", ""),
+		GoogleGroupsAdminEmail: getEnv("GOOGLE_GROUPS_ADMIN_EMAIL", ""),
+		GmailPubSubTopic: getEnv("GMAIL_PUBSUB_TOPIC", ""),
+		GmailWatchLabel: getEnv("GMAIL_WATCH_LABEL", "Format"),
+		GmailPushAudience: getEnv("GMAIL_PUSH_AUDIENCE", ""),
+		GmailPushServiceAccount: getEnv("GMAIL_PUSH_SERVICE_ACCOUNT", ""),
+		CampaignSendIntervalSeconds: getEnvInt("CAMPAIGN_SEND_INTERVAL_SECONDS", 2),
+		CampaignDailyLimit: getEnvInt("CAMPAIGN_DAILY_LIMIT", 400),
+		CampaignMaxRecipients: getEnvInt("CAMPAIGN_MAX_RECIPIENTS", 500),
+		SlackClientID:   getEnv("SLACK_CLIENT_ID", ""),
+		SlackClientSecret: getEnv("SLACK_CLIENT_SECRET", ""),
+		SlackAllowedTeams: getEnvList("SLACK_ALLOWED_TEAMS", ""),
+		GitHubClientID:  getEnv("GITHUB_CLIENT_ID", ""),
+		GitHubClientSecret: getEnv("GITHUB_CLIENT_SECRET", ""),
+		GitHubAllowedOrgs: getEnvList("GITHUB_ALLOWED_ORGS", ""),
+		OIDCIssuerURL:   getEnv("OIDC_ISSUER_URL", ""),
+		OIDCClientID:    getEnv("OIDC_CLIENT_ID", ""),
+		OIDCClientSecret: getEnv("OIDC_CLIENT_SECRET", ""),
+		OIDCDisplayName: getEnv("OIDC_DISPLAY_NAME", "SSO"),
+		OIDCAllowedDomains: getEnvList("OIDC_ALLOWED_DOMAINS", ""),
+		SAMLIDPMetadataURL: getEnv("SAML_IDP_METADATA_URL", ""),
+		SAMLEntityID:    getEnv("SAML_ENTITY_ID", ""),
+		SAMLCertFile:    getEnv("SAML_CERT_FILE", ""),
+		SAMLKeyFile:     getEnv("SAML_KEY_FILE", ""),
+		SAMLDisplayName: getEnv("SAML_DISPLAY_NAME", "SAML SSO"),
+		SAMLAllowedDomains: getEnvList("SAML_ALLOWED_DOMAINS", ""),
+		SAMLEmailAttribute: getEnv("SAML_EMAIL_ATTRIBUTE", ""),
+		SAMLNameAttribute: getEnv("SAML_NAME_ATTRIBUTE", ""),
+		ServiceHMACSecrets: getEnvList("SERVICE_HMAC_SECRETS", ""),
+		ServiceJWTIssuer: getEnv("SERVICE_JWT_ISSUER", ""),
+		ServiceJWTAudiences: getEnvList("SERVICE_JWT_AUDIENCES", ""),
+		ServiceJWTSubjects: getEnvList("SERVICE_JWT_SUBJECTS", ""),
+		JWTSigningKeys:  getEnvList("JWT_SIGNING_KEYS", ""),
+		JWTTTLMinutes:   getEnvInt("JWT_TTL_MINUTES", 15),
+		AdminEmails:     getEnvList("ADMIN_EMAILS", ""),
 		JPEGQuality:     getEnvInt("JPEG_QUALITY", 84),
+		WebPQuality:     getEnvInt("WEBP_QUALITY", 80),
+		MaxImageDimension: getEnvInt("MAX_IMAGE_DIMENSION", 3840),
+		SkipProcessingBytes: getEnvInt("SKIP_PROCESSING_BYTES", 1024*1024),
+		ProcessingWorkers: getEnvInt("PROCESSING_WORKERS", runtime.NumCPU()),
+		ProcessingMemoryBudgetMB: getEnvInt("PROCESSING_MEMORY_BUDGET_MB", 1024),
+		PDFDPI:          getEnvInt("PDF_DPI", 150),
+		ProcessingTimeoutSeconds: getEnvInt("PROCESSING_TIMEOUT_SECONDS", 60),
+		DefaultPreset:   getEnv("DEFAULT_PRESET", "web"),
 		JPEGProgressive: getEnvBool("JPEG_PROGRESSIVE", true),
 		PNGStrip:        getEnvBool("PNG_STRIP", true),
+		PNGInterlace:    getEnvBool("PNG_INTERLACE", false),
+		PNGLevel:        getEnvInt("PNG_OPTIMIZATION_LEVEL", 4),
+		PNGQuantize:     getEnvBool("PNG_QUANTIZE", false),
+		QuantizeQuality: getEnvInt("PNG_QUANTIZE_MIN_QUALITY", 70),
+		GIFToWebP:       getEnvBool("GIF_TO_WEBP", false),
+		MetadataKeepICC: getEnvBool("METADATA_KEEP_ICC", true),
+		MetadataKeepCopyright: getEnvBool("METADATA_KEEP_COPYRIGHT", false),
+		WatermarkImage:  getEnv("WATERMARK_IMAGE", ""),
+		WatermarkText:   getEnv("WATERMARK_TEXT", ""),
+		WatermarkPosition: getEnv("WATERMARK_POSITION", "bottom-right"),
+		WatermarkOpacity: getEnvFloat("WATERMARK_OPACITY", 0.5),
 		R2AccountID:     getEnv("R2_ACCOUNT_ID", ""),
 		R2AccessKeyID:   getEnv("R2_ACCESS_KEY_ID", ""),
 		R2SecretAccessKey: getEnv("R2_SECRET_ACCESS_KEY", ""),
 		R2Bucket:        getEnv("R2_BUCKET", "format-assets"),
 		R2PublicBaseURL: getEnv("R2_PUBLIC_BASE_URL", "https://i.format.hackclub.com"),
 		R2S3Endpoint:    getEnv("R2_S3_ENDPOINT", ""),
+		StorageBackend:  getEnv("STORAGE_BACKEND", "r2"),
+		StorageRegion:   getEnv("STORAGE_REGION", "us-east-1"),
+		LocalStorageDir: getEnv("LOCAL_STORAGE_DIR", "data/assets"),
+		PrivateBucket:   getEnv("PRIVATE_BUCKET", ""),
+		LocalPrivateDir: getEnv("LOCAL_PRIVATE_DIR", "data/private"),
+		FrontendDir:     getEnv("FRONTEND_DIR", ""),
+		StorageInsecureTLS: getEnvBool("STORAGE_INSECURE_TLS", false),
+		StorageSSE:      getEnv("STORAGE_SSE", ""),
+		StorageSSEKMSKeyID: getEnv("STORAGE_SSE_KMS_KEY_ID", ""),
+		StorageObjectLockMode: getEnv("STORAGE_OBJECT_LOCK_MODE", ""),
+		StorageObjectLockDays: getEnvInt("STORAGE_OBJECT_LOCK_DAYS", 0),
+		StorageObjectTagging: getEnvBool("STORAGE_OBJECT_TAGGING", false),
+		PresignedURLTTLMinutes: getEnvInt("PRESIGNED_URL_TTL_MINUTES", 0),
+		CacheMaxAgeImages: getEnvInt("CACHE_MAX_AGE_IMAGES", 31536000),
+		CacheMaxAgeDocuments: getEnvInt("CACHE_MAX_AGE_DOCUMENTS", 31536000),
+		CacheMaxAgeEphemeral: getEnvInt("CACHE_MAX_AGE_EPHEMERAL", 3600),
+		SignedURLSecret: getEnv("SIGNED_URL_SECRET", ""),
+		SignedURLTTLHours: getEnvInt("SIGNED_URL_TTL_HOURS", 168),
+		ImageSizes:      getEnvInts("IMAGE_SIZES", "32,64,96,128,160,200,240,320,400,480,600,640,800,960,1024,1200,1600,1920,2048"),
+		DatabaseURL:     getEnv("DATABASE_URL", "format.db"),
+		RateLimitUploadsPerMinute: getEnvInt("RATE_LIMIT_UPLOADS_PER_MINUTE", 60),
+		RateLimitUploadsBurst: getEnvInt("RATE_LIMIT_UPLOADS_BURST", 20),
+		RateLimitTransformsPerMinute: getEnvInt("RATE_LIMIT_TRANSFORMS_PER_MINUTE", 30),
+		RateLimitTransformsBurst: getEnvInt("RATE_LIMIT_TRANSFORMS_BURST", 10),
+		RateLimitAPIPerMinute: getEnvInt("RATE_LIMIT_API_PER_MINUTE", 600),
+		RateLimitAPIBurst: getEnvInt("RATE_LIMIT_API_BURST", 120),
+		RateLimitGmailPerMinute: getEnvInt("RATE_LIMIT_GMAIL_PER_MINUTE", 120),
+		RateLimitGmailBurst: getEnvInt("RATE_LIMIT_GMAIL_BURST", 30),
+		RateLimitAuthPerMinute: getEnvInt("RATE_LIMIT_AUTH_PER_MINUTE", 30),
+		RateLimitAuthBurst: getEnvInt("RATE_LIMIT_AUTH_BURST", 10),
+		RateLimitImagesPerMinute: getEnvInt("RATE_LIMIT_IMAGES_PER_MINUTE", 600),
+		RateLimitImagesBurst: getEnvInt("RATE_LIMIT_IMAGES_BURST", 200),
+		TrustedProxies:  getEnvPrefixes("TRUSTED_PROXIES", ""),
+		GCRetentionDays: getEnvInt("GC_RETENTION_DAYS", 0),
+		GCIntervalHours: getEnvInt("GC_INTERVAL_HOURS", 24),
+		ExpirySweepMinutes: getEnvInt("EXPIRY_SWEEP_INTERVAL_MINUTES", 10),
+		AnalyticsIngestToken: getEnv("ANALYTICS_INGEST_TOKEN", ""),
+		MetricsToken:    getEnv("METRICS_TOKEN", ""),
+		WebhookURLs:     getEnvList("WEBHOOK_URLS", ""),
+		WebhookSecret:   getEnv("WEBHOOK_SECRET", ""),
+		KeyNamespace:    getEnv("KEY_NAMESPACE", ""),
+		RetainOriginals: getEnvBool("RETAIN_ORIGINALS", false),
+		DedupCacheSize:  getEnvInt("DEDUP_CACHE_SIZE", 10000),
+		DedupCacheTTLMinutes: getEnvInt("DEDUP_CACHE_TTL_MINUTES", 60),
+		RedisURL:        getEnv("REDIS_URL", ""),
+		ClamAVAddress:   getEnv("CLAMAV_ADDRESS", ""),
+		ModerationURL:   getEnv("MODERATION_URL", ""),
+		ModerationToken: getEnv("MODERATION_TOKEN", ""),
+		ModerationAction: getEnv("MODERATION_ACTION", "reject"),
+		ModerationFailOpen: getEnvBool("MODERATION_FAIL_OPEN", false),
+		FooterTemplate:  getEnv("FOOTER_TEMPLATE", ""),
+		FooterOrgName:   getEnv("FOOTER_ORG_NAME", "Hack Club"),
+		FooterAddress:   getEnv("FOOTER_ADDRESS", "15 Falls Road, Shelburne, VT 05482"),
+		FooterUnsubscribeURL: getEnv("FOOTER_UNSUBSCRIBE_URL", "{{unsubscribe_url}}"),
+		AllowedClasses:  getEnvList("ALLOWED_CLASSES", ""),
 	}
 }
 
@@ -78,3 +302,48 @@ func getEnvBool(key string, defaultValue bool) bool {
 	}
 	return defaultValue
 }
+
+func getEnvFloat(key string, defaultValue float64) float64 {
+	if value := os.Getenv(key); value != "" {
+		if floatValue, err := strconv.ParseFloat(value, 64); err == nil {
+			return floatValue
+		}
+	}
+	return defaultValue
+}
+
+// getEnvList splits a comma-separated variable, dropping empty entries
+func getEnvList(key, defaultValue string) []string {
+	var values []string
+	for _, value := range strings.Split(getEnv(key, defaultValue), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// getEnvPrefixes is getEnvList of CIDR ranges or single IPs, dropping those
+// that don't parse
+func getEnvPrefixes(key, defaultValue string) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, value := range getEnvList(key, defaultValue) {
+		if prefix, err := netip.ParsePrefix(value); err == nil {
+			prefixes = append(prefixes, prefix.Masked())
+		} else if addr, err := netip.ParseAddr(value); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+		}
+	}
+	return prefixes
+}
+
+// getEnvInts is getEnvList of integers, dropping those that don't parse
+func getEnvInts(key, defaultValue string) []int {
+	var values []int
+	for _, value := range getEnvList(key, defaultValue) {
+		if intValue, err := strconv.Atoi(value); err == nil {
+			values = append(values, intValue)
+		}
+	}
+	return values
+}
@@ -0,0 +1,94 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Alias is a human-friendly name for an asset key. The alias can be pointed
+// at another key, the keys themselves never change.
+type Alias struct {
+	Alias     string    `json:"alias"`
+	Key       string    `json:"key"`
+	Owner     string    `json:"owner"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// CreateAlias creates a owned by a.Owner, reporting false and leaving the
+// alias alone when it already exists
+func (d *DB) CreateAlias(ctx context.Context, a *Alias) (bool, error) {
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	a.CreatedAt, a.UpdatedAt = now, now
+	result, err := d.db.ExecContext(ctx, `
+		INSERT INTO aliases (alias, key, owner, created_at, updated_at) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (alias) DO NOTHING`,
+		a.Alias, a.Key, a.Owner, a.CreatedAt, a.UpdatedAt)
+	if err != nil {
+		return false, fmt.Errorf("failed to create alias %s: %v", a.Alias, err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to create alias %s: %v", a.Alias, err)
+	}
+	return n > 0, nil
+}
+
+// RepointAlias points alias at key, keeping its owner. Unless owner is
+// empty, only an alias owner owns is repointed. It returns ErrNotFound when
+// there's no such alias of owner.
+func (d *DB) RepointAlias(ctx context.Context, alias, key, owner string) error {
+	result, err := d.db.ExecContext(ctx, `
+		UPDATE aliases SET key = $1, updated_at = $2
+		WHERE alias = $3 AND ($4 = '' OR LOWER(owner) = LOWER($4))`,
+		key, time.Now().UTC().Truncate(time.Microsecond), alias, owner)
+	if err != nil {
+		return fmt.Errorf("failed to repoint alias %s: %v", alias, err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to repoint alias %s: %v", alias, err)
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// GetAlias returns alias, ErrNotFound if there's no such alias
+func (d *DB) GetAlias(ctx context.Context, alias string) (*Alias, error) {
+	var a Alias
+	err := d.db.QueryRowContext(ctx, `SELECT alias, key, owner, created_at, updated_at FROM aliases WHERE alias = $1`, alias).
+		Scan(&a.Alias, &a.Key, &a.Owner, &a.CreatedAt, &a.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get alias %s: %v", alias, err)
+	}
+	return &a, nil
+}
+
+// IsAliased reports whether an alias points at key
+func (d *DB) IsAliased(ctx context.Context, key string) (bool, error) {
+	var n int
+	if err := d.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM aliases WHERE key = $1`, key).Scan(&n); err != nil {
+		return false, fmt.Errorf("failed to count aliases of %s: %v", key, err)
+	}
+	return n > 0, nil
+}
+
+// DeleteAlias removes alias, ErrNotFound if there's no such alias
+func (d *DB) DeleteAlias(ctx context.Context, alias string) error {
+	result, err := d.db.ExecContext(ctx, `DELETE FROM aliases WHERE alias = $1`, alias)
+	if err != nil {
+		return fmt.Errorf("failed to delete alias %s: %v", alias, err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
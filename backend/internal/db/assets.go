@@ -0,0 +1,349 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned for keys without a record
+	ErrNotFound = errors.New("asset not found")
+	// ErrInvalidCursor is returned for cursors ListAssets didn't hand out
+	ErrInvalidCursor = errors.New("invalid cursor")
+)
+
+// Asset is the recorded metadata of a stored asset
+type Asset struct {
+	Key           string    `json:"key"`
+	Namespace     string    `json:"namespace,omitempty"` // key prefix of the user or team, if namespaced
+	Hash          string    `json:"hash"`
+	MIME          string    `json:"mime"`
+	Width         int       `json:"width"`
+	Height        int       `json:"height"`
+	Bytes         int       `json:"bytes"`
+	OriginalBytes int       `json:"original_bytes"`
+	Uploader      string    `json:"uploader,omitempty"`
+	SourceURL     string    `json:"source_url,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+	// ReferencedAt is when the asset was last uploaded or used in a
+	// transform, zero for records older than the column
+	ReferencedAt time.Time `json:"referenced_at,omitempty"`
+	// ExpiresAt is when the asset gets deleted, nil to keep it
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// OriginalKey is where the untouched upload is kept in the private
+	// store, when originals are retained. It's never served.
+	OriginalKey string `json:"-"`
+	// Capture is the JSON encoded capture metadata (camera, capture time,
+	// format, color space) of the first upload, empty if unknown
+	Capture []byte `json:"-"`
+}
+
+// LastReferenced returns when the asset was last known to be in use
+func (a *Asset) LastReferenced() time.Time {
+	if a.ReferencedAt.After(a.UpdatedAt) {
+		return a.ReferencedAt
+	}
+	return a.UpdatedAt
+}
+
+// assetColumns are the columns scanAsset reads, in order
+const assetColumns = `key, namespace, hash, mime, width, height, bytes, original_bytes, uploader, source_url, created_at, updated_at, referenced_at, expires_at, original_key, capture`
+
+// scanAsset reads a row of assetColumns
+func scanAsset(row interface{ Scan(...interface{}) error }) (*Asset, error) {
+	var a Asset
+	var referencedAt, expiresAt sql.NullTime
+	var capture string
+	if err := row.Scan(&a.Key, &a.Namespace, &a.Hash, &a.MIME, &a.Width, &a.Height, &a.Bytes, &a.OriginalBytes, &a.Uploader, &a.SourceURL, &a.CreatedAt, &a.UpdatedAt, &referencedAt, &expiresAt, &a.OriginalKey, &capture); err != nil {
+		return nil, err
+	}
+	if capture != "" {
+		a.Capture = []byte(capture)
+	}
+	a.ReferencedAt = referencedAt.Time
+	if expiresAt.Valid {
+		a.ExpiresAt = &expiresAt.Time
+	}
+	return &a, nil
+}
+
+// SaveAsset records an asset. Keys are content-addressed, so saving an
+// existing key only bumps its updated_at (and sets its original key and
+// capture metadata if it had none), the first uploader is kept, unless
+// it was deleted, in which case the new upload replaces the tombstone. The
+// expiry is merged like in ExtendExpiry and a.ExpiresAt set to the result.
+func (d *DB) SaveAsset(ctx context.Context, a *Asset) error {
+	// Postgres keeps microseconds, truncate so cursors round-trip everywhere
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	if a.CreatedAt.IsZero() {
+		a.CreatedAt = now
+	}
+	a.UpdatedAt = now
+	a.ReferencedAt = now
+
+	_, err := d.db.ExecContext(ctx, `
+		INSERT INTO assets (`+assetColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $12, $13, $14, $15)
+		ON CONFLICT (key) DO UPDATE SET
+			uploader = CASE WHEN assets.deleted_at IS NULL THEN assets.uploader ELSE excluded.uploader END,
+			source_url = CASE WHEN assets.deleted_at IS NULL THEN assets.source_url ELSE excluded.source_url END,
+			created_at = CASE WHEN assets.deleted_at IS NULL THEN assets.created_at ELSE excluded.created_at END,
+			updated_at = excluded.updated_at,
+			referenced_at = excluded.referenced_at,
+			expires_at = CASE WHEN assets.deleted_at IS NULL THEN assets.expires_at ELSE excluded.expires_at END,
+			original_key = CASE WHEN assets.deleted_at IS NULL AND assets.original_key <> '' THEN assets.original_key ELSE excluded.original_key END,
+			capture = CASE WHEN assets.deleted_at IS NULL AND assets.capture <> '' THEN assets.capture ELSE excluded.capture END,
+			deleted_at = NULL`,
+		a.Key, a.Namespace, a.Hash, a.MIME, a.Width, a.Height, a.Bytes, a.OriginalBytes, a.Uploader, a.SourceURL, a.CreatedAt, a.UpdatedAt, a.ExpiresAt, a.OriginalKey, string(a.Capture))
+	if err != nil {
+		return fmt.Errorf("failed to save asset %s: %v", a.Key, err)
+	}
+	a.ExpiresAt, err = d.ExtendExpiry(ctx, a.Key, a.ExpiresAt)
+	return err
+}
+
+// ExtendExpiry merges the expiry of another upload of key into its record
+// and returns the result. An upload without expiry makes the asset
+// permanent, otherwise the later expiry wins, so an asset never disappears
+// before any of its uploads asked it to.
+func (d *DB) ExtendExpiry(ctx context.Context, key string, expiresAt *time.Time) (*time.Time, error) {
+	var err error
+	if expiresAt == nil {
+		_, err = d.db.ExecContext(ctx, `UPDATE assets SET expires_at = NULL WHERE key = $1 AND deleted_at IS NULL`, key)
+	} else {
+		_, err = d.db.ExecContext(ctx, `
+			UPDATE assets SET expires_at = $1
+			WHERE key = $2 AND deleted_at IS NULL AND expires_at IS NOT NULL AND expires_at < $1`,
+			expiresAt.UTC().Truncate(time.Microsecond), key)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to update expiry of %s: %v", key, err)
+	}
+
+	var merged sql.NullTime
+	if err := d.db.QueryRowContext(ctx, `SELECT expires_at FROM assets WHERE key = $1`, key).Scan(&merged); err != nil {
+		return nil, fmt.Errorf("failed to read expiry of %s: %v", key, err)
+	}
+	if !merged.Valid {
+		return nil, nil
+	}
+	return &merged.Time, nil
+}
+
+// ListExpiredAssets returns up to limit live assets whose expiry passed
+// before now
+func (d *DB) ListExpiredAssets(ctx context.Context, now time.Time, limit int) ([]*Asset, error) {
+	rows, err := d.db.QueryContext(ctx, `
+		SELECT `+assetColumns+` FROM assets
+		WHERE deleted_at IS NULL AND expires_at IS NOT NULL AND expires_at <= $1
+		ORDER BY expires_at LIMIT $2`,
+		now.UTC(), limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list expired assets: %v", err)
+	}
+	defer rows.Close()
+
+	var assets []*Asset
+	for rows.Next() {
+		a, err := scanAsset(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list expired assets: %v", err)
+		}
+		assets = append(assets, a)
+	}
+	return assets, rows.Err()
+}
+
+// GetAsset returns the record of key, ErrNotFound if there is none or it was
+// deleted
+func (d *DB) GetAsset(ctx context.Context, key string) (*Asset, error) {
+	a, err := scanAsset(d.db.QueryRowContext(ctx, `SELECT `+assetColumns+` FROM assets WHERE key = $1 AND deleted_at IS NULL`, key))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get asset %s: %v", key, err)
+	}
+	return a, nil
+}
+
+// GetAssetByStem returns the record, live or deleted, of the asset whose
+// key without extension is stem, preferring a live one, and whether it was
+// deleted. It returns ErrNotFound if the asset never had a record.
+func (d *DB) GetAssetByStem(ctx context.Context, stem string) (*Asset, bool, error) {
+	var deleted bool
+	row := d.db.QueryRowContext(ctx, `
+		SELECT `+assetColumns+`, deleted_at IS NOT NULL FROM assets
+		WHERE key LIKE $1 ORDER BY deleted_at IS NULL DESC LIMIT 1`,
+		// Stems have no LIKE wildcards, only the extension varies
+		stem+".%")
+	a, err := scanAsset(scanFunc(func(dest ...interface{}) error {
+		return row.Scan(append(dest, &deleted)...)
+	}))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false, ErrNotFound
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to get asset %s: %v", stem, err)
+	}
+	return a, deleted, nil
+}
+
+// scanFunc adapts a function to scanAsset
+type scanFunc func(dest ...interface{}) error
+
+func (f scanFunc) Scan(dest ...interface{}) error { return f(dest...) }
+
+// TouchAssets marks the assets at keys as referenced now. Unknown keys are
+// ignored.
+func (d *DB) TouchAssets(ctx context.Context, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	args := []interface{}{time.Now().UTC().Truncate(time.Microsecond)}
+	placeholders := make([]string, len(keys))
+	for i, key := range keys {
+		args = append(args, key)
+		placeholders[i] = fmt.Sprintf("$%d", i+2)
+	}
+	_, err := d.db.ExecContext(ctx, `UPDATE assets SET referenced_at = $1 WHERE deleted_at IS NULL AND key IN (`+strings.Join(placeholders, ", ")+`)`, args...)
+	if err != nil {
+		return fmt.Errorf("failed to touch assets: %v", err)
+	}
+	return nil
+}
+
+// DeleteAsset tombstones the record of key, keeping who uploaded what after
+// the object is gone. It returns ErrNotFound if there's no live record.
+func (d *DB) DeleteAsset(ctx context.Context, key string) error {
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	result, err := d.db.ExecContext(ctx, `UPDATE assets SET deleted_at = $1, updated_at = $1 WHERE key = $2 AND deleted_at IS NULL`, now, key)
+	if err != nil {
+		return fmt.Errorf("failed to delete asset %s: %v", key, err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	// The same bytes uploaded again start over
+	if _, err := d.db.ExecContext(ctx, `DELETE FROM asset_refs WHERE key = $1`, key); err != nil {
+		return fmt.Errorf("failed to delete references to %s: %v", key, err)
+	}
+	return nil
+}
+
+// OriginalInUse reports whether a live asset was processed from the
+// original stored at originalKey
+func (d *DB) OriginalInUse(ctx context.Context, originalKey string) (bool, error) {
+	var n int
+	err := d.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM assets WHERE original_key = $1 AND deleted_at IS NULL`, originalKey).Scan(&n)
+	if err != nil {
+		return false, fmt.Errorf("failed to count assets of original %s: %v", originalKey, err)
+	}
+	return n > 0, nil
+}
+
+// Page sizes of ListAssets
+const (
+	DefaultListLimit = 50
+	MaxListLimit     = 200
+)
+
+// AssetFilter narrows ListAssets. Zero values don't filter.
+type AssetFilter struct {
+	Uploader  string // who uploaded it first or holds a reference to it
+	Namespace string
+	Since     time.Time // created at or after
+	Cursor    string    // from the previous page
+	Limit     int       // DefaultListLimit if 0, at most MaxListLimit
+}
+
+// ListAssets returns a page of assets, newest first, and the cursor of the
+// next page, empty on the last one
+func (d *DB) ListAssets(ctx context.Context, filter AssetFilter) ([]*Asset, string, error) {
+	if filter.Limit <= 0 {
+		filter.Limit = DefaultListLimit
+	}
+	filter.Limit = min(filter.Limit, MaxListLimit)
+
+	where := []string{"deleted_at IS NULL"}
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if filter.Uploader != "" {
+		where = append(where, fmt.Sprintf("(uploader = %s OR key IN (SELECT key FROM asset_refs WHERE user_email = %s))",
+			arg(filter.Uploader), arg(strings.ToLower(filter.Uploader))))
+	}
+	if filter.Namespace != "" {
+		where = append(where, "namespace = "+arg(filter.Namespace))
+	}
+	if !filter.Since.IsZero() {
+		where = append(where, "created_at >= "+arg(filter.Since.UTC()))
+	}
+	if filter.Cursor != "" {
+		createdAt, key, err := decodeCursor(filter.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		where = append(where, fmt.Sprintf("(created_at < %s OR (created_at = %s AND key < %s))", arg(createdAt), arg(createdAt), arg(key)))
+	}
+
+	query := `SELECT ` + assetColumns + ` FROM assets WHERE ` + strings.Join(where, " AND ")
+	// One extra row tells whether there's a next page
+	query += " ORDER BY created_at DESC, key DESC LIMIT " + arg(filter.Limit+1)
+
+	rows, err := d.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to list assets: %v", err)
+	}
+	defer rows.Close()
+
+	assets := make([]*Asset, 0, filter.Limit)
+	for rows.Next() {
+		a, err := scanAsset(rows)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to list assets: %v", err)
+		}
+		assets = append(assets, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", fmt.Errorf("failed to list assets: %v", err)
+	}
+
+	var next string
+	if len(assets) > filter.Limit {
+		assets = assets[:filter.Limit]
+		last := assets[len(assets)-1]
+		next = encodeCursor(last.CreatedAt, last.Key)
+	}
+	return assets, next, nil
+}
+
+// encodeCursor makes an opaque cursor pointing after the given row
+func encodeCursor(createdAt time.Time, key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(createdAt.UTC().Format(time.RFC3339Nano) + "|" + key))
+}
+
+func decodeCursor(cursor string) (time.Time, string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, "", ErrInvalidCursor
+	}
+	at, key, ok := strings.Cut(string(raw), "|")
+	if !ok {
+		return time.Time{}, "", ErrInvalidCursor
+	}
+	createdAt, err := time.Parse(time.RFC3339Nano, at)
+	if err != nil {
+		return time.Time{}, "", ErrInvalidCursor
+	}
+	return createdAt, key, nil
+}
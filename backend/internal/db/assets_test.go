@@ -0,0 +1,611 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSaveAndGetAsset(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "format.db")
+	d, err := Open(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := d.GetAsset(ctx, "ab/missing.jpg"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("GetAsset(missing) error = %v, want ErrNotFound", err)
+	}
+
+	first := &Asset{Key: "ab/key.jpg", Hash: "sha256:1", MIME: "image/jpeg", Width: 10, Height: 20, Bytes: 100, OriginalBytes: 200, Uploader: "a@hackclub.com", SourceURL: "upload", Capture: []byte(`{"format":"image/heic"}`)}
+	if err := d.SaveAsset(ctx, first); err != nil {
+		t.Fatal(err)
+	}
+	// The same content uploaded again keeps the first uploader and capture
+	if err := d.SaveAsset(ctx, &Asset{Key: "ab/key.jpg", Hash: "sha256:1", MIME: "image/jpeg", Uploader: "b@hackclub.com", Capture: []byte(`{"format":"image/png"}`)}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := d.GetAsset(ctx, "ab/key.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Uploader != "a@hackclub.com" || got.Width != 10 || got.Height != 20 || got.SourceURL != "upload" || string(got.Capture) != `{"format":"image/heic"}` {
+		t.Errorf("GetAsset = %+v, want the first record", got)
+	}
+	if !got.CreatedAt.Equal(first.CreatedAt) || got.UpdatedAt.Before(got.CreatedAt) {
+		t.Errorf("timestamps created=%v updated=%v", got.CreatedAt, got.UpdatedAt)
+	}
+
+	// Reopening keeps the data and doesn't re-run migrations
+	d.Close()
+	if d, err = Open(ctx, path); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if _, err := d.GetAsset(ctx, "ab/key.jpg"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListAssets(t *testing.T) {
+	ctx := context.Background()
+	d, err := Open(ctx, filepath.Join(t.TempDir(), "format.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i, uploader := range []string{"a@hackclub.com", "b@hackclub.com", "a@hackclub.com", "a@hackclub.com"} {
+		a := &Asset{Key: fmt.Sprintf("ab/key%d.jpg", i), Hash: "sha256:x", MIME: "image/jpeg", Uploader: uploader, CreatedAt: base.Add(time.Duration(i) * time.Hour)}
+		if err := d.SaveAsset(ctx, a); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keys := func(assets []*Asset) []string {
+		var out []string
+		for _, a := range assets {
+			out = append(out, a.Key)
+		}
+		return out
+	}
+
+	page, next, err := d.ListAssets(ctx, AssetFilter{Uploader: "a@hackclub.com", Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := keys(page); !reflect.DeepEqual(got, []string{"ab/key3.jpg", "ab/key2.jpg"}) || next == "" {
+		t.Fatalf("first page = %v, next %q", got, next)
+	}
+	page, next, err = d.ListAssets(ctx, AssetFilter{Uploader: "a@hackclub.com", Limit: 2, Cursor: next})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := keys(page); !reflect.DeepEqual(got, []string{"ab/key0.jpg"}) || next != "" {
+		t.Fatalf("second page = %v, next %q", got, next)
+	}
+
+	page, _, err = d.ListAssets(ctx, AssetFilter{Since: base.Add(90 * time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := keys(page); !reflect.DeepEqual(got, []string{"ab/key3.jpg", "ab/key2.jpg"}) {
+		t.Errorf("since = %v", got)
+	}
+
+	// Uploaders of an identical file hold a reference to the first one's
+	if err := d.AddAssetRef(ctx, "ab/key1.jpg", "C@hackclub.com"); err != nil {
+		t.Fatal(err)
+	}
+	page, _, err = d.ListAssets(ctx, AssetFilter{Uploader: "c@hackclub.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := keys(page); !reflect.DeepEqual(got, []string{"ab/key1.jpg"}) {
+		t.Errorf("referenced = %v", got)
+	}
+
+	if _, _, err := d.ListAssets(ctx, AssetFilter{Cursor: "not a cursor"}); !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("invalid cursor error = %v", err)
+	}
+}
+
+func TestDeleteAsset(t *testing.T) {
+	ctx := context.Background()
+	d, err := Open(ctx, filepath.Join(t.TempDir(), "format.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	if err := d.SaveAsset(ctx, &Asset{Key: "ab/key.jpg", Hash: "sha256:1", MIME: "image/jpeg", Uploader: "a@hackclub.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.DeleteAsset(ctx, "ab/key.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.DeleteAsset(ctx, "ab/key.jpg"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("second DeleteAsset error = %v, want ErrNotFound", err)
+	}
+	if _, err := d.GetAsset(ctx, "ab/key.jpg"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetAsset(deleted) error = %v, want ErrNotFound", err)
+	}
+	if assets, _, err := d.ListAssets(ctx, AssetFilter{}); err != nil || len(assets) != 0 {
+		t.Errorf("ListAssets = %d assets, %v, want none", len(assets), err)
+	}
+
+	// Uploading the same content again belongs to the new uploader
+	if err := d.SaveAsset(ctx, &Asset{Key: "ab/key.jpg", Hash: "sha256:1", MIME: "image/jpeg", Uploader: "b@hackclub.com"}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := d.GetAsset(ctx, "ab/key.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Uploader != "b@hackclub.com" {
+		t.Errorf("uploader after re-upload = %q", got.Uploader)
+	}
+}
+
+func TestSources(t *testing.T) {
+	ctx := context.Background()
+	d, err := Open(ctx, filepath.Join(t.TempDir(), "format.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	if _, _, err := d.LookupSource(ctx, "sha256:1|opts", time.Time{}); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("LookupSource(unknown) error = %v, want ErrNotFound", err)
+	}
+
+	if err := d.SaveAsset(ctx, &Asset{Key: "ab/key.jpg", Hash: "sha256:2", MIME: "image/jpeg"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SaveSource(ctx, "sha256:1|opts", "ab/key.jpg", []byte(`{"key":"ab/key.jpg"}`)); err != nil {
+		t.Fatal(err)
+	}
+	key, asset, err := d.LookupSource(ctx, "sha256:1|opts", time.Time{})
+	if err != nil || key != "ab/key.jpg" || string(asset) != `{"key":"ab/key.jpg"}` {
+		t.Fatalf("LookupSource = %q, %s, %v", key, asset, err)
+	}
+	// Sources recorded before since have gone stale
+	if _, _, err := d.LookupSource(ctx, "sha256:1|opts", time.Now().Add(time.Minute)); !errors.Is(err, ErrNotFound) {
+		t.Errorf("LookupSource(stale) error = %v, want ErrNotFound", err)
+	}
+
+	// Sources of deleted assets are processed again
+	if err := d.DeleteAsset(ctx, "ab/key.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := d.LookupSource(ctx, "sha256:1|opts", time.Time{}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("LookupSource(deleted) error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	ctx := context.Background()
+	d, err := Open(ctx, filepath.Join(t.TempDir(), "format.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	entries := []*AuditEntry{
+		{Key: "ab/one.jpg", User: "a@hackclub.com", Source: "upload", IP: "1.2.3.4", CreatedAt: base},
+		{Key: "ab/two.jpg", User: "b@hackclub.com", Source: "https://example.com/x.png", IP: "5.6.7.8", CreatedAt: base.Add(time.Minute)},
+		{Key: "ab/one.jpg", User: "b@hackclub.com", Source: "upload", IP: "5.6.7.8", Deduped: true, CreatedAt: base.Add(2 * time.Minute)},
+	}
+	for _, e := range entries {
+		if err := d.SaveAuditEntry(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, next, err := d.ListAuditEntries(ctx, AuditFilter{Key: "ab/one.jpg"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].User != "b@hackclub.com" || !got[0].Deduped || got[1].User != "a@hackclub.com" || next != "" {
+		t.Errorf("ListAuditEntries(key) = %+v, next %q", got, next)
+	}
+
+	got, next, err = d.ListAuditEntries(ctx, AuditFilter{IP: "5.6.7.8", Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Key != "ab/one.jpg" || next == "" {
+		t.Fatalf("first page = %+v, next %q", got, next)
+	}
+	got, _, err = d.ListAuditEntries(ctx, AuditFilter{IP: "5.6.7.8", Limit: 1, Cursor: next})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Key != "ab/two.jpg" || got[0].Source != "https://example.com/x.png" {
+		t.Errorf("second page = %+v", got)
+	}
+}
+
+func TestAssetExpiry(t *testing.T) {
+	ctx := context.Background()
+	d, err := Open(ctx, filepath.Join(t.TempDir(), "format.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	soon := time.Now().Add(time.Hour).UTC().Truncate(time.Microsecond)
+	later := soon.Add(time.Hour)
+	past := time.Now().Add(-time.Minute).UTC().Truncate(time.Microsecond)
+
+	// A later expiry wins, an earlier one doesn't shorten it
+	a := &Asset{Key: "ab/temp.jpg", Hash: "sha256:1", MIME: "image/jpeg", ExpiresAt: &soon}
+	if err := d.SaveAsset(ctx, a); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SaveAsset(ctx, &Asset{Key: "ab/temp.jpg", Hash: "sha256:1", MIME: "image/jpeg", ExpiresAt: &later}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := d.ExtendExpiry(ctx, "ab/temp.jpg", &soon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || !got.Equal(later) {
+		t.Errorf("expiry = %v, want %v", got, later)
+	}
+
+	// An upload without TTL makes it permanent
+	b := &Asset{Key: "ab/temp.jpg", Hash: "sha256:1", MIME: "image/jpeg"}
+	if err := d.SaveAsset(ctx, b); err != nil {
+		t.Fatal(err)
+	}
+	if b.ExpiresAt != nil {
+		t.Errorf("expiry after permanent upload = %v, want none", b.ExpiresAt)
+	}
+
+	if err := d.SaveAsset(ctx, &Asset{Key: "ab/gone.jpg", Hash: "sha256:2", MIME: "image/jpeg", ExpiresAt: &past}); err != nil {
+		t.Fatal(err)
+	}
+	expired, err := d.ListExpiredAssets(ctx, time.Now(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expired) != 1 || expired[0].Key != "ab/gone.jpg" {
+		t.Errorf("ListExpiredAssets = %+v, want ab/gone.jpg", expired)
+	}
+}
+
+func TestAliases(t *testing.T) {
+	ctx := context.Background()
+	d, err := Open(ctx, filepath.Join(t.TempDir(), "format.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	if created, err := d.CreateAlias(ctx, &Alias{Alias: "logo", Key: "ab/one.png", Owner: "a@hackclub.com"}); err != nil || !created {
+		t.Fatalf("CreateAlias = %v, %v", created, err)
+	}
+	// Creating an existing alias leaves it alone
+	if created, err := d.CreateAlias(ctx, &Alias{Alias: "logo", Key: "ab/two.png", Owner: "b@hackclub.com"}); err != nil || created {
+		t.Fatalf("CreateAlias(existing) = %v, %v, want not created", created, err)
+	}
+	// Only the owner repoints it, which keeps the owner
+	if err := d.RepointAlias(ctx, "logo", "ab/two.png", "b@hackclub.com"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("RepointAlias(other owner) error = %v, want ErrNotFound", err)
+	}
+	if err := d.RepointAlias(ctx, "logo", "ab/two.png", "A@hackclub.com"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := d.GetAlias(ctx, "logo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Key != "ab/two.png" || got.Owner != "a@hackclub.com" {
+		t.Errorf("GetAlias = %+v, want ab/two.png owned by a@hackclub.com", got)
+	}
+	// Without an owner, as for admins, any alias is repointed
+	if err := d.RepointAlias(ctx, "logo", "ab/three.png", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.DeleteAlias(ctx, "logo"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.GetAlias(ctx, "logo"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetAlias(deleted) error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestIdempotentResponses(t *testing.T) {
+	ctx := context.Background()
+	d, err := Open(ctx, filepath.Join(t.TempDir(), "format.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	old := time.Now().Add(-48 * time.Hour).UTC().Truncate(time.Microsecond)
+	if err := d.SaveIdempotentResponse(ctx, &IdempotentResponse{Owner: "a@hackclub.com", Key: "retry-1", Fingerprint: "POST /api/assets", Status: 200, Body: []byte(`{"key":"ab/one.png"}`), CreatedAt: old}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.GetIdempotentResponse(ctx, "a@hackclub.com", "retry-1", time.Now().Add(-24*time.Hour)); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetIdempotentResponse(outside window) error = %v, want ErrNotFound", err)
+	}
+
+	// Reusing the key after the window replaces the response
+	if err := d.SaveIdempotentResponse(ctx, &IdempotentResponse{Owner: "a@hackclub.com", Key: "retry-1", Fingerprint: "POST /api/assets", Status: 200, Body: []byte(`{"key":"ab/two.png"}`)}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := d.GetIdempotentResponse(ctx, "a@hackclub.com", "retry-1", time.Now().Add(-24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got.Body) != `{"key":"ab/two.png"}` || got.Status != 200 {
+		t.Errorf("GetIdempotentResponse = %d %s, want 200 ab/two.png", got.Status, got.Body)
+	}
+	if _, err := d.GetIdempotentResponse(ctx, "b@hackclub.com", "retry-1", old); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetIdempotentResponse(other user) error = %v, want ErrNotFound", err)
+	}
+
+	if n, err := d.DeleteIdempotentResponses(ctx, time.Now().Add(time.Minute)); err != nil || n != 1 {
+		t.Errorf("DeleteIdempotentResponses = %d, %v, want 1", n, err)
+	}
+}
+
+func TestOAuthTokens(t *testing.T) {
+	ctx := context.Background()
+	d, err := Open(ctx, filepath.Join(t.TempDir(), "format.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	if _, err := d.GetOAuthToken(ctx, "session-1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetOAuthToken(missing) error = %v, want ErrNotFound", err)
+	}
+	expiry := time.Now().Add(time.Hour).UTC().Truncate(time.Microsecond)
+	if err := d.SaveOAuthToken(ctx, &OAuthToken{SessionID: "session-1", User: "a@hackclub.com", AccessToken: []byte{0, 1, 2}, RefreshToken: []byte{3}, Expiry: expiry}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := d.GetOAuthToken(ctx, "session-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.User != "a@hackclub.com" || string(got.AccessToken) != "\x00\x01\x02" || string(got.RefreshToken) != "\x03" || !got.Expiry.Equal(expiry) {
+		t.Errorf("GetOAuthToken = %+v", got)
+	}
+
+	if n, err := d.DeleteOAuthTokens(ctx, time.Now().Add(-time.Minute)); err != nil || n != 0 {
+		t.Errorf("DeleteOAuthTokens(before save) = %d, %v, want 0", n, err)
+	}
+	if err := d.DeleteOAuthToken(ctx, "session-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.GetOAuthToken(ctx, "session-1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetOAuthToken(deleted) error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	ctx := context.Background()
+	d, err := Open(ctx, filepath.Join(t.TempDir(), "format.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	old := time.Now().Add(-time.Hour)
+	for _, s := range []*Session{
+		{ID: "laptop", User: "a@hackclub.com", Provider: "google", IP: "10.0.0.1", UserAgent: "Firefox", CreatedAt: old, LastSeenAt: old},
+		{ID: "phone", User: "a@hackclub.com", Provider: "google", IP: "10.0.0.2", UserAgent: "Safari"},
+		{ID: "other", User: "b@hackclub.com", Provider: "slack", IP: "10.0.0.3", UserAgent: "Chrome"},
+	} {
+		if err := d.SaveSession(ctx, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sessions, err := d.ListSessions(ctx, "a@hackclub.com", time.Now().Add(-2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 2 || sessions[0].ID != "phone" || sessions[1].UserAgent != "Firefox" {
+		t.Fatalf("ListSessions = %+v, want phone then laptop", sessions)
+	}
+
+	// Touching only writes sessions not seen since after
+	if err := d.TouchSession(ctx, "laptop", time.Now(), time.Now().Add(-5*time.Minute), "10.0.0.9"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.TouchSession(ctx, "phone", time.Now(), time.Now().Add(-5*time.Minute), "10.0.0.9"); err != nil {
+		t.Fatal(err)
+	}
+	sessions, err = d.ListSessions(ctx, "a@hackclub.com", time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ips := map[string]string{}
+	for _, s := range sessions {
+		ips[s.ID] = s.IP
+	}
+	if len(sessions) != 2 || ips["laptop"] != "10.0.0.9" || ips["phone"] != "10.0.0.2" {
+		t.Errorf("sessions after touch = %+v", sessions)
+	}
+
+	if err := d.DeleteSession(ctx, "phone"); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := d.DeleteSessions(ctx, time.Now().Add(time.Minute)); err != nil || n != 2 {
+		t.Errorf("DeleteSessions = %d, %v, want 2", n, err)
+	}
+}
+
+func TestOriginalKey(t *testing.T) {
+	ctx := context.Background()
+	d, err := Open(ctx, filepath.Join(t.TempDir(), "format.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// An upload from before originals were retained picks up the original
+	if err := d.SaveAsset(ctx, &Asset{Key: "ab/one.jpg", Hash: "sha256:1", MIME: "image/jpeg"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SaveAsset(ctx, &Asset{Key: "ab/one.jpg", Hash: "sha256:1", MIME: "image/jpeg", OriginalKey: "originals/cd/raw.png"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SaveAsset(ctx, &Asset{Key: "ab/two.jpg", Hash: "sha256:2", MIME: "image/jpeg", OriginalKey: "originals/cd/raw.png"}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := d.GetAsset(ctx, "ab/one.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.OriginalKey != "originals/cd/raw.png" {
+		t.Errorf("OriginalKey = %q, want originals/cd/raw.png", got.OriginalKey)
+	}
+
+	// The original is in use until every asset made from it is deleted
+	if err := d.DeleteAsset(ctx, "ab/one.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if inUse, err := d.OriginalInUse(ctx, "originals/cd/raw.png"); err != nil || !inUse {
+		t.Errorf("OriginalInUse = %v, %v, want true", inUse, err)
+	}
+	if err := d.DeleteAsset(ctx, "ab/two.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if inUse, err := d.OriginalInUse(ctx, "originals/cd/raw.png"); err != nil || inUse {
+		t.Errorf("OriginalInUse = %v, %v, want false", inUse, err)
+	}
+}
+
+func TestAuthEvents(t *testing.T) {
+	ctx := context.Background()
+	d, err := Open(ctx, filepath.Join(t.TempDir(), "format.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i, e := range []*AuthEvent{
+		{Event: AuthEventLogin, User: "a@hackclub.com", Provider: "google", IP: "1.2.3.4"},
+		{Event: AuthEventDenied, Provider: "google", IP: "6.6.6.6", Detail: "domain example.com is not allowed"},
+		{Event: AuthEventTokenRefresh, User: "a@hackclub.com", Provider: "google", IP: "1.2.3.4", Detail: "gmail"},
+		{Event: AuthEventLogout, User: "a@hackclub.com", Provider: "google", IP: "1.2.3.4"},
+	} {
+		e.CreatedAt = base.Add(time.Duration(i) * time.Minute)
+		if err := d.SaveAuthEvent(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, _, err := d.ListAuthEvents(ctx, AuthEventFilter{Event: AuthEventDenied})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].IP != "6.6.6.6" || got[0].ID == "" {
+		t.Errorf("ListAuthEvents(denied) = %+v", got)
+	}
+
+	got, next, err := d.ListAuthEvents(ctx, AuthEventFilter{User: "a@hackclub.com", Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].Event != AuthEventLogout || got[1].Detail != "gmail" || next == "" {
+		t.Fatalf("first page = %+v, next %q", got, next)
+	}
+	got, next, err = d.ListAuthEvents(ctx, AuthEventFilter{User: "a@hackclub.com", Limit: 2, Cursor: next})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Event != AuthEventLogin || next != "" {
+		t.Errorf("second page = %+v, next %q", got, next)
+	}
+}
+
+func TestGmailWatches(t *testing.T) {
+	ctx := context.Background()
+	d, err := Open(ctx, filepath.Join(t.TempDir(), "format.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	if _, err := d.GetGmailWatch(ctx, "a@hackclub.com"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetGmailWatch(missing) error = %v, want ErrNotFound", err)
+	}
+	expires := time.Now().Add(7 * 24 * time.Hour).UTC().Truncate(time.Microsecond)
+	watch := &GmailWatch{User: "a@hackclub.com", SessionID: "session-1", LabelID: "Label_1", LabelName: "Format", HistoryID: 1200, ExpiresAt: expires}
+	if err := d.SaveGmailWatch(ctx, watch); err != nil {
+		t.Fatal(err)
+	}
+	watch.HistoryID = 1300
+	if err := d.SaveGmailWatch(ctx, watch); err != nil {
+		t.Fatal(err)
+	}
+	got, err := d.GetGmailWatch(ctx, "a@hackclub.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.SessionID != "session-1" || got.LabelID != "Label_1" || got.HistoryID != 1300 || !got.ExpiresAt.Equal(expires) {
+		t.Errorf("GetGmailWatch = %+v", got)
+	}
+	if expiring, err := d.ListExpiringGmailWatches(ctx, time.Now().Add(24*time.Hour)); err != nil || len(expiring) != 0 {
+		t.Errorf("ListExpiringGmailWatches(day) = %v, %v, want none", expiring, err)
+	}
+	if expiring, err := d.ListExpiringGmailWatches(ctx, expires.Add(time.Minute)); err != nil || len(expiring) != 1 || expiring[0].HistoryID != 1300 {
+		t.Errorf("ListExpiringGmailWatches(week) = %v, %v, want the watch", expiring, err)
+	}
+
+	if err := d.DeleteGmailWatch(ctx, "a@hackclub.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.GetGmailWatch(ctx, "a@hackclub.com"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetGmailWatch(deleted) error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestUserNamespace(t *testing.T) {
+	ctx := context.Background()
+	d, err := Open(ctx, filepath.Join(t.TempDir(), "format.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// Emails that util.Namespace would turn into the same segment
+	first, err := d.UserNamespace(ctx, "a.b@hackclub.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := d.UserNamespace(ctx, "a-b@hackclub.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == other {
+		t.Errorf("two users share namespace %s", first)
+	}
+	if strings.Contains(first, "hackclub") {
+		t.Errorf("namespace %s reveals the email", first)
+	}
+	again, err := d.UserNamespace(ctx, "A.B@hackclub.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != first {
+		t.Errorf("namespace changed from %s to %s", first, again)
+	}
+}
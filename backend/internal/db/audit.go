@@ -0,0 +1,111 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// AuditEntry records one upload: who got which asset from what, and from
+// where
+type AuditEntry struct {
+	Key       string    `json:"key"`
+	User      string    `json:"user"`
+	Source    string    `json:"source"` // source URL, data:<mime> or upload
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Deduped   bool      `json:"deduped"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// AuditFilter narrows ListAuditEntries. Zero values don't filter.
+type AuditFilter struct {
+	Key    string
+	User   string
+	IP     string
+	Since  time.Time
+	Cursor string
+	Limit  int // DefaultListLimit if 0, at most MaxListLimit
+}
+
+// SaveAuditEntry appends an entry to the upload audit log
+func (d *DB) SaveAuditEntry(ctx context.Context, e *AuditEntry) error {
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now().UTC().Truncate(time.Microsecond)
+	}
+	_, err := d.db.ExecContext(ctx, `
+		INSERT INTO upload_audit (key, user_email, source, ip, user_agent, deduped, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		e.Key, e.User, e.Source, e.IP, e.UserAgent, e.Deduped, e.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to save audit entry for %s: %v", e.Key, err)
+	}
+	return nil
+}
+
+// ListAuditEntries returns a page of the upload audit log, newest first, and
+// the cursor of the next page, empty on the last one
+func (d *DB) ListAuditEntries(ctx context.Context, filter AuditFilter) ([]*AuditEntry, string, error) {
+	if filter.Limit <= 0 {
+		filter.Limit = DefaultListLimit
+	}
+	filter.Limit = min(filter.Limit, MaxListLimit)
+
+	where := []string{"1 = 1"}
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if filter.Key != "" {
+		where = append(where, "key = "+arg(filter.Key))
+	}
+	if filter.User != "" {
+		where = append(where, "user_email = "+arg(filter.User))
+	}
+	if filter.IP != "" {
+		where = append(where, "ip = "+arg(filter.IP))
+	}
+	if !filter.Since.IsZero() {
+		where = append(where, "created_at >= "+arg(filter.Since.UTC()))
+	}
+	if filter.Cursor != "" {
+		createdAt, key, err := decodeCursor(filter.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		where = append(where, fmt.Sprintf("(created_at < %s OR (created_at = %s AND key < %s))", arg(createdAt), arg(createdAt), arg(key)))
+	}
+
+	query := `SELECT key, user_email, source, ip, user_agent, deduped, created_at FROM upload_audit
+		WHERE ` + strings.Join(where, " AND ") + `
+		ORDER BY created_at DESC, key DESC LIMIT ` + arg(filter.Limit+1)
+
+	rows, err := d.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to list audit entries: %v", err)
+	}
+	defer rows.Close()
+
+	entries := make([]*AuditEntry, 0, filter.Limit)
+	for rows.Next() {
+		var e AuditEntry
+		if err := rows.Scan(&e.Key, &e.User, &e.Source, &e.IP, &e.UserAgent, &e.Deduped, &e.CreatedAt); err != nil {
+			return nil, "", fmt.Errorf("failed to list audit entries: %v", err)
+		}
+		entries = append(entries, &e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", fmt.Errorf("failed to list audit entries: %v", err)
+	}
+
+	var next string
+	if len(entries) > filter.Limit {
+		entries = entries[:filter.Limit]
+		last := entries[len(entries)-1]
+		next = encodeCursor(last.CreatedAt, last.Key)
+	}
+	return entries, next, nil
+}
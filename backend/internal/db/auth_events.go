@@ -0,0 +1,138 @@
+package db
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Kinds of AuthEvent
+const (
+	AuthEventLogin  = "login"
+	AuthEventLogout = "logout"
+	// AuthEventDenied is a sign-in the provider's domain, team or allowlist
+	// check rejected
+	AuthEventDenied = "denied"
+	// AuthEventTokenRefresh is a Gmail access token or bearer JWT renewed
+	// without signing in, or refused
+	AuthEventTokenRefresh = "token_refresh"
+	AuthEventImpersonate  = "impersonate"
+)
+
+// AuthEvent records a sign-in, sign-out or token refresh for security
+// reviews
+type AuthEvent struct {
+	ID        string    `json:"id"`
+	Event     string    `json:"event"`
+	User      string    `json:"user"` // empty for sign-ins rejected before the email was known
+	Provider  string    `json:"provider"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Detail    string    `json:"detail,omitempty"` // why a sign-in was denied, what was refreshed
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// AuthEventFilter narrows ListAuthEvents. Zero values don't filter.
+type AuthEventFilter struct {
+	Event    string
+	User     string
+	Provider string
+	IP       string
+	Since    time.Time
+	Cursor   string
+	Limit    int // DefaultListLimit if 0, at most MaxListLimit
+}
+
+// SaveAuthEvent appends an event to the auth log
+func (d *DB) SaveAuthEvent(ctx context.Context, e *AuthEvent) error {
+	if e.ID == "" {
+		id := make([]byte, 12)
+		if _, err := rand.Read(id); err != nil {
+			return err
+		}
+		e.ID = hex.EncodeToString(id)
+	}
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now().UTC().Truncate(time.Microsecond)
+	}
+	_, err := d.db.ExecContext(ctx, `
+		INSERT INTO auth_events (id, event, user_email, provider, ip, user_agent, detail, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		e.ID, e.Event, e.User, e.Provider, e.IP, e.UserAgent, e.Detail, e.CreatedAt.UTC())
+	if err != nil {
+		return fmt.Errorf("failed to save %s event: %v", e.Event, err)
+	}
+	return nil
+}
+
+// ListAuthEvents returns a page of the auth log, newest first, and the
+// cursor of the next page, empty on the last one
+func (d *DB) ListAuthEvents(ctx context.Context, filter AuthEventFilter) ([]*AuthEvent, string, error) {
+	if filter.Limit <= 0 {
+		filter.Limit = DefaultListLimit
+	}
+	filter.Limit = min(filter.Limit, MaxListLimit)
+
+	where := []string{"1 = 1"}
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if filter.Event != "" {
+		where = append(where, "event = "+arg(filter.Event))
+	}
+	if filter.User != "" {
+		where = append(where, "user_email = "+arg(filter.User))
+	}
+	if filter.Provider != "" {
+		where = append(where, "provider = "+arg(filter.Provider))
+	}
+	if filter.IP != "" {
+		where = append(where, "ip = "+arg(filter.IP))
+	}
+	if !filter.Since.IsZero() {
+		where = append(where, "created_at >= "+arg(filter.Since.UTC()))
+	}
+	if filter.Cursor != "" {
+		createdAt, id, err := decodeCursor(filter.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		where = append(where, fmt.Sprintf("(created_at < %s OR (created_at = %s AND id < %s))", arg(createdAt), arg(createdAt), arg(id)))
+	}
+
+	query := `SELECT id, event, user_email, provider, ip, user_agent, detail, created_at FROM auth_events
+		WHERE ` + strings.Join(where, " AND ") + `
+		ORDER BY created_at DESC, id DESC LIMIT ` + arg(filter.Limit+1)
+
+	rows, err := d.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to list auth events: %v", err)
+	}
+	defer rows.Close()
+
+	events := make([]*AuthEvent, 0, filter.Limit)
+	for rows.Next() {
+		var e AuthEvent
+		if err := rows.Scan(&e.ID, &e.Event, &e.User, &e.Provider, &e.IP, &e.UserAgent, &e.Detail, &e.CreatedAt); err != nil {
+			return nil, "", fmt.Errorf("failed to list auth events: %v", err)
+		}
+		events = append(events, &e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", fmt.Errorf("failed to list auth events: %v", err)
+	}
+
+	var next string
+	if len(events) > filter.Limit {
+		events = events[:filter.Limit]
+		last := events[len(events)-1]
+		next = encodeCursor(last.CreatedAt, last.ID)
+	}
+	return events, next, nil
+}
@@ -0,0 +1,272 @@
+package db
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Statuses of a Campaign
+const (
+	CampaignDraft   = "draft"
+	CampaignSending = "sending"
+	// CampaignPaused is a campaign stopped before every recipient was sent
+	// to, by its owner, a restart or an unusable Gmail token
+	CampaignPaused = "paused"
+	CampaignSent   = "sent"
+)
+
+// Statuses of a CampaignRecipient
+const (
+	RecipientPending = "pending"
+	RecipientSent    = "sent"
+	RecipientFailed  = "failed"
+)
+
+// Campaign is a mail merge: a message whose {{placeholders}} are filled in
+// from the columns of an uploaded CSV, sent to each of its rows from the
+// owner's mailbox with the token of the session that created it
+type Campaign struct {
+	ID        string   `json:"id"`
+	Owner     string   `json:"owner"`
+	SessionID string   `json:"-"`
+	Name      string   `json:"name"`
+	Subject   string   `json:"subject"`
+	HTML      string   `json:"html"`
+	Columns   []string `json:"columns"` // of the CSV, in order
+	// EmailColumn is the column recipients' addresses are in
+	EmailColumn string `json:"email_column"`
+	// Mapping is the column each placeholder is filled in from
+	Mapping   map[string]string `json:"mapping"`
+	Status    string            `json:"status"`
+	Error     string            `json:"error,omitempty"` // why the campaign was paused
+	CreatedAt time.Time         `json:"created_at"`
+	UpdatedAt time.Time         `json:"updated_at"`
+}
+
+// CampaignRecipient is a row of a campaign's CSV and what came of sending
+// to it
+type CampaignRecipient struct {
+	CampaignID string            `json:"-"`
+	Row        int               `json:"row"` // from 1, below the header
+	Fields     map[string]string `json:"fields"`
+	Status     string            `json:"status"`
+	Error      string            `json:"error,omitempty"`
+	MessageID  string            `json:"message_id,omitempty"` // Gmail's, once sent
+	SentAt     *time.Time        `json:"sent_at,omitempty"`
+}
+
+// SaveCampaign creates c, giving it an ID, or updates it
+func (d *DB) SaveCampaign(ctx context.Context, c *Campaign) error {
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	if c.ID == "" {
+		id := make([]byte, 12)
+		if _, err := rand.Read(id); err != nil {
+			return err
+		}
+		c.ID = hex.EncodeToString(id)
+	}
+	if c.CreatedAt.IsZero() {
+		c.CreatedAt = now
+	}
+	c.UpdatedAt = now
+	columns, err := json.Marshal(c.Columns)
+	if err != nil {
+		return fmt.Errorf("failed to save campaign %s: %v", c.ID, err)
+	}
+	mapping, err := json.Marshal(c.Mapping)
+	if err != nil {
+		return fmt.Errorf("failed to save campaign %s: %v", c.ID, err)
+	}
+	_, err = d.db.ExecContext(ctx, `
+		INSERT INTO campaigns (id, owner_email, session_id, name, subject, html, columns, email_column, mapping, status, error, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+		ON CONFLICT (id) DO UPDATE SET session_id = excluded.session_id, name = excluded.name, subject = excluded.subject,
+			html = excluded.html, email_column = excluded.email_column, mapping = excluded.mapping, status = excluded.status,
+			error = excluded.error, updated_at = excluded.updated_at`,
+		c.ID, c.Owner, c.SessionID, c.Name, c.Subject, c.HTML, string(columns), c.EmailColumn, string(mapping),
+		c.Status, c.Error, c.CreatedAt, c.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to save campaign %s: %v", c.ID, err)
+	}
+	return nil
+}
+
+// campaignColumns are the columns scanCampaign reads
+const campaignColumns = `id, owner_email, session_id, name, subject, html, columns, email_column, mapping, status, error, created_at, updated_at`
+
+func scanCampaign(row interface{ Scan(...interface{}) error }) (*Campaign, error) {
+	var c Campaign
+	var columns, mapping string
+	err := row.Scan(&c.ID, &c.Owner, &c.SessionID, &c.Name, &c.Subject, &c.HTML, &columns, &c.EmailColumn, &mapping,
+		&c.Status, &c.Error, &c.CreatedAt, &c.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(columns), &c.Columns); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(mapping), &c.Mapping); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// GetCampaign returns a campaign, ErrNotFound if there's no such campaign
+func (d *DB) GetCampaign(ctx context.Context, id string) (*Campaign, error) {
+	c, err := scanCampaign(d.db.QueryRowContext(ctx, `SELECT `+campaignColumns+` FROM campaigns WHERE id = $1`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get campaign %s: %v", id, err)
+	}
+	return c, nil
+}
+
+// ListCampaigns returns the campaigns of owner, newest first, or of everyone
+// if owner is empty
+func (d *DB) ListCampaigns(ctx context.Context, owner string) ([]*Campaign, error) {
+	query, args := `SELECT `+campaignColumns+` FROM campaigns`, []interface{}{}
+	if owner != "" {
+		query += ` WHERE owner_email = $1`
+		args = append(args, owner)
+	}
+	rows, err := d.db.QueryContext(ctx, query+` ORDER BY created_at DESC`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list campaigns: %v", err)
+	}
+	defer rows.Close()
+
+	campaigns := []*Campaign{}
+	for rows.Next() {
+		c, err := scanCampaign(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list campaigns: %v", err)
+		}
+		campaigns = append(campaigns, c)
+	}
+	return campaigns, rows.Err()
+}
+
+// DeleteCampaign removes a campaign and its recipients, ErrNotFound if
+// there's no such campaign
+func (d *DB) DeleteCampaign(ctx context.Context, id string) error {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to delete campaign %s: %v", id, err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM campaign_recipients WHERE campaign_id = $1`, id); err != nil {
+		return fmt.Errorf("failed to delete campaign %s: %v", id, err)
+	}
+	result, err := tx.ExecContext(ctx, `DELETE FROM campaigns WHERE id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete campaign %s: %v", id, err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to delete campaign %s: %v", id, err)
+	}
+	return nil
+}
+
+// AddCampaignRecipients stores the rows of a campaign's CSV, pending
+func (d *DB) AddCampaignRecipients(ctx context.Context, campaignID string, recipients []*CampaignRecipient) error {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to add campaign recipients: %v", err)
+	}
+	defer tx.Rollback()
+
+	for _, r := range recipients {
+		r.CampaignID = campaignID
+		if r.Status == "" {
+			r.Status = RecipientPending
+		}
+		fields, err := json.Marshal(r.Fields)
+		if err != nil {
+			return fmt.Errorf("failed to add campaign recipients: %v", err)
+		}
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO campaign_recipients (campaign_id, row_index, fields, status, error, message_id, sent_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+			campaignID, r.Row, string(fields), r.Status, r.Error, r.MessageID, r.SentAt)
+		if err != nil {
+			return fmt.Errorf("failed to add campaign recipient %d: %v", r.Row, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to add campaign recipients: %v", err)
+	}
+	return nil
+}
+
+// ListCampaignRecipients returns the recipients of a campaign in CSV order,
+// only those with status unless it's empty
+func (d *DB) ListCampaignRecipients(ctx context.Context, campaignID, status string) ([]*CampaignRecipient, error) {
+	query, args := `
+		SELECT row_index, fields, status, error, message_id, sent_at FROM campaign_recipients
+		WHERE campaign_id = $1`, []interface{}{campaignID}
+	if status != "" {
+		query += ` AND status = $2`
+		args = append(args, status)
+	}
+	rows, err := d.db.QueryContext(ctx, query+` ORDER BY row_index`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list campaign recipients: %v", err)
+	}
+	defer rows.Close()
+
+	recipients := []*CampaignRecipient{}
+	for rows.Next() {
+		r := CampaignRecipient{CampaignID: campaignID}
+		var fields string
+		var sentAt sql.NullTime
+		if err := rows.Scan(&r.Row, &fields, &r.Status, &r.Error, &r.MessageID, &sentAt); err != nil {
+			return nil, fmt.Errorf("failed to list campaign recipients: %v", err)
+		}
+		if err := json.Unmarshal([]byte(fields), &r.Fields); err != nil {
+			return nil, fmt.Errorf("failed to list campaign recipients: %v", err)
+		}
+		if sentAt.Valid {
+			r.SentAt = &sentAt.Time
+		}
+		recipients = append(recipients, &r)
+	}
+	return recipients, rows.Err()
+}
+
+// CountCampaignMessages returns how many campaign messages owner's mailbox
+// has sent since a time
+func (d *DB) CountCampaignMessages(ctx context.Context, owner string, since time.Time) (int, error) {
+	var n int
+	err := d.db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM campaign_recipients r JOIN campaigns c ON c.id = r.campaign_id
+		WHERE c.owner_email = $1 AND r.status = $2 AND r.sent_at >= $3`,
+		owner, RecipientSent, since.UTC()).Scan(&n)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count campaign messages: %v", err)
+	}
+	return n, nil
+}
+
+// UpdateCampaignRecipient stores what came of sending to r
+func (d *DB) UpdateCampaignRecipient(ctx context.Context, r *CampaignRecipient) error {
+	_, err := d.db.ExecContext(ctx, `
+		UPDATE campaign_recipients SET status = $1, error = $2, message_id = $3, sent_at = $4
+		WHERE campaign_id = $5 AND row_index = $6`,
+		r.Status, r.Error, r.MessageID, r.SentAt, r.CampaignID, r.Row)
+	if err != nil {
+		return fmt.Errorf("failed to update campaign recipient %d: %v", r.Row, err)
+	}
+	return nil
+}
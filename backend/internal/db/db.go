@@ -0,0 +1,250 @@
+// Package db records asset metadata in SQLite or Postgres
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// DB is the metadata store. Queries are written in the SQL both SQLite and
+// Postgres understand, with $n placeholders.
+type DB struct {
+	db *sql.DB
+}
+
+// Open connects to databaseURL, a postgres:// URL or the path of a SQLite
+// file (optionally prefixed with sqlite://), and brings the schema up to date
+func Open(ctx context.Context, databaseURL string) (*DB, error) {
+	driver, dsn := "sqlite3", strings.TrimPrefix(databaseURL, "sqlite://")
+	if strings.HasPrefix(databaseURL, "postgres://") || strings.HasPrefix(databaseURL, "postgresql://") {
+		driver, dsn = "postgres", databaseURL
+	}
+
+	sqlDB, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %v", err)
+	}
+	if driver == "sqlite3" {
+		// SQLite allows a single writer, serialize instead of failing with
+		// "database is locked"
+		sqlDB.SetMaxOpenConns(1)
+	}
+	if err := sqlDB.PingContext(ctx); err != nil {
+		sqlDB.Close()
+		return nil, fmt.Errorf("failed to connect to database: %v", err)
+	}
+
+	d := &DB{db: sqlDB}
+	if err := d.migrate(ctx); err != nil {
+		sqlDB.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// Close closes the connection pool
+func (d *DB) Close() error {
+	return d.db.Close()
+}
+
+// Ping checks that the database is reachable
+func (d *DB) Ping(ctx context.Context) error {
+	return d.db.PingContext(ctx)
+}
+
+// migrations are applied in order, each once. Only ever append.
+var migrations = []string{
+	`CREATE TABLE assets (
+		key TEXT PRIMARY KEY,
+		hash TEXT NOT NULL,
+		mime TEXT NOT NULL,
+		width INTEGER NOT NULL,
+		height INTEGER NOT NULL,
+		bytes INTEGER NOT NULL,
+		original_bytes INTEGER NOT NULL,
+		uploader TEXT NOT NULL,
+		source_url TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		updated_at TIMESTAMP NOT NULL
+	)`,
+	`ALTER TABLE assets ADD COLUMN deleted_at TIMESTAMP`,
+	// Original bytes or URL plus options -> the asset they produced
+	`CREATE TABLE sources (
+		source TEXT PRIMARY KEY,
+		key TEXT NOT NULL,
+		asset TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL
+	)`,
+	`ALTER TABLE assets ADD COLUMN referenced_at TIMESTAMP`,
+	`ALTER TABLE assets ADD COLUMN namespace TEXT NOT NULL DEFAULT ''`,
+	`CREATE TABLE upload_audit (
+		key TEXT NOT NULL,
+		user_email TEXT NOT NULL,
+		source TEXT NOT NULL,
+		ip TEXT NOT NULL,
+		user_agent TEXT NOT NULL,
+		deduped BOOLEAN NOT NULL,
+		created_at TIMESTAMP NOT NULL
+	)`,
+	`CREATE INDEX upload_audit_key ON upload_audit (key)`,
+	`CREATE INDEX upload_audit_user ON upload_audit (user_email, created_at)`,
+	// Daily CDN views per asset, days are YYYY-MM-DD in UTC
+	`CREATE TABLE asset_views (
+		key TEXT NOT NULL,
+		day TEXT NOT NULL,
+		views INTEGER NOT NULL,
+		PRIMARY KEY (key, day)
+	)`,
+	`ALTER TABLE assets ADD COLUMN expires_at TIMESTAMP`,
+	`CREATE INDEX assets_expires_at ON assets (expires_at)`,
+	// Human-friendly names pointing at asset keys
+	`CREATE TABLE aliases (
+		alias TEXT PRIMARY KEY,
+		key TEXT NOT NULL,
+		owner TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		updated_at TIMESTAMP NOT NULL
+	)`,
+	// Responses to upload requests made with an Idempotency-Key, per user
+	`CREATE TABLE idempotency_keys (
+		owner TEXT NOT NULL,
+		key TEXT NOT NULL,
+		fingerprint TEXT NOT NULL,
+		status INTEGER NOT NULL,
+		body TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (owner, key)
+	)`,
+	`ALTER TABLE assets ADD COLUMN original_key TEXT NOT NULL DEFAULT ''`,
+	// Google OAuth tokens per session, sealed, never sent to the browser
+	`CREATE TABLE oauth_tokens (
+		session_id TEXT PRIMARY KEY,
+		user_email TEXT NOT NULL,
+		access_token BYTEA NOT NULL,
+		refresh_token BYTEA NOT NULL,
+		expiry TIMESTAMP,
+		updated_at TIMESTAMP NOT NULL
+	)`,
+	// Signed-in sessions, listed to their users
+	`CREATE TABLE sessions (
+		id TEXT PRIMARY KEY,
+		user_email TEXT NOT NULL,
+		provider TEXT NOT NULL,
+		ip TEXT NOT NULL,
+		user_agent TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		last_seen_at TIMESTAMP NOT NULL
+	)`,
+	`CREATE INDEX sessions_user ON sessions (user_email, last_seen_at)`,
+	// Logins, logouts, rejected sign-ins and token refreshes
+	`CREATE TABLE auth_events (
+		id TEXT PRIMARY KEY,
+		event TEXT NOT NULL,
+		user_email TEXT NOT NULL,
+		provider TEXT NOT NULL,
+		ip TEXT NOT NULL,
+		user_agent TEXT NOT NULL,
+		detail TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL
+	)`,
+	`CREATE INDEX auth_events_created_at ON auth_events (created_at)`,
+	`CREATE INDEX auth_events_user ON auth_events (user_email, created_at)`,
+	// Mailboxes whose labeled drafts are formatted on Gmail push notifications
+	`CREATE TABLE gmail_watches (
+		user_email TEXT PRIMARY KEY,
+		session_id TEXT NOT NULL,
+		label_id TEXT NOT NULL,
+		label_name TEXT NOT NULL,
+		history_id BIGINT NOT NULL,
+		expires_at TIMESTAMP NOT NULL,
+		created_at TIMESTAMP NOT NULL
+	)`,
+	// Mail merges and the rows of their CSVs
+	`CREATE TABLE campaigns (
+		id TEXT PRIMARY KEY,
+		owner_email TEXT NOT NULL,
+		session_id TEXT NOT NULL,
+		name TEXT NOT NULL,
+		subject TEXT NOT NULL,
+		html TEXT NOT NULL,
+		columns TEXT NOT NULL,
+		email_column TEXT NOT NULL,
+		mapping TEXT NOT NULL,
+		status TEXT NOT NULL,
+		error TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		updated_at TIMESTAMP NOT NULL
+	)`,
+	`CREATE INDEX campaigns_owner ON campaigns (owner_email, created_at)`,
+	`CREATE TABLE campaign_recipients (
+		campaign_id TEXT NOT NULL,
+		row_index INTEGER NOT NULL,
+		fields TEXT NOT NULL,
+		status TEXT NOT NULL,
+		error TEXT NOT NULL,
+		message_id TEXT NOT NULL,
+		sent_at TIMESTAMP,
+		PRIMARY KEY (campaign_id, row_index)
+	)`,
+	// Random key namespaces of users, see UserNamespace
+	`CREATE TABLE user_namespaces (
+		email TEXT PRIMARY KEY,
+		namespace TEXT NOT NULL UNIQUE,
+		created_at TIMESTAMP NOT NULL
+	)`,
+	// The uploaders of each asset, identical uploads share a key; see
+	// AddAssetRef. Live assets are referenced by everyone who uploaded them.
+	`CREATE TABLE asset_refs (
+		key TEXT NOT NULL,
+		user_email TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (key, user_email)
+	)`,
+	`INSERT INTO asset_refs (key, user_email, created_at)
+		SELECT u.key, LOWER(u.user_email), MIN(u.created_at) FROM upload_audit u
+		JOIN assets a ON a.key = u.key
+		WHERE a.deleted_at IS NULL AND u.user_email != ''
+		GROUP BY u.key, LOWER(u.user_email)`,
+	`INSERT INTO asset_refs (key, user_email, created_at)
+		SELECT key, LOWER(uploader), created_at FROM assets
+		WHERE deleted_at IS NULL AND uploader != ''
+		ON CONFLICT (key, user_email) DO NOTHING`,
+	// JSON capture metadata of the first upload, empty for older records
+	`ALTER TABLE assets ADD COLUMN capture TEXT NOT NULL DEFAULT ''`,
+}
+
+// migrate applies the migrations the database hasn't seen yet
+func (d *DB) migrate(ctx context.Context) error {
+	if _, err := d.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`); err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %v", err)
+	}
+
+	var version int
+	if err := d.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version); err != nil {
+		return fmt.Errorf("failed to read schema version: %v", err)
+	}
+
+	for i := version; i < len(migrations); i++ {
+		tx, err := d.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, migrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d failed: %v", i+1, err)
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version) VALUES ($1)`, i+1); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to record migration %d: %v", i+1, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("migration %d failed: %v", i+1, err)
+		}
+	}
+	return nil
+}
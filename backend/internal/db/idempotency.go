@@ -0,0 +1,67 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// IdempotentResponse is the stored response to a request made with an
+// Idempotency-Key, replayed when the request is retried
+type IdempotentResponse struct {
+	Owner string
+	Key   string
+	// Fingerprint identifies the endpoint the key was used with
+	Fingerprint string
+	Status      int
+	Body        []byte
+	CreatedAt   time.Time
+}
+
+// SaveIdempotentResponse stores r, replacing an older response under the
+// same owner and key
+func (d *DB) SaveIdempotentResponse(ctx context.Context, r *IdempotentResponse) error {
+	if r.CreatedAt.IsZero() {
+		r.CreatedAt = time.Now().UTC().Truncate(time.Microsecond)
+	}
+	_, err := d.db.ExecContext(ctx, `
+		INSERT INTO idempotency_keys (owner, key, fingerprint, status, body, created_at) VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (owner, key) DO UPDATE SET fingerprint = excluded.fingerprint, status = excluded.status,
+			body = excluded.body, created_at = excluded.created_at`,
+		r.Owner, r.Key, r.Fingerprint, r.Status, string(r.Body), r.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to save idempotent response: %v", err)
+	}
+	return nil
+}
+
+// GetIdempotentResponse returns the response stored for owner and key since
+// the given time, ErrNotFound if there's none
+func (d *DB) GetIdempotentResponse(ctx context.Context, owner, key string, since time.Time) (*IdempotentResponse, error) {
+	r := IdempotentResponse{Owner: owner, Key: key}
+	var body string
+	err := d.db.QueryRowContext(ctx, `
+		SELECT fingerprint, status, body, created_at FROM idempotency_keys
+		WHERE owner = $1 AND key = $2 AND created_at >= $3`, owner, key, since.UTC()).
+		Scan(&r.Fingerprint, &r.Status, &body, &r.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get idempotent response: %v", err)
+	}
+	r.Body = []byte(body)
+	return &r, nil
+}
+
+// DeleteIdempotentResponses removes responses stored before the given time
+// and returns how many there were
+func (d *DB) DeleteIdempotentResponses(ctx context.Context, before time.Time) (int64, error) {
+	result, err := d.db.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE created_at < $1`, before.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete idempotent responses: %v", err)
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,53 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// AddAssetRef records that user uploaded the asset at key. Identical
+// uploads share a key, each of their uploaders holds a reference to it.
+func (d *DB) AddAssetRef(ctx context.Context, key, user string) error {
+	_, err := d.db.ExecContext(ctx, `
+		INSERT INTO asset_refs (key, user_email, created_at) VALUES ($1, $2, $3)
+		ON CONFLICT (key, user_email) DO NOTHING`,
+		key, strings.ToLower(user), time.Now().UTC().Truncate(time.Microsecond))
+	if err != nil {
+		return fmt.Errorf("failed to add reference to %s: %v", key, err)
+	}
+	return nil
+}
+
+// AssetRefs returns the users holding a reference to the asset at key
+func (d *DB) AssetRefs(ctx context.Context, key string) ([]string, error) {
+	rows, err := d.db.QueryContext(ctx, `SELECT user_email FROM asset_refs WHERE key = $1 ORDER BY created_at`, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list references to %s: %v", key, err)
+	}
+	defer rows.Close()
+
+	var users []string
+	for rows.Next() {
+		var user string
+		if err := rows.Scan(&user); err != nil {
+			return nil, fmt.Errorf("failed to scan reference: %v", err)
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+// RemoveAssetRef drops user's reference to the asset at key, ErrNotFound if
+// they hold none
+func (d *DB) RemoveAssetRef(ctx context.Context, key, user string) error {
+	result, err := d.db.ExecContext(ctx, `DELETE FROM asset_refs WHERE key = $1 AND user_email = $2`, key, strings.ToLower(user))
+	if err != nil {
+		return fmt.Errorf("failed to remove reference to %s: %v", key, err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
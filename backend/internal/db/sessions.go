@@ -0,0 +1,89 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Session is a signed-in session, recorded so users can see where they're
+// signed in. The session itself lives in its cookie.
+type Session struct {
+	ID         string
+	User       string
+	Provider   string
+	IP         string
+	UserAgent  string
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+}
+
+// SaveSession records a new session
+func (d *DB) SaveSession(ctx context.Context, s *Session) error {
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	if s.CreatedAt.IsZero() {
+		s.CreatedAt = now
+	}
+	if s.LastSeenAt.IsZero() {
+		s.LastSeenAt = now
+	}
+	_, err := d.db.ExecContext(ctx, `
+		INSERT INTO sessions (id, user_email, provider, ip, user_agent, created_at, last_seen_at) VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		s.ID, s.User, s.Provider, s.IP, s.UserAgent, s.CreatedAt.UTC(), s.LastSeenAt.UTC())
+	if err != nil {
+		return fmt.Errorf("failed to save session: %v", err)
+	}
+	return nil
+}
+
+// TouchSession records that a session was used at from ip, unless it was
+// already seen since after, to spare a write per request
+func (d *DB) TouchSession(ctx context.Context, id string, at, after time.Time, ip string) error {
+	_, err := d.db.ExecContext(ctx, `
+		UPDATE sessions SET last_seen_at = $1, ip = $2 WHERE id = $3 AND last_seen_at < $4`,
+		at.UTC().Truncate(time.Microsecond), ip, id, after.UTC())
+	if err != nil {
+		return fmt.Errorf("failed to touch session: %v", err)
+	}
+	return nil
+}
+
+// ListSessions returns the sessions of a user seen since the given time,
+// most recently seen first
+func (d *DB) ListSessions(ctx context.Context, user string, since time.Time) ([]Session, error) {
+	rows, err := d.db.QueryContext(ctx, `
+		SELECT id, user_email, provider, ip, user_agent, created_at, last_seen_at FROM sessions
+		WHERE user_email = $1 AND last_seen_at >= $2 ORDER BY last_seen_at DESC`, user, since.UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sessions: %v", err)
+	}
+	defer rows.Close()
+
+	var sessions []Session
+	for rows.Next() {
+		var s Session
+		if err := rows.Scan(&s.ID, &s.User, &s.Provider, &s.IP, &s.UserAgent, &s.CreatedAt, &s.LastSeenAt); err != nil {
+			return nil, fmt.Errorf("failed to scan session: %v", err)
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// DeleteSession removes a session, if it's recorded
+func (d *DB) DeleteSession(ctx context.Context, id string) error {
+	if _, err := d.db.ExecContext(ctx, `DELETE FROM sessions WHERE id = $1`, id); err != nil {
+		return fmt.Errorf("failed to delete session: %v", err)
+	}
+	return nil
+}
+
+// DeleteSessions removes sessions last seen before the given time, which
+// have expired, and returns how many there were
+func (d *DB) DeleteSessions(ctx context.Context, before time.Time) (int64, error) {
+	result, err := d.db.ExecContext(ctx, `DELETE FROM sessions WHERE last_seen_at < $1`, before.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete sessions: %v", err)
+	}
+	return result.RowsAffected()
+}
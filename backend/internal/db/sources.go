@@ -0,0 +1,41 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// LookupSource returns the key and serialized asset previously produced from
+// source, an identifier of the original bytes or URL and the options they
+// were processed with. It returns ErrNotFound if the source is unknown, was
+// recorded before since, or its asset has since been deleted.
+func (d *DB) LookupSource(ctx context.Context, source string, since time.Time) (string, []byte, error) {
+	var key string
+	var asset []byte
+	err := d.db.QueryRowContext(ctx, `
+		SELECT s.key, s.asset FROM sources s
+		JOIN assets a ON a.key = s.key
+		WHERE s.source = $1 AND s.created_at >= $2 AND a.deleted_at IS NULL`, source, since.UTC()).Scan(&key, &asset)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil, ErrNotFound
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to look up source: %v", err)
+	}
+	return key, asset, nil
+}
+
+// SaveSource records that source produced the asset at key
+func (d *DB) SaveSource(ctx context.Context, source, key string, asset []byte) error {
+	_, err := d.db.ExecContext(ctx, `
+		INSERT INTO sources (source, key, asset, created_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (source) DO UPDATE SET key = excluded.key, asset = excluded.asset, created_at = excluded.created_at`,
+		source, key, string(asset), time.Now().UTC().Truncate(time.Microsecond))
+	if err != nil {
+		return fmt.Errorf("failed to save source of %s: %v", key, err)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// OAuthToken is the OAuth token a session signed in with, kept server-side
+// so it never reaches the browser. Tokens are sealed by the caller.
+type OAuthToken struct {
+	SessionID    string
+	User         string
+	AccessToken  []byte
+	RefreshToken []byte
+	Expiry       time.Time // zero when unknown
+	UpdatedAt    time.Time
+}
+
+// SaveOAuthToken stores t, replacing the session's previous token
+func (d *DB) SaveOAuthToken(ctx context.Context, t *OAuthToken) error {
+	t.UpdatedAt = time.Now().UTC().Truncate(time.Microsecond)
+	var expiry *time.Time
+	if !t.Expiry.IsZero() {
+		e := t.Expiry.UTC()
+		expiry = &e
+	}
+	_, err := d.db.ExecContext(ctx, `
+		INSERT INTO oauth_tokens (session_id, user_email, access_token, refresh_token, expiry, updated_at) VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (session_id) DO UPDATE SET user_email = excluded.user_email, access_token = excluded.access_token,
+			refresh_token = excluded.refresh_token, expiry = excluded.expiry, updated_at = excluded.updated_at`,
+		t.SessionID, t.User, t.AccessToken, t.RefreshToken, expiry, t.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to save oauth token: %v", err)
+	}
+	return nil
+}
+
+// GetOAuthToken returns the token of a session, ErrNotFound if there's none
+func (d *DB) GetOAuthToken(ctx context.Context, sessionID string) (*OAuthToken, error) {
+	t := OAuthToken{SessionID: sessionID}
+	var expiry sql.NullTime
+	err := d.db.QueryRowContext(ctx, `
+		SELECT user_email, access_token, refresh_token, expiry, updated_at FROM oauth_tokens
+		WHERE session_id = $1`, sessionID).
+		Scan(&t.User, &t.AccessToken, &t.RefreshToken, &expiry, &t.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get oauth token: %v", err)
+	}
+	if expiry.Valid {
+		t.Expiry = expiry.Time
+	}
+	return &t, nil
+}
+
+// DeleteOAuthToken removes the token of a session, if any
+func (d *DB) DeleteOAuthToken(ctx context.Context, sessionID string) error {
+	if _, err := d.db.ExecContext(ctx, `DELETE FROM oauth_tokens WHERE session_id = $1`, sessionID); err != nil {
+		return fmt.Errorf("failed to delete oauth token: %v", err)
+	}
+	return nil
+}
+
+// DeleteOAuthTokens removes tokens last saved before the given time, those
+// of sessions that have expired, and returns how many there were
+func (d *DB) DeleteOAuthTokens(ctx context.Context, before time.Time) (int64, error) {
+	result, err := d.db.ExecContext(ctx, `DELETE FROM oauth_tokens WHERE updated_at < $1`, before.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete oauth tokens: %v", err)
+	}
+	return result.RowsAffected()
+}
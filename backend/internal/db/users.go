@@ -0,0 +1,49 @@
+package db
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// UserNamespace returns the key namespace of the user with email, creating
+// it on first use. Namespaces are random, so keys don't reveal who uploaded
+// them and two emails never share one.
+func (d *DB) UserNamespace(ctx context.Context, email string) (string, error) {
+	email = strings.ToLower(email)
+	namespace, err := d.userNamespace(ctx, email)
+	if !errors.Is(err, ErrNotFound) {
+		return namespace, err
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	// A concurrent first upload may have created one, which then wins
+	_, err = d.db.ExecContext(ctx, `
+		INSERT INTO user_namespaces (email, namespace, created_at) VALUES ($1, $2, $3)
+		ON CONFLICT (email) DO NOTHING`,
+		email, hex.EncodeToString(id), time.Now().UTC().Truncate(time.Microsecond))
+	if err != nil {
+		return "", fmt.Errorf("failed to create namespace of %s: %v", email, err)
+	}
+	return d.userNamespace(ctx, email)
+}
+
+func (d *DB) userNamespace(ctx context.Context, email string) (string, error) {
+	var namespace string
+	err := d.db.QueryRowContext(ctx, `SELECT namespace FROM user_namespaces WHERE email = $1`, email).Scan(&namespace)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get namespace of %s: %v", email, err)
+	}
+	return namespace, nil
+}
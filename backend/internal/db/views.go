@@ -0,0 +1,68 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// dayFormat is how days are stored in asset_views
+const dayFormat = "2006-01-02"
+
+// ViewCount is a number of views of an asset on a day
+type ViewCount struct {
+	Key   string
+	Day   time.Time
+	Views int
+}
+
+// DailyViews is the view count of one day in AssetViews
+type DailyViews struct {
+	Day   string `json:"day"` // YYYY-MM-DD in UTC
+	Views int    `json:"views"`
+}
+
+// RecordViews adds counts to the daily view totals of their assets
+func (d *DB) RecordViews(ctx context.Context, counts []ViewCount) error {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to record views: %v", err)
+	}
+	defer tx.Rollback()
+
+	for _, c := range counts {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO asset_views (key, day, views) VALUES ($1, $2, $3)
+			ON CONFLICT (key, day) DO UPDATE SET views = asset_views.views + excluded.views`,
+			c.Key, c.Day.UTC().Format(dayFormat), c.Views)
+		if err != nil {
+			return fmt.Errorf("failed to record views of %s: %v", c.Key, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to record views: %v", err)
+	}
+	return nil
+}
+
+// AssetViews returns the daily views of key since the day of since, oldest
+// first. Days without views are left out.
+func (d *DB) AssetViews(ctx context.Context, key string, since time.Time) ([]DailyViews, error) {
+	rows, err := d.db.QueryContext(ctx, `
+		SELECT day, views FROM asset_views WHERE key = $1 AND day >= $2 ORDER BY day`,
+		key, since.UTC().Format(dayFormat))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get views of %s: %v", key, err)
+	}
+	defer rows.Close()
+
+	views := []DailyViews{}
+	for rows.Next() {
+		var v DailyViews
+		if err := rows.Scan(&v.Day, &v.Views); err != nil {
+			return nil, fmt.Errorf("failed to get views of %s: %v", key, err)
+		}
+		views = append(views, v)
+	}
+	return views, rows.Err()
+}
@@ -0,0 +1,88 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// GmailWatch is a mailbox whose drafts are formatted when they're given a
+// label, as Gmail push notifications report it. It calls Gmail with the
+// token of the session that started it.
+type GmailWatch struct {
+	User      string // the mailbox
+	SessionID string
+	LabelID   string
+	LabelName string
+	// HistoryID is the mailbox history the drafts have been formatted up to
+	HistoryID uint64
+	ExpiresAt time.Time // when Gmail stops notifying, unless renewed
+	CreatedAt time.Time
+}
+
+// SaveGmailWatch stores w, replacing the mailbox's previous watch
+func (d *DB) SaveGmailWatch(ctx context.Context, w *GmailWatch) error {
+	if w.CreatedAt.IsZero() {
+		w.CreatedAt = time.Now().UTC().Truncate(time.Microsecond)
+	}
+	_, err := d.db.ExecContext(ctx, `
+		INSERT INTO gmail_watches (user_email, session_id, label_id, label_name, history_id, expires_at, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (user_email) DO UPDATE SET session_id = excluded.session_id, label_id = excluded.label_id, label_name = excluded.label_name,
+			history_id = excluded.history_id, expires_at = excluded.expires_at, created_at = excluded.created_at`,
+		w.User, w.SessionID, w.LabelID, w.LabelName, int64(w.HistoryID), w.ExpiresAt.UTC(), w.CreatedAt.UTC())
+	if err != nil {
+		return fmt.Errorf("failed to save gmail watch: %v", err)
+	}
+	return nil
+}
+
+// GetGmailWatch returns the watch of a mailbox, ErrNotFound if there's none
+func (d *DB) GetGmailWatch(ctx context.Context, user string) (*GmailWatch, error) {
+	w := GmailWatch{User: user}
+	var historyID int64
+	err := d.db.QueryRowContext(ctx, `
+		SELECT session_id, label_id, label_name, history_id, expires_at, created_at FROM gmail_watches
+		WHERE user_email = $1`, user).
+		Scan(&w.SessionID, &w.LabelID, &w.LabelName, &historyID, &w.ExpiresAt, &w.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get gmail watch: %v", err)
+	}
+	w.HistoryID = uint64(historyID)
+	return &w, nil
+}
+
+// ListExpiringGmailWatches returns the watches that expire before a time
+func (d *DB) ListExpiringGmailWatches(ctx context.Context, before time.Time) ([]*GmailWatch, error) {
+	rows, err := d.db.QueryContext(ctx, `
+		SELECT user_email, session_id, label_id, label_name, history_id, expires_at, created_at FROM gmail_watches
+		WHERE expires_at < $1 ORDER BY expires_at`, before.UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list gmail watches: %v", err)
+	}
+	defer rows.Close()
+
+	var watches []*GmailWatch
+	for rows.Next() {
+		var w GmailWatch
+		var historyID int64
+		if err := rows.Scan(&w.User, &w.SessionID, &w.LabelID, &w.LabelName, &historyID, &w.ExpiresAt, &w.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan gmail watch: %v", err)
+		}
+		w.HistoryID = uint64(historyID)
+		watches = append(watches, &w)
+	}
+	return watches, rows.Err()
+}
+
+// DeleteGmailWatch removes the watch of a mailbox, if it has one
+func (d *DB) DeleteGmailWatch(ctx context.Context, user string) error {
+	if _, err := d.db.ExecContext(ctx, `DELETE FROM gmail_watches WHERE user_email = $1`, user); err != nil {
+		return fmt.Errorf("failed to delete gmail watch: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+// Package dedup remembers recently stored asset keys, so that uploads of hot
+// content skip the storage round trip checking whether the object exists
+package dedup
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// Index is a set of keys known to exist in storage. A key is only ever added
+// after its object was stored or found, and removed when it's deleted, so a
+// hit can skip the existence check. Errors count as misses: a failing index
+// makes uploads slower, not wrong. Implementations must be safe for
+// concurrent use.
+type Index interface {
+	Contains(ctx context.Context, key string) bool
+	Add(ctx context.Context, key string)
+	Remove(ctx context.Context, key string)
+}
+
+// LRU is an in-process Index of the size most recently used keys, each
+// remembered for at most ttl. Deletions on other instances aren't seen,
+// multi-instance deployments use Redis.
+type LRU struct {
+	size    int
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // front is most recently used
+	now     func() time.Time
+}
+
+type lruEntry struct {
+	key     string
+	expires time.Time
+}
+
+// NewLRU returns an LRU of size keys
+func NewLRU(size int, ttl time.Duration) *LRU {
+	return &LRU{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+		now:     time.Now,
+	}
+}
+
+// Contains reports whether key was added within the TTL and not evicted
+func (l *LRU) Contains(ctx context.Context, key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	element, ok := l.entries[key]
+	if !ok {
+		return false
+	}
+	if l.now().After(element.Value.(*lruEntry).expires) {
+		l.order.Remove(element)
+		delete(l.entries, key)
+		return false
+	}
+	l.order.MoveToFront(element)
+	return true
+}
+
+// Add remembers key, evicting the least recently used key when full
+func (l *LRU) Add(ctx context.Context, key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	expires := l.now().Add(l.ttl)
+	if element, ok := l.entries[key]; ok {
+		element.Value.(*lruEntry).expires = expires
+		l.order.MoveToFront(element)
+		return
+	}
+	l.entries[key] = l.order.PushFront(&lruEntry{key: key, expires: expires})
+	for l.order.Len() > l.size {
+		oldest := l.order.Back()
+		l.order.Remove(oldest)
+		delete(l.entries, oldest.Value.(*lruEntry).key)
+	}
+}
+
+// Remove forgets key
+func (l *LRU) Remove(ctx context.Context, key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if element, ok := l.entries[key]; ok {
+		l.order.Remove(element)
+		delete(l.entries, key)
+	}
+}
@@ -0,0 +1,157 @@
+package dedup
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLRU(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(0, 0)
+	l := NewLRU(2, time.Minute)
+	l.now = func() time.Time { return now }
+
+	l.Add(ctx, "a")
+	l.Add(ctx, "b")
+	if !l.Contains(ctx, "a") || !l.Contains(ctx, "b") {
+		t.Fatal("added keys missing")
+	}
+	// a was used after b, so b is evicted
+	l.Contains(ctx, "a")
+	l.Add(ctx, "c")
+	if l.Contains(ctx, "b") {
+		t.Error("least recently used key not evicted")
+	}
+	if !l.Contains(ctx, "a") || !l.Contains(ctx, "c") {
+		t.Error("recently used keys evicted")
+	}
+
+	l.Remove(ctx, "a")
+	if l.Contains(ctx, "a") {
+		t.Error("removed key still present")
+	}
+
+	now = now.Add(2 * time.Minute)
+	if l.Contains(ctx, "c") {
+		t.Error("expired key still present")
+	}
+}
+
+// fakeRedis answers EXISTS, SET, DEL, PING, AUTH and SELECT from a map,
+// ignoring expiry
+func fakeRedis(t *testing.T, password string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	var mu sync.Mutex
+	keys := make(map[string]bool)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				authed := password == ""
+				for {
+					args, err := readCommand(reader)
+					if err != nil {
+						return
+					}
+					reply := "+OK\r\n"
+					mu.Lock()
+					switch strings.ToUpper(args[0]) {
+					case "AUTH":
+						authed = args[len(args)-1] == password
+						if !authed {
+							reply = "-WRONGPASS invalid password\r\n"
+						}
+					case "PING":
+						reply = "+PONG\r\n"
+					case "SELECT":
+					case "EXISTS":
+						reply = ":0\r\n"
+						if keys[args[1]] {
+							reply = ":1\r\n"
+						}
+					case "SET":
+						keys[args[1]] = true
+					case "DEL":
+						delete(keys, args[1])
+						reply = ":1\r\n"
+					}
+					if !authed && strings.ToUpper(args[0]) != "AUTH" {
+						reply = "-NOAUTH Authentication required.\r\n"
+					}
+					mu.Unlock()
+					io.WriteString(conn, reply)
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		if _, err := reader.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		arg, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		args[i] = strings.TrimSuffix(arg, "\r\n")
+	}
+	return args, nil
+}
+
+func TestRedis(t *testing.T) {
+	ctx := context.Background()
+	address := fakeRedis(t, "secret")
+
+	if _, err := NewRedis(ctx, fmt.Sprintf("redis://%s", address), time.Minute, time.Second); err == nil {
+		t.Error("expected an error without the password")
+	}
+	if _, err := NewRedis(ctx, "http://"+address, time.Minute, time.Second); err == nil {
+		t.Error("expected an error for a non-Redis URL")
+	}
+
+	r, err := NewRedis(ctx, fmt.Sprintf("redis://:secret@%s/2", address), time.Minute, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Contains(ctx, "ab/key.jpg") {
+		t.Error("unknown key present")
+	}
+	r.Add(ctx, "ab/key.jpg")
+	if !r.Contains(ctx, "ab/key.jpg") {
+		t.Error("added key missing")
+	}
+	r.Remove(ctx, "ab/key.jpg")
+	if r.Contains(ctx, "ab/key.jpg") {
+		t.Error("removed key still present")
+	}
+}
@@ -0,0 +1,69 @@
+package dedup
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisKeyPrefix namespaces the keys of the index in a shared Redis
+const redisKeyPrefix = "format:dedup:"
+
+// redisPoolSize bounds the idle connections kept open
+const redisPoolSize = 8
+
+// Redis is an Index shared by every instance, stored in Redis with the TTL
+// as expiry
+type Redis struct {
+	client *redis.Client
+	ttl    time.Duration
+}
+
+// NewRedis connects to redisURL, redis://[user:password@]host:port[/db] or
+// rediss:// for TLS, and checks that it answers
+func NewRedis(ctx context.Context, redisURL string, ttl, timeout time.Duration) (*Redis, error) {
+	opts, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Redis URL, expected redis://host:port[/db]: %v", err)
+	}
+	opts.DialTimeout, opts.ReadTimeout, opts.WriteTimeout = timeout, timeout, timeout
+	opts.ContextTimeoutEnabled = true
+	opts.MaxIdleConns = redisPoolSize
+	// RESP2 is enough for EXISTS, SET and DEL and works with every server
+	opts.Protocol = 2
+
+	r := &Redis{client: redis.NewClient(opts), ttl: ttl}
+	if err := r.Ping(ctx); err != nil {
+		r.client.Close()
+		return nil, fmt.Errorf("failed to reach Redis: %v", err)
+	}
+	return r, nil
+}
+
+// Contains reports whether key is in the index
+func (r *Redis) Contains(ctx context.Context, key string) bool {
+	n, err := r.client.Exists(ctx, redisKeyPrefix+key).Result()
+	return err == nil && n > 0
+}
+
+// Add puts key in the index for the TTL
+func (r *Redis) Add(ctx context.Context, key string) {
+	r.client.Set(ctx, redisKeyPrefix+key, "1", r.ttl)
+}
+
+// Remove takes key out of the index
+func (r *Redis) Remove(ctx context.Context, key string) {
+	r.client.Del(ctx, redisKeyPrefix+key)
+}
+
+// Ping checks that Redis answers
+func (r *Redis) Ping(ctx context.Context) error {
+	return r.client.Ping(ctx).Err()
+}
+
+// Close closes the connections to Redis
+func (r *Redis) Close() error {
+	return r.client.Close()
+}
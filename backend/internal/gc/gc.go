@@ -0,0 +1,225 @@
+// Package gc deletes assets nothing has referenced within a retention window
+package gc
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/hackclub/format/internal/db"
+	"github.com/hackclub/format/internal/storage"
+	"github.com/hackclub/format/internal/util"
+	"github.com/hackclub/format/internal/webhook"
+	"github.com/rs/zerolog"
+)
+
+// ErrRunning is returned when a collection is already in progress
+var ErrRunning = errors.New("garbage collection already running")
+
+// deleteBatchSize is how many objects are deleted per storage request
+const deleteBatchSize = 1000
+
+// Collector walks the bucket and deletes asset objects, with their variants
+// and renders, whose record expired or wasn't referenced within the
+// retention window, and those left of deleted assets, with their retained
+// originals. Objects that never
+// had a record, like uploads from before records were kept, and aliased
+// assets are never collected.
+type Collector struct {
+	storage   storage.R2ClientInterface
+	private   storage.R2ClientInterface // retained originals, nil if none
+	db        *db.DB
+	notifier  *webhook.Notifier
+	retention time.Duration
+	logger    zerolog.Logger
+	running   sync.Mutex
+}
+
+// Report summarizes a collection
+type Report struct {
+	DryRun       bool      `json:"dry_run"`
+	Cutoff       time.Time `json:"cutoff"`
+	Scanned      int       `json:"scanned"`
+	Deleted      int       `json:"deleted"`
+	DeletedBytes int64     `json:"deleted_bytes"`
+	Errors       int       `json:"errors"`
+}
+
+func NewCollector(storage, private storage.R2ClientInterface, db *db.DB, notifier *webhook.Notifier, retention time.Duration, logger zerolog.Logger) *Collector {
+	return &Collector{
+		storage:   storage,
+		private:   private,
+		db:        db,
+		notifier:  notifier,
+		retention: retention,
+		logger:    logger,
+	}
+}
+
+// Run collects once. With dryRun, it only reports what it would delete.
+func (c *Collector) Run(ctx context.Context, dryRun bool) (*Report, error) {
+	if !c.running.TryLock() {
+		return nil, ErrRunning
+	}
+	defer c.running.Unlock()
+
+	report := &Report{DryRun: dryRun, Cutoff: time.Now().Add(-c.retention).UTC()}
+	var batch []collected
+	err := c.storage.WalkObjects(ctx, "", func(obj types.Object) error {
+		if candidate := c.collect(ctx, obj, report); candidate != nil {
+			batch = append(batch, *candidate)
+		}
+		if len(batch) == deleteBatchSize {
+			c.delete(ctx, batch, report)
+			batch = batch[:0]
+		}
+		return ctx.Err()
+	})
+	c.delete(ctx, batch, report)
+
+	c.logger.Info().
+		Bool("dry_run", dryRun).
+		Int("scanned", report.Scanned).
+		Int("deleted", report.Deleted).
+		Int64("deleted_bytes", report.DeletedBytes).
+		Int("errors", report.Errors).
+		Msg("garbage collection finished")
+	return report, err
+}
+
+// collected is an object to delete, with the record of its asset if any
+type collected struct {
+	key    string
+	record *db.Asset
+}
+
+// collect returns obj if it's an unreferenced asset object to delete, nil
+// otherwise and in dry runs
+func (c *Collector) collect(ctx context.Context, obj types.Object, report *Report) *collected {
+	key := aws.ToString(obj.Key)
+	// Leave anything that isn't ours alone
+	if !util.IsAssetKey(key) {
+		return nil
+	}
+	report.Scanned++
+
+	// Recent objects are kept whatever their record says, their upload may
+	// still be in progress
+	if obj.LastModified == nil || obj.LastModified.After(report.Cutoff) {
+		return nil
+	}
+
+	// Renders in another format have another extension than their asset
+	record, deleted, err := c.db.GetAssetByStem(ctx, util.KeyStem(key))
+	if errors.Is(err, db.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		c.logger.Error().Err(err).Str("key", key).Msg("failed to look up asset for garbage collection")
+		report.Errors++
+		return nil
+	}
+	if !deleted {
+		live, err := c.live(ctx, record, report.Cutoff)
+		if err != nil {
+			c.logger.Error().Err(err).Str("key", key).Msg("failed to look up aliases for garbage collection")
+			report.Errors++
+			return nil
+		}
+		if live {
+			return nil
+		}
+	} else {
+		// Only what's left of a deleted asset, there's nothing to tombstone
+		record = nil
+	}
+
+	report.Deleted++
+	report.DeletedBytes += aws.ToInt64(obj.Size)
+	if report.DryRun {
+		c.logger.Info().Str("key", key).Msg("would delete unreferenced object")
+		return nil
+	}
+	return &collected{key: key, record: record}
+}
+
+// live reports whether the asset of record is kept: it's aliased, or it
+// expires later or, without an expiry, was referenced since cutoff
+func (c *Collector) live(ctx context.Context, record *db.Asset, cutoff time.Time) (bool, error) {
+	if record.ExpiresAt != nil {
+		if record.ExpiresAt.After(time.Now()) {
+			return true, nil
+		}
+	} else if record.LastReferenced().After(cutoff) {
+		return true, nil
+	}
+	return c.db.IsAliased(ctx, record.Key)
+}
+
+// delete deletes a batch of collected objects in one storage request
+func (c *Collector) delete(ctx context.Context, batch []collected, report *Report) {
+	if len(batch) == 0 {
+		return
+	}
+	keys := make([]string, len(batch))
+	for i, candidate := range batch {
+		keys[i] = candidate.key
+	}
+	failed := c.storage.DeleteMany(ctx, keys)
+
+	for _, candidate := range batch {
+		key := candidate.key
+		if err := failed[key]; err != nil {
+			c.logger.Error().Err(err).Str("key", key).Msg("failed to delete unreferenced object")
+			report.Errors++
+			continue
+		}
+		// Tombstone the record with its object, the variants and renders
+		// walked after this batch then find it deleted
+		if candidate.record != nil && key == candidate.record.Key {
+			if err := c.db.DeleteAsset(ctx, key); err != nil {
+				c.logger.Error().Err(err).Str("key", key).Msg("failed to tombstone collected asset")
+				report.Errors++
+			} else {
+				c.deleteOriginal(ctx, candidate.record.OriginalKey, report)
+			}
+			c.notifier.Notify(webhook.EventDeleted, "", candidate.record)
+		}
+		c.logger.Info().Str("key", key).Msg("deleted unreferenced object")
+	}
+}
+
+// deleteOriginal deletes the retained original of a collected asset once no
+// live asset was processed from it
+func (c *Collector) deleteOriginal(ctx context.Context, originalKey string, report *Report) {
+	if originalKey == "" || c.private == nil {
+		return
+	}
+	inUse, err := c.db.OriginalInUse(ctx, originalKey)
+	if err == nil && !inUse {
+		err = c.private.Delete(ctx, originalKey)
+	}
+	if err != nil {
+		c.logger.Error().Err(err).Str("key", originalKey).Msg("failed to delete original of collected asset")
+		report.Errors++
+	}
+}
+
+// Start collects every interval until ctx is done
+func (c *Collector) Start(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := c.Run(ctx, false); err != nil {
+				c.logger.Error().Err(err).Msg("garbage collection failed")
+			}
+		}
+	}
+}
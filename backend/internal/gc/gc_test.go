@@ -0,0 +1,127 @@
+package gc
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hackclub/format/internal/db"
+	"github.com/hackclub/format/internal/storage"
+	"github.com/hackclub/format/internal/util"
+	"github.com/rs/zerolog"
+)
+
+func TestCollect(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	database, err := db.Open(ctx, filepath.Join(dir, "format.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+	mock := storage.NewMockR2Client(filepath.Join(dir, "assets"), "http://localhost:8080/img")
+
+	old := time.Now().Add(-48 * time.Hour)
+	key := func(name, ext string) string { return util.Base32Key([]byte(name), ext) }
+	derived := func(key, suffix string) string { return strings.TrimSuffix(key, filepath.Ext(key)) + suffix }
+	put := func(key string, modified time.Time) {
+		t.Helper()
+		if _, err := mock.Upload(ctx, key, []byte(key), "image/jpeg"); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(filepath.Join(dir, "assets", filepath.FromSlash(key)), modified, modified); err != nil {
+			t.Fatal(err)
+		}
+	}
+	record := func(key string, expiresAt *time.Time) {
+		t.Helper()
+		if err := database.SaveAsset(ctx, &db.Asset{Key: key, Hash: "sha256:" + key, MIME: "image/jpeg", ExpiresAt: expiresAt, OriginalKey: util.OriginalsPrefix + key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	legacy := key("legacy", ".jpg")
+	unreferenced := key("unreferenced", ".jpg")
+	variant := derived(unreferenced, "_thumb.jpg")
+	webp := derived(unreferenced, "_w320_h0_contain.webp")
+	referenced := key("referenced", ".jpg")
+	aliased := key("aliased", ".jpg")
+	expired := key("expired", ".jpg")
+	expiring := key("expiring", ".jpg")
+	recent := key("recent", ".jpg")
+	deleted := key("deleted", ".jpg")
+	orphan := derived(deleted, "_w320_h0_contain.webp")
+
+	past, future := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	for _, k := range []string{unreferenced, referenced, aliased, recent, deleted} {
+		record(k, nil)
+	}
+	record(expired, &past)
+	record(expiring, &future)
+	if err := database.DeleteAsset(ctx, deleted); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := database.CreateAlias(ctx, &db.Alias{Alias: "logo", Key: aliased, Owner: "orpheus@hackclub.com"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{legacy, unreferenced, variant, webp, referenced, aliased, expired, expiring, orphan} {
+		put(k, old)
+	}
+
+	// Everything recorded so far falls out of the window, but the asset
+	// referenced after it and the object just uploaded
+	private := storage.NewMockR2Client(filepath.Join(dir, "private"), "")
+	for _, k := range []string{unreferenced, referenced} {
+		if _, err := private.Upload(ctx, util.OriginalsPrefix+k, []byte(k), "image/png"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := NewCollector(mock, private, database, nil, 50*time.Millisecond, zerolog.Nop())
+	time.Sleep(100 * time.Millisecond)
+	if err := database.TouchAssets(ctx, []string{referenced}); err != nil {
+		t.Fatal(err)
+	}
+	put(recent, time.Now())
+
+	report, err := c.Run(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Deleted != 5 {
+		t.Errorf("dry run would delete %d objects, want 5", report.Deleted)
+	}
+	if exists, _ := mock.ObjectExists(ctx, unreferenced); !exists {
+		t.Fatal("dry run deleted an object")
+	}
+
+	if _, err := c.Run(ctx, false); err != nil {
+		t.Fatal(err)
+	}
+	for k, want := range map[string]bool{
+		legacy:       true,
+		unreferenced: false,
+		variant:      false,
+		webp:         false,
+		referenced:   true,
+		aliased:      true,
+		expired:      false,
+		expiring:     true,
+		recent:       true,
+		orphan:       false,
+	} {
+		if exists, _ := mock.ObjectExists(ctx, k); exists != want {
+			t.Errorf("%s exists = %v, want %v", k, exists, want)
+		}
+	}
+	for k, want := range map[string]bool{unreferenced: false, referenced: true} {
+		if exists, _ := private.ObjectExists(ctx, util.OriginalsPrefix+k); exists != want {
+			t.Errorf("original of %s exists = %v, want %v", k, exists, want)
+		}
+	}
+	if _, err := database.GetAsset(ctx, unreferenced); err != db.ErrNotFound {
+		t.Errorf("collected asset's record: got %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,499 @@
+package gmail
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/oauth2"
+	gmailapi "google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+)
+
+var (
+	// ErrNotConnected is returned for sessions that haven't granted Gmail
+	// access yet, or signed in with another provider than Google
+	ErrNotConnected = errors.New("gmail access has not been granted")
+	// ErrTokenExpired is returned when the session's access token has
+	// expired or been revoked
+	ErrTokenExpired = errors.New("gmail access has expired, grant it again")
+	// ErrNoAccess is returned when the user didn't grant Gmail access
+	ErrNoAccess = errors.New("gmail access was not granted, grant it again")
+	// ErrNotFound is returned for messages and attachments that don't exist
+	ErrNotFound = errors.New("message or attachment not found")
+	// ErrUnavailable is returned when Gmail asks to slow down or fails on
+	// its side, the call may succeed later
+	ErrUnavailable = errors.New("gmail is busy, try again later")
+)
+
+// Client calls the Gmail API with the token of a session
+type Client struct {
+	tokens   *TokenStore
+	contacts *contactCache
+	logger   zerolog.Logger
+	endpoint string // overridden in tests
+}
+
+func NewClient(tokens *TokenStore, logger zerolog.Logger) *Client {
+	return &Client{tokens: tokens, contacts: &contactCache{}, logger: logger}
+}
+
+// Tokens is where the client reads the tokens of sessions
+func (c *Client) Tokens() *TokenStore {
+	return c.tokens
+}
+
+// Attachment is a file attached to a message
+type Attachment struct {
+	Filename string
+	MimeType string
+	Data     []byte
+}
+
+// Hint helps find an attachment whose ID from a Gmail URL doesn't match the
+// message's, by the filename or alt text of the image it was in
+type Hint struct {
+	Filename string
+	Alt      string
+}
+
+// Profile returns the address of the session's mailbox, checking that it
+// can be read
+func (c *Client) Profile(ctx context.Context, sessionID string) (string, error) {
+	svc, err := c.service(ctx, sessionID)
+	if err != nil {
+		return "", err
+	}
+	profile, err := svc.Users.GetProfile("me").Context(ctx).Do()
+	if err != nil {
+		return "", apiError(err)
+	}
+	return profile.EmailAddress, nil
+}
+
+// Draft is a draft created in the user's mailbox
+type Draft struct {
+	ID        string `json:"id"`
+	MessageID string `json:"message_id"`
+}
+
+// CreateDraft creates a draft of message, an RFC 5322 message, in the
+// session's mailbox, in threadID unless empty. It needs the compose scope,
+// ErrNoAccess otherwise.
+func (c *Client) CreateDraft(ctx context.Context, sessionID string, message []byte, threadID string) (*Draft, error) {
+	svc, err := c.service(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	// Uploaded as media, messages with inline images outgrow JSON bodies
+	draft, err := svc.Users.Drafts.Create("me", &gmailapi.Draft{Message: &gmailapi.Message{ThreadId: threadID}}).
+		Media(bytes.NewReader(message), googleapi.ContentType("message/rfc822")).
+		Context(ctx).Do()
+	if err != nil {
+		return nil, apiError(err)
+	}
+	result := &Draft{ID: draft.Id}
+	if draft.Message != nil {
+		result.MessageID = draft.Message.Id
+	}
+	return result, nil
+}
+
+// Imported is a message imported into the user's mailbox
+type Imported struct {
+	ID       string
+	ThreadID string
+}
+
+// ImportDraft adds message, an RFC 5322 message, to the session's mailbox as
+// a draft, in threadID unless empty. Unlike drafts created through the API,
+// imported messages are stored as they are. It needs the insert scope,
+// ErrNoAccess otherwise.
+func (c *Client) ImportDraft(ctx context.Context, sessionID string, message []byte, threadID string) (*Imported, error) {
+	svc, err := c.service(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	imported, err := svc.Users.Messages.Import("me", &gmailapi.Message{LabelIds: []string{"DRAFT"}, ThreadId: threadID}).
+		InternalDateSource("dateHeader").
+		NeverMarkSpam(true).
+		Media(bytes.NewReader(message), googleapi.ContentType("message/rfc822")).
+		Context(ctx).Do()
+	if err != nil {
+		return nil, apiError(err)
+	}
+	return &Imported{ID: imported.Id, ThreadID: imported.ThreadId}, nil
+}
+
+// Send sends message, an RFC 5322 message, from the session's mailbox and
+// returns the ID Gmail gave it. The compose scope allows sending.
+func (c *Client) Send(ctx context.Context, sessionID string, message []byte) (string, error) {
+	svc, err := c.service(ctx, sessionID)
+	if err != nil {
+		return "", err
+	}
+	sent, err := svc.Users.Messages.Send("me", &gmailapi.Message{}).
+		Media(bytes.NewReader(message), googleapi.ContentType("message/rfc822")).
+		Context(ctx).Do()
+	if err != nil {
+		return "", apiError(err)
+	}
+	return sent.Id, nil
+}
+
+// Reply is what a reply needs of the message it's to
+type Reply struct {
+	ThreadID string
+	// MessageID and References are the message's headers, a reply's
+	// In-Reply-To and References follow from them
+	MessageID  string
+	References string
+	Subject    string
+	From       string
+	// ReplyTo is where replies go, From unless the message says otherwise
+	ReplyTo string
+	Date    time.Time
+	HTML    string
+}
+
+// Reply fetches the message a reply is to: messageID, or else the latest
+// message of threadID that isn't a draft
+func (c *Client) Reply(ctx context.Context, sessionID, messageID, threadID string) (*Reply, error) {
+	svc, err := c.service(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	var message *gmailapi.Message
+	if messageID != "" {
+		if message, err = svc.Users.Messages.Get("me", messageID).Format("full").Context(ctx).Do(); err != nil {
+			return nil, apiError(err)
+		}
+	} else {
+		thread, err := svc.Users.Threads.Get("me", threadID).Format("full").Context(ctx).Do()
+		if err != nil {
+			return nil, apiError(err)
+		}
+		for _, m := range thread.Messages {
+			if !hasLabels(m, "DRAFT") {
+				message = m
+			}
+		}
+		if message == nil {
+			return nil, ErrNotFound
+		}
+	}
+	if message.Payload == nil {
+		return nil, ErrNotFound
+	}
+
+	reply := &Reply{
+		ThreadID:   message.ThreadId,
+		MessageID:  header(message.Payload, "Message-ID"),
+		References: header(message.Payload, "References"),
+		Subject:    header(message.Payload, "Subject"),
+		From:       header(message.Payload, "From"),
+		ReplyTo:    header(message.Payload, "Reply-To"),
+		Date:       time.UnixMilli(message.InternalDate),
+	}
+	if reply.ReplyTo == "" {
+		reply.ReplyTo = reply.From
+	}
+	if date, err := mail.ParseDate(header(message.Payload, "Date")); err == nil {
+		reply.Date = date
+	}
+	if reply.HTML, err = messageBody(message.Payload, "text/html"); err != nil {
+		return nil, err
+	}
+	if reply.HTML == "" {
+		text, err := messageBody(message.Payload, "text/plain")
+		if err != nil {
+			return nil, err
+		}
+		reply.HTML = strings.ReplaceAll(html.EscapeString(text), "\n", "<br>")
+	}
+	return reply, nil
+}
+
+// MaxDrafts is the most drafts Drafts lists
+const MaxDrafts = 25
+
+// DraftSummary describes a draft for picking one
+type DraftSummary struct {
+	ID        string    `json:"id"`
+	MessageID string    `json:"message_id"`
+	Subject   string    `json:"subject"`
+	To        string    `json:"to,omitempty"`
+	Snippet   string    `json:"snippet"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Drafts lists up to limit of the session's most recent drafts, newest
+// first
+func (c *Client) Drafts(ctx context.Context, sessionID string, limit int) ([]*DraftSummary, error) {
+	svc, err := c.service(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	list, err := svc.Users.Drafts.List("me").MaxResults(int64(min(limit, MaxDrafts))).Context(ctx).Do()
+	if err != nil {
+		return nil, apiError(err)
+	}
+
+	// The list only has IDs, each draft's headers are fetched concurrently
+	drafts := make([]*DraftSummary, len(list.Drafts))
+	errs := make([]error, len(list.Drafts))
+	var wg sync.WaitGroup
+	for i, d := range list.Drafts {
+		wg.Add(1)
+		go func(i int, id string) {
+			defer wg.Done()
+			draft, err := svc.Users.Drafts.Get("me", id).Format("metadata").Context(ctx).Do()
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			drafts[i] = draftSummary(draft)
+		}(i, d.Id)
+	}
+	wg.Wait()
+
+	summaries := make([]*DraftSummary, 0, len(drafts))
+	for i, draft := range drafts {
+		if errs[i] != nil {
+			// Sent or deleted since it was listed
+			if errors.Is(apiError(errs[i]), ErrNotFound) {
+				continue
+			}
+			return nil, apiError(errs[i])
+		}
+		summaries = append(summaries, draft)
+	}
+	sort.SliceStable(summaries, func(i, j int) bool { return summaries[i].UpdatedAt.After(summaries[j].UpdatedAt) })
+	return summaries, nil
+}
+
+func draftSummary(draft *gmailapi.Draft) *DraftSummary {
+	summary := &DraftSummary{ID: draft.Id}
+	if draft.Message == nil {
+		return summary
+	}
+	summary.MessageID = draft.Message.Id
+	summary.Snippet = html.UnescapeString(draft.Message.Snippet)
+	summary.UpdatedAt = time.UnixMilli(draft.Message.InternalDate).UTC()
+	if draft.Message.Payload != nil {
+		for _, header := range draft.Message.Payload.Headers {
+			switch strings.ToLower(header.Name) {
+			case "subject":
+				summary.Subject = header.Value
+			case "to":
+				summary.To = header.Value
+			}
+		}
+	}
+	return summary
+}
+
+// Attachment downloads an attachment of a message. attachmentID is the
+// attid or realattid of a Gmail attachment URL, matched against the
+// X-Attachment-Id of the message's parts before their attachment IDs.
+func (c *Client) Attachment(ctx context.Context, sessionID, messageID, attachmentID string, hint Hint) (*Attachment, error) {
+	svc, err := c.service(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	message, err := svc.Users.Messages.Get("me", messageID).Format("full").Context(ctx).Do()
+	if err != nil {
+		return nil, apiError(err)
+	}
+	part := findAttachment(message.Payload, attachmentID, hint)
+	if part == nil {
+		// URL attachment IDs are sometimes unrelated to the message's,
+		// fall back to its first image
+		part = findImage(message.Payload)
+		if part == nil {
+			return nil, ErrNotFound
+		}
+		c.logger.Debug().Str("attachment_id", attachmentID).Str("filename", part.Filename).Msg("attachment not found by ID, using the first image")
+	}
+
+	return download(ctx, svc, messageID, part)
+}
+
+// download fetches the data of an attachment part of a message
+func download(ctx context.Context, svc *gmailapi.Service, messageID string, part *gmailapi.MessagePart) (*Attachment, error) {
+	body, err := svc.Users.Messages.Attachments.Get("me", messageID, part.Body.AttachmentId).Context(ctx).Do()
+	if err != nil {
+		return nil, apiError(err)
+	}
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(body.Data, "="))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode attachment: %v", err)
+	}
+	return &Attachment{Filename: part.Filename, MimeType: part.MimeType, Data: data}, nil
+}
+
+func (c *Client) service(ctx context.Context, sessionID string) (*gmailapi.Service, error) {
+	opts, err := c.options(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	return gmailapi.NewService(ctx, opts...)
+}
+
+// options authenticate Google API calls with the session's token
+func (c *Client) options(ctx context.Context, sessionID string) ([]option.ClientOption, error) {
+	// RequireToken already refreshed it
+	var token *oauth2.Token
+	if t := tokenFromContext(ctx); t != nil && t.token != nil {
+		token = t.token
+	} else {
+		var err error
+		if token, err = c.tokens.Token(ctx, sessionID); err != nil {
+			return nil, err
+		}
+	}
+	opts := []option.ClientOption{option.WithTokenSource(oauth2.StaticTokenSource(token))}
+	if c.endpoint != "" {
+		opts = append(opts, option.WithEndpoint(c.endpoint))
+	}
+	return opts, nil
+}
+
+// apiError maps Gmail API errors the user can act on to ours
+func apiError(err error) error {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		switch {
+		case apiErr.Code == http.StatusTooManyRequests || apiErr.Code >= http.StatusInternalServerError:
+			return fmt.Errorf("%w: %v", ErrUnavailable, apiErr.Message)
+		case apiErr.Code == http.StatusUnauthorized:
+			return ErrTokenExpired
+		case apiErr.Code == http.StatusForbidden:
+			// Gmail also answers 403 to users sending too fast
+			for _, item := range apiErr.Errors {
+				if item.Reason == "rateLimitExceeded" || item.Reason == "userRateLimitExceeded" {
+					return fmt.Errorf("%w: %v", ErrUnavailable, apiErr.Message)
+				}
+			}
+			return ErrNoAccess
+		case apiErr.Code == http.StatusNotFound || apiErr.Code == http.StatusBadRequest:
+			return ErrNotFound
+		}
+	}
+	return fmt.Errorf("gmail API call failed: %v", err)
+}
+
+var nonAlphanumeric = regexp.MustCompile(`[^a-z0-9]+`)
+
+// findAttachment returns the part of an attachment by its X-Attachment-Id,
+// Content-ID or attachment ID, or else an image whose filename matches the hint's
+// filename or shares words with its alt text
+func findAttachment(part *gmailapi.MessagePart, attachmentID string, hint Hint) *gmailapi.MessagePart {
+	if part == nil {
+		return nil
+	}
+	if part.Body != nil && part.Body.AttachmentId != "" {
+		for _, h := range part.Headers {
+			if strings.EqualFold(h.Name, "X-Attachment-Id") && h.Value == attachmentID {
+				return part
+			}
+			if strings.EqualFold(h.Name, "Content-ID") && strings.Trim(h.Value, "<>") == attachmentID {
+				return part
+			}
+		}
+		if part.Body.AttachmentId == attachmentID {
+			return part
+		}
+		if strings.HasPrefix(part.MimeType, "image/") && matchesHint(part.Filename, hint) {
+			return part
+		}
+	}
+	for _, sub := range part.Parts {
+		if found := findAttachment(sub, attachmentID, hint); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+func matchesHint(filename string, hint Hint) bool {
+	name := nonAlphanumeric.ReplaceAllString(strings.ToLower(filename), "")
+	if want := nonAlphanumeric.ReplaceAllString(strings.ToLower(hint.Filename), ""); want != "" && name != "" {
+		if strings.Contains(want, name) || strings.Contains(name, want) {
+			return true
+		}
+	}
+	if len(hint.Alt) <= 10 {
+		return false
+	}
+	for _, word := range strings.Fields(strings.ToLower(hint.Alt)) {
+		if len(word) <= 3 {
+			continue
+		}
+		for _, part := range nonAlphanumeric.Split(strings.ToLower(filename), -1) {
+			if len(part) > 3 && (strings.Contains(part, word) || strings.Contains(word, part)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// findImage returns the first image attachment of a message
+func findImage(part *gmailapi.MessagePart) *gmailapi.MessagePart {
+	if part == nil {
+		return nil
+	}
+	if part.Body != nil && part.Body.AttachmentId != "" && strings.HasPrefix(part.MimeType, "image/") {
+		return part
+	}
+	for _, sub := range part.Parts {
+		if found := findImage(sub); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// header returns the value of a header of a message part
+func header(part *gmailapi.MessagePart, name string) string {
+	for _, h := range part.Headers {
+		if strings.EqualFold(h.Name, name) {
+			return h.Value
+		}
+	}
+	return ""
+}
+
+// messageBody returns the body of a message of mimeType, text/html or
+// text/plain, empty if it has none
+func messageBody(part *gmailapi.MessagePart, mimeType string) (string, error) {
+	if part == nil {
+		return "", nil
+	}
+	if part.MimeType == mimeType && part.Body != nil && part.Body.Data != "" {
+		data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(part.Body.Data, "="))
+		if err != nil {
+			return "", fmt.Errorf("failed to decode message body: %v", err)
+		}
+		return string(data), nil
+	}
+	for _, sub := range part.Parts {
+		if body, err := messageBody(sub, mimeType); body != "" || err != nil {
+			return body, err
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,829 @@
+package gmail
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hackclub/format/internal/db"
+	"github.com/hackclub/format/internal/html"
+	"github.com/rs/zerolog"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+)
+
+// memoryDB is a TokenDB in memory
+type memoryDB map[string]*db.OAuthToken
+
+func (m memoryDB) SaveOAuthToken(ctx context.Context, t *db.OAuthToken) error {
+	t.UpdatedAt = time.Now()
+	m[t.SessionID] = t
+	return nil
+}
+
+func (m memoryDB) GetOAuthToken(ctx context.Context, sessionID string) (*db.OAuthToken, error) {
+	if t, ok := m[sessionID]; ok {
+		return t, nil
+	}
+	return nil, db.ErrNotFound
+}
+
+func (m memoryDB) DeleteOAuthToken(ctx context.Context, sessionID string) error {
+	delete(m, sessionID)
+	return nil
+}
+
+func (m memoryDB) DeleteOAuthTokens(ctx context.Context, before time.Time) (int64, error) {
+	return 0, nil
+}
+
+func TestTokenStore(t *testing.T) {
+	ctx := context.Background()
+	database := memoryDB{}
+	store, err := NewTokenStore(database, nil, "secret", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.Get(ctx, "session-1"); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("Get(missing) error = %v, want ErrNotConnected", err)
+	}
+	token := &oauth2.Token{AccessToken: "access", RefreshToken: "refresh", Expiry: time.Now().Add(time.Hour)}
+	if err := store.Save(ctx, "session-1", "a@hackclub.com", token); err != nil {
+		t.Fatal(err)
+	}
+	if string(database["session-1"].AccessToken) == "access" {
+		t.Error("access token stored in the clear")
+	}
+	got, err := store.Get(ctx, "session-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.AccessToken != "access" || got.RefreshToken != "refresh" {
+		t.Errorf("Get = %+v", got)
+	}
+
+	// A sealed token only opens for its own session
+	database["session-2"] = &db.OAuthToken{SessionID: "session-2", AccessToken: database["session-1"].AccessToken, RefreshToken: database["session-1"].RefreshToken, UpdatedAt: time.Now()}
+	if _, err := store.Get(ctx, "session-2"); err == nil {
+		t.Error("token moved to another session opened")
+	}
+}
+
+// refresherFunc is a Refresher whose token sources call it
+type refresherFunc func(token *oauth2.Token) (*oauth2.Token, error)
+
+func (f refresherFunc) TokenSource(ctx context.Context, token *oauth2.Token) oauth2.TokenSource {
+	return tokenSourceFunc(func() (*oauth2.Token, error) { return f(token) })
+}
+
+type tokenSourceFunc func() (*oauth2.Token, error)
+
+func (f tokenSourceFunc) Token() (*oauth2.Token, error) { return f() }
+
+func TestTokenRefresh(t *testing.T) {
+	ctx := context.Background()
+	refreshes := 0
+	refresher := refresherFunc(func(token *oauth2.Token) (*oauth2.Token, error) {
+		if token.RefreshToken != "refresh" {
+			return nil, &oauth2.RetrieveError{Response: &http.Response{StatusCode: http.StatusBadRequest}}
+		}
+		refreshes++
+		return &oauth2.Token{AccessToken: "new-access", Expiry: time.Now().Add(time.Hour)}, nil
+	})
+	store, err := NewTokenStore(memoryDB{}, refresher, "secret", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// About to expire, refreshed and stored with the same refresh token
+	if err := store.Save(ctx, "session-1", "a@hackclub.com", &oauth2.Token{AccessToken: "access", RefreshToken: "refresh", Expiry: time.Now().Add(30 * time.Second)}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		token, err := store.Token(ctx, "session-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token.AccessToken != "new-access" {
+			t.Errorf("Token = %s, want new-access", token.AccessToken)
+		}
+	}
+	if refreshes != 1 {
+		t.Errorf("refreshed %d times, want once", refreshes)
+	}
+	if stored, _ := store.Get(ctx, "session-1"); stored.RefreshToken != "refresh" {
+		t.Errorf("refresh token after refresh = %q, want kept", stored.RefreshToken)
+	}
+
+	// Refused refresh tokens and missing ones need the user to sign in again
+	if err := store.Save(ctx, "revoked", "a@hackclub.com", &oauth2.Token{AccessToken: "access", RefreshToken: "revoked", Expiry: time.Now().Add(-time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Token(ctx, "revoked"); !errors.Is(err, ErrTokenExpired) {
+		t.Errorf("Token(revoked) error = %v, want ErrTokenExpired", err)
+	}
+	if err := store.Save(ctx, "no-refresh", "a@hackclub.com", &oauth2.Token{AccessToken: "access", Expiry: time.Now().Add(-time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Token(ctx, "no-refresh"); !errors.Is(err, ErrTokenExpired) {
+		t.Errorf("Token(no refresh token) error = %v, want ErrTokenExpired", err)
+	}
+}
+
+func TestAttachment(t *testing.T) {
+	image := []byte("\x89PNG\r\n\x1a\nimage")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer access" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/gmail/v1/users/me/messages/msg-f:1":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"id": "1",
+				"payload": map[string]interface{}{
+					"mimeType": "multipart/related",
+					"parts": []map[string]interface{}{
+						{"mimeType": "text/html", "body": map[string]interface{}{"data": ""}},
+						{
+							"mimeType": "image/png",
+							"filename": "logo.png",
+							"headers":  []map[string]string{{"name": "X-Attachment-ID", "value": "ii_abc"}},
+							"body":     map[string]interface{}{"attachmentId": "ANGjdJ8"},
+						},
+					},
+				},
+			})
+		case "/gmail/v1/users/me/messages/msg-f:1/attachments/ANGjdJ8":
+			json.NewEncoder(w).Encode(map[string]string{"data": base64.URLEncoding.EncodeToString(image)})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	store, err := NewTokenStore(memoryDB{}, nil, "secret", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(ctx, "session-1", "a@hackclub.com", &oauth2.Token{AccessToken: "access", Expiry: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(ctx, "expired", "a@hackclub.com", &oauth2.Token{AccessToken: "access", Expiry: time.Now().Add(-time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+	client := NewClient(store, zerolog.Nop())
+	client.endpoint = server.URL + "/"
+
+	for _, id := range []string{"ii_abc", "ANGjdJ8", "unknown"} {
+		attachment, err := client.Attachment(ctx, "session-1", "msg-f:1", id, Hint{})
+		if err != nil {
+			t.Fatalf("Attachment(%s) = %v", id, err)
+		}
+		if string(attachment.Data) != string(image) || attachment.MimeType != "image/png" || attachment.Filename != "logo.png" {
+			t.Errorf("Attachment(%s) = %+v", id, attachment)
+		}
+	}
+
+	if _, err := client.Attachment(ctx, "session-1", "msg-f:2", "ii_abc", Hint{}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Attachment(missing message) error = %v, want ErrNotFound", err)
+	}
+	if _, err := client.Attachment(ctx, "expired", "msg-f:1", "ii_abc", Hint{}); !errors.Is(err, ErrTokenExpired) {
+		t.Errorf("Attachment(expired token) error = %v, want ErrTokenExpired", err)
+	}
+	if _, err := client.Attachment(ctx, "", "msg-f:1", "ii_abc", Hint{}); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("Attachment(no session) error = %v, want ErrNotConnected", err)
+	}
+	// The token RequireToken refreshed is used as is
+	refreshed := context.WithValue(ctx, requestTokenKey{}, &requestToken{token: &oauth2.Token{AccessToken: "access"}, scope: ScopeReadonly})
+	if _, err := client.Attachment(refreshed, "expired", "msg-f:1", "ii_abc", Hint{}); err != nil {
+		t.Errorf("Attachment(refreshed token) = %v", err)
+	}
+}
+
+func TestImageResolver(t *testing.T) {
+	images := map[string]string{"ANG1": "first", "ANG2": "second"}
+	fetches := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/gmail/v1/users/me/messages/msg-f:1":
+			fetches++
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"id": "1",
+				"payload": map[string]interface{}{
+					"mimeType": "multipart/related",
+					"parts": []map[string]interface{}{
+						{"partId": "0", "mimeType": "text/html", "body": map[string]interface{}{"data": ""}},
+						{
+							"partId":   "1",
+							"mimeType": "image/png",
+							"headers":  []map[string]string{{"name": "Content-ID", "value": "<ii_one>"}},
+							"body":     map[string]interface{}{"attachmentId": "ANG1"},
+						},
+						{"partId": "2", "mimeType": "image/png", "body": map[string]interface{}{"attachmentId": "ANG2"}},
+					},
+				},
+			})
+		case strings.HasPrefix(r.URL.Path, "/gmail/v1/users/me/messages/msg-f:1/attachments/"):
+			id := strings.TrimPrefix(r.URL.Path, "/gmail/v1/users/me/messages/msg-f:1/attachments/")
+			json.NewEncoder(w).Encode(map[string]string{"data": base64.URLEncoding.EncodeToString([]byte(images[id]))})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	store, err := NewTokenStore(memoryDB{}, nil, "secret", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(ctx, "session-1", "a@hackclub.com", &oauth2.Token{AccessToken: "access", Expiry: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	client := NewClient(store, zerolog.Nop())
+	client.endpoint = server.URL + "/"
+	resolver := client.ImageResolver("session-1")
+
+	// cid: takes its image, blob: URLs the remaining ones in order
+	for _, tt := range []struct{ messageID, src, want, source string }{
+		{"msg-f:1", "cid:ii_one", "first", "gmail:msg-f:1/1"},
+		{"msg-f:1", "blob:https://mail.google.com/4f1c", "second", "gmail:msg-f:1/2"},
+		{"", "https://mail.google.com/mail/u/0?ui=2&permmsgid=msg-f:1&realattid=ii_one&attid=0.1", "first", "gmail:msg-f:1/1"},
+	} {
+		data, source, err := resolver.ResolveImage(ctx, tt.messageID, tt.src, "")
+		if err != nil {
+			t.Fatalf("ResolveImage(%s) = %v", tt.src, err)
+		}
+		if string(data) != tt.want || source != tt.source {
+			t.Errorf("ResolveImage(%s) = %q, %s, want %q, %s", tt.src, data, source, tt.want, tt.source)
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("message fetched %d times, want once", fetches)
+	}
+	if _, _, err := resolver.ResolveImage(ctx, "msg-f:1", "blob:https://mail.google.com/9a2e", ""); !errors.Is(err, ErrNotFound) {
+		t.Errorf("ResolveImage(no image left) error = %v, want ErrNotFound", err)
+	}
+	if _, _, err := resolver.ResolveImage(ctx, "", "cid:ii_one", ""); !errors.Is(err, ErrNotFound) {
+		t.Errorf("ResolveImage(no message) error = %v, want ErrNotFound", err)
+	}
+
+	// References that match nothing aren't given another image
+	resolver = client.ImageResolver("session-1")
+	for _, src := range []string{
+		"cid:ii_missing",
+		"https://mail.google.com/mail/u/0?ui=2&permmsgid=msg-f:1&attid=0.9",
+		"https://mail.google.com/mail/u/0?ui=2&permmsgid=msg-f:1",
+	} {
+		if _, _, err := resolver.ResolveImage(ctx, "msg-f:1", src, ""); !errors.Is(err, ErrNotFound) {
+			t.Errorf("ResolveImage(%s) error = %v, want ErrNotFound", src, err)
+		}
+	}
+}
+
+func TestReply(t *testing.T) {
+	message := func(id string, labels []string, headers ...string) map[string]interface{} {
+		var h []map[string]string
+		for i := 0; i < len(headers); i += 2 {
+			h = append(h, map[string]string{"name": headers[i], "value": headers[i+1]})
+		}
+		return map[string]interface{}{
+			"id": id, "threadId": "t1", "labelIds": labels, "internalDate": "1700000000000",
+			"payload": map[string]interface{}{
+				"mimeType": "text/plain",
+				"headers":  h,
+				"body":     map[string]string{"data": base64.URLEncoding.EncodeToString([]byte("Can you <ship> it?\nThanks"))},
+			},
+		}
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/gmail/v1/users/me/threads/t1":
+			json.NewEncoder(w).Encode(map[string]interface{}{"id": "t1", "messages": []interface{}{
+				message("m0", []string{"INBOX"}),
+				message("m1", []string{"INBOX"},
+					"From", "Orpheus <orpheus@hackclub.com>", "Reply-To", "team@hackclub.com", "Subject", "Launch",
+					"Message-ID", "<m1@mail.gmail.com>", "References", "<m0@mail.gmail.com>", "Date", "Tue, 5 Mar 2024 14:07:00 +0000"),
+				message("m2", []string{"DRAFT"}),
+			}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	store, err := NewTokenStore(memoryDB{}, nil, "secret", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(ctx, "session-1", "a@hackclub.com", &oauth2.Token{AccessToken: "access", Expiry: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	client := NewClient(store, zerolog.Nop())
+	client.endpoint = server.URL + "/"
+
+	reply, err := client.Reply(ctx, "session-1", "", "t1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Reply{
+		ThreadID:   "t1",
+		MessageID:  "<m1@mail.gmail.com>",
+		References: "<m0@mail.gmail.com>",
+		Subject:    "Launch",
+		From:       "Orpheus <orpheus@hackclub.com>",
+		ReplyTo:    "team@hackclub.com",
+		HTML:       "Can you &lt;ship&gt; it?<br>Thanks",
+	}
+	if !reply.Date.Equal(time.Date(2024, 3, 5, 14, 7, 0, 0, time.UTC)) {
+		t.Errorf("Reply date = %v", reply.Date)
+	}
+	reply.Date = time.Time{}
+	if *reply != want {
+		t.Errorf("Reply = %+v, want %+v", *reply, want)
+	}
+
+	if _, err := client.Reply(ctx, "session-1", "", "t2"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Reply(missing thread) error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestCreateDraft(t *testing.T) {
+	message := "From: a@hackclub.com\r\nSubject: Hi\r\n\r\nHello"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer access" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodPost || !strings.HasSuffix(r.URL.Path, "/gmail/v1/users/me/drafts") {
+			http.NotFound(w, r)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		if !strings.Contains(string(body), "Content-Type: message/rfc822") || !strings.Contains(string(body), message) {
+			t.Errorf("upload body = %q, want the message as message/rfc822", body)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": "r-123", "message": map[string]string{"id": "18f"}})
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	store, err := NewTokenStore(memoryDB{}, nil, "secret", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(ctx, "session-1", "a@hackclub.com", &oauth2.Token{AccessToken: "access", Expiry: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	client := NewClient(store, zerolog.Nop())
+	client.endpoint = server.URL + "/"
+
+	draft, err := client.CreateDraft(ctx, "session-1", []byte(message), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if draft.ID != "r-123" || draft.MessageID != "18f" {
+		t.Errorf("CreateDraft = %+v", draft)
+	}
+}
+
+func TestImportDraft(t *testing.T) {
+	// Imported as is, where Gmail's editor would rewrite the HTML
+	message := "From: a@hackclub.com\r\nSubject: Hi\r\nContent-Type: text/html\r\n\r\n<table style=\"mso-table-lspace:0\"><tr><td>Hello</td></tr></table>"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || !strings.HasSuffix(r.URL.Path, "/gmail/v1/users/me/messages/import") {
+			http.NotFound(w, r)
+			return
+		}
+		if r.URL.Query().Get("internalDateSource") != "dateHeader" || r.URL.Query().Get("neverMarkSpam") != "true" {
+			t.Errorf("query = %s", r.URL.RawQuery)
+		}
+		body, _ := io.ReadAll(r.Body)
+		if !strings.Contains(string(body), `"labelIds":["DRAFT"]`) || !strings.Contains(string(body), `"threadId":"t-1"`) || !strings.Contains(string(body), message) {
+			t.Errorf("upload body = %q, want the message labeled DRAFT in t-1", body)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": "18f", "threadId": "t-1"})
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	store, err := NewTokenStore(memoryDB{}, nil, "secret", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(ctx, "session-1", "a@hackclub.com", &oauth2.Token{AccessToken: "access", Expiry: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	client := NewClient(store, zerolog.Nop())
+	client.endpoint = server.URL + "/"
+
+	imported, err := client.ImportDraft(ctx, "session-1", []byte(message), "t-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported.ID != "18f" || imported.ThreadID != "t-1" {
+		t.Errorf("ImportDraft = %+v", imported)
+	}
+}
+
+func TestDrafts(t *testing.T) {
+	drafts := map[string]map[string]interface{}{
+		"r-1": {"id": "r-1", "message": map[string]interface{}{
+			"id": "m1", "snippet": "Hey &amp; welcome", "internalDate": "1714564800000",
+			"payload": map[string]interface{}{"headers": []map[string]string{{"name": "Subject", "value": "Welcome"}, {"name": "To", "value": "club@hackclub.com"}}},
+		}},
+		"r-2": {"id": "r-2", "message": map[string]interface{}{
+			"id": "m2", "snippet": "Newer", "internalDate": "1714651200000",
+			"payload": map[string]interface{}{"headers": []map[string]string{{"name": "subject", "value": "Newsletter"}}},
+		}},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/gmail/v1/users/me/drafts":
+			if r.URL.Query().Get("maxResults") != "3" {
+				t.Errorf("maxResults = %s, want 3", r.URL.Query().Get("maxResults"))
+			}
+			// r-3 was sent since
+			json.NewEncoder(w).Encode(map[string]interface{}{"drafts": []map[string]string{{"id": "r-1"}, {"id": "r-3"}, {"id": "r-2"}}})
+		case strings.HasPrefix(r.URL.Path, "/gmail/v1/users/me/drafts/"):
+			draft, ok := drafts[strings.TrimPrefix(r.URL.Path, "/gmail/v1/users/me/drafts/")]
+			if !ok {
+				http.Error(w, `{"error": {"code": 404, "message": "Requested entity was not found."}}`, http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode(draft)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	store, err := NewTokenStore(memoryDB{}, nil, "secret", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(ctx, "session-1", "a@hackclub.com", &oauth2.Token{AccessToken: "access", Expiry: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	client := NewClient(store, zerolog.Nop())
+	client.endpoint = server.URL + "/"
+
+	got, err := client.Drafts(ctx, "session-1", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].Subject != "Newsletter" || got[1].ID != "r-1" || got[1].To != "club@hackclub.com" || got[1].Snippet != "Hey & welcome" {
+		t.Fatalf("Drafts = %+v %+v", got[0], got[len(got)-1])
+	}
+	if !got[1].UpdatedAt.Equal(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("UpdatedAt = %v", got[1].UpdatedAt)
+	}
+}
+
+func TestSetSignature(t *testing.T) {
+	var patched map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/gmail/v1/users/me/settings/sendAs":
+			json.NewEncoder(w).Encode(map[string]interface{}{"sendAs": []map[string]interface{}{
+				{"sendAsEmail": "team@hackclub.com", "displayName": "Team"},
+				{"sendAsEmail": "a@hackclub.com", "isPrimary": true, "signature": "<div>old</div>"},
+			}})
+		case r.Method == http.MethodPatch && r.URL.Path == "/gmail/v1/users/me/settings/sendAs/team@hackclub.com":
+			json.NewDecoder(r.Body).Decode(&patched)
+			json.NewEncoder(w).Encode(map[string]interface{}{"sendAsEmail": "team@hackclub.com", "signature": patched["signature"]})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	store, err := NewTokenStore(memoryDB{}, nil, "secret", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(ctx, "session-1", "a@hackclub.com", &oauth2.Token{AccessToken: "access", Expiry: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	client := NewClient(store, zerolog.Nop())
+	client.endpoint = server.URL + "/"
+
+	addresses, err := client.SendAs(ctx, "session-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addresses) != 2 || !addresses[0].Primary || addresses[0].Signature != "<div>old</div>" {
+		t.Errorf("SendAs = %+v", addresses)
+	}
+
+	// Clearing a signature sends it empty rather than leaving it out
+	got, err := client.SetSignature(ctx, "session-1", "Team@hackclub.com", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signature, ok := patched["signature"]; !ok || signature != "" || got.Email != "team@hackclub.com" {
+		t.Errorf("patched %v, got %+v", patched, got)
+	}
+	if _, err := client.SetSignature(ctx, "session-1", "other@hackclub.com", "<b>hi</b>"); !errors.Is(err, ErrNoSendAs) {
+		t.Errorf("SetSignature(unknown address) error = %v, want ErrNoSendAs", err)
+	}
+}
+
+func TestContacts(t *testing.T) {
+	person := func(name string, emails ...string) map[string]interface{} {
+		var addresses []map[string]string
+		for _, email := range emails {
+			addresses = append(addresses, map[string]string{"value": email})
+		}
+		return map[string]interface{}{"names": []map[string]string{{"displayName": name}}, "emailAddresses": addresses}
+	}
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		switch r.URL.Path {
+		case "/v1/people/me/connections":
+			json.NewEncoder(w).Encode(map[string]interface{}{"connections": []interface{}{
+				person("Zach Latta", "zach@hackclub.com"),
+				person("Orpheus", "orpheus@hackclub.com", "dino@hackclub.com"),
+			}})
+		case "/v1/otherContacts":
+			json.NewEncoder(w).Encode(map[string]interface{}{"otherContacts": []interface{}{
+				person("", "ZACH@hackclub.com"),
+				person("Hack Club Bank", "bank@hackclub.com"),
+				person("Zeke", "zeke@example.org"),
+			}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	store, err := NewTokenStore(memoryDB{}, nil, "secret", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(ctx, "session-1", "a@hackclub.com", &oauth2.Token{AccessToken: "access", Expiry: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	client := NewClient(store, zerolog.Nop())
+	client.endpoint = server.URL + "/"
+
+	emails := func(contacts []*Contact) string {
+		var list []string
+		for _, c := range contacts {
+			list = append(list, c.Email)
+		}
+		return strings.Join(list, ",")
+	}
+	got, err := client.Contacts(ctx, "session-1", "Z", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if emails(got) != "zach@hackclub.com,zeke@example.org" || !got[0].Saved || got[1].Saved {
+		t.Errorf("Contacts(z) = %+v", got)
+	}
+	// Word matches rank below prefixes, and the address book is cached
+	got, _ = client.Contacts(ctx, "session-1", "ba", 10)
+	if emails(got) != "bank@hackclub.com" {
+		t.Errorf("Contacts(ba) = %s", emails(got))
+	}
+	got, _ = client.Contacts(ctx, "session-1", "club", 1)
+	if len(got) != 1 || got[0].Email != "bank@hackclub.com" {
+		t.Errorf("Contacts(club, 1) = %s", emails(got))
+	}
+	if calls != 2 {
+		t.Errorf("People API called %d times, want 2", calls)
+	}
+}
+
+// memoryWatchDB is a WatchDB in memory
+type memoryWatchDB map[string]*db.GmailWatch
+
+func (m memoryWatchDB) SaveGmailWatch(ctx context.Context, w *db.GmailWatch) error {
+	saved := *w
+	m[w.User] = &saved
+	return nil
+}
+
+func (m memoryWatchDB) GetGmailWatch(ctx context.Context, user string) (*db.GmailWatch, error) {
+	if w, ok := m[user]; ok {
+		saved := *w
+		return &saved, nil
+	}
+	return nil, db.ErrNotFound
+}
+
+func (m memoryWatchDB) ListExpiringGmailWatches(ctx context.Context, before time.Time) ([]*db.GmailWatch, error) {
+	var watches []*db.GmailWatch
+	for _, w := range m {
+		if w.ExpiresAt.Before(before) {
+			saved := *w
+			watches = append(watches, &saved)
+		}
+	}
+	return watches, nil
+}
+
+func (m memoryWatchDB) DeleteGmailWatch(ctx context.Context, user string) error {
+	delete(m, user)
+	return nil
+}
+
+// fakeFormatter formats every draft the same
+type fakeFormatter struct{}
+
+func (fakeFormatter) Transform(ctx context.Context, req *html.TransformRequest) (*html.TransformResponse, error) {
+	return &html.TransformResponse{HTML: "<p>formatted " + req.GmailMessageID + "</p>"}, nil
+}
+
+func (fakeFormatter) Export(ctx context.Context, req *html.ExportRequest) ([]byte, error) {
+	return []byte("Subject: " + req.Subject + "\r\nTo: " + req.To + "\r\n\r\n" + req.HTML), nil
+}
+
+func TestWatcherProcess(t *testing.T) {
+	var updates []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/gmail/v1/users/me/history":
+			if r.URL.Query().Get("startHistoryId") != "100" || r.URL.Query().Get("labelId") != "Label_1" {
+				t.Errorf("history query = %s", r.URL.RawQuery)
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"historyId": "150",
+				"history": []map[string]interface{}{
+					{"messagesAdded": []map[string]interface{}{{"message": map[string]interface{}{"id": "m1", "labelIds": []string{"DRAFT", "Label_1"}}}}},
+					// Labeled, but not a draft
+					{"labelsAdded": []map[string]interface{}{{"message": map[string]interface{}{"id": "m2", "labelIds": []string{"INBOX", "Label_1"}}}}},
+					{"labelsAdded": []map[string]interface{}{{"message": map[string]interface{}{"id": "m3", "labelIds": []string{"DRAFT", "Label_1"}}}}},
+				},
+			})
+		case r.URL.Path == "/gmail/v1/users/me/drafts":
+			json.NewEncoder(w).Encode(map[string]interface{}{"drafts": []map[string]interface{}{
+				{"id": "r1", "message": map[string]string{"id": "m1"}},
+				{"id": "r3", "message": map[string]string{"id": "m3"}},
+			}})
+		case r.URL.Path == "/gmail/v1/users/me/drafts/r1":
+			json.NewEncoder(w).Encode(map[string]interface{}{"id": "r1", "message": map[string]interface{}{
+				"id": "m1", "threadId": "t1",
+				"payload": map[string]interface{}{
+					"mimeType": "multipart/alternative",
+					"headers":  []map[string]string{{"name": "Subject", "value": "Hi"}, {"name": "To", "value": "b@hackclub.com"}},
+					"parts": []map[string]interface{}{
+						{"mimeType": "text/plain", "body": map[string]string{"data": base64.URLEncoding.EncodeToString([]byte("hello"))}},
+						{"mimeType": "text/html", "body": map[string]string{"data": base64.URLEncoding.EncodeToString([]byte("<div>hello</div>"))}},
+					},
+				},
+			}})
+		case r.URL.Path == "/gmail/v1/users/me/drafts/r3":
+			// Written back by us already
+			json.NewEncoder(w).Encode(map[string]interface{}{"id": "r3", "message": map[string]interface{}{
+				"id": "m3",
+				"payload": map[string]interface{}{
+					"mimeType": "text/html",
+					"headers":  []map[string]string{{"name": "Message-ID", "value": "<abc@format.hackclub.com>"}},
+					"body":     map[string]string{"data": base64.URLEncoding.EncodeToString([]byte("<p>formatted</p>"))},
+				},
+			}})
+		case r.Method == http.MethodPut && strings.HasSuffix(r.URL.Path, "/gmail/v1/users/me/drafts/r1"):
+			body, _ := io.ReadAll(r.Body)
+			updates = append(updates, string(body))
+			json.NewEncoder(w).Encode(map[string]interface{}{"id": "r1", "message": map[string]string{"id": "m4"}})
+		case r.URL.Path == "/gmail/v1/users/me/watch":
+			json.NewEncoder(w).Encode(map[string]string{"historyId": "160", "expiration": fmt.Sprint(time.Now().Add(7 * 24 * time.Hour).UnixMilli())})
+		default:
+			t.Errorf("unexpected %s %s", r.Method, r.URL.Path)
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	store, err := NewTokenStore(memoryDB{}, nil, "secret", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(ctx, "session-1", "a@hackclub.com", &oauth2.Token{AccessToken: "access", Expiry: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	client := NewClient(store, zerolog.Nop())
+	client.endpoint = server.URL + "/"
+	watches := memoryWatchDB{}
+	watcher := &Watcher{client: client, db: watches, formatter: fakeFormatter{}, topic: "projects/p/topics/gmail", label: "Format", logger: zerolog.Nop(), mailboxes: map[string]*sync.Mutex{}}
+
+	// Expiring within a day, so it's renewed
+	watches["a@hackclub.com"] = &db.GmailWatch{User: "a@hackclub.com", SessionID: "session-1", LabelID: "Label_1", LabelName: "Format", HistoryID: 100, ExpiresAt: time.Now().Add(time.Hour)}
+	if err := watcher.process(ctx, "a@hackclub.com", 150); err != nil {
+		t.Fatal(err)
+	}
+	if len(updates) != 1 || !strings.Contains(updates[0], "Subject: Hi") || !strings.Contains(updates[0], "To: b@hackclub.com") ||
+		!strings.Contains(updates[0], "<p>formatted m1</p>") || !strings.Contains(updates[0], `"threadId":"t1"`) {
+		t.Errorf("draft updates = %q, want r1 formatted in its thread", updates)
+	}
+	if w := watches["a@hackclub.com"]; w.HistoryID != 160 || time.Until(w.ExpiresAt) < 6*24*time.Hour {
+		t.Errorf("watch after processing = %+v, want renewed", w)
+	}
+
+	// Notifications the watch has seen are ignored
+	if err := watcher.process(ctx, "a@hackclub.com", 155); err != nil || len(updates) != 1 {
+		t.Errorf("process(seen) = %v, %d updates", err, len(updates))
+	}
+
+	// The watch ends with the session's token
+	if err := store.Delete(ctx, "session-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := watcher.process(ctx, "a@hackclub.com", 170); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := watches["a@hackclub.com"]; ok {
+		t.Error("watch kept after its token was deleted")
+	}
+}
+
+func TestWatcherRenew(t *testing.T) {
+	var renewed []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/gmail/v1/users/me/history":
+			json.NewEncoder(w).Encode(map[string]interface{}{"historyId": "120"})
+		case "/gmail/v1/users/me/watch":
+			renewed = append(renewed, r.Header.Get("Authorization"))
+			json.NewEncoder(w).Encode(map[string]string{"historyId": "130", "expiration": fmt.Sprint(time.Now().Add(7 * 24 * time.Hour).UnixMilli())})
+		default:
+			t.Errorf("unexpected %s %s", r.Method, r.URL.Path)
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	store, err := NewTokenStore(memoryDB{}, nil, "secret", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(ctx, "session-1", "a@hackclub.com", &oauth2.Token{AccessToken: "access", Expiry: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	client := NewClient(store, zerolog.Nop())
+	client.endpoint = server.URL + "/"
+	watches := memoryWatchDB{}
+	watcher := &Watcher{client: client, db: watches, formatter: fakeFormatter{}, topic: "projects/p/topics/gmail", label: "Format", logger: zerolog.Nop(), mailboxes: map[string]*sync.Mutex{}}
+
+	// A quiet mailbox about to lapse, one with days left, and one whose
+	// session is gone
+	watches["a@hackclub.com"] = &db.GmailWatch{User: "a@hackclub.com", SessionID: "session-1", LabelID: "Label_1", HistoryID: 100, ExpiresAt: time.Now().Add(time.Hour)}
+	watches["b@hackclub.com"] = &db.GmailWatch{User: "b@hackclub.com", SessionID: "session-1", LabelID: "Label_1", HistoryID: 100, ExpiresAt: time.Now().Add(5 * 24 * time.Hour)}
+	watches["c@hackclub.com"] = &db.GmailWatch{User: "c@hackclub.com", SessionID: "session-2", LabelID: "Label_1", HistoryID: 100, ExpiresAt: time.Now().Add(time.Hour)}
+
+	n, err := watcher.RenewWatches(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 || len(renewed) != 1 {
+		t.Errorf("RenewWatches = %d, %d renewed, want 2 looked at and 1 renewed", n, len(renewed))
+	}
+	if w := watches["a@hackclub.com"]; time.Until(w.ExpiresAt) < 6*24*time.Hour {
+		t.Errorf("quiet watch = %+v, want renewed", w)
+	}
+	if w := watches["b@hackclub.com"]; time.Until(w.ExpiresAt) > 6*24*time.Hour {
+		t.Errorf("watch with days left = %+v, want untouched", w)
+	}
+	if _, ok := watches["c@hackclub.com"]; ok {
+		t.Error("watch kept after its token was gone")
+	}
+}
+
+func TestAPIError(t *testing.T) {
+	tests := []struct {
+		err  *googleapi.Error
+		want error
+	}{
+		{&googleapi.Error{Code: http.StatusTooManyRequests}, ErrUnavailable},
+		{&googleapi.Error{Code: http.StatusServiceUnavailable}, ErrUnavailable},
+		{&googleapi.Error{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: "userRateLimitExceeded"}}}, ErrUnavailable},
+		{&googleapi.Error{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: "insufficientPermissions"}}}, ErrNoAccess},
+		{&googleapi.Error{Code: http.StatusUnauthorized}, ErrTokenExpired},
+		{&googleapi.Error{Code: http.StatusNotFound}, ErrNotFound},
+	}
+	for _, tt := range tests {
+		if got := apiError(tt.err); !errors.Is(got, tt.want) {
+			t.Errorf("apiError(%d %v) = %v, want %v", tt.err.Code, tt.err.Errors, got, tt.want)
+		}
+	}
+}
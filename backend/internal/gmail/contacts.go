@@ -0,0 +1,219 @@
+package gmail
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	people "google.golang.org/api/people/v1"
+)
+
+const (
+	// contactsTTL is how long a session's address book is kept, autocomplete
+	// asks on every keystroke
+	contactsTTL = 10 * time.Minute
+	// maxContacts bounds the address book loaded of each source
+	maxContacts = 2000
+	// maxCachedBooks bounds the address books kept, the oldest are dropped
+	maxCachedBooks = 500
+)
+
+// Contact is someone the user can address mail to
+type Contact struct {
+	Name  string `json:"name,omitempty"`
+	Email string `json:"email"`
+	// Saved is set for the user's contacts, unset for the "other contacts"
+	// Google collects from their mail
+	Saved bool `json:"saved"`
+}
+
+// addressBook is a session's contacts, loaded at once and searched locally
+type addressBook struct {
+	contacts []*Contact
+	loaded   time.Time
+}
+
+// contactCache holds the address books of sessions
+type contactCache struct {
+	mu    sync.Mutex
+	books map[string]*addressBook
+}
+
+func (c *contactCache) get(sessionID string) *addressBook {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	book, ok := c.books[sessionID]
+	if !ok || time.Since(book.loaded) > contactsTTL {
+		return nil
+	}
+	return book
+}
+
+func (c *contactCache) put(sessionID string, book *addressBook) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.books == nil {
+		c.books = map[string]*addressBook{}
+	}
+	for id, b := range c.books {
+		if time.Since(b.loaded) > contactsTTL {
+			delete(c.books, id)
+		}
+	}
+	for len(c.books) >= maxCachedBooks {
+		var oldest string
+		for id, b := range c.books {
+			if oldest == "" || b.loaded.Before(c.books[oldest].loaded) {
+				oldest = id
+			}
+		}
+		delete(c.books, oldest)
+	}
+	c.books[sessionID] = book
+}
+
+// Contacts returns up to limit of the user's contacts whose name or address
+// starts with query, or has a word that does, saved contacts first. Address
+// books are loaded from the People API and cached for contactsTTL. It needs
+// the contacts scope, ErrNoAccess otherwise.
+func (c *Client) Contacts(ctx context.Context, sessionID, query string, limit int) ([]*Contact, error) {
+	book := c.contacts.get(sessionID)
+	if book == nil {
+		contacts, err := c.loadContacts(ctx, sessionID)
+		if err != nil {
+			return nil, err
+		}
+		book = &addressBook{contacts: contacts, loaded: time.Now()}
+		c.contacts.put(sessionID, book)
+	}
+
+	query = strings.ToLower(strings.TrimSpace(query))
+	type match struct {
+		contact *Contact
+		rank    int
+	}
+	var matches []match
+	for _, contact := range book.contacts {
+		if rank := matchRank(contact, query); rank >= 0 {
+			matches = append(matches, match{contact, rank})
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		if matches[i].rank != matches[j].rank {
+			return matches[i].rank < matches[j].rank
+		}
+		return matches[i].contact.Saved && !matches[j].contact.Saved
+	})
+	results := []*Contact{}
+	for _, m := range matches {
+		if len(results) == limit {
+			break
+		}
+		results = append(results, m.contact)
+	}
+	return results, nil
+}
+
+// matchRank is how well contact matches query, lower is better, -1 if it
+// doesn't: the address starting with it, then the name, then a word of
+// either
+func matchRank(contact *Contact, query string) int {
+	email, name := strings.ToLower(contact.Email), strings.ToLower(contact.Name)
+	switch {
+	case query == "":
+		return 0
+	case strings.HasPrefix(email, query):
+		return 0
+	case strings.HasPrefix(name, query):
+		return 1
+	}
+	words := strings.FieldsFunc(name+" "+email, func(r rune) bool {
+		return r == ' ' || r == '.' || r == '@' || r == '-' || r == '_'
+	})
+	for _, word := range words {
+		if strings.HasPrefix(word, query) {
+			return 2
+		}
+	}
+	return -1
+}
+
+// loadContacts reads the user's saved and other contacts, an address once,
+// saved ones winning. Either source may be missing from the grant.
+func (c *Client) loadContacts(ctx context.Context, sessionID string) ([]*Contact, error) {
+	opts, err := c.options(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	svc, err := people.NewService(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	var contacts []*Contact
+	seen := map[string]bool{}
+	add := func(persons []*people.Person, saved bool) {
+		for _, p := range persons {
+			var name string
+			if len(p.Names) > 0 {
+				name = p.Names[0].DisplayName
+			}
+			for _, address := range p.EmailAddresses {
+				key := strings.ToLower(address.Value)
+				if key == "" || seen[key] {
+					continue
+				}
+				seen[key] = true
+				contacts = append(contacts, &Contact{Name: name, Email: address.Value, Saved: saved})
+			}
+		}
+	}
+
+	var failures []error
+	pageToken, loaded := "", 0
+	for loaded < maxContacts {
+		call := svc.People.Connections.List("people/me").PersonFields("names,emailAddresses").PageSize(1000).Context(ctx)
+		if pageToken != "" {
+			call = call.PageToken(pageToken)
+		}
+		page, err := call.Do()
+		if err != nil {
+			failures = append(failures, apiError(err))
+			break
+		}
+		add(page.Connections, true)
+		loaded += len(page.Connections)
+		if pageToken = page.NextPageToken; pageToken == "" {
+			break
+		}
+	}
+	pageToken, loaded = "", 0
+	for loaded < maxContacts {
+		call := svc.OtherContacts.List().ReadMask("names,emailAddresses").PageSize(1000).Context(ctx)
+		if pageToken != "" {
+			call = call.PageToken(pageToken)
+		}
+		page, err := call.Do()
+		if err != nil {
+			failures = append(failures, apiError(err))
+			break
+		}
+		add(page.OtherContacts, false)
+		loaded += len(page.OtherContacts)
+		if pageToken = page.NextPageToken; pageToken == "" {
+			break
+		}
+	}
+	if len(failures) == 2 {
+		return nil, failures[0]
+	}
+	for _, err := range failures {
+		if !errors.Is(err, ErrNoAccess) {
+			return nil, err
+		}
+	}
+	return contacts, nil
+}
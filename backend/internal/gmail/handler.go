@@ -0,0 +1,551 @@
+package gmail
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hackclub/format/internal/assets"
+	"github.com/hackclub/format/internal/db"
+	"github.com/hackclub/format/internal/html"
+	"github.com/hackclub/format/internal/imageproc"
+	"github.com/hackclub/format/internal/session"
+	"github.com/hackclub/format/internal/util"
+	"github.com/rs/zerolog"
+	"golang.org/x/oauth2"
+)
+
+// Scopes of /api/auth/gmail/grant, what a Gmail call needs the user to grant
+const (
+	ScopeReadonly = "readonly"
+	ScopeCompose  = "compose"
+	ScopeSettings = "settings"
+	ScopeContacts = "contacts"
+	ScopeInsert   = "insert"
+)
+
+// grantURL is where users grant Gmail access again
+const grantURL = "/api/auth/gmail/grant"
+
+// requestToken is the access token RequireToken refreshed for a request,
+// and the scope its Gmail calls need
+type requestToken struct {
+	token *oauth2.Token
+	scope string
+}
+
+type requestTokenKey struct{}
+
+// tokenFromContext returns the token RequireToken refreshed for a request
+func tokenFromContext(ctx context.Context) *requestToken {
+	t, _ := ctx.Value(requestTokenKey{}).(*requestToken)
+	return t
+}
+
+// Uploader rehosts attachments on the CDN, the asset service
+type Uploader interface {
+	ProcessFromData(ctx context.Context, input *assets.ProcessInput) (*assets.Asset, error)
+}
+
+// Exporter builds email messages of transformed HTML, the HTML transformer
+type Exporter interface {
+	Export(ctx context.Context, req *html.ExportRequest) ([]byte, error)
+}
+
+// Handler serves the Gmail operations the frontend performs through the
+// backend, which holds the tokens
+type Handler struct {
+	client   *Client
+	sessions *session.Manager
+	uploader Uploader
+	exporter Exporter
+	watcher  *Watcher // nil unless push notifications are configured
+	logger   zerolog.Logger
+}
+
+func NewHandler(client *Client, sessions *session.Manager, uploader Uploader, exporter Exporter, watcher *Watcher, logger zerolog.Logger) *Handler {
+	return &Handler{client: client, sessions: sessions, uploader: uploader, exporter: exporter, watcher: watcher, logger: logger}
+}
+
+// HandleStatus reports whether the session can use Gmail, and with which
+// mailbox
+func (h *Handler) HandleStatus(w http.ResponseWriter, r *http.Request) {
+	status := map[string]interface{}{"connected": false}
+	email, err := h.client.Profile(r.Context(), h.sessions.SessionID(r))
+	switch {
+	case err == nil:
+		status["connected"] = true
+		status["email"] = email
+	case errors.Is(err, ErrNotConnected), errors.Is(err, ErrTokenExpired), errors.Is(err, ErrNoAccess):
+		status["reason"] = err.Error()
+		status["reconsent"] = true
+		status["grant_url"] = grantURL
+	default:
+		h.logger.Error().Err(err).Msg("failed to check gmail access")
+		http.Error(w, "Failed to check Gmail access", http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// HandleAccessToken gives the frontend a short-lived Gmail access token of
+// the session, refreshed server-side. The refresh token never leaves the
+// backend.
+func (h *Handler) HandleAccessToken(w http.ResponseWriter, r *http.Request) {
+	token, err := h.client.Tokens().Token(r.Context(), h.sessions.SessionID(r))
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+	response := map[string]interface{}{
+		"access_token": token.AccessToken,
+		"token_type":   "Bearer",
+	}
+	if !token.Expiry.IsZero() {
+		response["expires_in"] = int64(time.Until(token.Expiry).Seconds())
+		response["expires_at"] = token.Expiry.Unix()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(response)
+}
+
+// HandleAttachment downloads an attachment of one of the user's messages,
+// given the permmsgid and realattid (or attid) of its Gmail URL
+func (h *Handler) HandleAttachment(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	messageID, attachmentID := query.Get("messageId"), query.Get("attachmentId")
+	if messageID == "" || attachmentID == "" {
+		http.Error(w, "messageId and attachmentId are required", http.StatusBadRequest)
+		return
+	}
+	hint := Hint{Filename: query.Get("filename"), Alt: query.Get("alt")}
+
+	attachment, err := h.client.Attachment(r.Context(), h.sessions.SessionID(r), messageID, attachmentID, hint)
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+
+	contentType := attachment.MimeType
+	if contentType == "" || contentType == "application/octet-stream" {
+		contentType = http.DetectContentType(attachment.Data)
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Write(attachment.Data)
+}
+
+// HandleRehostAttachment fetches an image attachment of one of the user's
+// messages, given its messageId and attachmentId (and the filename and alt
+// hints of HandleAttachment), and runs it through the asset pipeline like an
+// upload, returning the CDN asset. It takes the processing options of
+// uploads too.
+func (h *Handler) HandleRehostAttachment(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		MessageID    string `json:"messageId"`
+		AttachmentID string `json:"attachmentId"`
+		Filename     string `json:"filename,omitempty"`
+		Alt          string `json:"alt,omitempty"`
+		imageproc.ProcessOptions
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.MessageID == "" || req.AttachmentID == "" {
+		http.Error(w, "messageId and attachmentId are required", http.StatusBadRequest)
+		return
+	}
+	if err := req.ProcessOptions.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	attachment, err := h.client.Attachment(r.Context(), h.sessions.SessionID(r), req.MessageID, req.AttachmentID, Hint{Filename: req.Filename, Alt: req.Alt})
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+	// Gmail often labels inline images application/octet-stream
+	contentType := util.DetectContentType(attachment.Data)
+	if !strings.HasPrefix(contentType, "image/") {
+		http.Error(w, fmt.Sprintf("Attachment %s is not an image", attachment.Filename), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	asset, err := h.uploader.ProcessFromData(r.Context(), &assets.ProcessInput{
+		Data:        attachment.Data,
+		ContentType: contentType,
+		SourceURL:   "gmail:" + req.MessageID + "/" + req.AttachmentID,
+		Options:     req.ProcessOptions,
+	})
+	if err != nil {
+		h.logger.Error().Err(err).Str("message", req.MessageID).Msg("failed to rehost gmail attachment")
+		http.Error(w, fmt.Sprintf("Failed to process image: %v", err), assets.ProcessErrorStatus(err))
+		return
+	}
+	if asset.ExpiresAt != nil {
+		w.Header().Set("X-Asset-Expires-At", asset.ExpiresAt.Format(time.RFC3339))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(asset)
+}
+
+// HandleCreateDraft creates a draft of transformed HTML in the user's
+// mailbox, built like an export: {html, subject, to, cc, bcc,
+// inline_images}, from the user unless from is set. With reply_to, a
+// message ID, or thread_id, whose latest message is replied to, the draft
+// is a reply in its thread: the message is quoted below the HTML, and the
+// subject and recipient default to the reply's. It needs the compose
+// scope, granted through /api/auth/gmail/grant?scope=compose.
+func (h *Handler) HandleCreateDraft(w http.ResponseWriter, r *http.Request) {
+	message, threadID, ok := h.draftMessage(w, r)
+	if !ok {
+		return
+	}
+	draft, err := h.client.CreateDraft(r.Context(), h.sessions.SessionID(r), message, threadID)
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"id":         draft.ID,
+		"message_id": draft.MessageID,
+		"url":        draftURL(r, draft.MessageID),
+	})
+}
+
+// HandleImportDraft takes the same request as HandleCreateDraft, but
+// imports the message built into the mailbox labeled as a draft, rather than
+// creating it through Gmail's editor, which rewrites the HTML. The message
+// keeps the exact bytes built. It needs the insert scope, granted through
+// /api/auth/gmail/grant?scope=insert.
+func (h *Handler) HandleImportDraft(w http.ResponseWriter, r *http.Request) {
+	message, threadID, ok := h.draftMessage(w, r)
+	if !ok {
+		return
+	}
+	imported, err := h.client.ImportDraft(r.Context(), h.sessions.SessionID(r), message, threadID)
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+	h.logger.Info().Str("message_id", imported.ID).Int("bytes", len(message)).Msg("draft imported")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message_id": imported.ID,
+		"thread_id":  imported.ThreadID,
+		"url":        draftURL(r, imported.ID),
+	})
+}
+
+// draftMessage builds the message of a draft request, quoting the message
+// replied to, and returns it with the thread it goes in. It writes an error
+// unless ok.
+func (h *Handler) draftMessage(w http.ResponseWriter, r *http.Request) (message []byte, threadID string, ok bool) {
+	ctx := r.Context()
+	r.Body = http.MaxBytesReader(w, r.Body, 1_500_000)
+	var req struct {
+		html.ExportRequest
+		ReplyTo  string `json:"reply_to,omitempty"`
+		ThreadID string `json:"thread_id,omitempty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return nil, "", false
+	}
+	if req.HTML == "" {
+		http.Error(w, "HTML content required", http.StatusBadRequest)
+		return nil, "", false
+	}
+	user, _ := ctx.Value("user").(*session.User)
+	if req.From == "" && user != nil {
+		req.From = (&mail.Address{Name: user.Name, Address: user.Email}).String()
+	}
+
+	if req.ReplyTo != "" || req.ThreadID != "" {
+		reply, err := h.client.Reply(ctx, h.sessions.SessionID(r), req.ReplyTo, req.ThreadID)
+		if err != nil {
+			h.writeError(w, r, err)
+			return nil, "", false
+		}
+		threadID = reply.ThreadID
+		req.HTML = html.AppendReplyQuote(req.HTML, &html.QuotedMessage{From: reply.From, Date: reply.Date, HTML: reply.HTML})
+		if reply.MessageID != "" {
+			req.InReplyTo = reply.MessageID
+			req.References = strings.TrimSpace(reply.References + " " + reply.MessageID)
+		}
+		if req.Subject == "" {
+			req.Subject = reply.Subject
+			if !strings.HasPrefix(strings.ToLower(req.Subject), "re:") {
+				req.Subject = "Re: " + req.Subject
+			}
+		}
+		if req.To == "" {
+			req.To = reply.ReplyTo
+		}
+	}
+
+	message, err := h.exporter.Export(ctx, &req.ExportRequest)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to build email: %v", err), http.StatusBadRequest)
+		return nil, "", false
+	}
+	return message, threadID, true
+}
+
+// draftURL opens a draft in the compose window of the user's account
+func draftURL(r *http.Request, messageID string) string {
+	u := "https://mail.google.com/mail/"
+	if user, _ := r.Context().Value("user").(*session.User); user != nil {
+		u += "?authuser=" + url.QueryEscape(user.Email)
+	}
+	return u + "#drafts?compose=" + url.QueryEscape(messageID)
+}
+
+// HandleListDrafts lists the user's most recent drafts, ?limit= of them
+// (10 by default), to pick one to format
+func (h *Handler) HandleListDrafts(w http.ResponseWriter, r *http.Request) {
+	limit := 10
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > MaxDrafts {
+			http.Error(w, fmt.Sprintf("Invalid limit, expected 1 to %d", MaxDrafts), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	drafts, err := h.client.Drafts(r.Context(), h.sessions.SessionID(r), limit)
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "private, no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{"drafts": drafts})
+}
+
+// HandleContacts suggests recipients whose name or address starts with ?q=,
+// up to ?limit= of them (10 by default). It needs the contacts scope.
+func (h *Handler) HandleContacts(w http.ResponseWriter, r *http.Request) {
+	limit := 10
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > 50 {
+			http.Error(w, "Invalid limit, expected 1 to 50", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	contacts, err := h.client.Contacts(r.Context(), h.sessions.SessionID(r), r.URL.Query().Get("q"), limit)
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "private, no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{"contacts": contacts})
+}
+
+// HandleSignatures lists the addresses the user sends mail as and their
+// signatures
+func (h *Handler) HandleSignatures(w http.ResponseWriter, r *http.Request) {
+	addresses, err := h.client.SendAs(r.Context(), h.sessions.SessionID(r))
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "private, no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{"send_as": addresses})
+}
+
+// HandleSetSignature makes transformed HTML the signature of one of the
+// user's addresses: {html, send_as?}, the primary address by default. It
+// needs the settings scope.
+func (h *Handler) HandleSetSignature(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		HTML   string `json:"html"`
+		SendAs string `json:"send_as,omitempty"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	signature := strings.TrimSpace(html.StripMarker(req.HTML))
+	if n := len([]rune(signature)); n > MaxSignatureLength {
+		http.Error(w, fmt.Sprintf("Signature is %d characters, Gmail allows %d", n, MaxSignatureLength), http.StatusBadRequest)
+		return
+	}
+	address, err := h.client.SetSignature(r.Context(), h.sessions.SessionID(r), req.SendAs, signature)
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+	h.logger.Info().Str("send_as", address.Email).Int("length", len(signature)).Msg("gmail signature set")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(address)
+}
+
+// HandleWatchStatus reports whether the user's drafts are formatted when
+// given the label: {watching, label, expires_at, since}
+func (h *Handler) HandleWatchStatus(w http.ResponseWriter, r *http.Request) {
+	user, _ := r.Context().Value("user").(*session.User)
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	watch, err := h.watcher.Status(r.Context(), strings.ToLower(user.Email))
+	if err != nil {
+		h.logger.Error().Err(err).Msg("failed to get gmail watch")
+		http.Error(w, "Failed to get watch", http.StatusInternalServerError)
+		return
+	}
+	h.writeWatch(w, watch)
+}
+
+// HandleStartWatch starts formatting the user's drafts when they're given
+// the label, which the mailbox must have. It needs the compose scope.
+func (h *Handler) HandleStartWatch(w http.ResponseWriter, r *http.Request) {
+	user, _ := r.Context().Value("user").(*session.User)
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	watch, err := h.watcher.Start(r.Context(), h.sessions.SessionID(r), strings.ToLower(user.Email))
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+	h.logger.Info().Str("email", user.Email).Str("label", watch.LabelName).Msg("gmail watch started")
+	h.writeWatch(w, watch)
+}
+
+// HandleStopWatch stops formatting the user's labeled drafts
+func (h *Handler) HandleStopWatch(w http.ResponseWriter, r *http.Request) {
+	user, _ := r.Context().Value("user").(*session.User)
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if err := h.watcher.Stop(r.Context(), h.sessions.SessionID(r), strings.ToLower(user.Email)); err != nil {
+		h.logger.Error().Err(err).Msg("failed to stop gmail watch")
+		http.Error(w, "Failed to stop watch", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) writeWatch(w http.ResponseWriter, watch *db.GmailWatch) {
+	status := map[string]interface{}{"watching": watch != nil, "label": h.watcher.Label()}
+	if watch != nil {
+		status["label"] = watch.LabelName
+		status["expires_at"] = watch.ExpiresAt
+		status["since"] = watch.CreatedAt
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// HandlePush receives the notifications Gmail publishes for watched
+// mailboxes, from a Pub/Sub push subscription authenticated with an ID
+// token. They're acknowledged at once and handled in the background, those
+// that can't be parsed too since Pub/Sub would retry them forever.
+func (h *Handler) HandlePush(w http.ResponseWriter, r *http.Request) {
+	raw, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if err := h.watcher.verify(r.Context(), raw); err != nil {
+		h.logger.Warn().Err(err).Msg("rejected gmail push")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var push struct {
+		Message struct {
+			Data string `json:"data"`
+		} `json:"message"`
+	}
+	var notification struct {
+		EmailAddress string `json:"emailAddress"`
+		HistoryID    uint64 `json:"historyId"`
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 64<<10)
+	err := json.NewDecoder(r.Body).Decode(&push)
+	if err == nil {
+		var data []byte
+		if data, err = base64.StdEncoding.DecodeString(push.Message.Data); err == nil {
+			err = json.Unmarshal(data, &notification)
+		}
+	}
+	if err != nil || notification.EmailAddress == "" {
+		h.logger.Warn().Err(err).Msg("ignoring malformed gmail push")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	h.watcher.Notified(strings.ToLower(notification.EmailAddress), notification.HistoryID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RequireToken refreshes the session's access token before the Gmail calls
+// of a request, when it's about to expire, so they don't fail mid-way. When
+// it can't be refreshed the request is answered with a re-consent error for
+// scope.
+func (h *Handler) RequireToken(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), requestTokenKey{}, &requestToken{scope: scope})
+			r = r.WithContext(ctx)
+			token, err := h.client.Tokens().Token(ctx, h.sessions.SessionID(r))
+			if err != nil {
+				h.writeError(w, r, err)
+				return
+			}
+			tokenFromContext(ctx).token = token
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// writeError answers with what the user can do about a failed Gmail call.
+// Errors fixed by granting access again are JSON, with reconsent set and
+// the grant_url to send the user to.
+func (h *Handler) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, ErrNotConnected), errors.Is(err, ErrTokenExpired), errors.Is(err, ErrNoAccess):
+		scope := ScopeReadonly
+		if t := tokenFromContext(r.Context()); t != nil {
+			scope = t.scope
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":     err.Error(),
+			"reconsent": true,
+			"grant_url": grantURL + "?scope=" + scope,
+		})
+	case errors.Is(err, ErrNoLabel), errors.Is(err, ErrNoSendAs):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrNotFound):
+		http.Error(w, "Message or attachment not found", http.StatusNotFound)
+	case errors.Is(err, ErrUnavailable):
+		http.Error(w, "Gmail is busy, try again later", http.StatusServiceUnavailable)
+	default:
+		h.logger.Error().Err(err).Msg("gmail request failed")
+		http.Error(w, "Gmail request failed", http.StatusBadGateway)
+	}
+}
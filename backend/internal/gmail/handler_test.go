@@ -0,0 +1,116 @@
+package gmail
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hackclub/format/internal/assets"
+	"github.com/hackclub/format/internal/session"
+	"github.com/rs/zerolog"
+	"golang.org/x/oauth2"
+)
+
+// fakeUploader records what it's asked to rehost
+type fakeUploader struct {
+	inputs []*assets.ProcessInput
+}
+
+func (u *fakeUploader) ProcessFromData(ctx context.Context, input *assets.ProcessInput) (*assets.Asset, error) {
+	u.inputs = append(u.inputs, input)
+	return &assets.Asset{URL: "https://cdn.example.com/logo.png", MIME: input.ContentType, Bytes: len(input.Data)}, nil
+}
+
+func TestRehostAttachment(t *testing.T) {
+	image := []byte("\x89PNG\r\n\x1a\nimage")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer access" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/gmail/v1/users/me/messages/msg-f:1":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"id": "1",
+				"payload": map[string]interface{}{
+					"mimeType": "multipart/mixed",
+					"parts": []map[string]interface{}{
+						{"mimeType": "application/octet-stream", "filename": "invoice.pdf", "body": map[string]interface{}{"attachmentId": "ANGpdf"}},
+						{"mimeType": "image/png", "filename": "logo.png", "body": map[string]interface{}{"attachmentId": "ANGjdJ8"}},
+					},
+				},
+			})
+		case "/gmail/v1/users/me/messages/msg-f:1/attachments/ANGjdJ8":
+			json.NewEncoder(w).Encode(map[string]string{"data": base64.URLEncoding.EncodeToString(image)})
+		case "/gmail/v1/users/me/messages/msg-f:1/attachments/ANGpdf":
+			json.NewEncoder(w).Encode(map[string]string{"data": base64.URLEncoding.EncodeToString([]byte("%PDF-1.4\n"))})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	store, err := NewTokenStore(memoryDB{}, nil, "secret", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := NewClient(store, zerolog.Nop())
+	client.endpoint = server.URL + "/"
+	uploader := &fakeUploader{}
+	h := NewHandler(client, session.NewManager("test-session-secret-of-32-bytes!", "http://localhost:8080"), uploader, nil, nil, zerolog.Nop())
+
+	rehost := func(body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/api/gmail/attachments", strings.NewReader(body))
+		// As RequireToken leaves it
+		r = r.WithContext(context.WithValue(r.Context(), requestTokenKey{}, &requestToken{token: &oauth2.Token{AccessToken: "access"}, scope: ScopeReadonly}))
+		w := httptest.NewRecorder()
+		h.HandleRehostAttachment(w, r)
+		return w
+	}
+
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"invalid JSON", `{`, http.StatusBadRequest},
+		{"missing message ID", `{"attachmentId":"ANGjdJ8"}`, http.StatusBadRequest},
+		{"missing attachment ID", `{"messageId":"msg-f:1"}`, http.StatusBadRequest},
+		{"missing message", `{"messageId":"msg-f:2","attachmentId":"ANGjdJ8"}`, http.StatusNotFound},
+		{"not an image", `{"messageId":"msg-f:1","attachmentId":"ANGpdf"}`, http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := rehost(tt.body); w.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+	if len(uploader.inputs) != 0 {
+		t.Fatalf("rejected requests uploaded %d attachments", len(uploader.inputs))
+	}
+
+	w := rehost(`{"messageId":"msg-f:1","attachmentId":"ANGjdJ8","preset":"email"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+	}
+	var asset assets.Asset
+	if err := json.NewDecoder(w.Body).Decode(&asset); err != nil {
+		t.Fatal(err)
+	}
+	if asset.URL != "https://cdn.example.com/logo.png" || asset.MIME != "image/png" {
+		t.Errorf("asset = %+v", asset)
+	}
+	if len(uploader.inputs) != 1 {
+		t.Fatalf("uploaded %d attachments, want 1", len(uploader.inputs))
+	}
+	input := uploader.inputs[0]
+	if string(input.Data) != string(image) || input.ContentType != "image/png" || input.SourceURL != "gmail:msg-f:1/ANGjdJ8" || input.Options.Preset != "email" {
+		t.Errorf("input = %+v", input)
+	}
+}
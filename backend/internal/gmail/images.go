@@ -0,0 +1,120 @@
+package gmail
+
+import (
+	"context"
+	"net/url"
+	"strings"
+
+	gmailapi "google.golang.org/api/gmail/v1"
+)
+
+// ImageResolver finds the attachments behind the images of pasted Gmail
+// HTML in a session's mailbox: Gmail attachment URLs, cid: references and
+// the blob: URLs of draft images. Each message is fetched once. Only blob:
+// URLs, which carry nothing to match, take the message's images in the
+// order they're resolved; cid: references and attachment URLs must match
+// their attachment. It serves a single transform and isn't safe for
+// concurrent use.
+type ImageResolver struct {
+	client    *Client
+	sessionID string
+	svc       *gmailapi.Service
+	messages  map[string]*gmailapi.Message
+	used      map[*gmailapi.MessagePart]bool
+}
+
+// ImageResolver returns a resolver for the images of the session's messages
+func (c *Client) ImageResolver(sessionID string) *ImageResolver {
+	return &ImageResolver{
+		client:    c,
+		sessionID: sessionID,
+		messages:  make(map[string]*gmailapi.Message),
+		used:      make(map[*gmailapi.MessagePart]bool),
+	}
+}
+
+// ResolveImage downloads the image src refers to. Gmail attachment URLs
+// name their message, cid: and blob: URLs are looked up in messageID. It
+// returns the image and a source identifying it for the asset pipeline.
+func (r *ImageResolver) ResolveImage(ctx context.Context, messageID, src, alt string) ([]byte, string, error) {
+	var attachmentID string
+	blob := strings.HasPrefix(src, "blob:")
+	switch {
+	case strings.HasPrefix(src, "cid:"):
+		attachmentID, _ = url.PathUnescape(strings.TrimPrefix(src, "cid:"))
+	case blob:
+	default:
+		u, err := url.Parse(src)
+		if err != nil || u.Host != "mail.google.com" {
+			return nil, "", ErrNotFound
+		}
+		query := u.Query()
+		if id := query.Get("permmsgid"); id != "" {
+			messageID = id
+		}
+		attachmentID = query.Get("realattid")
+		if attachmentID == "" {
+			attachmentID = query.Get("attid")
+		}
+	}
+	if messageID == "" || (!blob && attachmentID == "") {
+		return nil, "", ErrNotFound
+	}
+
+	message, err := r.message(ctx, messageID)
+	if err != nil {
+		return nil, "", err
+	}
+	var part *gmailapi.MessagePart
+	if blob {
+		part = r.nextImage(message.Payload)
+	} else {
+		part = findAttachment(message.Payload, attachmentID, Hint{Alt: alt})
+	}
+	if part == nil {
+		return nil, "", ErrNotFound
+	}
+	r.used[part] = true
+
+	attachment, err := download(ctx, r.svc, messageID, part)
+	if err != nil {
+		return nil, "", err
+	}
+	return attachment.Data, "gmail:" + messageID + "/" + part.PartId, nil
+}
+
+// message fetches a message, once
+func (r *ImageResolver) message(ctx context.Context, messageID string) (*gmailapi.Message, error) {
+	if message, ok := r.messages[messageID]; ok {
+		return message, nil
+	}
+	if r.svc == nil {
+		svc, err := r.client.service(ctx, r.sessionID)
+		if err != nil {
+			return nil, err
+		}
+		r.svc = svc
+	}
+	message, err := r.svc.Users.Messages.Get("me", messageID).Format("full").Context(ctx).Do()
+	if err != nil {
+		return nil, apiError(err)
+	}
+	r.messages[messageID] = message
+	return message, nil
+}
+
+// nextImage returns the first image of a message that wasn't resolved yet
+func (r *ImageResolver) nextImage(part *gmailapi.MessagePart) *gmailapi.MessagePart {
+	if part == nil {
+		return nil
+	}
+	if part.Body != nil && part.Body.AttachmentId != "" && strings.HasPrefix(part.MimeType, "image/") && !r.used[part] {
+		return part
+	}
+	for _, sub := range part.Parts {
+		if found := r.nextImage(sub); found != nil {
+			return found
+		}
+	}
+	return nil
+}
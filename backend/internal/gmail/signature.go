@@ -0,0 +1,79 @@
+package gmail
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	gmailapi "google.golang.org/api/gmail/v1"
+)
+
+// MaxSignatureLength is the longest signature Gmail accepts, in characters
+const MaxSignatureLength = 10000
+
+// ErrNoSendAs is returned for addresses the mailbox can't send as
+var ErrNoSendAs = errors.New("not an address of the mailbox")
+
+// SendAs is an address the user sends mail as, and its signature
+type SendAs struct {
+	Email       string `json:"email"`
+	DisplayName string `json:"display_name,omitempty"`
+	Primary     bool   `json:"primary"`
+	Signature   string `json:"signature"`
+}
+
+func sendAsOf(s *gmailapi.SendAs) *SendAs {
+	return &SendAs{Email: s.SendAsEmail, DisplayName: s.DisplayName, Primary: s.IsPrimary, Signature: s.Signature}
+}
+
+// SendAs lists the addresses of the session's mailbox with their signatures,
+// the primary one first
+func (c *Client) SendAs(ctx context.Context, sessionID string) ([]*SendAs, error) {
+	svc, err := c.service(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	list, err := svc.Users.Settings.SendAs.List("me").Context(ctx).Do()
+	if err != nil {
+		return nil, apiError(err)
+	}
+	addresses := make([]*SendAs, 0, len(list.SendAs))
+	for _, s := range list.SendAs {
+		if s.IsPrimary {
+			addresses = append([]*SendAs{sendAsOf(s)}, addresses...)
+		} else {
+			addresses = append(addresses, sendAsOf(s))
+		}
+	}
+	return addresses, nil
+}
+
+// SetSignature makes signature, HTML, the signature of the mailbox's address
+// email, its primary address if empty. An empty signature removes it. It
+// needs the settings scope, ErrNoAccess otherwise.
+func (c *Client) SetSignature(ctx context.Context, sessionID, email, signature string) (*SendAs, error) {
+	addresses, err := c.SendAs(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	var target *SendAs
+	for _, a := range addresses {
+		if (email == "" && a.Primary) || (email != "" && strings.EqualFold(a.Email, email)) {
+			target = a
+			break
+		}
+	}
+	if target == nil {
+		return nil, ErrNoSendAs
+	}
+
+	svc, err := c.service(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	updated, err := svc.Users.Settings.SendAs.Patch("me", target.Email, &gmailapi.SendAs{Signature: signature, ForceSendFields: []string{"Signature"}}).Context(ctx).Do()
+	if err != nil {
+		return nil, apiError(err)
+	}
+	return sendAsOf(updated), nil
+}
@@ -0,0 +1,224 @@
+// Package gmail calls the Gmail API on behalf of signed-in users, with the
+// Google OAuth tokens kept server-side for their session
+package gmail
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hackclub/format/internal/db"
+	"golang.org/x/oauth2"
+)
+
+// TokenDB is the part of the metadata store tokens are kept in
+type TokenDB interface {
+	SaveOAuthToken(ctx context.Context, t *db.OAuthToken) error
+	GetOAuthToken(ctx context.Context, sessionID string) (*db.OAuthToken, error)
+	DeleteOAuthToken(ctx context.Context, sessionID string) error
+	DeleteOAuthTokens(ctx context.Context, before time.Time) (int64, error)
+}
+
+// Refresher gets new access tokens with a refresh token, the Google
+// provider's OAuth client
+type Refresher interface {
+	TokenSource(ctx context.Context, token *oauth2.Token) oauth2.TokenSource
+}
+
+// refreshMargin is how long before it expires an access token is refreshed,
+// so it doesn't expire mid-request
+const refreshMargin = time.Minute
+
+// TokenStore keeps the OAuth tokens of sessions, sealed with a key derived
+// from the session secret so a leaked database doesn't leak mailboxes
+type TokenStore struct {
+	db        TokenDB
+	refresher Refresher
+	aead      cipher.AEAD
+	maxAge    time.Duration
+	// refreshing serializes refreshes so concurrent requests of a session
+	// don't each spend its refresh token
+	refreshing sync.Mutex
+	onRefresh  func(ctx context.Context, user string, err error)
+}
+
+// NewTokenStore seals tokens with secret and refreshes them with refresher.
+// Tokens not saved again within maxAge, the session lifetime, are purged.
+func NewTokenStore(database TokenDB, refresher Refresher, secret string, maxAge time.Duration) (*TokenStore, error) {
+	key := sha256.Sum256([]byte("format oauth tokens\n" + secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenStore{db: database, refresher: refresher, aead: aead, maxAge: maxAge}, nil
+}
+
+// OnRefresh calls fn after each refresh of an access token with the user
+// it's for, and the error if Google refused the refresh token
+func (s *TokenStore) OnRefresh(fn func(ctx context.Context, user string, err error)) {
+	s.onRefresh = fn
+}
+
+// Save stores the token of a session, replacing its previous one
+func (s *TokenStore) Save(ctx context.Context, sessionID, user string, token *oauth2.Token) error {
+	if sessionID == "" {
+		return fmt.Errorf("no session to store the token for")
+	}
+	access, err := s.seal(sessionID, token.AccessToken)
+	if err != nil {
+		return err
+	}
+	refresh, err := s.seal(sessionID, token.RefreshToken)
+	if err != nil {
+		return err
+	}
+	if err := s.db.SaveOAuthToken(ctx, &db.OAuthToken{
+		SessionID:    sessionID,
+		User:         user,
+		AccessToken:  access,
+		RefreshToken: refresh,
+		Expiry:       token.Expiry,
+	}); err != nil {
+		return err
+	}
+	// Logins are rare enough to purge expired sessions' tokens on
+	_, err = s.db.DeleteOAuthTokens(ctx, time.Now().Add(-s.maxAge))
+	return err
+}
+
+// Get returns the token of a session, ErrNotConnected if it has none
+func (s *TokenStore) Get(ctx context.Context, sessionID string) (*oauth2.Token, error) {
+	if sessionID == "" {
+		return nil, ErrNotConnected
+	}
+	stored, err := s.db.GetOAuthToken(ctx, sessionID)
+	if errors.Is(err, db.ErrNotFound) {
+		return nil, ErrNotConnected
+	}
+	if err != nil {
+		return nil, err
+	}
+	if time.Since(stored.UpdatedAt) > s.maxAge {
+		return nil, ErrNotConnected
+	}
+	access, err := s.open(sessionID, stored.AccessToken)
+	if err != nil {
+		return nil, err
+	}
+	refresh, err := s.open(sessionID, stored.RefreshToken)
+	if err != nil {
+		return nil, err
+	}
+	return &oauth2.Token{
+		AccessToken:  access,
+		RefreshToken: refresh,
+		TokenType:    "Bearer",
+		Expiry:       stored.Expiry,
+	}, nil
+}
+
+// Token returns an access token of a session valid for at least
+// refreshMargin, refreshing and storing it first if needed. It's
+// ErrTokenExpired when the session has no refresh token or Google refused
+// it, and the user has to consent again.
+func (s *TokenStore) Token(ctx context.Context, sessionID string) (*oauth2.Token, error) {
+	token, err := s.Get(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if fresh(token) {
+		return token, nil
+	}
+
+	s.refreshing.Lock()
+	defer s.refreshing.Unlock()
+	// Another request may have refreshed it meanwhile
+	token, err = s.Get(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if fresh(token) {
+		return token, nil
+	}
+	if token.RefreshToken == "" || s.refresher == nil {
+		return nil, ErrTokenExpired
+	}
+	stored, err := s.db.GetOAuthToken(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Expire it so the token source refreshes now rather than when it's
+	// actually expired
+	expired := *token
+	expired.Expiry = time.Now().Add(-time.Second)
+	refreshed, err := s.refresher.TokenSource(ctx, &expired).Token()
+	if err != nil {
+		var retrieveErr *oauth2.RetrieveError
+		if errors.As(err, &retrieveErr) && retrieveErr.Response != nil && retrieveErr.Response.StatusCode < 500 {
+			// invalid_grant: revoked, or unused for too long
+			err = fmt.Errorf("%w: %v", ErrTokenExpired, err)
+			s.refreshed(ctx, stored.User, err)
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to refresh token: %v", err)
+	}
+	if refreshed.RefreshToken == "" {
+		refreshed.RefreshToken = token.RefreshToken
+	}
+	if err := s.Save(ctx, sessionID, stored.User, refreshed); err != nil {
+		return nil, err
+	}
+	s.refreshed(ctx, stored.User, nil)
+	return refreshed, nil
+}
+
+func (s *TokenStore) refreshed(ctx context.Context, user string, err error) {
+	if s.onRefresh != nil {
+		s.onRefresh(ctx, user, err)
+	}
+}
+
+// fresh reports whether token is valid for at least refreshMargin
+func fresh(token *oauth2.Token) bool {
+	return token.AccessToken != "" && (token.Expiry.IsZero() || time.Until(token.Expiry) > refreshMargin)
+}
+
+// Delete forgets the token of a session
+func (s *TokenStore) Delete(ctx context.Context, sessionID string) error {
+	if sessionID == "" {
+		return nil
+	}
+	return s.db.DeleteOAuthToken(ctx, sessionID)
+}
+
+// seal encrypts value, bound to its session so it can't be moved to another
+func (s *TokenStore) seal(sessionID, value string) ([]byte, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return s.aead.Seal(nonce, nonce, []byte(value), []byte(sessionID)), nil
+}
+
+func (s *TokenStore) open(sessionID string, sealed []byte) (string, error) {
+	if len(sealed) < s.aead.NonceSize() {
+		return "", fmt.Errorf("sealed token is too short")
+	}
+	nonce, ciphertext := sealed[:s.aead.NonceSize()], sealed[s.aead.NonceSize():]
+	value, err := s.aead.Open(nil, nonce, ciphertext, []byte(sessionID))
+	if err != nil {
+		return "", fmt.Errorf("failed to open token: %v", err)
+	}
+	return string(value), nil
+}
@@ -0,0 +1,442 @@
+package gmail
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/hackclub/format/internal/db"
+	"github.com/hackclub/format/internal/html"
+	"github.com/hackclub/format/internal/session"
+	"github.com/rs/zerolog"
+	gmailapi "google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// ErrNoLabel is returned when starting a watch for a label the mailbox
+// doesn't have
+var ErrNoLabel = errors.New("label not found")
+
+// WatchDB is the part of the metadata store watches are kept in
+type WatchDB interface {
+	SaveGmailWatch(ctx context.Context, w *db.GmailWatch) error
+	GetGmailWatch(ctx context.Context, user string) (*db.GmailWatch, error)
+	ListExpiringGmailWatches(ctx context.Context, before time.Time) ([]*db.GmailWatch, error)
+	DeleteGmailWatch(ctx context.Context, user string) error
+}
+
+// Formatter transforms drafts and builds the messages they're replaced
+// with, the HTML transformer
+type Formatter interface {
+	Exporter
+	Transform(ctx context.Context, req *html.TransformRequest) (*html.TransformResponse, error)
+}
+
+// WatchConfig configures push notifications
+type WatchConfig struct {
+	// Topic is the Pub/Sub topic Gmail publishes to, projects/*/topics/*
+	Topic string
+	// Label is the name of the label that has a draft formatted
+	Label string
+	// PushAudience is the audience of the tokens Pub/Sub push requests are
+	// authenticated with, and PushServiceAccount the service account they
+	// must be for. Google signs tokens for every service account, so both
+	// are required.
+	PushAudience       string
+	PushServiceAccount string
+}
+
+// watchRenewal is how long before it expires a watch is renewed, Gmail
+// stops notifying after 7 days. Watches of mailboxes without notifications
+// are renewed by RenewWatches.
+const watchRenewal = 24 * time.Hour
+
+// formatTimeout bounds the handling of a notification, which runs after
+// Pub/Sub has been answered
+const formatTimeout = 2 * time.Minute
+
+// formattedMessageID is the domain of the Message-ID of the messages
+// Export builds, drafts we wrote back aren't formatted again
+const formattedMessageID = "@format.hackclub.com>"
+
+// Watcher formats the drafts users give a label, zero-click: Gmail notifies
+// a Pub/Sub topic of changes to the mailboxes being watched, whose push
+// subscription calls us, and the labeled drafts are transformed and written
+// back. A watch calls Gmail with the token of the session that started it,
+// and ends when that token is gone.
+type Watcher struct {
+	client    *Client
+	db        WatchDB
+	formatter Formatter
+	topic     string
+	label     string
+	// verify checks the token of a push request
+	verify func(ctx context.Context, raw string) error
+	logger zerolog.Logger
+
+	// mailboxes serializes the notifications of each mailbox
+	mu        sync.Mutex
+	mailboxes map[string]*sync.Mutex
+}
+
+func NewWatcher(ctx context.Context, client *Client, database WatchDB, formatter Formatter, cfg WatchConfig, logger zerolog.Logger) (*Watcher, error) {
+	if !strings.HasPrefix(cfg.Topic, "projects/") || !strings.Contains(cfg.Topic, "/topics/") {
+		return nil, fmt.Errorf("invalid Pub/Sub topic %q, expected projects/PROJECT/topics/TOPIC", cfg.Topic)
+	}
+	if cfg.PushAudience == "" {
+		return nil, fmt.Errorf("a push audience is required")
+	}
+	if cfg.PushServiceAccount == "" {
+		return nil, fmt.Errorf("a push service account is required")
+	}
+	label := cfg.Label
+	if label == "" {
+		label = "Format"
+	}
+
+	// Pub/Sub signs push requests with a Google ID token of its service
+	// account
+	provider, err := oidc.NewProvider(ctx, "https://accounts.google.com")
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover Google's keys: %w", err)
+	}
+	verifier := provider.Verifier(&oidc.Config{ClientID: cfg.PushAudience})
+	verify := func(ctx context.Context, raw string) error {
+		token, err := verifier.Verify(ctx, raw)
+		if err != nil {
+			return err
+		}
+		var claims struct {
+			Email         string `json:"email"`
+			EmailVerified bool   `json:"email_verified"`
+		}
+		if err := token.Claims(&claims); err != nil {
+			return err
+		}
+		if !claims.EmailVerified || !strings.EqualFold(claims.Email, cfg.PushServiceAccount) {
+			return fmt.Errorf("token is for %s, not the push service account", claims.Email)
+		}
+		return nil
+	}
+
+	return &Watcher{
+		client:    client,
+		db:        database,
+		formatter: formatter,
+		topic:     cfg.Topic,
+		label:     label,
+		verify:    verify,
+		logger:    logger,
+		mailboxes: make(map[string]*sync.Mutex),
+	}, nil
+}
+
+// Label is the name of the label that has a draft formatted
+func (w *Watcher) Label() string {
+	return w.label
+}
+
+// Start watches the session's mailbox, user's, for drafts given the label.
+// It needs the compose scope, and the label to exist.
+func (w *Watcher) Start(ctx context.Context, sessionID, user string) (*db.GmailWatch, error) {
+	svc, err := w.client.service(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	labels, err := svc.Users.Labels.List("me").Context(ctx).Do()
+	if err != nil {
+		return nil, apiError(err)
+	}
+	var labelID string
+	for _, l := range labels.Labels {
+		if strings.EqualFold(l.Name, w.label) {
+			labelID = l.Id
+			break
+		}
+	}
+	if labelID == "" {
+		return nil, fmt.Errorf("%w: create a Gmail label named %q first", ErrNoLabel, w.label)
+	}
+
+	watch := &db.GmailWatch{User: user, SessionID: sessionID, LabelID: labelID, LabelName: w.label}
+	if err := w.watch(ctx, svc, watch); err != nil {
+		return nil, err
+	}
+	return watch, nil
+}
+
+// watch asks Gmail to notify of changes to the watch's label, and stores
+// the watch from the mailbox's current history
+func (w *Watcher) watch(ctx context.Context, svc *gmailapi.Service, watch *db.GmailWatch) error {
+	resp, err := svc.Users.Watch("me", &gmailapi.WatchRequest{
+		TopicName:           w.topic,
+		LabelIds:            []string{watch.LabelID},
+		LabelFilterBehavior: "include",
+	}).Context(ctx).Do()
+	if err != nil {
+		return apiError(err)
+	}
+	watch.HistoryID = resp.HistoryId
+	watch.ExpiresAt = time.UnixMilli(resp.Expiration).UTC()
+	return w.db.SaveGmailWatch(ctx, watch)
+}
+
+// Status returns the watch of a mailbox, nil if it isn't watched
+func (w *Watcher) Status(ctx context.Context, user string) (*db.GmailWatch, error) {
+	watch, err := w.db.GetGmailWatch(ctx, user)
+	if errors.Is(err, db.ErrNotFound) {
+		return nil, nil
+	}
+	return watch, err
+}
+
+// Stop stops watching the session's mailbox, user's
+func (w *Watcher) Stop(ctx context.Context, sessionID, user string) error {
+	if svc, err := w.client.service(ctx, sessionID); err == nil {
+		if err := svc.Users.Stop("me").Context(ctx).Do(); err != nil {
+			// Notifications of forgotten watches are ignored anyway
+			w.logger.Warn().Err(err).Str("email", user).Msg("failed to stop gmail watch")
+		}
+	}
+	return w.db.DeleteGmailWatch(ctx, user)
+}
+
+// Notified formats the drafts labeled in the mailbox of user since its
+// watch last looked, up to historyID, in the background. Images are
+// rehosted as user's.
+func (w *Watcher) Notified(user string, historyID uint64) {
+	go func() {
+		ctx, cancel := context.WithTimeout(userContext(context.Background(), user), formatTimeout)
+		defer cancel()
+		if err := w.process(ctx, user, historyID); err != nil {
+			w.logger.Error().Err(err).Str("email", user).Msg("failed to format watched drafts")
+		}
+	}()
+}
+
+// RenewWatches renews the watches about to expire, catching up on their
+// drafts first, so quiet mailboxes keep being watched. It returns how many
+// were looked at.
+func (w *Watcher) RenewWatches(ctx context.Context) (int, error) {
+	watches, err := w.db.ListExpiringGmailWatches(ctx, time.Now().Add(watchRenewal))
+	if err != nil {
+		return 0, err
+	}
+	for _, watch := range watches {
+		wctx, cancel := context.WithTimeout(userContext(ctx, watch.User), formatTimeout)
+		err := w.process(wctx, watch.User, 0)
+		cancel()
+		if err != nil {
+			w.logger.Error().Err(err).Str("email", watch.User).Msg("failed to renew gmail watch")
+		}
+	}
+	return len(watches), nil
+}
+
+// StartRenewal runs RenewWatches every interval until ctx is done
+func (w *Watcher) StartRenewal(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := w.RenewWatches(ctx); err != nil {
+				w.logger.Error().Err(err).Msg("gmail watch renewal failed")
+			}
+		}
+	}
+}
+
+// userContext is the context drafts of user's mailbox are formatted in,
+// images are rehosted as theirs
+func userContext(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, "user", &session.User{Email: user, Provider: "google"})
+}
+
+// process formats the drafts labeled since the watch of user last looked
+func (w *Watcher) process(ctx context.Context, user string, historyID uint64) error {
+	lock := w.mailbox(user)
+	lock.Lock()
+	defer lock.Unlock()
+
+	watch, err := w.db.GetGmailWatch(ctx, user)
+	if errors.Is(err, db.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if historyID != 0 && historyID <= watch.HistoryID {
+		return nil
+	}
+	svc, err := w.client.service(ctx, watch.SessionID)
+	if errors.Is(err, ErrNotConnected) || errors.Is(err, ErrTokenExpired) {
+		// Signed out or revoked, the watch ends with the token
+		w.logger.Info().Str("email", user).Msg("gmail token gone, ending watch")
+		return w.db.DeleteGmailWatch(ctx, user)
+	}
+	if err != nil {
+		return err
+	}
+
+	var messageIDs []string
+	seen := make(map[string]bool)
+	latest := watch.HistoryID
+	err = svc.Users.History.List("me").StartHistoryId(watch.HistoryID).LabelId(watch.LabelID).
+		HistoryTypes("messageAdded", "labelAdded").Pages(ctx, func(page *gmailapi.ListHistoryResponse) error {
+		latest = max(latest, page.HistoryId)
+		for _, h := range page.History {
+			var messages []*gmailapi.Message
+			for _, added := range h.MessagesAdded {
+				messages = append(messages, added.Message)
+			}
+			for _, added := range h.LabelsAdded {
+				messages = append(messages, added.Message)
+			}
+			for _, m := range messages {
+				if m != nil && !seen[m.Id] && hasLabels(m, "DRAFT", watch.LabelID) {
+					seen[m.Id] = true
+					messageIDs = append(messageIDs, m.Id)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		err = apiError(err)
+		if !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		// The history has been trimmed past where the watch looked, pick
+		// up from the notification
+		latest = max(latest, historyID)
+	}
+
+	if len(messageIDs) > 0 {
+		drafts, err := w.draftIDs(ctx, svc)
+		if err != nil {
+			return err
+		}
+		for _, messageID := range messageIDs {
+			// Drafts edited since are no longer this message
+			draftID, ok := drafts[messageID]
+			if !ok {
+				continue
+			}
+			if err := w.formatDraft(ctx, svc, watch, draftID); err != nil {
+				w.logger.Error().Err(err).Str("email", user).Str("draft", draftID).Msg("failed to format draft")
+			}
+		}
+	}
+
+	watch.HistoryID = latest
+	if time.Until(watch.ExpiresAt) < watchRenewal {
+		return w.watch(ctx, svc, watch)
+	}
+	return w.db.SaveGmailWatch(ctx, watch)
+}
+
+// mailbox returns the lock of a mailbox's notifications
+func (w *Watcher) mailbox(user string) *sync.Mutex {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	lock, ok := w.mailboxes[user]
+	if !ok {
+		lock = &sync.Mutex{}
+		w.mailboxes[user] = lock
+	}
+	return lock
+}
+
+// draftIDs maps the message ID of each draft of a mailbox to the draft's
+func (w *Watcher) draftIDs(ctx context.Context, svc *gmailapi.Service) (map[string]string, error) {
+	drafts := make(map[string]string)
+	err := svc.Users.Drafts.List("me").Pages(ctx, func(page *gmailapi.ListDraftsResponse) error {
+		for _, d := range page.Drafts {
+			if d.Message != nil {
+				drafts[d.Message.Id] = d.Id
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, apiError(err)
+	}
+	return drafts, nil
+}
+
+// formatDraft transforms a draft and writes it back, keeping its headers
+// and thread. Its cid: images are rehosted from the draft itself.
+func (w *Watcher) formatDraft(ctx context.Context, svc *gmailapi.Service, watch *db.GmailWatch, draftID string) error {
+	draft, err := svc.Users.Drafts.Get("me", draftID).Format("full").Context(ctx).Do()
+	if err != nil {
+		return apiError(err)
+	}
+	message := draft.Message
+	if message == nil || message.Payload == nil {
+		return nil
+	}
+	if strings.HasSuffix(header(message.Payload, "Message-ID"), formattedMessageID) {
+		// Written back by us
+		return nil
+	}
+	body, err := messageBody(message.Payload, "text/html")
+	if err != nil || body == "" {
+		return err
+	}
+
+	result, err := w.formatter.Transform(ctx, &html.TransformRequest{
+		HTML:           body,
+		GmailMessageID: message.Id,
+		Images:         w.client.ImageResolver(watch.SessionID),
+	})
+	if err != nil {
+		return err
+	}
+	raw, err := w.formatter.Export(ctx, &html.ExportRequest{
+		HTML:    result.HTML,
+		Subject: header(message.Payload, "Subject"),
+		From:    header(message.Payload, "From"),
+		To:      header(message.Payload, "To"),
+		Cc:      header(message.Payload, "Cc"),
+		Bcc:     header(message.Payload, "Bcc"),
+		// Replies stay in their thread
+		InReplyTo:  header(message.Payload, "In-Reply-To"),
+		References: header(message.Payload, "References"),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = svc.Users.Drafts.Update("me", draftID, &gmailapi.Draft{Id: draftID, Message: &gmailapi.Message{ThreadId: message.ThreadId}}).
+		Media(bytes.NewReader(raw), googleapi.ContentType("message/rfc822")).
+		Context(ctx).Do()
+	if err != nil {
+		return apiError(err)
+	}
+	w.logger.Info().Str("email", watch.User).Str("draft", draftID).Int("images", result.Stats.ImagesRehosted).Msg("formatted watched draft")
+	return nil
+}
+
+// hasLabels reports whether a message carries all of labels
+func hasLabels(message *gmailapi.Message, labels ...string) bool {
+	for _, want := range labels {
+		found := false
+		for _, l := range message.LabelIds {
+			if l == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,136 @@
+// Package health checks that the dependencies of the server are reachable
+package health
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Statuses of a check and of the server as a whole
+const (
+	StatusOK       = "ok"
+	StatusError    = "error"
+	StatusDegraded = "degraded"
+)
+
+// Check returns an error when a dependency can't be reached
+type Check func(ctx context.Context) error
+
+// Result is the outcome of a check. The error is only logged, health is
+// public.
+type Result struct {
+	Status    string    `json:"status"`
+	LatencyMS int64     `json:"latency_ms"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// Report is the outcome of every check
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]Result `json:"checks"`
+}
+
+// Checker runs named checks and caches their results, so frequent health
+// probes don't turn into a request to every dependency each
+type Checker struct {
+	names  []string
+	checks map[string]Check
+	// optional names the checks whose failure degrades the server
+	// without making it unready
+	optional map[string]bool
+	ttl      time.Duration
+	timeout  time.Duration
+	logger   zerolog.Logger
+
+	mu        sync.Mutex
+	report    Report
+	checkedAt time.Time
+}
+
+// NewChecker returns a Checker reusing results for ttl and failing checks
+// that take longer than timeout
+func NewChecker(ttl, timeout time.Duration, logger zerolog.Logger) *Checker {
+	return &Checker{
+		checks:   map[string]Check{},
+		optional: map[string]bool{},
+		ttl:      ttl,
+		timeout:  timeout,
+		logger:   logger,
+	}
+}
+
+// Add registers check under name
+func (c *Checker) Add(name string, check Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.checks[name]; !ok {
+		c.names = append(c.names, name)
+		sort.Strings(c.names)
+	}
+	c.checks[name] = check
+	delete(c.optional, name)
+	c.checkedAt = time.Time{}
+}
+
+// AddOptional registers check under name for a dependency the server works
+// without, which only degrades the report when it fails
+func (c *Checker) AddOptional(name string, check Check) {
+	c.Add(name, check)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.optional[name] = true
+}
+
+// Run returns the results of every check, running them again, concurrently,
+// once the cached ones are older than the TTL. The report is an error when a
+// required check fails and degraded when only optional ones do.
+func (c *Checker) Run(ctx context.Context) Report {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.checkedAt.IsZero() && time.Since(c.checkedAt) < c.ttl {
+		return c.report
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	results := make([]Result, len(c.names))
+	var wg sync.WaitGroup
+	for i, name := range c.names {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			start := time.Now()
+			err := c.checks[name](ctx)
+			results[i] = Result{
+				Status:    StatusOK,
+				LatencyMS: time.Since(start).Milliseconds(),
+				CheckedAt: start.UTC(),
+			}
+			if err != nil {
+				results[i].Status = StatusError
+				c.logger.Error().Err(err).Str("check", name).Msg("health check failed")
+			}
+		}(i, name)
+	}
+	wg.Wait()
+
+	report := Report{Status: StatusOK, Checks: make(map[string]Result, len(c.names))}
+	for i, name := range c.names {
+		report.Checks[name] = results[i]
+		switch {
+		case results[i].Status == StatusOK:
+		case !c.optional[name]:
+			report.Status = StatusError
+		case report.Status == StatusOK:
+			report.Status = StatusDegraded
+		}
+	}
+	c.report = report
+	c.checkedAt = time.Now()
+	return report
+}
@@ -0,0 +1,50 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestChecker(t *testing.T) {
+	ctx := context.Background()
+	calls := 0
+	var storageErr error
+	c := NewChecker(time.Hour, time.Second, zerolog.Nop())
+	c.Add("storage", func(ctx context.Context) error {
+		calls++
+		return storageErr
+	})
+	c.Add("database", func(ctx context.Context) error { return nil })
+
+	report := c.Run(ctx)
+	if report.Status != StatusOK || report.Checks["storage"].Status != StatusOK {
+		t.Errorf("report = %+v, want ok", report)
+	}
+
+	// Results are cached for the TTL
+	storageErr = errors.New("unreachable")
+	if c.Run(ctx); calls != 1 {
+		t.Errorf("checks ran %d times, want 1", calls)
+	}
+
+	c.checkedAt = time.Now().Add(-2 * time.Hour)
+	report = c.Run(ctx)
+	if report.Status != StatusError || report.Checks["storage"].Status != StatusError || report.Checks["database"].Status != StatusOK {
+		t.Errorf("report = %+v, want storage failing", report)
+	}
+}
+
+func TestCheckerOptional(t *testing.T) {
+	c := NewChecker(0, time.Second, zerolog.Nop())
+	c.Add("database", func(ctx context.Context) error { return nil })
+	c.AddOptional("redis", func(ctx context.Context) error { return errors.New("unreachable") })
+
+	report := c.Run(context.Background())
+	if report.Status != StatusDegraded || report.Checks["redis"].Status != StatusError {
+		t.Errorf("report = %+v, want degraded with redis failing", report)
+	}
+}
@@ -0,0 +1,106 @@
+package html
+
+import (
+	"context"
+	"fmt"
+	stdhtml "html"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/hackclub/format/internal/assets"
+	"github.com/hackclub/format/internal/util"
+)
+
+// documentLinkRegex matches links and captures their href
+var documentLinkRegex = regexp.MustCompile(`<a[^>]*href=["']([^"']+)["'][^>]*>`)
+
+// documentPassResult collects everything rehostDocuments reports besides the
+// HTML
+type documentPassResult struct {
+	rehosted int
+	assets   map[string]*assets.Asset
+	messages []string
+}
+
+// rehostDocuments points links to PDFs and other allowed documents at copies
+// on our CDN, so they keep working when the original moves or expires.
+// Documents present in known are reused as long as they still point at our
+// CDN. Links that fail to rehost are left alone.
+func (t *Transformer) rehostDocuments(ctx context.Context, html string, known map[string]*assets.Asset) (string, documentPassResult) {
+	result := documentPassResult{assets: make(map[string]*assets.Asset)}
+
+	// Collect the distinct document URLs, in document order
+	var toRehost []string
+	seen := make(map[string]bool)
+	for _, match := range documentLinkRegex.FindAllStringSubmatch(html, -1) {
+		href := match[1]
+		if seen[href] || !t.isDocumentLink(href) {
+			continue
+		}
+		seen[href] = true
+		if asset, ok := known[href]; ok && t.isCDNAsset(asset) {
+			result.assets[href] = asset
+			continue
+		}
+		toRehost = append(toRehost, href)
+	}
+
+	results := make(map[string]rehostResult, len(toRehost))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, maxConcurrentRehosts)
+	for _, href := range toRehost {
+		wg.Add(1)
+		go func(href string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			asset, err := t.assetService.ProcessDocumentFromURL(ctx, stdhtml.UnescapeString(href))
+
+			mu.Lock()
+			results[href] = rehostResult{asset: asset, err: err}
+			mu.Unlock()
+		}(href)
+	}
+	wg.Wait()
+
+	// One message per document
+	for _, href := range toRehost {
+		rehosted := results[href]
+		if rehosted.err != nil {
+			result.messages = append(result.messages, fmt.Sprintf("Failed to rehost document %s: %v", href[:min(50, len(href))], rehosted.err))
+			continue
+		}
+		result.assets[href] = rehosted.asset
+		result.messages = append(result.messages, fmt.Sprintf("Document rehosted: %s -> %s", href[:min(50, len(href))], rehosted.asset.URL))
+	}
+
+	html = documentLinkRegex.ReplaceAllStringFunc(html, func(tag string) string {
+		href := documentLinkRegex.FindStringSubmatch(tag)[1]
+		asset, ok := result.assets[href]
+		if !ok {
+			return tag
+		}
+		result.rehosted++
+		return strings.Replace(tag, href, asset.URL, 1)
+	})
+
+	return html, result
+}
+
+// isDocumentLink reports whether href is an HTTPS link to an allowed
+// document type that isn't on our CDN already
+func (t *Transformer) isDocumentLink(href string) bool {
+	u, err := url.Parse(stdhtml.UnescapeString(href))
+	if err != nil || u.Scheme != "https" {
+		return false
+	}
+	if t.cdnHost != "" && u.Host == t.cdnHost {
+		return false
+	}
+	return util.GetDocumentMIME(path.Ext(u.Path)) != ""
+}
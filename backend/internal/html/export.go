@@ -0,0 +1,247 @@
+package html
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"time"
+)
+
+type ExportRequest struct {
+	HTML    string `json:"html"`
+	Subject string `json:"subject"`
+	From    string `json:"from,omitempty"`
+	To      string `json:"to,omitempty"`
+	Cc      string `json:"cc,omitempty"`
+	Bcc     string `json:"bcc,omitempty"`
+	// InReplyTo and References are the Message-IDs a reply threads under,
+	// only set by the server from the message replied to
+	InReplyTo  string `json:"-"`
+	References string `json:"-"`
+	// InlineImages embeds images as CID attachments instead of linking them
+	InlineImages bool `json:"inline_images,omitempty"`
+}
+
+var exportImgSrcRegex = regexp.MustCompile(`(<img[^>]*src=["'])([^"']+)(["'])`)
+
+// msgIDRegex matches an RFC 5322 msg-id, <id-left@id-right>
+var msgIDRegex = regexp.MustCompile(`^<[^<>@\s]+@[^<>@\s]+>$`)
+
+// Export wraps transformed HTML into a complete RFC 5322 multipart message
+// with a generated plaintext part
+func (t *Transformer) Export(ctx context.Context, req *ExportRequest) ([]byte, error) {
+	htmlBody := strings.ReplaceAll(req.HTML, transformedMarker, "")
+	plainBody := semanticHTMLToMarkdown(toSemanticHTML(htmlBody))
+
+	var inline []inlineImage
+	if req.InlineImages {
+		var err error
+		htmlBody, inline, err = t.inlineImages(ctx, htmlBody)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var buf bytes.Buffer
+
+	// Top-level headers
+	headers := []struct{ key, value string }{
+		{"From", req.From},
+		{"To", req.To},
+		{"Cc", req.Cc},
+		{"Bcc", req.Bcc},
+		{"Subject", mime.QEncoding.Encode("utf-8", req.Subject)},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"Message-ID", fmt.Sprintf("<%s@format.hackclub.com>", randomID())},
+		{"In-Reply-To", req.InReplyTo},
+		{"References", req.References},
+		{"MIME-Version", "1.0"},
+	}
+	for _, h := range headers {
+		if h.value == "" {
+			continue
+		}
+		if h.key == "From" || h.key == "To" || h.key == "Cc" || h.key == "Bcc" {
+			addrs, err := mail.ParseAddressList(h.value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s address: %v", strings.ToLower(h.key), err)
+			}
+			formatted := make([]string, len(addrs))
+			for i, addr := range addrs {
+				formatted[i] = addr.String()
+			}
+			h.value = strings.Join(formatted, ", ")
+		}
+		if h.key == "In-Reply-To" || h.key == "References" {
+			ids := strings.Fields(h.value)
+			for _, id := range ids {
+				if !msgIDRegex.MatchString(id) {
+					return nil, fmt.Errorf("invalid %s: %q is not a Message-ID", h.key, id)
+				}
+			}
+			h.value = strings.Join(ids, " ")
+		}
+		fmt.Fprintf(&buf, "%s: %s\r\n", h.key, h.value)
+	}
+
+	// Body: multipart/alternative, wrapped in multipart/related with inline images
+	outer := multipart.NewWriter(&buf)
+	alternative := outer
+	if len(inline) > 0 {
+		fmt.Fprintf(&buf, "Content-Type: multipart/related; boundary=%s\r\n\r\n", outer.Boundary())
+
+		var altBuf bytes.Buffer
+		alternative = multipart.NewWriter(&altBuf)
+		if err := writeAlternative(alternative, plainBody, htmlBody); err != nil {
+			return nil, err
+		}
+		part, err := outer.CreatePart(textproto.MIMEHeader{
+			"Content-Type": {fmt.Sprintf("multipart/alternative; boundary=%s", alternative.Boundary())},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := part.Write(altBuf.Bytes()); err != nil {
+			return nil, err
+		}
+
+		for _, img := range inline {
+			if err := writeInlineImage(outer, img); err != nil {
+				return nil, err
+			}
+		}
+		if err := outer.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	fmt.Fprintf(&buf, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", alternative.Boundary())
+	if err := writeAlternative(alternative, plainBody, htmlBody); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeAlternative writes the plaintext and HTML parts and closes w
+func writeAlternative(w *multipart.Writer, plainBody, htmlBody string) error {
+	for _, body := range []struct{ contentType, content string }{
+		{"text/plain; charset=utf-8", plainBody},
+		{"text/html; charset=utf-8", htmlBody},
+	} {
+		part, err := w.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {body.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return err
+		}
+		qp := quotedprintable.NewWriter(part)
+		if _, err := qp.Write([]byte(body.content)); err != nil {
+			return err
+		}
+		if err := qp.Close(); err != nil {
+			return err
+		}
+	}
+	return w.Close()
+}
+
+type inlineImage struct {
+	cid         string
+	contentType string
+	data        []byte
+}
+
+// inlineImages fetches every image and points its src at a cid: reference
+func (t *Transformer) inlineImages(ctx context.Context, htmlBody string) (string, []inlineImage, error) {
+	var images []inlineImage
+	cids := make(map[string]string)
+
+	for _, match := range exportImgSrcRegex.FindAllStringSubmatch(htmlBody, -1) {
+		src := match[2]
+		if _, ok := cids[src]; ok || strings.HasPrefix(src, "cid:") {
+			continue
+		}
+
+		var data []byte
+		var contentType string
+		var err error
+		if strings.HasPrefix(src, "data:") {
+			data, contentType, err = parseDataURI(src)
+		} else {
+			data, contentType, err = t.fetcher.FetchURL(ctx, src)
+		}
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to inline image %s: %v", src[:min(50, len(src))], err)
+		}
+
+		cid := randomID() + "@format.hackclub.com"
+		cids[src] = cid
+		images = append(images, inlineImage{cid: cid, contentType: contentType, data: data})
+	}
+
+	htmlBody = exportImgSrcRegex.ReplaceAllStringFunc(htmlBody, func(match string) string {
+		submatches := exportImgSrcRegex.FindStringSubmatch(match)
+		cid, ok := cids[submatches[2]]
+		if !ok {
+			return match
+		}
+		return submatches[1] + "cid:" + cid + submatches[3]
+	})
+
+	return htmlBody, images, nil
+}
+
+// writeInlineImage writes a base64 image part referenced by Content-ID
+func writeInlineImage(w *multipart.Writer, img inlineImage) error {
+	part, err := w.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {img.contentType},
+		"Content-Transfer-Encoding": {"base64"},
+		"Content-ID":                {"<" + img.cid + ">"},
+		"Content-Disposition":       {"inline"},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Wrap base64 at 76 characters per RFC 2045
+	encoded := base64.StdEncoding.EncodeToString(img.data)
+	for len(encoded) > 76 {
+		if _, err := fmt.Fprintf(part, "%s\r\n", encoded[:76]); err != nil {
+			return err
+		}
+		encoded = encoded[76:]
+	}
+	_, err = fmt.Fprintf(part, "%s\r\n", encoded)
+	return err
+}
+
+// parseDataURI decodes a base64 data URI
+func parseDataURI(dataURI string) ([]byte, string, error) {
+	header, encoded, ok := strings.Cut(strings.TrimPrefix(dataURI, "data:"), ",")
+	if !ok || !strings.HasSuffix(header, ";base64") {
+		return nil, "", fmt.Errorf("only base64 data URIs are supported")
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to decode base64 data: %v", err)
+	}
+	return data, strings.TrimSuffix(header, ";base64"), nil
+}
+
+func randomID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
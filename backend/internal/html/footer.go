@@ -0,0 +1,86 @@
+package html
+
+import (
+	"fmt"
+	stdhtml "html"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultFooterTemplate is a CAN-SPAM friendly footer: who the email is from,
+// a physical address and an unsubscribe link
+const DefaultFooterTemplate = `<div style="color: rgb(136, 136, 136); font-family: Arial, Helvetica, sans-serif; font-size: x-small; margin-top: 24px;">` +
+	`You're receiving this email because you're part of the {{org_name}} community.<br>` +
+	`{{org_name}}, {{address}}<br>` +
+	`<a href="{{unsubscribe_url}}" style="color: rgb(136, 136, 136);">Unsubscribe</a>` +
+	`</div>`
+
+// Footer blocks are delimited by these comments so that a re-transform
+// replaces the footer instead of appending a second one
+const (
+	footerStartMarker = "<!-- format-footer -->"
+	footerEndMarker   = "<!-- /format-footer -->"
+)
+
+var footerBlockRegex = regexp.MustCompile(`(?s)` + regexp.QuoteMeta(footerStartMarker) + `.*?` + regexp.QuoteMeta(footerEndMarker))
+
+// FooterConfig holds the per-deployment footer settings
+type FooterConfig struct {
+	Template       string
+	OrgName        string
+	Address        string
+	UnsubscribeURL string
+}
+
+// stripFooter removes footer blocks added by a previous transform
+func stripFooter(html string) string {
+	return footerBlockRegex.ReplaceAllString(html, "")
+}
+
+// footerURLSchemes are the schemes a request may set URL variables, those
+// named *_url, to. Values without a scheme, like an ESP's merge tag, are
+// left alone.
+var footerURLSchemes = []string{"http", "https", "mailto"}
+
+// renderFooter fills the footer template. Variables from the request override
+// the configured ones, except URL variables of other schemes, which are
+// ignored with a message; all values are HTML-escaped.
+func (t *Transformer) renderFooter(vars map[string]string) (string, []string) {
+	tmpl := t.footer.Template
+	if tmpl == "" {
+		tmpl = DefaultFooterTemplate
+	}
+
+	values := map[string]string{
+		"org_name":        t.footer.OrgName,
+		"address":         t.footer.Address,
+		"unsubscribe_url": t.footer.UnsubscribeURL,
+		"year":            strconv.Itoa(time.Now().Year()),
+	}
+	var messages []string
+	for k, v := range vars {
+		if strings.HasSuffix(k, "_url") && !safeFooterURL(v) {
+			messages = append(messages, fmt.Sprintf("Ignored footer variable %s, only http, https and mailto URLs are allowed", k))
+			continue
+		}
+		values[k] = v
+	}
+
+	replacements := make([]string, 0, len(values)*2)
+	for k, v := range values {
+		replacements = append(replacements, "{{"+k+"}}", stdhtml.EscapeString(v))
+	}
+
+	return footerStartMarker + strings.NewReplacer(replacements...).Replace(tmpl) + footerEndMarker, messages
+}
+
+// safeFooterURL reports whether a URL variable's value has one of the
+// footerURLSchemes or none
+func safeFooterURL(value string) bool {
+	u, err := url.Parse(value)
+	return err == nil && (u.Scheme == "" || slices.Contains(footerURLSchemes, u.Scheme))
+}
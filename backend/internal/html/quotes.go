@@ -0,0 +1,198 @@
+package html
+
+import (
+	"fmt"
+	stdhtml "html"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Quote handling modes for TransformRequest.QuoteMode
+const (
+	QuoteModeKeep     = "keep"     // leave quoted history untouched (default)
+	QuoteModeDrop     = "drop"     // remove quoted history entirely
+	QuoteModeTrim     = "trim"     // keep only the latest QuoteLevels levels
+	QuoteModeCollapse = "collapse" // move quoted history behind a divider
+)
+
+var (
+	gmailQuoteRegex     = regexp.MustCompile(`<div[^>]*class="gmail_quote[^"]*"[^>]*>`)
+	attributionRegex    = regexp.MustCompile(`(?:<(?:div|p|span)[^>]*>\s*)*On\s[^<]{1,300}?\swrote:`)
+	blockquoteOpenRegex = regexp.MustCompile(`<blockquote[^>]*>`)
+	tagsOnlyRegex       = regexp.MustCompile(`^(?:\s|<[^>]*>)*$`)
+)
+
+// quoteDivider separates the message from collapsed quoted history. The
+// history itself is wrapped in a gmail_quote div so Gmail hides it behind its
+// "..." toggle.
+const quoteDivider = `<hr style="border: none; border-top: 1px solid rgb(204, 204, 204); margin: 16px 0px;">`
+
+// QuotedMessage is the message a reply quotes
+type QuotedMessage struct {
+	From string // its From header
+	Date time.Time
+	HTML string
+}
+
+// replyQuoteStyle is the style Gmail gives the blockquote of a reply
+const replyQuoteStyle = "margin: 0px 0px 0px 0.8ex; border-left: 1px solid rgb(204, 204, 204); padding-left: 1ex;"
+
+var bodyRegex = regexp.MustCompile(`(?is)<body[^>]*>(.*)</body>`)
+
+// AppendReplyQuote appends the message a reply is to, quoted like Gmail
+// does: an "On DATE, NAME wrote:" attribution and the message in a
+// gmail_quote blockquote, so Gmail collapses it behind its "..." toggle
+func AppendReplyQuote(html string, quoted *QuotedMessage) string {
+	body := quoted.HTML
+	if m := bodyRegex.FindStringSubmatch(body); m != nil {
+		body = m[1]
+	}
+	sender := quoted.From
+	if addr, err := mail.ParseAddress(quoted.From); err == nil {
+		sender = addr.Address
+		if addr.Name != "" {
+			sender = addr.Name + " <" + addr.Address + ">"
+		}
+	}
+	attribution := fmt.Sprintf("On %s %s wrote:",
+		quoted.Date.Format("Mon, Jan 2, 2006 at 3:04 PM"), stdhtml.EscapeString(sender))
+
+	return html + `<br><div class="gmail_quote">` +
+		`<div dir="ltr" class="gmail_attr">` + attribution + `<br></div>` +
+		`<blockquote class="gmail_quote" style="` + replyQuoteStyle + `">` + body + `</blockquote>` +
+		`</div>`
+}
+
+// IsValidQuoteMode reports whether mode is a supported quote handling mode
+func IsValidQuoteMode(mode string) bool {
+	switch mode {
+	case "", QuoteModeKeep, QuoteModeDrop, QuoteModeTrim, QuoteModeCollapse:
+		return true
+	default:
+		return false
+	}
+}
+
+// handleQuotes applies the quote mode to the quoted history of a pasted
+// thread and returns the number of quote levels removed
+func (t *Transformer) handleQuotes(html, mode string, levels int) (string, int, error) {
+	if !IsValidQuoteMode(mode) {
+		return html, 0, fmt.Errorf("unknown quote mode %q", mode)
+	}
+	if mode == "" || mode == QuoteModeKeep {
+		return html, 0, nil
+	}
+
+	boundary := findQuoteBoundary(html)
+	if boundary == -1 {
+		return html, 0, nil
+	}
+	message, quoted := html[:boundary], html[boundary:]
+
+	switch mode {
+	case QuoteModeDrop:
+		return message, max(1, strings.Count(quoted, "<blockquote")), nil
+	case QuoteModeTrim:
+		if levels <= 0 {
+			return message, max(1, strings.Count(quoted, "<blockquote")), nil
+		}
+		quoted, removed := trimQuoteLevels(quoted, levels)
+		return message + quoted, removed, nil
+	default: // QuoteModeCollapse
+		if loc := gmailQuoteRegex.FindStringIndex(quoted); loc == nil || loc[0] != 0 {
+			quoted = `<div class="gmail_quote">` + quoted + `</div>`
+		}
+		return message + quoteDivider + quoted, 0, nil
+	}
+}
+
+// findQuoteBoundary returns the index where the quoted history starts, either
+// a gmail_quote container or an "On ... wrote:" attribution, or -1
+func findQuoteBoundary(html string) int {
+	boundary := -1
+	if loc := gmailQuoteRegex.FindStringIndex(html); loc != nil {
+		boundary = loc[0]
+	}
+	if loc := attributionRegex.FindStringIndex(html); loc != nil && (boundary == -1 || loc[0] < boundary) {
+		boundary = loc[0]
+	}
+	return boundary
+}
+
+// trimQuoteLevels removes blockquotes nested deeper than levels, together
+// with the attribution line right before each of them
+func trimQuoteLevels(quoted string, levels int) (string, int) {
+	const closeTag = "</blockquote>"
+
+	removed := 0
+	depth := 0
+	pos := 0
+	for {
+		nextOpen := blockquoteOpenRegex.FindStringIndex(quoted[pos:])
+		nextClose := strings.Index(quoted[pos:], closeTag)
+		if nextOpen == nil && nextClose == -1 {
+			return quoted, removed
+		}
+
+		if nextOpen != nil && (nextClose == -1 || nextOpen[0] < nextClose) {
+			openStart := pos + nextOpen[0]
+			if depth < levels {
+				depth++
+				pos += nextOpen[1]
+				continue
+			}
+
+			end := matchingBlockquoteEnd(quoted, openStart)
+			start := attributionStart(quoted[:openStart])
+			quoted = quoted[:start] + quoted[end:]
+			pos = start
+			removed++
+			continue
+		}
+
+		depth--
+		pos += nextClose + len(closeTag)
+	}
+}
+
+// matchingBlockquoteEnd returns the index just past the </blockquote> that
+// closes the blockquote opening at start, or the end of the string
+func matchingBlockquoteEnd(html string, start int) int {
+	const closeTag = "</blockquote>"
+
+	depth := 0
+	pos := start
+	for {
+		nextOpen := strings.Index(html[pos:], "<blockquote")
+		nextClose := strings.Index(html[pos:], closeTag)
+		if nextClose == -1 {
+			return len(html)
+		}
+		if nextOpen != -1 && nextOpen < nextClose {
+			depth++
+			pos += nextOpen + len("<blockquote")
+			continue
+		}
+		depth--
+		pos += nextClose + len(closeTag)
+		if depth == 0 {
+			return pos
+		}
+	}
+}
+
+// attributionStart returns where the "On ... wrote:" line directly preceding
+// the end of before starts, or len(before) if there is none
+func attributionStart(before string) int {
+	matches := attributionRegex.FindAllStringIndex(before, -1)
+	if len(matches) == 0 {
+		return len(before)
+	}
+	last := matches[len(matches)-1]
+	if !tagsOnlyRegex.MatchString(before[last[1]:]) {
+		return len(before)
+	}
+	return last[0]
+}
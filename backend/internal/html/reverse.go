@@ -0,0 +1,219 @@
+package html
+
+import (
+	"fmt"
+	stdhtml "html"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Output formats for Reverse
+const (
+	ReverseFormatHTML     = "html"
+	ReverseFormatMarkdown = "markdown"
+)
+
+type ReverseRequest struct {
+	HTML   string `json:"html"`
+	Format string `json:"format,omitempty"` // "html" (default) or "markdown"
+}
+
+type ReverseResponse struct {
+	Content string `json:"content"`
+	Format  string `json:"format"`
+}
+
+var (
+	reverseDivRegex        = regexp.MustCompile(`(?s)<div([^>]*)>(.*?)</div>`)
+	reverseStyleRegex      = regexp.MustCompile(`style="([^"]*)"`)
+	reverseTagRegex        = regexp.MustCompile(`<([a-zA-Z][a-zA-Z0-9]*)(\s[^>]*)>`)
+	reverseKeepAttrRegex   = regexp.MustCompile(`\s(?:href|src|alt)="[^"]*"`)
+	reverseSpanRegex       = regexp.MustCompile(`</?span[^>]*>`)
+	reverseBlankDivRegex   = regexp.MustCompile(`<p>\s*(?:<br\s*/?>)?\s*</p>`)
+	reverseBlockquoteRegex = regexp.MustCompile(`<blockquote[^>]*>`)
+	reverseHRRegex         = regexp.MustCompile(`<hr[^>]*>`)
+
+	mdHeadingRegex = regexp.MustCompile(`(?s)<h([1-6])>(.*?)</h[1-6]>`)
+	mdParaRegex    = regexp.MustCompile(`(?s)<p>(.*?)</p>`)
+	mdLinkRegex    = regexp.MustCompile(`(?s)<a[^>]*href="([^"]*)"[^>]*>(.*?)</a>`)
+	mdImgRegex     = regexp.MustCompile(`<img[^>]*>`)
+	mdSrcRegex     = regexp.MustCompile(`src="([^"]*)"`)
+	mdAltRegex     = regexp.MustCompile(`alt="([^"]*)"`)
+	mdStrongRegex  = regexp.MustCompile(`(?s)<(?:strong|b)>(.*?)</(?:strong|b)>`)
+	mdEmRegex      = regexp.MustCompile(`(?s)<(?:em|i)>(.*?)</(?:em|i)>`)
+	mdCodeRegex    = regexp.MustCompile(`(?s)<code>(.*?)</code>`)
+	mdBrRegex      = regexp.MustCompile(`<br\s*/?>`)
+	mdItemRegex    = regexp.MustCompile(`(?s)<li>(.*?)</li>`)
+	mdTagRegex     = regexp.MustCompile(`<[^>]+>`)
+	mdBlankRegex   = regexp.MustCompile(`\n{3,}`)
+)
+
+// Reverse converts Gmail-formatted HTML, as emitted by Transform, back into
+// clean semantic HTML or Markdown
+func (t *Transformer) Reverse(req *ReverseRequest) (*ReverseResponse, error) {
+	format := req.Format
+	if format == "" {
+		format = ReverseFormatHTML
+	}
+	if format != ReverseFormatHTML && format != ReverseFormatMarkdown {
+		return nil, fmt.Errorf("unsupported format %q", format)
+	}
+
+	content := toSemanticHTML(req.HTML)
+	if format == ReverseFormatMarkdown {
+		content = semanticHTMLToMarkdown(content)
+	}
+
+	return &ReverseResponse{
+		Content: content,
+		Format:  format,
+	}, nil
+}
+
+// toSemanticHTML turns styled Gmail divs back into headings and paragraphs
+// and drops presentational attributes
+func toSemanticHTML(html string) string {
+	html = strings.ReplaceAll(html, transformedMarker, "")
+	html = stripFooter(html)
+
+	// Styled divs become headings or paragraphs
+	html = reverseDivRegex.ReplaceAllStringFunc(html, func(match string) string {
+		submatches := reverseDivRegex.FindStringSubmatch(match)
+		style := ""
+		if m := reverseStyleRegex.FindStringSubmatch(submatches[1]); m != nil {
+			style = m[1]
+		}
+		content := submatches[2]
+
+		if strings.Contains(style, "font-weight: bold") {
+			switch {
+			case strings.Contains(style, "font-size: large"):
+				return "<h1>" + content + "</h1>"
+			case strings.Contains(style, "font-size: medium"):
+				return "<h2>" + content + "</h2>"
+			default:
+				return "<h3>" + content + "</h3>"
+			}
+		}
+		return "<p>" + content + "</p>"
+	})
+
+	html = reverseBlockquoteRegex.ReplaceAllString(html, "<blockquote>")
+	html = reverseHRRegex.ReplaceAllString(html, "<hr>")
+	html = reverseSpanRegex.ReplaceAllString(html, "")
+
+	// Only keep attributes that carry content
+	html = reverseTagRegex.ReplaceAllStringFunc(html, func(match string) string {
+		submatches := reverseTagRegex.FindStringSubmatch(match)
+		kept := strings.Join(reverseKeepAttrRegex.FindAllString(submatches[2], -1), "")
+		return "<" + strings.ToLower(submatches[1]) + kept + ">"
+	})
+
+	// Gmail blank-line divs are just spacing
+	html = reverseBlankDivRegex.ReplaceAllString(html, "")
+
+	return strings.TrimSpace(html)
+}
+
+// semanticHTMLToMarkdown converts the output of toSemanticHTML to Markdown
+func semanticHTMLToMarkdown(html string) string {
+	// Inline elements
+	html = mdImgRegex.ReplaceAllStringFunc(html, func(match string) string {
+		src, alt := "", ""
+		if m := mdSrcRegex.FindStringSubmatch(match); m != nil {
+			src = m[1]
+		}
+		if m := mdAltRegex.FindStringSubmatch(match); m != nil {
+			alt = m[1]
+		}
+		return fmt.Sprintf("![%s](%s)", alt, src)
+	})
+	html = mdLinkRegex.ReplaceAllString(html, "[$2]($1)")
+	html = mdStrongRegex.ReplaceAllString(html, "**$1**")
+	html = mdEmRegex.ReplaceAllString(html, "_${1}_")
+	html = mdCodeRegex.ReplaceAllString(html, "`$1`")
+	html = mdBrRegex.ReplaceAllString(html, "  \n")
+
+	// Block elements, innermost lists and blockquotes first
+	html = convertInnermost(html, []string{"ul", "ol"}, markdownList)
+	html = convertInnermost(html, []string{"blockquote"}, markdownBlockquote)
+	html = mdHeadingRegex.ReplaceAllStringFunc(html, func(match string) string {
+		submatches := mdHeadingRegex.FindStringSubmatch(match)
+		level, _ := strconv.Atoi(submatches[1])
+		return "\n\n" + strings.Repeat("#", level) + " " + strings.TrimSpace(submatches[2]) + "\n\n"
+	})
+	html = mdParaRegex.ReplaceAllString(html, "\n\n$1\n\n")
+	html = strings.ReplaceAll(html, "<hr>", "\n\n---\n\n")
+
+	// Anything left over is markup we don't map
+	html = mdTagRegex.ReplaceAllString(html, "")
+	html = stdhtml.UnescapeString(html)
+	html = mdBlankRegex.ReplaceAllString(html, "\n\n")
+
+	return strings.TrimSpace(html) + "\n"
+}
+
+// convertInnermost repeatedly replaces the innermost element with one of the
+// given tag names using convert(tag, content) until none are left
+func convertInnermost(html string, tags []string, convert func(tag, content string) string) string {
+	for {
+		start, tag := -1, ""
+		for _, t := range tags {
+			if i := strings.LastIndex(html, "<"+t+">"); i > start {
+				start, tag = i, t
+			}
+		}
+		if start == -1 {
+			return html
+		}
+
+		contentStart := start + len("<"+tag+">")
+		end := strings.Index(html[contentStart:], "</"+tag+">")
+		if end == -1 {
+			// Unclosed element, drop the opening tag
+			return html[:start] + html[contentStart:]
+		}
+		end += contentStart
+
+		html = html[:start] + convert(tag, html[contentStart:end]) + html[end+len("</"+tag+">"):]
+	}
+}
+
+// markdownList renders list items, indenting the continuation lines of
+// nested lists
+func markdownList(tag, content string) string {
+	var b strings.Builder
+	b.WriteString("\n\n")
+	for i, item := range mdItemRegex.FindAllStringSubmatch(content, -1) {
+		marker := "- "
+		if tag == "ol" {
+			marker = strconv.Itoa(i+1) + ". "
+		}
+		lines := strings.Split(strings.TrimSpace(item[1]), "\n")
+		b.WriteString(marker + lines[0] + "\n")
+		for _, line := range lines[1:] {
+			if strings.TrimSpace(line) != "" {
+				b.WriteString("  " + line + "\n")
+			}
+		}
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
+// markdownBlockquote prefixes every line of the quote with "> "
+func markdownBlockquote(tag, content string) string {
+	content = mdParaRegex.ReplaceAllString(content, "\n\n$1\n\n")
+	content = strings.TrimSpace(mdBlankRegex.ReplaceAllString(content, "\n\n"))
+
+	lines := strings.Split(content, "\n")
+	for i, line := range lines {
+		if line == "" {
+			lines[i] = ">"
+		} else {
+			lines[i] = "> " + line
+		}
+	}
+	return "\n\n" + strings.Join(lines, "\n") + "\n\n"
+}
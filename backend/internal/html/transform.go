@@ -3,26 +3,109 @@ package html
 import (
 	"context"
 	"fmt"
+	stdhtml "html"
 	"net/url"
 	"regexp"
 	"strings"
+	"sync"
+	"unicode"
 
 	"github.com/hackclub/format/internal/assets"
+	"github.com/hackclub/format/internal/imageproc"
+	"github.com/hackclub/format/internal/util"
 )
 
 type Transformer struct {
 	assetService *assets.Service
+	fetcher      *util.HTTPFetcher
 	cdnHost      string
+	cdnPath      string // path asset keys follow on cdnHost, ending in /
+	footer       FooterConfig
+	// allowedClasses are CSS classes kept by sanitization in addition to
+	// gmail_*, entries ending in * match by prefix
+	allowedClasses []string
 }
 
 type TransformRequest struct {
 	HTML string `json:"html"`
+	// Assets is an optional original URL -> asset map from a previous
+	// transform, images found in it are reused instead of rehosted again
+	Assets map[string]*assets.Asset `json:"assets,omitempty"`
+	// QuoteMode controls what happens to quoted history of a pasted thread,
+	// see the QuoteMode* constants. QuoteLevels applies to QuoteModeTrim.
+	QuoteMode   string `json:"quote_mode,omitempty"`
+	QuoteLevels int    `json:"quote_levels,omitempty"`
+	// Footer appends the configured compliance footer, FooterVars overrides
+	// its template variables. A footer from a previous transform is always
+	// replaced.
+	Footer     bool              `json:"footer,omitempty"`
+	FooterVars map[string]string `json:"footer_vars,omitempty"`
+	// AllowedClasses extends the configured class allowlist for this request
+	AllowedClasses []string `json:"allowed_classes,omitempty"`
+	// Lossless rehosts images pixel-exact in their source format
+	Lossless bool `json:"lossless,omitempty"`
+	// RehostDocuments points links to PDFs and other documents at copies on
+	// our CDN
+	RehostDocuments bool `json:"rehost_documents,omitempty"`
+	// GmailMessageID is the message the HTML was copied from, its cid: and
+	// blob: images are looked up there
+	GmailMessageID string `json:"gmail_message_id,omitempty"`
+	// Images resolves the images only the user's mailbox serves, set by the
+	// server for sessions with Gmail access
+	Images ImageResolver `json:"-"`
+}
+
+// ImageResolver fetches the images pasted Gmail HTML references by Gmail
+// attachment URLs, cid: or blob: URLs
+type ImageResolver interface {
+	// ResolveImage returns the image src refers to, looked up in messageID
+	// unless src names its message, and a source identifying it
+	ResolveImage(ctx context.Context, messageID, src, alt string) ([]byte, string, error)
 }
 
 type TransformResponse struct {
-	HTML     string   `json:"html"`
-	Messages []string `json:"messages,omitempty"`
-	Stats    Stats    `json:"stats"`
+	HTML     string        `json:"html"`
+	Messages []string      `json:"messages,omitempty"`
+	Images   []ImageResult `json:"images"`
+	// Assets maps each rehosted original URL to its asset. Data URIs are left
+	// out since echoing them back would bloat the response.
+	Assets map[string]*assets.Asset `json:"assets"`
+	Stats  Stats                    `json:"stats"`
+	// AlreadyTransformed is set when the input carried the marker left by a
+	// previous transform
+	AlreadyTransformed bool `json:"already_transformed"`
+}
+
+// transformedMarker is prepended to every transform output so that pasting
+// the result back in can be recognised
+const transformedMarker = "<!-- format.hackclub.com -->"
+
+// StripMarker removes the marker of transformed HTML, for where it's used
+// as is rather than exported
+func StripMarker(html string) string {
+	return strings.ReplaceAll(html, transformedMarker, "")
+}
+
+// gmailStyleFingerprint identifies elements that already carry the Gmail
+// styles applied by convertToGmailFormat, those are left untouched
+const gmailStyleFingerprint = "color: rgb(34, 34, 34)"
+
+// Image statuses reported in ImageResult
+const (
+	ImageStatusRehosted    = "rehosted"
+	ImageStatusSkipped     = "skipped"
+	ImageStatusUnsupported = "unsupported"
+	ImageStatusFailed      = "failed"
+)
+
+// ImageResult describes what happened to a single <img> in the document
+type ImageResult struct {
+	OriginalURL string `json:"original_url"`
+	URL         string `json:"url"`
+	Status      string `json:"status"`
+	Error       string `json:"error,omitempty"`
+	BytesSaved  int    `json:"bytes_saved"`
+	Deduped     bool   `json:"deduped"`
 }
 
 type Stats struct {
@@ -30,16 +113,37 @@ type Stats struct {
 	ImagesRehosted  int `json:"images_rehosted"`
 	StylesRemoved   int `json:"styles_removed"`
 	ScriptsRemoved  int `json:"scripts_removed"`
+
+	EmptyElementsRemoved  int `json:"empty_elements_removed"`
+	SpansUnwrapped        int `json:"spans_unwrapped"`
+	LineBreaksRemoved     int `json:"line_breaks_removed"`
+	ZeroWidthCharsRemoved int `json:"zero_width_chars_removed"`
+	QuotesRemoved         int `json:"quotes_removed"`
+
+	LinksCleaned      int `json:"links_cleaned"`
+	MailtoLinks       int `json:"mailto_links"`
+	DocumentsRehosted int `json:"documents_rehosted"`
+	Words             int `json:"words"`
+	ReadTimeMinutes   int `json:"read_time_minutes"`
+	BytesSaved        int `json:"bytes_saved"`
 }
 
-func NewTransformer(assetService *assets.Service, cdnBaseURL string) *Transformer {
-	host := ""
+// wordsPerMinute is the reading speed used to estimate read time
+const wordsPerMinute = 200
+
+func NewTransformer(assetService *assets.Service, cdnBaseURL string, footer FooterConfig, allowedClasses []string) *Transformer {
+	host, path := "", "/"
 	if u, err := url.Parse(cdnBaseURL); err == nil {
 		host = u.Host
+		path = strings.TrimSuffix(u.Path, "/") + "/"
 	}
 	return &Transformer{
-		assetService: assetService,
-		cdnHost:      host,
+		assetService:   assetService,
+		fetcher:        util.NewHTTPFetcher(),
+		cdnHost:        host,
+		cdnPath:        path,
+		footer:         footer,
+		allowedClasses: allowedClasses,
 	}
 }
 
@@ -49,26 +153,103 @@ func (t *Transformer) Transform(ctx context.Context, req *TransformRequest) (*Tr
 	stats := Stats{}
 	messages := []string{}
 
-	// 1. Extract and process images
-	html, imageStats, imageMessages := t.processImages(ctx, html)
-	stats.ImagesProcessed = imageStats.ImagesProcessed
-	stats.ImagesRehosted = imageStats.ImagesRehosted
-	messages = append(messages, imageMessages...)
+	// 0. Detect output of a previous transform
+	alreadyTransformed := strings.Contains(html, transformedMarker)
+	html = strings.ReplaceAll(html, transformedMarker, "")
+	html = stripFooter(html)
 
-	// 2. Sanitize HTML
-	html, sanitizeStats := t.sanitizeHTML(html)
+	// 1. Drop, trim or collapse quoted history before anything is rehosted
+	html, quotesRemoved, err := t.handleQuotes(html, req.QuoteMode, req.QuoteLevels)
+	if err != nil {
+		return nil, err
+	}
+	stats.QuotesRemoved = quotesRemoved
+
+	// 2. Extract and process images
+	imageOptions := emailImageOptions
+	imageOptions.Lossless = req.Lossless
+	html, imageResult := t.processImages(ctx, html, req.Assets, req.Images, req.GmailMessageID, imageOptions)
+	stats.ImagesProcessed = imageResult.stats.ImagesProcessed
+	stats.ImagesRehosted = imageResult.stats.ImagesRehosted
+	stats.BytesSaved = imageResult.stats.BytesSaved
+	messages = append(messages, imageResult.messages...)
+
+	// 2b. Rehost linked documents, when asked to
+	if req.RehostDocuments {
+		var documentResult documentPassResult
+		html, documentResult = t.rehostDocuments(ctx, html, req.Assets)
+		stats.DocumentsRehosted = documentResult.rehosted
+		for href, asset := range documentResult.assets {
+			imageResult.assets[href] = asset
+		}
+		messages = append(messages, documentResult.messages...)
+	}
+
+	// 3. Sanitize HTML
+	allowedClasses := append(append([]string{"gmail_*"}, t.allowedClasses...), req.AllowedClasses...)
+	html, sanitizeStats := t.sanitizeHTML(html, allowedClasses)
 	stats.StylesRemoved = sanitizeStats.StylesRemoved
 	stats.ScriptsRemoved = sanitizeStats.ScriptsRemoved
+	stats.LinksCleaned = sanitizeStats.LinksCleaned
+	stats.MailtoLinks = sanitizeStats.MailtoLinks
+
+	// 4. Strip leftover junk from pasted content
+	html, cleanupStats := t.cleanupHTML(html)
+	stats.EmptyElementsRemoved = cleanupStats.EmptyElementsRemoved
+	stats.SpansUnwrapped = cleanupStats.SpansUnwrapped
+	stats.LineBreaksRemoved = cleanupStats.LineBreaksRemoved
+	stats.ZeroWidthCharsRemoved = cleanupStats.ZeroWidthCharsRemoved
+
+	// Reading stats cover the message itself, not the footer
+	stats.Words = countWords(html)
+	stats.ReadTimeMinutes = (stats.Words + wordsPerMinute - 1) / wordsPerMinute
+
+	// 5. Append the compliance footer
+	if req.Footer {
+		footer, footerMessages := t.renderFooter(req.FooterVars)
+		html += footer
+		messages = append(messages, footerMessages...)
+	}
 
 	return &TransformResponse{
-		HTML:     html,
-		Messages: messages,
-		Stats:    stats,
+		HTML:               transformedMarker + html,
+		Messages:           messages,
+		Images:             imageResult.images,
+		Assets:             imageResult.assets,
+		Stats:              stats,
+		AlreadyTransformed: alreadyTransformed,
 	}, nil
 }
 
-// processImages finds all img tags and rehoists external/data images
-func (t *Transformer) processImages(ctx context.Context, html string) (string, Stats, []string) {
+// maxConcurrentRehosts bounds how many images of a single document are
+// fetched, processed and uploaded at the same time
+const maxConcurrentRehosts = 4
+
+// emailImageOptions are used when rehosting images for an email
+var emailImageOptions = imageproc.ProcessOptions{Preset: imageproc.PresetEmail}
+
+// rehostResult is the outcome of rehosting a single distinct image URL
+type rehostResult struct {
+	asset *assets.Asset
+	err   error
+}
+
+// imagePassResult collects everything processImages reports besides the HTML
+type imagePassResult struct {
+	stats    Stats
+	images   []ImageResult
+	assets   map[string]*assets.Asset
+	messages []string
+}
+
+// altRegex finds the alt text of an img tag
+var altRegex = regexp.MustCompile(`alt=["']([^"']*)["']`)
+
+// processImages finds all img tags and rehoists external/data images. Images
+// present in known are reused as long as they still point at our CDN. Gmail
+// images are fetched through mailbox, from messageID when they don't name
+// their message.
+func (t *Transformer) processImages(ctx context.Context, html string, known map[string]*assets.Asset, mailbox ImageResolver, messageID string, opts imageproc.ProcessOptions) (string, imagePassResult) {
 	stats := Stats{}
 	messages := []string{}
 
@@ -79,61 +260,145 @@ func (t *Transformer) processImages(ctx context.Context, html string) (string, S
 	matches := imgRegex.FindAllStringSubmatch(html, -1)
 	stats.ImagesProcessed = len(matches)
 
-	// Process each image
+	// Collect the distinct URLs that need rehosting, in document order
+	var toRehost []string
+	reused := make(map[string]rehostResult)
+	fetched := make(map[string]*assets.ProcessInput)
+	statuses := make(map[string]string)
+	// Keys of the CDN assets the document uses, kept from garbage collection
+	var referenced []string
 	for _, match := range matches {
-		fullImgTag := match[0]
 		srcURL := match[1]
+		if _, ok := statuses[srcURL]; ok {
+			continue
+		}
+		statuses[srcURL] = ImageStatusSkipped
 
 		// Skip if already on our CDN
 		if t.cdnHost != "" {
 			if u, err := url.Parse(srcURL); err == nil && u.Host == t.cdnHost {
+				referenced = append(referenced, strings.TrimPrefix(u.Path, t.cdnPath))
+				continue
+			}
+		}
+
+		// Fetch Gmail images from the user's mailbox
+		gmailImage := strings.HasPrefix(srcURL, "blob:") || strings.HasPrefix(srcURL, "cid:") ||
+			(strings.Contains(srcURL, "mail.google.com") && strings.Contains(srcURL, "attid="))
+		if gmailImage && mailbox != nil && (messageID != "" || strings.Contains(srcURL, "permmsgid=")) {
+			if asset, ok := known[srcURL]; ok && t.isCDNAsset(asset) {
+				reused[srcURL] = rehostResult{asset: asset}
+				continue
+			}
+			var alt string
+			if m := altRegex.FindStringSubmatch(match[0]); m != nil {
+				alt = stdhtml.UnescapeString(m[1])
+			}
+			input, err := t.fetchGmailImage(ctx, mailbox, messageID, stdhtml.UnescapeString(srcURL), alt)
+			if err != nil {
+				reused[srcURL] = rehostResult{err: err}
+				messages = append(messages, fmt.Sprintf("Failed to fetch Gmail image %s: %v", srcURL[:min(50, len(srcURL))], err))
 				continue
 			}
+			fetched[srcURL] = input
+			toRehost = append(toRehost, srcURL)
+			continue
 		}
 
 		// Handle blob URLs (Gmail draft images)
 		if strings.HasPrefix(srcURL, "blob:") {
+			statuses[srcURL] = ImageStatusUnsupported
 			messages = append(messages, "Gmail draft detected - Use the 🖼️ button to upload images for rehosting")
 			continue
 		}
 
 		// Handle Gmail attachment URLs (require authentication)
 		if strings.Contains(srcURL, "mail.google.com") && strings.Contains(srcURL, "attid=") {
-			messages = append(messages, "Gmail attachment detected - Use the 🖼️ button in the toolbar to upload images manually for rehosting")
+			statuses[srcURL] = ImageStatusUnsupported
+			messages = append(messages, "Gmail attachment detected - Paste it into the editor to rehost it from Gmail, or use the 🖼️ button in the toolbar to upload it")
 			continue
 		}
 
 		// Check if we should rehost this image
-		shouldRehost := t.shouldRehostImage(srcURL)
-		if !shouldRehost {
+		if !t.shouldRehostImage(srcURL) {
+			continue
+		}
+
+		// Reuse the asset from a previous transform
+		if asset, ok := known[srcURL]; ok && t.isCDNAsset(asset) {
+			reused[srcURL] = rehostResult{asset: asset}
+			if u, err := url.Parse(asset.URL); err == nil {
+				referenced = append(referenced, strings.TrimPrefix(u.Path, "/"))
+			}
 			continue
 		}
 
-		// Process the image
-		var asset *assets.Asset
-		var err error
+		toRehost = append(toRehost, srcURL)
+	}
+
+	if len(referenced) > 0 {
+		t.assetService.TouchAssets(ctx, referenced)
+	}
+	results := t.rehostImages(ctx, toRehost, fetched, opts)
+	for srcURL, result := range reused {
+		results[srcURL] = result
+	}
 
-		if strings.HasPrefix(srcURL, "data:") {
-			asset, err = t.assetService.ProcessFromDataURI(ctx, srcURL)
+	// One message per image
+	for _, srcURL := range toRehost {
+		result := results[srcURL]
+		if result.err == nil {
+			stats.BytesSaved += max(0, result.asset.OriginalBytes-result.asset.Bytes)
+		}
+		if result.err != nil {
+			messages = append(messages, fmt.Sprintf("Failed to rehost image %s: %v", srcURL[:min(50, len(srcURL))], result.err))
+		} else if result.asset.Deduped {
+			messages = append(messages, fmt.Sprintf("Image deduplicated: %s", result.asset.URL))
 		} else {
-			asset, err = t.assetService.ProcessFromURL(ctx, srcURL)
+			messages = append(messages, fmt.Sprintf("Image rehosted: %s -> %s", srcURL[:min(50, len(srcURL))], result.asset.URL))
 		}
+	}
 
-		if err != nil {
-			messages = append(messages, fmt.Sprintf("Failed to rehost image %s: %v", srcURL[:min(50, len(srcURL))], err))
+	// Rewrite the img tags in document order
+	images := make([]ImageResult, 0, len(matches))
+	assetMap := make(map[string]*assets.Asset)
+	for _, match := range matches {
+		fullImgTag := match[0]
+		srcURL := match[1]
+
+		result, ok := results[srcURL]
+		if !ok {
+			images = append(images, ImageResult{
+				OriginalURL: srcURL,
+				URL:         srcURL,
+				Status:      statuses[srcURL],
+			})
+			continue
+		}
+		if result.err != nil {
+			images = append(images, ImageResult{
+				OriginalURL: srcURL,
+				URL:         srcURL,
+				Status:      ImageStatusFailed,
+				Error:       result.err.Error(),
+			})
 			continue
 		}
 
-		// One message per image
-		if asset.Deduped {
-			messages = append(messages, fmt.Sprintf("Image deduplicated: %s", asset.URL))
-		} else {
-			messages = append(messages, fmt.Sprintf("Image rehosted: %s -> %s", srcURL[:min(50, len(srcURL))], asset.URL))
+		images = append(images, ImageResult{
+			OriginalURL: srcURL,
+			URL:         result.asset.URL,
+			Status:      ImageStatusRehosted,
+			BytesSaved:  max(0, result.asset.OriginalBytes-result.asset.Bytes),
+			Deduped:     result.asset.Deduped,
+		})
+		if !strings.HasPrefix(srcURL, "data:") {
+			assetMap[srcURL] = result.asset
 		}
 
 		// Replace the src in the img tag
-		newImgTag := srcRegex.ReplaceAllString(fullImgTag, fmt.Sprintf(`src="%s"`, asset.URL))
-		
+		newImgTag := srcRegex.ReplaceAllString(fullImgTag, fmt.Sprintf(`src="%s"`, result.asset.URL))
+
 		// Add alt text if missing
 		if !strings.Contains(newImgTag, "alt=") {
 			newImgTag = strings.Replace(newImgTag, ">", ` alt="">`, 1)
@@ -146,7 +411,74 @@ func (t *Transformer) processImages(ctx context.Context, html string) (string, S
 		stats.ImagesRehosted++
 	}
 
-	return html, stats, messages
+	return html, imagePassResult{
+		stats:    stats,
+		images:   images,
+		assets:   assetMap,
+		messages: messages,
+	}
+}
+
+// isCDNAsset reports whether a client-supplied asset points at our CDN, so
+// that it can't be used to inject arbitrary image URLs
+func (t *Transformer) isCDNAsset(asset *assets.Asset) bool {
+	if asset == nil || t.cdnHost == "" {
+		return false
+	}
+	u, err := url.Parse(asset.URL)
+	return err == nil && u.Host == t.cdnHost
+}
+
+// fetchGmailImage resolves a Gmail image through mailbox, ready to be
+// processed
+func (t *Transformer) fetchGmailImage(ctx context.Context, mailbox ImageResolver, messageID, src, alt string) (*assets.ProcessInput, error) {
+	data, source, err := mailbox.ResolveImage(ctx, messageID, src, alt)
+	if err != nil {
+		return nil, err
+	}
+	// Gmail often labels inline images application/octet-stream
+	contentType := util.DetectContentType(data)
+	if !strings.HasPrefix(contentType, "image/") {
+		return nil, fmt.Errorf("attachment is not an image")
+	}
+	return &assets.ProcessInput{Data: data, ContentType: contentType, SourceURL: source}, nil
+}
+
+// rehostImages processes the given distinct URLs concurrently, with at most
+// maxConcurrentRehosts in flight. URLs in fetched are processed from the data
+// fetched for them.
+func (t *Transformer) rehostImages(ctx context.Context, srcURLs []string, fetched map[string]*assets.ProcessInput, opts imageproc.ProcessOptions) map[string]rehostResult {
+	results := make(map[string]rehostResult, len(srcURLs))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, maxConcurrentRehosts)
+
+	for _, srcURL := range srcURLs {
+		wg.Add(1)
+		go func(srcURL string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			var asset *assets.Asset
+			var err error
+			if input, ok := fetched[srcURL]; ok {
+				input.Options = opts
+				asset, err = t.assetService.ProcessFromData(ctx, input)
+			} else if strings.HasPrefix(srcURL, "data:") {
+				asset, err = t.assetService.ProcessFromDataURI(ctx, srcURL, opts)
+			} else {
+				asset, err = t.assetService.ProcessFromURL(ctx, srcURL, opts)
+			}
+
+			mu.Lock()
+			results[srcURL] = rehostResult{asset: asset, err: err}
+			mu.Unlock()
+		}(srcURL)
+	}
+
+	wg.Wait()
+	return results
 }
 
 // shouldRehostImage determines if an image should be rehosted
@@ -212,7 +544,7 @@ func (t *Transformer) addGmailSafeImageStyles(imgTag string) string {
 }
 
 // sanitizeHTML removes dangerous elements and converts everything to Gmail format
-func (t *Transformer) sanitizeHTML(html string) (string, Stats) {
+func (t *Transformer) sanitizeHTML(html string, allowedClasses []string) (string, Stats) {
 	stats := Stats{}
 
 	// Remove script tags
@@ -231,16 +563,16 @@ func (t *Transformer) sanitizeHTML(html string) (string, Stats) {
 	html = t.convertToGmailFormat(html)
 
 	// Remove dangerous attributes
-	html = t.removeDangerousAttributes(html)
+	html = t.removeDangerousAttributes(html, allowedClasses)
 
 	// Normalize links (including mailto: detection)
-	html = t.normalizeLinks(html)
+	html, stats.LinksCleaned, stats.MailtoLinks = t.normalizeLinks(html)
 
 	return html, stats
 }
 
 // removeDangerousAttributes removes potentially dangerous HTML attributes
-func (t *Transformer) removeDangerousAttributes(html string) string {
+func (t *Transformer) removeDangerousAttributes(html string, allowedClasses []string) string {
 	// Remove onclick and other event handlers
 	eventRegex := regexp.MustCompile(`\s+on\w+="[^"]*"`)
 	html = eventRegex.ReplaceAllString(html, "")
@@ -249,13 +581,19 @@ func (t *Transformer) removeDangerousAttributes(html string) string {
 	jsLinkRegex := regexp.MustCompile(`href="javascript:[^"]*"`)
 	html = jsLinkRegex.ReplaceAllString(html, `href="#"`)
 
-	// Remove classes except gmail_quote (preserve Gmail-specific classes)
+	// Remove classes except allowlisted ones (gmail_* is always allowed)
 	classRegex := regexp.MustCompile(`\s+class="([^"]*)"`)
 	html = classRegex.ReplaceAllStringFunc(html, func(match string) string {
-		if strings.Contains(match, `class="gmail_quote"`) || strings.Contains(match, `class="gmail_`) {
-			return match // Keep Gmail classes
+		var kept []string
+		for _, class := range strings.Fields(classRegex.FindStringSubmatch(match)[1]) {
+			if classAllowed(class, allowedClasses) {
+				kept = append(kept, class)
+			}
 		}
-		return "" // Remove other classes
+		if len(kept) == 0 {
+			return ""
+		}
+		return fmt.Sprintf(` class="%s"`, strings.Join(kept, " "))
 	})
 	
 	// Remove IDs (but be more careful)
@@ -265,22 +603,57 @@ func (t *Transformer) removeDangerousAttributes(html string) string {
 	return html
 }
 
-// normalizeLinks ensures all links are HTTPS and removes tracking
-func (t *Transformer) normalizeLinks(html string) string {
-	linkRegex := regexp.MustCompile(`<a[^>]*href="([^"]+)"[^>]*>`)
-	
-	return linkRegex.ReplaceAllStringFunc(html, func(match string) string {
-		hrefRegex := regexp.MustCompile(`href="([^"]+)"`)
-		hrefMatch := hrefRegex.FindStringSubmatch(match)
-		if len(hrefMatch) != 2 {
-			return match
+// classAllowed reports whether class matches an allowlist entry, entries
+// ending in * match by prefix
+func classAllowed(class string, allowed []string) bool {
+	for _, entry := range allowed {
+		if prefix, ok := strings.CutSuffix(entry, "*"); ok {
+			if strings.HasPrefix(class, prefix) {
+				return true
+			}
+		} else if class == entry {
+			return true
 		}
-		
-		originalURL := hrefMatch[1]
+	}
+	return false
+}
+
+// normalizeLinks ensures all links are HTTPS and removes tracking. It returns
+// the number of web links changed and the number of mailto: links, whether
+// they already were or were bare addresses.
+func (t *Transformer) normalizeLinks(html string) (string, int, int) {
+	// The href of <a> tags only, not of <abbr> or data-href attributes
+	linkRegex := regexp.MustCompile(`<a\s(?:[^>]*\s)?href="([^"]+)"[^>]*>`)
+	cleaned, mailto := 0, 0
+
+	html = linkRegex.ReplaceAllStringFunc(html, func(match string) string {
+		loc := linkRegex.FindStringSubmatchIndex(match)
+		originalURL := match[loc[2]:loc[3]]
 		cleanURL := t.cleanURL(originalURL)
-		
-		return strings.Replace(match, fmt.Sprintf(`href="%s"`, originalURL), fmt.Sprintf(`href="%s"`, cleanURL), 1)
+		switch {
+		case strings.HasPrefix(strings.ToLower(cleanURL), "mailto:"):
+			mailto++
+		case cleanURL != originalURL:
+			cleaned++
+		}
+
+		return match[:loc[2]] + cleanURL + match[loc[3]:]
 	})
+
+	return html, cleaned, mailto
+}
+
+// countWords counts the words in the visible text of html, ignoring tokens
+// that are only punctuation
+func countWords(html string) int {
+	text := regexp.MustCompile(`<[^>]+>`).ReplaceAllString(html, " ")
+	words := 0
+	for _, field := range strings.Fields(stdhtml.UnescapeString(text)) {
+		if strings.IndexFunc(field, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }) != -1 {
+			words++
+		}
+	}
+	return words
 }
 
 // cleanURL removes tracking parameters, ensures HTTPS, and detects email addresses
@@ -349,7 +722,7 @@ func (t *Transformer) convertToGmailFormat(html string) string {
 	divRegex := regexp.MustCompile(`<div[^>]*>(.*?)</div>`)
 	html = divRegex.ReplaceAllStringFunc(html, func(match string) string {
 		// Skip if it's already a Gmail-style div or contains lists/blockquotes
-		if strings.Contains(match, `color: rgb(34, 34, 34)`) || 
+		if strings.Contains(match, gmailStyleFingerprint) ||
 		   strings.Contains(match, `<ol>`) || strings.Contains(match, `<ul>`) || 
 		   strings.Contains(match, `<blockquote`) {
 			return match
@@ -372,8 +745,15 @@ func (t *Transformer) convertToGmailFormat(html string) string {
 
 	// Convert blockquotes to Gmail format
 	blockquoteRegex := regexp.MustCompile(`<blockquote[^>]*>(.*?)</blockquote>`)
-	html = blockquoteRegex.ReplaceAllString(html, 
-		`<blockquote class="gmail_quote" style="color: rgb(34, 34, 34); font-family: Arial, Helvetica, sans-serif; font-size: small; font-style: normal; font-variant-ligatures: normal; font-variant-caps: normal; font-weight: 400; letter-spacing: normal; orphans: 2; text-align: start; text-indent: 0px; text-transform: none; widows: 2; word-spacing: 0px; -webkit-text-stroke-width: 0px; white-space: normal; text-decoration-thickness: initial; text-decoration-style: initial; text-decoration-color: initial; margin: 0px 0px 0px 0.8ex; border-left: 1px solid rgb(204, 204, 204); padding-left: 1ex;">$1</blockquote>`)
+	html = blockquoteRegex.ReplaceAllStringFunc(html, func(match string) string {
+		// Skip blockquotes styled by a previous transform
+		openTag := match[:strings.Index(match, ">")+1]
+		if strings.Contains(openTag, gmailStyleFingerprint) {
+			return match
+		}
+		return blockquoteRegex.ReplaceAllString(match,
+			`<blockquote class="gmail_quote" style="color: rgb(34, 34, 34); font-family: Arial, Helvetica, sans-serif; font-size: small; font-style: normal; font-variant-ligatures: normal; font-variant-caps: normal; font-weight: 400; letter-spacing: normal; orphans: 2; text-align: start; text-indent: 0px; text-transform: none; widows: 2; word-spacing: 0px; -webkit-text-stroke-width: 0px; white-space: normal; text-decoration-thickness: initial; text-decoration-style: initial; text-decoration-color: initial; margin: 0px 0px 0px 0.8ex; border-left: 1px solid rgb(204, 204, 204); padding-left: 1ex;">$1</blockquote>`)
+	})
 
 	// Ensure proper link styling
 	linkRegex := regexp.MustCompile(`<a([^>]*?)>`)
@@ -389,6 +769,96 @@ func (t *Transformer) convertToGmailFormat(html string) string {
 
 
 
+// zeroWidthChars are invisible characters that pasted content picks up from
+// editors. U+200D (zero-width joiner) is deliberately absent since removing it
+// breaks emoji sequences.
+var zeroWidthChars = []string{"\u200B", "\u200C", "\u2060", "\uFEFF"}
+
+var (
+	emptyDivRegex = regexp.MustCompile(`<div[^>]*>\s*</div>`)
+	brRunRegex    = regexp.MustCompile(`(?:<br\s*/?>\s*){3,}`)
+	brRegex       = regexp.MustCompile(`<br\s*/?>`)
+)
+
+// cleanupHTML removes empty divs, bare span wrappers, runs of more than two
+// line breaks and zero-width characters
+func (t *Transformer) cleanupHTML(html string) (string, Stats) {
+	stats := Stats{}
+
+	// Zero-width characters
+	for _, zw := range zeroWidthChars {
+		stats.ZeroWidthCharsRemoved += strings.Count(html, zw)
+		html = strings.ReplaceAll(html, zw, "")
+	}
+
+	// Bare <span> wrappers carry no formatting, keep only their content
+	html, stats.SpansUnwrapped = unwrapBareSpans(html)
+
+	// Collapse <br> runs down to two
+	html = brRunRegex.ReplaceAllStringFunc(html, func(match string) string {
+		stats.LineBreaksRemoved += len(brRegex.FindAllString(match, -1)) - 2
+		return "<br><br>"
+	})
+
+	// Empty divs, repeated so that divs emptied by a previous pass go too
+	for {
+		matches := emptyDivRegex.FindAllString(html, -1)
+		if len(matches) == 0 {
+			break
+		}
+		stats.EmptyElementsRemoved += len(matches)
+		html = emptyDivRegex.ReplaceAllString(html, "")
+	}
+
+	return html, stats
+}
+
+// unwrapBareSpans removes <span> tags that have no attributes, keeping their
+// content. Nested spans are matched by depth so the right closing tag is
+// dropped.
+func unwrapBareSpans(html string) (string, int) {
+	const open = "<span>"
+	const closeTag = "</span>"
+
+	removed := 0
+	for {
+		start := strings.Index(html, open)
+		if start == -1 {
+			return html, removed
+		}
+
+		// Find the matching close tag
+		depth := 1
+		pos := start + len(open)
+		end := -1
+		for depth > 0 {
+			nextOpen := strings.Index(html[pos:], "<span")
+			nextClose := strings.Index(html[pos:], closeTag)
+			if nextClose == -1 {
+				break
+			}
+			if nextOpen != -1 && nextOpen < nextClose {
+				depth++
+				pos += nextOpen + len("<span")
+				continue
+			}
+			depth--
+			if depth == 0 {
+				end = pos + nextClose
+			}
+			pos += nextClose + len(closeTag)
+		}
+
+		if end == -1 {
+			// Unbalanced markup, drop the stray opening tag
+			html = html[:start] + html[start+len(open):]
+		} else {
+			html = html[:start] + html[start+len(open):end] + html[end+len(closeTag):]
+		}
+		removed++
+	}
+}
+
 // convertHeadingsToGmail converts headings to Gmail-compatible divs
 func (t *Transformer) convertHeadingsToGmail(html string) string {
 	const gmailBaseStyle = `color: rgb(34, 34, 34); font-family: Arial, Helvetica, sans-serif; font-style: normal; font-variant-ligatures: normal; font-variant-caps: normal; letter-spacing: normal; orphans: 2; text-align: start; text-indent: 0px; text-transform: none; widows: 2; word-spacing: 0px; -webkit-text-stroke-width: 0px; white-space: normal; text-decoration-thickness: initial; text-decoration-style: initial; text-decoration-color: initial;`
@@ -0,0 +1,403 @@
+package html
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCleanupHTML(t *testing.T) {
+	transformer := &Transformer{}
+
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+		stats    Stats
+	}{
+		{
+			name:     "empty divs",
+			input:    `<div>a</div><div></div><div style="x"> </div>`,
+			expected: `<div>a</div>`,
+			stats:    Stats{EmptyElementsRemoved: 2},
+		},
+		{
+			name:     "nested empty divs",
+			input:    `<div><div></div></div>`,
+			expected: ``,
+			stats:    Stats{EmptyElementsRemoved: 2},
+		},
+		{
+			name:     "blank line div is kept",
+			input:    `<div><br></div>`,
+			expected: `<div><br></div>`,
+		},
+		{
+			name:     "bare spans",
+			input:    `<span>a<span>b</span>c</span><span style="color: red">d</span>`,
+			expected: `abc<span style="color: red">d</span>`,
+			stats:    Stats{SpansUnwrapped: 2},
+		},
+		{
+			name:     "bare span around styled span",
+			input:    `<span><span style="x">a</span></span>`,
+			expected: `<span style="x">a</span>`,
+			stats:    Stats{SpansUnwrapped: 1},
+		},
+		{
+			name:     "br runs",
+			input:    `a<br><br/><br /> <br>b<br><br>c`,
+			expected: `a<br><br>b<br><br>c`,
+			stats:    Stats{LineBreaksRemoved: 2},
+		},
+		{
+			name:     "zero-width characters",
+			input:    "a\u200Bb\uFEFFc",
+			expected: "abc",
+			stats:    Stats{ZeroWidthCharsRemoved: 2},
+		},
+		{
+			name:     "emoji joiner is kept",
+			input:    "👩\u200D💻",
+			expected: "👩\u200D💻",
+		},
+	}
+
+	for _, test := range tests {
+		result, stats := transformer.cleanupHTML(test.input)
+		if result != test.expected {
+			t.Errorf("%s: cleanupHTML(%q) = %q, expected %q", test.name, test.input, result, test.expected)
+		}
+		if stats != test.stats {
+			t.Errorf("%s: cleanupHTML(%q) stats = %+v, expected %+v", test.name, test.input, stats, test.stats)
+		}
+	}
+}
+
+func TestTransformIsIdempotent(t *testing.T) {
+	transformer := NewTransformer(nil, "https://i.format.hackclub.com", FooterConfig{
+		OrgName:        "Hack Club",
+		Address:        "15 Falls Road, Shelburne, VT 05482",
+		UnsubscribeURL: "{{unsubscribe_url}}",
+	}, nil)
+	input := `<h1>Title</h1><p>Hello <a href="http://example.com/?utm_source=x&id=1">link</a></p>` +
+		`<div><div>nested</div><div>divs</div></div><blockquote><blockquote>deep</blockquote></blockquote>` +
+		`<ul><li>item</li></ul><p><br></p>`
+
+	first, err := transformer.Transform(context.Background(), &TransformRequest{HTML: input, Footer: true})
+	if err != nil {
+		t.Fatalf("Transform returned error: %v", err)
+	}
+	if first.AlreadyTransformed {
+		t.Error("fresh input reported as already transformed")
+	}
+
+	second, err := transformer.Transform(context.Background(), &TransformRequest{HTML: first.HTML, Footer: true})
+	if err != nil {
+		t.Fatalf("Transform returned error: %v", err)
+	}
+	if !second.AlreadyTransformed {
+		t.Error("transform output not detected as already transformed")
+	}
+	if second.HTML != first.HTML {
+		t.Errorf("second transform changed output:\nfirst:  %s\nsecond: %s", first.HTML, second.HTML)
+	}
+	if strings.Count(second.HTML, transformedMarker) != 1 {
+		t.Error("transformed marker should appear exactly once")
+	}
+	if strings.Count(second.HTML, footerStartMarker) != 1 {
+		t.Error("footer should appear exactly once")
+	}
+}
+
+func TestFooterURLVariables(t *testing.T) {
+	transformer := NewTransformer(nil, "https://i.format.hackclub.com", FooterConfig{
+		OrgName:        "Hack Club",
+		UnsubscribeURL: "https://hackclub.com/unsubscribe",
+	}, nil)
+	tests := []struct {
+		value string
+		href  string
+	}{
+		{"javascript:alert(document.cookie)", "https://hackclub.com/unsubscribe"},
+		{"JavaScript:alert(1)", "https://hackclub.com/unsubscribe"},
+		{" javascript:alert(1)", "https://hackclub.com/unsubscribe"},
+		{"data:text/html,<script>alert(1)</script>", "https://hackclub.com/unsubscribe"},
+		{"https://example.com/u?id=1&t=2", "https://example.com/u?id=1&amp;t=2"},
+		{"mailto:unsubscribe@hackclub.com", "mailto:unsubscribe@hackclub.com"},
+		{"*|UNSUB|*", "*|UNSUB|*"},
+	}
+	for _, tt := range tests {
+		result, err := transformer.Transform(context.Background(), &TransformRequest{
+			HTML:       "<p>Hi</p>",
+			Footer:     true,
+			FooterVars: map[string]string{"unsubscribe_url": tt.value},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(result.HTML, `href="`+tt.href+`"`) {
+			t.Errorf("unsubscribe_url %q: footer %s, want href %q", tt.value, result.HTML, tt.href)
+		}
+		ignored := tt.href == "https://hackclub.com/unsubscribe"
+		if ignored != (len(result.Messages) == 1) {
+			t.Errorf("unsubscribe_url %q: messages %v", tt.value, result.Messages)
+		}
+	}
+}
+
+func TestHandleQuotes(t *testing.T) {
+	transformer := &Transformer{}
+	thread := `<div>Latest reply</div>` +
+		`<div class="gmail_quote"><div class="gmail_attr">On Mon, Alice wrote:<br></div>` +
+		`<blockquote class="gmail_quote">First reply` +
+		`<div class="gmail_quote"><div class="gmail_attr">On Sun, Bob wrote:<br></div>` +
+		`<blockquote class="gmail_quote">Original</blockquote></div>` +
+		`</blockquote></div>`
+
+	tests := []struct {
+		mode     string
+		levels   int
+		contains []string
+		excludes []string
+		removed  int
+	}{
+		{mode: QuoteModeKeep, contains: []string{"Latest reply", "First reply", "Original"}},
+		{mode: QuoteModeDrop, contains: []string{"Latest reply"}, excludes: []string{"Alice", "First reply", "Original"}, removed: 2},
+		{mode: QuoteModeTrim, levels: 1, contains: []string{"Latest reply", "Alice", "First reply"}, excludes: []string{"Bob", "Original"}, removed: 1},
+		{mode: QuoteModeTrim, levels: 2, contains: []string{"Latest reply", "First reply", "Original"}},
+		{mode: QuoteModeCollapse, contains: []string{"</div>" + quoteDivider + `<div class="gmail_quote">`, "Original"}},
+	}
+
+	for _, test := range tests {
+		result, removed, err := transformer.handleQuotes(thread, test.mode, test.levels)
+		if err != nil {
+			t.Fatalf("handleQuotes(%s, %d) returned error: %v", test.mode, test.levels, err)
+		}
+		for _, s := range test.contains {
+			if !strings.Contains(result, s) {
+				t.Errorf("handleQuotes(%s, %d) = %q, expected it to contain %q", test.mode, test.levels, result, s)
+			}
+		}
+		for _, s := range test.excludes {
+			if strings.Contains(result, s) {
+				t.Errorf("handleQuotes(%s, %d) = %q, expected it not to contain %q", test.mode, test.levels, result, s)
+			}
+		}
+		if removed != test.removed {
+			t.Errorf("handleQuotes(%s, %d) removed %d levels, expected %d", test.mode, test.levels, removed, test.removed)
+		}
+	}
+
+	if _, _, err := transformer.handleQuotes(thread, "bogus", 0); err == nil {
+		t.Error("handleQuotes should reject unknown modes")
+	}
+}
+
+func TestRemoveDangerousAttributesClassAllowlist(t *testing.T) {
+	transformer := &Transformer{}
+	allowed := []string{"gmail_*", "keep-me", "track-*"}
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`<div class="gmail_quote">a</div>`, `<div class="gmail_quote">a</div>`},
+		{`<div class="foo">a</div>`, `<div>a</div>`},
+		{`<div class="foo keep-me track-safe">a</div>`, `<div class="keep-me track-safe">a</div>`},
+		{`<div class="keep-me-not">a</div>`, `<div>a</div>`},
+	}
+
+	for _, test := range tests {
+		result := transformer.removeDangerousAttributes(test.input, allowed)
+		if result != test.expected {
+			t.Errorf("removeDangerousAttributes(%q) = %q, expected %q", test.input, result, test.expected)
+		}
+	}
+}
+
+func TestReverse(t *testing.T) {
+	transformer := NewTransformer(nil, "https://i.format.hackclub.com", FooterConfig{}, nil)
+	input := `<h1>Title</h1><p>Hello <a href="https://example.com/">link</a> and <strong>bold</strong></p>` +
+		`<ul><li>one</li><li>two</li></ul><blockquote><p>quoted</p></blockquote><p><br></p><p>Bye</p>`
+
+	transformed, err := transformer.Transform(context.Background(), &TransformRequest{HTML: input})
+	if err != nil {
+		t.Fatalf("Transform returned error: %v", err)
+	}
+
+	semantic, err := transformer.Reverse(&ReverseRequest{HTML: transformed.HTML})
+	if err != nil {
+		t.Fatalf("Reverse returned error: %v", err)
+	}
+	expectedHTML := `<h1>Title</h1><p>Hello <a href="https://example.com/">link</a> and <strong>bold</strong></p>` +
+		`<ul><li>one</li><li>two</li></ul><blockquote><p>quoted</p></blockquote><p>Bye</p>`
+	if semantic.Content != expectedHTML {
+		t.Errorf("Reverse(html) = %q, expected %q", semantic.Content, expectedHTML)
+	}
+
+	markdown, err := transformer.Reverse(&ReverseRequest{HTML: transformed.HTML, Format: ReverseFormatMarkdown})
+	if err != nil {
+		t.Fatalf("Reverse returned error: %v", err)
+	}
+	expectedMarkdown := "# Title\n\nHello [link](https://example.com/) and **bold**\n\n- one\n- two\n\n> quoted\n\nBye\n"
+	if markdown.Content != expectedMarkdown {
+		t.Errorf("Reverse(markdown) = %q, expected %q", markdown.Content, expectedMarkdown)
+	}
+
+	if _, err := transformer.Reverse(&ReverseRequest{HTML: input, Format: "pdf"}); err == nil {
+		t.Error("Reverse should reject unknown formats")
+	}
+}
+
+func TestExport(t *testing.T) {
+	transformer := NewTransformer(nil, "https://i.format.hackclub.com", FooterConfig{}, nil)
+	pixel := "data:image/png;base64,iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAYAAAAfFcSJAAAADUlEQVR42mNkYPhfDwAChwGA60e6kgAAAABJRU5ErkJggg=="
+
+	message, err := transformer.Export(context.Background(), &ExportRequest{
+		HTML:         `<div>Hello <b>world</b></div><img src="` + pixel + `">`,
+		Subject:      "Hi there",
+		From:         "Orpheus <orpheus@hackclub.com>",
+		To:           "team@hackclub.com",
+		InReplyTo:    "<b@mail.gmail.com>",
+		References:   "<a@mail.gmail.com> <b@mail.gmail.com>",
+		InlineImages: true,
+	})
+	if err != nil {
+		t.Fatalf("Export returned error: %v", err)
+	}
+
+	for _, s := range []string{
+		"From: \"Orpheus\" <orpheus@hackclub.com>\r\n",
+		"Subject: Hi there\r\n",
+		"In-Reply-To: <b@mail.gmail.com>\r\n",
+		"References: <a@mail.gmail.com> <b@mail.gmail.com>\r\n",
+		"Content-Type: multipart/related;",
+		"Content-Type: multipart/alternative;",
+		"Content-Type: text/plain; charset=utf-8",
+		"Content-Type: text/html; charset=utf-8",
+		"Content-Type: image/png",
+		`src=3D"cid:`,
+	} {
+		if !strings.Contains(string(message), s) {
+			t.Errorf("exported message missing %q", s)
+		}
+	}
+
+	if _, err := transformer.Export(context.Background(), &ExportRequest{HTML: "<div>x</div>", To: "not an address"}); err == nil {
+		t.Error("Export should reject invalid addresses")
+	}
+}
+
+func TestExportRejectsHeaderInjection(t *testing.T) {
+	transformer := NewTransformer(nil, "https://i.format.hackclub.com", FooterConfig{}, nil)
+	for _, req := range []*ExportRequest{
+		{HTML: "<div>x</div>", InReplyTo: "<b@mail.gmail.com>\r\nBcc: victim@example.com"},
+		{HTML: "<div>x</div>", References: "<a@mail.gmail.com>\r\n\r\n<script>"},
+		{HTML: "<div>x</div>", References: "<a@mail.gmail.com>\nX-Injected: yes"},
+	} {
+		message, err := transformer.Export(context.Background(), req)
+		if err == nil {
+			t.Errorf("Export accepted %q %q:\n%s", req.InReplyTo, req.References, message)
+		}
+	}
+
+	// The reply headers can't be set by clients
+	var req ExportRequest
+	if err := json.Unmarshal([]byte(`{"html":"x","in_reply_to":"<b@mail.gmail.com>","references":"<a@mail.gmail.com>"}`), &req); err != nil {
+		t.Fatal(err)
+	}
+	if req.InReplyTo != "" || req.References != "" {
+		t.Errorf("decoded reply headers %q %q from JSON", req.InReplyTo, req.References)
+	}
+}
+
+func TestAppendReplyQuote(t *testing.T) {
+	date := time.Date(2024, 3, 5, 14, 7, 0, 0, time.UTC)
+	got := AppendReplyQuote("<div>Sounds good</div>", &QuotedMessage{
+		From: `"Orpheus" <orpheus@hackclub.com>`,
+		Date: date,
+		HTML: `<html><body><div dir="ltr">Can you ship it?</div></body></html>`,
+	})
+	for _, s := range []string{
+		`<div>Sounds good</div><br><div class="gmail_quote">`,
+		`On Tue, Mar 5, 2024 at 2:07 PM Orpheus &lt;orpheus@hackclub.com&gt; wrote:`,
+		`<blockquote class="gmail_quote" style="` + replyQuoteStyle + `"><div dir="ltr">Can you ship it?</div></blockquote></div>`,
+	} {
+		if !strings.Contains(got, s) {
+			t.Errorf("AppendReplyQuote = %s, missing %s", got, s)
+		}
+	}
+	// The quote is recognised as history by the quote modes
+	if findQuoteBoundary(got) != len("<div>Sounds good</div><br>") {
+		t.Errorf("quote boundary = %d", findQuoteBoundary(got))
+	}
+}
+
+func TestTransformStats(t *testing.T) {
+	transformer := NewTransformer(nil, "https://i.format.hackclub.com", FooterConfig{}, nil)
+	input := `<p>Write to <a href="orpheus@hackclub.com">us</a> or see <a href="http://hackclub.com/?utm_source=x">the&nbsp;site</a>.</p>` +
+		`<p><a href="https://hackclub.com/">Already clean</a></p>`
+
+	result, err := transformer.Transform(context.Background(), &TransformRequest{HTML: input})
+	if err != nil {
+		t.Fatalf("Transform returned error: %v", err)
+	}
+
+	if result.Stats.LinksCleaned != 1 {
+		t.Errorf("LinksCleaned = %d, expected 1", result.Stats.LinksCleaned)
+	}
+	if result.Stats.MailtoLinks != 1 {
+		t.Errorf("MailtoLinks = %d, expected 1", result.Stats.MailtoLinks)
+	}
+	if result.Stats.Words != 9 {
+		t.Errorf("Words = %d, expected 9", result.Stats.Words)
+	}
+	if result.Stats.ReadTimeMinutes != 1 {
+		t.Errorf("ReadTimeMinutes = %d, expected 1", result.Stats.ReadTimeMinutes)
+	}
+}
+
+func TestNormalizeLinks(t *testing.T) {
+	transformer := NewTransformer(nil, "https://i.format.hackclub.com", FooterConfig{}, nil)
+	tests := []struct {
+		name            string
+		input, want     string
+		cleaned, mailto int
+	}{
+		{"bare address", `<a href="orpheus@hackclub.com">us</a>`, `<a href="mailto:orpheus@hackclub.com">us</a>`, 0, 1},
+		{"mailto link", `<a href="mailto:orpheus@hackclub.com">us</a>`, `<a href="mailto:orpheus@hackclub.com">us</a>`, 0, 1},
+		{"uppercase scheme", `<a href="MAILTO:orpheus@hackclub.com">us</a>`, `<a href="MAILTO:orpheus@hackclub.com">us</a>`, 0, 1},
+		{"tracked link", `<a class="x" href="http://hackclub.com/?utm_source=x">site</a>`, `<a class="x" href="https://hackclub.com/">site</a>`, 1, 0},
+		{"clean link", `<a href="https://hackclub.com/">site</a>`, `<a href="https://hackclub.com/">site</a>`, 0, 0},
+		{"not a link", `<abbr href="orpheus@hackclub.com">HC</abbr><div data-href="mailto:a@hackclub.com"></div>`, `<abbr href="orpheus@hackclub.com">HC</abbr><div data-href="mailto:a@hackclub.com"></div>`, 0, 0},
+		{"data-href before href", `<a data-href="http://hackclub.com/" href="http://hackclub.com/">site</a>`, `<a data-href="http://hackclub.com/" href="https://hackclub.com/">site</a>`, 1, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, cleaned, mailto := transformer.normalizeLinks(tt.input)
+			if got != tt.want || cleaned != tt.cleaned || mailto != tt.mailto {
+				t.Errorf("normalizeLinks = %s, %d cleaned, %d mailto; want %s, %d, %d", got, cleaned, mailto, tt.want, tt.cleaned, tt.mailto)
+			}
+		})
+	}
+}
+
+func TestIsDocumentLink(t *testing.T) {
+	transformer := &Transformer{cdnHost: "i.format.hackclub.com"}
+	tests := map[string]bool{
+		"https://example.com/deck.PPTX":              true,
+		"https://example.com/files/report.pdf?dl=1":  true,
+		"https://example.com/page.html":              false,
+		"http://example.com/report.pdf":              false,
+		"https://i.format.hackclub.com/ab/cdef.pdf":  false,
+		"mailto:orpheus@hackclub.com?subject=hi.pdf": false,
+	}
+	for href, want := range tests {
+		if got := transformer.isDocumentLink(href); got != want {
+			t.Errorf("isDocumentLink(%q) = %v, want %v", href, got, want)
+		}
+	}
+}
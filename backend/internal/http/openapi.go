@@ -0,0 +1,270 @@
+package http
+
+import (
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/hackclub/format/internal/assets"
+	"github.com/hackclub/format/internal/html"
+	"github.com/hackclub/format/internal/imageproc"
+	"github.com/hackclub/format/internal/openapi"
+	"github.com/hackclub/format/internal/problem"
+	"github.com/hackclub/format/internal/session"
+)
+
+// The responses handlers encode, and requests they decode, that are only
+// shaped for the API
+type (
+	configResponse struct {
+		CDNBaseURL string `json:"cdnBaseUrl"`
+		AuthMode   string `json:"authMode"` // cookie or bearer
+	}
+	providersResponse struct {
+		Providers []providerInfo `json:"providers"`
+	}
+	sessionInfo struct {
+		Provider   string    `json:"provider"`
+		IP         string    `json:"ip"`
+		UserAgent  string    `json:"user_agent"`
+		CreatedAt  time.Time `json:"created_at"`
+		LastSeenAt time.Time `json:"last_seen_at"`
+		Current    bool      `json:"current"`
+	}
+	sessionsResponse struct {
+		Sessions []sessionInfo `json:"sessions"`
+	}
+	jwtResponse struct {
+		Token     string `json:"token"`
+		TokenType string `json:"token_type"`
+		ExpiresIn int64  `json:"expires_in"`
+		ExpiresAt int64  `json:"expires_at"`
+	}
+	uploadRequest struct {
+		URL     string `json:"url,omitempty"`
+		DataURI string `json:"dataUri,omitempty"`
+		imageproc.ProcessOptions
+	}
+	uploadForm struct {
+		File []byte `json:"file"`
+		imageproc.ProcessOptions
+	}
+)
+
+// openAPI describes the API integrators call: signing in, uploading assets
+// and transforming HTML
+func (s *Server) openAPI() *openapi.Document {
+	doc := openapi.New("Format API", "1", "Rehosts images on the CDN and formats HTML for email. Requests are authenticated with the session cookie of a sign-in, a JWT in bearer mode or a service's HMAC signature or JWT.")
+	doc.Servers = []openapi.Server{{URL: s.config.AppBaseURL}}
+	doc.Tags = []openapi.Tag{
+		{Name: "auth", Description: "Signing in and tokens"},
+		{Name: "assets", Description: "Image uploads, rehosted on the CDN"},
+		{Name: "html", Description: "HTML transforms for email"},
+		{Name: "config", Description: "Public configuration"},
+	}
+	doc.Components.SecuritySchemes = map[string]*openapi.SecurityScheme{
+		"session": {Type: "apiKey", In: "cookie", Name: session.SessionName, Description: "Set by signing in at /api/auth/login"},
+		"bearer":  {Type: "http", Scheme: "bearer", BearerFormat: "JWT", Description: "A JWT of POST /api/auth/jwt in bearer mode, or a service's JWT"},
+		"hmac":    {Type: "apiKey", In: "header", Name: "Authorization", Description: "HMAC <service>:<unix time>:<hex HMAC-SHA256 of \"METHOD\\nrequest URI\\nunix time\\nhex SHA-256 of the body\">, each used once"},
+	}
+	signedIn := []map[string][]string{{"session": {}}, {"bearer": {}}, {"hmac": {}}}
+	public := []map[string][]string{}
+
+	// Errors are problem details, see package problem
+	problemSchema := doc.Schema(problem.Problem{})
+	errorResponse := func(description string) *openapi.Response {
+		return &openapi.Response{Description: description, Content: map[string]*openapi.MediaType{problem.ContentType: {Schema: problemSchema}}}
+	}
+	ok := func(v interface{}) map[string]*openapi.Response {
+		return map[string]*openapi.Response{
+			"200": {Description: "OK", Content: doc.JSON(v)},
+			"400": errorResponse("Invalid request"),
+			"401": errorResponse("Not signed in"),
+			"429": errorResponse("Rate limited, retry after Retry-After seconds"),
+		}
+	}
+	jsonBody := func(v interface{}) *openapi.RequestBody {
+		return &openapi.RequestBody{Required: true, Content: doc.JSON(v)}
+	}
+	query := func(name, description string) *openapi.Parameter {
+		return &openapi.Parameter{Name: name, In: "query", Description: description, Schema: &openapi.Schema{Type: "string"}}
+	}
+	assetKey := &openapi.Parameter{Name: "key", In: "path", Required: true, Description: "The asset's key, which may contain slashes", Schema: &openapi.Schema{Type: "string"}}
+
+	// Config
+	doc.Add("GET", "/api/config", &openapi.Operation{
+		Tags: []string{"config"}, OperationID: "getConfig", Security: public,
+		Summary:   "The CDN base URL and how clients authenticate",
+		Responses: ok(configResponse{}),
+	})
+
+	// Auth
+	doc.Add("GET", "/api/auth/providers", &openapi.Operation{
+		Tags: []string{"auth"}, OperationID: "listProviders", Security: public,
+		Summary:   "The providers users can sign in with, the default first",
+		Responses: ok(providersResponse{}),
+	})
+	doc.Add("GET", "/api/auth/login", &openapi.Operation{
+		Tags: []string{"auth"}, OperationID: "login", Security: public,
+		Summary:    "Start signing in, redirecting to the provider",
+		Parameters: []*openapi.Parameter{query("provider", "The provider, the default when missing")},
+		Responses: map[string]*openapi.Response{
+			"307": {Description: "Redirect to the provider, which redirects back to /api/auth/callback/{provider}"},
+			"400": errorResponse("Unknown provider"),
+		},
+	})
+	doc.Add("GET", "/api/auth/me", &openapi.Operation{
+		Tags: []string{"auth"}, OperationID: "getMe", Security: signedIn,
+		Summary:   "The signed-in user",
+		Responses: ok(session.User{}),
+	})
+	doc.Add("GET", "/api/auth/sessions", &openapi.Operation{
+		Tags: []string{"auth"}, OperationID: "listSessions", Security: signedIn,
+		Summary:   "Where the user is signed in",
+		Responses: ok(sessionsResponse{}),
+	})
+	doc.Add("POST", "/api/auth/jwt", &openapi.Operation{
+		Tags: []string{"auth"}, OperationID: "mintJWT", Security: signedIn,
+		Summary:     "Mint a short-lived JWT in bearer mode",
+		Description: "Called with the session cookie after signing in, or with a JWT to refresh it, until the session lifetime since signing in.",
+		Responses:   ok(jwtResponse{}),
+	})
+	doc.Add("POST", "/api/auth/logout", &openapi.Operation{
+		Tags: []string{"auth"}, OperationID: "logout", Security: public,
+		Summary:   "Sign out, forgetting the session's Gmail access",
+		Responses: ok(map[string]string{}),
+	})
+
+	// Assets
+	form := doc.Schema(uploadForm{})
+	doc.Components.Schemas["uploadForm"].Properties["file"] = &openapi.Schema{Type: "string", Format: "binary"}
+	doc.Add("POST", "/api/assets", &openapi.Operation{
+		Tags: []string{"assets"}, OperationID: "uploadAsset", Security: signedIn,
+		Summary:     "Upload an image, or rehost one of a URL or data URI",
+		Description: "Send an Idempotency-Key header to make retries safe. Assets uploaded with a ttl carry an Expires header.",
+		RequestBody: &openapi.RequestBody{Required: true, Content: map[string]*openapi.MediaType{
+			"application/json":    {Schema: doc.Schema(uploadRequest{})},
+			"multipart/form-data": {Schema: form},
+		}},
+		Responses: ok(assets.Asset{}),
+	})
+	doc.Add("POST", "/api/assets/batch", &openapi.Operation{
+		Tags: []string{"assets"}, OperationID: "uploadAssets", Security: signedIn,
+		Summary:     "Rehost up to 20 images at once",
+		Description: "Items are processed concurrently. A failing item gets an error without failing the others.",
+		RequestBody: jsonBody(assets.BatchRequest{}),
+		Responses:   ok(assets.BatchResponse{}),
+	})
+	listResponses := ok(assets.AssetList{})
+	listResponses["403"] = errorResponse("Another user's assets, for users other than admins")
+	doc.Add("GET", "/api/assets", &openapi.Operation{
+		Tags: []string{"assets"}, OperationID: "listAssets", Security: signedIn,
+		Summary:     "Recorded assets, newest first",
+		Description: "Users other than admins only see the assets they uploaded.",
+		Parameters: []*openapi.Parameter{
+			query("uploader", "Only those of an uploader's email, or me. Only admins can list someone else's"),
+			query("namespace", "Only those of a key namespace"),
+			query("since", "Only those uploaded since an RFC 3339 timestamp"),
+			query("cursor", "The next_cursor of the previous page"),
+			{Name: "limit", In: "query", Description: "The page size", Schema: &openapi.Schema{Type: "integer"}},
+		},
+		Responses: listResponses,
+	})
+	doc.Add("GET", "/api/assets/{key}", &openapi.Operation{
+		Tags: []string{"assets"}, OperationID: "getAsset", Security: signedIn,
+		Summary:    "The recorded metadata of an asset",
+		Parameters: []*openapi.Parameter{assetKey},
+		Responses:  ok(assets.StoredAsset{}),
+	})
+	doc.Add("DELETE", "/api/assets/{key}", &openapi.Operation{
+		Tags: []string{"assets"}, OperationID: "deleteAsset", Security: signedIn,
+		Summary:     "Delete an asset the user uploaded, or any as an admin",
+		Description: "Identical uploads share a key: the asset is only deleted once every user who uploaded it has.",
+		Parameters:  []*openapi.Parameter{assetKey},
+		Responses: map[string]*openapi.Response{
+			"204": {Description: "Deleted"},
+			"403": errorResponse("Uploaded by someone else"),
+			"404": errorResponse("No such asset"),
+		},
+	})
+
+	// HTML
+	doc.Add("POST", "/api/html/transform", &openapi.Operation{
+		Tags: []string{"html"}, OperationID: "transformHTML", Security: signedIn,
+		Summary:     "Format HTML for email, rehosting its images",
+		RequestBody: jsonBody(html.TransformRequest{}),
+		Responses:   ok(html.TransformResponse{}),
+	})
+	doc.Add("POST", "/api/html/reverse", &openapi.Operation{
+		Tags: []string{"html"}, OperationID: "reverseHTML", Security: signedIn,
+		Summary:     "Turn formatted HTML back into editable HTML or Markdown",
+		RequestBody: jsonBody(html.ReverseRequest{}),
+		Responses:   ok(html.ReverseResponse{}),
+	})
+	export := ok(nil)
+	export["200"] = &openapi.Response{Description: "The message", Content: map[string]*openapi.MediaType{"message/rfc822": {Schema: &openapi.Schema{Type: "string", Format: "binary"}}}}
+	doc.Add("POST", "/api/html/export", &openapi.Operation{
+		Tags: []string{"html"}, OperationID: "exportHTML", Security: signedIn,
+		Summary:     "Export transformed HTML as an .eml message",
+		RequestBody: jsonBody(html.ExportRequest{}),
+		Responses:   export,
+	})
+
+	return doc
+}
+
+// HandleOpenAPI serves the OpenAPI document of the API
+func (s *Server) HandleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(s.openAPI())
+}
+
+// swaggerUIDir is where the frontend build has Swagger UI's files, the
+// swagger-ui-dist release make swagger-ui copies into its public directory
+const swaggerUIDir = "public/swagger-ui"
+
+// swaggerUI renders /api/openapi.json with the Swagger UI we serve, no
+// third-party script runs on our origin
+const swaggerUI = `<!doctype html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>Format API</title>
+  <link rel="stylesheet" href="/api/docs/swagger-ui/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="/api/docs/swagger-ui/swagger-ui-bundle.js"></script>
+  <script>
+    window.ui = SwaggerUIBundle({ url: "/api/openapi.json", dom_id: "#swagger-ui" });
+  </script>
+</body>
+</html>
+`
+
+// HandleAPIDocs serves Swagger UI of the OpenAPI document, when the build
+// has it
+func (s *Server) HandleAPIDocs(w http.ResponseWriter, r *http.Request) {
+	if _, err := fs.Stat(s.frontend, swaggerUIDir+"/swagger-ui-bundle.js"); err != nil {
+		problem.Error(w, r, "Swagger UI isn't in this build, run make swagger-ui; the spec is at /api/openapi.json", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.Write([]byte(swaggerUI))
+}
+
+// HandleSwaggerUI serves the files of Swagger UI
+func (s *Server) HandleSwaggerUI(w http.ResponseWriter, r *http.Request) {
+	name := path.Base(chi.URLParam(r, "*"))
+	if name != "swagger-ui.css" && name != "swagger-ui-bundle.js" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	http.ServeFileFS(w, r, s.frontend, swaggerUIDir+"/"+name)
+}
@@ -2,10 +2,19 @@ package http
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html/template"
+	"io/fs"
+	"net"
 	"net/http"
+	"net/mail"
+	"net/netip"
 	"net/url"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -14,36 +23,101 @@ import (
 	"github.com/go-chi/cors"
 	"github.com/hackclub/format/internal/assets"
 	"github.com/hackclub/format/internal/auth"
+	"github.com/hackclub/format/internal/campaign"
 	"github.com/hackclub/format/internal/config"
+	"github.com/hackclub/format/internal/db"
+	"github.com/hackclub/format/internal/gc"
+	"github.com/hackclub/format/internal/gmail"
+	"github.com/hackclub/format/internal/health"
 	"github.com/hackclub/format/internal/html"
+	"github.com/hackclub/format/internal/integrity"
+	"github.com/hackclub/format/internal/problem"
+	"github.com/hackclub/format/internal/ratelimit"
 	"github.com/hackclub/format/internal/session"
+	"github.com/hackclub/format/internal/storage"
+	"github.com/hackclub/format/internal/util"
+	"github.com/hackclub/format/internal/web"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog"
+	"golang.org/x/oauth2"
 )
 
 type Server struct {
 	config         *config.Config
 	logger         zerolog.Logger
 	sessionManager *session.Manager
-	oidcProvider   *auth.OIDCProvider
+	providers      *auth.Registry
+	services       *auth.ServiceAuthenticator // nil when service-to-service auth is off
+	bearer         *auth.JWTIssuer // nil unless JWT bearer mode is on
+	gmail          *gmail.Client
+	gmailHandler   *gmail.Handler
+	campaigns      *campaign.Handler
+	watching       bool // whether labeled drafts are formatted on Gmail push notifications
 	assetHandler   *assets.Handler
 	htmlTransformer *html.Transformer
+	collector      *gc.Collector // nil when garbage collection is disabled
+	lifecycle      storage.LifecycleManager // nil when the storage backend has no lifecycle rules
+	auditor        *integrity.Auditor
+	health         *health.Checker
+	frontend       fs.FS // the built frontend, laid out like its directory
+	// Per-user limits of each class of routes, nil when unlimited
+	uploadLimiter    *ratelimit.Limiter
+	transformLimiter *ratelimit.Limiter
+	apiLimiter       *ratelimit.Limiter
+	gmailLimiter     *ratelimit.Limiter
+	authLimiter      *ratelimit.Limiter // per IP, sign-ins are anonymous
+	imageLimiter     *ratelimit.Limiter // per IP, images load in emails
 }
 
 func NewServer(
 	cfg *config.Config,
 	logger zerolog.Logger,
 	sessionManager *session.Manager,
-	oidcProvider *auth.OIDCProvider,
+	providers *auth.Registry,
+	services *auth.ServiceAuthenticator,
+	bearer *auth.JWTIssuer,
+	gmailClient *gmail.Client,
+	watcher *gmail.Watcher,
+	campaigns *campaign.Service,
 	assetHandler *assets.Handler,
 	htmlTransformer *html.Transformer,
+	collector *gc.Collector,
+	lifecycle storage.LifecycleManager,
+	auditor *integrity.Auditor,
+	health *health.Checker,
+	frontend fs.FS,
 ) *Server {
+	newLimiter := func(class string, perMinute, burst int) *ratelimit.Limiter {
+		if perMinute <= 0 {
+			return nil
+		}
+		return ratelimit.NewLimiter(class, perMinute, burst)
+	}
+
 	return &Server{
 		config:         cfg,
 		logger:         logger,
 		sessionManager: sessionManager,
-		oidcProvider:   oidcProvider,
+		providers:      providers,
+		services:       services,
+		bearer:         bearer,
+		gmail:          gmailClient,
+		watching:       watcher != nil,
+		gmailHandler:   gmail.NewHandler(gmailClient, sessionManager, assetHandler.Service(), htmlTransformer, watcher, logger),
+		campaigns:      campaign.NewHandler(campaigns, sessionManager, logger),
 		assetHandler:   assetHandler,
 		htmlTransformer: htmlTransformer,
+		collector:      collector,
+		lifecycle:      lifecycle,
+		auditor:        auditor,
+		health:         health,
+		frontend:       frontend,
+		uploadLimiter:    newLimiter("uploads", cfg.RateLimitUploadsPerMinute, cfg.RateLimitUploadsBurst),
+		transformLimiter: newLimiter("transforms", cfg.RateLimitTransformsPerMinute, cfg.RateLimitTransformsBurst),
+		apiLimiter:       newLimiter("api", cfg.RateLimitAPIPerMinute, cfg.RateLimitAPIBurst),
+		gmailLimiter:     newLimiter("gmail", cfg.RateLimitGmailPerMinute, cfg.RateLimitGmailBurst),
+		authLimiter:      newLimiter("auth", cfg.RateLimitAuthPerMinute, cfg.RateLimitAuthBurst),
+		imageLimiter:     newLimiter("images", cfg.RateLimitImagesPerMinute, cfg.RateLimitImagesBurst),
 	}
 }
 
@@ -61,7 +135,7 @@ func (s *Server) Routes() http.Handler {
 
 	// Middleware
 	r.Use(middleware.RequestID)
-	r.Use(middleware.RealIP)
+	r.Use(s.RealIP)
 	r.Use(s.LoggingMiddleware)
 	r.Use(middleware.Recoverer)
 	r.Use(middleware.Timeout(60 * time.Second))
@@ -77,45 +151,152 @@ func (s *Server) Routes() http.Handler {
 	r.Use(cors.Handler(cors.Options{
 		AllowedOrigins:   allowed,
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
-		ExposedHeaders:   []string{"Link"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token", "Idempotency-Key"},
+		ExposedHeaders:   []string{"Link", "Idempotent-Replayed", "Retry-After", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "RateLimit-Policy"},
 		AllowCredentials: true,
 		MaxAge:           300,
 	}))
 
-	// Health check
+	// Liveness and readiness checks, and Prometheus metrics for scrapers
+	// bearing the metrics token
 	r.Get("/healthz", s.HealthCheck)
+	r.Get("/readyz", s.ReadyCheck)
+	if s.config.MetricsToken != "" {
+		r.With(s.MetricsTokenMiddleware).Handle("/metrics", promhttp.Handler())
+	}
 
 	// Serve Next.js static files and public assets
-	r.Handle("/_next/*", http.StripPrefix("/_next/", http.FileServer(http.Dir("./.next"))))
+	next, _ := fs.Sub(s.frontend, ".next")
+	r.Handle("/_next/*", http.StripPrefix("/_next/", http.FileServerFS(next)))
 	r.Handle("/favicon.svg", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, "./public/favicon.svg")
+		http.ServeFileFS(w, r, s.frontend, "public/favicon.svg")
 	}))
 	
+	// Resized asset delivery (no auth required, used in emails)
+	r.With(s.RateLimit(s.imageLimiter)).Get("/i/*", s.assetHandler.HandleResize)
+	// Image proxy for deployments that don't expose the bucket, with
+	// on-the-fly variants
+	r.With(s.RateLimit(s.imageLimiter)).Get("/img/*", s.assetHandler.HandleImage)
+	// Files of the local storage backend as stored, for development offline
+	if s.config.StorageBackend == storage.BackendLocal {
+		r.Get("/local-assets/*", s.HandleLocalAsset)
+	}
+
+	// Asset aliases (no auth required, used in emails)
+	r.Get("/a/{alias}", s.assetHandler.HandleResolveAlias)
+
+	// CDN log ingestion, authenticated with a bearer token as Logpush can't
+	// sign in
+	if s.config.AnalyticsIngestToken != "" {
+		r.With(s.IngestTokenMiddleware).Post("/api/analytics/logs", s.assetHandler.HandleIngestLogs)
+	}
+
+	// Gmail push notifications, authenticated with the ID token of the
+	// Pub/Sub subscription
+	if s.watching {
+		r.Post("/api/gmail/push", s.gmailHandler.HandlePush)
+	}
+
 	// Public config endpoint (no auth required)
 	r.Get("/api/config", s.HandleConfig)
+
+	// OpenAPI document of the API and Swagger UI to browse it
+	r.Get("/api/openapi.json", s.HandleOpenAPI)
+	r.Get("/api/docs", s.HandleAPIDocs)
+	r.Get("/api/docs/swagger-ui/*", s.HandleSwaggerUI)
 	
 	// Authentication routes (no auth required)
 	r.Route("/api/auth", func(r chi.Router) {
-		r.Get("/login", s.HandleLogin)
-		r.Get("/callback", s.HandleCallback)
+		r.Get("/providers", s.HandleProviders)
+		r.Group(func(r chi.Router) {
+			r.Use(s.RateLimit(s.authLimiter))
+			r.Get("/login", s.HandleLogin)
+			r.Get("/callback", s.HandleCallback)
+			r.Get("/callback/{provider}", s.HandleCallback)
+			r.Post("/callback/{provider}", s.HandleCallback)
+		})
+		r.Get("/saml/metadata", s.HandleSAMLMetadata)
 		r.Post("/logout", s.HandleLogout)
 		r.With(s.AuthMiddleware).Get("/me", s.HandleMe)
+		r.With(s.AuthMiddleware).Get("/sessions", s.HandleSessions)
+		r.With(s.AuthMiddleware).Post("/jwt", s.HandleJWT)
+		r.Get("/jwks.json", s.HandleJWKS)
+		r.With(s.AuthMiddleware).Post("/token", s.gmailHandler.HandleAccessToken)
+		r.With(s.AuthMiddleware).Get("/gmail/grant", s.HandleGmailGrant)
 
 	})
 
 	// Protected API routes
 	r.Route("/api", func(r chi.Router) {
 		r.Use(s.AuthMiddleware)
+		r.Use(s.RateLimit(s.apiLimiter))
 
 		// Assets
-		r.Post("/assets", s.assetHandler.HandleUpload)
-		r.Post("/assets/batch", s.assetHandler.HandleBatch)
+		r.Get("/assets", s.assetHandler.HandleListAssets)
+		r.With(s.assetHandler.Idempotent, s.RateLimit(s.uploadLimiter)).Post("/assets", s.assetHandler.HandleUpload)
+		r.With(s.assetHandler.Idempotent, s.RateLimit(s.uploadLimiter)).Post("/assets/batch", s.assetHandler.HandleBatch)
+		r.With(s.RateLimit(s.uploadLimiter)).Post("/assets/convert", s.assetHandler.HandleConvert)
+		r.With(s.RateLimit(s.uploadLimiter)).Post("/assets/from-page", s.assetHandler.HandleFromPage)
 		// Accept sharded keys like ab/xxxxxxxx.jpg
+		r.Post("/assets/refresh", s.assetHandler.HandleRefreshURLs)
 		r.Get("/assets/*", s.assetHandler.HandleGetAsset)
+		r.With(s.RateLimit(s.uploadLimiter)).Post("/assets/*", s.assetHandler.HandleAssetAction)
+		r.Delete("/assets/*", s.assetHandler.HandleDeleteAsset)
+
+		// Documents linked from emails, stored as they are
+		r.With(s.RateLimit(s.uploadLimiter)).Post("/documents", s.assetHandler.HandleDocument)
+
+		// Aliases
+		r.Get("/aliases/{alias}", s.assetHandler.HandleGetAlias)
+		r.Put("/aliases/{alias}", s.assetHandler.HandleSetAlias)
+		r.Delete("/aliases/{alias}", s.assetHandler.HandleDeleteAlias)
 
 		// HTML transformation
-		r.Post("/html/transform", s.HandleHTMLTransform)
+		r.With(s.RateLimit(s.transformLimiter)).Post("/html/transform", s.HandleHTMLTransform)
+		r.Post("/html/reverse", s.HandleHTMLReverse)
+		r.With(s.RateLimit(s.transformLimiter)).Post("/html/export", s.HandleHTMLExport)
+
+		// Gmail, with the token kept for the session
+		readonly, compose := s.gmailHandler.RequireToken(gmail.ScopeReadonly), s.gmailHandler.RequireToken(gmail.ScopeCompose)
+		r.Group(func(r chi.Router) {
+			r.Use(s.RateLimit(s.gmailLimiter))
+			r.Get("/gmail/status", s.gmailHandler.HandleStatus)
+			r.With(readonly).Get("/gmail/attachment", s.gmailHandler.HandleAttachment)
+			r.With(s.RateLimit(s.uploadLimiter), readonly).Post("/gmail/attachments", s.gmailHandler.HandleRehostAttachment)
+			r.With(readonly).Get("/gmail/drafts", s.gmailHandler.HandleListDrafts)
+			r.With(compose).Post("/gmail/drafts", s.gmailHandler.HandleCreateDraft)
+			r.With(s.gmailHandler.RequireToken(gmail.ScopeInsert)).Post("/gmail/drafts/import", s.gmailHandler.HandleImportDraft)
+			r.With(s.gmailHandler.RequireToken(gmail.ScopeContacts)).Get("/gmail/contacts", s.gmailHandler.HandleContacts)
+			r.With(readonly).Get("/gmail/signature", s.gmailHandler.HandleSignatures)
+			r.With(s.gmailHandler.RequireToken(gmail.ScopeSettings)).Put("/gmail/signature", s.gmailHandler.HandleSetSignature)
+			if s.watching {
+				r.Get("/gmail/watch", s.gmailHandler.HandleWatchStatus)
+				r.With(compose).Post("/gmail/watch", s.gmailHandler.HandleStartWatch)
+				r.Delete("/gmail/watch", s.gmailHandler.HandleStopWatch)
+			}
+		})
+
+		// Mail merges, sent from the user's mailbox
+		r.Get("/campaigns", s.campaigns.HandleList)
+		r.With(s.RateLimit(s.uploadLimiter)).Post("/campaigns", s.campaigns.HandleCreate)
+		r.Get("/campaigns/{id}", s.campaigns.HandleGet)
+		r.Put("/campaigns/{id}", s.campaigns.HandleUpdate)
+		r.Delete("/campaigns/{id}", s.campaigns.HandleDelete)
+		r.Get("/campaigns/{id}/preview", s.campaigns.HandlePreview)
+		r.Get("/campaigns/{id}/recipients", s.campaigns.HandleRecipients)
+		r.With(compose).Post("/campaigns/{id}/send", s.campaigns.HandleSend)
+		r.Post("/campaigns/{id}/pause", s.campaigns.HandlePause)
+
+		// Admin
+		r.With(s.AdminMiddleware).Post("/admin/gc", s.HandleGC)
+		r.With(s.AdminMiddleware).Get("/admin/audit", s.assetHandler.HandleAuditLog)
+		r.With(s.AdminMiddleware).Post("/admin/assets/delete", s.assetHandler.HandleBulkDelete)
+		r.With(s.AdminMiddleware).Get("/admin/lifecycle", s.HandleGetLifecycle)
+		r.With(s.AdminMiddleware).Put("/admin/lifecycle", s.HandleSetLifecycle)
+		r.With(s.AdminMiddleware).Post("/admin/integrity", s.HandleIntegrityAudit)
+		r.With(s.AdminMiddleware).Post("/admin/impersonate", s.HandleImpersonate)
+		r.With(s.AdminMiddleware).Delete("/admin/impersonate", s.HandleStopImpersonating)
+		r.With(s.AdminMiddleware).Get("/admin/auth-events", s.HandleAuthEvents)
 
 		
 	})
@@ -126,6 +307,62 @@ func (s *Server) Routes() http.Handler {
 	return r
 }
 
+// RealIP sets RemoteAddr to the client's IP from X-Forwarded-For or
+// X-Real-IP, but only for requests from TRUSTED_PROXIES. Anyone else could
+// pick the address they're rate limited and logged under.
+func (s *Server) RealIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ip := s.forwardedIP(r); ip.IsValid() {
+			r.RemoteAddr = ip.String()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// forwardedIP is the client a trusted proxy forwarded r for. The nearest
+// address of X-Forwarded-For that isn't a proxy is the first one the
+// client couldn't have written.
+func (s *Server) forwardedIP(r *http.Request) netip.Addr {
+	peer, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil || !s.trustedProxy(peer.Addr()) {
+		return netip.Addr{}
+	}
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			return netip.Addr{}
+		}
+		if ip = ip.Unmap(); !s.trustedProxy(ip) || i == 0 {
+			return ip
+		}
+	}
+	ip, _ := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP")))
+	return ip.Unmap()
+}
+
+func (s *Server) trustedProxy(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	for _, prefix := range s.config.TrustedProxies {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the IP of the client, RealIP has already applied any
+// X-Forwarded-For/X-Real-IP from a trusted proxy
+func clientIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
 func contains(s []string, v string) bool {
 	for _, x := range s {
 		if x == v {
@@ -159,20 +396,136 @@ func (s *Server) LoggingMiddleware(next http.Handler) http.Handler {
 func (s *Server) AuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		user, err := s.sessionManager.GetUser(r)
+		if err == nil && user != nil {
+			if err := s.sessionManager.Seen(r); err != nil {
+				s.logger.Warn().Err(err).Msg("failed to record session activity")
+			}
+		}
+		var authTime time.Time
+		if (err != nil || user == nil) && s.bearer != nil && strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+			// JWTs we minted in bearer mode, those of other issuers are
+			// left to the service authenticator
+			identity, signedIn, bearerErr := s.bearer.Verify(r.Context(), strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+			if bearerErr == nil {
+				user, err, authTime = &session.User{
+					Sub:      identity.Sub,
+					Email:    identity.Email,
+					Name:     identity.Name,
+					Picture:  identity.Picture,
+					HD:       identity.HD,
+					Provider: identity.Provider,
+				}, nil, signedIn
+			} else if !errors.Is(bearerErr, auth.ErrForeignToken) {
+				s.logger.Debug().Err(bearerErr).Msg("bearer token rejected")
+			}
+		}
+		if (err != nil || user == nil) && s.services != nil {
+			// Other services authenticate each request instead
+			identity, serviceErr := s.services.Authenticate(r)
+			if serviceErr == nil {
+				user, err = &session.User{
+					Sub:      identity.Sub,
+					Email:    identity.Email,
+					Name:     identity.Name,
+					Provider: identity.Provider,
+				}, nil
+			} else if !errors.Is(serviceErr, auth.ErrNoServiceCredentials) {
+				s.logger.Warn().Err(serviceErr).Str("ip", clientIP(r)).Msg("service authentication failed")
+			}
+		}
 		if err != nil || user == nil {
 			s.logger.Debug().Err(err).Msg("authentication failed")
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			problem.Error(w, r, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
 
-		// Add user to request context
+		// Add user and client to request context, uploads are audited
 		ctx := context.WithValue(r.Context(), "user", user)
+		if admin, _ := s.sessionManager.Impersonator(r); admin != nil && authTime.IsZero() {
+			// Everything an admin does as someone else is logged
+			s.logger.Warn().
+				Str("admin", admin.Email).
+				Str("impersonating", user.Email).
+				Str("method", r.Method).
+				Str("path", r.URL.Path).
+				Msg("impersonated request")
+			ctx = context.WithValue(ctx, "impersonator", admin)
+		}
+		ctx = context.WithValue(ctx, "client_ip", clientIP(r))
+		ctx = context.WithValue(ctx, "user_agent", r.UserAgent())
+		if !authTime.IsZero() {
+			ctx = context.WithValue(ctx, "auth_time", authTime)
+		}
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
+// AdminMiddleware only lets ADMIN_EMAILS through, after AuthMiddleware.
+// An admin impersonating a user is still one; a service never is.
+func (s *Server) AdminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := r.Context().Value("user").(*session.User)
+		if !ok {
+			problem.Error(w, r, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if admin, ok := r.Context().Value("impersonator").(*session.User); ok {
+			user = admin
+		}
+		if user.Provider != auth.ProviderService && s.isAdmin(user.Email) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		problem.Error(w, r, "Forbidden", http.StatusForbidden)
+	})
+}
+
+func (s *Server) isAdmin(email string) bool {
+	for _, admin := range s.config.AdminEmails {
+		if strings.EqualFold(admin, email) {
+			return true
+		}
+	}
+	return false
+}
+
+// RateLimit limits requests per client with limiter, or not at all if it's
+// nil
+func (s *Server) RateLimit(limiter *ratelimit.Limiter) func(http.Handler) http.Handler {
+	if limiter == nil {
+		return func(next http.Handler) http.Handler { return next }
+	}
+	return limiter.Middleware
+}
+
+// IngestTokenMiddleware only lets through requests bearing the analytics
+// ingest token
+func (s *Server) IngestTokenMiddleware(next http.Handler) http.Handler {
+	return requireToken(s.config.AnalyticsIngestToken, next)
+}
+
+// MetricsTokenMiddleware only lets through requests bearing the metrics
+// token
+func (s *Server) MetricsTokenMiddleware(next http.Handler) http.Handler {
+	return requireToken(s.config.MetricsToken, next)
+}
+
+// requireToken only lets through requests to next bearing token
+func requireToken(expected string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+			problem.Error(w, r, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 // Handlers
 
+// HealthCheck reports that the server is up. It doesn't check
+// dependencies, so an outage of one doesn't get the container restarted.
 func (s *Server) HealthCheck(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{
@@ -182,133 +535,490 @@ func (s *Server) HealthCheck(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// ReadyCheck reports the status of the server and of each dependency, with
+// a 503 when a required one is unreachable. Optional ones like Redis only
+// degrade the status.
+func (s *Server) ReadyCheck(w http.ResponseWriter, r *http.Request) {
+	report := s.health.Run(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+	if report.Status == health.StatusError {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":    report.Status,
+		"timestamp": time.Now().Format(time.RFC3339),
+		"version":   "1.0.0",
+		"checks":    report.Checks,
+	})
+}
+
+// HandleLocalAsset serves a file of the local storage backend as it was
+// stored, so HTML transformed with R2_PUBLIC_BASE_URL=<backend>/local-assets
+// renders without a bucket. Only asset keys are served, never originals.
+func (s *Server) HandleLocalAsset(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "*")
+	if !util.IsAssetKey(key) {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	http.ServeFile(w, r, filepath.Join(s.config.LocalStorageDir, filepath.FromSlash(key)))
+}
+
 func (s *Server) HandleConfig(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"cdnBaseUrl": s.config.R2PublicBaseURL,
+	authMode := "cookie"
+	if s.bearer != nil {
+		authMode = "bearer"
+	}
+	json.NewEncoder(w).Encode(configResponse{
+		CDNBaseURL: s.config.R2PublicBaseURL,
+		AuthMode:   authMode,
 	})
 }
 
 
+// providerInfo describes a sign-in option for the login screen
+type providerInfo struct {
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name"`
+	LoginURL    string `json:"login_url"`
+}
+
+// HandleProviders lists the providers users can sign in with, the default
+// first
+func (s *Server) HandleProviders(w http.ResponseWriter, r *http.Request) {
+	providers := []providerInfo{}
+	for _, p := range s.providers.List() {
+		providers = append(providers, providerInfo{
+			Name:        p.Name(),
+			DisplayName: p.DisplayName(),
+			LoginURL:    "/api/auth/login?provider=" + url.QueryEscape(p.Name()),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(providersResponse{Providers: providers})
+}
+
+// HandleLogin starts signing in with ?provider=, the default provider when
+// it's missing
 func (s *Server) HandleLogin(w http.ResponseWriter, r *http.Request) {
+	provider, ok := s.providers.Get(r.URL.Query().Get("provider"))
+	if !ok {
+		problem.Error(w, r, "Unknown or disabled provider", http.StatusBadRequest)
+		return
+	}
+
+	state, challenge, ok := s.startOAuth(w, r, provider.Name())
+	if !ok {
+		return
+	}
+	authURL := provider.GetAuthURL(state, challenge)
+	http.Redirect(w, r, authURL, http.StatusTemporaryRedirect)
+}
+
+// gmailGrantFlow is stored as the provider of a Gmail grant, which comes
+// back through Google's callback. gmailComposeGrantFlow also asks for
+// drafts, gmailSettingsGrantFlow for signatures, gmailContactsGrantFlow for
+// contacts, gmailInsertGrantFlow for importing messages.
+const (
+	gmailGrantFlow         = auth.ProviderGoogle + ":gmail"
+	gmailComposeGrantFlow  = gmailGrantFlow + ":compose"
+	gmailSettingsGrantFlow = gmailGrantFlow + ":settings"
+	gmailContactsGrantFlow = gmailGrantFlow + ":contacts"
+	gmailInsertGrantFlow   = gmailGrantFlow + ":insert"
+)
+
+// gmailGrantScopes is the scope each grant flow must come back with
+var gmailGrantScopes = map[string]string{
+	gmailGrantFlow:         auth.GmailReadonlyScope,
+	gmailComposeGrantFlow:  auth.GmailComposeScope,
+	gmailSettingsGrantFlow: auth.GmailSettingsScope,
+	gmailContactsGrantFlow: auth.OtherContactsScope,
+	gmailInsertGrantFlow:   auth.GmailInsertScope,
+}
+
+// HandleGmailGrant asks a user signed in with Google for Gmail access, the
+// first time a Gmail feature needs it. With ?scope=compose it also asks to
+// create drafts, with ?scope=settings to set signatures, with
+// ?scope=contacts to suggest recipients, with ?scope=insert to import
+// drafts.
+func (s *Server) HandleGmailGrant(w http.ResponseWriter, r *http.Request) {
+	user, _ := r.Context().Value("user").(*session.User)
+	if user == nil || (user.Provider != "" && user.Provider != auth.ProviderGoogle) {
+		problem.Error(w, r, "Gmail access needs a Google sign-in", http.StatusBadRequest)
+		return
+	}
+	provider, ok := s.providers.Get(auth.ProviderGoogle)
+	google, isGoogle := provider.(*auth.OIDCProvider)
+	if !ok || !isGoogle {
+		problem.Error(w, r, "Google sign-in is disabled", http.StatusNotFound)
+		return
+	}
+
+	flow, scopes := gmailGrantFlow, []string{auth.GmailReadonlyScope}
+	switch r.URL.Query().Get("scope") {
+	case "", gmail.ScopeReadonly:
+	case gmail.ScopeCompose:
+		flow, scopes = gmailComposeGrantFlow, append(scopes, auth.GmailComposeScope)
+	case gmail.ScopeSettings:
+		flow, scopes = gmailSettingsGrantFlow, append(scopes, auth.GmailSettingsScope)
+	case gmail.ScopeContacts:
+		flow, scopes = gmailContactsGrantFlow, append(scopes, auth.ContactsScope, auth.OtherContactsScope)
+	case gmail.ScopeInsert:
+		flow, scopes = gmailInsertGrantFlow, append(scopes, auth.GmailInsertScope)
+	default:
+		problem.Error(w, r, "Unknown scope, expected readonly, compose, settings, contacts or insert", http.StatusBadRequest)
+		return
+	}
+
+	state, challenge, ok := s.startOAuth(w, r, flow)
+	if !ok {
+		return
+	}
+	http.Redirect(w, r, google.GetGrantURL(state, challenge, user.Email, scopes...), http.StatusTemporaryRedirect)
+}
+
+// startOAuth generates and stores the state and PKCE verifier of an
+// authorization request for flow, a provider name or gmailGrantFlow
+func (s *Server) startOAuth(w http.ResponseWriter, r *http.Request, flow string) (state, challenge string, ok bool) {
 	// Generate state + PKCE
-	state := auth.GenerateState()
+	state = auth.GenerateState()
 	verifier := auth.GeneratePKCEVerifier()
-	challenge := auth.PKCEChallengeS256(verifier)
+	challenge = auth.PKCEChallengeS256(verifier)
 
 	// Persist in session
 	if err := s.sessionManager.SetOAuthState(w, r, state); err != nil {
 		s.logger.Error().Err(err).Msg("failed to store oauth state")
-		http.Error(w, "Server error", http.StatusInternalServerError)
-		return
+		problem.Error(w, r, "Server error", http.StatusInternalServerError)
+		return "", "", false
 	}
 	if err := s.sessionManager.SetOAuthCodeVerifier(w, r, verifier); err != nil {
 		s.logger.Error().Err(err).Msg("failed to store oauth code verifier")
-		http.Error(w, "Server error", http.StatusInternalServerError)
-		return
+		problem.Error(w, r, "Server error", http.StatusInternalServerError)
+		return "", "", false
 	}
-
-	authURL := s.oidcProvider.GetAuthURL(state, challenge)
-	http.Redirect(w, r, authURL, http.StatusTemporaryRedirect)
+	if err := s.sessionManager.SetOAuthProvider(w, r, flow); err != nil {
+		s.logger.Error().Err(err).Msg("failed to store oauth provider")
+		problem.Error(w, r, "Server error", http.StatusInternalServerError)
+		return "", "", false
+	}
+	return state, challenge, true
 }
 
+// HandleCallback finishes signing in with the provider of the route,
+// Google's for /api/auth/callback
 func (s *Server) HandleCallback(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
+	name := chi.URLParam(r, "provider")
+	if name == "" {
+		name = auth.ProviderGoogle
+	}
+	provider, ok := s.providers.Get(name)
+	if !ok {
+		problem.Error(w, r, "Unknown or disabled provider", http.StatusNotFound)
+		return
+	}
+
+	// SAML identity providers post their response and the state instead
+	stateParam, code := r.URL.Query().Get("state"), r.URL.Query().Get("code")
+	if r.Method == http.MethodPost {
+		r.Body = http.MaxBytesReader(w, r.Body, 1<<20)
+		if _, err := r.Cookie(session.SessionName); err != nil {
+			// A cross-site POST doesn't carry the SameSite=Lax session
+			// cookie, posting it again from our own origin does
+			if r.PostFormValue("resubmitted") != "" {
+				problem.Error(w, r, "Session cookie missing, allow cookies and sign in again", http.StatusBadRequest)
+				return
+			}
+			s.resubmitCallback(w, r)
+			return
+		}
+		stateParam, code = r.PostFormValue("RelayState"), r.PostFormValue("SAMLResponse")
+	}
+
 	// Validate state
-	stateParam := r.URL.Query().Get("state")
 	if stateParam == "" {
-		http.Error(w, "Missing state", http.StatusBadRequest)
+		problem.Error(w, r, "Missing state", http.StatusBadRequest)
 		return
 	}
 	expectedState, err := s.sessionManager.GetAndClearOAuthState(w, r)
 	if err != nil || expectedState == "" || expectedState != stateParam {
 		s.logger.Error().Err(err).Msg("invalid oauth state")
-		http.Error(w, "Invalid state", http.StatusBadRequest)
+		problem.Error(w, r, "Invalid state", http.StatusBadRequest)
 		return
 	}
 
 	verifier, err := s.sessionManager.GetAndClearOAuthCodeVerifier(w, r)
 	if err != nil || verifier == "" {
 		s.logger.Error().Err(err).Msg("missing code verifier")
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+		problem.Error(w, r, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	// The login must have been started with this provider
+	started, _ := s.sessionManager.GetAndClearOAuthProvider(w, r)
+	_, granting := gmailGrantScopes[started]
+	granting = granting && provider.Name() == auth.ProviderGoogle
+	if started != provider.Name() && !granting {
+		s.logger.Error().Str("started", started).Str("callback", provider.Name()).Msg("oauth provider mismatch")
+		problem.Error(w, r, "Invalid request", http.StatusBadRequest)
 		return
 	}
 
 	// Exchange code
-	code := r.URL.Query().Get("code")
 	if code == "" {
 		s.logger.Error().Msg("no authorization code received")
-		http.Error(w, "Authorization failed", http.StatusBadRequest)
+		problem.Error(w, r, "Authorization failed", http.StatusBadRequest)
 		return
 	}
-	token, err := s.oidcProvider.ExchangeCode(ctx, code, verifier)
-	if err != nil {
-		s.logger.Error().Err(err).Msg("failed to exchange code for token")
-		http.Error(w, "Authorization failed", http.StatusInternalServerError)
+	identity, token, err := provider.Authenticate(ctx, code, verifier)
+	if errors.Is(err, auth.ErrNotAllowed) {
+		var denied *auth.NotAllowedError
+		email, detail := "", err.Error()
+		if errors.As(err, &denied) {
+			email, detail = denied.Email, denied.Reason
+		}
+		s.logger.Error().Err(err).Str("provider", provider.Name()).Str("email", email).Msg("sign-in rejected")
+		s.authEvent(r, db.AuthEventDenied, email, provider.Name(), detail)
+		problem.Error(w, r, "Authorization failed - not allowed or invalid token", http.StatusForbidden)
 		return
 	}
-
-	// Verify ID token
-	rawIDToken, ok := token.Extra("id_token").(string)
-	if !ok {
-		s.logger.Error().Msg("no id_token in response")
-		http.Error(w, "Authorization failed", http.StatusInternalServerError)
+	if err != nil {
+		s.logger.Error().Err(err).Str("provider", provider.Name()).Msg("failed to authenticate")
+		problem.Error(w, r, "Authorization failed", http.StatusInternalServerError)
 		return
 	}
 
-	claims, err := s.oidcProvider.VerifyIDToken(ctx, rawIDToken)
-	if err != nil {
-		s.logger.Error().Err(err).Msg("failed to verify ID token")
-		http.Error(w, "Authorization failed - domain not allowed or invalid token", http.StatusForbidden)
+	if granting {
+		s.finishGmailGrant(w, r, identity, token, gmailGrantScopes[started])
 		return
 	}
 
 	// Create user session
 	user := &session.User{
-		Sub:     claims.Sub,
-		Email:   claims.Email,
-		Name:    claims.Name,
-		Picture: claims.Picture,
-		HD:      claims.HD,
+		Sub:      identity.Sub,
+		Email:    identity.Email,
+		Name:     identity.Name,
+		Picture:  identity.Picture,
+		HD:       identity.HD,
+		Provider: identity.Provider,
 	}
 
 	// Create user session (essential for authentication)
 	err = s.sessionManager.SetUser(w, r, user)
 	if err != nil {
 		s.logger.Error().Err(err).Msg("failed to set user session")
-		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		problem.Error(w, r, "Failed to create session", http.StatusInternalServerError)
 		return
 	}
 
-	s.logger.Info().Str("email", user.Email).Str("domain", user.HD).Msg("user logged in")
+	s.logger.Info().Str("email", user.Email).Str("provider", identity.Provider).Str("group", identity.Group).Msg("user logged in")
+	detail := ""
+	if identity.Allowlisted {
+		s.logger.Info().Str("email", user.Email).Str("hd", identity.HD).Msg("allowlisted email signed in")
+		detail = "allowlisted email"
+	}
+	s.authEvent(r, db.AuthEventLogin, user.Email, identity.Provider, detail)
 
-	// Also pass OAuth tokens to frontend via URL fragment for Gmail API access
-	expiresIn := int64(3600) // Default fallback
-	if !token.Expiry.IsZero() {
-		expiresIn = int64(time.Until(token.Expiry).Seconds())
-		if expiresIn <= 0 {
-			expiresIn = 0 // Token already expired
-		}
+	// Only Google tokens give Gmail access, when it was granted before
+	if identity.Provider != auth.ProviderGoogle || token == nil || !auth.HasScope(token, auth.GmailReadonlyScope) {
+		http.Redirect(w, r, s.config.AppBaseURL, http.StatusTemporaryRedirect)
+		return
 	}
-	
-	redirectURL := fmt.Sprintf("%s#access_token=%s&expires_in=%d", 
-		s.config.AppBaseURL, 
-		token.AccessToken,
-		expiresIn)
-	
-	if token.RefreshToken != "" {
-		redirectURL += "&refresh_token=" + token.RefreshToken
+
+	// Keep the tokens server-side, Gmail is called through the backend so
+	// they never reach the browser
+	if err := s.gmail.Tokens().Save(ctx, s.sessionManager.SessionID(r), user.Email, token); err != nil {
+		// Signing in still works, Gmail features report not connected
+		s.logger.Error().Err(err).Str("email", user.Email).Msg("failed to store oauth token")
 	}
-	
-	http.Redirect(w, r, redirectURL, http.StatusTemporaryRedirect)
+	http.Redirect(w, r, s.config.AppBaseURL, http.StatusTemporaryRedirect)
+}
+
+// resubmitPage posts a SAML response back to the callback from our own
+// origin, so the session cookie comes along
+var resubmitPage = template.Must(template.New("resubmit").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Signing in…</title></head>
+<body>
+<form method="post" action="{{.Action}}">
+<input type="hidden" name="SAMLResponse" value="{{.SAMLResponse}}">
+<input type="hidden" name="RelayState" value="{{.RelayState}}">
+<input type="hidden" name="resubmitted" value="1">
+<noscript><button type="submit">Continue signing in</button></noscript>
+</form>
+<script>document.forms[0].submit()</script>
+</body></html>
+`))
+
+func (s *Server) resubmitCallback(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := resubmitPage.Execute(w, map[string]string{
+		"Action":       r.URL.Path,
+		"SAMLResponse": r.PostFormValue("SAMLResponse"),
+		"RelayState":   r.PostFormValue("RelayState"),
+	}); err != nil {
+		s.logger.Error().Err(err).Msg("failed to render callback resubmit page")
+	}
+}
+
+// HandleSAMLMetadata serves our service provider metadata, which the SAML
+// identity provider is configured with
+func (s *Server) HandleSAMLMetadata(w http.ResponseWriter, r *http.Request) {
+	provider, _ := s.providers.Get(auth.ProviderSAML)
+	samlProvider, ok := provider.(*auth.SAMLProvider)
+	if !ok {
+		problem.Error(w, r, "SAML sign-in is disabled", http.StatusNotFound)
+		return
+	}
+	metadata, err := samlProvider.Metadata()
+	if err != nil {
+		s.logger.Error().Err(err).Msg("failed to render SAML metadata")
+		problem.Error(w, r, "Server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	w.Write(metadata)
+}
+
+// finishGmailGrant stores the token of a Gmail grant of scope for the
+// session of the user who asked for it
+func (s *Server) finishGmailGrant(w http.ResponseWriter, r *http.Request, identity *auth.Identity, token *oauth2.Token, scope string) {
+	user, err := s.sessionManager.GetUser(r)
+	if err != nil || user == nil || user.Sub != identity.Sub {
+		s.logger.Error().Err(err).Str("email", identity.Email).Msg("gmail granted for another account than the session's")
+		problem.Error(w, r, "Gmail access must be granted by the signed-in account", http.StatusForbidden)
+		return
+	}
+	if !auth.HasScope(token, scope) {
+		s.logger.Info().Str("email", user.Email).Str("scope", scope).Msg("gmail access declined")
+		http.Redirect(w, r, s.config.AppBaseURL+"/?gmail=declined", http.StatusTemporaryRedirect)
+		return
+	}
+	if err := s.gmail.Tokens().Save(r.Context(), s.sessionManager.SessionID(r), user.Email, token); err != nil {
+		s.logger.Error().Err(err).Str("email", user.Email).Msg("failed to store oauth token")
+		problem.Error(w, r, "Failed to store Gmail access", http.StatusInternalServerError)
+		return
+	}
+	s.logger.Info().Str("email", user.Email).Str("scope", scope).Msg("gmail access granted")
+	http.Redirect(w, r, s.config.AppBaseURL+"/?gmail=granted", http.StatusTemporaryRedirect)
+}
+
+// HandleSessions lists where the user is signed in
+func (s *Server) HandleSessions(w http.ResponseWriter, r *http.Request) {
+	user, ok := r.Context().Value("user").(*session.User)
+	if !ok {
+		problem.Error(w, r, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	sessions, err := s.sessionManager.Sessions(r.Context(), user.Email)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("failed to list sessions")
+		problem.Error(w, r, "Failed to list sessions", http.StatusInternalServerError)
+		return
+	}
+
+	// Session IDs key server-side state, they're not sent back
+	current := s.sessionManager.SessionID(r)
+	list := make([]sessionInfo, 0, len(sessions))
+	for _, sess := range sessions {
+		list = append(list, sessionInfo{
+			Provider:   sess.Provider,
+			IP:         sess.IP,
+			UserAgent:  sess.UserAgent,
+			CreatedAt:  sess.CreatedAt,
+			LastSeenAt: sess.LastSeenAt,
+			Current:    sess.ID == current,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessionsResponse{Sessions: list})
+}
+
+// HandleJWT mints a short-lived JWT in bearer mode, for a user signed in
+// with the session cookie or refreshing a JWT, until the session lifetime
+// since they signed in
+func (s *Server) HandleJWT(w http.ResponseWriter, r *http.Request) {
+	if s.bearer == nil {
+		problem.Error(w, r, "JWT bearer mode is disabled", http.StatusNotFound)
+		return
+	}
+	user, ok := r.Context().Value("user").(*session.User)
+	if !ok {
+		problem.Error(w, r, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if user.Provider == auth.ProviderService {
+		problem.Error(w, r, "Services authenticate every request", http.StatusForbidden)
+		return
+	}
+	if r.Context().Value("impersonator") != nil {
+		// Impersonation is kept to the session, where it expires
+		problem.Error(w, r, "Stop impersonating to use bearer mode", http.StatusForbidden)
+		return
+	}
+	authTime, refreshing := r.Context().Value("auth_time").(time.Time)
+	if !refreshing {
+		authTime = time.Now()
+	}
+	if time.Since(authTime) > s.sessionManager.MaxAge() {
+		s.authEvent(r, db.AuthEventTokenRefresh, user.Email, user.Provider, "jwt refused: session expired")
+		problem.Error(w, r, "Session expired, sign in again", http.StatusUnauthorized)
+		return
+	}
+
+	token, expiry, err := s.bearer.Mint(&auth.Identity{
+		Provider: user.Provider,
+		Sub:      user.Sub,
+		Email:    user.Email,
+		Name:     user.Name,
+		Picture:  user.Picture,
+		HD:       user.HD,
+	}, authTime)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("failed to mint jwt")
+		problem.Error(w, r, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if refreshing {
+		s.authEvent(r, db.AuthEventTokenRefresh, user.Email, user.Provider, "jwt")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(jwtResponse{
+		Token:     token,
+		TokenType: "Bearer",
+		ExpiresIn: int64(time.Until(expiry).Seconds()),
+		ExpiresAt: expiry.Unix(),
+	})
+}
+
+// HandleJWKS publishes the keys JWTs are verified with
+func (s *Server) HandleJWKS(w http.ResponseWriter, r *http.Request) {
+	if s.bearer == nil {
+		problem.Error(w, r, "JWT bearer mode is disabled", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/jwk-set+json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(s.bearer.JWKS())
 }
 
 func (s *Server) HandleLogout(w http.ResponseWriter, r *http.Request) {
+	if user, err := s.sessionManager.GetUser(r); err == nil && user != nil {
+		s.authEvent(r, db.AuthEventLogout, user.Email, user.Provider, "")
+	}
+	if err := s.gmail.Tokens().Delete(r.Context(), s.sessionManager.SessionID(r)); err != nil {
+		s.logger.Error().Err(err).Msg("failed to delete oauth token")
+	}
 	err := s.sessionManager.ClearSession(w, r)
 	if err != nil {
 		s.logger.Error().Err(err).Msg("failed to clear session")
-		http.Error(w, "Logout failed", http.StatusInternalServerError)
+		problem.Error(w, r, "Logout failed", http.StatusInternalServerError)
 		return
 	}
 
@@ -319,23 +1029,32 @@ func (s *Server) HandleLogout(w http.ResponseWriter, r *http.Request) {
 func (s *Server) HandleMe(w http.ResponseWriter, r *http.Request) {
 	userValue := r.Context().Value("user")
 	if userValue == nil {
-		http.Error(w, "User not found in context", http.StatusUnauthorized)
+		problem.Error(w, r, "User not found in context", http.StatusUnauthorized)
 		return
 	}
 	
 	user, ok := userValue.(*session.User)
 	if !ok {
-		http.Error(w, "Invalid user context", http.StatusInternalServerError)
+		problem.Error(w, r, "Invalid user context", http.StatusInternalServerError)
 		return
 	}
 	
 	w.Header().Set("Content-Type", "application/json")
+	if admin, expires := s.sessionManager.Impersonator(r); admin != nil && r.Context().Value("impersonator") != nil {
+		// Flagged so the frontend shows whose account this is
+		json.NewEncoder(w).Encode(struct {
+			*session.User
+			Impersonator           *session.User `json:"impersonator"`
+			ImpersonationExpiresAt int64         `json:"impersonation_expires_at"`
+		}{user, admin, expires.Unix()})
+		return
+	}
 	json.NewEncoder(w).Encode(user)
 }
 
 func (s *Server) HandleSPA(w http.ResponseWriter, r *http.Request) {
 	// For any non-API routes, serve the built Next.js HTML
-	http.ServeFile(w, r, "./.next/server/app/index.html")
+	http.ServeFileFS(w, r, s.frontend, web.IndexPath)
 }
 
 
@@ -348,18 +1067,29 @@ func (s *Server) HandleHTMLTransform(w http.ResponseWriter, r *http.Request) {
 
 	var req html.TransformRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		problem.Error(w, r, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
 	if req.HTML == "" {
-		http.Error(w, "HTML content required", http.StatusBadRequest)
+		problem.Error(w, r, "HTML content required", http.StatusBadRequest)
 		return
 	}
+	if !html.IsValidQuoteMode(req.QuoteMode) {
+		problem.Error(w, r, "Invalid quote_mode", http.StatusBadRequest)
+		return
+	}
+
+	// Gmail images are fetched from the mailbox of sessions that granted
+	// access, the others get told how to upload them
+	sessionID := s.sessionManager.SessionID(r)
+	if _, err := s.gmail.Tokens().Get(ctx, sessionID); err == nil {
+		req.Images = s.gmail.ImageResolver(sessionID)
+	}
 
 	result, err := s.htmlTransformer.Transform(ctx, &req)
 	if err != nil {
 		s.logger.Error().Err(err).Msg("failed to transform HTML")
-		http.Error(w, "Failed to transform HTML", http.StatusInternalServerError)
+		problem.Error(w, r, "Failed to transform HTML", http.StatusInternalServerError)
 		return
 	}
 
@@ -367,4 +1097,315 @@ func (s *Server) HandleHTMLTransform(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(result)
 }
 
+func (s *Server) HandleHTMLReverse(w http.ResponseWriter, r *http.Request) {
+	// limit HTML size (e.g., 1.5MB)
+	r.Body = http.MaxBytesReader(w, r.Body, 1_500_000)
+
+	var req html.ReverseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem.Error(w, r, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.HTML == "" {
+		problem.Error(w, r, "HTML content required", http.StatusBadRequest)
+		return
+	}
+
+	result, err := s.htmlTransformer.Reverse(&req)
+	if err != nil {
+		problem.Error(w, r, fmt.Sprintf("Failed to reverse HTML: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func (s *Server) HandleHTMLExport(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	// limit HTML size (e.g., 1.5MB)
+	r.Body = http.MaxBytesReader(w, r.Body, 1_500_000)
+
+	var req html.ExportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem.Error(w, r, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.HTML == "" {
+		problem.Error(w, r, "HTML content required", http.StatusBadRequest)
+		return
+	}
+
+	// Default the sender to the signed-in user
+	if req.From == "" {
+		if user, ok := ctx.Value("user").(*session.User); ok {
+			req.From = (&mail.Address{Name: user.Name, Address: user.Email}).String()
+		}
+	}
+
+	message, err := s.htmlTransformer.Export(ctx, &req)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("failed to export HTML")
+		problem.Error(w, r, fmt.Sprintf("Failed to export email: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "message/rfc822")
+	w.Header().Set("Content-Disposition", `attachment; filename="email.eml"`)
+	w.Write(message)
+}
+
+// HandleGC runs asset garbage collection now, only reporting what it would
+// delete with ?dry_run=true
+func (s *Server) HandleGC(w http.ResponseWriter, r *http.Request) {
+	if s.collector == nil {
+		problem.Error(w, r, "Garbage collection is disabled, set GC_RETENTION_DAYS", http.StatusConflict)
+		return
+	}
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+
+	// Walking a large bucket outlives the request timeout
+	report, err := s.collector.Run(context.WithoutCancel(r.Context()), dryRun)
+	if errors.Is(err, gc.ErrRunning) {
+		problem.Error(w, r, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		s.logger.Error().Err(err).Msg("garbage collection failed")
+		problem.Error(w, r, fmt.Sprintf("Garbage collection failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// HandleIntegrityAudit checks the checksums of the objects under ?prefix=,
+// all of them by default
+func (s *Server) HandleIntegrityAudit(w http.ResponseWriter, r *http.Request) {
+	// Walking a large bucket outlives the request timeout
+	report, err := s.auditor.Run(context.WithoutCancel(r.Context()), r.URL.Query().Get("prefix"))
+	if errors.Is(err, integrity.ErrRunning) {
+		problem.Error(w, r, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		s.logger.Error().Err(err).Msg("integrity audit failed")
+		problem.Error(w, r, fmt.Sprintf("Integrity audit failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// lifecycleBody is the body of the lifecycle endpoints
+type lifecycleBody struct {
+	Rules []storage.LifecycleRule `json:"rules"`
+}
+
+// HandleGetLifecycle returns the bucket's lifecycle rules
+func (s *Server) HandleGetLifecycle(w http.ResponseWriter, r *http.Request) {
+	if s.lifecycle == nil {
+		problem.Error(w, r, "The storage backend has no lifecycle rules", http.StatusNotImplemented)
+		return
+	}
+	rules, err := s.lifecycle.GetLifecycle(r.Context())
+	if err != nil {
+		s.logger.Error().Err(err).Msg("failed to get lifecycle rules")
+		problem.Error(w, r, "Failed to get lifecycle rules", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(lifecycleBody{Rules: rules})
+}
+
+// HandleSetLifecycle replaces the bucket's lifecycle rules, e.g. expiring
+// tmp/ after 30 days or moving originals/ to infrequent access. An empty
+// list removes them all.
+func (s *Server) HandleSetLifecycle(w http.ResponseWriter, r *http.Request) {
+	if s.lifecycle == nil {
+		problem.Error(w, r, "The storage backend has no lifecycle rules", http.StatusNotImplemented)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 1_000_000)
+	var body lifecycleBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Rules == nil {
+		problem.Error(w, r, "Invalid request body, expected {\"rules\": [...]}", http.StatusBadRequest)
+		return
+	}
+	if err := storage.ValidateLifecycle(body.Rules); err != nil {
+		problem.Invalid(w, r, err)
+		return
+	}
+
+	if err := s.lifecycle.SetLifecycle(r.Context(), body.Rules); err != nil {
+		if errors.Is(err, storage.ErrUnsupportedLifecycle) {
+			problem.Error(w, r, err.Error()+", edit them with the provider instead", http.StatusConflict)
+			return
+		}
+		s.logger.Error().Err(err).Msg("failed to set lifecycle rules")
+		problem.Error(w, r, "Failed to set lifecycle rules", http.StatusBadGateway)
+		return
+	}
+	user, _ := r.Context().Value("user").(*session.User)
+	s.logger.Info().Str("admin", user.Email).Int("rules", len(body.Rules)).Msg("replaced bucket lifecycle rules")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
 
+// HandleImpersonate makes an admin act as another user, for
+// ImpersonationMaxAge or until they stop, to reproduce problems with their
+// quota and assets. Gmail stays connected to the admin's own account, the
+// user's mailbox is never exposed. Admins can't be impersonated.
+func (s *Server) HandleImpersonate(w http.ResponseWriter, r *http.Request) {
+	if _, ok := r.Context().Value("auth_time").(time.Time); ok {
+		problem.Error(w, r, "Impersonation needs a session, not a bearer token", http.StatusBadRequest)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 1_000)
+	var body struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		problem.Error(w, r, "Invalid request body, expected {\"email\": \"...\"}", http.StatusBadRequest)
+		return
+	}
+	address, err := mail.ParseAddress(body.Email)
+	if err != nil || address.Name != "" {
+		problem.Error(w, r, "Invalid email", http.StatusBadRequest)
+		return
+	}
+	email := strings.ToLower(address.Address)
+	if s.isAdmin(email) {
+		problem.Error(w, r, "Admins can't be impersonated", http.StatusForbidden)
+		return
+	}
+
+	target := &session.User{Sub: email, Email: email, Name: email}
+	if sessions, err := s.sessionManager.Sessions(r.Context(), email); err == nil && len(sessions) > 0 {
+		target.Provider = sessions[0].Provider
+	}
+	// Workspace users carry their domain, as they would signing in
+	_, domain, _ := strings.Cut(email, "@")
+	for _, d := range s.config.AllowedDomains {
+		if strings.EqualFold(strings.TrimSpace(d), domain) {
+			target.HD = domain
+		}
+	}
+
+	admin, _ := r.Context().Value("impersonator").(*session.User)
+	if admin == nil {
+		admin, _ = r.Context().Value("user").(*session.User)
+	}
+	expires, err := s.sessionManager.Impersonate(w, r, target)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("failed to start impersonation")
+		problem.Error(w, r, "Failed to impersonate", http.StatusInternalServerError)
+		return
+	}
+	s.logger.Warn().
+		Str("admin", admin.Email).
+		Str("impersonating", email).
+		Str("ip", clientIP(r)).
+		Time("expires_at", expires).
+		Msg("started impersonation")
+	s.authEvent(r, db.AuthEventImpersonate, admin.Email, admin.Provider, "started as "+email)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"user":                     target,
+		"impersonator":             admin,
+		"impersonation_expires_at": expires.Unix(),
+	})
+}
+
+// HandleStopImpersonating signs an impersonating admin back in as
+// themselves
+func (s *Server) HandleStopImpersonating(w http.ResponseWriter, r *http.Request) {
+	user, _ := r.Context().Value("user").(*session.User)
+	admin, err := s.sessionManager.StopImpersonating(w, r)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("failed to stop impersonation")
+		problem.Error(w, r, "Failed to stop impersonating", http.StatusInternalServerError)
+		return
+	}
+	if admin == nil {
+		problem.Error(w, r, "Not impersonating anyone", http.StatusConflict)
+		return
+	}
+	s.logger.Warn().
+		Str("admin", admin.Email).
+		Str("impersonating", user.Email).
+		Str("ip", clientIP(r)).
+		Msg("stopped impersonation")
+	s.authEvent(r, db.AuthEventImpersonate, admin.Email, admin.Provider, "stopped as "+user.Email)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(admin)
+}
+
+// authEvent appends an event to the auth log with the client of r. Failing
+// to is only logged.
+func (s *Server) authEvent(r *http.Request, event, email, provider, detail string) {
+	if err := s.sessionManager.RecordEvent(r.Context(), &db.AuthEvent{
+		Event:     event,
+		User:      email,
+		Provider:  provider,
+		IP:        clientIP(r),
+		UserAgent: r.UserAgent(),
+		Detail:    detail,
+	}); err != nil {
+		s.logger.Error().Err(err).Str("event", event).Str("email", email).Msg("failed to record auth event")
+	}
+}
+
+// HandleAuthEvents lists the auth log for admins, newest first, filtered by
+// the event, user, provider, ip and since (RFC 3339) query parameters and
+// paginated with cursor and limit
+func (s *Server) HandleAuthEvents(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := db.AuthEventFilter{
+		Event:    query.Get("event"),
+		User:     query.Get("user"),
+		Provider: query.Get("provider"),
+		IP:       query.Get("ip"),
+		Cursor:   query.Get("cursor"),
+	}
+	if v := query.Get("since"); v != "" {
+		since, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			problem.Error(w, r, "Invalid since, expected an RFC 3339 timestamp", http.StatusBadRequest)
+			return
+		}
+		filter.Since = since
+	}
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > db.MaxListLimit {
+			problem.Error(w, r, fmt.Sprintf("Invalid limit, expected 1 to %d", db.MaxListLimit), http.StatusBadRequest)
+			return
+		}
+		filter.Limit = limit
+	}
+
+	events, next, err := s.sessionManager.Events(r.Context(), filter)
+	if errors.Is(err, db.ErrInvalidCursor) {
+		problem.Error(w, r, "Invalid cursor", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		s.logger.Error().Err(err).Msg("failed to list auth events")
+		problem.Error(w, r, "Failed to list auth events", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"events":      events,
+		"next_cursor": next,
+	})
+}
@@ -0,0 +1,385 @@
+package http
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/hackclub/format/internal/assets"
+	"github.com/hackclub/format/internal/auth"
+	"github.com/hackclub/format/internal/config"
+	"github.com/hackclub/format/internal/health"
+	"github.com/hackclub/format/internal/problem"
+	"github.com/hackclub/format/internal/session"
+	"github.com/rs/zerolog"
+)
+
+var (
+	testAdmin = &session.User{Sub: "1", Email: "admin@hackclub.com", Name: "Admin", Provider: auth.ProviderGoogle}
+	testUser  = &session.User{Sub: "2", Email: "orpheus@hackclub.com", Name: "Orpheus", Provider: auth.ProviderGoogle}
+)
+
+// testServer is a Server without storage, Gmail or processing, enough to
+// exercise authentication
+type testServer struct {
+	*Server
+	handler http.Handler
+}
+
+func newTestServer(t *testing.T, cfg *config.Config) *testServer {
+	t.Helper()
+	if cfg.AppBaseURL == "" {
+		cfg.AppBaseURL = "http://localhost:8080"
+	}
+	if cfg.AdminEmails == nil {
+		cfg.AdminEmails = []string{testAdmin.Email, "root@hackclub.com"}
+	}
+	sessions := session.NewManager("test-session-secret-of-32-bytes!", cfg.AppBaseURL)
+	s := NewServer(cfg, zerolog.Nop(), sessions, nil, nil, nil, nil, nil, nil,
+		assets.NewHandler(nil, cfg.AdminEmails, nil, zerolog.Nop()), nil, nil, nil, nil, nil, fstest.MapFS{})
+	return &testServer{Server: s, handler: s.Routes()}
+}
+
+// signIn returns the session cookie of user signing in
+func (s *testServer) signIn(t *testing.T, user *session.User) []*http.Cookie {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	if err := s.sessionManager.SetUser(rec, httptest.NewRequest(http.MethodGet, "/", nil), user); err != nil {
+		t.Fatal(err)
+	}
+	return rec.Result().Cookies()
+}
+
+// do serves a request with cookies, which are updated with those the
+// response sets
+func (s *testServer) do(method, path, body string, cookies *[]*http.Cookie, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if cookies != nil {
+		for _, c := range *cookies {
+			req.AddCookie(c)
+		}
+	}
+	rec := httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, req)
+	if set := rec.Result().Cookies(); cookies != nil && len(set) > 0 {
+		*cookies = set
+	}
+	return rec
+}
+
+func TestImpersonateRequiresAdmin(t *testing.T) {
+	s := newTestServer(t, &config.Config{})
+	cookies := s.signIn(t, testUser)
+	rec := s.do(http.MethodPost, "/api/admin/impersonate", `{"email":"someone@hackclub.com"}`, &cookies, nil)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("non-admin impersonating: got %d, want 403", rec.Code)
+	}
+	if admin, _ := s.sessionManager.Impersonator(requestWith(cookies)); admin != nil {
+		t.Error("non-admin session is impersonating")
+	}
+}
+
+func TestListAssetsOfOthersRequiresAdmin(t *testing.T) {
+	s := newTestServer(t, &config.Config{})
+	cookies := s.signIn(t, testUser)
+	if rec := s.do(http.MethodGet, "/api/assets?uploader="+testAdmin.Email, "", &cookies, nil); rec.Code != http.StatusForbidden {
+		t.Errorf("non-admin listing another user's assets: got %d, want 403", rec.Code)
+	}
+}
+
+func TestImpersonateRefusesAdmins(t *testing.T) {
+	s := newTestServer(t, &config.Config{})
+	cookies := s.signIn(t, testAdmin)
+	for _, email := range []string{"root@hackclub.com", "ROOT@hackclub.com"} {
+		rec := s.do(http.MethodPost, "/api/admin/impersonate", `{"email":"`+email+`"}`, &cookies, nil)
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("impersonating admin %s: got %d, want 403", email, rec.Code)
+		}
+	}
+}
+
+func TestImpersonateRefusesBearerTokens(t *testing.T) {
+	issuer, err := auth.NewJWTIssuer("http://localhost:8080", []string{writeSigningKey(t)}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, &config.Config{})
+	s.bearer = issuer
+	token, _, err := issuer.Mint(&auth.Identity{Provider: testAdmin.Provider, Sub: testAdmin.Sub, Email: testAdmin.Email, Name: testAdmin.Name}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := http.Header{"Authorization": {"Bearer " + token}}
+	rec := s.do(http.MethodPost, "/api/admin/impersonate", `{"email":"orpheus@hackclub.com"}`, nil, header)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("impersonating with a bearer token: got %d, want 400", rec.Code)
+	}
+	if len(rec.Result().Cookies()) != 0 {
+		t.Error("bearer impersonation set a session cookie")
+	}
+}
+
+func TestImpersonation(t *testing.T) {
+	s := newTestServer(t, &config.Config{})
+	cookies := s.signIn(t, testAdmin)
+
+	rec := s.do(http.MethodPost, "/api/admin/impersonate", `{"email":"Orpheus@hackclub.com"}`, &cookies, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("impersonating: got %d: %s", rec.Code, rec.Body)
+	}
+
+	// Requests run as the user, carrying the admin
+	var user, impersonator *session.User
+	s.AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _ = r.Context().Value("user").(*session.User)
+		impersonator, _ = r.Context().Value("impersonator").(*session.User)
+	})).ServeHTTP(httptest.NewRecorder(), requestWith(cookies))
+	if user == nil || user.Email != testUser.Email {
+		t.Errorf("impersonated request user = %+v, want %s", user, testUser.Email)
+	}
+	if impersonator == nil || impersonator.Email != testAdmin.Email {
+		t.Errorf("impersonated request impersonator = %+v, want %s", impersonator, testAdmin.Email)
+	}
+
+	var me struct {
+		Email                  string        `json:"email"`
+		Impersonator           *session.User `json:"impersonator"`
+		ImpersonationExpiresAt int64         `json:"impersonation_expires_at"`
+	}
+	rec = s.do(http.MethodGet, "/api/auth/me", "", &cookies, nil)
+	if err := json.NewDecoder(rec.Body).Decode(&me); err != nil {
+		t.Fatal(err)
+	}
+	if me.Email != testUser.Email || me.Impersonator == nil || me.Impersonator.Email != testAdmin.Email {
+		t.Errorf("/api/auth/me while impersonating = %+v", me)
+	}
+	if until := time.Until(time.Unix(me.ImpersonationExpiresAt, 0)); until <= 0 || until > session.ImpersonationMaxAge {
+		t.Errorf("impersonation expires in %v", until)
+	}
+
+	// Still an admin, who can stop
+	rec = s.do(http.MethodDelete, "/api/admin/impersonate", "", &cookies, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("stopping: got %d: %s", rec.Code, rec.Body)
+	}
+	me.Impersonator = nil
+	rec = s.do(http.MethodGet, "/api/auth/me", "", &cookies, nil)
+	if err := json.NewDecoder(rec.Body).Decode(&me); err != nil {
+		t.Fatal(err)
+	}
+	if me.Email != testAdmin.Email || me.Impersonator != nil {
+		t.Errorf("/api/auth/me after stopping = %+v", me)
+	}
+	if rec := s.do(http.MethodDelete, "/api/admin/impersonate", "", &cookies, nil); rec.Code != http.StatusConflict {
+		t.Errorf("stopping again: got %d, want 409", rec.Code)
+	}
+}
+
+func TestServiceCannotReachAdminRoutes(t *testing.T) {
+	// Even a service whose pseudo-address is listed as an admin
+	s := newTestServer(t, &config.Config{AdminEmails: []string{testAdmin.Email, "service:mailer"}})
+	secret := []byte("mailer-secret-of-at-least-32-bytes")
+	s.services = auth.NewServiceAuthenticator(map[string]string{"mailer": string(secret)})
+
+	routes := []struct{ method, path, body string }{
+		{http.MethodPost, "/api/admin/gc", ""},
+		{http.MethodGet, "/api/admin/audit", ""},
+		{http.MethodPost, "/api/admin/assets/delete", `{"keys":["a.png"]}`},
+		{http.MethodGet, "/api/admin/lifecycle", ""},
+		{http.MethodPut, "/api/admin/lifecycle", `{"enabled":false}`},
+		{http.MethodPost, "/api/admin/integrity", ""},
+		{http.MethodPost, "/api/admin/impersonate", `{"email":"orpheus@hackclub.com"}`},
+		{http.MethodDelete, "/api/admin/impersonate", ""},
+		{http.MethodGet, "/api/admin/auth-events", ""},
+	}
+	for _, route := range routes {
+		now := time.Now().Unix()
+		signature := auth.SignServiceRequest(secret, route.method, route.path, now, []byte(route.body))
+		header := http.Header{"Authorization": {fmt.Sprintf("HMAC mailer:%d:%s", now, signature)}}
+		rec := s.do(route.method, route.path, route.body, nil, header)
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("service %s %s: got %d, want 403", route.method, route.path, rec.Code)
+		}
+	}
+
+	// The same credentials do authenticate elsewhere
+	now := time.Now().Unix()
+	signature := auth.SignServiceRequest(secret, http.MethodGet, "/api/auth/me", now, nil)
+	header := http.Header{"Authorization": {fmt.Sprintf("HMAC mailer:%d:%s", now, signature)}}
+	if rec := s.do(http.MethodGet, "/api/auth/me", "", nil, header); rec.Code != http.StatusOK {
+		t.Errorf("service /api/auth/me: got %d, want 200", rec.Code)
+	}
+}
+
+func TestRealIP(t *testing.T) {
+	proxies := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("192.0.2.1/32")}
+	tests := []struct {
+		name, remoteAddr string
+		header           http.Header
+		want             string
+	}{
+		{"direct", "203.0.113.9:4000", nil, "203.0.113.9:4000"},
+		{"untrusted peer forwarding", "203.0.113.9:4000", http.Header{"X-Forwarded-For": {"198.51.100.7"}, "X-Real-Ip": {"198.51.100.8"}}, "203.0.113.9:4000"},
+		{"trusted proxy", "10.1.2.3:4000", http.Header{"X-Forwarded-For": {"198.51.100.7"}}, "198.51.100.7"},
+		{"spoofed hop before the proxy", "10.1.2.3:4000", http.Header{"X-Forwarded-For": {"1.2.3.4, 198.51.100.7"}}, "198.51.100.7"},
+		{"proxy chain", "10.1.2.3:4000", http.Header{"X-Forwarded-For": {"198.51.100.7, 10.9.9.9", "192.0.2.1"}}, "198.51.100.7"},
+		{"X-Real-IP", "192.0.2.1:4000", http.Header{"X-Real-Ip": {"198.51.100.8"}}, "198.51.100.8"},
+		{"garbage", "10.1.2.3:4000", http.Header{"X-Forwarded-For": {"not-an-ip"}}, "10.1.2.3:4000"},
+	}
+	s := newTestServer(t, &config.Config{TrustedProxies: proxies})
+	for _, tt := range tests {
+		var got string
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = tt.remoteAddr
+		for name, values := range tt.header {
+			req.Header[name] = values
+		}
+		s.RealIP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = r.RemoteAddr
+		})).ServeHTTP(httptest.NewRecorder(), req)
+		if got != tt.want {
+			t.Errorf("%s: RemoteAddr = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAuthRateLimitIgnoresForwardedFor(t *testing.T) {
+	s := newTestServer(t, &config.Config{RateLimitAuthPerMinute: 1, RateLimitAuthBurst: 1})
+	for i, ip := range []string{"198.51.100.1", "198.51.100.2"} {
+		rec := s.do(http.MethodGet, "/api/auth/login", "", nil, http.Header{"X-Forwarded-For": {ip}})
+		if limited := rec.Code == http.StatusTooManyRequests; limited != (i > 0) {
+			t.Errorf("sign-in %d claiming to be %s: got %d", i+1, ip, rec.Code)
+		}
+	}
+}
+
+// requestWith is a request bearing cookies
+func requestWith(cookies []*http.Cookie) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/api/auth/me", nil)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	return req
+}
+
+// writeSigningKey writes a P-256 key for JWTs in bearer mode
+func writeSigningKey(t *testing.T) string {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "jwt.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestAPIDocs(t *testing.T) {
+	s := newTestServer(t, &config.Config{})
+	if rec := s.do(http.MethodGet, "/api/docs", "", nil, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("GET /api/docs without Swagger UI = %d, want 404", rec.Code)
+	}
+
+	s.frontend = fstest.MapFS{
+		"public/swagger-ui/swagger-ui.css":       {Data: []byte("body {}")},
+		"public/swagger-ui/swagger-ui-bundle.js": {Data: []byte("var SwaggerUIBundle")},
+		"public/favicon.svg":                     {Data: []byte("<svg/>")},
+	}
+	s.handler = s.Routes()
+	rec := s.do(http.MethodGet, "/api/docs", "", nil, nil)
+	if rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), "https://") {
+		t.Errorf("GET /api/docs = %d %s, want Swagger UI served by us", rec.Code, rec.Body)
+	}
+	if rec := s.do(http.MethodGet, "/api/docs/swagger-ui/swagger-ui.css", "", nil, nil); rec.Code != http.StatusOK || rec.Body.String() != "body {}" {
+		t.Errorf("GET swagger-ui.css = %d %q", rec.Code, rec.Body)
+	}
+	if rec := s.do(http.MethodGet, "/api/docs/swagger-ui/../favicon.svg", "", nil, nil); rec.Code == http.StatusOK {
+		t.Errorf("GET outside swagger-ui = %d, want refused", rec.Code)
+	}
+
+	// The spec describes what the handlers encode
+	var got configResponse
+	rec = s.do(http.MethodGet, "/api/config", "", nil, nil)
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil || got.AuthMode != "cookie" {
+		t.Errorf("GET /api/config = %+v, %v", got, err)
+	}
+}
+
+func TestOpenAPIErrorsAreProblems(t *testing.T) {
+	doc := newTestServer(t, &config.Config{}).openAPI()
+	if _, ok := doc.Components.Schemas["Problem"]; !ok {
+		t.Fatal("no Problem schema")
+	}
+	for path, ops := range doc.Paths {
+		for method, op := range ops {
+			for status, resp := range op.Responses {
+				if status[0] != '4' && status[0] != '5' {
+					continue
+				}
+				if media, ok := resp.Content[problem.ContentType]; !ok || media.Schema.Ref != "#/components/schemas/Problem" || len(resp.Content) != 1 {
+					t.Errorf("%s %s %s = %+v, want a problem", method, path, status, resp.Content)
+				}
+			}
+		}
+	}
+}
+
+func TestHealthAndReadiness(t *testing.T) {
+	s := newTestServer(t, &config.Config{})
+	var storageErr, redisErr error
+	s.health = health.NewChecker(0, time.Second, zerolog.Nop())
+	s.health.Add("storage", func(ctx context.Context) error { return storageErr })
+	s.health.AddOptional("redis", func(ctx context.Context) error { return redisErr })
+
+	tests := []struct {
+		name                 string
+		storageErr, redisErr error
+		ready                int
+		status               string
+	}{
+		{"all up", nil, nil, http.StatusOK, health.StatusOK},
+		{"redis down", nil, errors.New("unreachable"), http.StatusOK, health.StatusDegraded},
+		{"storage down", errors.New("unreachable"), nil, http.StatusServiceUnavailable, health.StatusError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storageErr, redisErr = tt.storageErr, tt.redisErr
+			// Liveness doesn't depend on dependencies
+			if rec := s.do(http.MethodGet, "/healthz", "", nil, nil); rec.Code != http.StatusOK {
+				t.Errorf("GET /healthz = %d, want 200", rec.Code)
+			}
+			rec := s.do(http.MethodGet, "/readyz", "", nil, nil)
+			var got health.Report
+			if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != tt.ready || got.Status != tt.status {
+				t.Errorf("GET /readyz = %d %q, want %d %q", rec.Code, got.Status, tt.ready, tt.status)
+			}
+		})
+	}
+}
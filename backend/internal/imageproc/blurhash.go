@@ -0,0 +1,133 @@
+package imageproc
+
+import (
+    "bytes"
+    "fmt"
+    "image"
+    "image/png"
+    "math"
+    "strings"
+
+    "github.com/h2non/bimg"
+)
+
+// BlurHash component counts, 4x3 suits the mostly landscape images in emails
+const (
+    blurHashXComponents = 4
+    blurHashYComponents = 3
+    blurHashSampleWidth = 32 // the hash only holds a dozen colors anyway
+)
+
+const base83Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// blurHash computes a BlurHash placeholder from a tiny thumbnail of the image
+func blurHash(data []byte) (string, error) {
+    thumb, err := bimg.NewImage(data).Process(bimg.Options{
+        Width: blurHashSampleWidth,
+        Type:  bimg.PNG,
+    })
+    if err != nil {
+        return "", fmt.Errorf("failed to create thumbnail: %v", err)
+    }
+    img, err := png.Decode(bytes.NewReader(thumb))
+    if err != nil {
+        return "", fmt.Errorf("failed to decode thumbnail: %v", err)
+    }
+    return encodeBlurHash(img, blurHashXComponents, blurHashYComponents), nil
+}
+
+// encodeBlurHash implements the BlurHash encoding algorithm
+// (https://github.com/woltapp/blurhash/blob/master/Algorithm.md)
+func encodeBlurHash(img image.Image, xComponents, yComponents int) string {
+    bounds := img.Bounds()
+    width, height := bounds.Dx(), bounds.Dy()
+
+    // Linear RGB of every pixel, computed once
+    pixels := make([][3]float64, width*height)
+    for y := 0; y < height; y++ {
+        for x := 0; x < width; x++ {
+            r, g, b, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+            pixels[y*width+x] = [3]float64{sRGBToLinear(r >> 8), sRGBToLinear(g >> 8), sRGBToLinear(b >> 8)}
+        }
+    }
+
+    factors := make([][3]float64, 0, xComponents*yComponents)
+    for j := 0; j < yComponents; j++ {
+        for i := 0; i < xComponents; i++ {
+            normalisation := 2.0
+            if i == 0 && j == 0 {
+                normalisation = 1
+            }
+            var factor [3]float64
+            for y := 0; y < height; y++ {
+                for x := 0; x < width; x++ {
+                    basis := math.Cos(math.Pi*float64(i*x)/float64(width)) * math.Cos(math.Pi*float64(j*y)/float64(height))
+                    for c := 0; c < 3; c++ {
+                        factor[c] += basis * pixels[y*width+x][c]
+                    }
+                }
+            }
+            scale := normalisation / float64(width*height)
+            factors = append(factors, [3]float64{factor[0] * scale, factor[1] * scale, factor[2] * scale})
+        }
+    }
+
+    var hash strings.Builder
+    hash.WriteString(encodeBase83((xComponents-1)+(yComponents-1)*9, 1))
+
+    dc, ac := factors[0], factors[1:]
+    maximumValue := 1.0
+    if len(ac) > 0 {
+        actualMaximum := 0.0
+        for _, f := range ac {
+            for _, v := range f {
+                actualMaximum = math.Max(actualMaximum, math.Abs(v))
+            }
+        }
+        quantisedMaximum := int(math.Max(0, math.Min(82, math.Floor(actualMaximum*166-0.5))))
+        maximumValue = float64(quantisedMaximum+1) / 166
+        hash.WriteString(encodeBase83(quantisedMaximum, 1))
+    } else {
+        hash.WriteString(encodeBase83(0, 1))
+    }
+
+    hash.WriteString(encodeBase83(linearToSRGB(dc[0])<<16+linearToSRGB(dc[1])<<8+linearToSRGB(dc[2]), 4))
+
+    quantise := func(v float64) int {
+        return int(math.Max(0, math.Min(18, math.Floor(signPow(v/maximumValue, 0.5)*9+9.5))))
+    }
+    for _, f := range ac {
+        hash.WriteString(encodeBase83(quantise(f[0])*19*19+quantise(f[1])*19+quantise(f[2]), 2))
+    }
+
+    return hash.String()
+}
+
+func encodeBase83(value, length int) string {
+    out := make([]byte, length)
+    for i := length - 1; i >= 0; i-- {
+        out[i] = base83Chars[value%83]
+        value /= 83
+    }
+    return string(out)
+}
+
+func sRGBToLinear(value uint32) float64 {
+    v := float64(value) / 255
+    if v <= 0.04045 {
+        return v / 12.92
+    }
+    return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(value float64) int {
+    v := math.Max(0, math.Min(1, value))
+    if v <= 0.0031308 {
+        return int(v*12.92*255 + 0.5)
+    }
+    return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(value, exp float64) float64 {
+    return math.Copysign(math.Pow(math.Abs(value), exp), value)
+}
@@ -0,0 +1,22 @@
+package imageproc
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestEncodeBlurHash(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 8, 6))
+	for y := 0; y < 6; y++ {
+		for x := 0; x < 8; x++ {
+			img.Set(x, y, color.RGBA{uint8(x * 30), uint8(y * 40), 200, 255})
+		}
+	}
+
+	// Reference value from the woltapp algorithm for the same gradient
+	expected := "LcE..23Ea|%5zRNMfQnUeqf7fQf7"
+	if got := encodeBlurHash(img, 4, 3); got != expected {
+		t.Errorf("encodeBlurHash() = %s, expected %s", got, expected)
+	}
+}
@@ -0,0 +1,113 @@
+package imageproc
+
+import (
+    "context"
+    "fmt"
+
+    "github.com/h2non/bimg"
+)
+
+// Output formats for Convert
+const (
+    FormatJPEG = "jpeg"
+    FormatPNG  = "png"
+    FormatWebP = "webp"
+    FormatAVIF = "avif"
+)
+
+// IsValidFormat reports whether format is a supported conversion target
+func IsValidFormat(format string) bool {
+    switch format {
+    case FormatJPEG, FormatPNG, FormatWebP, FormatAVIF:
+        return true
+    default:
+        return false
+    }
+}
+
+// Convert re-encodes an image in the requested format, bypassing the
+// automatic format decision of Process. The image is scaled down to the
+// configured maximum like in Process, animations keep their first frame.
+// quality applies to the lossy formats, 0 for the configured quality.
+func (p *Processor) Convert(ctx context.Context, data []byte, format string, quality int) (*ProcessResult, error) {
+    if !IsValidFormat(format) {
+        return nil, fmt.Errorf("unknown format %q, expected jpeg, png, webp or avif", format)
+    }
+    if quality < 0 || quality > 100 {
+        return nil, fmt.Errorf("quality must be between 1 and 100")
+    }
+    if format == FormatAVIF && !bimg.IsTypeSupportedSave(bimg.AVIF) {
+        return nil, fmt.Errorf("AVIF output is not supported: libvips was built without AVIF support")
+    }
+
+    ctx, cancel := p.withTimeout(ctx)
+    defer cancel()
+    release, err := p.acquireWorker(ctx)
+    if err != nil {
+        return nil, err
+    }
+    defer release()
+
+    metadata, err := bimg.NewImage(data).Metadata()
+    if err != nil {
+        return nil, fmt.Errorf("failed to read image metadata: %v", err)
+    }
+    shrink := shrinkOnLoadFactor(data, metadata.Size.Width, metadata.Size.Height, p.maxDimension)
+    if err := p.checkMemoryBudget(len(data), metadata.Size.Width, metadata.Size.Height, p.maxDimension, shrink); err != nil {
+        return nil, err
+    }
+
+    fmt.Printf("🔁 Converting %s image to %s...\n", metadata.Type, format)
+    params := p.jpegSettings(ProcessOptions{Quality: quality})
+    var converted []byte
+    switch format {
+    case FormatJPEG, FormatPNG:
+        // The Go decoders would hold every pixel, libvips shrinks on load
+        data = shrinkOnLoad(data, metadata.Size.Width, metadata.Size.Height, p.maxDimension, nil)
+    }
+    switch format {
+    case FormatJPEG:
+        img := decodeImage(data, nil)
+        if img != nil && metadata.Alpha {
+            img = flattenOnWhite(img) // JPEG has no alpha
+        }
+        converted, err = encodeJPEG(img, data, jpegOrientation(data), p.maxDimension, params, nil)
+    case FormatPNG:
+        converted, err = encodePNG(decodeImage(data, nil), data, jpegOrientation(data), p.maxDimension, nil)
+        if err == nil {
+            converted, err = compressWithOxipng(ctx, converted, p.pngSettings(ProcessOptions{}))
+        }
+    default:
+        options := bimg.Options{Type: bimg.WEBP, Quality: p.webpQualityFor(ProcessOptions{Quality: quality}), StripMetadata: true}
+        if format == FormatAVIF {
+            options.Type, options.Quality = bimg.AVIF, params.quality
+        }
+        if needsResize(metadata.Size.Width, metadata.Size.Height, p.maxDimension) {
+            options.Width, options.Height = calculateDimensionsWithMax(metadata.Size.Width, metadata.Size.Height, p.maxDimension)
+        }
+        converted, err = bimg.NewImage(data).Process(options)
+    }
+    if err != nil {
+        return nil, fmt.Errorf("failed to convert image to %s: %v", format, err)
+    }
+
+    if converted, err = p.stripMetadata(converted); err != nil {
+        return nil, fmt.Errorf("failed to strip metadata: %v", err)
+    }
+
+    finalMetadata, err := bimg.NewImage(converted).Metadata()
+    if err != nil {
+        return nil, fmt.Errorf("failed to read converted image metadata: %v", err)
+    }
+
+    return &ProcessResult{
+        Data:           converted,
+        ContentType:    "image/" + format,
+        Width:          finalMetadata.Size.Width,
+        Height:         finalMetadata.Size.Height,
+        HasAlpha:       finalMetadata.Alpha,
+        Frames:         1,
+        OriginalSize:   len(data),
+        CompressedSize: len(converted),
+    }, nil
+}
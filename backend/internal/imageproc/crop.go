@@ -0,0 +1,108 @@
+package imageproc
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+
+    "github.com/h2non/bimg"
+)
+
+// CropRect is an explicit crop in pixels of the upright image
+type CropRect struct {
+    X      int `json:"x"`
+    Y      int `json:"y"`
+    Width  int `json:"width"`
+    Height int `json:"height"`
+}
+
+// Crop strategies for aspect ratio crops
+const (
+    CropSmart  = "smart"  // keep the most interesting region (libvips attention)
+    CropCenter = "center" // keep the center
+)
+
+// validateCrop checks the crop options, which are mutually exclusive
+func (o ProcessOptions) validateCrop() error {
+    if o.Crop != nil && o.CropAspect != "" {
+        return invalidOption("crop", "crop and cropAspect can't be combined")
+    }
+    if c := o.Crop; c != nil && (c.X < 0 || c.Y < 0 || c.Width <= 0 || c.Height <= 0) {
+        return invalidOption("crop", "crop must have a non-negative origin and positive size")
+    }
+    if o.CropAspect != "" {
+        if _, _, err := parseAspect(o.CropAspect); err != nil {
+            return err
+        }
+    }
+    switch o.CropStrategy {
+    case "", CropSmart, CropCenter:
+        return nil
+    default:
+        return invalidOption("cropStrategy", "unknown crop strategy %q", o.CropStrategy)
+    }
+}
+
+// parseAspect parses an aspect ratio like "16:9"
+func parseAspect(aspect string) (int, int, error) {
+    w, h, ok := strings.Cut(aspect, ":")
+    width, errW := strconv.Atoi(w)
+    height, errH := strconv.Atoi(h)
+    if !ok || errW != nil || errH != nil || width <= 0 || height <= 0 {
+        return 0, 0, invalidOption("cropAspect", "invalid cropAspect %q, expected e.g. 16:9", aspect)
+    }
+    return width, height, nil
+}
+
+// applyCrop crops the image as requested and returns a lossless PNG of the
+// upright, cropped image
+func applyCrop(data []byte, opts ProcessOptions) ([]byte, error) {
+    upright, err := bimg.NewImage(data).Process(bimg.Options{Type: bimg.PNG, Quality: 100})
+    if err != nil {
+        return nil, fmt.Errorf("failed to decode image for cropping: %v", err)
+    }
+    size, err := bimg.NewImage(upright).Size()
+    if err != nil {
+        return nil, fmt.Errorf("failed to read image size: %v", err)
+    }
+
+    options := bimg.Options{Type: bimg.PNG, Quality: 100}
+    if c := opts.Crop; c != nil {
+        if c.X+c.Width > size.Width || c.Y+c.Height > size.Height {
+            return nil, fmt.Errorf("crop %dx%d+%d+%d is outside the %dx%d image", c.Width, c.Height, c.X, c.Y, size.Width, size.Height)
+        }
+        fmt.Printf("✂️ Cropping to %dx%d at (%d, %d)\n", c.Width, c.Height, c.X, c.Y)
+        options.Top, options.Left = c.Y, c.X
+        options.AreaWidth, options.AreaHeight = c.Width, c.Height
+    } else {
+        aspectW, aspectH, err := parseAspect(opts.CropAspect)
+        if err != nil {
+            return nil, err
+        }
+        // Largest region with the target aspect that fits the image
+        width, height := size.Width, size.Width*aspectH/aspectW
+        if height > size.Height {
+            width, height = size.Height*aspectW/aspectH, size.Height
+        }
+        fmt.Printf("✂️ Cropping to %s (%dx%d, %s)\n", opts.CropAspect, width, height, cropStrategy(opts))
+        options.Width, options.Height = width, height
+        options.Crop = true
+        options.Gravity = bimg.GravityCentre
+        if cropStrategy(opts) == CropSmart {
+            options.Gravity = bimg.GravitySmart
+        }
+    }
+
+    cropped, err := bimg.NewImage(upright).Process(options)
+    if err != nil {
+        return nil, fmt.Errorf("failed to crop image: %v", err)
+    }
+    return cropped, nil
+}
+
+func cropStrategy(opts ProcessOptions) string {
+    if opts.CropStrategy == "" {
+        return CropSmart
+    }
+    return opts.CropStrategy
+}
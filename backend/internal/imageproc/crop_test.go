@@ -0,0 +1,27 @@
+package imageproc
+
+import "testing"
+
+func TestValidateCrop(t *testing.T) {
+	tests := []struct {
+		name  string
+		opts  ProcessOptions
+		valid bool
+	}{
+		{"none", ProcessOptions{}, true},
+		{"rect", ProcessOptions{Crop: &CropRect{X: 0, Y: 10, Width: 100, Height: 50}}, true},
+		{"empty rect", ProcessOptions{Crop: &CropRect{Width: 0, Height: 50}}, false},
+		{"negative origin", ProcessOptions{Crop: &CropRect{X: -1, Width: 10, Height: 10}}, false},
+		{"aspect", ProcessOptions{CropAspect: "16:9", CropStrategy: CropCenter}, true},
+		{"bad aspect", ProcessOptions{CropAspect: "wide"}, false},
+		{"zero aspect", ProcessOptions{CropAspect: "0:1"}, false},
+		{"both", ProcessOptions{Crop: &CropRect{Width: 1, Height: 1}, CropAspect: "1:1"}, false},
+		{"bad strategy", ProcessOptions{CropAspect: "1:1", CropStrategy: "entropy"}, false},
+	}
+
+	for _, test := range tests {
+		if err := test.opts.Validate(); (err == nil) != test.valid {
+			t.Errorf("%s: Validate() = %v, expected valid=%v", test.name, err, test.valid)
+		}
+	}
+}
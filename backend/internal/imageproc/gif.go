@@ -0,0 +1,208 @@
+package imageproc
+
+import (
+    "context"
+    "bytes"
+    "fmt"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strconv"
+)
+
+// gifFrameCount walks the GIF block structure and counts image descriptors
+// without decoding any pixel data. It returns 0 for data that isn't a GIF.
+func gifFrameCount(data []byte) int {
+    if len(data) < 13 || (string(data[:6]) != "GIF87a" && string(data[:6]) != "GIF89a") {
+        return 0
+    }
+
+    pos := 13
+    // Skip the global color table
+    if flags := data[10]; flags&0x80 != 0 {
+        pos += 3 << ((flags & 0x07) + 1)
+    }
+
+    frames := 0
+    for pos < len(data) {
+        switch data[pos] {
+        case 0x21: // Extension: introducer, label, sub-blocks
+            pos = skipSubBlocks(data, pos+2)
+        case 0x2C: // Image descriptor: 10 bytes, local color table, LZW code size, sub-blocks
+            frames++
+            if pos+10 > len(data) {
+                return frames
+            }
+            flags := data[pos+9]
+            pos += 10
+            if flags&0x80 != 0 {
+                pos += 3 << ((flags & 0x07) + 1)
+            }
+            pos = skipSubBlocks(data, pos+1)
+        default: // Trailer (0x3B) or garbage
+            return frames
+        }
+    }
+    return frames
+}
+
+// gifHasTransparency reports whether a frame of a GIF has a transparent
+// color, set by the graphic control extension before it
+func gifHasTransparency(data []byte) bool {
+    if !isGIF(data) || len(data) < 13 {
+        return false
+    }
+    pos := 13
+    if flags := data[10]; flags&0x80 != 0 {
+        pos += 3 << ((flags & 0x07) + 1)
+    }
+    for pos < len(data) {
+        switch data[pos] {
+        case 0x21:
+            // Graphic control extension: label, size 4, packed fields
+            if pos+3 < len(data) && data[pos+1] == 0xF9 && data[pos+3]&0x01 != 0 {
+                return true
+            }
+            pos = skipSubBlocks(data, pos+2)
+        case 0x2C:
+            if pos+10 > len(data) {
+                return false
+            }
+            flags := data[pos+9]
+            pos += 10
+            if flags&0x80 != 0 {
+                pos += 3 << ((flags & 0x07) + 1)
+            }
+            pos = skipSubBlocks(data, pos+1)
+        default:
+            return false
+        }
+    }
+    return false
+}
+
+// skipSubBlocks returns the position after a chain of data sub-blocks
+func skipSubBlocks(data []byte, pos int) int {
+    for pos < len(data) {
+        size := int(data[pos])
+        pos++
+        if size == 0 {
+            return pos
+        }
+        pos += size
+    }
+    return pos
+}
+
+// processAnimatedGIF optimizes an animated GIF while keeping all frames,
+// converting to animated WebP when allowed and smaller
+func (p *Processor) processAnimatedGIF(ctx context.Context, data []byte, frames, width, height, maxDimension int, timings stageTimings) (*ProcessResult, error) {
+    originalSize := len(data)
+    fmt.Printf("🎞️ Animated GIF detected (%d frames), preserving animation.\n", frames)
+
+    done := timings.track(StageOptimize)
+    processedData, err := optimizeWithGifsicle(ctx, data, width, height, maxDimension)
+    done()
+    if ctx.Err() != nil {
+        return nil, ctx.Err()
+    }
+    if err != nil {
+        fmt.Printf("⚠️ gifsicle optimization failed, keeping original GIF. Error: %v\n", err)
+        processedData = data
+    }
+    outputContentType := "image/gif"
+
+    if p.animatedWebP {
+        done := timings.track(StageEncode)
+        webpData, err := convertGIFToWebP(ctx, processedData, p.webpQualityFor(ProcessOptions{}))
+        done()
+        if ctx.Err() != nil {
+            return nil, ctx.Err()
+        }
+        if err != nil {
+            fmt.Printf("⚠️ gif2webp conversion failed, keeping GIF. Error: %v\n", err)
+        } else if len(webpData) < len(processedData) {
+            processedData = webpData
+            outputContentType = "image/webp"
+        }
+    }
+
+    if len(processedData) > originalSize {
+        processedData = data
+        outputContentType = "image/gif"
+    }
+
+    // The size of what's returned, the original when optimizing failed
+    finalWidth, finalHeight := animationSize(processedData)
+    if finalWidth == 0 || finalHeight == 0 {
+        finalWidth, finalHeight = width, height
+        if needsResize(width, height, maxDimension) {
+            finalWidth, finalHeight = calculateDimensionsWithMax(width, height, maxDimension)
+        }
+    }
+
+    fmt.Printf("✅ Animated GIF optimized: %d bytes -> %d bytes (%s)\n", originalSize, len(processedData), outputContentType)
+
+    return &ProcessResult{
+        Data:           processedData,
+        ContentType:    outputContentType,
+        Width:          finalWidth,
+        Height:         finalHeight,
+        HasAlpha:       animationHasAlpha(processedData),
+        Frames:         animationFrames(processedData),
+        OriginalSize:   originalSize,
+        CompressedSize: len(processedData),
+    }, nil
+}
+
+// optimizeWithGifsicle losslessly optimizes all frames, scaling the animation
+// down if it exceeds maxDimension
+func optimizeWithGifsicle(ctx context.Context, input []byte, width, height, maxDimension int) ([]byte, error) {
+    args := []string{"-O3", "--no-comments", "--no-names"}
+    if needsResize(width, height, maxDimension) {
+        args = append(args, "--resize-fit", fmt.Sprintf("%dx%d", maxDimension, maxDimension))
+    }
+    cmd := exec.CommandContext(ctx, "gifsicle", args...)
+
+    var out, stderr bytes.Buffer
+    cmd.Stdin = bytes.NewReader(input)
+    cmd.Stdout = &out
+    cmd.Stderr = &stderr
+
+    if err := cmd.Run(); err != nil {
+        return nil, fmt.Errorf("%v: %s", err, stderr.String())
+    }
+    if out.Len() == 0 {
+        return nil, fmt.Errorf("gifsicle produced no output")
+    }
+    return out.Bytes(), nil
+}
+
+// convertGIFToWebP converts an animated GIF to animated WebP at quality with
+// gif2webp, which only works on files
+func convertGIFToWebP(ctx context.Context, input []byte, quality int) ([]byte, error) {
+    dir, err := os.MkdirTemp("", "gif2webp")
+    if err != nil {
+        return nil, err
+    }
+    defer os.RemoveAll(dir)
+
+    inPath := filepath.Join(dir, "in.gif")
+    outPath := filepath.Join(dir, "out.webp")
+    if err := os.WriteFile(inPath, input, 0600); err != nil {
+        return nil, err
+    }
+
+    var stderr bytes.Buffer
+    cmd := exec.CommandContext(ctx, "gif2webp", "-mixed", "-q", strconv.Itoa(quality), "-m", "6", "-quiet", inPath, "-o", outPath)
+    cmd.Stderr = &stderr
+    if err := cmd.Run(); err != nil {
+        return nil, fmt.Errorf("%v: %s", err, stderr.String())
+    }
+
+    return os.ReadFile(outPath)
+}
+
+func needsResize(width, height, maxDimension int) bool {
+    return width > maxDimension || height > maxDimension
+}
@@ -0,0 +1,85 @@
+package imageproc
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/gif"
+	"testing"
+)
+
+func encodeGIF(t *testing.T, frames int) []byte {
+	t.Helper()
+	anim := &gif.GIF{}
+	for i := 0; i < frames; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, 4, 4), color.Palette{color.Black, color.White})
+		frame.SetColorIndex(i%4, i%4, 1)
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, 10)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		t.Fatalf("failed to encode GIF: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestGIFFrameCount(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		expected int
+	}{
+		{"single frame", encodeGIF(t, 1), 1},
+		{"animated", encodeGIF(t, 5), 5},
+		{"not a gif", []byte("\x89PNG\r\n\x1a\n0000000000"), 0},
+		{"truncated", encodeGIF(t, 3)[:20], 0},
+	}
+
+	for _, test := range tests {
+		if result := gifFrameCount(test.data); result != test.expected {
+			t.Errorf("%s: gifFrameCount() = %d, expected %d", test.name, result, test.expected)
+		}
+	}
+}
+
+func TestProcessAnimatedGIFSize(t *testing.T) {
+	data := encodeGIF(t, 3)
+	if w, h := animationSize(data); w != 4 || h != 4 {
+		t.Fatalf("animationSize = %dx%d, want 4x4", w, h)
+	}
+
+	// Scaling down to 2 pixels, or keeping the original when gifsicle
+	// isn't there: either way the reported size is that of the result
+	p := &Processor{}
+	result, err := p.processAnimatedGIF(context.Background(), data, 3, 4, 4, 2, stageTimings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w, h := animationSize(result.Data); result.Width != w || result.Height != h {
+		t.Errorf("result is %dx%d, reported %dx%d", w, h, result.Width, result.Height)
+	}
+	if result.Frames != 3 || result.HasAlpha {
+		t.Errorf("result has %d frames, alpha %v, want 3 opaque ones", result.Frames, result.HasAlpha)
+	}
+}
+
+func TestGIFHasTransparency(t *testing.T) {
+	if gifHasTransparency(encodeGIF(t, 2)) {
+		t.Error("opaque GIF reported transparent")
+	}
+
+	anim := &gif.GIF{}
+	for i := 0; i < 2; i++ {
+		anim.Image = append(anim.Image, image.NewPaletted(image.Rect(0, 0, 4, 4), color.Palette{color.Transparent, color.White}))
+		anim.Delay = append(anim.Delay, 10)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		t.Fatal(err)
+	}
+	if !gifHasTransparency(buf.Bytes()) || !animationHasAlpha(buf.Bytes()) {
+		t.Error("GIF with a transparent color reported opaque")
+	}
+}
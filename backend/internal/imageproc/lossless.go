@@ -0,0 +1,85 @@
+package imageproc
+
+import (
+    "context"
+    "fmt"
+
+    "github.com/h2non/bimg"
+)
+
+// processLossless hosts an image pixel-exact: no resizing and no JPEG
+// conversion. PNGs go through oxipng and GIFs through gifsicle, JPEG and WebP
+// keep their encoded data with only metadata stripped. Anything else, and
+// images whose pixels were cropped or watermarked, become PNG.
+func (p *Processor) processLossless(ctx context.Context, data []byte, originalSize, frames int, opts ProcessOptions, timings stageTimings) (*ProcessResult, error) {
+    fmt.Println("💎 Lossless mode, keeping the source pixels and format...")
+
+    var err error
+    imageType := bimg.DetermineImageType(data)
+    if opts.cropRequested() {
+        done := timings.track(StageCrop)
+        data, err = applyCrop(data, opts)
+        done()
+        if err != nil {
+            return nil, err
+        }
+        imageType, frames = bimg.PNG, 1
+    }
+    if opts.Watermark {
+        done := timings.track(StageWatermark)
+        data, err = p.applyWatermark(data)
+        done()
+        if err != nil {
+            return nil, err
+        }
+        imageType, frames = bimg.PNG, 1
+    }
+
+    var processedData []byte
+    done := timings.track(StageOptimize)
+    switch imageType {
+    case bimg.JPEG, bimg.WEBP:
+        processedData = data
+    case bimg.GIF:
+        if processedData, err = optimizeWithGifsicle(ctx, data, 0, 0, 0); err != nil {
+            if ctx.Err() != nil {
+                return nil, ctx.Err()
+            }
+            fmt.Printf("⚠️ gifsicle optimization failed, keeping the original. Error: %v\n", err)
+            processedData = data
+        }
+    default:
+        // Anything that isn't PNG yet (BMP, TIFF, ...) is converted losslessly
+        if imageType != bimg.PNG {
+            if data, err = bimg.NewImage(data).Process(bimg.Options{Type: bimg.PNG, Compression: 1}); err != nil {
+                return nil, fmt.Errorf("failed to convert image to PNG: %v", err)
+            }
+            imageType = bimg.PNG
+        }
+        if processedData, err = compressWithOxipng(ctx, data, p.pngSettings(opts)); err != nil {
+            return nil, fmt.Errorf("oxipng compression failed: %w", err)
+        }
+    }
+    done()
+
+    processedData, err = p.stripMetadata(processedData)
+    if err != nil {
+        return nil, fmt.Errorf("failed to strip metadata: %v", err)
+    }
+
+    finalMetadata, err := bimg.NewImage(processedData).Metadata()
+    if err != nil {
+        return nil, fmt.Errorf("failed to read final image metadata: %v", err)
+    }
+
+    return &ProcessResult{
+        Data:           processedData,
+        ContentType:    "image/" + bimg.ImageTypeName(imageType),
+        Width:          finalMetadata.Size.Width,
+        Height:         finalMetadata.Size.Height,
+        HasAlpha:       finalMetadata.Alpha,
+        Frames:         max(1, frames),
+        OriginalSize:   originalSize,
+        CompressedSize: len(processedData),
+    }, nil
+}
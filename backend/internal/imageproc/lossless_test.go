@@ -0,0 +1,49 @@
+package imageproc
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/jpeg"
+	"testing"
+)
+
+func TestLosslessOptions(t *testing.T) {
+	if err := (ProcessOptions{Lossless: true}).Validate(); err != nil {
+		t.Errorf("lossless should be valid, got %v", err)
+	}
+	if err := (ProcessOptions{Lossless: true, MaxDimension: 800}).Validate(); err == nil {
+		t.Error("lossless with maxDimension should be rejected")
+	}
+	p := NewProcessor(Config{DefaultPreset: PresetWeb})
+	if !p.withPreset(ProcessOptions{Preset: PresetArchive}).Lossless {
+		t.Error("archive preset should be lossless")
+	}
+}
+
+func TestProcessLosslessKeepsJPEG(t *testing.T) {
+	var src bytes.Buffer
+	if err := jpeg.Encode(&src, image.NewGray(image.Rect(0, 0, 16, 8)), nil); err != nil {
+		t.Fatal(err)
+	}
+	var withMeta bytes.Buffer
+	withMeta.Write(src.Bytes()[:2])
+	writeJPEGSegment(&withMeta, 0xE1, testEXIF())
+	withMeta.Write(src.Bytes()[2:])
+
+	p := NewProcessor(Config{JPEGQuality: 84, MaxDimension: 8, DefaultPreset: PresetWeb})
+	result, err := p.processLossless(context.Background(), withMeta.Bytes(), withMeta.Len(), 1, ProcessOptions{Lossless: true}, stageTimings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.ContentType != "image/jpeg" {
+		t.Errorf("content type = %s, want the source's image/jpeg", result.ContentType)
+	}
+	// The encoded pixels are untouched and not resized, only the metadata goes
+	if !bytes.HasSuffix(result.Data, src.Bytes()[2:]) {
+		t.Error("lossless JPEG was re-encoded")
+	}
+	if bytes.Contains(result.Data, []byte("GPS-SECRET")) {
+		t.Error("lossless JPEG kept its metadata")
+	}
+}
@@ -0,0 +1,534 @@
+package imageproc
+
+import (
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "sort"
+    "strings"
+    "time"
+
+    "github.com/h2non/bimg"
+    "github.com/hackclub/format/internal/util"
+)
+
+// MetadataPolicy controls what survives metadata stripping. Everything else,
+// GPS coordinates, camera serial numbers, XMP and comments included, is
+// always removed.
+type MetadataPolicy struct {
+    KeepICC       bool // color profiles, dropping them shifts colors
+    KeepCopyright bool // EXIF Copyright/Artist and PNG Copyright/Author text
+}
+
+// EXIF tags carried over into the rebuilt EXIF block
+const (
+    exifTagOrientation = 0x0112
+    exifTagArtist      = 0x013B
+    exifTagCopyright   = 0x8298
+)
+
+// stripMetadata removes privacy-sensitive metadata from JPEG, PNG, WebP and
+// GIF data without re-encoding pixels. Other formats are returned as-is, the
+// main pipeline re-encodes them to one of these.
+func (p *Processor) stripMetadata(data []byte) ([]byte, error) {
+    switch {
+    case bytes.HasPrefix(data, []byte{0xFF, 0xD8}):
+        return stripJPEGMetadata(data, p.metadata)
+    case bytes.HasPrefix(data, pngSignature):
+        return stripPNGMetadata(data, p.metadata)
+    case isWebP(data):
+        return stripWebPMetadata(data, p.metadata)
+    case isGIF(data):
+        return stripGIFMetadata(data, p.metadata)
+    default:
+        return data, nil
+    }
+}
+
+// canStripMetadata reports whether stripMetadata strips data's format. Files
+// in other formats, like TIFF or AVIF, have to be re-encoded to lose their
+// EXIF.
+func canStripMetadata(data []byte) bool {
+    return bytes.HasPrefix(data, []byte{0xFF, 0xD8}) || bytes.HasPrefix(data, pngSignature) || isWebP(data) || isGIF(data)
+}
+
+func isWebP(data []byte) bool {
+    return len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP"
+}
+
+func isGIF(data []byte) bool {
+    return bytes.HasPrefix(data, []byte("GIF87a")) || bytes.HasPrefix(data, []byte("GIF89a"))
+}
+
+// stripJPEGMetadata drops APPn and COM segments except JFIF, Adobe and
+// (optionally) ICC profiles. The EXIF segment is rebuilt with only the
+// orientation, so photos don't end up sideways, and optionally copyright.
+func stripJPEGMetadata(data []byte, policy MetadataPolicy) ([]byte, error) {
+    out := bytes.NewBuffer(make([]byte, 0, len(data)))
+    out.Write(data[:2])
+
+    pos := 2
+    for pos < len(data) {
+        if data[pos] != 0xFF {
+            return nil, fmt.Errorf("malformed JPEG: expected marker at offset %d", pos)
+        }
+        // Skip fill bytes
+        for pos+1 < len(data) && data[pos+1] == 0xFF {
+            pos++
+        }
+        if pos+1 >= len(data) {
+            return nil, fmt.Errorf("malformed JPEG: truncated marker")
+        }
+        marker := data[pos+1]
+
+        // Standalone markers have no length
+        if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD9) {
+            out.Write(data[pos : pos+2])
+            pos += 2
+            if marker == 0xD9 {
+                break
+            }
+            continue
+        }
+
+        if pos+4 > len(data) {
+            return nil, fmt.Errorf("malformed JPEG: truncated segment")
+        }
+        end := pos + 2 + int(binary.BigEndian.Uint16(data[pos+2:pos+4]))
+        if end < pos+4 || end > len(data) {
+            return nil, fmt.Errorf("malformed JPEG: segment overruns file")
+        }
+        segment, payload := data[pos:end], data[pos+4:end]
+
+        switch {
+        case marker == 0xDA:
+            // Start of scan: entropy-coded data follows, no metadata past here
+            out.Write(data[pos:])
+            return out.Bytes(), nil
+        case marker == 0xE1 && bytes.HasPrefix(payload, []byte("Exif\x00\x00")):
+            if tiff := minimalEXIF(payload[6:], policy); tiff != nil {
+                writeJPEGSegment(out, 0xE1, append([]byte("Exif\x00\x00"), tiff...))
+            }
+        case marker == 0xE2 && bytes.HasPrefix(payload, []byte("ICC_PROFILE\x00")):
+            if policy.KeepICC {
+                out.Write(segment)
+            }
+        case marker == 0xE0, marker == 0xEE:
+            // JFIF and Adobe segments affect decoding
+            out.Write(segment)
+        case marker >= 0xE0 && marker <= 0xEF, marker == 0xFE:
+            // Other APPn (XMP, IPTC, MPF, maker data) and comments
+        default:
+            out.Write(segment)
+        }
+        pos = end
+    }
+    return out.Bytes(), nil
+}
+
+func writeJPEGSegment(out *bytes.Buffer, marker byte, payload []byte) {
+    out.Write([]byte{0xFF, marker})
+    binary.Write(out, binary.BigEndian, uint16(len(payload)+2))
+    out.Write(payload)
+}
+
+// minimalEXIF rebuilds a TIFF structure holding only the IFD0 tags we keep,
+// or returns nil if there are none. Sub-IFDs (EXIF, GPS, interop) are never
+// carried over.
+func minimalEXIF(tiff []byte, policy MetadataPolicy) []byte {
+    tags, order := readIFD0(tiff)
+    keep := []uint16{exifTagOrientation}
+    if policy.KeepCopyright {
+        keep = append(keep, exifTagArtist, exifTagCopyright)
+    }
+
+    type entry struct {
+        tag, typ uint16
+        count    uint32
+        value    []byte
+    }
+    var entries []entry
+    for _, tag := range keep {
+        if e, ok := tags[tag]; ok {
+            entries = append(entries, entry{tag, e.typ, e.count, e.value})
+        }
+    }
+    if len(entries) == 0 {
+        return nil
+    }
+    sort.Slice(entries, func(i, j int) bool { return entries[i].tag < entries[j].tag })
+
+    // Header, entry count, entries, next-IFD offset, then out-of-line values
+    var out bytes.Buffer
+    if order == binary.LittleEndian {
+        out.WriteString("II")
+    } else {
+        out.WriteString("MM")
+    }
+    binary.Write(&out, order, uint16(42))
+    binary.Write(&out, order, uint32(8))
+    binary.Write(&out, order, uint16(len(entries)))
+
+    dataOffset := 8 + 2 + 12*len(entries) + 4
+    var extra bytes.Buffer
+    for _, e := range entries {
+        binary.Write(&out, order, e.tag)
+        binary.Write(&out, order, e.typ)
+        binary.Write(&out, order, e.count)
+        if len(e.value) <= 4 {
+            inline := make([]byte, 4)
+            copy(inline, e.value)
+            out.Write(inline)
+        } else {
+            binary.Write(&out, order, uint32(dataOffset+extra.Len()))
+            extra.Write(e.value)
+            if extra.Len()%2 == 1 {
+                extra.WriteByte(0)
+            }
+        }
+    }
+    binary.Write(&out, order, uint32(0))
+    out.Write(extra.Bytes())
+    return out.Bytes()
+}
+
+type ifdEntry struct {
+    typ   uint16
+    count uint32
+    value []byte
+}
+
+// readIFD0 returns the IFD0 entries of a TIFF structure that have SHORT or
+// ASCII values, keyed by tag
+func readIFD0(tiff []byte) (map[uint16]ifdEntry, binary.ByteOrder) {
+    tags := make(map[uint16]ifdEntry)
+    if len(tiff) < 8 {
+        return tags, binary.BigEndian
+    }
+    var order binary.ByteOrder = binary.BigEndian
+    if string(tiff[:2]) == "II" {
+        order = binary.LittleEndian
+    }
+
+    ifd := int(order.Uint32(tiff[4:8]))
+    if ifd+2 > len(tiff) {
+        return tags, order
+    }
+    count := int(order.Uint16(tiff[ifd : ifd+2]))
+    for i := 0; i < count; i++ {
+        off := ifd + 2 + i*12
+        if off+12 > len(tiff) {
+            break
+        }
+        tag := order.Uint16(tiff[off : off+2])
+        typ := order.Uint16(tiff[off+2 : off+4])
+        n := order.Uint32(tiff[off+4 : off+8])
+
+        var size int
+        switch typ {
+        case 2: // ASCII
+            size = int(n)
+        case 3: // SHORT
+            size = int(n) * 2
+        default:
+            continue
+        }
+
+        var value []byte
+        if size <= 4 {
+            value = tiff[off+8 : off+8+size]
+        } else {
+            valueOff := int(order.Uint32(tiff[off+8 : off+12]))
+            if valueOff < 0 || valueOff+size > len(tiff) {
+                continue
+            }
+            value = tiff[valueOff : valueOff+size]
+        }
+        tags[tag] = ifdEntry{typ: typ, count: n, value: value}
+    }
+    return tags, order
+}
+
+// jpegOrientation returns the EXIF orientation (1-8) of a JPEG, 1 when it
+// has none. The Go decoders ignore it, so pixels decoded with them have to be
+// rotated by hand.
+func jpegOrientation(data []byte) int {
+    if !bytes.HasPrefix(data, []byte{0xFF, 0xD8}) {
+        return 1
+    }
+    pos := 2
+    for pos+4 <= len(data) && data[pos] == 0xFF {
+        marker := data[pos+1]
+        if marker == 0xDA || marker == 0xD9 {
+            break
+        }
+        end := pos + 2 + int(binary.BigEndian.Uint16(data[pos+2:pos+4]))
+        if end < pos+4 || end > len(data) {
+            break
+        }
+        payload := data[pos+4 : end]
+        if marker == 0xE1 && bytes.HasPrefix(payload, []byte("Exif\x00\x00")) {
+            tags, order := readIFD0(payload[6:])
+            if e, ok := tags[exifTagOrientation]; ok && e.typ == 3 && len(e.value) >= 2 {
+                if o := int(order.Uint16(e.value)); o >= 1 && o <= 8 {
+                    return o
+                }
+            }
+            return 1
+        }
+        pos = end
+    }
+    return 1
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// stripPNGMetadata drops eXIf, text and timestamp chunks, and iCCP unless
+// ICC profiles are kept
+func stripPNGMetadata(data []byte, policy MetadataPolicy) ([]byte, error) {
+    out := bytes.NewBuffer(make([]byte, 0, len(data)))
+    out.Write(pngSignature)
+
+    pos := len(pngSignature)
+    for pos < len(data) {
+        if pos+8 > len(data) {
+            return nil, fmt.Errorf("malformed PNG: truncated chunk header")
+        }
+        length := int(binary.BigEndian.Uint32(data[pos : pos+4]))
+        end := pos + 12 + length
+        if end > len(data) {
+            return nil, fmt.Errorf("malformed PNG: chunk overruns file")
+        }
+        chunkType := string(data[pos+4 : pos+8])
+        chunkData := data[pos+8 : pos+8+length]
+
+        keep := true
+        switch chunkType {
+        case "eXIf", "tIME":
+            keep = false
+        case "tEXt", "zTXt", "iTXt":
+            keyword, _, _ := bytes.Cut(chunkData, []byte{0})
+            keep = policy.KeepCopyright && (string(keyword) == "Copyright" || string(keyword) == "Author")
+        case "iCCP":
+            keep = policy.KeepICC
+        }
+        if keep {
+            out.Write(data[pos:end])
+        }
+
+        pos = end
+        if chunkType == "IEND" {
+            break
+        }
+    }
+    return out.Bytes(), nil
+}
+
+// VP8X feature flags
+const (
+    webpFlagICC  = 0x20
+    webpFlagEXIF = 0x08
+    webpFlagXMP  = 0x04
+)
+
+// stripWebPMetadata drops EXIF and XMP chunks, and ICCP unless ICC profiles
+// are kept, then fixes up the VP8X flags and RIFF size
+func stripWebPMetadata(data []byte, policy MetadataPolicy) ([]byte, error) {
+    var body bytes.Buffer
+    vp8xFlagsAt := -1
+    var dropped byte
+
+    pos := 12
+    for pos < len(data) {
+        if pos+8 > len(data) {
+            return nil, fmt.Errorf("malformed WebP: truncated chunk header")
+        }
+        fourCC := string(data[pos : pos+4])
+        size := int(binary.LittleEndian.Uint32(data[pos+4 : pos+8]))
+        end := pos + 8 + size + size%2
+        if end > len(data) {
+            return nil, fmt.Errorf("malformed WebP: chunk overruns file")
+        }
+
+        switch {
+        case fourCC == "EXIF":
+            dropped |= webpFlagEXIF
+        case fourCC == "XMP ":
+            dropped |= webpFlagXMP
+        case fourCC == "ICCP" && !policy.KeepICC:
+            dropped |= webpFlagICC
+        default:
+            if fourCC == "VP8X" && size >= 1 {
+                vp8xFlagsAt = body.Len() + 8
+            }
+            body.Write(data[pos:end])
+        }
+        pos = end
+    }
+
+    out := body.Bytes()
+    if vp8xFlagsAt >= 0 {
+        out[vp8xFlagsAt] &^= dropped
+    }
+
+    var buf bytes.Buffer
+    buf.WriteString("RIFF")
+    binary.Write(&buf, binary.LittleEndian, uint32(4+len(out)))
+    buf.WriteString("WEBP")
+    buf.Write(out)
+    return buf.Bytes(), nil
+}
+
+// GIF application extensions kept by stripGIFMetadata, the others (XMP
+// included) are dropped
+const (
+    gifAppNetscape = "NETSCAPE2.0" // loop count
+    gifAppAnimExts = "ANIMEXTS1.0" // loop count, older encoders
+    gifAppICC      = "ICCRGBG1012" // color profile
+)
+
+// stripGIFMetadata drops comment extensions and application extensions
+// other than loop counts, and the color profile unless ICC profiles are kept
+func stripGIFMetadata(data []byte, policy MetadataPolicy) ([]byte, error) {
+    if len(data) < 13 {
+        return nil, fmt.Errorf("malformed GIF: truncated header")
+    }
+    pos := 13
+    if flags := data[10]; flags&0x80 != 0 {
+        pos += 3 << ((flags & 0x07) + 1)
+    }
+    if pos > len(data) {
+        return nil, fmt.Errorf("malformed GIF: truncated color table")
+    }
+    out := bytes.NewBuffer(make([]byte, 0, len(data)))
+    out.Write(data[:pos])
+
+    for pos < len(data) {
+        start := pos
+        keep := true
+        switch data[pos] {
+        case 0x3B: // trailer
+            out.WriteByte(0x3B)
+            return out.Bytes(), nil
+        case 0x21: // extension
+            if pos+2 > len(data) {
+                return nil, fmt.Errorf("malformed GIF: truncated extension")
+            }
+            switch data[pos+1] {
+            case 0xFE: // comment
+                keep = false
+            case 0xFF: // application
+                if pos+3 > len(data) || pos+3+int(data[pos+2]) > len(data) {
+                    return nil, fmt.Errorf("malformed GIF: truncated application extension")
+                }
+                switch string(data[pos+3 : pos+3+int(data[pos+2])]) {
+                case gifAppNetscape, gifAppAnimExts:
+                case gifAppICC:
+                    keep = policy.KeepICC
+                default:
+                    keep = false
+                }
+            }
+            pos += 2
+        case 0x2C: // image
+            if pos+10 > len(data) {
+                return nil, fmt.Errorf("malformed GIF: truncated image descriptor")
+            }
+            if flags := data[pos+9]; flags&0x80 != 0 {
+                pos += 3 << ((flags & 0x07) + 1)
+            }
+            // Descriptor and LZW minimum code size
+            pos += 11
+        default:
+            return nil, fmt.Errorf("malformed GIF: unknown block 0x%02x", data[pos])
+        }
+        end, err := gifSubBlocksEnd(data, pos)
+        if err != nil {
+            return nil, err
+        }
+        if keep {
+            out.Write(data[start:end])
+        }
+        pos = end
+    }
+    return nil, fmt.Errorf("malformed GIF: missing trailer")
+}
+
+// gifSubBlocksEnd returns where the data sub-blocks starting at pos end,
+// after their terminator
+func gifSubBlocksEnd(data []byte, pos int) (int, error) {
+    for pos < len(data) {
+        size := int(data[pos])
+        pos += 1 + size
+        if size == 0 {
+            return pos, nil
+        }
+    }
+    return 0, fmt.Errorf("malformed GIF: truncated data sub-blocks")
+}
+
+// CaptureMetadata describes the uploaded file as it was before processing
+// and metadata stripping. Location and serial numbers are never included.
+type CaptureMetadata struct {
+    // Format is the MIME type of the upload
+    Format string `json:"format"`
+    // Camera is the EXIF make and model
+    Camera string `json:"camera,omitempty"`
+    // CapturedAt is the EXIF capture time, in the camera's local time
+    // without a zone (2006-01-02T15:04:05)
+    CapturedAt string `json:"captured_at,omitempty"`
+    // ColorSpace is the libvips interpretation, like srgb, cmyk or b-w
+    ColorSpace string `json:"color_space,omitempty"`
+    // ICCProfile is set when the upload carried a color profile
+    ICCProfile bool `json:"icc_profile,omitempty"`
+    Width      int  `json:"width,omitempty"`
+    Height     int  `json:"height,omitempty"`
+}
+
+// captureMetadata reads the CaptureMetadata of an upload. Files libvips
+// can't read, like SVGs, only get their format.
+func captureMetadata(data []byte) *CaptureMetadata {
+    contentType := util.DetectContentType(data)
+    metadata, err := bimg.NewImage(data).Metadata()
+    if err != nil {
+        return &CaptureMetadata{Format: contentType}
+    }
+    return newCaptureMetadata(metadata, contentType)
+}
+
+// exifTimeLayout is how EXIF writes dates
+const exifTimeLayout = "2006:01:02 15:04:05"
+
+func newCaptureMetadata(metadata bimg.ImageMetadata, contentType string) *CaptureMetadata {
+    capture := &CaptureMetadata{
+        Format:     contentType,
+        ColorSpace: metadata.Space,
+        ICCProfile: metadata.Profile,
+        Width:      metadata.Size.Width,
+        Height:     metadata.Size.Height,
+    }
+
+    // Models usually repeat the make, "Canon" "Canon EOS R5"
+    cameraMake, model := strings.TrimSpace(metadata.EXIF.Make), strings.TrimSpace(metadata.EXIF.Model)
+    switch {
+    case model == "":
+        capture.Camera = cameraMake
+    case cameraMake == "" || strings.HasPrefix(strings.ToLower(model), strings.ToLower(cameraMake)):
+        capture.Camera = model
+    default:
+        capture.Camera = cameraMake + " " + model
+    }
+
+    for _, value := range []string{metadata.EXIF.DateTimeOriginal, metadata.EXIF.DateTimeDigitized, metadata.EXIF.Datetime} {
+        // libvips appends the value's type, "2024:05:01 12:00:00 (2024:05:01 12:00:00, ASCII, 20 components, 20 bytes)"
+        value = strings.TrimSpace(value)
+        if len(value) < len(exifTimeLayout) {
+            continue
+        }
+        if t, err := time.Parse(exifTimeLayout, value[:len(exifTimeLayout)]); err == nil {
+            capture.CapturedAt = t.Format("2006-01-02T15:04:05")
+            break
+        }
+    }
+    return capture
+}
@@ -0,0 +1,206 @@
+package imageproc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/h2non/bimg"
+)
+
+// testEXIF builds a little-endian EXIF payload with Orientation, Copyright
+// and a GPSInfo pointer in IFD0
+func testEXIF() []byte {
+	var b bytes.Buffer
+	b.WriteString("Exif\x00\x00II")
+	le := binary.LittleEndian
+	binary.Write(&b, le, uint16(42))
+	binary.Write(&b, le, uint32(8))
+	binary.Write(&b, le, uint16(3))
+	// Orientation: SHORT 6, inline
+	binary.Write(&b, le, []uint16{exifTagOrientation, 3})
+	binary.Write(&b, le, uint32(1))
+	binary.Write(&b, le, []uint16{6, 0})
+	// Copyright: ASCII at offset 50
+	binary.Write(&b, le, []uint16{exifTagCopyright, 2})
+	binary.Write(&b, le, uint32(10))
+	binary.Write(&b, le, uint32(50))
+	// GPSInfo: LONG pointer to a GPS IFD
+	binary.Write(&b, le, []uint16{0x8825, 4})
+	binary.Write(&b, le, uint32(1))
+	binary.Write(&b, le, uint32(60))
+	binary.Write(&b, le, uint32(0))
+	b.WriteString("Hack Club\x00")
+	b.WriteString("GPS-SECRET")
+	return b.Bytes()
+}
+
+func TestStripJPEGMetadata(t *testing.T) {
+	var src bytes.Buffer
+	if err := jpeg.Encode(&src, image.NewGray(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var withMeta bytes.Buffer
+	withMeta.Write(src.Bytes()[:2])
+	writeJPEGSegment(&withMeta, 0xE1, testEXIF())
+	writeJPEGSegment(&withMeta, 0xE1, []byte("http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta>XMP-SECRET</x:xmpmeta>"))
+	writeJPEGSegment(&withMeta, 0xFE, []byte("COMMENT-SECRET"))
+	withMeta.Write(src.Bytes()[2:])
+
+	for _, keepCopyright := range []bool{false, true} {
+		out, err := stripJPEGMetadata(withMeta.Bytes(), MetadataPolicy{KeepCopyright: keepCopyright})
+		if err != nil {
+			t.Fatalf("stripJPEGMetadata: %v", err)
+		}
+		for _, secret := range []string{"GPS-SECRET", "XMP-SECRET", "COMMENT-SECRET"} {
+			if bytes.Contains(out, []byte(secret)) {
+				t.Errorf("output still contains %s", secret)
+			}
+		}
+		if _, err := jpeg.Decode(bytes.NewReader(out)); err != nil {
+			t.Errorf("stripped JPEG no longer decodes: %v", err)
+		}
+
+		exifStart := bytes.Index(out, []byte("Exif\x00\x00"))
+		if exifStart == -1 {
+			t.Fatal("EXIF with orientation was dropped")
+		}
+		tags, _ := readIFD0(out[exifStart+6:])
+		if o, ok := tags[exifTagOrientation]; !ok || o.value[0] != 6 {
+			t.Errorf("orientation not preserved: %+v", tags)
+		}
+		if _, ok := tags[exifTagCopyright]; ok != keepCopyright {
+			t.Errorf("copyright kept = %v, expected %v", ok, keepCopyright)
+		}
+		if _, ok := tags[0x8825]; ok {
+			t.Error("GPSInfo pointer survived")
+		}
+	}
+}
+
+func TestStripPNGMetadata(t *testing.T) {
+	var src bytes.Buffer
+	if err := png.Encode(&src, image.NewGray(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+
+	chunk := func(typ string, data []byte) []byte {
+		var c bytes.Buffer
+		binary.Write(&c, binary.BigEndian, uint32(len(data)))
+		c.WriteString(typ)
+		c.Write(data)
+		binary.Write(&c, binary.BigEndian, crc32.ChecksumIEEE(append([]byte(typ), data...)))
+		return c.Bytes()
+	}
+
+	// Insert metadata chunks right after IHDR
+	ihdrEnd := len(pngSignature) + 12 + 13
+	var withMeta bytes.Buffer
+	withMeta.Write(src.Bytes()[:ihdrEnd])
+	withMeta.Write(chunk("eXIf", testEXIF()[6:]))
+	withMeta.Write(chunk("tEXt", []byte("Comment\x00TEXT-SECRET")))
+	withMeta.Write(chunk("tEXt", []byte("Copyright\x00Hack Club")))
+	withMeta.Write(src.Bytes()[ihdrEnd:])
+
+	out, err := stripPNGMetadata(withMeta.Bytes(), MetadataPolicy{KeepCopyright: true})
+	if err != nil {
+		t.Fatalf("stripPNGMetadata: %v", err)
+	}
+	if bytes.Contains(out, []byte("GPS-SECRET")) || bytes.Contains(out, []byte("TEXT-SECRET")) {
+		t.Error("PNG metadata survived stripping")
+	}
+	if !bytes.Contains(out, []byte("Copyright\x00Hack Club")) {
+		t.Error("Copyright text chunk should be kept")
+	}
+	if _, err := png.Decode(bytes.NewReader(out)); err != nil {
+		t.Errorf("stripped PNG no longer decodes: %v", err)
+	}
+}
+
+func TestStripGIFMetadata(t *testing.T) {
+	var encoded bytes.Buffer
+	frame := image.NewPaletted(image.Rect(0, 0, 2, 2), color.Palette{color.Black, color.White})
+	if err := gif.EncodeAll(&encoded, &gif.GIF{Image: []*image.Paletted{frame, frame}, Delay: []int{10, 10}}); err != nil {
+		t.Fatal(err)
+	}
+	// Insert a comment and an XMP packet before the loop count
+	src := encoded.Bytes()
+	at := bytes.Index(src, []byte("\x21\xFF\x0B"+gifAppNetscape))
+	if at < 0 {
+		t.Fatal("encoded GIF has no loop count")
+	}
+	var extensions []byte
+	extensions = append(extensions, 0x21, 0xFE, 10)
+	extensions = append(extensions, "GPS-SECRET"...)
+	extensions = append(extensions, 0)
+	extensions = append(extensions, 0x21, 0xFF, 11)
+	extensions = append(extensions, "XMP DataXMP"...)
+	extensions = append(extensions, 11)
+	extensions = append(extensions, "GPS-SECRET2"...)
+	extensions = append(extensions, 0)
+	data := append(append(append([]byte{}, src[:at]...), extensions...), src[at:]...)
+
+	out, err := stripGIFMetadata(data, MetadataPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(out, []byte("GPS-SECRET")) {
+		t.Error("comment or XMP survived")
+	}
+	if !bytes.Contains(out, []byte(gifAppNetscape)) {
+		t.Error("loop count was dropped")
+	}
+	decoded, err := gif.DecodeAll(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("stripped GIF no longer decodes: %v", err)
+	}
+	if len(decoded.Image) != 2 {
+		t.Errorf("stripped GIF has %d frames, want 2", len(decoded.Image))
+	}
+}
+
+func TestCanStripMetadata(t *testing.T) {
+	tests := map[string]bool{
+		"\xFF\xD8\xFF\xE0":             true,
+		string(pngSignature):           true,
+		"RIFF\x00\x00\x00\x00WEBPVP8 ": true,
+		"GIF89a":                       true,
+		"II*\x00":                      false, // TIFF
+		"\x00\x00\x00\x1cftypavif":     false,
+	}
+	for data, want := range tests {
+		if got := canStripMetadata([]byte(data)); got != want {
+			t.Errorf("canStripMetadata(%q) = %v, want %v", data, got, want)
+		}
+	}
+}
+
+func TestNewCaptureMetadata(t *testing.T) {
+	var metadata bimg.ImageMetadata
+	metadata.Space = "srgb"
+	metadata.Profile = true
+	metadata.Size = bimg.ImageSize{Width: 4032, Height: 3024}
+	metadata.EXIF.Make = "Canon"
+	metadata.EXIF.Model = "Canon EOS R5"
+	metadata.EXIF.DateTimeOriginal = "2024:05:01 12:34:56 (2024:05:01 12:34:56, ASCII, 20 components, 20 bytes)"
+
+	got := newCaptureMetadata(metadata, "image/jpeg")
+	want := CaptureMetadata{Format: "image/jpeg", Camera: "Canon EOS R5", CapturedAt: "2024-05-01T12:34:56", ColorSpace: "srgb", ICCProfile: true, Width: 4032, Height: 3024}
+	if *got != want {
+		t.Errorf("newCaptureMetadata = %+v, want %+v", *got, want)
+	}
+
+	metadata.EXIF.Make, metadata.EXIF.Model = "Apple", "iPhone 15 Pro"
+	metadata.EXIF.DateTimeOriginal = "    :  :     :  :  "
+	got = newCaptureMetadata(metadata, "image/heic")
+	if got.Camera != "Apple iPhone 15 Pro" || got.CapturedAt != "" {
+		t.Errorf("newCaptureMetadata camera = %q, captured at %q, want Apple iPhone 15 Pro and none", got.Camera, got.CapturedAt)
+	}
+}
@@ -0,0 +1,110 @@
+package imageproc
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "fmt"
+    "math"
+    "os/exec"
+    "regexp"
+    "strconv"
+)
+
+// errPDFOutputTooLarge stops pdftoppm once its PNG outgrows what a page
+// within the max dimension can take
+var errPDFOutputTooLarge = errors.New("rendered page is too large")
+
+// renderPDFPage rasterizes the first page of a PDF to PNG with poppler's
+// pdftoppm, so one-page posters and flyers can be shown in email. The result
+// goes through the normal pipeline like any other PNG. Pages are rendered at
+// dpi but never beyond maxDimension, as the memory budget is only checked
+// after rendering.
+func renderPDFPage(ctx context.Context, input []byte, dpi, maxDimension int) ([]byte, error) {
+    width, height, err := pdfPageSize(ctx, input)
+    if err != nil {
+        // Unknown sizes are scaled to fit, which is always safe
+        fmt.Printf("⚠️  Could not read the PDF page size: %v\n", err)
+    }
+    scale := pdfScaleArgs(width, height, dpi, maxDimension)
+    fmt.Printf("📄 PDF detected, rendering the first page with %v...\n", scale)
+    // Reading "-" takes the PDF from stdin, and without an output root the
+    // single page is written to stdout
+    args := append([]string{"-png"}, scale...)
+    cmd := exec.CommandContext(ctx, "pdftoppm", append(args, "-f", "1", "-l", "1", "-singlefile", "-")...)
+
+    // An RGBA page within the max dimension, uncompressed, plus headers
+    out := &cappedBuffer{max: maxDimension*maxDimension*4 + 1<<20}
+    var stderr bytes.Buffer
+    cmd.Stdin = bytes.NewReader(input)
+    cmd.Stdout = out
+    cmd.Stderr = &stderr
+
+    if err := cmd.Run(); err != nil {
+        if out.exceeded {
+            return nil, fmt.Errorf("failed to render PDF: %w", errPDFOutputTooLarge)
+        }
+        return nil, fmt.Errorf("failed to render PDF: %v: %s", err, stderr.String())
+    }
+    if out.Len() == 0 {
+        return nil, fmt.Errorf("failed to render PDF: pdftoppm produced no output")
+    }
+    return out.Bytes(), nil
+}
+
+// pdfScaleArgs picks how pdftoppm sizes a page of width by height points:
+// at dpi, or scaled to fit maxDimension when that would be larger or the
+// size is unknown
+func pdfScaleArgs(width, height float64, dpi, maxDimension int) []string {
+    longest := math.Max(width, height) / 72 * float64(dpi)
+    if !(longest > 0) || longest > float64(maxDimension) {
+        return []string{"-scale-to", strconv.Itoa(maxDimension)}
+    }
+    return []string{"-r", strconv.Itoa(dpi)}
+}
+
+var pdfPageSizeRegex = regexp.MustCompile(`size:\s+([0-9.]+) x ([0-9.]+) pts`)
+
+// pdfPageSize reads the size in points of the first page of a PDF with
+// poppler's pdfinfo
+func pdfPageSize(ctx context.Context, input []byte) (float64, float64, error) {
+    cmd := exec.CommandContext(ctx, "pdfinfo", "-f", "1", "-l", "1", "-")
+    cmd.Stdin = bytes.NewReader(input)
+    out, err := cmd.Output()
+    if err != nil {
+        return 0, 0, err
+    }
+    return parsePDFPageSize(string(out))
+}
+
+// parsePDFPageSize reads the page size of pdfinfo's output
+func parsePDFPageSize(info string) (float64, float64, error) {
+    match := pdfPageSizeRegex.FindStringSubmatch(info)
+    if match == nil {
+        return 0, 0, fmt.Errorf("no page size in pdfinfo output")
+    }
+    width, err := strconv.ParseFloat(match[1], 64)
+    if err != nil {
+        return 0, 0, err
+    }
+    height, err := strconv.ParseFloat(match[2], 64)
+    if err != nil {
+        return 0, 0, err
+    }
+    return width, height, nil
+}
+
+// cappedBuffer is a bytes.Buffer refusing writes past max bytes
+type cappedBuffer struct {
+    bytes.Buffer
+    max      int
+    exceeded bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+    if b.Len()+len(p) > b.max {
+        b.exceeded = true
+        return 0, errPDFOutputTooLarge
+    }
+    return b.Buffer.Write(p)
+}
@@ -0,0 +1,92 @@
+package imageproc
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	_ "image/png"
+	"os/exec"
+	"reflect"
+	"testing"
+)
+
+// onePagePDF builds a PDF whose single empty page has the given MediaBox
+func onePagePDF(width, height int) []byte {
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] >>", width, height),
+	}
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, object := range objects {
+		offsets[i] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return buf.Bytes()
+}
+
+func TestPDFScaleArgs(t *testing.T) {
+	tests := []struct {
+		name          string
+		width, height float64
+		want          []string
+	}{
+		{"letter at the DPI", 612, 792, []string{"-r", "150"}},
+		{"oversized MediaBox scaled to fit", 14400, 14400, []string{"-scale-to", "2000"}},
+		{"landscape just over", 13440, 100, []string{"-scale-to", "2000"}},
+		{"unknown size scaled to fit", 0, 0, []string{"-scale-to", "2000"}},
+	}
+	for _, tt := range tests {
+		if got := pdfScaleArgs(tt.width, tt.height, 150, 2000); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: pdfScaleArgs = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParsePDFPageSize(t *testing.T) {
+	info := "Pages:          1\nPage    1 size: 14400 x 14400 pts\nPage    1 rot:  0\n"
+	width, height, err := parsePDFPageSize(info)
+	if err != nil || width != 14400 || height != 14400 {
+		t.Errorf("parsePDFPageSize = %v, %v, %v", width, height, err)
+	}
+	if _, _, err := parsePDFPageSize("Pages: 1\n"); err == nil {
+		t.Error("parsePDFPageSize should fail without a page size")
+	}
+}
+
+func TestCappedBuffer(t *testing.T) {
+	buf := &cappedBuffer{max: 4}
+	if _, err := buf.Write([]byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := buf.Write([]byte("de")); err != errPDFOutputTooLarge || !buf.exceeded {
+		t.Errorf("writing past the cap got %v", err)
+	}
+}
+
+func TestRenderOversizedPDFPage(t *testing.T) {
+	if _, err := exec.LookPath("pdftoppm"); err != nil {
+		t.Skip("pdftoppm is not installed")
+	}
+	// 200 inches square, 30000px at 150 DPI
+	data, err := renderPDFPage(context.Background(), onePagePDF(14400, 14400), 150, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Width > 1000 || config.Height > 1000 {
+		t.Errorf("rendered page is %dx%d, want at most 1000x1000", config.Width, config.Height)
+	}
+}
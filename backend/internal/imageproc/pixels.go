@@ -0,0 +1,90 @@
+package imageproc
+
+import (
+    "image"
+    "image/draw"
+
+    xdraw "golang.org/x/image/draw"
+    _ "golang.org/x/image/tiff" // register decoders for image.Decode
+    _ "golang.org/x/image/webp"
+)
+
+// scaleToFit scales img down to fit within maxDimension after applying the
+// EXIF orientation, and returns the upright result. The scaling happens
+// before the rotation so the rotation only touches the smaller image.
+func scaleToFit(img image.Image, orientation, maxDimension int) image.Image {
+    bounds := img.Bounds()
+    width, height := bounds.Dx(), bounds.Dy()
+    swapped := orientation >= 5 && orientation <= 8 // rotated by 90 degrees
+    if swapped {
+        width, height = height, width
+    }
+
+    if maxDimension > 0 && needsResize(width, height, maxDimension) {
+        width, height = calculateDimensionsWithMax(width, height, maxDimension)
+        if swapped {
+            width, height = height, width
+        }
+        scaled := image.NewRGBA(image.Rect(0, 0, width, height))
+        xdraw.CatmullRom.Scale(scaled, scaled.Bounds(), img, bounds, draw.Src, nil)
+        img = scaled
+    }
+
+    if orientation <= 1 || orientation > 8 {
+        return img
+    }
+    return orient(toRGBA(img), orientation)
+}
+
+func toRGBA(img image.Image) *image.RGBA {
+    if rgba, ok := img.(*image.RGBA); ok {
+        return rgba
+    }
+    rgba := image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+    draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Src)
+    return rgba
+}
+
+// flattenOnWhite composites an image with transparency onto white
+func flattenOnWhite(img image.Image) *image.RGBA {
+    rgba := image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+    draw.Draw(rgba, rgba.Bounds(), image.White, image.Point{}, draw.Src)
+    draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Over)
+    return rgba
+}
+
+// orient applies an EXIF orientation (2-8) by copying pixels
+func orient(src *image.RGBA, orientation int) *image.RGBA {
+    w, h := src.Bounds().Dx(), src.Bounds().Dy()
+    dw, dh := w, h
+    if orientation >= 5 {
+        dw, dh = h, w
+    }
+    dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+
+    for y := 0; y < h; y++ {
+        for x := 0; x < w; x++ {
+            var dx, dy int
+            switch orientation {
+            case 2: // mirrored horizontally
+                dx, dy = w-1-x, y
+            case 3: // rotated 180
+                dx, dy = w-1-x, h-1-y
+            case 4: // mirrored vertically
+                dx, dy = x, h-1-y
+            case 5: // mirrored along the top-left diagonal
+                dx, dy = y, x
+            case 6: // rotated 90 clockwise
+                dx, dy = h-1-y, x
+            case 7: // mirrored along the top-right diagonal
+                dx, dy = h-1-y, w-1-x
+            case 8: // rotated 90 counter-clockwise
+                dx, dy = y, w-1-x
+            }
+            si := src.PixOffset(x+src.Rect.Min.X, y+src.Rect.Min.Y)
+            di := dst.PixOffset(dx, dy)
+            copy(dst.Pix[di:di+4], src.Pix[si:si+4])
+        }
+    }
+    return dst
+}
@@ -0,0 +1,68 @@
+package imageproc
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func TestScaleToFitOrientation(t *testing.T) {
+	// 4x2 image with a red top-left pixel, stored rotated (orientation 6)
+	src := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	src.Set(0, 0, color.RGBA{255, 0, 0, 255})
+
+	out := scaleToFit(src, 6, 0)
+	if out.Bounds().Dx() != 2 || out.Bounds().Dy() != 4 {
+		t.Fatalf("expected 2x4 after rotation, got %dx%d", out.Bounds().Dx(), out.Bounds().Dy())
+	}
+	// Rotating 90 degrees clockwise moves the top-left pixel to the top-right
+	if r, _, _, _ := out.At(1, 0).RGBA(); r != 0xffff {
+		t.Errorf("expected the red pixel at (1, 0)")
+	}
+}
+
+func TestScaleToFitMaxDimension(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 400, 200))
+
+	out := scaleToFit(src, 8, 100)
+	if out.Bounds().Dx() != 50 || out.Bounds().Dy() != 100 {
+		t.Errorf("expected 50x100, got %dx%d", out.Bounds().Dx(), out.Bounds().Dy())
+	}
+}
+
+func TestShrinkOnLoadFactor(t *testing.T) {
+	var jpegData bytes.Buffer
+	if err := jpeg.Encode(&jpegData, image.NewRGBA(image.Rect(0, 0, 1, 1)), nil); err != nil {
+		t.Fatal(err)
+	}
+	var pngData bytes.Buffer
+	if err := png.Encode(&pngData, image.NewRGBA(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		data          []byte
+		width, height int
+		maxDimension  int
+		want          int
+	}{
+		{"fits", jpegData.Bytes(), 2000, 1000, 2048, 1},
+		{"slightly too large", jpegData.Bytes(), 3000, 2000, 2048, 1},
+		{"twice too large", jpegData.Bytes(), 6000, 4000, 2048, 2},
+		{"portrait", jpegData.Bytes(), 4000, 12000, 2048, 4},
+		{"huge", jpegData.Bytes(), 40000, 30000, 2048, 8},
+		{"no maximum", jpegData.Bytes(), 40000, 30000, 0, 1},
+		{"png", pngData.Bytes(), 40000, 30000, 2048, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := shrinkOnLoadFactor(tt.data, tt.width, tt.height, tt.maxDimension); got != tt.want {
+				t.Errorf("shrinkOnLoadFactor = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
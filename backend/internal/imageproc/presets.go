@@ -0,0 +1,61 @@
+package imageproc
+
+import "image"
+
+// Named presets for ProcessOptions.Preset
+const (
+    PresetEmail   = "email"   // email-width JPEGs, SVG and animated WebP made mail client safe
+    PresetWeb     = "web"     // full quality at the configured maximum size
+    PresetArchive = "archive" // the original pixels and format, losslessly optimized
+)
+
+// Preset is a set of processing defaults. Zero values fall back to the
+// configured defaults.
+type Preset struct {
+    MaxDimension int
+    Quality      int
+    Subsampling  image.YCbCrSubsampleRatio // JPEG chroma subsampling, 4:4:4 by default
+    Lossless     bool
+    RasterizeSVG bool
+    AnimatedGIF  bool // animated WebP becomes GIF for clients that can't play it
+}
+
+var presets = map[string]Preset{
+    PresetEmail: {
+        MaxDimension: 1200,
+        Quality:      82,
+        Subsampling:  image.YCbCrSubsampleRatio420,
+        RasterizeSVG: true,
+        AnimatedGIF:  true,
+    },
+    PresetWeb: {},
+    PresetArchive: {
+        Lossless: true,
+    },
+}
+
+// IsValidPreset reports whether name is a known preset, or empty for the
+// configured default
+func IsValidPreset(name string) bool {
+    _, ok := presets[name]
+    return ok || name == ""
+}
+
+// withPreset resolves the request's preset, or the configured default, and
+// fills in everything the request didn't set itself from it
+func (p *Processor) withPreset(opts ProcessOptions) ProcessOptions {
+    if opts.Preset == "" {
+        opts.Preset = p.defaultPreset
+    }
+    preset := presets[opts.Preset]
+    opts.Lossless = opts.Lossless || preset.Lossless
+    // Lossless output is never resized
+    if opts.MaxDimension == 0 && !opts.Lossless {
+        opts.MaxDimension = preset.MaxDimension
+    }
+    if opts.Quality == 0 {
+        opts.Quality = preset.Quality
+    }
+    opts.RasterizeSVG = opts.RasterizeSVG || preset.RasterizeSVG
+    return opts
+}
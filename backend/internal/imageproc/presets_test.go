@@ -0,0 +1,48 @@
+package imageproc
+
+import "testing"
+
+func TestWithPreset(t *testing.T) {
+	p := &Processor{defaultPreset: PresetWeb}
+
+	opts := p.withPreset(ProcessOptions{})
+	if opts.Preset != PresetWeb || opts.MaxDimension != 0 || opts.Quality != 0 {
+		t.Errorf("default preset should leave the configured defaults, got %+v", opts)
+	}
+
+	opts = p.withPreset(ProcessOptions{Preset: PresetEmail, Quality: 90})
+	if opts.MaxDimension != 1200 || opts.Quality != 90 || !opts.RasterizeSVG {
+		t.Errorf("email preset should fill unset options only, got %+v", opts)
+	}
+
+	opts = p.withPreset(ProcessOptions{Preset: PresetEmail, Lossless: true})
+	if opts.MaxDimension != 0 {
+		t.Errorf("lossless requests shouldn't get a dimension cap, got %d", opts.MaxDimension)
+	}
+
+	if err := (ProcessOptions{Preset: PresetArchive, MaxDimension: 800}).Validate(); err == nil {
+		t.Error("archive preset with maxDimension should be rejected")
+	}
+	if err := (ProcessOptions{Preset: "print"}).Validate(); err == nil {
+		t.Error("unknown preset should be rejected")
+	}
+}
+
+func TestWebPQuality(t *testing.T) {
+	p := NewProcessor(Config{JPEGQuality: 84, WebPQuality: 75, DefaultPreset: PresetWeb})
+	if got := p.webpQualityFor(p.withPreset(ProcessOptions{})); got != 75 {
+		t.Errorf("default WebP quality = %d, want the configured 75", got)
+	}
+	if got := p.webpQualityFor(p.withPreset(ProcessOptions{Preset: PresetEmail})); got != presets[PresetEmail].Quality {
+		t.Errorf("email WebP quality = %d, want the preset's %d", got, presets[PresetEmail].Quality)
+	}
+	if got := p.webpQualityFor(ProcessOptions{Quality: 60}); got != 60 {
+		t.Errorf("requested WebP quality = %d, want 60", got)
+	}
+	if got := p.jpegSettings(p.withPreset(ProcessOptions{})).quality; got != 84 {
+		t.Errorf("JPEG quality = %d, want 84 regardless of WebP's", got)
+	}
+	if got := NewProcessor(Config{JPEGQuality: 84}).webpQualityFor(ProcessOptions{}); got != 84 {
+		t.Errorf("unset WebP quality = %d, want JPEG's 84", got)
+	}
+}
@@ -0,0 +1,44 @@
+package imageproc
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "fmt"
+    "os/exec"
+)
+
+// pngquant exit codes for results it refused to write
+const (
+    pngquantTooLarge   = 98 // --skip-if-larger: the palette PNG wasn't smaller
+    pngquantLowQuality = 99 // the palette couldn't reach the --quality floor
+)
+
+// quantizePNG reduces a PNG to a palette of at most 256 colors with pngquant.
+// That's lossy, but shrinks UI screenshots and diagrams dramatically. When
+// the result would look worse than minQuality (0-100) or wouldn't be
+// smaller, it returns nil without an error and the caller keeps the lossless
+// PNG.
+func quantizePNG(ctx context.Context, input []byte, minQuality int) ([]byte, error) {
+    cmd := exec.CommandContext(ctx, "pngquant", fmt.Sprintf("--quality=%d-100", minQuality), "--speed", "3", "--skip-if-larger", "--strip", "-")
+
+    var out, stderr bytes.Buffer
+    cmd.Stdin = bytes.NewReader(input)
+    cmd.Stdout = &out
+    cmd.Stderr = &stderr
+
+    if err := cmd.Run(); err != nil {
+        if ctx.Err() != nil {
+            return nil, ctx.Err()
+        }
+        var exitErr *exec.ExitError
+        if errors.As(err, &exitErr) && (exitErr.ExitCode() == pngquantLowQuality || exitErr.ExitCode() == pngquantTooLarge) {
+            return nil, nil
+        }
+        return nil, fmt.Errorf("%v: %s", err, stderr.String())
+    }
+    if out.Len() == 0 {
+        return nil, nil
+    }
+    return out.Bytes(), nil
+}
@@ -0,0 +1,105 @@
+package imageproc
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"math/rand"
+	"os/exec"
+	"testing"
+)
+
+func TestQuantizeSettings(t *testing.T) {
+	yes, no := true, false
+	on := NewProcessor(Config{PNGQuantize: true, QuantizeQuality: 70})
+	off := NewProcessor(Config{})
+	tests := []struct {
+		name string
+		p    *Processor
+		opts ProcessOptions
+		want bool
+	}{
+		{"configured", on, ProcessOptions{}, true},
+		{"turned off by the request", on, ProcessOptions{Quantize: &no}, false},
+		{"not configured", off, ProcessOptions{}, false},
+		{"requested", off, ProcessOptions{Quantize: &yes}, true},
+		{"lossless", on, ProcessOptions{Lossless: true}, false},
+		{"lossless and requested", off, ProcessOptions{Lossless: true, Quantize: &yes}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.p.pngSettings(tt.opts).quantize; got != tt.want {
+				t.Errorf("quantize = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	for _, opts := range []ProcessOptions{{Lossless: true, Quantize: &yes}, {Preset: PresetArchive, Quantize: &yes}} {
+		if err := opts.Validate(); err == nil {
+			t.Errorf("quantize with lossless %+v should be rejected", opts)
+		}
+	}
+}
+
+// testPNG encodes a w x h image with fill setting each pixel
+func testPNG(t *testing.T, w, h int, fill func(x, y int) color.Color) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, fill(x, y))
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestQuantizeKeepsLosslessOnFailure(t *testing.T) {
+	// pngquant rejects it, or isn't installed: either way the input is kept
+	p := NewProcessor(Config{PNGQuantize: true, QuantizeQuality: 70})
+	input := []byte("\x89PNG\r\n\x1a\nnot really")
+	out, err := p.quantize(context.Background(), input, stageTimings{})
+	if err != nil || !bytes.Equal(out, input) {
+		t.Errorf("quantize = %q, %v, want the input back", out, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := p.quantize(ctx, input, stageTimings{}); err == nil {
+		t.Error("quantize should give up when cancelled")
+	}
+}
+
+func TestQuantizePNG(t *testing.T) {
+	if _, err := exec.LookPath("pngquant"); err != nil {
+		t.Skip("pngquant is not installed")
+	}
+	ctx := context.Background()
+
+	// A screenshot: a few flat colors
+	palette := []color.Color{color.White, color.Black, color.RGBA{0xec, 0x37, 0x50, 0xff}, color.RGBA{0x33, 0x8e, 0xda, 0xff}}
+	screenshot := testPNG(t, 256, 256, func(x, y int) color.Color { return palette[(x/32+y/64)%len(palette)] })
+	out, err := quantizePNG(ctx, screenshot, 70)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// IHDR's color type, after the signature, chunk length and type, and 9
+	// bytes of header, is 3 for palette PNGs
+	if out == nil || out[8+8+9] != 3 || len(out) >= len(screenshot) {
+		t.Errorf("screenshot wasn't quantized to a smaller palette PNG")
+	}
+
+	// Noise can't keep a perfect score with 256 colors
+	rng := rand.New(rand.NewSource(1))
+	noise := testPNG(t, 128, 128, func(x, y int) color.Color {
+		return color.RGBA{uint8(rng.Intn(256)), uint8(rng.Intn(256)), uint8(rng.Intn(256)), 0xff}
+	})
+	if out, err := quantizePNG(ctx, noise, 100); err != nil || out != nil {
+		t.Errorf("quantizePNG(noise) = %d bytes, %v, want nil below the quality floor", len(out), err)
+	}
+}
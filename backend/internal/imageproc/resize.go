@@ -0,0 +1,141 @@
+package imageproc
+
+import (
+    "context"
+    "fmt"
+
+    "github.com/h2non/bimg"
+)
+
+// Fit modes for Resize
+const (
+    FitContain = "contain" // fit inside the box, keeping aspect ratio (default)
+    FitCover   = "cover"   // fill the box, cropping the overflow
+    FitFill    = "fill"    // stretch to exactly the box
+)
+
+// IsValidFit reports whether fit is a supported fit mode
+func IsValidFit(fit string) bool {
+    switch fit {
+    case "", FitContain, FitCover, FitFill:
+        return true
+    default:
+        return false
+    }
+}
+
+// Resize renders an already processed image at a display size, keeping its
+// format. Either dimension may be 0 to scale by the other one. Images are
+// never enlarged.
+func (p *Processor) Resize(ctx context.Context, data []byte, width, height int, fit string) (*ProcessResult, error) {
+    if width == 0 && height == 0 {
+        return nil, fmt.Errorf("width or height is required")
+    }
+    return p.Render(ctx, data, width, height, fit, "")
+}
+
+// MaxDimension is the largest width or height Render renders at
+func (p *Processor) MaxDimension() int {
+    return p.maxDimension
+}
+
+// ImageSize reads the width and height of an image without decoding it
+func ImageSize(data []byte) (int, int, error) {
+    size, err := bimg.NewImage(data).Size()
+    if err != nil {
+        return 0, 0, fmt.Errorf("failed to read image size: %v", err)
+    }
+    return size.Width, size.Height, nil
+}
+
+// Render is Resize with an output format, jpeg, png or webp, or empty to keep
+// the image's. Without dimensions the image keeps its size and is only
+// converted.
+func (p *Processor) Render(ctx context.Context, data []byte, width, height int, fit, format string) (*ProcessResult, error) {
+    if width < 0 || height < 0 || width > p.maxDimension || height > p.maxDimension {
+        return nil, fmt.Errorf("dimensions must be between 1 and %d", p.maxDimension)
+    }
+    if !IsValidFit(fit) {
+        return nil, fmt.Errorf("unknown fit %q", fit)
+    }
+    var outputType bimg.ImageType
+    switch format {
+    case "":
+    case FormatJPEG:
+        outputType = bimg.JPEG
+    case FormatPNG:
+        outputType = bimg.PNG
+    case FormatWebP:
+        outputType = bimg.WEBP
+    default:
+        return nil, fmt.Errorf("unknown format %q, expected jpeg, png or webp", format)
+    }
+    ctx, cancel := p.withTimeout(ctx)
+    defer cancel()
+    release, err := p.acquireWorker(ctx)
+    if err != nil {
+        return nil, err
+    }
+    defer release()
+
+    imageType := bimg.DetermineImageType(data)
+    switch imageType {
+    case bimg.JPEG, bimg.PNG, bimg.WEBP:
+    default:
+        return nil, fmt.Errorf("resizing %s images is not supported", bimg.ImageTypeName(imageType))
+    }
+    if outputType == bimg.UNKNOWN {
+        outputType = imageType
+    }
+
+    options := bimg.Options{
+        Width:         width,
+        Height:        height,
+        Type:          outputType,
+        Quality:       p.jpegQuality,
+        Interlace:     outputType == bimg.JPEG && p.jpegProgressive,
+        StripMetadata: true,
+    }
+    if outputType == bimg.WEBP {
+        options.Quality = p.webpQualityFor(ProcessOptions{})
+    }
+    // A box fit only differs from scaling when both dimensions are given
+    if width > 0 && height > 0 {
+        switch fit {
+        case FitCover:
+            options.Crop = true
+            options.Gravity = bimg.GravityCentre
+        case FitFill:
+            options.Force = true
+        }
+    }
+
+    resized, err := bimg.NewImage(data).Process(options)
+    if err != nil {
+        return nil, fmt.Errorf("failed to resize image: %v", err)
+    }
+    if outputType == bimg.PNG {
+        if resized, err = compressWithOxipng(ctx, resized, p.pngSettings(ProcessOptions{})); err != nil {
+            return nil, fmt.Errorf("oxipng compression failed: %w", err)
+        }
+    }
+    if resized, err = p.stripMetadata(resized); err != nil {
+        return nil, fmt.Errorf("failed to strip metadata: %v", err)
+    }
+
+    metadata, err := bimg.NewImage(resized).Metadata()
+    if err != nil {
+        return nil, fmt.Errorf("failed to read resized image metadata: %v", err)
+    }
+
+    return &ProcessResult{
+        Data:           resized,
+        ContentType:    "image/" + bimg.ImageTypeName(outputType),
+        Width:          metadata.Size.Width,
+        Height:         metadata.Size.Height,
+        HasAlpha:       metadata.Alpha,
+        Frames:         1,
+        OriginalSize:   len(data),
+        CompressedSize: len(resized),
+    }, nil
+}
@@ -0,0 +1,67 @@
+package imageproc
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSanitizeSVG(t *testing.T) {
+	input := `<?xml version="1.0"?>
+<?xml-stylesheet href="https://evil.example/style.css"?>
+<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" onload="alert(1)" width="10" height="10">
+<script type="text/javascript">alert(2)</script>
+<foreignObject width="10" height="10"><body><iframe src="https://evil.example"></iframe></body></foreignObject>
+<a xlink:href="javascript:alert(3)"><rect width="10" height="10" onclick='alert(4)' fill="red"/></a>
+<x:script xmlns:x="http://www.w3.org/2000/svg">alert(5)</x:script>
+<a href="&#106;avascript:alert(6)"><circle r="1"/></a>
+<a href=" java&#x09;script:alert(7)"><circle r="2"/></a>
+<a href="#"><set attributeName="href" to="javascript:alert(8)"/></a>
+<a href="#"><animate attributeName="xlink:href" values="javascript:alert(9)"/></a>
+<image href="data:image/svg+xml;base64,PHN2Zz48L3N2Zz4=" width="1" height="1"/>
+<use href="https://evil.example/sprite.svg#icon"/>
+<style>@import url(https://evil.example/track.css);</style>
+<h:div xmlns:h="http://www.w3.org/1999/xhtml"><h:script>alert(10)</h:script></h:div>
+<use href="#shape"/>
+<a href="https://hackclub.com"><text x="1" y="5" style="font-weight:bold">Hack Club &amp; friends</text></a>
+<animateTransform attributeName="transform" type="rotate" from="0" to="360" dur="2s"/>
+<image xlink:href="data:image/png;base64,iVBORw0KGgo=" width="1" height="1"/>
+</svg>`
+
+	sanitized, err := sanitizeSVG([]byte(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(sanitized)
+
+	for _, banned := range []string{"<!DOCTYPE", "xml-stylesheet", "onload", "onclick", "script", "alert", "foreignObject", "iframe", "<set", "<animate ", "image/svg+xml", "evil.example", "div"} {
+		if strings.Contains(got, banned) {
+			t.Errorf("sanitized SVG still contains %q:\n%s", banned, got)
+		}
+	}
+	for _, kept := range []string{
+		`<svg xmlns="http://www.w3.org/2000/svg"`,
+		`fill="red"`,
+		`<use href="#shape">`,
+		`<a href="https://hackclub.com">`,
+		`style="font-weight:bold"`,
+		`Hack Club &amp; friends`,
+		`<animateTransform attributeName="transform"`,
+		`xlink:href="data:image/png;base64,iVBORw0KGgo="`,
+	} {
+		if !strings.Contains(got, kept) {
+			t.Errorf("sanitized SVG lost %q:\n%s", kept, got)
+		}
+	}
+}
+
+func TestSanitizeSVGRejects(t *testing.T) {
+	for name, input := range map[string]string{
+		"external entity": `<!DOCTYPE svg [<!ENTITY xxe SYSTEM "file:///etc/passwd">]><svg xmlns="http://www.w3.org/2000/svg"><text>&xxe;</text></svg>`,
+		"malformed":       `<svg xmlns="http://www.w3.org/2000/svg"><g></svg>`,
+		"other root":      `<html xmlns="http://www.w3.org/1999/xhtml"><svg xmlns="http://www.w3.org/2000/svg"/></html>`,
+	} {
+		if got, err := sanitizeSVG([]byte(input)); err == nil {
+			t.Errorf("%s: sanitizeSVG = %s, want an error", name, got)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package imageproc
+
+import (
+    "time"
+
+    "github.com/hackclub/format/internal/metrics"
+)
+
+// Pipeline stages reported in ProcessResult.Timings and the
+// format_processing_stage_seconds metric
+const (
+    StageDecode    = "decode"
+    StageResize    = "resize"
+    StageEncode    = "encode"
+    StageOptimize  = "optimize"
+    StageQuantize  = "quantize"
+    StageCrop      = "crop"
+    StageWatermark = "watermark"
+    StageMetadata  = "metadata"
+    StageBlurHash  = "blurhash"
+    StageVariants  = "variants"
+)
+
+// stageTimings accumulates the time spent per stage of one image. A nil
+// stageTimings still reports to the metrics.
+type stageTimings map[string]time.Duration
+
+// track starts timing stage and returns the function that stops it
+func (t stageTimings) track(stage string) func() {
+    start := time.Now()
+    return func() {
+        elapsed := time.Since(start)
+        if t != nil {
+            t[stage] += elapsed
+        }
+        metrics.ProcessingStageDuration.WithLabelValues(stage).Observe(elapsed.Seconds())
+    }
+}
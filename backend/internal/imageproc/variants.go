@@ -0,0 +1,91 @@
+package imageproc
+
+import (
+    "context"
+    "fmt"
+
+    "github.com/h2non/bimg"
+)
+
+// VariantFull names the processed image itself
+const VariantFull = "full"
+
+// variantWidths are the named sizes that can be requested besides "full"
+var variantWidths = map[string]int{
+    "thumb":  320,
+    "medium": 1200,
+}
+
+// IsValidVariant reports whether name is a known variant
+func IsValidVariant(name string) bool {
+    _, ok := variantWidths[name]
+    return ok || name == VariantFull
+}
+
+type VariantResult struct {
+    Name        string
+    Data        []byte
+    ContentType string
+    Width       int
+    Height      int
+}
+
+// generateVariants renders the requested sizes from the processed image,
+// in the same format. Sizes at or above the image's own width aren't
+// rendered, the full image already serves them. Animated and vector output
+// is left alone.
+func (p *Processor) generateVariants(ctx context.Context, result *ProcessResult, opts ProcessOptions) ([]VariantResult, error) {
+    if result.ContentType != "image/jpeg" && result.ContentType != "image/png" && !(result.ContentType == "image/webp" && result.Frames <= 1) {
+        return nil, nil
+    }
+
+    var variants []VariantResult
+    for _, name := range opts.Variants {
+        width, ok := variantWidths[name]
+        if !ok || width >= result.Width {
+            continue
+        }
+        if err := ctx.Err(); err != nil {
+            return nil, err
+        }
+
+        fmt.Printf("📐 Rendering %s variant at %dpx wide...\n", name, width)
+        resized, err := bimg.NewImage(result.Data).Process(bimg.Options{
+            Width:   width,
+            Type:    bimg.PNG, // lossless intermediate for the encoders below
+            Quality: 100,
+        })
+        if err != nil {
+            return nil, fmt.Errorf("failed to resize %s variant: %v", name, err)
+        }
+
+        var data []byte
+        switch result.ContentType {
+        case "image/jpeg":
+            data, err = compressWithJpegli(resized, 0, p.jpegSettings(opts), nil)
+        case "image/png":
+            data, err = compressWithOxipng(ctx, resized, p.pngSettings(opts))
+        default:
+            data, err = bimg.NewImage(resized).Process(bimg.Options{Type: bimg.WEBP, Quality: p.webpQualityFor(opts)})
+        }
+        if err != nil {
+            return nil, fmt.Errorf("failed to compress %s variant: %v", name, err)
+        }
+        if data, err = p.stripMetadata(data); err != nil {
+            return nil, fmt.Errorf("failed to strip metadata: %v", err)
+        }
+
+        size, err := bimg.NewImage(data).Size()
+        if err != nil {
+            return nil, fmt.Errorf("failed to read %s variant size: %v", name, err)
+        }
+        variants = append(variants, VariantResult{
+            Name:        name,
+            Data:        data,
+            ContentType: result.ContentType,
+            Width:       size.Width,
+            Height:      size.Height,
+        })
+    }
+    return variants, nil
+}
@@ -2,19 +2,42 @@ package imageproc
 
 import (
     "bytes"
+    "context"
+    "errors"
     "fmt"
     "image"
+    "image/png"
     "os/exec"
+    "strconv"
+    "time"
 
     "github.com/gen2brain/jpegli"
     "github.com/h2non/bimg"
+    "github.com/hackclub/format/internal/metrics"
     "github.com/hackclub/format/internal/util"
 )
 
 type Processor struct {
     jpegQuality     int
+    webpQuality     int // 0 uses jpegQuality
+    maxDimension    int // images are scaled down to fit within this box
+    skipThreshold   int // files up to this many bytes keep their pixels, 0 processes everything
     jpegProgressive bool
     pngStrip        bool
+    pngLevel        int  // oxipng optimization level, 0-6
+    pngInterlace    bool // Adam7 interlaced PNGs render progressively
+    pngQuantize     bool // palette-quantize PNG output, see quantizePNG
+    quantizeQuality int  // quality floor below which quantization is dropped
+    animatedWebP    bool // convert animated GIFs to animated WebP when smaller
+    memoryBudget    int64 // estimated peak bytes per image, 0 for no limit
+    pdfDPI          int   // resolution the first page of PDFs is rendered at
+    timeout         time.Duration // per-image processing deadline, 0 for none
+    defaultPreset   string        // preset for requests that don't pick one
+    metadata        MetadataPolicy
+    watermark       WatermarkConfig
+    // workers bounds how many images are processed at once across all
+    // requests, libvips and the encoders are memory hungry
+    workers chan struct{}
 }
 
 type ProcessResult struct {
@@ -23,35 +46,395 @@ type ProcessResult struct {
     Width          int
     Height         int
     HasAlpha       bool
+    Frames         int
     OriginalSize   int
     CompressedSize int
+    Variants       []VariantResult
+    BlurHash       string
+    // Capture describes the upload before processing
+    Capture *CaptureMetadata
+    // Timings is the time spent per pipeline stage, see the Stage* constants
+    Timings map[string]time.Duration
 }
 
-func NewProcessor(jpegQuality int, jpegProgressive, pngStrip bool) *Processor {
+// ProcessOptions are per-request processing options
+type ProcessOptions struct {
+    // RasterizeSVG converts SVGs to PNG instead of hosting the sanitized SVG
+    RasterizeSVG bool `json:"rasterizeSvg,omitempty"`
+    // Width is the rasterized SVG width in pixels, 0 for its intrinsic size
+    Width int `json:"width,omitempty"`
+    // Quality overrides the configured JPEG quality (1-100) when set
+    Quality int `json:"quality,omitempty"`
+    // Progressive overrides the configured progressive JPEG setting when set
+    Progressive *bool `json:"progressive,omitempty"`
+    // Variants are extra named sizes to render, e.g. "thumb" or "medium"
+    Variants []string `json:"variants,omitempty"`
+    // Watermark overlays the configured watermark
+    Watermark bool `json:"watermark,omitempty"`
+    // Force runs the full pipeline even for files under the skip threshold
+    Force bool `json:"force,omitempty"`
+    // MaxDimension lowers the maximum width/height for this request, e.g.
+    // 1200 for email-width output. It can't exceed the configured maximum.
+    MaxDimension int `json:"maxDimension,omitempty"`
+    // Crop cuts out an explicit region, CropAspect instead crops to an
+    // aspect ratio like "16:9" using CropStrategy ("smart" or "center")
+    Crop         *CropRect `json:"crop,omitempty"`
+    CropAspect   string    `json:"cropAspect,omitempty"`
+    CropStrategy string    `json:"cropStrategy,omitempty"`
+    // Lossless keeps the source pixels and format (no resizing or JPEG
+    // conversion) and only applies lossless optimization
+    Lossless bool `json:"lossless,omitempty"`
+    // KeepJPEG encodes opaque JPEG sources as JPEG again, with jpegli,
+    // rather than as PNG
+    KeepJPEG bool `json:"keepJpeg,omitempty"`
+    // PNGInterlace and PNGLevel override the configured PNG interlacing and
+    // oxipng optimization level (0-6) when set
+    PNGInterlace *bool `json:"pngInterlace,omitempty"`
+    PNGLevel     *int  `json:"pngLevel,omitempty"`
+    // Quantize overrides whether PNG output is palette quantized, a lossy
+    // step that only sticks if it meets the configured quality floor
+    Quantize *bool `json:"quantize,omitempty"`
+    // Preset picks a named set of defaults ("email", "web" or "archive"),
+    // the options above override it. Empty uses the configured default.
+    Preset string `json:"preset,omitempty"`
+    // TTL is how many seconds the stored asset is kept, 0 for good. It
+    // doesn't change processing.
+    TTL int `json:"ttl,omitempty"`
+}
+
+// MaxTTL is the longest TTL in seconds, a year
+const MaxTTL = 365 * 24 * 60 * 60
+
+func (o ProcessOptions) cropRequested() bool {
+    return o.Crop != nil || o.CropAspect != ""
+}
+
+// Validate checks that the options are within range
+func (o ProcessOptions) Validate() error {
+    if o.Width < 0 {
+        return invalidOption("width", "width must not be negative")
+    }
+    if o.MaxDimension < 0 {
+        return invalidOption("maxDimension", "maxDimension must not be negative")
+    }
+    if !IsValidPreset(o.Preset) {
+        return invalidOption("preset", "unknown preset %q", o.Preset)
+    }
+    if (o.Lossless || presets[o.Preset].Lossless) && o.MaxDimension > 0 {
+        return invalidOption("maxDimension", "maxDimension can't be combined with lossless")
+    }
+    if (o.Lossless || presets[o.Preset].Lossless) && o.Quantize != nil && *o.Quantize {
+        return invalidOption("quantize", "quantize can't be combined with lossless")
+    }
+    if o.PNGLevel != nil && (*o.PNGLevel < 0 || *o.PNGLevel > maxPNGLevel) {
+        return invalidOption("pngLevel", "pngLevel must be between 0 and %d", maxPNGLevel)
+    }
+    if o.Quality < 0 || o.Quality > 100 {
+        return invalidOption("quality", "quality must be between 1 and 100")
+    }
+    if o.TTL < 0 || o.TTL > MaxTTL {
+        return invalidOption("ttl", "ttl must be between 0 and %d seconds", MaxTTL)
+    }
+    for _, name := range o.Variants {
+        if !IsValidVariant(name) {
+            return invalidOption("variants", "unknown variant %q", name)
+        }
+    }
+    return o.validateCrop()
+}
+
+// OptionError is a processing option with an invalid value
+type OptionError struct {
+    Option string
+    Reason string
+}
+
+func (e *OptionError) Error() string {
+    return e.Reason
+}
+
+// Field names the invalid option, for per-field error responses
+func (e *OptionError) Field() string {
+    return e.Option
+}
+
+func invalidOption(option, format string, args ...interface{}) error {
+    return &OptionError{Option: option, Reason: fmt.Sprintf(format, args...)}
+}
+
+// jpegParams are the settings a JPEG is encoded with
+type jpegParams struct {
+    quality     int
+    progressive bool
+    subsampling image.YCbCrSubsampleRatio
+}
+
+// jpegSettings returns the JPEG settings to use, applying any per-request
+// overrides and the request's preset to the configured defaults
+func (p *Processor) jpegSettings(opts ProcessOptions) jpegParams {
+    params := jpegParams{
+        quality:     p.jpegQuality,
+        progressive: p.jpegProgressive,
+        subsampling: presets[opts.Preset].Subsampling,
+    }
+    if opts.Quality > 0 {
+        params.quality = opts.Quality
+    }
+    if opts.Progressive != nil {
+        params.progressive = *opts.Progressive
+    }
+    return params
+}
+
+// webpQualityFor returns the quality to encode WebP at: the request's or its
+// preset's, otherwise the configured WebP quality. WebP holds up at lower
+// numbers than JPEG, so it's set apart.
+func (p *Processor) webpQualityFor(opts ProcessOptions) int {
+    switch {
+    case opts.Quality > 0:
+        return opts.Quality
+    case p.webpQuality > 0:
+        return p.webpQuality
+    default:
+        return p.jpegQuality
+    }
+}
+
+// maxPNGLevel is oxipng's highest optimization level short of the very slow
+// "max" preset
+const maxPNGLevel = 6
+
+// pngParams are the settings PNG output is optimized with
+type pngParams struct {
+    level     int
+    interlace bool
+    quantize  bool
+}
+
+// pngSettings returns the PNG settings to use, applying any per-request
+// overrides to the configured defaults
+func (p *Processor) pngSettings(opts ProcessOptions) pngParams {
+    params := pngParams{level: p.pngLevel, interlace: p.pngInterlace, quantize: p.pngQuantize && !opts.Lossless}
+    if opts.PNGLevel != nil {
+        params.level = *opts.PNGLevel
+    }
+    if opts.PNGInterlace != nil {
+        params.interlace = *opts.PNGInterlace
+    }
+    if opts.Quantize != nil && !opts.Lossless {
+        params.quantize = *opts.Quantize
+    }
+    return params
+}
+
+// maxDimensionFor returns the maximum width/height for a request
+func (p *Processor) maxDimensionFor(opts ProcessOptions) int {
+    if opts.MaxDimension > 0 && opts.MaxDimension < p.maxDimension {
+        return opts.MaxDimension
+    }
+    return p.maxDimension
+}
+
+// Config configures a Processor
+type Config struct {
+    JPEGQuality     int
+    WebPQuality     int // quality of WebP output, 0 uses JPEGQuality
+    JPEGProgressive bool
+    MaxDimension    int // images are scaled down to fit within this box
+    SkipThreshold   int // files up to this many bytes keep their pixels, 0 processes everything
+    Workers         int // images processed at once across all requests, at least 1
+    PDFDPI          int // resolution the first page of PDFs is rendered at
+    PNGStrip        bool
+    PNGLevel        int  // oxipng optimization level, 0-6
+    PNGInterlace    bool // Adam7 interlaced PNGs render progressively
+    PNGQuantize     bool // palette-quantize PNG output, see quantizePNG
+    QuantizeQuality int  // quality floor below which quantization is dropped
+    AnimatedWebP    bool // convert animated GIFs to animated WebP when smaller
+    MemoryBudget    int64         // estimated peak bytes per image, 0 for no limit
+    Timeout         time.Duration // per-image processing deadline, 0 for none
+    DefaultPreset   string        // preset for requests that don't pick one
+    Metadata        MetadataPolicy
+    Watermark       WatermarkConfig
+}
+
+func NewProcessor(cfg Config) *Processor {
     return &Processor{
-        jpegQuality:     jpegQuality,
-        jpegProgressive: jpegProgressive,
-        pngStrip:        pngStrip,
+        jpegQuality:     cfg.JPEGQuality,
+        webpQuality:     cfg.WebPQuality,
+        maxDimension:    cfg.MaxDimension,
+        skipThreshold:   cfg.SkipThreshold,
+        jpegProgressive: cfg.JPEGProgressive,
+        pngStrip:        cfg.PNGStrip,
+        pngLevel:        cfg.PNGLevel,
+        pngInterlace:    cfg.PNGInterlace,
+        pngQuantize:     cfg.PNGQuantize,
+        quantizeQuality: cfg.QuantizeQuality,
+        animatedWebP:    cfg.AnimatedWebP,
+        memoryBudget:    cfg.MemoryBudget,
+        pdfDPI:          cfg.PDFDPI,
+        timeout:         cfg.Timeout,
+        defaultPreset:   cfg.DefaultPreset,
+        metadata:        cfg.Metadata,
+        watermark:       cfg.Watermark,
+        workers:         make(chan struct{}, max(1, cfg.Workers)),
     }
 }
 
-const oneMB = 1024 * 1024
-const maxDimension = 3840
 
-func (p *Processor) Process(data []byte, originalContentType string) (*ProcessResult, error) {
+// Process runs an image through the pipeline. It gives up when ctx is done
+// or the configured per-image deadline passes, killing any running encoder.
+func (p *Processor) Process(ctx context.Context, data []byte, originalContentType string, opts ProcessOptions) (*ProcessResult, error) {
+    opts = p.withPreset(opts)
+    if opts.Watermark && !p.watermark.Enabled() {
+        return nil, fmt.Errorf("watermarking is not configured")
+    }
+
+    ctx, cancel := p.withTimeout(ctx)
+    defer cancel()
+    release, err := p.acquireWorker(ctx)
+    if err != nil {
+        return nil, err
+    }
+    defer release()
+
+    timings := stageTimings{}
+    result, err := p.process(ctx, data, originalContentType, opts, timings)
+    if err != nil {
+        return nil, p.timeoutError(err)
+    }
+
+    // The placeholder is a nice-to-have, don't fail the upload over it
+    done := timings.track(StageBlurHash)
+    if hash, err := blurHash(result.Data); err != nil {
+        fmt.Printf("⚠️ BlurHash generation failed, skipping placeholder. Error: %v\n", err)
+    } else {
+        result.BlurHash = hash
+    }
+    done()
+
+    if len(opts.Variants) > 0 {
+        done := timings.track(StageVariants)
+        result.Variants, err = p.generateVariants(ctx, result, opts)
+        done()
+        if err != nil {
+            return nil, p.timeoutError(err)
+        }
+    }
+
+    result.Capture = captureMetadata(data)
+    result.Timings = timings
+    metrics.ProcessingInputBytes.Observe(float64(len(data)))
+    metrics.ProcessingOutputBytes.Observe(float64(result.CompressedSize))
+    metrics.ProcessingConversions.WithLabelValues(util.DetectContentType(data), result.ContentType).Inc()
+    return result, nil
+}
+
+// acquireWorker blocks until a processing worker is free and returns the
+// function that releases it, or fails once ctx is done
+func (p *Processor) acquireWorker(ctx context.Context) (func(), error) {
+    start := time.Now()
+    metrics.ProcessingQueued.Inc()
+    select {
+    case p.workers <- struct{}{}:
+    case <-ctx.Done():
+        metrics.ProcessingQueued.Dec()
+        return nil, p.timeoutError(fmt.Errorf("gave up waiting for a processing worker: %w", ctx.Err()))
+    }
+    metrics.ProcessingQueued.Dec()
+    metrics.ProcessingQueueWait.Observe(time.Since(start).Seconds())
+    metrics.ProcessingInFlight.Inc()
+
+    return func() {
+        metrics.ProcessingInFlight.Dec()
+        <-p.workers
+    }, nil
+}
+
+// withTimeout applies the per-image processing deadline to ctx
+func (p *Processor) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+    if p.timeout <= 0 {
+        return context.WithCancel(ctx)
+    }
+    return context.WithTimeout(ctx, p.timeout)
+}
+
+// timeoutError makes a deadline error say what the deadline was
+func (p *Processor) timeoutError(err error) error {
+    if errors.Is(err, context.DeadlineExceeded) && p.timeout > 0 {
+        return fmt.Errorf("image processing timed out after %s: %w", p.timeout, err)
+    }
+    return err
+}
+
+func (p *Processor) process(ctx context.Context, data []byte, originalContentType string, opts ProcessOptions, timings stageTimings) (*ProcessResult, error) {
     originalSize := len(data)
 
-    // 1. If the file is under 1MB, don't touch it.
-    if originalSize <= oneMB {
-        fmt.Printf("✅ Image size is %d bytes (<= 1MB), skipping processing.\n", originalSize)
-        metadata, err := bimg.NewImage(data).Metadata()
+    // SVGs are always sanitized, regardless of size, since they can carry script
+    if util.IsSVG(originalContentType, data) {
+        return p.processSVG(ctx, data, opts, timings)
+    }
+
+    // HEIC/HEIF (iPhone photos) can't be read by the standard decoders and
+    // most mail clients can't show it, so decode it through libheif up front
+    // and always run the full pipeline, which converts it to JPEG.
+    forceProcess := false
+    // PDFs can't be shown in email either, host their first page instead
+    if util.IsPDF(originalContentType, data) {
+        done := timings.track(StageDecode)
+        rendered, err := renderPDFPage(ctx, data, p.pdfDPI, p.maxDimension)
+        done()
         if err != nil {
+            return nil, err
+        }
+        data = rendered
+        originalContentType = "image/png"
+        forceProcess = true
+    } else if util.IsHEIF(originalContentType, data) {
+        done := timings.track(StageDecode)
+        decoded, err := decodeHEIF(data)
+        done()
+        if err != nil {
+            return nil, err
+        }
+        data = decoded
+        originalContentType = "image/png"
+        forceProcess = true
+    }
+
+    // Crops and watermarks have to be applied to the pixels
+    forceProcess = forceProcess || opts.Force || opts.Watermark || opts.cropRequested()
+
+    // Read the header once, every stage below works from it
+    metadata, metadataErr := bimg.NewImage(data).Metadata()
+
+    // The configured maximum only applies to files that go through the full
+    // pipeline, but a per-request maximum is a hard limit even for small files
+    maxDimension := p.maxDimensionFor(opts)
+    if opts.MaxDimension > 0 && !forceProcess && metadataErr == nil && needsResize(metadata.Size.Width, metadata.Size.Height, maxDimension) {
+        forceProcess = true
+    }
+
+    // 1. If the file is under the skip threshold, don't touch the pixels, but
+    // still strip metadata so GPS coordinates and serial numbers never reach
+    // the CDN. Formats whose metadata can't be stripped in place, like TIFF
+    // and AVIF, are re-encoded whatever their size.
+    if p.skipThreshold > 0 && originalSize <= p.skipThreshold && !forceProcess && canStripMetadata(data) {
+        fmt.Printf("✅ Image size is %d bytes (<= %d), skipping processing.\n", originalSize, p.skipThreshold)
+        done := timings.track(StageMetadata)
+        data, err := p.stripMetadata(data)
+        done()
+        if err != nil {
+            return nil, fmt.Errorf("failed to strip metadata: %v", err)
+        }
+        // Stripping metadata never changes the pixels, so the header still applies
+        if metadataErr != nil {
             // Could fail on non-images, but that's ok. Return original data.
             return &ProcessResult{
                 Data:           data,
                 ContentType:    originalContentType,
+                Frames:         animationFrames(data),
                 OriginalSize:   originalSize,
-                CompressedSize: originalSize,
+                CompressedSize: len(data),
             }, nil
         }
         return &ProcessResult{
@@ -60,12 +443,13 @@ func (p *Processor) Process(data []byte, originalContentType string) (*ProcessRe
             Width:          metadata.Size.Width,
             Height:         metadata.Size.Height,
             HasAlpha:       metadata.Alpha,
+            Frames:         animationFrames(data),
             OriginalSize:   originalSize,
-            CompressedSize: originalSize,
+            CompressedSize: len(data),
         }, nil
     }
 
-    fmt.Printf("🚀 Image size is %d bytes (> 1MB), starting SOTA processing pipeline.\n", originalSize)
+    fmt.Printf("🚀 Image size is %d bytes, starting SOTA processing pipeline.\n", originalSize)
 
     // Validate input is a supported image format
     if !util.IsImageMIME(originalContentType) {
@@ -76,63 +460,132 @@ func (p *Processor) Process(data []byte, originalContentType string) (*ProcessRe
         originalContentType = detectedType
     }
 
-    // 2. Get image metadata
-    metadata, err := bimg.NewImage(data).Metadata()
-    if err != nil {
-        return nil, fmt.Errorf("failed to read image metadata: %v", err)
+    // 2. Check the image metadata
+    if metadataErr != nil {
+        return nil, fmt.Errorf("failed to read image metadata: %v", metadataErr)
     }
 
-    // 3. Resize if necessary
-    imageToProcess := data
-    needsResize := metadata.Size.Width > maxDimension || metadata.Size.Height > maxDimension
-    if needsResize {
-        fmt.Printf("🔄 Image resize triggered: %dx%d -> max %dpx\n", metadata.Size.Width, metadata.Size.Height, maxDimension)
-        newWidth, newHeight := calculateDimensionsWithMax(metadata.Size.Width, metadata.Size.Height, maxDimension)
-
-        // Resize using bimg with proper format output
-        resizeOptions := bimg.Options{
-            Width: newWidth,
-            Height: newHeight,
-            Type: bimg.PNG,  // Use PNG to preserve quality for next stage
-            Quality: 100,
-        }
-        
-        resizedData, err := bimg.NewImage(data).Process(resizeOptions)
-        if err != nil {
-            return nil, fmt.Errorf("failed to resize image: %v", err)
-        }
-        imageToProcess = resizedData
+    // Refuse images whose decoded pixels wouldn't fit the memory budget
+    // before libvips or the Go decoders allocate them
+    shrink := 1
+    if !opts.cropRequested() {
+        shrink = shrinkOnLoadFactor(data, metadata.Size.Width, metadata.Size.Height, maxDimension)
+    }
+    if err := p.checkMemoryBudget(originalSize, metadata.Size.Width, metadata.Size.Height, maxDimension, shrink); err != nil {
+        return nil, err
     }
 
-    // 4. Decide format and apply SOTA compression
-    var processedData []byte
-    var outputContentType string
+    if opts.Lossless {
+        return p.processLossless(ctx, data, originalSize, animationFrames(data), opts, timings)
+    }
+
+    // Animated GIFs take their own path, the resize/convert pipeline below
+    // would flatten them to the first frame
+    if frames := gifFrameCount(data); frames > 1 {
+        return p.processAnimatedGIF(ctx, data, frames, metadata.Size.Width, metadata.Size.Height, maxDimension, timings)
+    }
+    // Animated WebP too, it would lose all but the first frame
+    if frames := webpFrameCount(data); frames > 1 {
+        return p.processAnimatedWebP(ctx, data, frames, metadata.Size.Width, metadata.Size.Height, maxDimension, opts, timings)
+    }
+
+    // 3. Decode once, the same pixels feed the transparency check and the
+    // encoder. Formats the Go decoders can't read fall back to libvips.
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
+    // Large JPEGs and WebPs are decoded smaller to begin with. Crop
+    // rectangles are in the pixels of the original, so crops decode it all.
+    if shrink > 1 {
+        data = shrinkOnLoad(data, metadata.Size.Width, metadata.Size.Height, maxDimension, timings)
+    }
+    orientation := jpegOrientation(data)
+    decoded := decodeImage(data, timings)
 
     // Use more accurate transparency detection - check if image actually uses transparency
-    hasRealTransparency := hasActualTransparency(data, metadata)
+    hasRealTransparency := hasActualTransparency(decoded, metadata)
     shouldConvertToJPEG := util.ShouldConvertToJPEG(originalContentType, hasRealTransparency)
-    
+    // JPEGs aren't converted, only re-encoded as JPEG when asked to
+    isJPEG := originalContentType == "image/jpeg" || originalContentType == "image/jpg"
+    if opts.KeepJPEG && isJPEG && !hasRealTransparency {
+        shouldConvertToJPEG = true
+    }
+
     fmt.Printf("🔍 Transparency analysis: hasAlphaChannel=%t, hasRealTransparency=%t, shouldConvertToJPEG=%t\n", 
         metadata.Alpha, hasRealTransparency, shouldConvertToJPEG)
 
+    // Crops and watermarks need libvips and hand back a lossless PNG of the
+    // upright image, which replaces the original from here on
+    imageToProcess := data
+    var err error
+    if opts.cropRequested() || opts.Watermark {
+        if opts.cropRequested() {
+            done := timings.track(StageCrop)
+            imageToProcess, err = applyCrop(imageToProcess, opts)
+            done()
+            if err != nil {
+                return nil, err
+            }
+        }
+        if opts.Watermark {
+            done := timings.track(StageWatermark)
+            imageToProcess, err = p.applyWatermark(imageToProcess)
+            done()
+            if err != nil {
+                return nil, err
+            }
+        }
+        orientation = 1
+        decoded = decodeImage(imageToProcess, timings)
+    }
+
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
+
+    // 4. Resize and encode in one step, straight to the output format, so
+    // there's never a full-quality intermediate next to the original
+    var processedData []byte
+    var outputContentType string
+
     if shouldConvertToJPEG {
-        fmt.Println("✨ Compressing with state-of-the-art jpegli...")
+        params := p.jpegSettings(opts)
+        fmt.Printf("✨ Compressing with state-of-the-art jpegli (quality=%d, progressive=%t, preset=%s)...\n", params.quality, params.progressive, opts.Preset)
         outputContentType = "image/jpeg"
-        processedData, err = compressWithJpegli(imageToProcess)
+        processedData, err = encodeJPEG(decoded, imageToProcess, orientation, maxDimension, params, timings)
         if err != nil {
             return nil, fmt.Errorf("jpegli compression failed: %w", err)
         }
     } else {
         fmt.Println("✨ Compressing with oxipng...")
         outputContentType = "image/png"
-        // If we resized, the intermediate is a PNG. If not, it's the original PNG.
-        // In either case, it's safe to run through oxipng.
-        processedData, err = compressWithOxipng(imageToProcess)
+        pngData, err := encodePNG(decoded, imageToProcess, orientation, maxDimension, timings)
+        if err != nil {
+            return nil, err
+        }
+        params := p.pngSettings(opts)
+        if params.quantize {
+            pngData, err = p.quantize(ctx, pngData, timings)
+            if err != nil {
+                return nil, err
+            }
+        }
+        done := timings.track(StageOptimize)
+        processedData, err = compressWithOxipng(ctx, pngData, params)
+        done()
         if err != nil {
             return nil, fmt.Errorf("oxipng compression failed: %w", err)
         }
     }
 
+    // Encoders may carry metadata over from the source
+    done := timings.track(StageMetadata)
+    processedData, err = p.stripMetadata(processedData)
+    done()
+    if err != nil {
+        return nil, fmt.Errorf("failed to strip metadata: %v", err)
+    }
+
     // 5. Get final metadata and return
     finalMetadata, err := bimg.NewImage(processedData).Metadata()
     if err != nil {
@@ -145,44 +598,90 @@ func (p *Processor) Process(data []byte, originalContentType string) (*ProcessRe
         Width:          finalMetadata.Size.Width,
         Height:         finalMetadata.Size.Height,
         HasAlpha:       finalMetadata.Alpha,
+        Frames:         1,
         OriginalSize:   originalSize,
         CompressedSize: len(processedData),
     }, nil
 }
 
-// compressWithJpegli uses the Go jpegli library for state-of-the-art JPEG compression.
-func compressWithJpegli(input []byte) ([]byte, error) {
-    // Decode the input image data to Go image.Image
-    var img image.Image
-    var err error
-    
-    // Try to decode as various formats
-    reader := bytes.NewReader(input)
-    img, _, err = image.Decode(reader)
+// decodeHEIF converts HEIC/HEIF to a lossless PNG intermediate via libvips'
+// libheif support, applying EXIF orientation on the way
+func decodeHEIF(data []byte) ([]byte, error) {
+    if !bimg.IsTypeSupported(bimg.HEIF) {
+        return nil, fmt.Errorf("HEIF images are not supported: libvips was built without libheif")
+    }
+
+    fmt.Println("📱 HEIF image detected, decoding with libheif...")
+    decoded, err := bimg.NewImage(data).Process(bimg.Options{
+        Type:    bimg.PNG,
+        Quality: 100,
+    })
+    if err != nil {
+        return nil, fmt.Errorf("failed to decode HEIF image: %v", err)
+    }
+    return decoded, nil
+}
+
+// decodeImage decodes data with the Go decoders, returning nil for formats
+// they can't read
+func decodeImage(data []byte, timings stageTimings) image.Image {
+    defer timings.track(StageDecode)()
+    img, _, err := image.Decode(bytes.NewReader(data))
     if err != nil {
-        // Fall back to bimg if standard decoders fail
         fmt.Printf("⚠️ Standard image decode failed, falling back to bimg. Error: %v\n", err)
-        return fallbackJPEGCompression(input)
+        return nil
+    }
+    return img
+}
+
+// compressWithJpegli decodes input and compresses it with jpegli, see
+// encodeJPEG
+func compressWithJpegli(input []byte, maxDimension int, params jpegParams, timings stageTimings) ([]byte, error) {
+    return encodeJPEG(decodeImage(input, timings), input, jpegOrientation(input), maxDimension, params, timings)
+}
+
+// encodeJPEG uses the Go jpegli library for state-of-the-art JPEG compression
+// of already decoded pixels, scaling them down to fit maxDimension (0 for no
+// limit) first. input is the encoded image, which libvips compresses instead
+// if img is nil or jpegli fails.
+func encodeJPEG(img image.Image, input []byte, orientation, maxDimension int, params jpegParams, timings stageTimings) ([]byte, error) {
+    if img == nil {
+        defer timings.track(StageEncode)()
+        return fallbackJPEGCompression(input, maxDimension, params.quality, params.progressive)
+    }
+
+    bounds := img.Bounds()
+    done := timings.track(StageResize)
+    img = scaleToFit(img, orientation, maxDimension)
+    done()
+    if img.Bounds() != bounds {
+        fmt.Printf("🔄 Image resized: %dx%d -> %dx%d\n", bounds.Dx(), bounds.Dy(), img.Bounds().Dx(), img.Bounds().Dy())
     }
 
     // Use jpegli to encode with optimal settings
     var buf bytes.Buffer
     
-    // jpegli.EncodingOptions with high quality and optimal settings
+    progressiveLevel := 0
+    if params.progressive {
+        progressiveLevel = 2 // Maximum progressive JPEG
+    }
+
+    // jpegli.EncodingOptions with the configured quality and optimal settings
     options := &jpegli.EncodingOptions{
-        Quality:               95,    // High quality for minimal loss
-        ProgressiveLevel:      2,     // Maximum progressive JPEG
+        Quality:               params.quality,
+        ProgressiveLevel:      progressiveLevel,
         OptimizeCoding:        true,  // Huffman code optimization
         AdaptiveQuantization:  true,  // Better quality
         FancyDownsampling:     true,  // Better quality
-        ChromaSubsampling:     image.YCbCrSubsampleRatio444, // No chroma subsampling for max quality
+        ChromaSubsampling:     params.subsampling, // 4:4:4 (none) unless the preset trades it for size
     }
     
-    err = jpegli.Encode(&buf, img, options)
+    defer timings.track(StageEncode)()
+    err := jpegli.Encode(&buf, img, options)
     if err != nil {
         // Fall back to bimg if jpegli fails
         fmt.Printf("⚠️ jpegli encoding failed, falling back to bimg. Error: %v\n", err)
-        return fallbackJPEGCompression(input)
+        return fallbackJPEGCompression(input, maxDimension, params.quality, params.progressive)
     }
 
     fmt.Printf("✅ jpegli compression successful: %d bytes -> %d bytes (%.1f%% reduction)\n", 
@@ -191,15 +690,50 @@ func compressWithJpegli(input []byte) ([]byte, error) {
     return buf.Bytes(), nil
 }
 
-// fallbackJPEGCompression uses bimg as fallback when jpegli fails
-func fallbackJPEGCompression(input []byte) ([]byte, error) {
+// encodePNG scales already decoded pixels down to fit maxDimension and
+// encodes them as PNG, quickly, since oxipng does the real compression. PNGs
+// that need no changes are returned as-is, and libvips takes over if img is
+// nil.
+func encodePNG(img image.Image, input []byte, orientation, maxDimension int, timings stageTimings) ([]byte, error) {
+    if img == nil {
+        defer timings.track(StageResize)()
+        return resizeToPNG(input, maxDimension)
+    }
+
+    bounds := img.Bounds()
+    done := timings.track(StageResize)
+    img = scaleToFit(img, orientation, maxDimension)
+    done()
+    if img.Bounds() == bounds && orientation <= 1 && bimg.DetermineImageType(input) == bimg.PNG {
+        return input, nil
+    }
+    if img.Bounds() != bounds {
+        fmt.Printf("🔄 Image resized: %dx%d -> %dx%d\n", bounds.Dx(), bounds.Dy(), img.Bounds().Dx(), img.Bounds().Dy())
+    }
+
+    defer timings.track(StageEncode)()
+    var buf bytes.Buffer
+    encoder := png.Encoder{CompressionLevel: png.BestSpeed}
+    if err := encoder.Encode(&buf, img); err != nil {
+        return nil, fmt.Errorf("failed to encode PNG: %v", err)
+    }
+    return buf.Bytes(), nil
+}
+
+// fallbackJPEGCompression uses bimg as fallback when jpegli fails, resizing
+// and encoding in a single libvips pass
+func fallbackJPEGCompression(input []byte, maxDimension, quality int, progressive bool) ([]byte, error) {
     img := bimg.NewImage(input)
     jpegOptions := bimg.Options{
         Type: bimg.JPEG,
-        Quality: 90,
+        Quality: quality,
+        Interlace: progressive,
         StripMetadata: true,
         Interpretation: bimg.InterpretationSRGB,
     }
+    if size, err := img.Size(); err == nil && maxDimension > 0 && needsResize(size.Width, size.Height, maxDimension) {
+        jpegOptions.Width, jpegOptions.Height = calculateDimensionsWithMax(size.Width, size.Height, maxDimension)
+    }
     
     jpegData, err := img.Process(jpegOptions)
     if err != nil {
@@ -211,10 +745,125 @@ func fallbackJPEGCompression(input []byte) ([]byte, error) {
     return jpegData, nil
 }
 
-// compressWithOxipng uses `oxipng` for lossless PNG optimization.
-func compressWithOxipng(input []byte) ([]byte, error) {
+// shrinkOnLoadFactor returns what libvips divides the size of data by when
+// decoding it to fit maxDimension: 2, 4 or 8 for JPEGs and WebPs at least
+// that many times too large, 1 for other images. It mirrors bimg, which
+// shrinks by 3/4 of the scale with its default bicubic interpolator.
+func shrinkOnLoadFactor(data []byte, width, height, maxDimension int) int {
+    contentType := util.DetectContentType(data)
+    if maxDimension <= 0 || (contentType != "image/jpeg" && contentType != "image/webp") {
+        return 1
+    }
+    shrink := max(width, height) * 3 / (4 * maxDimension)
+    switch {
+    case shrink >= 8:
+        return 8
+    case shrink >= 4:
+        return 4
+    case shrink >= 2:
+        return 2
+    }
+    return 1
+}
+
+// shrinkOnLoad has libvips decode a large JPEG or WebP at a fraction of its
+// size, shrink-on-load, and scale it to fit maxDimension, so its full-size
+// pixels are never in memory. It returns an upright PNG of the result for
+// the Go decoders, or data itself for images that can't be shrunk on load.
+func shrinkOnLoad(data []byte, width, height, maxDimension int, timings stageTimings) []byte {
+    if shrinkOnLoadFactor(data, width, height, maxDimension) == 1 {
+        return data
+    }
+    defer timings.track(StageResize)()
+    newWidth, newHeight := calculateDimensionsWithMax(width, height, maxDimension)
+    shrunk, err := bimg.NewImage(data).Process(bimg.Options{
+        Width:          newWidth,
+        Height:         newHeight,
+        Type:           bimg.PNG,
+        Compression:    1, // decoded right away, and oxipng does the real compression
+        Interpretation: bimg.InterpretationSRGB,
+    })
+    if err != nil {
+        fmt.Printf("⚠️ Shrink-on-load failed, decoding at full size. Error: %v\n", err)
+        return data
+    }
+    fmt.Printf("🔄 Shrunk on load: %dx%d -> %dx%d\n", width, height, newWidth, newHeight)
+    return shrunk
+}
+
+// resizeToPNG scales an image down to fit maxDimension and encodes it as
+// PNG, the final output format. PNGs that already fit are returned as-is.
+func resizeToPNG(input []byte, maxDimension int) ([]byte, error) {
+    img := bimg.NewImage(input)
+    size, err := img.Size()
+    if err != nil {
+        return nil, fmt.Errorf("failed to read image size: %v", err)
+    }
+    resize := needsResize(size.Width, size.Height, maxDimension)
+    if !resize && bimg.DetermineImageType(input) == bimg.PNG {
+        return input, nil
+    }
+
+    options := bimg.Options{Type: bimg.PNG, Compression: 1} // oxipng does the real compression
+    if resize {
+        options.Width, options.Height = calculateDimensionsWithMax(size.Width, size.Height, maxDimension)
+        fmt.Printf("🔄 Image resize triggered: %dx%d -> %dx%d\n", size.Width, size.Height, options.Width, options.Height)
+    }
+    resized, err := img.Process(options)
+    if err != nil {
+        return nil, fmt.Errorf("failed to resize image: %v", err)
+    }
+    return resized, nil
+}
+
+// checkMemoryBudget estimates the peak memory of processing an image, the
+// encoded input and output plus decoded RGBA pixels before and after
+// scaling, and rejects it if it's over the configured budget. Images
+// decoded with shrink-on-load only ever hold 1/shrink² of their pixels.
+func (p *Processor) checkMemoryBudget(inputSize, width, height, maxDimension, shrink int) error {
+    if p.memoryBudget <= 0 {
+        return nil
+    }
+    newWidth, newHeight := calculateDimensionsWithMax(width, height, maxDimension)
+    decoded := int64(width/shrink) * int64(height/shrink) * 4
+    estimate := int64(inputSize)*2 + decoded + int64(newWidth)*int64(newHeight)*4
+    if estimate > p.memoryBudget {
+        return fmt.Errorf("image is too large to process: %dx%d needs about %dMB, the limit is %dMB",
+            width, height, estimate>>20, p.memoryBudget>>20)
+    }
+    return nil
+}
+
+// quantize palette-quantizes a PNG if that meets the quality floor, keeping
+// the lossless PNG otherwise. Only cancellation is an error.
+func (p *Processor) quantize(ctx context.Context, pngData []byte, timings stageTimings) ([]byte, error) {
+    fmt.Printf("🎨 Quantizing with pngquant (quality floor %d)...\n", p.quantizeQuality)
+    done := timings.track(StageQuantize)
+    quantized, err := quantizePNG(ctx, pngData, p.quantizeQuality)
+    done()
+    switch {
+    case ctx.Err() != nil:
+        return nil, ctx.Err()
+    case err != nil:
+        fmt.Printf("⚠️ pngquant failed, keeping lossless PNG. Error: %v\n", err)
+    case quantized == nil:
+        fmt.Println("↩️ Quantization below quality floor or not smaller, keeping lossless PNG")
+    default:
+        fmt.Printf("🎨 Quantized: %d bytes -> %d bytes\n", len(pngData), len(quantized))
+        return quantized, nil
+    }
+    return pngData, nil
+}
+
+// compressWithOxipng uses `oxipng` for lossless PNG optimization, killing it
+// when ctx is done.
+func compressWithOxipng(ctx context.Context, input []byte, params pngParams) ([]byte, error) {
+    interlace := "0"
+    if params.interlace {
+        interlace = "1" // Adam7
+    }
     // Universal web-safe default: purely lossless, keeps display-critical metadata
-    cmd := exec.Command("oxipng", "-o", "4", "--strip", "safe", "-i", "0", "-")
+    cmd := exec.CommandContext(ctx, "oxipng", "-o", strconv.Itoa(params.level), "--strip", "safe", "-i", interlace, "-")
 
     var out, stderr bytes.Buffer
     cmd.Stdin = bytes.NewReader(input)
@@ -222,6 +871,9 @@ func compressWithOxipng(input []byte) ([]byte, error) {
     cmd.Stderr = &stderr
 
     if err := cmd.Run(); err != nil {
+        if ctx.Err() != nil {
+            return nil, ctx.Err()
+        }
         // If oxipng fails (e.g., on a non-PNG passed to it), just return the input
         fmt.Printf("⚠️ oxipng compression failed, returning unoptimized data. Error: %v\nStderr: %s", err, stderr.String())
         return input, nil
@@ -249,18 +901,17 @@ func calculateDimensionsWithMax(originalWidth, originalHeight, maxDimension int)
     return int(float64(maxDimension) * ratio), maxDimension
 }
 
-// hasActualTransparency checks if image actually uses transparency by sampling alpha values
-func hasActualTransparency(data []byte, metadata bimg.ImageMetadata) bool {
+// hasActualTransparency checks if an image actually uses transparency by
+// sampling the alpha values of its decoded pixels
+func hasActualTransparency(img image.Image, metadata bimg.ImageMetadata) bool {
     // If no alpha channel, definitely no transparency
     if !metadata.Alpha {
         return false
     }
     
-    // Decode the image using Go's standard image decoder to access raw pixel data
-    reader := bytes.NewReader(data)
-    img, _, err := image.Decode(reader)
-    if err != nil {
-        fmt.Printf("🔍 Failed to decode image for alpha sampling, assuming transparency. Error: %v\n", err)
+    // Sample the decoded pixels
+    if img == nil {
+        fmt.Println("🔍 Image couldn't be decoded for alpha sampling, assuming transparency.")
         return true // Conservative approach - assume transparency if we can't decode
     }
     
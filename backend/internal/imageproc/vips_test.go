@@ -0,0 +1,63 @@
+package imageproc
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"os/exec"
+	"testing"
+)
+
+func TestPNGSettings(t *testing.T) {
+	p := NewProcessor(Config{PNGLevel: 4})
+	if got := p.pngSettings(ProcessOptions{}); got.level != 4 || got.interlace {
+		t.Errorf("default settings = %+v, want the configured level 4, not interlaced", got)
+	}
+
+	level, interlace := 2, true
+	if got := p.pngSettings(ProcessOptions{PNGLevel: &level, PNGInterlace: &interlace}); got.level != 2 || !got.interlace {
+		t.Errorf("requested settings = %+v, want level 2, interlaced", got)
+	}
+
+	interlace = false
+	p = NewProcessor(Config{PNGLevel: 4, PNGInterlace: true})
+	if got := p.pngSettings(ProcessOptions{PNGInterlace: &interlace}); got.interlace {
+		t.Error("a request should be able to turn configured interlacing off")
+	}
+
+	for _, level := range []int{-1, maxPNGLevel + 1} {
+		if err := (ProcessOptions{PNGLevel: &level}).Validate(); err == nil {
+			t.Errorf("pngLevel %d should be rejected", level)
+		}
+	}
+}
+
+func TestCompressWithOxipngInterlace(t *testing.T) {
+	if _, err := exec.LookPath("oxipng"); err != nil {
+		t.Skip("oxipng is not installed")
+	}
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			img.Set(x, y, color.RGBA{uint8(x * 4), uint8(y * 4), 0, 255})
+		}
+	}
+	var src bytes.Buffer
+	if err := png.Encode(&src, img); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, interlace := range []bool{false, true} {
+		out, err := compressWithOxipng(context.Background(), src.Bytes(), pngParams{level: 2, interlace: interlace})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The interlace method is the last byte of IHDR, after the
+		// signature, chunk length and type, and 12 bytes of header
+		if got := out[8+8+12] == 1; got != interlace {
+			t.Errorf("interlaced = %v, want %v", got, interlace)
+		}
+	}
+}
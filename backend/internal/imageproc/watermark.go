@@ -0,0 +1,131 @@
+package imageproc
+
+import (
+    "fmt"
+    stdhtml "html"
+
+    "github.com/h2non/bimg"
+)
+
+// Watermark corners
+const (
+    WatermarkTopLeft     = "top-left"
+    WatermarkTopRight    = "top-right"
+    WatermarkBottomLeft  = "bottom-left"
+    WatermarkBottomRight = "bottom-right"
+)
+
+// WatermarkConfig is the deployment's watermark. Image (a PNG logo) takes
+// precedence over Text.
+type WatermarkConfig struct {
+    Image    []byte
+    Text     string
+    Position string  // one of the Watermark* corners, bottom-right by default
+    Opacity  float32 // 0-1
+}
+
+// Enabled reports whether a watermark image or text is configured
+func (c WatermarkConfig) Enabled() bool {
+    return len(c.Image) > 0 || c.Text != ""
+}
+
+// IsValidWatermarkPosition reports whether position is a supported corner
+func IsValidWatermarkPosition(position string) bool {
+    switch position {
+    case "", WatermarkTopLeft, WatermarkTopRight, WatermarkBottomLeft, WatermarkBottomRight:
+        return true
+    default:
+        return false
+    }
+}
+
+// maxWatermarkRatio caps the watermark width relative to the image
+const maxWatermarkRatio = 0.2
+
+// applyWatermark overlays the configured watermark in its corner and returns
+// a lossless PNG for the compression stage
+func (p *Processor) applyWatermark(data []byte) ([]byte, error) {
+    // Decode to an upright PNG first so the corner math sees the displayed
+    // dimensions, not the pre-rotation ones
+    base, err := bimg.NewImage(data).Process(bimg.Options{Type: bimg.PNG, Quality: 100})
+    if err != nil {
+        return nil, fmt.Errorf("failed to decode image for watermarking: %v", err)
+    }
+    baseSize, err := bimg.NewImage(base).Size()
+    if err != nil {
+        return nil, fmt.Errorf("failed to read image size: %v", err)
+    }
+    width, height := baseSize.Width, baseSize.Height
+
+    overlay, err := p.watermarkOverlay(width)
+    if err != nil {
+        return nil, err
+    }
+    size, err := bimg.NewImage(overlay).Size()
+    if err != nil {
+        return nil, fmt.Errorf("failed to read watermark size: %v", err)
+    }
+    if size.Width > width || size.Height > height {
+        return nil, fmt.Errorf("image is too small to watermark")
+    }
+
+    margin := min(width, height) / 50
+    left, top := margin, margin
+    switch p.watermark.Position {
+    case WatermarkTopRight:
+        left = width - size.Width - margin
+    case WatermarkBottomLeft:
+        top = height - size.Height - margin
+    case WatermarkTopLeft:
+    default: // bottom-right
+        left = width - size.Width - margin
+        top = height - size.Height - margin
+    }
+
+    fmt.Printf("🏷️ Applying watermark at %s (%dx%d)\n", p.watermark.Position, size.Width, size.Height)
+    watermarked, err := bimg.NewImage(base).Process(bimg.Options{
+        Type:    bimg.PNG,
+        Quality: 100,
+        WatermarkImage: bimg.WatermarkImage{
+            Left:    max(0, left),
+            Top:     max(0, top),
+            Buf:     overlay,
+            Opacity: p.watermark.Opacity,
+        },
+    })
+    if err != nil {
+        return nil, fmt.Errorf("failed to apply watermark: %v", err)
+    }
+    return watermarked, nil
+}
+
+// watermarkOverlay returns the watermark as a PNG sized for an image of the
+// given width: the logo scaled down if needed, or the text rendered via SVG
+func (p *Processor) watermarkOverlay(imageWidth int) ([]byte, error) {
+    maxWidth := int(float64(imageWidth) * maxWatermarkRatio)
+
+    if len(p.watermark.Image) > 0 {
+        size, err := bimg.NewImage(p.watermark.Image).Size()
+        if err != nil {
+            return nil, fmt.Errorf("failed to read watermark image: %v", err)
+        }
+        if size.Width <= maxWidth {
+            return p.watermark.Image, nil
+        }
+        return bimg.NewImage(p.watermark.Image).Process(bimg.Options{Width: maxWidth, Type: bimg.PNG})
+    }
+
+    // Rough Arial metrics are fine, the box only needs to contain the text
+    fontSize := max(12, imageWidth/60)
+    boxWidth := min(maxWidth*2, len([]rune(p.watermark.Text))*fontSize*6/10+fontSize)
+    boxHeight := fontSize * 3 / 2
+    svg := fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d">`+
+        `<text x="%d" y="%d" font-family="Arial, Helvetica, sans-serif" font-size="%d" fill="white" stroke="black" stroke-width="%d" paint-order="stroke">%s</text></svg>`,
+        boxWidth, boxHeight, fontSize/2, fontSize*11/10, fontSize, max(1, fontSize/12), stdhtml.EscapeString(p.watermark.Text))
+
+    overlay, err := bimg.NewImage([]byte(svg)).Process(bimg.Options{Type: bimg.PNG})
+    if err != nil {
+        return nil, fmt.Errorf("failed to render watermark text: %v", err)
+    }
+    return overlay, nil
+}
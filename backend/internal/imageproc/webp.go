@@ -0,0 +1,172 @@
+package imageproc
+
+import (
+    "bytes"
+    "context"
+    "encoding/binary"
+    "fmt"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strconv"
+)
+
+// webpFrameCount counts the ANMF chunks of an animated WebP without decoding
+// anything. It returns 0 for data that isn't a WebP and 1 for still WebPs.
+func webpFrameCount(data []byte) int {
+    if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+        return 0
+    }
+
+    frames := 0
+    animated := false
+    pos := 12
+    for pos+8 <= len(data) {
+        fourCC := string(data[pos : pos+4])
+        size := int(binary.LittleEndian.Uint32(data[pos+4 : pos+8]))
+        switch fourCC {
+        case "VP8X":
+            animated = pos+8 < len(data) && data[pos+8]&0x02 != 0
+        case "ANMF":
+            frames++
+        }
+        if size > len(data) {
+            break
+        }
+        pos += 8 + size + size%2
+    }
+    if !animated {
+        return 1
+    }
+    return max(1, frames)
+}
+
+// animationFrames returns the number of frames of an animated GIF or WebP,
+// 1 for anything else
+func animationFrames(data []byte) int {
+    return max(1, max(gifFrameCount(data), webpFrameCount(data)))
+}
+
+// animationSize reads the canvas size of a GIF, or of a WebP with the VP8X
+// header animated ones have, without decoding anything. It returns 0, 0 for
+// anything else.
+func animationSize(data []byte) (int, int) {
+    if isGIF(data) && len(data) >= 10 {
+        return int(binary.LittleEndian.Uint16(data[6:8])), int(binary.LittleEndian.Uint16(data[8:10]))
+    }
+    // VP8X is the first chunk when present: flags, 3 reserved bytes, then
+    // the canvas width and height minus one in 24 bits each
+    if isWebP(data) && len(data) >= 30 && string(data[12:16]) == "VP8X" {
+        width := int(data[24]) | int(data[25])<<8 | int(data[26])<<16
+        height := int(data[27]) | int(data[28])<<8 | int(data[29])<<16
+        return width + 1, height + 1
+    }
+    return 0, 0
+}
+
+// animationHasAlpha reports whether a GIF has a transparent color, or a
+// WebP's VP8X header says it has alpha
+func animationHasAlpha(data []byte) bool {
+    if isWebP(data) && len(data) >= 21 && string(data[12:16]) == "VP8X" {
+        return data[20]&0x10 != 0
+    }
+    return gifHasTransparency(data)
+}
+
+// processAnimatedWebP keeps an animated WebP animated, scaling it down if it
+// exceeds maxDimension. Requests whose preset targets clients without WebP
+// support get an animated GIF instead.
+func (p *Processor) processAnimatedWebP(ctx context.Context, data []byte, frames, width, height, maxDimension int, opts ProcessOptions, timings stageTimings) (*ProcessResult, error) {
+    originalSize := len(data)
+    fmt.Printf("🎞️ Animated WebP detected (%d frames), preserving animation.\n", frames)
+
+    resize := needsResize(width, height, maxDimension)
+    toGIF := presets[opts.Preset].AnimatedGIF
+    finalWidth, finalHeight := width, height
+    if resize {
+        finalWidth, finalHeight = calculateDimensionsWithMax(width, height, maxDimension)
+    }
+
+    processedData, outputContentType := data, "image/webp"
+    var err error
+    switch {
+    case toGIF:
+        fmt.Println("🔁 Converting animated WebP to GIF for compatibility...")
+        done := timings.track(StageEncode)
+        processedData, err = convertAnimation(ctx, data, "webp", "gif", "", finalWidth, finalHeight)
+        done()
+        if err != nil {
+            return nil, fmt.Errorf("failed to convert animated WebP to GIF: %v", err)
+        }
+        outputContentType = "image/gif"
+
+        done = timings.track(StageOptimize)
+        optimized, err := optimizeWithGifsicle(ctx, processedData, 0, 0, 0)
+        done()
+        if ctx.Err() != nil {
+            return nil, ctx.Err()
+        }
+        if err != nil {
+            fmt.Printf("⚠️ gifsicle optimization failed, keeping unoptimized GIF. Error: %v\n", err)
+        } else {
+            processedData = optimized
+        }
+    case resize:
+        done := timings.track(StageResize)
+        processedData, err = convertAnimation(ctx, data, "webp", "webp", fmt.Sprintf("[Q=%d]", p.webpQualityFor(opts)), finalWidth, finalHeight)
+        done()
+        if err != nil {
+            return nil, fmt.Errorf("failed to resize animated WebP: %v", err)
+        }
+    }
+
+    done := timings.track(StageMetadata)
+    processedData, err = p.stripMetadata(processedData)
+    done()
+    if err != nil {
+        return nil, fmt.Errorf("failed to strip metadata: %v", err)
+    }
+    if w, h := animationSize(processedData); w > 0 && h > 0 {
+        finalWidth, finalHeight = w, h
+    }
+
+    fmt.Printf("✅ Animated WebP processed: %d bytes -> %d bytes (%s)\n", originalSize, len(processedData), outputContentType)
+
+    return &ProcessResult{
+        Data:           processedData,
+        ContentType:    outputContentType,
+        Width:          finalWidth,
+        Height:         finalHeight,
+        HasAlpha:       animationHasAlpha(processedData),
+        Frames:         animationFrames(processedData),
+        OriginalSize:   originalSize,
+        CompressedSize: len(processedData),
+    }, nil
+}
+
+// convertAnimation loads all frames of an animation with the vips CLI, bimg
+// only ever loads the first one, and saves them scaled to fit width x height
+// in the format of outExt with the given vips save options
+func convertAnimation(ctx context.Context, input []byte, inExt, outExt, saveOptions string, width, height int) ([]byte, error) {
+    dir, err := os.MkdirTemp("", "animation")
+    if err != nil {
+        return nil, err
+    }
+    defer os.RemoveAll(dir)
+
+    inPath := filepath.Join(dir, "in."+inExt)
+    outPath := filepath.Join(dir, "out."+outExt)
+    if err := os.WriteFile(inPath, input, 0600); err != nil {
+        return nil, err
+    }
+
+    var stderr bytes.Buffer
+    cmd := exec.CommandContext(ctx, "vips", "thumbnail", inPath+"[n=-1]", outPath+saveOptions, strconv.Itoa(width),
+        "--height", strconv.Itoa(height), "--size", "down")
+    cmd.Stderr = &stderr
+    if err := cmd.Run(); err != nil {
+        return nil, fmt.Errorf("%v: %s", err, stderr.String())
+    }
+
+    return os.ReadFile(outPath)
+}
@@ -0,0 +1,62 @@
+package imageproc
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// webpChunks builds a RIFF WebP container around the given chunks
+func webpChunks(chunks ...[]byte) []byte {
+	var body []byte
+	for _, c := range chunks {
+		body = append(body, c...)
+	}
+	out := []byte("RIFF")
+	out = binary.LittleEndian.AppendUint32(out, uint32(4+len(body)))
+	return append(append(out, "WEBP"...), body...)
+}
+
+func webpChunk(fourCC string, payload []byte) []byte {
+	c := binary.LittleEndian.AppendUint32([]byte(fourCC), uint32(len(payload)))
+	c = append(c, payload...)
+	if len(payload)%2 == 1 {
+		c = append(c, 0)
+	}
+	return c
+}
+
+func TestWebPFrameCount(t *testing.T) {
+	vp8x := func(flags byte) []byte { return webpChunk("VP8X", []byte{flags, 0, 0, 0, 0, 0, 0, 0, 0, 0}) }
+	frame := webpChunk("ANMF", make([]byte, 17))
+
+	if n := webpFrameCount(webpChunks(vp8x(0x02), webpChunk("ANIM", make([]byte, 6)), frame, frame, frame)); n != 3 {
+		t.Errorf("expected 3 frames, got %d", n)
+	}
+	if n := webpFrameCount(webpChunks(webpChunk("VP8L", make([]byte, 5)))); n != 1 {
+		t.Errorf("expected a still WebP to have 1 frame, got %d", n)
+	}
+	if n := webpFrameCount([]byte("GIF89a")); n != 0 {
+		t.Errorf("expected 0 for non-WebP data, got %d", n)
+	}
+}
+
+func TestAnimationSize(t *testing.T) {
+	// A 300x2000 canvas, stored minus one
+	vp8x := webpChunk("VP8X", []byte{0x02, 0, 0, 0, 0x2b, 0x01, 0x00, 0xcf, 0x07, 0x00})
+	if w, h := animationSize(webpChunks(vp8x, webpChunk("ANIM", make([]byte, 6)))); w != 300 || h != 2000 {
+		t.Errorf("animationSize(WebP) = %dx%d, want 300x2000", w, h)
+	}
+	if w, h := animationSize(webpChunks(webpChunk("VP8L", make([]byte, 5)))); w != 0 || h != 0 {
+		t.Errorf("animationSize(WebP without VP8X) = %dx%d, want 0x0", w, h)
+	}
+}
+
+func TestAnimationHasAlpha(t *testing.T) {
+	vp8x := func(flags byte) []byte { return webpChunk("VP8X", []byte{flags, 0, 0, 0, 0, 0, 0, 0, 0, 0}) }
+	if !animationHasAlpha(webpChunks(vp8x(0x12))) {
+		t.Error("WebP with the alpha flag reported opaque")
+	}
+	if animationHasAlpha(webpChunks(vp8x(0x02))) {
+		t.Error("WebP without the alpha flag reported transparent")
+	}
+}
@@ -0,0 +1,131 @@
+// Package integrity audits stored objects against the checksums recorded when
+// they were uploaded
+package integrity
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/hackclub/format/internal/db"
+	"github.com/hackclub/format/internal/storage"
+	"github.com/hackclub/format/internal/util"
+	"github.com/rs/zerolog"
+)
+
+// ErrRunning is returned when an audit is already in progress
+var ErrRunning = errors.New("integrity audit already running")
+
+// maxReportedKeys bounds the mismatched keys listed in a report
+const maxReportedKeys = 100
+
+// Storage is what an audit needs from the storage backend
+type Storage interface {
+	WalkObjects(ctx context.Context, prefix string, fn func(types.Object) error) error
+	GetObjectMetadata(ctx context.Context, key string) (*s3.HeadObjectOutput, error)
+}
+
+// Auditor compares, for every object, the SHA-256 recorded in its metadata
+// at upload with the checksum the store verified and, for assets, with the
+// hash in their record
+type Auditor struct {
+	storage Storage
+	db      *db.DB
+	logger  zerolog.Logger
+	running sync.Mutex
+}
+
+// Report summarizes an audit
+type Report struct {
+	Prefix  string `json:"prefix"`
+	Scanned int    `json:"scanned"`
+	// Verified objects had a recorded checksum that matched everything it
+	// was compared with
+	Verified int `json:"verified"`
+	// Unverified objects were uploaded without a recorded checksum
+	Unverified int      `json:"unverified"`
+	Mismatched []string `json:"mismatched"`
+	Errors     int      `json:"errors"`
+}
+
+func NewAuditor(storage Storage, db *db.DB, logger zerolog.Logger) *Auditor {
+	return &Auditor{
+		storage: storage,
+		db:      db,
+		logger:  logger,
+	}
+}
+
+// Run audits the objects under prefix, all of them when empty
+func (a *Auditor) Run(ctx context.Context, prefix string) (*Report, error) {
+	if !a.running.TryLock() {
+		return nil, ErrRunning
+	}
+	defer a.running.Unlock()
+
+	report := &Report{Prefix: prefix, Mismatched: []string{}}
+	err := a.storage.WalkObjects(ctx, prefix, func(obj types.Object) error {
+		a.audit(ctx, aws.ToString(obj.Key), report)
+		return ctx.Err()
+	})
+
+	a.logger.Info().
+		Str("prefix", prefix).
+		Int("scanned", report.Scanned).
+		Int("verified", report.Verified).
+		Int("unverified", report.Unverified).
+		Int("mismatched", len(report.Mismatched)).
+		Int("errors", report.Errors).
+		Msg("integrity audit finished")
+	return report, err
+}
+
+// audit checks the object at key
+func (a *Auditor) audit(ctx context.Context, key string, report *Report) {
+	report.Scanned++
+	meta, err := a.storage.GetObjectMetadata(ctx, key)
+	if err != nil {
+		a.logger.Error().Err(err).Str("key", key).Msg("failed to read object metadata for integrity audit")
+		report.Errors++
+		return
+	}
+	recorded := strings.ToLower(meta.Metadata[storage.ChecksumMetadata])
+	if recorded == "" {
+		report.Unverified++
+		return
+	}
+
+	mismatch := ""
+	if stored := aws.ToString(meta.ChecksumSHA256); stored != "" {
+		// Multipart checksums end in -<parts> and aren't of the whole data
+		if decoded, err := base64.StdEncoding.DecodeString(stored); err == nil && hex.EncodeToString(decoded) != recorded {
+			mismatch = "store checksum " + hex.EncodeToString(decoded)
+		}
+	}
+	if mismatch == "" && util.IsBaseKey(key) {
+		record, err := a.db.GetAsset(ctx, key)
+		if err != nil && !errors.Is(err, db.ErrNotFound) {
+			a.logger.Error().Err(err).Str("key", key).Msg("failed to look up asset for integrity audit")
+			report.Errors++
+			return
+		}
+		if record != nil && record.Hash != "" && record.Hash != "sha256:"+recorded {
+			mismatch = "record hash " + record.Hash
+		}
+	}
+
+	if mismatch != "" {
+		a.logger.Error().Str("key", key).Str("recorded", recorded).Str("against", mismatch).Msg("object checksum mismatch")
+		if len(report.Mismatched) < maxReportedKeys {
+			report.Mismatched = append(report.Mismatched, key)
+		}
+		return
+	}
+	report.Verified++
+}
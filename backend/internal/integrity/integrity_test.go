@@ -0,0 +1,84 @@
+package integrity
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/hackclub/format/internal/db"
+	"github.com/hackclub/format/internal/storage"
+	"github.com/hackclub/format/internal/util"
+	"github.com/rs/zerolog"
+)
+
+// fakeStorage serves the metadata of a fixed set of objects
+type fakeStorage map[string]*s3.HeadObjectOutput
+
+func (f fakeStorage) WalkObjects(ctx context.Context, prefix string, fn func(types.Object) error) error {
+	for key := range f {
+		if err := fn(types.Object{Key: aws.String(key)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f fakeStorage) GetObjectMetadata(ctx context.Context, key string) (*s3.HeadObjectOutput, error) {
+	return f[key], nil
+}
+
+func metadata(recorded, stored []byte) *s3.HeadObjectOutput {
+	out := &s3.HeadObjectOutput{Metadata: map[string]string{}}
+	if recorded != nil {
+		sum := sha256.Sum256(recorded)
+		out.Metadata[storage.ChecksumMetadata] = hex.EncodeToString(sum[:])
+	}
+	if stored != nil {
+		sum := sha256.Sum256(stored)
+		out.ChecksumSHA256 = aws.String(base64.StdEncoding.EncodeToString(sum[:]))
+	}
+	return out
+}
+
+func TestAudit(t *testing.T) {
+	ctx := context.Background()
+	database, err := db.Open(ctx, filepath.Join(t.TempDir(), "format.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	good, corrupt, recordless := []byte("good"), []byte("corrupt"), []byte("recordless")
+	goodKey := util.Base32Key(good, ".jpg")
+	corruptKey := util.Base32Key(corrupt, ".jpg")
+	for key, data := range map[string][]byte{goodKey: good, corruptKey: []byte("other")} {
+		if err := database.SaveAsset(ctx, &db.Asset{Key: key, Hash: "sha256:" + util.HashBytes(data), MIME: "image/jpeg"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	auditor := NewAuditor(fakeStorage{
+		goodKey:                            metadata(good, good),
+		corruptKey:                         metadata(corrupt, nil),
+		util.Base32Key(recordless, ".jpg"): metadata(recordless, recordless),
+		"tmp/mismatched.bin":               metadata(good, corrupt),
+		"tmp/legacy.bin":                   metadata(nil, nil),
+	}, database, zerolog.Nop())
+
+	report, err := auditor.Run(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Scanned != 5 || report.Verified != 2 || report.Unverified != 1 || report.Errors != 0 {
+		t.Errorf("report = %+v, want 5 scanned, 2 verified, 1 unverified", report)
+	}
+	if len(report.Mismatched) != 2 {
+		t.Errorf("mismatched = %v, want %s and tmp/mismatched.bin", report.Mismatched, corruptKey)
+	}
+}
@@ -0,0 +1,335 @@
+// Package malware rejects files that are more than the image they claim to
+// be before they're published on the CDN
+package malware
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrPolyglot is returned for images carrying another file, like an
+	// appended ZIP or embedded HTML
+	ErrPolyglot = errors.New("file contains data besides the image")
+	// ErrInfected is returned for files ClamAV found a signature in
+	ErrInfected = errors.New("file is infected")
+	// ErrActiveContent is returned for documents that run code or launch
+	// other files when opened
+	ErrActiveContent = errors.New("document contains active content")
+)
+
+// Scanner checks files for polyglot payloads and, with a clamd address,
+// with ClamAV
+type Scanner struct {
+	clamdAddress string
+	timeout      time.Duration
+}
+
+// NewScanner returns a Scanner. clamdAddress is the host:port of clamd,
+// empty to only check for polyglots.
+func NewScanner(clamdAddress string, timeout time.Duration) *Scanner {
+	return &Scanner{clamdAddress: clamdAddress, timeout: timeout}
+}
+
+// Check returns ErrPolyglot or ErrInfected, wrapped with details, for files
+// that mustn't be published
+func (s *Scanner) Check(ctx context.Context, data []byte, contentType string) error {
+	if err := CheckPolyglot(data, contentType); err != nil {
+		return err
+	}
+	if s == nil || s.clamdAddress == "" {
+		return nil
+	}
+	return s.scanClamd(ctx, data)
+}
+
+// CheckDocument returns ErrActiveContent or ErrInfected, wrapped with
+// details, for documents that mustn't be published. Documents aren't images,
+// the polyglot checks don't apply.
+func (s *Scanner) CheckDocument(ctx context.Context, data []byte, contentType string) error {
+	if err := CheckActiveContent(data, contentType); err != nil {
+		return err
+	}
+	if s == nil || s.clamdAddress == "" {
+		return nil
+	}
+	return s.scanClamd(ctx, data)
+}
+
+// pdfActionRegex matches the PDF names of scripts, launch actions and
+// embedded files
+var pdfActionRegex = regexp.MustCompile(`/(JavaScript|JS|Launch|EmbeddedFile)\b`)
+
+// CheckActiveContent rejects PDFs with scripts, launch actions or embedded
+// files. Names hidden with #xx escapes aren't decoded, ClamAV catches known
+// exploits using them.
+func CheckActiveContent(data []byte, contentType string) error {
+	if contentType != "application/pdf" {
+		return nil
+	}
+	if match := pdfActionRegex.Find(data); match != nil {
+		return fmt.Errorf("%w: PDF %s", ErrActiveContent, match)
+	}
+	return nil
+}
+
+// markupSignatures are never found in image data by chance but make
+// browsers or servers treat the file as something else
+var markupSignatures = [][]byte{
+	[]byte("<script"),
+	[]byte("<html"),
+	[]byte("<iframe"),
+	[]byte("<?php"),
+	[]byte("javascript:"),
+}
+
+// CheckPolyglot rejects images with bytes after the end of their structure,
+// where appended archives hide, images whose structure can't be followed to
+// its end, and images with embedded markup. SVGs are markup and aren't
+// checked.
+func CheckPolyglot(data []byte, contentType string) error {
+	end := len(data)
+	switch contentType {
+	case "image/svg+xml":
+		return nil
+	case "image/jpeg":
+		end = jpegEnd(data)
+	case "image/png":
+		end = pngEnd(data)
+	case "image/gif":
+		end = gifEnd(data)
+	case "image/webp", "image/avif", "image/heic", "image/heif":
+		end = containerEnd(data, contentType)
+	}
+	if end < 0 {
+		return fmt.Errorf("%w: can't find the end of the %s", ErrPolyglot, contentType)
+	}
+	if end < len(data) && len(bytes.Trim(data[end:], "\x00")) > 0 {
+		return fmt.Errorf("%w: %d bytes after the end of the %s", ErrPolyglot, len(data)-end, contentType)
+	}
+
+	lower := bytes.ToLower(data)
+	for _, signature := range markupSignatures {
+		if bytes.Contains(lower, signature) {
+			return fmt.Errorf("%w: embedded %q", ErrPolyglot, signature)
+		}
+	}
+	return nil
+}
+
+// jpegEnd returns where the JPEG in data ends, after the first end of image
+// marker outside of segments and entropy-coded data, -1 if it can't tell
+func jpegEnd(data []byte) int {
+	if len(data) < 2 || data[0] != 0xFF || data[1] != 0xD8 {
+		return -1
+	}
+	pos := 2
+	for {
+		// Markers may be padded with any number of 0xFF
+		if pos >= len(data) || data[pos] != 0xFF {
+			return -1
+		}
+		for pos < len(data) && data[pos] == 0xFF {
+			pos++
+		}
+		if pos >= len(data) {
+			return -1
+		}
+		marker := data[pos]
+		pos++
+		switch {
+		case marker == 0xD9: // end of image
+			return pos
+		case marker == 0x01 || marker >= 0xD0 && marker <= 0xD7: // standalone
+			continue
+		case marker == 0x00:
+			return -1
+		}
+		if pos+2 > len(data) {
+			return -1
+		}
+		length := int(binary.BigEndian.Uint16(data[pos : pos+2]))
+		if length < 2 || pos+length > len(data) {
+			return -1
+		}
+		pos += length
+		if marker != 0xDA {
+			continue
+		}
+		// Entropy-coded data follows a start of scan, up to the next marker
+		// that isn't a stuffed 0xFF00 or a restart
+		for {
+			i := bytes.IndexByte(data[pos:], 0xFF)
+			if i < 0 || pos+i+1 >= len(data) {
+				return -1
+			}
+			pos += i
+			next := data[pos+1]
+			if next == 0xFF {
+				// Padding before a marker
+				pos++
+				continue
+			}
+			if next != 0x00 && (next < 0xD0 || next > 0xD7) {
+				break
+			}
+			pos += 2
+		}
+	}
+}
+
+// pngEnd returns where the PNG in data ends, after the CRC of its first IEND
+// chunk, -1 if it can't tell
+func pngEnd(data []byte) int {
+	if !bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")) {
+		return -1
+	}
+	pos := 8
+	for pos+12 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[pos : pos+4]))
+		if length > len(data)-pos-12 {
+			return -1
+		}
+		chunkType := string(data[pos+4 : pos+8])
+		pos += 12 + length
+		if chunkType == "IEND" {
+			return pos
+		}
+	}
+	return -1
+}
+
+// gifEnd returns where the GIF in data ends, after the first trailer between
+// its blocks, -1 if it can't tell
+func gifEnd(data []byte) int {
+	if len(data) < 13 || !bytes.HasPrefix(data, []byte("GIF87a")) && !bytes.HasPrefix(data, []byte("GIF89a")) {
+		return -1
+	}
+	pos := 13
+	if flags := data[10]; flags&0x80 != 0 {
+		pos += 3 << (flags&0x07 + 1)
+	}
+	for pos < len(data) {
+		switch data[pos] {
+		case 0x3B: // trailer
+			return pos + 1
+		case 0x21: // extension: introducer and label
+			pos += 2
+		case 0x2C: // image: descriptor, local color table, LZW code size
+			if pos+10 > len(data) {
+				return -1
+			}
+			if flags := data[pos+9]; flags&0x80 != 0 {
+				pos += 3 << (flags&0x07 + 1)
+			}
+			pos += 11
+		default:
+			return -1
+		}
+		// Data sub-blocks, up to an empty one
+		for {
+			if pos >= len(data) {
+				return -1
+			}
+			size := int(data[pos])
+			pos += 1 + size
+			if size == 0 {
+				break
+			}
+		}
+	}
+	return -1
+}
+
+// containerEnd returns where the RIFF (WebP) or ISO BMFF (AVIF, HEIF)
+// container of data ends, -1 if it can't tell
+func containerEnd(data []byte, contentType string) int {
+	if contentType == "image/webp" {
+		if len(data) < 12 || string(data[:4]) != "RIFF" {
+			return -1
+		}
+		size := int(binary.LittleEndian.Uint32(data[4:8]))
+		return min(8+size+size%2, len(data))
+	}
+
+	// ISO BMFF is a sequence of top-level boxes
+	pos := 0
+	for pos+8 <= len(data) {
+		size := int(binary.BigEndian.Uint32(data[pos : pos+4]))
+		switch {
+		case size == 0:
+			return len(data) // the last box extends to the end
+		case size == 1:
+			if pos+16 > len(data) {
+				return -1
+			}
+			size = int(binary.BigEndian.Uint64(data[pos+8 : pos+16]))
+		case size < 8:
+			return -1
+		}
+		if size > len(data)-pos {
+			return -1
+		}
+		pos += size
+	}
+	return pos
+}
+
+// clamdChunkSize is the size of the INSTREAM chunks sent to clamd
+const clamdChunkSize = 64 << 10
+
+// scanClamd streams data to clamd with the INSTREAM command
+func (s *Scanner) scanClamd(ctx context.Context, data []byte) error {
+	dialer := net.Dialer{Timeout: s.timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", s.clamdAddress)
+	if err != nil {
+		return fmt.Errorf("failed to connect to clamd: %v", err)
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(s.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return fmt.Errorf("clamd scan failed: %v", err)
+	}
+	for len(data) > 0 {
+		chunk := data[:min(clamdChunkSize, len(data))]
+		data = data[len(chunk):]
+		if err := binary.Write(conn, binary.BigEndian, uint32(len(chunk))); err != nil {
+			return fmt.Errorf("clamd scan failed: %v", err)
+		}
+		if _, err := conn.Write(chunk); err != nil {
+			return fmt.Errorf("clamd scan failed: %v", err)
+		}
+	}
+	// A zero-length chunk ends the stream
+	if err := binary.Write(conn, binary.BigEndian, uint32(0)); err != nil {
+		return fmt.Errorf("clamd scan failed: %v", err)
+	}
+
+	reply, err := io.ReadAll(conn)
+	if err != nil {
+		return fmt.Errorf("clamd scan failed: %v", err)
+	}
+	result := strings.TrimSpace(strings.TrimRight(string(reply), "\x00"))
+	switch {
+	case strings.HasSuffix(result, "OK"):
+		return nil
+	case strings.HasSuffix(result, "FOUND"):
+		signature := strings.TrimSuffix(strings.TrimPrefix(result, "stream: "), " FOUND")
+		return fmt.Errorf("%w: %s", ErrInfected, signature)
+	default:
+		return fmt.Errorf("clamd scan failed: %s", result)
+	}
+}
@@ -0,0 +1,156 @@
+package malware
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func testPNG(t *testing.T) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func testJPEG(t *testing.T) []byte {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 16, 16)), nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func testGIF(t *testing.T) []byte {
+	var buf bytes.Buffer
+	if err := gif.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 4, 4)), nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestCheckPolyglot(t *testing.T) {
+	clean := testPNG(t)
+	cleanJPEG, cleanGIF := testJPEG(t), testGIF(t)
+	appended := func(image []byte, payload string) []byte {
+		return append(append([]byte{}, image...), payload...)
+	}
+	tests := []struct {
+		name        string
+		data        []byte
+		contentType string
+		polyglot    bool
+	}{
+		{"clean PNG", clean, "image/png", false},
+		{"PNG with zero padding", append(append([]byte{}, clean...), 0, 0, 0), "image/png", false},
+		{"PNG with appended ZIP", append(append([]byte{}, clean...), []byte("PK\x03\x04payload")...), "image/png", true},
+		{"JPEG with appended HTML", []byte("\xFF\xD8\xFF\xE0data\xFF\xD9<html><body>hi"), "image/jpeg", true},
+		{"JPEG with embedded script", []byte("\xFF\xD8\xFF\xFEcomment <SCRIPT>alert(1)</script>\xFF\xD9"), "image/jpeg", true},
+		{"PNG with appended data ending in IEND", appended(clean, "PK\x03\x04payload\x00\x00\x00\x00IEND\xAE\x42\x60\x82"), "image/png", true},
+		{"clean JPEG", cleanJPEG, "image/jpeg", false},
+		{"JPEG with appended data ending in EOI", appended(cleanJPEG, "PK\x03\x04payload\xFF\xD9"), "image/jpeg", true},
+		{"clean GIF", cleanGIF, "image/gif", false},
+		{"GIF with appended data ending in a trailer", appended(cleanGIF, "PK\x03\x04payload;"), "image/gif", true},
+		{"GIF without trailer", []byte("GIF89a....PK\x03\x04"), "image/gif", true},
+		{"WebP with appended data", append([]byte("RIFF\x04\x00\x00\x00WEBP"), "extra"...), "image/webp", true},
+		{"SVG", []byte("<svg><script>alert(1)</script></svg>"), "image/svg+xml", false},
+	}
+	for _, tt := range tests {
+		err := CheckPolyglot(tt.data, tt.contentType)
+		if got := errors.Is(err, ErrPolyglot); got != tt.polyglot {
+			t.Errorf("%s: CheckPolyglot() = %v, want polyglot %v", tt.name, err, tt.polyglot)
+		}
+	}
+}
+
+func TestCheckActiveContent(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        string
+		contentType string
+		active      bool
+	}{
+		{"plain PDF", "%PDF-1.7\n1 0 obj << /Type /Catalog /Pages 2 0 R >>", "application/pdf", false},
+		{"PDF with script", "%PDF-1.7\n1 0 obj << /OpenAction << /S /JavaScript /JS (app.alert(1)) >> >>", "application/pdf", true},
+		{"PDF with launch action", "%PDF-1.7\n<< /S /Launch /F (cmd.exe) >>", "application/pdf", true},
+		{"PDF with JSON-like name", "%PDF-1.7\n<< /JSONData 1 >>", "application/pdf", false},
+		{"text mentioning a script", "/JavaScript", "text/plain", false},
+	}
+	for _, tt := range tests {
+		err := CheckActiveContent([]byte(tt.data), tt.contentType)
+		if got := errors.Is(err, ErrActiveContent); got != tt.active {
+			t.Errorf("%s: CheckActiveContent() = %v, want active %v", tt.name, err, tt.active)
+		}
+	}
+}
+
+// fakeClamd answers INSTREAM requests, reporting streams containing "EICAR"
+// as infected
+func fakeClamd(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				command := make([]byte, len("zINSTREAM\x00"))
+				if _, err := io.ReadFull(conn, command); err != nil {
+					return
+				}
+				var stream []byte
+				for {
+					var size uint32
+					if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+						return
+					}
+					if size == 0 {
+						break
+					}
+					chunk := make([]byte, size)
+					if _, err := io.ReadFull(conn, chunk); err != nil {
+						return
+					}
+					stream = append(stream, chunk...)
+				}
+				if bytes.Contains(stream, []byte("EICAR")) {
+					conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+				} else {
+					conn.Write([]byte("stream: OK\x00"))
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestClamd(t *testing.T) {
+	scanner := NewScanner(fakeClamd(t), 5*time.Second)
+	ctx := context.Background()
+
+	if err := scanner.Check(ctx, testPNG(t), "image/png"); err != nil {
+		t.Errorf("clean image: %v", err)
+	}
+	// Larger than one chunk
+	infected := append(bytes.Repeat([]byte{1}, clamdChunkSize+10), []byte("EICAR")...)
+	if err := scanner.Check(ctx, infected, "application/octet-stream"); !errors.Is(err, ErrInfected) {
+		t.Errorf("infected file: %v, want ErrInfected", err)
+	}
+}
@@ -0,0 +1,54 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Image processing worker pool
+var (
+	ProcessingQueueWait = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "format_processing_queue_wait_seconds",
+		Help:    "Time images waited for a free processing worker.",
+		Buckets: []float64{.001, .01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	})
+	ProcessingQueued = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "format_processing_queued",
+		Help: "Images waiting for a processing worker.",
+	})
+	ProcessingInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "format_processing_in_flight",
+		Help: "Images currently being processed.",
+	})
+)
+
+// Image processing pipeline
+var (
+	ProcessingStageDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "format_processing_stage_seconds",
+		Help:    "Time spent in each image processing stage (decode, resize, encode, optimize, ...).",
+		Buckets: []float64{.001, .005, .01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"stage"})
+	ProcessingInputBytes = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "format_processing_input_bytes",
+		Help:    "Size of images going into the processing pipeline.",
+		Buckets: prometheus.ExponentialBuckets(1024, 4, 10), // 1KB to 256MB
+	})
+	ProcessingOutputBytes = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "format_processing_output_bytes",
+		Help:    "Size of processed images.",
+		Buckets: prometheus.ExponentialBuckets(1024, 4, 10),
+	})
+	ProcessingConversions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "format_processing_conversions_total",
+		Help: "Processed images by detected input type and output type.",
+	}, []string{"input", "output"})
+)
+
+// Rate limiting
+var (
+	RateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "format_rate_limited_total",
+		Help: "Requests rejected with 429 by the rate limiter, by route class.",
+	}, []string{"class"})
+)
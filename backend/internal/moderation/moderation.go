@@ -0,0 +1,95 @@
+// Package moderation scans images for NSFW or abusive content before they're
+// published
+package moderation
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ErrFlagged is returned for images moderation rejected or quarantined
+var ErrFlagged = errors.New("image was flagged by content moderation")
+
+// Actions for flagged images
+const (
+	ActionReject     = "reject"     // the image is dropped
+	ActionQuarantine = "quarantine" // the image is kept under QuarantinePrefix for review
+)
+
+// QuarantinePrefix is where quarantined images are stored, in the private
+// store that's never served
+const QuarantinePrefix = "quarantine/"
+
+// IsValidAction reports whether action is ActionReject or ActionQuarantine
+func IsValidAction(action string) bool {
+	return action == ActionReject || action == ActionQuarantine
+}
+
+// Verdict is the outcome of a scan
+type Verdict struct {
+	Flagged    bool     `json:"flagged"`
+	Categories []string `json:"categories,omitempty"`
+}
+
+// Scanner scans an image. Implementations must be safe for concurrent use.
+type Scanner interface {
+	Scan(ctx context.Context, data []byte, contentType string) (*Verdict, error)
+}
+
+// Policy is how uploads are moderated. Without a Scanner they aren't.
+type Policy struct {
+	Scanner  Scanner
+	Action   string // ActionReject or ActionQuarantine
+	FailOpen bool   // publish when the scanner fails instead of rejecting
+}
+
+// HTTPScanner posts the image bytes to a moderation endpoint, which answers
+// with a Verdict as JSON
+type HTTPScanner struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func NewHTTPScanner(url, token string, timeout time.Duration) *HTTPScanner {
+	return &HTTPScanner{
+		url:    url,
+		token:  token,
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+// Scan implements Scanner
+func (s *HTTPScanner) Scan(ctx context.Context, data []byte, contentType string) (*Verdict, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("moderation request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("moderation returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var verdict Verdict
+	if err := json.NewDecoder(resp.Body).Decode(&verdict); err != nil {
+		return nil, fmt.Errorf("invalid moderation response: %v", err)
+	}
+	return &verdict, nil
+}
@@ -0,0 +1,38 @@
+package moderation
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHTTPScanner(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" || r.Header.Get("Content-Type") != "image/png" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		json.NewEncoder(w).Encode(Verdict{Flagged: string(body) == "bad", Categories: []string{"nsfw"}})
+	}))
+	defer server.Close()
+
+	scanner := NewHTTPScanner(server.URL, "token", 5*time.Second)
+	verdict, err := scanner.Scan(context.Background(), []byte("bad"), "image/png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !verdict.Flagged || len(verdict.Categories) != 1 {
+		t.Errorf("verdict = %+v, want flagged", verdict)
+	}
+	if verdict, err = scanner.Scan(context.Background(), []byte("fine"), "image/png"); err != nil || verdict.Flagged {
+		t.Errorf("verdict = %+v, %v, want not flagged", verdict, err)
+	}
+	if _, err := scanner.Scan(context.Background(), []byte("bad"), "image/jpeg"); err == nil {
+		t.Error("expected an error for a failed request")
+	}
+}
@@ -0,0 +1,236 @@
+// Package openapi builds OpenAPI 3 documents whose schemas are reflected
+// from the Go types handlers decode and encode, so the published spec
+// follows the code.
+package openapi
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Version is the OpenAPI version of the documents
+const Version = "3.0.3"
+
+type Document struct {
+	OpenAPI    string                           `json:"openapi"`
+	Info       Info                             `json:"info"`
+	Servers    []Server                         `json:"servers,omitempty"`
+	Tags       []Tag                            `json:"tags,omitempty"`
+	Paths      map[string]map[string]*Operation `json:"paths"`
+	Components Components                       `json:"components"`
+
+	// names holds the component name of each reflected type
+	names map[reflect.Type]string
+}
+
+type Info struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Version     string `json:"version"`
+}
+
+type Server struct {
+	URL string `json:"url"`
+}
+
+type Tag struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+}
+
+type Components struct {
+	Schemas         map[string]*Schema         `json:"schemas"`
+	SecuritySchemes map[string]*SecurityScheme `json:"securitySchemes,omitempty"`
+}
+
+type SecurityScheme struct {
+	Type         string `json:"type"`
+	Description  string `json:"description,omitempty"`
+	Name         string `json:"name,omitempty"`
+	In           string `json:"in,omitempty"`
+	Scheme       string `json:"scheme,omitempty"`
+	BearerFormat string `json:"bearerFormat,omitempty"`
+}
+
+type Operation struct {
+	Tags        []string             `json:"tags,omitempty"`
+	Summary     string               `json:"summary"`
+	Description string               `json:"description,omitempty"`
+	OperationID string               `json:"operationId"`
+	Parameters  []*Parameter         `json:"parameters,omitempty"`
+	RequestBody *RequestBody         `json:"requestBody,omitempty"`
+	Responses   map[string]*Response `json:"responses"`
+	// Security is nil for the document's default, empty for none
+	Security []map[string][]string `json:"security,omitempty"`
+}
+
+type Parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"` // query, path or header
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+type RequestBody struct {
+	Description string                `json:"description,omitempty"`
+	Required    bool                  `json:"required"`
+	Content     map[string]*MediaType `json:"content"`
+}
+
+type Response struct {
+	Description string                `json:"description"`
+	Content     map[string]*MediaType `json:"content,omitempty"`
+}
+
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Enum                 []string           `json:"enum,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+}
+
+// New returns an empty document
+func New(title, version, description string) *Document {
+	return &Document{
+		OpenAPI:    Version,
+		Info:       Info{Title: title, Version: version, Description: description},
+		Paths:      map[string]map[string]*Operation{},
+		Components: Components{Schemas: map[string]*Schema{}, SecuritySchemes: map[string]*SecurityScheme{}},
+		names:      map[reflect.Type]string{},
+	}
+}
+
+// Add documents the operation of method on path, in OpenAPI's {param} syntax
+func (d *Document) Add(method, path string, op *Operation) {
+	if d.Paths[path] == nil {
+		d.Paths[path] = map[string]*Operation{}
+	}
+	d.Paths[path][strings.ToLower(method)] = op
+}
+
+// JSON describes a JSON body shaped like v
+func (d *Document) JSON(v interface{}) map[string]*MediaType {
+	return map[string]*MediaType{"application/json": {Schema: d.Schema(v)}}
+}
+
+// Schema reflects the JSON schema of v, a value or a nil pointer of its
+// type. Named structs become components, referred to by $ref.
+func (d *Document) Schema(v interface{}) *Schema {
+	return d.schemaOf(reflect.TypeOf(v))
+}
+
+var (
+	timeType    = reflect.TypeOf(time.Time{})
+	rawJSONType = reflect.TypeOf(json.RawMessage{})
+)
+
+func (d *Document) schemaOf(t reflect.Type) *Schema {
+	if t == nil {
+		return &Schema{}
+	}
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return &Schema{Type: "string", Format: "date-time"}
+	case t == rawJSONType:
+		return &Schema{}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return &Schema{Type: "integer"}
+	case reflect.Int64, reflect.Uint64:
+		return &Schema{Type: "integer", Format: "int64"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &Schema{Type: "string", Format: "byte"}
+		}
+		return &Schema{Type: "array", Items: d.schemaOf(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: d.schemaOf(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return d.object(t)
+		}
+		name, ok := d.names[t]
+		if !ok {
+			name = d.name(t)
+			d.names[t] = name
+			// Registered before its fields, types may refer to themselves
+			d.Components.Schemas[name] = &Schema{}
+			*d.Components.Schemas[name] = *d.object(t)
+		}
+		return &Schema{Ref: "#/components/schemas/" + name}
+	}
+	// Interfaces may hold anything
+	return &Schema{}
+}
+
+// name picks the component name of t, its type name unless another package
+// has a type of that name
+func (d *Document) name(t reflect.Type) string {
+	name := t.Name()
+	if _, taken := d.Components.Schemas[name]; !taken {
+		return name
+	}
+	pkg := t.PkgPath()
+	pkg = pkg[strings.LastIndex(pkg, "/")+1:]
+	return strings.ToUpper(pkg[:1]) + pkg[1:] + name
+}
+
+// object reflects the properties of struct t as encoding/json marshals them
+func (d *Document) object(t reflect.Type) *Schema {
+	s := &Schema{Type: "object", Properties: map[string]*Schema{}}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		ft := f.Type
+		for ft.Kind() == reflect.Pointer {
+			ft = ft.Elem()
+		}
+		if f.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+			// Embedded structs' fields are promoted
+			for key, property := range d.object(ft).Properties {
+				if _, ok := s.Properties[key]; !ok {
+					s.Properties[key] = property
+				}
+			}
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		switch ft.Kind() {
+		case reflect.Func, reflect.Chan, reflect.UnsafePointer:
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		s.Properties[name] = d.schemaOf(f.Type)
+	}
+	return s
+}
@@ -0,0 +1,60 @@
+package openapi
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+type base struct {
+	ID      string `json:"id"`
+	Created time.Time
+}
+
+type node struct {
+	*base
+	ID       int               `json:"id"` // shadows base's
+	Name     string            `json:"name,omitempty"`
+	Data     []byte            `json:"data"`
+	Labels   map[string]string `json:"labels"`
+	Children []*node           `json:"children"`
+	Any      interface{}       `json:"any"`
+	Secret   string            `json:"-"`
+	hidden   string
+	Callback func()
+}
+
+func TestSchema(t *testing.T) {
+	doc := New("Test", "1", "")
+	if ref := doc.Schema(&node{}).Ref; ref != "#/components/schemas/node" {
+		t.Fatalf("Schema(*node) = %q, want a reference", ref)
+	}
+	s := doc.Components.Schemas["node"]
+	want := map[string]Schema{
+		"id":       {Type: "integer"},
+		"Created":  {Type: "string", Format: "date-time"},
+		"name":     {Type: "string"},
+		"data":     {Type: "string", Format: "byte"},
+		"labels":   {Type: "object", AdditionalProperties: &Schema{Type: "string"}},
+		"children": {Type: "array", Items: &Schema{Ref: "#/components/schemas/node"}},
+		"any":      {},
+	}
+	if len(s.Properties) != len(want) {
+		t.Errorf("properties = %v, want %d", s.Properties, len(want))
+	}
+	for name, w := range want {
+		got, _ := json.Marshal(s.Properties[name])
+		expected, _ := json.Marshal(w)
+		if string(got) != string(expected) {
+			t.Errorf("property %s = %s, want %s", name, got, expected)
+		}
+	}
+
+	// Anonymous structs are inlined
+	if s := doc.Schema(struct{ N int }{}); s.Type != "object" || s.Properties["N"].Type != "integer" {
+		t.Errorf("Schema(anonymous) = %+v", s)
+	}
+	if _, err := json.Marshal(doc); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,85 @@
+// Package problem writes error responses as RFC 7807 problem details, so
+// clients get the status's title, what went wrong, the request ID to quote
+// and which fields were invalid in one JSON shape.
+package problem
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// ContentType is the media type of problem details
+const ContentType = "application/problem+json"
+
+// TypeValidation is the type of problems listing invalid fields, others are
+// about:blank, described by their status
+const TypeValidation = "/problems/validation"
+
+// Problem is an RFC 7807 problem details object
+type Problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	// Instance is the path of the request that failed
+	Instance  string       `json:"instance,omitempty"`
+	RequestID string       `json:"request_id,omitempty"`
+	Errors    []FieldError `json:"errors,omitempty"`
+}
+
+// FieldError is an invalid field of a request
+type FieldError struct {
+	Field  string `json:"field"`
+	Detail string `json:"detail"`
+}
+
+// fielder is implemented by errors about one field of a request
+type fielder interface {
+	error
+	Field() string
+}
+
+// Error replies to r with a problem of status described by detail, in place
+// of http.Error
+func Error(w http.ResponseWriter, r *http.Request, detail string, status int) {
+	Write(w, r, &Problem{Status: status, Detail: detail})
+}
+
+// Invalid replies to r with 400 Bad Request for err, listing the field it's
+// about when it names one
+func Invalid(w http.ResponseWriter, r *http.Request, err error) {
+	p := &Problem{Status: http.StatusBadRequest, Detail: err.Error()}
+	var f fielder
+	if errors.As(err, &f) {
+		p.Type = TypeValidation
+		p.Errors = []FieldError{{Field: f.Field(), Detail: f.Error()}}
+	}
+	Write(w, r, p)
+}
+
+// Write replies to r with p, filling in its type, title, instance and
+// request ID when missing
+func Write(w http.ResponseWriter, r *http.Request, p *Problem) {
+	if p.Type == "" {
+		p.Type = "about:blank"
+	}
+	if p.Title == "" {
+		p.Title = http.StatusText(p.Status)
+	}
+	if p.Instance == "" {
+		p.Instance = r.URL.Path
+	}
+	if p.RequestID == "" {
+		p.RequestID = middleware.GetReqID(r.Context())
+	}
+
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", ContentType)
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
@@ -0,0 +1,47 @@
+package problem
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+type optionError struct{ option string }
+
+func (e *optionError) Error() string { return e.option + " is invalid" }
+func (e *optionError) Field() string { return e.option }
+
+func TestWrite(t *testing.T) {
+	var handler http.HandlerFunc
+	server := middleware.RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { handler(w, r) }))
+	request := func() (*httptest.ResponseRecorder, *Problem) {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest("POST", "/api/assets", nil))
+		var p Problem
+		if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+			t.Fatal(err)
+		}
+		return w, &p
+	}
+
+	handler = func(w http.ResponseWriter, r *http.Request) { Error(w, r, "Asset not found", http.StatusNotFound) }
+	w, p := request()
+	if w.Code != http.StatusNotFound || w.Header().Get("Content-Type") != ContentType {
+		t.Errorf("status %d, Content-Type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	if p.Type != "about:blank" || p.Title != "Not Found" || p.Status != 404 || p.Detail != "Asset not found" || p.Instance != "/api/assets" || p.RequestID == "" {
+		t.Errorf("problem = %+v", p)
+	}
+
+	handler = func(w http.ResponseWriter, r *http.Request) {
+		Invalid(w, r, fmt.Errorf("invalid options for item 2: %w", &optionError{"quality"}))
+	}
+	w, p = request()
+	if w.Code != http.StatusBadRequest || p.Type != TypeValidation || len(p.Errors) != 1 || p.Errors[0] != (FieldError{"quality", "quality is invalid"}) {
+		t.Errorf("status %d, problem = %+v", w.Code, p)
+	}
+}
@@ -0,0 +1,128 @@
+// Package ratelimit limits requests per client with token buckets
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hackclub/format/internal/metrics"
+	"github.com/hackclub/format/internal/problem"
+	"github.com/hackclub/format/internal/session"
+	"golang.org/x/time/rate"
+)
+
+// idleTimeout is how long a client's bucket is kept after its last request.
+// A dropped bucket starts full again, which idle clients' would be anyway.
+const idleTimeout = 10 * time.Minute
+
+// Limiter holds a token bucket per client for a class of routes
+type Limiter struct {
+	class     string
+	limit     rate.Limit
+	burst     int
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// Status is where a client's bucket stands after a request
+type Status struct {
+	Allowed bool
+	// Remaining is the requests the client can make right away
+	Remaining int
+	// Reset is how long until the bucket is full again
+	Reset time.Duration
+	// RetryAfter is how long until the next request is allowed, when it
+	// isn't
+	RetryAfter time.Duration
+}
+
+// NewLimiter returns a Limiter of the routes of class allowing each client
+// perMinute requests a minute on average and bursts of up to burst requests
+func NewLimiter(class string, perMinute, burst int) *Limiter {
+	return &Limiter{
+		class:     class,
+		limit:     rate.Limit(float64(perMinute) / 60),
+		burst:     max(burst, 1),
+		buckets:   map[string]*bucket{},
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow takes a token from the bucket of client
+func (l *Limiter) Allow(client string) Status {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastSweep) > idleTimeout {
+		for key, b := range l.buckets {
+			if now.Sub(b.lastSeen) > idleTimeout {
+				delete(l.buckets, key)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &bucket{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.buckets[client] = b
+	}
+	b.lastSeen = now
+
+	status := Status{Allowed: true}
+	reservation := b.limiter.ReserveN(now, 1)
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+		status = Status{RetryAfter: delay}
+	}
+	tokens := b.limiter.TokensAt(now)
+	status.Remaining = max(int(tokens), 0)
+	status.Reset = time.Duration((float64(l.burst) - tokens) / float64(l.limit) * float64(time.Second))
+	return status
+}
+
+// Middleware rejects requests of clients over the limit with 429 Too Many
+// Requests and a Retry-After header. Every response gets RateLimit-Limit,
+// RateLimit-Remaining and RateLimit-Reset headers, the innermost limiter's
+// when routes have several. Clients are signed-in users, so it belongs
+// after authentication, or IP addresses otherwise.
+func (l *Limiter) Middleware(next http.Handler) http.Handler {
+	// A full bucket refills in window, the policy's quota is the burst
+	window := int(math.Ceil(float64(l.burst) / float64(l.limit)))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := l.Allow(clientKey(r))
+		w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", l.burst, window))
+		w.Header().Set("RateLimit-Limit", fmt.Sprintf("%d", l.burst))
+		w.Header().Set("RateLimit-Remaining", fmt.Sprintf("%d", status.Remaining))
+		w.Header().Set("RateLimit-Reset", fmt.Sprintf("%d", int(math.Ceil(status.Reset.Seconds()))))
+		if !status.Allowed {
+			metrics.RateLimited.WithLabelValues(l.class).Inc()
+			w.Header().Set("Retry-After", fmt.Sprintf("%d", int(math.Ceil(status.RetryAfter.Seconds()))))
+			problem.Error(w, r, "Too many requests, try again later", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientKey identifies who a request counts against
+func clientKey(r *http.Request) string {
+	if user, ok := r.Context().Value("user").(*session.User); ok && user.Email != "" {
+		return "user:" + user.Email
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return "ip:" + host
+	}
+	return "ip:" + r.RemoteAddr
+}
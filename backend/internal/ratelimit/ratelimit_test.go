@@ -0,0 +1,61 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hackclub/format/internal/metrics"
+	"github.com/hackclub/format/internal/session"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMiddleware(t *testing.T) {
+	limiter := NewLimiter("test", 1, 2)
+	handler := limiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	request := func(email, ip string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/api/assets", nil)
+		r.RemoteAddr = ip + ":1234"
+		if email != "" {
+			r = r.WithContext(context.WithValue(r.Context(), "user", &session.User{Email: email}))
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	// The burst passes, then the bucket is empty
+	for i := 0; i < 2; i++ {
+		w := request("a@hackclub.com", "1.2.3.4")
+		if w.Code != http.StatusOK {
+			t.Fatalf("request %d: status %d, want 200", i, w.Code)
+		}
+		if got, want := w.Header().Get("RateLimit-Remaining"), fmt.Sprint(1-i); got != want {
+			t.Errorf("request %d: RateLimit-Remaining = %q, want %q", i, got, want)
+		}
+	}
+	w := request("a@hackclub.com", "5.6.7.8")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("over limit: status %d, want 429", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got == "" || got == "0" {
+		t.Errorf("Retry-After = %q, want seconds until the next token", got)
+	}
+	if w.Header().Get("RateLimit-Limit") != "2" || w.Header().Get("RateLimit-Policy") != "2;w=120" || w.Header().Get("RateLimit-Reset") == "0" {
+		t.Errorf("RateLimit headers = %v", w.Header())
+	}
+	if got := testutil.ToFloat64(metrics.RateLimited.WithLabelValues("test")); got != 1 {
+		t.Errorf("format_rate_limited_total = %v, want 1", got)
+	}
+
+	// Other users and anonymous clients have their own buckets
+	if w := request("b@hackclub.com", "1.2.3.4"); w.Code != http.StatusOK {
+		t.Errorf("other user: status %d, want 200", w.Code)
+	}
+	if w := request("", "1.2.3.4"); w.Code != http.StatusOK {
+		t.Errorf("anonymous: status %d, want 200", w.Code)
+	}
+}
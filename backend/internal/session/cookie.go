@@ -1,10 +1,13 @@
 package session
 
 import (
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
 	"github.com/gorilla/sessions"
 )
@@ -12,13 +15,23 @@ import (
 const (
 	SessionName = "format-session"
 	UserKey     = "user"
+	// sessionIDKey identifies a login, server-side state like OAuth
+	// tokens is keyed by it
+	sessionIDKey = "sid"
 
 	oauthStateKey        = "oauth_state"
 	oauthCodeVerifierKey = "oauth_code_verifier"
+	oauthProviderKey     = "oauth_provider"
+
+	impersonatorKey         = "impersonator"
+	impersonationExpiresKey = "impersonation_expires"
 )
 
+const sessionMaxAge = 12 * time.Hour
+
 type Manager struct {
 	store sessions.Store
+	db    SessionDB // nil unless sessions are recorded
 }
 
 type User struct {
@@ -27,6 +40,9 @@ type User struct {
 	Name    string `json:"name"`
 	Picture string `json:"picture"`
 	HD      string `json:"hd"`
+	// Provider is the identity provider signed in with: google, slack,
+	// github or oidc, or service for other services calling the API
+	Provider string `json:"provider,omitempty"`
 }
 
 type TokenInfo struct {
@@ -47,7 +63,7 @@ func NewManager(sessionSecret string, appBaseURL string) *Manager {
 
 	store.Options = &sessions.Options{
 		Path:     "/",
-		MaxAge:   12 * 60 * 60, // 12 hours
+		MaxAge:   int(sessionMaxAge.Seconds()),
 		HttpOnly: true,
 		Secure:   secure,
 		SameSite: sameSite,
@@ -66,15 +82,52 @@ func (m *Manager) SetUser(w http.ResponseWriter, r *http.Request, user *User) er
 		return err
 	}
 	sess.Values[UserKey] = string(userBytes)
+	sess.Values[impersonatorKey] = ""
+	// Every login gets a new ID, server-side state of earlier ones is
+	// never reused
+	id := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	sessionID := base64.RawURLEncoding.EncodeToString(id)
+	if err := m.record(r, sessionID, user); err != nil {
+		return err
+	}
+	sess.Values[sessionIDKey] = sessionID
 	return sess.Save(r, w)
 }
 
+// SessionID returns the ID of the signed-in session, empty for sessions
+// without one
+func (m *Manager) SessionID(r *http.Request) string {
+	sess, err := m.store.Get(r, SessionName)
+	if err != nil {
+		return ""
+	}
+	id, _ := sess.Values[sessionIDKey].(string)
+	return id
+}
+
+// MaxAge is how long sessions last
+func (m *Manager) MaxAge() time.Duration {
+	return sessionMaxAge
+}
+
 func (m *Manager) GetUser(r *http.Request) (*User, error) {
 	sess, err := m.store.Get(r, SessionName)
 	if err != nil {
 		return nil, err
 	}
-	userStr, ok := sess.Values[UserKey].(string)
+	if admin, _, expired := impersonation(sess); expired {
+		// Impersonation ends by itself, the admin is back
+		return admin, nil
+	}
+	return sessionUser(sess, UserKey)
+}
+
+// sessionUser decodes the user stored under key, nil if there's none
+func sessionUser(sess *sessions.Session, key string) (*User, error) {
+	userStr, ok := sess.Values[key].(string)
 	if !ok || userStr == "" {
 		return nil, nil
 	}
@@ -90,11 +143,20 @@ func (m *Manager) ClearSession(w http.ResponseWriter, r *http.Request) error {
 	if err != nil {
 		return err
 	}
+	// Signed out even if the record of the session couldn't be removed
+	id, _ := sess.Values[sessionIDKey].(string)
+	forgetErr := m.forget(r, id)
 	sess.Values[UserKey] = ""
+	sess.Values[impersonatorKey] = ""
+	sess.Values[sessionIDKey] = ""
 	sess.Values[oauthStateKey] = ""
 	sess.Values[oauthCodeVerifierKey] = ""
+	sess.Values[oauthProviderKey] = ""
 	sess.Options.MaxAge = -1
-	return sess.Save(r, w)
+	if err := sess.Save(r, w); err != nil {
+		return err
+	}
+	return forgetErr
 }
 
 func (m *Manager) RequireAuth(next http.Handler) http.Handler {
@@ -157,3 +219,27 @@ func (m *Manager) GetAndClearOAuthCodeVerifier(w http.ResponseWriter, r *http.Re
 	}
 	return verifier, nil
 }
+
+// SetOAuthProvider remembers which provider a login was started with, for
+// its callback
+func (m *Manager) SetOAuthProvider(w http.ResponseWriter, r *http.Request, provider string) error {
+	sess, err := m.store.Get(r, SessionName)
+	if err != nil {
+		return err
+	}
+	sess.Values[oauthProviderKey] = provider
+	return sess.Save(r, w)
+}
+
+func (m *Manager) GetAndClearOAuthProvider(w http.ResponseWriter, r *http.Request) (string, error) {
+	sess, err := m.store.Get(r, SessionName)
+	if err != nil {
+		return "", err
+	}
+	provider, _ := sess.Values[oauthProviderKey].(string)
+	sess.Values[oauthProviderKey] = ""
+	if err := sess.Save(r, w); err != nil {
+		return "", err
+	}
+	return provider, nil
+}
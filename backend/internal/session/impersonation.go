@@ -0,0 +1,91 @@
+package session
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// ImpersonationMaxAge is how long an admin acts as another user before the
+// session is theirs again
+const ImpersonationMaxAge = 30 * time.Minute
+
+// Impersonate makes the signed-in admin act as target for
+// ImpersonationMaxAge. The admin is kept in the session, and restored by
+// StopImpersonating or when it expires.
+func (m *Manager) Impersonate(w http.ResponseWriter, r *http.Request, target *User) (time.Time, error) {
+	sess, err := m.store.Get(r, SessionName)
+	if err != nil {
+		return time.Time{}, err
+	}
+	admin, _, _ := impersonation(sess)
+	if admin == nil {
+		// Not impersonating yet, the signed-in user is the admin
+		if admin, err = sessionUser(sess, UserKey); err != nil || admin == nil {
+			return time.Time{}, fmt.Errorf("no signed-in user to impersonate from")
+		}
+	}
+	adminBytes, err := json.Marshal(admin)
+	if err != nil {
+		return time.Time{}, err
+	}
+	targetBytes, err := json.Marshal(target)
+	if err != nil {
+		return time.Time{}, err
+	}
+	expires := time.Now().Add(ImpersonationMaxAge)
+	sess.Values[impersonatorKey] = string(adminBytes)
+	sess.Values[impersonationExpiresKey] = expires.Unix()
+	sess.Values[UserKey] = string(targetBytes)
+	return expires, sess.Save(r, w)
+}
+
+// StopImpersonating signs the admin back in as themselves and returns them,
+// nil if the session wasn't impersonating anyone
+func (m *Manager) StopImpersonating(w http.ResponseWriter, r *http.Request) (*User, error) {
+	sess, err := m.store.Get(r, SessionName)
+	if err != nil {
+		return nil, err
+	}
+	admin, _, _ := impersonation(sess)
+	if admin == nil {
+		return nil, nil
+	}
+	adminBytes, err := json.Marshal(admin)
+	if err != nil {
+		return nil, err
+	}
+	sess.Values[UserKey] = string(adminBytes)
+	sess.Values[impersonatorKey] = ""
+	sess.Values[impersonationExpiresKey] = int64(0)
+	return admin, sess.Save(r, w)
+}
+
+// Impersonator returns the admin acting as the signed-in user and when that
+// ends, nil unless impersonating
+func (m *Manager) Impersonator(r *http.Request) (*User, time.Time) {
+	sess, err := m.store.Get(r, SessionName)
+	if err != nil {
+		return nil, time.Time{}
+	}
+	admin, expires, expired := impersonation(sess)
+	if expired {
+		return nil, time.Time{}
+	}
+	return admin, expires
+}
+
+// impersonation returns the impersonating admin of a session and when the
+// impersonation ends, and whether it has
+func impersonation(sess *sessions.Session) (admin *User, expires time.Time, expired bool) {
+	admin, err := sessionUser(sess, impersonatorKey)
+	if err != nil || admin == nil {
+		return nil, time.Time{}, false
+	}
+	unix, _ := sess.Values[impersonationExpiresKey].(int64)
+	expires = time.Unix(unix, 0)
+	return admin, expires, !time.Now().Before(expires)
+}
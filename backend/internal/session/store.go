@@ -0,0 +1,110 @@
+package session
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/hackclub/format/internal/db"
+)
+
+// SessionDB is the part of the metadata store sessions are recorded in
+type SessionDB interface {
+	SaveSession(ctx context.Context, s *db.Session) error
+	TouchSession(ctx context.Context, id string, at, after time.Time, ip string) error
+	ListSessions(ctx context.Context, user string, since time.Time) ([]db.Session, error)
+	DeleteSession(ctx context.Context, id string) error
+	DeleteSessions(ctx context.Context, before time.Time) (int64, error)
+	SaveAuthEvent(ctx context.Context, e *db.AuthEvent) error
+	ListAuthEvents(ctx context.Context, filter db.AuthEventFilter) ([]*db.AuthEvent, string, error)
+}
+
+// touchInterval is how stale the last seen time of a session gets before
+// a request updates it
+const touchInterval = 5 * time.Minute
+
+// SetStore records sessions in database, so users can list them. Without
+// it sessions only live in their cookie.
+func (m *Manager) SetStore(database SessionDB) {
+	m.db = database
+}
+
+// record records the new session id of user, replacing the session r was
+// signed in with, if any
+func (m *Manager) record(r *http.Request, id string, user *User) error {
+	if m.db == nil {
+		return nil
+	}
+	ctx := r.Context()
+	if previous := m.SessionID(r); previous != "" {
+		if err := m.db.DeleteSession(ctx, previous); err != nil {
+			return err
+		}
+	}
+	if err := m.db.SaveSession(ctx, &db.Session{
+		ID:        id,
+		User:      user.Email,
+		Provider:  user.Provider,
+		IP:        remoteIP(r),
+		UserAgent: r.UserAgent(),
+	}); err != nil {
+		return err
+	}
+	// Logins are rare enough to purge expired sessions on
+	_, err := m.db.DeleteSessions(ctx, time.Now().Add(-sessionMaxAge))
+	return err
+}
+
+// Seen records that the session of r was just used
+func (m *Manager) Seen(r *http.Request) error {
+	id := m.SessionID(r)
+	if m.db == nil || id == "" {
+		return nil
+	}
+	now := time.Now()
+	return m.db.TouchSession(r.Context(), id, now, now.Add(-touchInterval), remoteIP(r))
+}
+
+// Sessions returns the unexpired sessions of a user, most recently used
+// first
+func (m *Manager) Sessions(ctx context.Context, email string) ([]db.Session, error) {
+	if m.db == nil {
+		return nil, nil
+	}
+	return m.db.ListSessions(ctx, email, time.Now().Add(-sessionMaxAge))
+}
+
+// RecordEvent appends e to the auth log
+func (m *Manager) RecordEvent(ctx context.Context, e *db.AuthEvent) error {
+	if m.db == nil {
+		return nil
+	}
+	return m.db.SaveAuthEvent(ctx, e)
+}
+
+// Events returns a page of the auth log, newest first, and the cursor of
+// the next one. It's empty without a store.
+func (m *Manager) Events(ctx context.Context, filter db.AuthEventFilter) ([]*db.AuthEvent, string, error) {
+	if m.db == nil {
+		return []*db.AuthEvent{}, "", nil
+	}
+	return m.db.ListAuthEvents(ctx, filter)
+}
+
+// forget removes the recorded session id
+func (m *Manager) forget(r *http.Request, id string) error {
+	if m.db == nil || id == "" {
+		return nil
+	}
+	return m.db.DeleteSession(r.Context(), id)
+}
+
+// remoteIP is the IP of the client, after the RealIP middleware applied any
+// X-Forwarded-For/X-Real-IP of a trusted proxy
+func remoteIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
@@ -0,0 +1,59 @@
+package signedurl
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSignAndVerify(t *testing.T) {
+	signer := NewSigner("secret", 24*time.Hour)
+	key := "ab/abcdefghijklmnopqrstuvwx.jpg"
+
+	signed := signer.Sign("https://cdn.example.com/"+key, key)
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiry, err := signer.Verify(key, u.Query())
+	if err != nil {
+		t.Fatalf("Verify(%s) = %v", signed, err)
+	}
+	if until := time.Until(expiry); until < 24*time.Hour || until > 25*time.Hour {
+		t.Errorf("expiry in %v, want 24 to 25 hours", until)
+	}
+
+	// Resize parameters can be added to a signed URL
+	query := u.Query()
+	query.Set("w", "600")
+	if _, err := signer.Verify(key, query); err != nil {
+		t.Errorf("Verify(with w) = %v", err)
+	}
+
+	past := time.Now().Add(-time.Minute).Unix()
+	expired := url.Values{"exp": {strconv.FormatInt(past, 10)}, "sig": {signer.signature(key, past)}}
+
+	tests := []struct {
+		name  string
+		key   string
+		query url.Values
+		want  error
+	}{
+		{"other key", "ab/other.jpg", u.Query(), ErrInvalid},
+		{"other secret", key, mustQuery(NewSigner("other", time.Hour).Sign("/", key)), ErrInvalid},
+		{"unsigned", key, url.Values{}, ErrMissing},
+		{"expired", key, expired, ErrExpired},
+	}
+	for _, tt := range tests {
+		if _, err := signer.Verify(tt.key, tt.query); !errors.Is(err, tt.want) {
+			t.Errorf("%s: Verify() = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func mustQuery(rawURL string) url.Values {
+	u, _ := url.Parse(rawURL)
+	return u.Query()
+}
@@ -0,0 +1,67 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// CachePolicy is how long caches keep uploaded objects, in seconds, by class.
+// Keys are content-addressed, so images and documents can be cached for good,
+// but assets uploaded with a TTL must not outlive it in caches.
+type CachePolicy struct {
+	ImageMaxAge    int
+	DocumentMaxAge int
+	// EphemeralMaxAge caps assets uploaded with a TTL, which are never
+	// cached for longer than their TTL either
+	EphemeralMaxAge int
+}
+
+// DefaultCachePolicy caches images and documents for a year and ephemeral
+// assets for up to an hour
+var DefaultCachePolicy = CachePolicy{
+	ImageMaxAge:     31536000,
+	DocumentMaxAge:  31536000,
+	EphemeralMaxAge: 3600,
+}
+
+// Validate checks that every max age is positive
+func (p CachePolicy) Validate() error {
+	if p.ImageMaxAge <= 0 || p.DocumentMaxAge <= 0 || p.EphemeralMaxAge <= 0 {
+		return fmt.Errorf("cache max ages must be positive")
+	}
+	return nil
+}
+
+// CacheControl returns the Cache-Control of an object of contentType kept
+// for ttl, 0 for good
+func (p CachePolicy) CacheControl(contentType string, ttl time.Duration) string {
+	if ttl > 0 {
+		maxAge := p.EphemeralMaxAge
+		if seconds := int(ttl.Seconds()); seconds < maxAge {
+			maxAge = seconds
+		}
+		return fmt.Sprintf("public, max-age=%d", maxAge)
+	}
+	maxAge := p.DocumentMaxAge
+	if strings.HasPrefix(contentType, "image/") {
+		maxAge = p.ImageMaxAge
+	}
+	return fmt.Sprintf("public, max-age=%d, immutable", maxAge)
+}
+
+// ttlKey carries the TTL of the uploads made with a context
+type ttlKey struct{}
+
+// WithTTL returns a context whose uploads are cached no longer than ttl.
+// Objects that already exist keep their Cache-Control.
+func WithTTL(ctx context.Context, ttl time.Duration) context.Context {
+	return context.WithValue(ctx, ttlKey{}, ttl)
+}
+
+// ttlFromContext returns the TTL set with WithTTL, 0 for none
+func ttlFromContext(ctx context.Context) time.Duration {
+	ttl, _ := ctx.Value(ttlKey{}).(time.Duration)
+	return ttl
+}
@@ -0,0 +1,29 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCacheControl(t *testing.T) {
+	policy := CachePolicy{ImageMaxAge: 1000, DocumentMaxAge: 500, EphemeralMaxAge: 60}
+	tests := []struct {
+		contentType string
+		ttl         time.Duration
+		want        string
+	}{
+		{"image/jpeg", 0, "public, max-age=1000, immutable"},
+		{"application/pdf", 0, "public, max-age=500, immutable"},
+		{"image/png", time.Hour, "public, max-age=60"},
+		{"image/png", 30 * time.Second, "public, max-age=30"},
+	}
+	for _, tt := range tests {
+		if got := policy.CacheControl(tt.contentType, tt.ttl); got != tt.want {
+			t.Errorf("CacheControl(%q, %s) = %q, want %q", tt.contentType, tt.ttl, got, tt.want)
+		}
+	}
+
+	if err := (CachePolicy{ImageMaxAge: 1, DocumentMaxAge: 1}).Validate(); err == nil {
+		t.Error("expected an error for a zero max age")
+	}
+}
@@ -0,0 +1,164 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Storage backends selectable with STORAGE_BACKEND
+const (
+	BackendR2    = "r2"    // Cloudflare R2
+	BackendS3    = "s3"    // AWS S3 or another S3-compatible store
+	BackendGCS   = "gcs"   // Google Cloud Storage through its S3-compatible XML API
+	BackendMinIO = "minio" // a MinIO server, for development with the full S3 path
+	BackendLocal = "local" // files on disk, for development
+)
+
+// minioEndpoint is where `minio server` listens by default
+const minioEndpoint = "http://localhost:9000"
+
+// gcsEndpoint is the S3-compatible endpoint of Google Cloud Storage, which
+// takes HMAC keys as access keys
+const gcsEndpoint = "https://storage.googleapis.com"
+
+// Config selects a storage backend and holds its settings. The S3-style
+// backends share the credential fields, local only uses LocalDir and
+// PublicBaseURL.
+type Config struct {
+	Backend         string
+	AccountID       string // R2 only, builds the default endpoint
+	AccessKeyID     string
+	SecretAccessKey string
+	Bucket          string
+	Endpoint        string
+	Region          string // S3 and MinIO
+	PublicBaseURL   string
+	LocalDir        string
+	// InsecureTLS skips certificate verification of a MinIO server on
+	// localhost with a self-signed certificate
+	InsecureTLS bool
+	// Policy sets encryption, object lock and tagging on uploads to S3 and
+	// MinIO
+	Policy UploadPolicy
+	// PresignTTL, when set, serves assets through presigned GET URLs of the
+	// bucket valid this long instead of PublicBaseURL
+	PresignTTL time.Duration
+	// Cache is the Cache-Control of uploads by class, DefaultCachePolicy
+	// when zero
+	Cache CachePolicy
+}
+
+// IsValidBackend reports whether backend is a storage backend, or empty for
+// R2
+func IsValidBackend(backend string) bool {
+	switch backend {
+	case "", BackendR2, BackendS3, BackendGCS, BackendMinIO, BackendLocal:
+		return true
+	}
+	return false
+}
+
+// New returns the client of the configured backend
+func New(ctx context.Context, cfg Config) (R2ClientInterface, error) {
+	if cfg.InsecureTLS && cfg.Backend != BackendMinIO {
+		return nil, fmt.Errorf("skipping TLS verification is only supported for MinIO")
+	}
+	if err := cfg.Policy.Validate(); err != nil {
+		return nil, err
+	}
+	if cfg.Cache == (CachePolicy{}) {
+		cfg.Cache = DefaultCachePolicy
+	}
+	if err := cfg.Cache.Validate(); err != nil {
+		return nil, err
+	}
+	if cfg.PresignTTL < 0 || cfg.PresignTTL > MaxPresignTTL {
+		return nil, fmt.Errorf("presigned URLs can be valid for at most %s", MaxPresignTTL)
+	}
+	if cfg.PresignTTL > 0 && cfg.Backend == BackendLocal {
+		return nil, fmt.Errorf("presigned URLs need an S3-compatible backend")
+	}
+	if cfg.Policy != (UploadPolicy{}) && cfg.Backend != BackendS3 && cfg.Backend != BackendMinIO {
+		// R2 always encrypts at rest, locks whole buckets and has no
+		// object tags, GCS has none of the headers, local disk has neither
+		return nil, fmt.Errorf("server-side encryption, object lock and tagging are only supported for S3 and MinIO")
+	}
+
+	var client *R2Client
+	var err error
+	switch cfg.Backend {
+	case "", BackendR2:
+		client, err = NewR2Client(ctx, cfg.AccountID, cfg.AccessKeyID, cfg.SecretAccessKey, cfg.Bucket, cfg.Endpoint, cfg.PublicBaseURL)
+	case BackendS3:
+		client, err = NewS3Client(ctx, cfg.AccessKeyID, cfg.SecretAccessKey, cfg.Bucket, cfg.Endpoint, cfg.Region, cfg.PublicBaseURL, false, false)
+		if err == nil {
+			client.SetUploadPolicy(cfg.Policy)
+		}
+	case BackendGCS:
+		endpoint := cfg.Endpoint
+		if endpoint == "" {
+			endpoint = gcsEndpoint
+		}
+		client, err = NewS3Client(ctx, cfg.AccessKeyID, cfg.SecretAccessKey, cfg.Bucket, endpoint, "auto", cfg.PublicBaseURL, false, false)
+		if err == nil {
+			// The XML API doesn't take x-amz-checksum headers
+			client.noChecksums = true
+		}
+	case BackendMinIO:
+		client, err = newMinIOClient(ctx, cfg)
+	case BackendLocal:
+		if cfg.LocalDir == "" {
+			return nil, fmt.Errorf("local storage needs a directory")
+		}
+		return NewMockR2Client(cfg.LocalDir, cfg.PublicBaseURL), nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q, expected r2, s3, gcs, minio or local", cfg.Backend)
+	}
+	if err != nil {
+		return nil, err
+	}
+	client.SetCachePolicy(cfg.Cache)
+	if cfg.PresignTTL > 0 {
+		client.SetPresignedURLs(cfg.PresignTTL)
+	}
+	return client, nil
+}
+
+// newMinIOClient connects to MinIO with path-style addressing and creates
+// the bucket on first use
+func newMinIOClient(ctx context.Context, cfg Config) (*R2Client, error) {
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		endpoint = minioEndpoint
+	}
+	if cfg.InsecureTLS && !isLocalhost(endpoint) {
+		return nil, fmt.Errorf("skipping TLS verification is only allowed for localhost, not %s", endpoint)
+	}
+	client, err := NewS3Client(ctx, cfg.AccessKeyID, cfg.SecretAccessKey, cfg.Bucket, endpoint, cfg.Region, cfg.PublicBaseURL, true, cfg.InsecureTLS)
+	if err != nil {
+		return nil, err
+	}
+	if err := client.EnsureBucket(ctx); err != nil {
+		return nil, fmt.Errorf("failed to set up MinIO bucket %s: %v", cfg.Bucket, err)
+	}
+	client.SetUploadPolicy(cfg.Policy)
+	return client, nil
+}
+
+// isLocalhost reports whether endpoint points at this machine
+func isLocalhost(endpoint string) bool {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return false
+	}
+	host := u.Hostname()
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
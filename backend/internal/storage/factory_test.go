@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+func TestIsLocalhost(t *testing.T) {
+	tests := map[string]bool{
+		"http://localhost:9000":      true,
+		"https://minio.localhost":    true,
+		"https://127.0.0.1:9000":     true,
+		"https://[::1]:9000":         true,
+		"https://minio.example.com":  false,
+		"https://localhost.evil.com": false,
+		"https://10.0.0.5:9000":      false,
+	}
+	for endpoint, want := range tests {
+		if got := isLocalhost(endpoint); got != want {
+			t.Errorf("isLocalhost(%q) = %v, want %v", endpoint, got, want)
+		}
+	}
+}
+
+func TestNewRejectsInsecureTLS(t *testing.T) {
+	ctx := context.Background()
+	if _, err := New(ctx, Config{Backend: BackendR2, InsecureTLS: true}); err == nil {
+		t.Error("expected an error skipping TLS verification for R2")
+	}
+	if _, err := New(ctx, Config{Backend: BackendMinIO, Endpoint: "https://minio.example.com", InsecureTLS: true}); err == nil {
+		t.Error("expected an error skipping TLS verification for a remote MinIO")
+	}
+}
+
+func TestUploadPolicyValidate(t *testing.T) {
+	tests := []struct {
+		policy UploadPolicy
+		valid  bool
+	}{
+		{UploadPolicy{}, true},
+		{UploadPolicy{Encryption: "AES256"}, true},
+		{UploadPolicy{Encryption: "aws:kms", KMSKeyID: "key"}, true},
+		{UploadPolicy{Encryption: "AES256", KMSKeyID: "key"}, false},
+		{UploadPolicy{Encryption: "rot13"}, false},
+		{UploadPolicy{LockMode: "COMPLIANCE", LockDays: 30}, true},
+		{UploadPolicy{LockMode: "GOVERNANCE"}, false},
+		{UploadPolicy{LockDays: 30}, false},
+		{UploadPolicy{LockMode: "forever", LockDays: 30}, false},
+	}
+	for _, test := range tests {
+		if err := test.policy.Validate(); (err == nil) != test.valid {
+			t.Errorf("Validate(%+v) = %v, want valid %v", test.policy, err, test.valid)
+		}
+	}
+
+	if _, err := New(context.Background(), Config{Backend: BackendR2, Policy: UploadPolicy{Encryption: "AES256"}}); err == nil {
+		t.Error("expected an error for encryption on R2")
+	}
+}
+
+func TestValidateLifecycle(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []LifecycleRule
+		valid bool
+	}{
+		{"none", nil, true},
+		{"expire tmp", []LifecycleRule{{ID: "tmp", Prefix: "tmp/", Enabled: true, ExpireDays: 30}}, true},
+		{"transition originals", []LifecycleRule{{ID: "originals", Prefix: "originals/", Transitions: []LifecycleTransition{{30, "STANDARD_IA"}, {90, "GLACIER"}}}}, true},
+		{"expire tagged", []LifecycleRule{{ID: "ttl", Tags: map[string]string{"ttl": "7d"}, ExpireDays: 7}}, true},
+		{"no id", []LifecycleRule{{Prefix: "tmp/", ExpireDays: 30}}, false},
+		{"no action", []LifecycleRule{{ID: "tmp", Prefix: "tmp/"}}, false},
+		{"transition without class", []LifecycleRule{{ID: "tmp", Transitions: []LifecycleTransition{{Days: 30}}}}, false},
+		{"transition after expiry", []LifecycleRule{{ID: "tmp", ExpireDays: 30, Transitions: []LifecycleTransition{{60, "STANDARD_IA"}}}}, false},
+		{"transitions out of order", []LifecycleRule{{ID: "tmp", Transitions: []LifecycleTransition{{90, "GLACIER"}, {30, "STANDARD_IA"}}}}, false},
+		{"abort with tags", []LifecycleRule{{ID: "tmp", Tags: map[string]string{"ttl": "7d"}, AbortMultipartDays: 1}}, false},
+		{"unsupported", []LifecycleRule{{ID: "tmp", ExpireDays: 1, Unsupported: true}}, false},
+		{"duplicate ids", []LifecycleRule{{ID: "tmp", ExpireDays: 1}, {ID: "tmp", ExpireDays: 2}}, false},
+	}
+	for _, test := range tests {
+		if err := ValidateLifecycle(test.rules); (err == nil) != test.valid {
+			t.Errorf("%s: ValidateLifecycle = %v, want valid %v", test.name, err, test.valid)
+		}
+	}
+}
+
+func TestLifecycleRoundTrip(t *testing.T) {
+	rules := []LifecycleRule{
+		{ID: "tmp", Prefix: "tmp/", Enabled: true, ExpireDays: 30, AbortMultipartDays: 1},
+		{ID: "ttl", Enabled: true, Tags: map[string]string{"ttl": "7d"}, ExpireDays: 7},
+		{ID: "big", Prefix: "originals/", Tags: map[string]string{"namespace": "team", "source": "upload"}, MinSize: 1 << 20, MaxSize: 1 << 30,
+			Transitions: []LifecycleTransition{{30, "STANDARD_IA"}, {90, "GLACIER"}}},
+		{ID: "large", MinSize: 1 << 20, ExpireDays: 365},
+	}
+	for _, rule := range rules {
+		if got := fromS3Rule(toS3Rule(rule)); !reflect.DeepEqual(got, rule) {
+			t.Errorf("%s round trips to %+v, want %+v", rule.ID, got, rule)
+		}
+	}
+
+	unsupported := []types.LifecycleRule{
+		{ID: aws.String("date"), Expiration: &types.LifecycleExpiration{Date: aws.Time(time.Now())}},
+		{ID: aws.String("markers"), Expiration: &types.LifecycleExpiration{ExpiredObjectDeleteMarker: aws.Bool(true)}},
+		{ID: aws.String("noncurrent"), NoncurrentVersionExpiration: &types.NoncurrentVersionExpiration{NoncurrentDays: aws.Int32(30)}},
+		{ID: aws.String("transition date"), Transitions: []types.Transition{{Date: aws.Time(time.Now()), StorageClass: types.TransitionStorageClassGlacier}}},
+	}
+	for _, rule := range unsupported {
+		if !fromS3Rule(rule).Unsupported {
+			t.Errorf("%s isn't marked unsupported", aws.ToString(rule.ID))
+		}
+	}
+}
+
+func TestPresignedURLs(t *testing.T) {
+	client, err := New(context.Background(), Config{
+		Backend:         BackendS3,
+		AccessKeyID:     "key",
+		SecretAccessKey: "secret",
+		Bucket:          "assets",
+		Region:          "us-east-1",
+		PublicBaseURL:   "https://i.example.com",
+		PresignTTL:      time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := client.BaseURL()
+	if base != "https://assets.s3.us-east-1.amazonaws.com/" {
+		t.Errorf("BaseURL = %q", base)
+	}
+	got := client.GetPublicURL("ab/cdef.jpg")
+	if !strings.HasPrefix(got, base+"ab/cdef.jpg?") || !strings.Contains(got, "X-Amz-Expires=3600") || !strings.Contains(got, "X-Amz-Signature=") {
+		t.Errorf("GetPublicURL = %q, want a presigned URL", got)
+	}
+
+	if _, err := New(context.Background(), Config{Backend: BackendS3, PresignTTL: 8 * 24 * time.Hour}); err == nil {
+		t.Error("expected an error for presigned URLs valid over 7 days")
+	}
+}
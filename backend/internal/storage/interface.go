@@ -2,12 +2,38 @@ package storage
 
 import (
 	"context"
+	"errors"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
+// ErrObjectNotFound is returned by Download when the key doesn't exist
+var ErrObjectNotFound = errors.New("object not found")
+
 // R2ClientInterface defines the interface that both real and mock R2 clients implement
 type R2ClientInterface interface {
 	ObjectExists(ctx context.Context, key string) (bool, error)
 	Upload(ctx context.Context, key string, data []byte, contentType string) (*UploadResult, error)
+	UploadDocument(ctx context.Context, key string, data []byte, contentType, filename string) (*UploadResult, error)
+	Download(ctx context.Context, key string) ([]byte, string, error)
+	Open(ctx context.Context, key string) (*Object, error)
 	GetPublicURL(key string) string
+	// BaseURL is what the URLs of GetPublicURL start with, before the key
+	BaseURL() string
 	Delete(ctx context.Context, key string) error
+	// DeleteMany deletes keys in as few requests as the store allows and
+	// returns the errors of those that failed
+	DeleteMany(ctx context.Context, keys []string) map[string]error
+	ListObjects(ctx context.Context, prefix string, maxKeys int32) ([]types.Object, error)
+	WalkObjects(ctx context.Context, prefix string, fn func(types.Object) error) error
+	GetObjectMetadata(ctx context.Context, key string) (*s3.HeadObjectOutput, error)
+	// Ping checks that the store is reachable with the configured
+	// credentials
+	Ping(ctx context.Context) error
 }
+
+var (
+	_ R2ClientInterface = (*R2Client)(nil)
+	_ R2ClientInterface = (*MockR2Client)(nil)
+)
@@ -0,0 +1,295 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// maxLifecycleRules is the most rules S3 accepts per bucket
+const maxLifecycleRules = 1000
+
+// ErrUnsupportedLifecycle is returned when replacing the rules of a bucket
+// that has rules LifecycleRule can't express, which would be lost
+var ErrUnsupportedLifecycle = errors.New("the bucket has lifecycle rules that can't be edited here")
+
+// LifecycleRule expires or transitions the objects under a prefix, with
+// all of the tags and within the sizes if set, a number of days after they
+// were uploaded
+type LifecycleRule struct {
+	ID      string `json:"id"`
+	Prefix  string `json:"prefix"`
+	Enabled bool   `json:"enabled"`
+	// Tags limits the rule to objects with all of these tags
+	Tags map[string]string `json:"tags,omitempty"`
+	// MinSize and MaxSize limit the rule to objects larger and smaller than
+	// this many bytes, 0 for no limit
+	MinSize int64 `json:"min_size,omitempty"`
+	MaxSize int64 `json:"max_size,omitempty"`
+	// ExpireDays deletes objects this long after upload, 0 for never
+	ExpireDays int `json:"expire_days,omitempty"`
+	// Transitions move objects to other storage classes, in order of days
+	Transitions []LifecycleTransition `json:"transitions,omitempty"`
+	// AbortMultipartDays cleans up unfinished multipart uploads, 0 for never
+	AbortMultipartDays int `json:"abort_multipart_days,omitempty"`
+	// Unsupported is set on rules of the bucket using settings the fields
+	// above can't express, like expiry dates or noncurrent versions. The
+	// rules can't be replaced while there's one.
+	Unsupported bool `json:"unsupported,omitempty"`
+}
+
+// LifecycleTransition moves objects to StorageClass this long after upload
+type LifecycleTransition struct {
+	Days         int    `json:"days"`
+	StorageClass string `json:"storage_class"`
+}
+
+// Validate checks that the rule has an ID and does something
+func (r LifecycleRule) Validate() error {
+	if r.ID == "" || len(r.ID) > 255 {
+		return fmt.Errorf("rule needs an id of at most 255 characters")
+	}
+	if r.Unsupported {
+		return fmt.Errorf("rule %s: unsupported rules can't be written back", r.ID)
+	}
+	if r.ExpireDays < 0 || r.AbortMultipartDays < 0 || r.MinSize < 0 || r.MaxSize < 0 {
+		return fmt.Errorf("rule %s: days and sizes must not be negative", r.ID)
+	}
+	if r.ExpireDays == 0 && len(r.Transitions) == 0 && r.AbortMultipartDays == 0 {
+		return fmt.Errorf("rule %s: needs expire_days, transitions or abort_multipart_days", r.ID)
+	}
+	if r.MaxSize != 0 && r.MinSize >= r.MaxSize {
+		return fmt.Errorf("rule %s: min_size must be below max_size", r.ID)
+	}
+	if r.AbortMultipartDays != 0 && (len(r.Tags) > 0 || r.MinSize != 0 || r.MaxSize != 0) {
+		// Unfinished uploads have neither tags nor a size yet
+		return fmt.Errorf("rule %s: abort_multipart_days only takes a prefix", r.ID)
+	}
+	for i, transition := range r.Transitions {
+		if transition.Days <= 0 || transition.StorageClass == "" {
+			return fmt.Errorf("rule %s: transitions need days and a storage_class", r.ID)
+		}
+		if i > 0 && transition.Days <= r.Transitions[i-1].Days {
+			return fmt.Errorf("rule %s: transitions must be in order of days", r.ID)
+		}
+		if r.ExpireDays != 0 && transition.Days >= r.ExpireDays {
+			return fmt.Errorf("rule %s: objects must transition before they expire", r.ID)
+		}
+	}
+	return nil
+}
+
+// ValidateLifecycle checks a set of rules before they replace a bucket's
+func ValidateLifecycle(rules []LifecycleRule) error {
+	if len(rules) > maxLifecycleRules {
+		return fmt.Errorf("at most %d lifecycle rules are allowed", maxLifecycleRules)
+	}
+	seen := make(map[string]bool)
+	for _, rule := range rules {
+		if err := rule.Validate(); err != nil {
+			return err
+		}
+		if seen[rule.ID] {
+			return fmt.Errorf("duplicate rule id %s", rule.ID)
+		}
+		seen[rule.ID] = true
+	}
+	return nil
+}
+
+// LifecycleManager reads and replaces the lifecycle rules of a bucket.
+// Backends without lifecycle rules don't implement it.
+type LifecycleManager interface {
+	GetLifecycle(ctx context.Context) ([]LifecycleRule, error)
+	SetLifecycle(ctx context.Context, rules []LifecycleRule) error
+}
+
+// GetLifecycle returns the bucket's lifecycle rules, none if it has no
+// configuration
+func (r *R2Client) GetLifecycle(ctx context.Context) ([]LifecycleRule, error) {
+	result, err := r.client.GetBucketLifecycleConfiguration(ctx, &s3.GetBucketLifecycleConfigurationInput{
+		Bucket: aws.String(r.bucket),
+	})
+	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "NoSuchLifecycleConfiguration" {
+			return []LifecycleRule{}, nil
+		}
+		return nil, fmt.Errorf("failed to get lifecycle rules: %v", err)
+	}
+
+	rules := make([]LifecycleRule, 0, len(result.Rules))
+	for _, rule := range result.Rules {
+		rules = append(rules, fromS3Rule(rule))
+	}
+	return rules, nil
+}
+
+// SetLifecycle replaces the bucket's lifecycle rules, removing the
+// configuration when rules is empty. It returns ErrUnsupportedLifecycle
+// rather than drop rules of the bucket it can't express.
+func (r *R2Client) SetLifecycle(ctx context.Context, rules []LifecycleRule) error {
+	if err := ValidateLifecycle(rules); err != nil {
+		return err
+	}
+	current, err := r.GetLifecycle(ctx)
+	if err != nil {
+		return err
+	}
+	for _, rule := range current {
+		if rule.Unsupported {
+			return fmt.Errorf("%w: rule %s", ErrUnsupportedLifecycle, rule.ID)
+		}
+	}
+	if len(rules) == 0 {
+		_, err := r.client.DeleteBucketLifecycle(ctx, &s3.DeleteBucketLifecycleInput{
+			Bucket: aws.String(r.bucket),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to delete lifecycle rules: %v", err)
+		}
+		return nil
+	}
+
+	converted := make([]types.LifecycleRule, 0, len(rules))
+	for _, rule := range rules {
+		converted = append(converted, toS3Rule(rule))
+	}
+
+	_, err = r.client.PutBucketLifecycleConfiguration(ctx, &s3.PutBucketLifecycleConfigurationInput{
+		Bucket:                 aws.String(r.bucket),
+		LifecycleConfiguration: &types.BucketLifecycleConfiguration{Rules: converted},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set lifecycle rules: %v", err)
+	}
+	return nil
+}
+
+// fromS3Rule converts a rule of the bucket, marking it Unsupported when it
+// uses settings LifecycleRule can't express
+func fromS3Rule(rule types.LifecycleRule) LifecycleRule {
+	converted := LifecycleRule{
+		ID:      aws.ToString(rule.ID),
+		Prefix:  aws.ToString(rule.Prefix),
+		Enabled: rule.Status == types.ExpirationStatusEnabled,
+	}
+	addTag := func(tag types.Tag) {
+		if converted.Tags == nil {
+			converted.Tags = make(map[string]string)
+		}
+		converted.Tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+	switch filter := rule.Filter.(type) {
+	case nil:
+	case *types.LifecycleRuleFilterMemberPrefix:
+		converted.Prefix = filter.Value
+	case *types.LifecycleRuleFilterMemberTag:
+		addTag(filter.Value)
+	case *types.LifecycleRuleFilterMemberObjectSizeGreaterThan:
+		converted.MinSize = filter.Value
+	case *types.LifecycleRuleFilterMemberObjectSizeLessThan:
+		converted.MaxSize = filter.Value
+	case *types.LifecycleRuleFilterMemberAnd:
+		converted.Prefix = aws.ToString(filter.Value.Prefix)
+		for _, tag := range filter.Value.Tags {
+			addTag(tag)
+		}
+		converted.MinSize = aws.ToInt64(filter.Value.ObjectSizeGreaterThan)
+		converted.MaxSize = aws.ToInt64(filter.Value.ObjectSizeLessThan)
+	default:
+		converted.Unsupported = true
+	}
+	if rule.Expiration != nil {
+		converted.ExpireDays = int(aws.ToInt32(rule.Expiration.Days))
+		if rule.Expiration.Date != nil || aws.ToBool(rule.Expiration.ExpiredObjectDeleteMarker) {
+			converted.Unsupported = true
+		}
+	}
+	for _, transition := range rule.Transitions {
+		if transition.Date != nil {
+			converted.Unsupported = true
+			continue
+		}
+		converted.Transitions = append(converted.Transitions, LifecycleTransition{
+			Days:         int(aws.ToInt32(transition.Days)),
+			StorageClass: string(transition.StorageClass),
+		})
+	}
+	if rule.AbortIncompleteMultipartUpload != nil {
+		converted.AbortMultipartDays = int(aws.ToInt32(rule.AbortIncompleteMultipartUpload.DaysAfterInitiation))
+	}
+	if rule.NoncurrentVersionExpiration != nil || len(rule.NoncurrentVersionTransitions) > 0 {
+		converted.Unsupported = true
+	}
+	return converted
+}
+
+// toS3Rule converts a rule for the bucket, with the simplest filter S3
+// takes: a single condition on its own, several joined with And
+func toS3Rule(rule LifecycleRule) types.LifecycleRule {
+	converted := types.LifecycleRule{
+		ID:     aws.String(rule.ID),
+		Status: types.ExpirationStatusDisabled,
+	}
+	if rule.Enabled {
+		converted.Status = types.ExpirationStatusEnabled
+	}
+
+	var tags []types.Tag
+	for key, value := range rule.Tags {
+		tags = append(tags, types.Tag{Key: aws.String(key), Value: aws.String(value)})
+	}
+	sort.Slice(tags, func(i, j int) bool { return aws.ToString(tags[i].Key) < aws.ToString(tags[j].Key) })
+	conditions := len(tags)
+	for _, set := range []bool{rule.Prefix != "", rule.MinSize != 0, rule.MaxSize != 0} {
+		if set {
+			conditions++
+		}
+	}
+	switch {
+	case conditions > 1:
+		and := types.LifecycleRuleAndOperator{Tags: tags}
+		if rule.Prefix != "" {
+			and.Prefix = aws.String(rule.Prefix)
+		}
+		if rule.MinSize != 0 {
+			and.ObjectSizeGreaterThan = aws.Int64(rule.MinSize)
+		}
+		if rule.MaxSize != 0 {
+			and.ObjectSizeLessThan = aws.Int64(rule.MaxSize)
+		}
+		converted.Filter = &types.LifecycleRuleFilterMemberAnd{Value: and}
+	case len(tags) == 1:
+		converted.Filter = &types.LifecycleRuleFilterMemberTag{Value: tags[0]}
+	case rule.MinSize != 0:
+		converted.Filter = &types.LifecycleRuleFilterMemberObjectSizeGreaterThan{Value: rule.MinSize}
+	case rule.MaxSize != 0:
+		converted.Filter = &types.LifecycleRuleFilterMemberObjectSizeLessThan{Value: rule.MaxSize}
+	default:
+		converted.Filter = &types.LifecycleRuleFilterMemberPrefix{Value: rule.Prefix}
+	}
+
+	if rule.ExpireDays > 0 {
+		converted.Expiration = &types.LifecycleExpiration{Days: aws.Int32(int32(rule.ExpireDays))}
+	}
+	for _, transition := range rule.Transitions {
+		converted.Transitions = append(converted.Transitions, types.Transition{
+			Days:         aws.Int32(int32(transition.Days)),
+			StorageClass: types.TransitionStorageClass(strings.ToUpper(transition.StorageClass)),
+		})
+	}
+	if rule.AbortMultipartDays > 0 {
+		converted.AbortIncompleteMultipartUpload = &types.AbortIncompleteMultipartUpload{
+			DaysAfterInitiation: aws.Int32(int32(rule.AbortMultipartDays)),
+		}
+	}
+	return converted
+}
@@ -2,12 +2,24 @@ package storage
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io/fs"
+	"mime"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
-// MockR2Client provides a local filesystem mock of R2Client for development
+// MockR2Client provides a local filesystem mock of R2Client for development,
+// selected with STORAGE_BACKEND=local
 type MockR2Client struct {
 	baseDir       string
 	publicBaseURL string
@@ -25,7 +37,7 @@ func NewMockR2Client(baseDir, publicBaseURL string) *MockR2Client {
 
 // ObjectExists checks if a file exists locally
 func (m *MockR2Client) ObjectExists(ctx context.Context, key string) (bool, error) {
-	filePath := filepath.Join(m.baseDir, key)
+	filePath := m.path(key)
 	_, err := os.Stat(filePath)
 	if os.IsNotExist(err) {
 		return false, nil
@@ -35,7 +47,7 @@ func (m *MockR2Client) ObjectExists(ctx context.Context, key string) (bool, erro
 
 // Upload saves data to local filesystem
 func (m *MockR2Client) Upload(ctx context.Context, key string, data []byte, contentType string) (*UploadResult, error) {
-	filePath := filepath.Join(m.baseDir, key)
+	filePath := m.path(key)
 	
 	// Ensure directory exists
 	dir := filepath.Dir(filePath)
@@ -57,13 +69,169 @@ func (m *MockR2Client) Upload(ctx context.Context, key string, data []byte, cont
 	}, nil
 }
 
+// Download reads a file from the local filesystem
+func (m *MockR2Client) Download(ctx context.Context, key string) ([]byte, string, error) {
+	data, err := os.ReadFile(m.path(key))
+	if os.IsNotExist(err) {
+		return nil, "", ErrObjectNotFound
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return data, mime.TypeByExtension(filepath.Ext(key)), nil
+}
+
 // GetPublicURL returns the public URL for a file
 func (m *MockR2Client) GetPublicURL(key string) string {
 	return fmt.Sprintf("%s/%s", m.publicBaseURL, key)
 }
 
+// BaseURL returns what the URLs of GetPublicURL start with
+func (m *MockR2Client) BaseURL() string {
+	return m.publicBaseURL + "/"
+}
+
 // Additional methods to match interface
 func (m *MockR2Client) Delete(ctx context.Context, key string) error {
-	filePath := filepath.Join(m.baseDir, key)
-	return os.Remove(filePath)
+	filePath := m.path(key)
+	err := os.Remove(filePath)
+	if os.IsNotExist(err) {
+		// Like S3, deleting a missing object succeeds
+		return nil
+	}
+	return err
+}
+
+// DeleteMany removes files one by one
+func (m *MockR2Client) DeleteMany(ctx context.Context, keys []string) map[string]error {
+	failed := make(map[string]error)
+	for _, key := range keys {
+		if err := m.Delete(ctx, key); err != nil {
+			failed[key] = err
+		}
+	}
+	return failed
+}
+
+// UploadDocument saves a document like Upload, the filename isn't kept
+func (m *MockR2Client) UploadDocument(ctx context.Context, key string, data []byte, contentType, filename string) (*UploadResult, error) {
+	return m.Upload(ctx, key, data, contentType)
+}
+
+// Open starts reading a file for streaming. The caller closes its Body.
+func (m *MockR2Client) Open(ctx context.Context, key string) (*Object, error) {
+	file, err := os.Open(m.path(key))
+	if os.IsNotExist(err) {
+		return nil, ErrObjectNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		file.Close()
+		return nil, ErrObjectNotFound
+	}
+	return &Object{
+		Body:        file,
+		ContentType: mime.TypeByExtension(filepath.Ext(key)),
+		Size:        info.Size(),
+		ETag:        fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size()),
+	}, nil
+}
+
+// GetObjectMetadata describes a file like HeadObject. Its checksum is of
+// the current contents, so only the asset's record can disagree with it.
+func (m *MockR2Client) GetObjectMetadata(ctx context.Context, key string) (*s3.HeadObjectOutput, error) {
+	data, err := os.ReadFile(m.path(key))
+	if os.IsNotExist(err) {
+		return nil, ErrObjectNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(m.path(key))
+	if err != nil {
+		return nil, err
+	}
+	checksum := sha256.Sum256(data)
+	return &s3.HeadObjectOutput{
+		ContentType:   aws.String(mime.TypeByExtension(filepath.Ext(key))),
+		ContentLength: aws.Int64(info.Size()),
+		LastModified:  aws.Time(info.ModTime()),
+		ETag:          aws.String(fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size())),
+		Metadata:      map[string]string{ChecksumMetadata: hex.EncodeToString(checksum[:])},
+	}, nil
+}
+
+// errStopWalk ends a walk early without an error
+var errStopWalk = errors.New("stop walk")
+
+// ListObjects lists up to maxKeys files with the given prefix, in key order
+func (m *MockR2Client) ListObjects(ctx context.Context, prefix string, maxKeys int32) ([]types.Object, error) {
+	var objects []types.Object
+	err := m.WalkObjects(ctx, prefix, func(obj types.Object) error {
+		if int32(len(objects)) >= maxKeys {
+			return errStopWalk
+		}
+		objects = append(objects, obj)
+		return nil
+	})
+	if err != nil && !errors.Is(err, errStopWalk) {
+		return nil, err
+	}
+	return objects, nil
+}
+
+// WalkObjects calls fn for every file with the given prefix, in key order,
+// stopping at the first error
+func (m *MockR2Client) WalkObjects(ctx context.Context, prefix string, fn func(types.Object) error) error {
+	// Only walk the directory the prefix is in
+	root := m.path(path.Dir(prefix + "x"))
+	err := filepath.WalkDir(root, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(m.baseDir, filePath)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		return fn(types.Object{
+			Key:          aws.String(key),
+			Size:         aws.Int64(info.Size()),
+			LastModified: aws.Time(info.ModTime()),
+		})
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Ping checks that the base directory exists
+func (m *MockR2Client) Ping(ctx context.Context) error {
+	info, err := os.Stat(m.baseDir)
+	if err != nil {
+		return fmt.Errorf("failed to reach storage directory: %v", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("storage path %s is not a directory", m.baseDir)
+	}
+	return nil
+}
+
+// path returns the file of key, which can't escape the base directory
+func (m *MockR2Client) path(key string) string {
+	return filepath.Join(m.baseDir, filepath.FromSlash(path.Clean("/"+key)))
 }
@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/hackclub/format/internal/util"
+)
+
+func TestMockR2Client(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	m := NewMockR2Client(filepath.Join(dir, "assets"), "http://localhost:8080/img")
+
+	for _, key := range []string{"ab/one.jpg", "ab/one_w200.webp", "cd/two.png"} {
+		if _, err := m.Upload(ctx, key, []byte(key), "image/jpeg"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	objects, err := m.ListObjects(ctx, "ab/one_", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 1 || aws.ToString(objects[0].Key) != "ab/one_w200.webp" {
+		t.Errorf("ListObjects(ab/one_) = %v", objects)
+	}
+	if objects, _ := m.ListObjects(ctx, "", 2); len(objects) != 2 {
+		t.Errorf("ListObjects limited to 2 returned %d", len(objects))
+	}
+	if objects, err := m.ListObjects(ctx, "zz/", 10); err != nil || len(objects) != 0 {
+		t.Errorf("ListObjects of a missing directory = %v, %v", objects, err)
+	}
+
+	obj, err := m.Open(ctx, "cd/two.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(obj.Body)
+	obj.Body.Close()
+	if string(data) != "cd/two.png" || obj.ContentType != "image/png" || obj.Size != int64(len(data)) {
+		t.Errorf("Open = %q, %q, %d", data, obj.ContentType, obj.Size)
+	}
+	if _, err := m.Open(ctx, "cd/missing.png"); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("Open of a missing key = %v", err)
+	}
+
+	meta, err := m.GetObjectMetadata(ctx, "ab/one.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aws.ToInt64(meta.ContentLength) != 10 || meta.Metadata[ChecksumMetadata] != util.HashBytes([]byte("ab/one.jpg")) {
+		t.Errorf("GetObjectMetadata = %d bytes, checksum %q", aws.ToInt64(meta.ContentLength), meta.Metadata[ChecksumMetadata])
+	}
+	if _, err := m.GetObjectMetadata(ctx, "ab/missing.jpg"); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("GetObjectMetadata of a missing key = %v", err)
+	}
+
+	// Keys can't reach outside the base directory
+	if _, err := m.Upload(ctx, "../escaped.jpg", []byte("x"), "image/jpeg"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escaped.jpg")); !os.IsNotExist(err) {
+		t.Error("upload escaped the base directory")
+	}
+
+	if err := m.Delete(ctx, "cd/two.png"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Delete(ctx, "cd/two.png"); err != nil {
+		t.Errorf("deleting a missing key = %v", err)
+	}
+}
@@ -3,20 +3,109 @@ package storage
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
 )
 
 type R2Client struct {
 	client          *s3.Client
 	bucket          string
 	publicBaseURL   string
+	policy          UploadPolicy
+	// presigner signs GET URLs valid for presignTTL, nil when the bucket
+	// is public
+	presigner       *s3.PresignClient
+	presignTTL      time.Duration
+	// noChecksums leaves out the SHA-256 checksum header, for stores that
+	// reject it
+	noChecksums     bool
+	cache           CachePolicy
+}
+
+// ChecksumMetadata is the object metadata holding the hex SHA-256 of the
+// data computed before upload
+const ChecksumMetadata = "sha256"
+
+// MaxPresignTTL is the longest validity of a presigned URL SigV4 allows
+const MaxPresignTTL = 7 * 24 * time.Hour
+
+// UploadPolicy is how uploads are encrypted and retained by stores that
+// support it, for deployments with compliance requirements. The zero value
+// leaves both to the bucket's defaults.
+type UploadPolicy struct {
+	// Encryption is the server-side encryption requested: AES256, aws:kms
+	// or empty for the bucket default
+	Encryption string
+	// KMSKeyID is the KMS key for aws:kms, empty for the account default
+	KMSKeyID string
+	// LockMode is the object lock mode, GOVERNANCE or COMPLIANCE, empty for
+	// none. The bucket needs object lock enabled.
+	LockMode string
+	// LockDays is how long locked objects can't be overwritten or deleted
+	LockDays int
+	// Tagging tags uploads with the tags of their context, see WithTags
+	Tagging bool
+}
+
+// Validate checks that the policy's settings are known and consistent
+func (p UploadPolicy) Validate() error {
+	switch types.ServerSideEncryption(p.Encryption) {
+	case "", types.ServerSideEncryptionAes256:
+		if p.KMSKeyID != "" {
+			return fmt.Errorf("a KMS key needs aws:kms encryption")
+		}
+	case types.ServerSideEncryptionAwsKms:
+	default:
+		return fmt.Errorf("unknown server-side encryption %q, expected AES256 or aws:kms", p.Encryption)
+	}
+	switch types.ObjectLockMode(p.LockMode) {
+	case "":
+		if p.LockDays != 0 {
+			return fmt.Errorf("a retention period needs an object lock mode")
+		}
+	case types.ObjectLockModeGovernance, types.ObjectLockModeCompliance:
+		if p.LockDays <= 0 {
+			return fmt.Errorf("object lock needs a positive retention period")
+		}
+	default:
+		return fmt.Errorf("unknown object lock mode %q, expected GOVERNANCE or COMPLIANCE", p.LockMode)
+	}
+	return nil
+}
+
+// SetPresignedURLs makes GetPublicURL return presigned GET URLs valid for
+// ttl, for private buckets
+func (r *R2Client) SetPresignedURLs(ttl time.Duration) {
+	r.presigner = s3.NewPresignClient(r.client)
+	r.presignTTL = ttl
+}
+
+// SetCachePolicy sets the Cache-Control of every later upload
+func (r *R2Client) SetCachePolicy(policy CachePolicy) {
+	r.cache = policy
+}
+
+// SetUploadPolicy applies policy to every later upload
+func (r *R2Client) SetUploadPolicy(policy UploadPolicy) {
+	r.policy = policy
 }
 
 type UploadResult struct {
@@ -28,35 +117,61 @@ type UploadResult struct {
 }
 
 func NewR2Client(ctx context.Context, accountID, accessKeyID, secretAccessKey, bucket, endpoint, publicBaseURL string) (*R2Client, error) {
-	// Create custom credentials
-	creds := credentials.NewStaticCredentialsProvider(accessKeyID, secretAccessKey, "")
-	
 	// Use accountID to build default endpoint if not provided
 	if endpoint == "" {
 		endpoint = fmt.Sprintf("https://%s.r2.cloudflarestorage.com", accountID)
 	}
 	
-	// Create AWS config for R2
-	cfg, err := config.LoadDefaultConfig(ctx,
-		config.WithCredentialsProvider(creds),
-		config.WithEndpointResolverWithOptions(aws.EndpointResolverWithOptionsFunc(
+	// R2 uses "auto" as region
+	return NewS3Client(ctx, accessKeyID, secretAccessKey, bucket, endpoint, "auto", publicBaseURL, false, false)
+}
+
+// NewS3Client returns a client for any S3-compatible store. Without an
+// endpoint it talks to AWS S3 in region, and without an access key it uses
+// the default AWS credential chain (environment, shared config, IAM role).
+// pathStyle addresses the bucket in the path rather than the host name, as
+// MinIO needs; insecureTLS skips certificate verification, for self-signed
+// local servers only.
+func NewS3Client(ctx context.Context, accessKeyID, secretAccessKey, bucket, endpoint, region, publicBaseURL string, pathStyle, insecureTLS bool) (*R2Client, error) {
+	if region == "" {
+		region = "us-east-1"
+	}
+	options := []func(*config.LoadOptions) error{config.WithRegion(region)}
+	if insecureTLS {
+		httpClient := awshttp.NewBuildableClient().WithTransportOptions(func(transport *http.Transport) {
+			transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		})
+		options = append(options, config.WithHTTPClient(httpClient))
+	}
+	if accessKeyID != "" {
+		// Create custom credentials
+		creds := credentials.NewStaticCredentialsProvider(accessKeyID, secretAccessKey, "")
+		options = append(options, config.WithCredentialsProvider(creds))
+	}
+	if endpoint != "" {
+		options = append(options, config.WithEndpointResolverWithOptions(aws.EndpointResolverWithOptionsFunc(
 			func(service, region string, options ...interface{}) (aws.Endpoint, error) {
 				return aws.Endpoint{
 					URL: endpoint,
 				}, nil
-			})),
-		config.WithRegion("auto"), // R2 uses "auto" as region
-	)
+			})))
+	}
+
+	// Create AWS config
+	cfg, err := config.LoadDefaultConfig(ctx, options...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load AWS config: %v", err)
 	}
 
-	client := s3.NewFromConfig(cfg)
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		o.UsePathStyle = pathStyle
+	})
 
 	return &R2Client{
 		client:        client,
 		bucket:        bucket,
 		publicBaseURL: strings.TrimSuffix(publicBaseURL, "/"),
+		cache:         DefaultCachePolicy,
 	}, nil
 }
 
@@ -69,9 +184,7 @@ func (r *R2Client) ObjectExists(ctx context.Context, key string) (bool, error) {
 	
 	if err != nil {
 		// For 404 errors (object doesn't exist), return false without error
-		if strings.Contains(err.Error(), "404") || 
-		   strings.Contains(err.Error(), "NotFound") || 
-		   strings.Contains(err.Error(), "NoSuchKey") {
+		if isNotFound(err) {
 			return false, nil
 		}
 		return false, err
@@ -80,18 +193,157 @@ func (r *R2Client) ObjectExists(ctx context.Context, key string) (bool, error) {
 	return true, nil
 }
 
-// Upload uploads data to R2 with the specified key
+// Download fetches an object's data and content type from R2
+func (r *R2Client) Download(ctx context.Context, key string) ([]byte, string, error) {
+	result, err := r.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(r.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return nil, "", ErrObjectNotFound
+		}
+		return nil, "", fmt.Errorf("failed to download from R2: %v", err)
+	}
+	defer result.Body.Close()
+
+	data, err := io.ReadAll(result.Body)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read object body: %v", err)
+	}
+	return data, aws.ToString(result.ContentType), nil
+}
+
+// Object is an object being read from R2
+type Object struct {
+	Body        io.ReadCloser
+	ContentType string
+	Size        int64
+	ETag        string
+	// ContentDisposition is set for documents
+	ContentDisposition string
+	// CacheControl is what the object was uploaded with, empty if unknown
+	CacheControl string
+}
+
+// Open starts reading an object from R2 for streaming. The caller closes
+// its Body.
+func (r *R2Client) Open(ctx context.Context, key string) (*Object, error) {
+	result, err := r.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(r.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return nil, ErrObjectNotFound
+		}
+		return nil, fmt.Errorf("failed to download from R2: %v", err)
+	}
+	return &Object{
+		Body:        result.Body,
+		ContentType: aws.ToString(result.ContentType),
+		Size:        aws.ToInt64(result.ContentLength),
+		ETag:        aws.ToString(result.ETag),
+		ContentDisposition: aws.ToString(result.ContentDisposition),
+		CacheControl: aws.ToString(result.CacheControl),
+	}, nil
+}
+
+// Ping checks that the bucket is reachable and the credentials accepted,
+// with a HeadBucket request
+func (r *R2Client) Ping(ctx context.Context) error {
+	_, err := r.client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(r.bucket)})
+	if err != nil {
+		return fmt.Errorf("failed to reach bucket %s: %v", r.bucket, err)
+	}
+	return nil
+}
+
+// EnsureBucket creates the bucket if it doesn't exist yet, for local servers
+// that start empty
+func (r *R2Client) EnsureBucket(ctx context.Context) error {
+	_, err := r.client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(r.bucket)})
+	if err == nil {
+		return nil
+	}
+	if !isNotFound(err) {
+		return fmt.Errorf("failed to check bucket: %v", err)
+	}
+	_, err = r.client.CreateBucket(ctx, &s3.CreateBucketInput{Bucket: aws.String(r.bucket)})
+	var owned *types.BucketAlreadyOwnedByYou
+	if err != nil && !errors.As(err, &owned) {
+		return fmt.Errorf("failed to create bucket: %v", err)
+	}
+	return nil
+}
+
+func isNotFound(err error) bool {
+	return strings.Contains(err.Error(), "404") ||
+		strings.Contains(err.Error(), "NotFound") ||
+		strings.Contains(err.Error(), "NoSuchKey")
+}
+
+// Upload uploads data to R2 with the specified key. SVGs are stored as
+// attachments, so browsers opening one from the bucket download it rather
+// than render it on the CDN origin; <img> ignores the disposition.
 func (r *R2Client) Upload(ctx context.Context, key string, data []byte, contentType string) (*UploadResult, error) {
+	disposition := ""
+	if contentType == "image/svg+xml" {
+		disposition = "attachment"
+	}
+	return r.upload(ctx, key, data, contentType, disposition)
+}
+
+// UploadDocument uploads a document to R2 with the specified key. PDFs open
+// in the browser, other documents download, both under filename.
+func (r *R2Client) UploadDocument(ctx context.Context, key string, data []byte, contentType, filename string) (*UploadResult, error) {
+	dispositionType := "attachment"
+	if contentType == "application/pdf" {
+		dispositionType = "inline"
+	}
+	disposition := mime.FormatMediaType(dispositionType, map[string]string{"filename": filename})
+	if disposition == "" {
+		// Not encodable, browsers fall back to the last path segment
+		disposition = dispositionType
+	}
+	return r.upload(ctx, key, data, contentType, disposition)
+}
+
+func (r *R2Client) upload(ctx context.Context, key string, data []byte, contentType, disposition string) (*UploadResult, error) {
+	checksum := sha256.Sum256(data)
 	input := &s3.PutObjectInput{
 		Bucket:      aws.String(r.bucket),
 		Key:         aws.String(key),
 		Body:        bytes.NewReader(data),
 		ContentType: aws.String(contentType),
-		CacheControl: aws.String("public, max-age=31536000, immutable"),
+		CacheControl: aws.String(r.cache.CacheControl(contentType, ttlFromContext(ctx))),
 		Metadata: map[string]string{
-			"source": "format.hackclub.com",
+			"source":         "format.hackclub.com",
+			ChecksumMetadata: hex.EncodeToString(checksum[:]),
 		},
 	}
+	if !r.noChecksums {
+		// The store rejects the upload if what it received doesn't match
+		input.ChecksumSHA256 = aws.String(base64.StdEncoding.EncodeToString(checksum[:]))
+	}
+	if disposition != "" {
+		input.ContentDisposition = aws.String(disposition)
+	}
+	if r.policy.Encryption != "" {
+		input.ServerSideEncryption = types.ServerSideEncryption(r.policy.Encryption)
+		if r.policy.KMSKeyID != "" {
+			input.SSEKMSKeyId = aws.String(r.policy.KMSKeyID)
+		}
+	}
+	if r.policy.Tagging {
+		if tagging := encodeTags(ctx); tagging != "" {
+			input.Tagging = aws.String(tagging)
+		}
+	}
+	if r.policy.LockMode != "" {
+		input.ObjectLockMode = types.ObjectLockMode(r.policy.LockMode)
+		input.ObjectLockRetainUntilDate = aws.Time(time.Now().AddDate(0, 0, r.policy.LockDays))
+	}
 
 	result, err := r.client.PutObject(ctx, input)
 	if err != nil {
@@ -107,11 +359,35 @@ func (r *R2Client) Upload(ctx context.Context, key string, data []byte, contentT
 	}, nil
 }
 
-// GetPublicURL returns the public CDN URL for the given key
+// GetPublicURL returns the public CDN URL for the given key, or a presigned
+// URL of the bucket itself when presigning is on
 func (r *R2Client) GetPublicURL(key string) string {
+	if r.presigner != nil {
+		request, err := r.presigner.PresignGetObject(context.Background(), &s3.GetObjectInput{
+			Bucket: aws.String(r.bucket),
+			Key:    aws.String(key),
+		}, s3.WithPresignExpires(r.presignTTL))
+		// Presigning is local and only fails on invalid input
+		if err == nil {
+			return request.URL
+		}
+	}
 	return fmt.Sprintf("%s/%s", r.publicBaseURL, key)
 }
 
+// BaseURL returns what the URLs of GetPublicURL start with, before the key
+func (r *R2Client) BaseURL() string {
+	if r.presigner != nil {
+		// Presigned URLs depend on the addressing style, cut one at its key
+		const placeholder = "format-base-url"
+		if presigned, err := url.Parse(r.GetPublicURL(placeholder)); err == nil {
+			presigned.RawQuery = ""
+			return strings.TrimSuffix(presigned.String(), placeholder)
+		}
+	}
+	return r.publicBaseURL + "/"
+}
+
 // Delete removes an object from R2
 func (r *R2Client) Delete(ctx context.Context, key string) error {
 	_, err := r.client.DeleteObject(ctx, &s3.DeleteObjectInput{
@@ -121,11 +397,55 @@ func (r *R2Client) Delete(ctx context.Context, key string) error {
 	return err
 }
 
-// GetObjectMetadata retrieves metadata for an object
+// maxDeleteKeys is the most keys DeleteObjects takes per request
+const maxDeleteKeys = 1000
+
+// DeleteMany removes objects with one request per maxDeleteKeys keys and
+// returns the errors of the keys that couldn't be deleted. Stores without
+// multi-object delete, like GCS, get one request per key instead.
+func (r *R2Client) DeleteMany(ctx context.Context, keys []string) map[string]error {
+	failed := make(map[string]error)
+	for start := 0; start < len(keys); start += maxDeleteKeys {
+		batch := keys[start:min(start+maxDeleteKeys, len(keys))]
+		objects := make([]types.ObjectIdentifier, len(batch))
+		for i, key := range batch {
+			objects[i] = types.ObjectIdentifier{Key: aws.String(key)}
+		}
+
+		result, err := r.client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(r.bucket),
+			Delete: &types.Delete{Objects: objects, Quiet: aws.Bool(true)},
+		})
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "NotImplemented" {
+			for _, key := range batch {
+				if err := r.Delete(ctx, key); err != nil {
+					failed[key] = err
+				}
+			}
+			continue
+		}
+		if err != nil {
+			for _, key := range batch {
+				failed[key] = fmt.Errorf("failed to delete objects: %v", err)
+			}
+			continue
+		}
+		// Quiet mode only reports the failures
+		for _, deleteErr := range result.Errors {
+			failed[aws.ToString(deleteErr.Key)] = fmt.Errorf("failed to delete object: %s %s", aws.ToString(deleteErr.Code), aws.ToString(deleteErr.Message))
+		}
+	}
+	return failed
+}
+
+// GetObjectMetadata retrieves metadata for an object, including the SHA-256
+// checksum the store verified on upload where it keeps one
 func (r *R2Client) GetObjectMetadata(ctx context.Context, key string) (*s3.HeadObjectOutput, error) {
 	return r.client.HeadObject(ctx, &s3.HeadObjectInput{
-		Bucket: aws.String(r.bucket),
-		Key:    aws.String(key),
+		Bucket:       aws.String(r.bucket),
+		Key:          aws.String(key),
+		ChecksumMode: types.ChecksumModeEnabled,
 	})
 }
 
@@ -144,3 +464,24 @@ func (r *R2Client) ListObjects(ctx context.Context, prefix string, maxKeys int32
 
 	return result.Contents, nil
 }
+
+// WalkObjects calls fn for every object with the given prefix, page by page,
+// stopping at the first error
+func (r *R2Client) WalkObjects(ctx context.Context, prefix string, fn func(types.Object) error) error {
+	paginator := s3.NewListObjectsV2Paginator(r.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(r.bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to list objects: %v", err)
+		}
+		for _, obj := range page.Contents {
+			if err := fn(obj); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// S3 limits on object tags
+const (
+	maxTags           = 10
+	maxTagKeyLength   = 128
+	maxTagValueLength = 256
+)
+
+// tagsKey carries the tags of the uploads made with a context
+type tagsKey struct{}
+
+// WithTags returns a context whose uploads are tagged with tags, on stores
+// with tagging turned on. Objects that already exist keep their tags, see
+// Tagger.
+func WithTags(ctx context.Context, tags map[string]string) context.Context {
+	return context.WithValue(ctx, tagsKey{}, tags)
+}
+
+// encodeTags returns the tags of ctx as an x-amz-tagging header, empty when
+// there are none. Characters S3 doesn't allow in tags become underscores and
+// long values are cut.
+func encodeTags(ctx context.Context) string {
+	tags, _ := ctx.Value(tagsKey{}).(map[string]string)
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	values := url.Values{}
+	for _, key := range keys {
+		if len(values) == maxTags {
+			break
+		}
+		value := sanitizeTag(tags[key], maxTagValueLength)
+		key = sanitizeTag(key, maxTagKeyLength)
+		if key != "" && value != "" {
+			values.Set(key, value)
+		}
+	}
+	return values.Encode()
+}
+
+// sanitizeTag keeps the characters S3 allows in tags, letters, digits,
+// spaces and + - = . _ : / @, within max bytes
+func sanitizeTag(s string, max int) string {
+	s = strings.Map(func(r rune) rune {
+		if r < 0x80 && (r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune(" +-=._:/@", r)) {
+			return r
+		}
+		return '_'
+	}, s)
+	if len(s) > max {
+		s = s[:max]
+	}
+	return strings.TrimSpace(s)
+}
+
+// Tagger changes the tags of stored objects, for objects an upload
+// deduplicated onto. Stores that never tag objects don't implement it.
+type Tagger interface {
+	// SetTag sets the tag name of the object at key to value, or removes it
+	// when value is empty, keeping its other tags
+	SetTag(ctx context.Context, key, name, value string) error
+}
+
+// SetTag sets or removes a tag of the object at key, when tagging is on
+func (r *R2Client) SetTag(ctx context.Context, key, name, value string) error {
+	if !r.policy.Tagging {
+		return nil
+	}
+	current, err := r.client.GetObjectTagging(ctx, &s3.GetObjectTaggingInput{
+		Bucket: aws.String(r.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get tags of %s: %v", key, err)
+	}
+	tags := make([]types.Tag, 0, len(current.TagSet)+1)
+	for _, tag := range current.TagSet {
+		if aws.ToString(tag.Key) != name {
+			tags = append(tags, tag)
+		}
+	}
+	if value = sanitizeTag(value, maxTagValueLength); value != "" {
+		tags = append(tags, types.Tag{Key: aws.String(sanitizeTag(name, maxTagKeyLength)), Value: aws.String(value)})
+	}
+
+	if len(tags) == 0 {
+		_, err = r.client.DeleteObjectTagging(ctx, &s3.DeleteObjectTaggingInput{
+			Bucket: aws.String(r.bucket),
+			Key:    aws.String(key),
+		})
+	} else {
+		_, err = r.client.PutObjectTagging(ctx, &s3.PutObjectTaggingInput{
+			Bucket:  aws.String(r.bucket),
+			Key:     aws.String(key),
+			Tagging: &types.Tagging{TagSet: tags},
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to set tags of %s: %v", key, err)
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+package storage
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestEncodeTags(t *testing.T) {
+	if got := encodeTags(context.Background()); got != "" {
+		t.Errorf("encodeTags without tags = %q", got)
+	}
+
+	ctx := WithTags(context.Background(), map[string]string{
+		"uploader":  "orpheus@hackclub.com",
+		"source":    "cdn.example.com",
+		"namespace": "hackclub.com",
+		"ttl":       "7d",
+		"note":      "a&b=c?d",
+		"long":      strings.Repeat("x", 300),
+		"empty":     "",
+	})
+	want := "long=" + strings.Repeat("x", 256) + "&namespace=hackclub.com&note=a_b%3Dc_d&source=cdn.example.com&ttl=7d&uploader=orpheus%40hackclub.com"
+	if got := encodeTags(ctx); got != want {
+		t.Errorf("encodeTags = %q, want %q", got, want)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"crypto/sha256"
 	"encoding/base32"
 	"fmt"
+	"regexp"
 	"strings"
 )
 
@@ -26,3 +27,62 @@ func Base32Key(data []byte, ext string) string {
 	// 2-char sharding for directory structure  
 	return fmt.Sprintf("%s/%s%s", key[:2], key[2:], ext)
 }
+
+// derivedKeyRegex matches the keys Base32Key produces, optionally under a
+// namespace, and the keys derived from them for variants and renders,
+// <key without extension>_<suffix>.<ext>
+var derivedKeyRegex = regexp.MustCompile(`^((?:[a-z0-9.-]+/)?[a-z2-7]{2}/[a-z2-7]{24})(_[a-z0-9_]+)?(\.[a-z]+)$`)
+
+// OriginalsPrefix is where untouched uploads are kept when originals are
+// retained. They're never served.
+const OriginalsPrefix = "originals/"
+
+// privatePrefixes hold Base32Keys that aren't public assets: retained
+// originals and quarantined images (moderation.QuarantinePrefix)
+var privatePrefixes = []string{OriginalsPrefix, "quarantine/"}
+
+// IsAssetKey reports whether key is a Base32Key or derived from one, and not
+// under a private prefix
+func IsAssetKey(key string) bool {
+	for _, prefix := range privatePrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return false
+		}
+	}
+	return derivedKeyRegex.MatchString(key)
+}
+
+// IsBaseKey reports whether key is a Base32Key, not derived from one
+func IsBaseKey(key string) bool {
+	return IsAssetKey(key) && BaseKey(key) == key
+}
+
+// namespaceInvalidChars are replaced in namespaces
+var namespaceInvalidChars = regexp.MustCompile(`[^a-z0-9.-]+`)
+
+// Namespace turns a user or team identifier, like an email or a domain, into
+// a key prefix segment
+func Namespace(id string) string {
+	return strings.Trim(namespaceInvalidChars.ReplaceAllString(strings.ToLower(id), "-"), "-.")
+}
+
+// KeyStem returns the Base32Key a key is or was derived from without its
+// extension, which renders in another format share, or "" if key isn't an
+// asset key
+func KeyStem(key string) string {
+	m := derivedKeyRegex.FindStringSubmatch(key)
+	if m == nil {
+		return ""
+	}
+	return m[1]
+}
+
+// BaseKey returns the Base32Key a derived key was derived from, or key
+// itself if it isn't derived
+func BaseKey(key string) string {
+	m := derivedKeyRegex.FindStringSubmatch(key)
+	if m == nil {
+		return key
+	}
+	return m[1] + m[3]
+}
@@ -1,6 +1,7 @@
 package util
 
 import (
+	"strings"
 	"testing"
 )
 
@@ -50,3 +51,43 @@ func TestBase32Key(t *testing.T) {
 		t.Error("Base32Key returned different keys for same data")
 	}
 }
+
+func TestBaseKey(t *testing.T) {
+	key := Base32Key([]byte("test image data"), ".jpg")
+	tests := []struct {
+		key     string
+		isAsset bool
+		base    string
+	}{
+		{key, true, key},
+		{strings.TrimSuffix(key, ".jpg") + "_thumb.jpg", true, key},
+		{strings.TrimSuffix(key, ".jpg") + "_w100_h0_contain.jpg", true, key},
+		{"zach-hackclub.com/" + key, true, "zach-hackclub.com/" + key},
+		{"zach-hackclub.com/" + strings.TrimSuffix(key, ".jpg") + "_thumb.jpg", true, "zach-hackclub.com/" + key},
+		{"logs/2024-05-01.txt", false, "logs/2024-05-01.txt"},
+		{OriginalsPrefix + key, false, OriginalsPrefix + key},
+		{"quarantine/" + key, false, "quarantine/" + key},
+	}
+	for _, tt := range tests {
+		if got := IsAssetKey(tt.key); got != tt.isAsset {
+			t.Errorf("IsAssetKey(%q) = %v, want %v", tt.key, got, tt.isAsset)
+		}
+		if got := BaseKey(tt.key); got != tt.base {
+			t.Errorf("BaseKey(%q) = %q, want %q", tt.key, got, tt.base)
+		}
+	}
+}
+
+func TestNamespace(t *testing.T) {
+	tests := map[string]string{
+		"Zach@HackClub.com": "zach-hackclub.com",
+		"hackclub.com":      "hackclub.com",
+		"a+b@x.org":         "a-b-x.org",
+		"../etc":            "etc",
+	}
+	for id, want := range tests {
+		if got := Namespace(id); got != want {
+			t.Errorf("Namespace(%q) = %q, want %q", id, got, want)
+		}
+	}
+}
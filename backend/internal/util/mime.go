@@ -1,19 +1,75 @@
 package util
 
 import (
+	"bytes"
 	"mime"
 	"net/http"
+	"regexp"
+	"strings"
 )
 
 // DetectContentType detects the MIME type of the given data
 func DetectContentType(data []byte) string {
+	// net/http doesn't sniff HEIF, which is what iPhones shoot
+	if brand := isoBMFFBrand(data); brand != "" {
+		switch brand {
+		case "heic", "heix", "heim", "heis", "hevc", "hevx":
+			return "image/heic"
+		case "mif1", "msf1":
+			return "image/heif"
+		case "avif", "avis":
+			return "image/avif"
+		}
+	}
+	// SVG is XML, which net/http reports as text
+	if isSVG(data) {
+		return "image/svg+xml"
+	}
 	return http.DetectContentType(data)
 }
 
+// IsSVG checks if the data is an SVG image, by content type or by sniffing
+func IsSVG(contentType string, data []byte) bool {
+	return contentType == "image/svg+xml" || isSVG(data)
+}
+
+// svgRootRegex matches an <svg> root element after an optional XML
+// declaration, comments and DOCTYPE
+var svgRootRegex = regexp.MustCompile(`^(?s:\s|<\?xml.*?\?>|<!--.*?-->|<!DOCTYPE[^\[>]*(?:\[.*?\])?\s*>)*<svg[\s>]`)
+
+// isSVG checks whether the data is an XML document with an <svg> root
+func isSVG(data []byte) bool {
+	head := bytes.TrimPrefix(data[:min(len(data), 4096)], []byte("\xef\xbb\xbf"))
+	return svgRootRegex.Match(head)
+}
+
+// IsHEIF checks if the data is a HEIC/HEIF image, by content type or by sniffing
+func IsHEIF(contentType string, data []byte) bool {
+	if contentType == "image/heic" || contentType == "image/heif" {
+		return true
+	}
+	detected := DetectContentType(data)
+	return detected == "image/heic" || detected == "image/heif"
+}
+
+// isoBMFFBrand returns the major brand of an ISO base media file (the
+// container used by HEIF and AVIF), or "" if data isn't one
+func isoBMFFBrand(data []byte) string {
+	if len(data) < 12 || string(data[4:8]) != "ftyp" {
+		return ""
+	}
+	return string(data[8:12])
+}
+
+// IsPDF checks if the data is a PDF document, by content type or by sniffing
+func IsPDF(contentType string, data []byte) bool {
+	return contentType == "application/pdf" || bytes.HasPrefix(data, []byte("%PDF-"))
+}
+
 // IsImageMIME checks if the MIME type is a supported image format
 func IsImageMIME(contentType string) bool {
 	switch contentType {
-	case "image/jpeg", "image/jpg", "image/png", "image/webp", "image/gif", "image/tiff", "image/heif", "image/avif":
+	case "image/jpeg", "image/jpg", "image/png", "image/webp", "image/gif", "image/tiff", "image/heif", "image/heic", "image/avif", "image/svg+xml":
 		return true
 	default:
 		return false
@@ -35,13 +91,76 @@ func GetImageExtension(contentType string) string {
 		return ".tiff"
 	case "image/heif":
 		return ".heif"
+	case "image/heic":
+		return ".heic"
 	case "image/avif":
 		return ".avif"
+	case "image/svg+xml":
+		return ".svg"
 	default:
 		return ".jpg" // Default fallback
 	}
 }
 
+// documentTypes maps the extensions of documents that are rehosted as they
+// are, for links in emails, to their MIME types
+var documentTypes = map[string]string{
+	".pdf":  "application/pdf",
+	".doc":  "application/msword",
+	".docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	".xls":  "application/vnd.ms-excel",
+	".xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	".ppt":  "application/vnd.ms-powerpoint",
+	".pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	".odt":  "application/vnd.oasis.opendocument.text",
+	".ods":  "application/vnd.oasis.opendocument.spreadsheet",
+	".odp":  "application/vnd.oasis.opendocument.presentation",
+	".rtf":  "application/rtf",
+	".txt":  "text/plain",
+	".csv":  "text/csv",
+}
+
+// GetDocumentMIME returns the MIME type of an allowed document extension,
+// empty for anything else
+func GetDocumentMIME(ext string) string {
+	return documentTypes[strings.ToLower(ext)]
+}
+
+// GetDocumentExtension returns the file extension of an allowed document
+// MIME type, empty for anything else
+func GetDocumentExtension(contentType string) string {
+	for ext, documentType := range documentTypes {
+		if documentType == contentType {
+			return ext
+		}
+	}
+	return ""
+}
+
+// oleSignature starts legacy Office (.doc, .xls, .ppt) files
+var oleSignature = []byte{0xD0, 0xCF, 0x11, 0xE0, 0xA1, 0xB1, 0x1A, 0xE1}
+
+// IsDocumentData checks that data looks like a document of the given allowed
+// MIME type, so that a renamed executable or HTML page isn't published as one
+func IsDocumentData(contentType string, data []byte) bool {
+	switch {
+	case contentType == "application/pdf":
+		return bytes.HasPrefix(data, []byte("%PDF-"))
+	case contentType == "application/rtf":
+		return bytes.HasPrefix(data, []byte(`{\rtf`))
+	case strings.HasPrefix(contentType, "application/vnd.openxmlformats-officedocument."),
+		strings.HasPrefix(contentType, "application/vnd.oasis.opendocument."):
+		// ZIP containers
+		return bytes.HasPrefix(data, []byte("PK\x03\x04"))
+	case contentType == "application/msword", contentType == "application/vnd.ms-excel", contentType == "application/vnd.ms-powerpoint":
+		return bytes.HasPrefix(data, oleSignature)
+	case strings.HasPrefix(contentType, "text/"):
+		return strings.HasPrefix(http.DetectContentType(data), "text/plain")
+	default:
+		return false
+	}
+}
+
 // GetMIMEFromExtension returns the MIME type for a file extension
 func GetMIMEFromExtension(ext string) string {
 	return mime.TypeByExtension(ext)
@@ -14,6 +14,7 @@ func TestIsImageMIME(t *testing.T) {
 		{"image/png", true},
 		{"image/webp", true},
 		{"image/gif", true},
+		{"image/heic", true},
 		{"text/plain", false},
 		{"application/json", false},
 		{"", false},
@@ -69,3 +70,84 @@ func TestShouldConvertToJPEG(t *testing.T) {
 		}
 	}
 }
+
+func TestDetectContentTypeHEIF(t *testing.T) {
+	tests := []struct {
+		data     []byte
+		expected string
+	}{
+		{[]byte("\x00\x00\x00\x18ftypheic\x00\x00\x00\x00"), "image/heic"},
+		{[]byte("\x00\x00\x00\x18ftypmif1\x00\x00\x00\x00"), "image/heif"},
+		{[]byte("\x00\x00\x00\x1cftypavif\x00\x00\x00\x00"), "image/avif"},
+		{[]byte("\x00\x00\x00\x18ftypisom\x00\x00\x00\x00"), "application/octet-stream"},
+	}
+
+	for _, test := range tests {
+		result := DetectContentType(test.data)
+		if result != test.expected {
+			t.Errorf("DetectContentType(%q) = %s, expected %s", test.data, result, test.expected)
+		}
+	}
+
+	if !IsHEIF("image/heic", nil) {
+		t.Error("IsHEIF should trust an image/heic content type")
+	}
+	if IsHEIF("image/jpeg", []byte("\xff\xd8\xff\xe0")) {
+		t.Error("IsHEIF should not match JPEG data")
+	}
+}
+
+func TestIsSVG(t *testing.T) {
+	tests := []struct {
+		data     string
+		expected bool
+	}{
+		{`<svg xmlns="http://www.w3.org/2000/svg"></svg>`, true},
+		{"\ufeff<?xml version=\"1.0\"?>\n<!-- logo -->\n<svg></svg>", true},
+		{`<html><body><svg></svg></body></html>`, false},
+		{"not markup <svg>", false},
+		{"\x89PNG\r\n\x1a\n", false},
+	}
+
+	for _, test := range tests {
+		if result := IsSVG("", []byte(test.data)); result != test.expected {
+			t.Errorf("IsSVG(%q) = %v, expected %v", test.data, result, test.expected)
+		}
+	}
+	if DetectContentType([]byte(`<svg></svg>`)) != "image/svg+xml" {
+		t.Error("DetectContentType should sniff SVG")
+	}
+}
+
+func TestIsPDF(t *testing.T) {
+	if !IsPDF("", []byte("%PDF-1.7\n%\xe2\xe3\xcf\xd3")) {
+		t.Error("IsPDF should sniff the PDF header")
+	}
+	if !IsPDF("application/pdf", nil) {
+		t.Error("IsPDF should trust the application/pdf content type")
+	}
+	if IsPDF("image/png", []byte("\x89PNG\r\n\x1a\n")) {
+		t.Error("IsPDF should not match a PNG")
+	}
+}
+
+func TestIsDocumentData(t *testing.T) {
+	tests := []struct {
+		contentType string
+		data        string
+		want        bool
+	}{
+		{"application/pdf", "%PDF-1.7\n", true},
+		{"application/pdf", "MZ\x90\x00", false},
+		{GetDocumentMIME(".DOCX"), "PK\x03\x04\x14\x00", true},
+		{GetDocumentMIME(".xls"), "\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1", true},
+		{"text/csv", "name,email\nOrpheus,orpheus@hackclub.com\n", true},
+		{"text/plain", "<html><script>alert(1)</script></html>", false},
+		{"application/x-msdownload", "MZ\x90\x00", false},
+	}
+	for _, tt := range tests {
+		if got := IsDocumentData(tt.contentType, []byte(tt.data)); got != tt.want {
+			t.Errorf("IsDocumentData(%q, %q) = %v, want %v", tt.contentType, tt.data, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+// Package web holds the built frontend, embedded in the server binary so it
+// serves the same pages whatever directory it runs from.
+package web
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"os"
+)
+
+// IndexPath is the page served for the routes the API doesn't handle
+const IndexPath = ".next/server/app/index.html"
+
+// dist is the frontend as laid out after a build, with its .next/static,
+// .next/server/app and public directories, copied by make embed-frontend
+//
+//go:embed all:dist
+var dist embed.FS
+
+// Open returns the frontend to serve and where it's from: dir when set,
+// otherwise the embedded build. Binaries built without one serve the working
+// directory, as during development.
+func Open(dir string) (fs.FS, string, error) {
+	if dir != "" {
+		fsys := os.DirFS(dir)
+		if _, err := fs.Stat(fsys, IndexPath); err != nil {
+			return nil, "", fmt.Errorf("no frontend build in %s: %w", dir, err)
+		}
+		return fsys, dir, nil
+	}
+
+	embedded, err := fs.Sub(dist, "dist")
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := fs.Stat(embedded, IndexPath); err == nil {
+		return embedded, "embedded", nil
+	}
+	return os.DirFS("."), ".", nil
+}
@@ -0,0 +1,39 @@
+package web
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpen(t *testing.T) {
+	dir := t.TempDir()
+	if _, _, err := Open(dir); err == nil {
+		t.Error("Open(dir without a build) succeeded")
+	}
+
+	index := filepath.Join(dir, filepath.FromSlash(IndexPath))
+	if err := os.MkdirAll(filepath.Dir(index), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(index, []byte("<html></html>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	fsys, source, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := fs.ReadFile(fsys, IndexPath); source != dir || err != nil || string(data) != "<html></html>" {
+		t.Errorf("Open(dir) = %s, %q, %v", source, data, err)
+	}
+
+	// Without a frontend embedded, the working directory is served
+	want := "."
+	if _, err := fs.Stat(dist, "dist/"+IndexPath); err == nil {
+		want = "embedded"
+	}
+	if _, source, err := Open(""); source != want || err != nil {
+		t.Errorf("Open(\"\") = %s, %v, want %s", source, err, want)
+	}
+}
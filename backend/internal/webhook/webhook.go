@@ -0,0 +1,117 @@
+// Package webhook notifies configured URLs of asset events
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Asset events
+const (
+	EventUploaded     = "asset.uploaded"
+	EventDeduplicated = "asset.deduplicated"
+	EventDeleted      = "asset.deleted"
+)
+
+const (
+	maxAttempts    = 3
+	requestTimeout = 10 * time.Second
+)
+
+// Payload is the JSON body of a webhook request
+type Payload struct {
+	Event     string      `json:"event"`
+	Timestamp time.Time   `json:"timestamp"`
+	User      string      `json:"user,omitempty"` // who caused the event, if anyone
+	Asset     interface{} `json:"asset"`
+}
+
+// Notifier posts events to the configured URLs, signing each body with
+// HMAC-SHA256 of the secret in the X-Format-Signature header
+type Notifier struct {
+	urls   []string
+	secret string
+	client *http.Client
+	logger zerolog.Logger
+}
+
+func NewNotifier(urls []string, secret string, logger zerolog.Logger) *Notifier {
+	return &Notifier{
+		urls:   urls,
+		secret: secret,
+		client: &http.Client{Timeout: requestTimeout},
+		logger: logger,
+	}
+}
+
+// Notify sends event in the background, retrying failed deliveries. It's a
+// no-op without URLs.
+func (n *Notifier) Notify(event, user string, asset interface{}) {
+	if n == nil || len(n.urls) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(Payload{Event: event, Timestamp: time.Now().UTC(), User: user, Asset: asset})
+	if err != nil {
+		n.logger.Error().Err(err).Str("event", event).Msg("failed to encode webhook payload")
+		return
+	}
+	signature := n.sign(body)
+
+	for _, url := range n.urls {
+		go n.deliver(url, event, body, signature)
+	}
+}
+
+// sign returns the X-Format-Signature of body
+func (n *Notifier) sign(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(n.secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliver posts body to url, backing off between attempts
+func (n *Notifier) deliver(url, event string, body []byte, signature string) {
+	var err error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		if err = n.post(url, event, body, signature); err == nil {
+			return
+		}
+		if attempt < maxAttempts {
+			time.Sleep(time.Duration(attempt*attempt) * time.Second)
+		}
+	}
+	n.logger.Error().Err(err).Str("url", url).Str("event", event).Msg("webhook delivery failed")
+}
+
+func (n *Notifier) post(url, event string, body []byte, signature string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Format-Event", event)
+	req.Header.Set("X-Format-Signature", signature)
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
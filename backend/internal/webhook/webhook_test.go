@@ -0,0 +1,55 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestNotifySignsPayload(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- r
+		bodies <- body
+	}))
+	defer server.Close()
+
+	n := NewNotifier([]string{server.URL}, "secret", zerolog.Nop())
+	n.Notify(EventUploaded, "a@hackclub.com", map[string]string{"key": "ab/key.jpg"})
+
+	select {
+	case r := <-received:
+		body := <-bodies
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write(body)
+		if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); r.Header.Get("X-Format-Signature") != want {
+			t.Errorf("signature = %q, want %q", r.Header.Get("X-Format-Signature"), want)
+		}
+		if r.Header.Get("X-Format-Event") != EventUploaded {
+			t.Errorf("event header = %q", r.Header.Get("X-Format-Event"))
+		}
+		var payload struct {
+			Event string            `json:"event"`
+			User  string            `json:"user"`
+			Asset map[string]string `json:"asset"`
+		}
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Fatal(err)
+		}
+		if payload.Event != EventUploaded || payload.User != "a@hackclub.com" || payload.Asset["key"] != "ab/key.jpg" {
+			t.Errorf("payload = %+v", payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook not delivered")
+	}
+}
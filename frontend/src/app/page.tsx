@@ -9,7 +9,7 @@ import { htmlAPI } from '@/lib/api'
 import { TransformResult } from '@/types'
 
 import { useGmailAPI } from '@/hooks/useGmailAPI'
-import { useOAuthTokens } from '@/hooks/useOAuthTokens'
+import { gmailClient } from '@/lib/gmailAPI'
 
 
 
@@ -21,8 +21,7 @@ const Editor = dynamic(() => import('@/components/Editor'), {
 })
 
 export default function HomePage() {
-  useOAuthTokens() // Capture tokens from OAuth redirect
-  const { user, logout } = useAuth()
+  const { user, logout, stopImpersonating } = useAuth()
   const { hasGmailAccess } = useGmailAPI()
   const [content, setContent] = useState('')
   const [transforming, setTransforming] = useState(false)
@@ -38,6 +37,29 @@ export default function HomePage() {
     }
   }, [transformResult])
 
+  // Transforms the content and saves it as a Gmail draft, opened in a new tab
+  const handleCreateDraft = async () => {
+    if (!content.trim()) {
+      setError('No content to process')
+      return
+    }
+    const subject = window.prompt('Subject of the Gmail draft')
+    if (subject === null) return
+
+    try {
+      setTransforming(true)
+      setError(null)
+      const html = transformResult?.html || (await htmlAPI.transform(content)).html
+      const draft = await gmailClient.createDraft({ html, subject })
+      window.open(draft.url, '_blank', 'noopener')
+    } catch (err) {
+      console.error('Create draft error:', err)
+      setError(err instanceof Error ? err.message : 'Failed to create Gmail draft')
+    } finally {
+      setTransforming(false)
+    }
+  }
+
   const handleProcessAndCopy = async () => {
     if (!content.trim()) {
       setError('No content to process')
@@ -91,6 +113,33 @@ export default function HomePage() {
   return (
     <AuthGuard>
       <div className="min-h-screen bg-white relative">
+        {/* Impersonation Banner */}
+        {user?.impersonator && (
+          <div className="fixed top-0 inset-x-0 z-40 bg-amber-100 border-b border-amber-300 text-amber-900 text-sm px-4 py-2 flex items-center justify-center gap-3">
+            <span>
+              {user.impersonator.email} is acting as <strong>{user.email}</strong>
+              {user.impersonation_expires_at && ` until ${new Date(user.impersonation_expires_at * 1000).toLocaleTimeString()}`}
+            </span>
+            <button
+              onClick={stopImpersonating}
+              className="bg-white border border-amber-300 px-2 py-1 rounded hover:bg-amber-50"
+            >
+              Stop impersonating
+            </button>
+          </div>
+        )}
+
+        {/* Floating Gmail Draft Button */}
+        {user && hasGmailAccess && (
+          <button
+            onClick={handleCreateDraft}
+            disabled={transforming || !content.trim()}
+            className="fixed bottom-4 right-28 z-30 bg-white border border-gray-300 text-gray-600 px-3 py-2 rounded-lg shadow-lg hover:bg-gray-50 text-sm disabled:opacity-50"
+          >
+            Save as Gmail draft
+          </button>
+        )}
+
         {/* Floating Sign Out Button */}
         {user && (
           <button
@@ -8,7 +8,7 @@ interface AuthGuardProps {
 }
 
 export function AuthGuard({ children }: AuthGuardProps) {
-  const { user, loading, error, login } = useAuth()
+  const { user, loading, error, login, providers } = useAuth()
 
   if (loading) {
     return (
@@ -25,7 +25,7 @@ export function AuthGuard({ children }: AuthGuardProps) {
           <h1 className="text-xl font-bold text-red-600 mb-4">Authentication Error</h1>
           <p className="text-gray-600 mb-4">{error}</p>
           <button
-            onClick={login}
+            onClick={() => login()}
             className="bg-hack-red text-white px-4 py-2 rounded hover:bg-red-600 transition-colors"
           >
             Try Again
@@ -43,13 +43,16 @@ export function AuthGuard({ children }: AuthGuardProps) {
             <h1 className="text-3xl font-bold text-gray-900 mb-2">format.hackclub.com</h1>
           </div>
           
-          <div className="bg-white rounded-lg shadow-lg p-8">
-            <button
-              onClick={login}
-              className="w-full bg-hack-red text-white px-4 py-3 rounded-lg hover:bg-red-600 transition-colors font-semibold"
-            >
-              Sign in with Google
-            </button>
+          <div className="bg-white rounded-lg shadow-lg p-8 space-y-3">
+            {(providers.length > 0 ? providers : [{ name: 'google', display_name: 'Google', login_url: '' }]).map((provider) => (
+              <button
+                key={provider.name}
+                onClick={() => login(provider.name)}
+                className="w-full bg-hack-red text-white px-4 py-3 rounded-lg hover:bg-red-600 transition-colors font-semibold"
+              >
+                Sign in with {provider.display_name}
+              </button>
+            ))}
             
             <p className="text-xs text-gray-500 mt-4">
               Only @hackclub.com accounts are allowed
@@ -179,37 +179,27 @@ function ImageProcessorPlugin() {
         if (gmailAttachmentInfo) {
           console.log('📧 Processing Gmail attachment via Gmail API')
           
-          // Use Gmail API to fetch the attachment with context
-          const blob = await gmailClient.fetchAttachment({
+          // The backend fetches the attachment with context and rehosts it
+          const asset = await gmailClient.rehostAttachment({
             ...gmailAttachmentInfo,
             context: {
               alt: imageNode.getAltText() || ''
             }
           })
+          console.log('✅ Gmail attachment processed to CDN:', asset.url)
           
-          if (blob) {
-            console.log('✅ Gmail attachment fetched successfully')
-            
-            // Upload the blob via our file upload API
-            const file = new File([blob], 'gmail-attachment.jpg', { type: blob.type || 'image/jpeg' })
-            const asset = await assetsAPI.uploadFile(file)
-            console.log('✅ Gmail attachment processed to CDN:', asset.url)
-            
-            // Replace the image node with CDN version
-            editor.update(() => {
-              const newImageNode = $createImageNode({
-                src: asset.url,
-                altText: imageNode.getAltText(),
-                width: asset.width,
-                height: asset.height,
-              })
-              
-              imageNode.replace(newImageNode)
-              console.log('🔄 Gmail image node replaced with CDN version')
+          // Replace the image node with CDN version
+          editor.update(() => {
+            const newImageNode = $createImageNode({
+              src: asset.url,
+              altText: imageNode.getAltText(),
+              width: asset.width,
+              height: asset.height,
             })
-          } else {
-            console.error('❌ Failed to fetch Gmail attachment')
-          }
+            
+            imageNode.replace(newImageNode)
+            console.log('🔄 Gmail image node replaced with CDN version')
+          })
           
         } else {
           // Regular external image - use URL upload
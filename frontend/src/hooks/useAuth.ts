@@ -2,15 +2,17 @@
 
 import { useState, useEffect } from 'react'
 import { authAPI } from '@/lib/api'
-import { User } from '@/types'
+import { User, AuthProvider } from '@/types'
 
 export function useAuth() {
   const [user, setUser] = useState<User | null>(null)
   const [loading, setLoading] = useState(true)
   const [error, setError] = useState<string | null>(null)
+  const [providers, setProviders] = useState<AuthProvider[]>([])
 
   useEffect(() => {
     loadUser()
+    authAPI.getProviders().then(setProviders).catch(() => setProviders([]))
   }, [])
 
   const loadUser = async () => {
@@ -26,15 +28,14 @@ export function useAuth() {
     }
   }
 
-  const login = () => {
-    window.location.href = authAPI.getLoginURL()
+  const login = (provider?: string) => {
+    window.location.href = authAPI.getLoginURL(provider)
   }
 
   const logout = async () => {
     try {
+      // The backend forgets the session's Gmail tokens
       await authAPI.logout()
-      // Clear any stored Gmail tokens
-      localStorage.removeItem('gmail_tokens')
       setUser(null)
       // Force reload to ensure clean state
       window.location.reload()
@@ -43,12 +44,23 @@ export function useAuth() {
     }
   }
 
+  const stopImpersonating = async () => {
+    try {
+      await authAPI.stopImpersonating()
+      window.location.reload()
+    } catch (err) {
+      setError(err instanceof Error ? err.message : 'Failed to stop impersonating')
+    }
+  }
+
   return {
     user,
     loading,
     error,
     login,
     logout,
+    stopImpersonating,
+    providers,
     isAuthenticated: !!user,
   }
 }
@@ -1,29 +1,80 @@
-import { User, Asset, TransformResult, BatchInput, BatchResult } from '@/types'
+import { User, AuthProvider, Asset, TransformResult, BatchInput, BatchResult, Campaign, CampaignMessage, CampaignRecipient } from '@/types'
 
 const API_BASE = '/api'
 
+// FieldError is an invalid field of a request, listed by validation problems
+export interface FieldError {
+  field: string
+  detail: string
+}
+
 export class APIError extends Error {
-  constructor(message: string, public status: number) {
+  constructor(message: string, public status: number, public errors: FieldError[] = [], public requestId?: string) {
     super(message)
     this.name = 'APIError'
   }
 }
 
+// errorFrom turns an error response into an APIError. The API answers with
+// RFC 7807 problem+json, whose detail is the message.
+export async function errorFrom(response: Response): Promise<APIError> {
+  const text = await response.text()
+  if (response.headers.get('Content-Type')?.startsWith('application/problem+json')) {
+    try {
+      const problem = JSON.parse(text)
+      return new APIError(problem.detail || problem.title || `HTTP ${response.status}`, response.status, problem.errors ?? [], problem.request_id)
+    } catch {
+      // Not JSON after all, shown as is
+    }
+  }
+  return new APIError(text || `HTTP ${response.status}`, response.status)
+}
+
+// In bearer mode the API is called with a short-lived JWT minted from the
+// login cookie, kept in memory and refreshed a minute before it expires
+let bearer: { token: string, expiresAt: number } | null = null
+let bearerMode: Promise<boolean> | null = null
+
+async function bearerToken(): Promise<string | null> {
+  bearerMode ??= fetch(`${API_BASE}/config`)
+    .then(response => response.ok ? response.json() : {})
+    .then(config => config.authMode === 'bearer')
+    .catch(() => false)
+  if (!(await bearerMode)) return null
+  if (bearer && Date.now() < bearer.expiresAt - 60_000) {
+    return bearer.token
+  }
+
+  const response = await fetch(`${API_BASE}/auth/jwt`, {
+    method: 'POST',
+    credentials: 'include',
+    headers: bearer ? { Authorization: `Bearer ${bearer.token}` } : {},
+  })
+  if (!response.ok) {
+    bearer = null
+    return null
+  }
+  const { token, expires_in } = await response.json()
+  bearer = { token, expiresAt: Date.now() + expires_in * 1000 }
+  return token
+}
+
 async function apiRequest<T>(endpoint: string, options: RequestInit = {}): Promise<T> {
   const url = `${API_BASE}${endpoint}`
-  
+  const token = endpoint === '/config' ? null : await bearerToken()
+
   const response = await fetch(url, {
     credentials: 'include',
+    ...options,
     headers: {
       'Content-Type': 'application/json',
+      ...(token ? { Authorization: `Bearer ${token}` } : {}),
       ...options.headers,
     },
-    ...options,
   })
 
   if (!response.ok) {
-    const errorText = await response.text()
-    throw new APIError(errorText || `HTTP ${response.status}`, response.status)
+    throw await errorFrom(response)
   }
 
   return response.json()
@@ -44,10 +95,20 @@ export const authAPI = {
 
   async logout(): Promise<void> {
     await apiRequest('/auth/logout', { method: 'POST' })
+    bearer = null
+  },
+
+  async stopImpersonating(): Promise<User> {
+    return apiRequest<User>('/admin/impersonate', { method: 'DELETE' })
+  },
+
+  async getProviders(): Promise<AuthProvider[]> {
+    const { providers } = await apiRequest<{ providers: AuthProvider[] }>('/auth/providers')
+    return providers
   },
 
-  getLoginURL(): string {
-    return `${API_BASE}/auth/login`
+  getLoginURL(provider?: string): string {
+    return provider ? `${API_BASE}/auth/login?provider=${encodeURIComponent(provider)}` : `${API_BASE}/auth/login`
   },
 }
 
@@ -70,15 +131,16 @@ export const assetsAPI = {
   async uploadFile(file: File): Promise<Asset> {
     const formData = new FormData()
     formData.append('file', file)
+    const token = await bearerToken()
     
     return fetch(`${API_BASE}/assets`, {
       method: 'POST',
       credentials: 'include',
+      headers: token ? { Authorization: `Bearer ${token}` } : {},
       body: formData,
     }).then(async (response) => {
       if (!response.ok) {
-        const errorText = await response.text()
-        throw new APIError(errorText || `HTTP ${response.status}`, response.status)
+        throw await errorFrom(response)
       }
       return response.json()
     })
@@ -94,18 +156,102 @@ export const assetsAPI = {
 
 // HTML API
 export const htmlAPI = {
-  async transform(html: string): Promise<TransformResult> {
+  // gmailMessageId is the message the HTML was copied from, its cid: and
+  // blob: images are fetched from it when Gmail is connected
+  async transform(html: string, assets?: Record<string, Asset>, gmailMessageId?: string): Promise<TransformResult> {
     return apiRequest<TransformResult>('/html/transform', {
       method: 'POST',
-      body: JSON.stringify({ html }),
+      body: JSON.stringify({ html, assets, gmail_message_id: gmailMessageId }),
     })
   },
+
+  async reverse(html: string, format: 'html' | 'markdown' = 'html'): Promise<{ content: string; format: string }> {
+    return apiRequest<{ content: string; format: string }>('/html/reverse', {
+      method: 'POST',
+      body: JSON.stringify({ html, format }),
+    })
+  },
+}
+
+// Campaigns API, mail merges sent from the user's mailbox
+export const campaignsAPI = {
+  async list(): Promise<Campaign[]> {
+    const { campaigns } = await apiRequest<{ campaigns: Campaign[] }>('/campaigns')
+    return campaigns
+  },
+
+  // create uploads the recipients' CSV; the email column and the mapping of
+  // placeholders are guessed from its header unless given
+  async create(csv: File, campaign: { name?: string, subject: string, html: string, email_column?: string, mapping?: Record<string, string> }): Promise<Campaign> {
+    const formData = new FormData()
+    formData.append('csv', csv)
+    formData.append('subject', campaign.subject)
+    formData.append('html', campaign.html)
+    if (campaign.name) formData.append('name', campaign.name)
+    if (campaign.email_column) formData.append('email_column', campaign.email_column)
+    if (campaign.mapping) formData.append('mapping', JSON.stringify(campaign.mapping))
+    const token = await bearerToken()
+
+    const response = await fetch(`${API_BASE}/campaigns`, {
+      method: 'POST',
+      credentials: 'include',
+      headers: token ? { Authorization: `Bearer ${token}` } : {},
+      body: formData,
+    })
+    if (!response.ok) {
+      throw await errorFrom(response)
+    }
+    return response.json()
+  },
+
+  async get(id: string): Promise<Campaign> {
+    return apiRequest<Campaign>(`/campaigns/${encodeURIComponent(id)}`)
+  },
+
+  async update(id: string, changes: Partial<Pick<Campaign, 'name' | 'subject' | 'html' | 'email_column' | 'mapping'>>): Promise<Campaign> {
+    return apiRequest<Campaign>(`/campaigns/${encodeURIComponent(id)}`, {
+      method: 'PUT',
+      body: JSON.stringify(changes),
+    })
+  },
+
+  async remove(id: string): Promise<void> {
+    const token = await bearerToken()
+    const response = await fetch(`${API_BASE}/campaigns/${encodeURIComponent(id)}`, {
+      method: 'DELETE',
+      credentials: 'include',
+      headers: token ? { Authorization: `Bearer ${token}` } : {},
+    })
+    if (!response.ok) {
+      throw await errorFrom(response)
+    }
+  },
+
+  async preview(id: string, limit = 3): Promise<{ messages: CampaignMessage[], unmapped: string[] }> {
+    return apiRequest(`/campaigns/${encodeURIComponent(id)}/preview?limit=${limit}`)
+  },
+
+  async recipients(id: string, status?: CampaignRecipient['status']): Promise<CampaignRecipient[]> {
+    const query = status ? `?status=${status}` : ''
+    const { recipients } = await apiRequest<{ recipients: CampaignRecipient[] }>(`/campaigns/${encodeURIComponent(id)}/recipients${query}`)
+    return recipients
+  },
+
+  // send starts sending to the recipients not sent to yet, also resuming a
+  // paused campaign. It needs Gmail compose access.
+  async send(id: string): Promise<Campaign> {
+    return apiRequest<Campaign>(`/campaigns/${encodeURIComponent(id)}/send`, { method: 'POST' })
+  },
+
+  async pause(id: string): Promise<Campaign> {
+    return apiRequest<Campaign>(`/campaigns/${encodeURIComponent(id)}/pause`, { method: 'POST' })
+  },
 }
 
 // Config API
 export const configAPI = {
-  async getConfig(): Promise<{ cdnBaseUrl: string }> {
-    return apiRequest<{ cdnBaseUrl: string }>('/config')
+  async getConfig(): Promise<{ cdnBaseUrl: string, authMode: 'cookie' | 'bearer' }> {
+    return apiRequest<{ cdnBaseUrl: string, authMode: 'cookie' | 'bearer' }>('/config')
   },
 }
 
@@ -1,4 +1,5 @@
 // Client-side Gmail API integration to automatically fetch attachment images
+import { Asset } from '@/types'
 
 interface GmailAttachmentInfo {
   messageId: string
@@ -7,237 +8,291 @@ interface GmailAttachmentInfo {
   originalUrl: string
 }
 
-interface GmailTokens {
-  access_token: string
-  refresh_token?: string
-  expires_at?: number
+export interface GmailDraftRequest {
+  html: string
+  subject: string
+  to?: string
+  cc?: string
+  bcc?: string
+  inline_images?: boolean
+  // reply_to (a Gmail message ID) or thread_id (its latest message) make the
+  // draft a reply quoting that message, in its thread
+  reply_to?: string
+  thread_id?: string
 }
 
-// Client-side Gmail API class
+export interface GmailDraft {
+  id: string
+  message_id: string
+  url: string
+}
+
+// GmailWatch is whether drafts given label are formatted on their own
+export interface GmailWatch {
+  watching: boolean
+  label: string
+  expires_at?: string
+  since?: string
+}
+
+export interface GmailDraftSummary {
+  id: string
+  message_id: string
+  subject: string
+  to?: string
+  snippet: string
+  updated_at: string
+}
+
+// GmailScope is what a Gmail feature needs the user to grant
+export type GmailScope = 'readonly' | 'compose' | 'settings' | 'contacts' | 'insert'
+
+// GmailContact is a recipient suggestion, saved contacts come first
+export interface GmailContact {
+  name?: string
+  email: string
+  saved: boolean
+}
+
+// GmailSendAs is an address the user sends mail as
+export interface GmailSendAs {
+  email: string
+  display_name?: string
+  primary: boolean
+  signature: string
+}
+
+export interface GmailStatus {
+  connected: boolean
+  email?: string
+  reason?: string
+  // reconsent is set when access has to be granted again, at grant_url
+  reconsent?: boolean
+  grant_url?: string
+}
+
+// Client-side Gmail API class. Gmail is called through the backend, which
+// keeps the OAuth tokens of the session, so no token reaches the browser.
 class GmailAPIClient {
-  private tokens: GmailTokens | null = null
+  // Short-lived access token from /api/auth/token, kept in memory only
+  private accessToken: { token: string, expiresAt: number } | null = null
+  // Gmail access is only asked for once per page load
+  private accessRequested = false
 
   constructor() {
-    this.loadTokens()
+    this.clearLegacyTokens()
   }
 
-  private loadTokens(): void {
+  // Tokens used to be handed to the browser and kept in localStorage
+  private clearLegacyTokens(): void {
     if (typeof window === 'undefined') return // Skip during SSR
-    
-    try {
-      const stored = localStorage.getItem('gmail_tokens')
-      if (stored) {
-        this.tokens = JSON.parse(stored)
-      }
-    } catch (error) {
-      console.error('Failed to load Gmail tokens:', error)
-      this.tokens = null
-    }
+    localStorage.removeItem('gmail_tokens')
   }
 
-  private saveTokens(tokens: GmailTokens): void {
-    if (typeof window === 'undefined') return // Skip during SSR
-    
-    try {
-      localStorage.setItem('gmail_tokens', JSON.stringify(tokens))
-      this.tokens = tokens
-    } catch (error) {
-      console.error('Failed to save Gmail tokens:', error)
+  async getStatus(): Promise<GmailStatus> {
+    const response = await fetch('/api/gmail/status', { credentials: 'include' })
+    if (!response.ok) {
+      return { connected: false, reason: `HTTP ${response.status}` }
     }
+    return response.json()
   }
 
-  setTokens(tokens: GmailTokens): void {
-    this.saveTokens(tokens)
+  // requestAccess sends the user to grant Gmail access, which isn't asked for
+  // at sign-in. Google brings them back to the app afterwards. Drafts need
+  // the compose scope on top, signatures the settings scope and recipient
+  // suggestions the contacts scope.
+  requestAccess(scope: GmailScope = 'readonly'): boolean {
+    if (typeof window === 'undefined' || this.accessRequested) return false
+    this.accessRequested = true
+    const grant = window.confirm({
+      compose: 'Creating Gmail drafts needs access to compose in your mailbox. Grant it now? You will need to create the draft again afterwards.',
+      insert: 'Adding drafts exactly as formatted needs access to add messages to your mailbox. Grant it now? You will need to create the draft again afterwards.',
+      contacts: 'Suggesting recipients needs read access to your Google contacts. Grant it now?',
+      settings: 'Setting your Gmail signature needs access to your basic mail settings. Grant it now? You will need to set the signature again afterwards.',
+      readonly: 'Copying images from Gmail needs read access to your mailbox. Grant it now? You will need to paste again afterwards.',
+    }[scope])
+    if (grant) {
+      window.location.href = `/api/auth/gmail/grant?scope=${scope}`
+    }
+    return grant
   }
 
-  hasValidTokens(): boolean {
-    if (!this.tokens?.access_token) return false
-    
-    // Check if token is expired (if we have expiry info)
-    if (this.tokens.expires_at) {
-      return Date.now() < this.tokens.expires_at
+  // failed turns an error response into an Error. When access wasn't granted
+  // yet, expired or was revoked, the user is asked to grant it again.
+  private async failed(response: Response, fallback: string, scope: GmailScope = 'readonly'): Promise<Error> {
+    const errorText = await response.text()
+    try {
+      const body = JSON.parse(errorText)
+      if (body.reconsent) {
+        this.requestAccess(scope)
+        return new Error(body.error)
+      }
+      if (body.detail) {
+        // problem+json of the shared middleware
+        return new Error(body.detail)
+      }
+    } catch {
+      // Not JSON
     }
-    
-    return true // Assume valid if no expiry
+    return new Error(errorText || fallback)
   }
 
-  async getValidAccessToken(): Promise<string | null> {
-    if (!this.hasValidTokens()) {
-      console.log('No valid Gmail tokens available')
+  // getAccessToken returns a Gmail access token for calls the backend doesn't
+  // proxy. The backend refreshes it, the browser never holds a refresh token.
+  async getAccessToken(): Promise<string | null> {
+    if (this.accessToken && Date.now() < this.accessToken.expiresAt - 60_000) {
+      return this.accessToken.token
+    }
+    const response = await fetch('/api/auth/token', { method: 'POST', credentials: 'include' })
+    if (!response.ok) {
+      this.accessToken = null
       return null
     }
-    return this.tokens!.access_token
+    const { access_token, expires_in } = await response.json()
+    this.accessToken = { token: access_token, expiresAt: Date.now() + (expires_in ?? 300) * 1000 }
+    return access_token
   }
 
   async fetchAttachment(info: GmailAttachmentInfo & { context?: { filename?: string, alt?: string } }): Promise<Blob | null> {
     try {
-      const accessToken = await this.getValidAccessToken()
-      if (!accessToken) {
-        throw new Error('No valid access token')
-      }
-
-      console.log('📧 Fetching Gmail attachment via API:', info.messageId, info.attachmentId)
-
-      // Use the original message ID format from the URL (msg-f: or msg-a:)
-      const apiMessageId = info.messageId
-      console.log('📧 Using message ID format:', apiMessageId)
-
-      // Get the message
-      const messageResponse = await fetch(
-        `https://www.googleapis.com/gmail/v1/users/me/messages/${encodeURIComponent(apiMessageId)}`,
-        {
-          headers: {
-            'Authorization': `Bearer ${accessToken}`,
-          }
-        }
-      )
-
-      console.log(`📧 Response: ${messageResponse.status}`)
-
-      if (!messageResponse.ok) {
-        if (messageResponse.status === 403) {
-          throw new Error(`Gmail API access denied (403) - please sign out and sign in again to grant Gmail permissions`)
-        }
-        const errorText = await messageResponse.text()
-        console.log(`❌ Gmail API error:`, messageResponse.status, errorText.substring(0, 200))
-        throw new Error(`Failed to fetch message: ${messageResponse.status}`)
-      }
-
-      const message = await messageResponse.json()
-      console.log('✅ Found message with API format')
-      const successfulMessageId = apiMessageId
-      
-      console.log('📧 Message structure - payload keys:', Object.keys(message.payload))
-      console.log('📧 Looking for attachment ID:', info.attachmentId)
-      
-      // Debug: log the message parts structure
-      if (message.payload.parts) {
-        console.log('📧 Message has', message.payload.parts.length, 'parts')
-        message.payload.parts.forEach((part: any, index: number) => {
-          console.log(`📧 Part ${index}:`, {
-            mimeType: part.mimeType,
-            filename: part.filename,
-            hasBody: !!part.body,
-            attachmentId: part.body?.attachmentId,
-            hasAttachmentId: !!part.body?.attachmentId
-          })
-        })
-      }
-      
-      // Find the attachment in the message parts using the correct attachmentId and context
-      let attachmentBodyId = this.findAttachmentBodyId(message.payload, info.attachmentId, info.context)
-      if (!attachmentBodyId) {
-        // As a fallback, try to find any image if the specific ID fails (sometimes realattid is weird)
-        const fallbackBodyId = this.findImageAttachmentBodyId(message.payload)
-        if (!fallbackBodyId) {
-          throw new Error(`Attachment with ID ${info.attachmentId} not found in message`)
-        }
-        console.log(`⚠️ Could not find specific attachment ID, falling back to first image: ${fallbackBodyId}`)
-        attachmentBodyId = fallbackBodyId
-      } else {
-        console.log('✅ Found specific attachment with body ID:', attachmentBodyId)
-      }
+      console.log('📧 Fetching Gmail attachment via backend:', info.messageId, info.attachmentId)
 
-      // Fetch the actual attachment data using the successful message ID
-      const attachmentResponse = await fetch(
-        `https://www.googleapis.com/gmail/v1/users/me/messages/${encodeURIComponent(successfulMessageId)}/attachments/${attachmentBodyId}`,
-        {
-          headers: {
-            'Authorization': `Bearer ${accessToken}`,
-          }
-        }
-      )
+      const params = new URLSearchParams({
+        messageId: info.messageId,
+        attachmentId: info.attachmentId,
+      })
+      if (info.context?.filename) params.set('filename', info.context.filename)
+      if (info.context?.alt) params.set('alt', info.context.alt)
 
-      if (!attachmentResponse.ok) {
-        throw new Error(`Failed to fetch attachment: ${attachmentResponse.status}`)
-      }
-
-      const attachmentData = await attachmentResponse.json()
-      
-      // Decode base64url data
-      const binaryString = atob(attachmentData.data.replace(/-/g, '+').replace(/_/g, '/'))
-      const bytes = new Uint8Array(binaryString.length)
-      for (let i = 0; i < binaryString.length; i++) {
-        bytes[i] = binaryString.charCodeAt(i)
+      const response = await fetch(`/api/gmail/attachment?${params}`, { credentials: 'include' })
+      if (!response.ok) {
+        throw await this.failed(response, `Failed to fetch attachment: ${response.status}`)
       }
-      
-      return new Blob([bytes])
+      return await response.blob()
     } catch (error) {
       console.error('Gmail API fetch failed:', error)
       return null
     }
   }
 
-  private findImageAttachmentBodyId(part: any): string | null {
-    // Check if this part is an image attachment
-    if (part.body?.attachmentId && part.mimeType?.startsWith('image/')) {
-      console.log('🖼️ Found image attachment:', part.mimeType, part.filename)
-      return part.body.attachmentId
+  // listDrafts returns the user's most recent drafts, newest first
+  async listDrafts(limit = 10): Promise<GmailDraftSummary[]> {
+    const response = await fetch(`/api/gmail/drafts?limit=${limit}`, { credentials: 'include' })
+    if (!response.ok) {
+      throw await this.failed(response, `Failed to list drafts: ${response.status}`)
     }
+    const { drafts } = await response.json()
+    return drafts
+  }
 
-    // Search in nested parts
-    if (part.parts) {
-      for (const subPart of part.parts) {
-        const found = this.findImageAttachmentBodyId(subPart)
-        if (found) return found
-      }
+  // createDraft creates a Gmail draft of transformed HTML, ready to send
+  async createDraft(draft: GmailDraftRequest): Promise<GmailDraft> {
+    const response = await fetch('/api/gmail/drafts', {
+      method: 'POST',
+      credentials: 'include',
+      headers: { 'Content-Type': 'application/json' },
+      body: JSON.stringify(draft),
+    })
+    if (!response.ok) {
+      throw await this.failed(response, `Failed to create draft: ${response.status}`, 'compose')
     }
+    return response.json()
+  }
 
-    return null
+  // importDraft adds the draft to the mailbox as built, byte for byte, for
+  // HTML Gmail's editor mangles. The draft has no ID until Gmail opens it.
+  async importDraft(draft: GmailDraftRequest): Promise<{ message_id: string, thread_id: string, url: string }> {
+    const response = await fetch('/api/gmail/drafts/import', {
+      method: 'POST',
+      credentials: 'include',
+      headers: { 'Content-Type': 'application/json' },
+      body: JSON.stringify(draft),
+    })
+    if (!response.ok) {
+      throw await this.failed(response, `Failed to import draft: ${response.status}`, 'insert')
+    }
+    return response.json()
   }
 
-  private findAttachmentBodyId(part: any, target: string, context?: { filename?: string, alt?: string }): string | null {
-    // Match the UI's realattid=ii_... against the header
-    const xAtt = part.headers?.find(
-      (h: any) => h.name?.toLowerCase() === 'x-attachment-id'
-    )?.value;
-    if (xAtt && xAtt === target && part.body?.attachmentId) {
-      return part.body.attachmentId;
+  // watchStatus reports whether drafts given the label are formatted
+  async watchStatus(): Promise<GmailWatch> {
+    const response = await fetch('/api/gmail/watch', { credentials: 'include' })
+    if (!response.ok) {
+      throw await this.failed(response, `Failed to get watch: ${response.status}`)
     }
-    // Also allow a direct match to body.attachmentId
-    if (part.body?.attachmentId === target) {
-      return part.body.attachmentId;
+    return response.json()
+  }
+
+  // startWatch has drafts given the label formatted and written back
+  // without opening the app
+  async startWatch(): Promise<GmailWatch> {
+    const response = await fetch('/api/gmail/watch', { method: 'POST', credentials: 'include' })
+    if (!response.ok) {
+      throw await this.failed(response, `Failed to start watch: ${response.status}`, 'compose')
     }
-    
-    // Smart matching using context clues when direct ID fails
-    if (context && part.body?.attachmentId && part.mimeType?.startsWith('image/')) {
-      // Match by filename if provided
-      if (context.filename && part.filename) {
-        const contextName = context.filename.toLowerCase().replace(/[^a-z0-9]/g, '')
-        const partName = part.filename.toLowerCase().replace(/[^a-z0-9]/g, '')
-        if (contextName === partName || contextName.includes(partName) || partName.includes(contextName)) {
-          console.log('🎯 Found attachment by filename match:', part.filename, '≈', context.filename)
-          return part.body.attachmentId
-        }
-      }
-      
-      // Match by image dimensions or other attributes from context
-      if (context.alt && context.alt.length > 10) {
-        // If alt text contains meaningful content that might match Content-ID or description
-        const altWords = context.alt.toLowerCase().split(/\s+/).filter((w: string) => w.length > 3)
-        const filenameWords = (part.filename || '').toLowerCase().split(/[^a-z0-9]+/).filter((w: string) => w.length > 3)
-        const commonWords = altWords.filter(word => filenameWords.some((fword: string) => fword.includes(word) || word.includes(fword)))
-        if (commonWords.length > 0) {
-          console.log('🎯 Found attachment by alt text similarity:', commonWords)
-          return part.body.attachmentId
-        }
-      }
+    return response.json()
+  }
+
+  async stopWatch(): Promise<void> {
+    const response = await fetch('/api/gmail/watch', { method: 'DELETE', credentials: 'include' })
+    if (!response.ok) {
+      throw await this.failed(response, `Failed to stop watch: ${response.status}`)
     }
-    
-    if (part.parts) {
-      for (const sub of part.parts) {
-        const found = this.findAttachmentBodyId(sub, target, context);
-        if (found) return found;
-      }
+  }
+
+  // contacts suggests recipients whose name or address starts with query
+  async contacts(query: string, limit = 10): Promise<GmailContact[]> {
+    const params = new URLSearchParams({ q: query, limit: String(limit) })
+    const response = await fetch(`/api/gmail/contacts?${params}`, { credentials: 'include' })
+    if (!response.ok) {
+      throw await this.failed(response, `Failed to get contacts: ${response.status}`, 'contacts')
     }
-    return null;
+    const { contacts } = await response.json()
+    return contacts
   }
 
-  clearTokens(): void {
-    if (typeof window === 'undefined') return // Skip during SSR
-    
-    localStorage.removeItem('gmail_tokens')
-    this.tokens = null
+  async signatures(): Promise<GmailSendAs[]> {
+    const response = await fetch('/api/gmail/signature', { credentials: 'include' })
+    if (!response.ok) {
+      throw await this.failed(response, `Failed to get signatures: ${response.status}`)
+    }
+    const { send_as } = await response.json()
+    return send_as
+  }
+
+  // setSignature makes transformed HTML the Gmail signature of sendAs, the
+  // primary address by default
+  async setSignature(html: string, sendAs?: string): Promise<GmailSendAs> {
+    const response = await fetch('/api/gmail/signature', {
+      method: 'PUT',
+      credentials: 'include',
+      headers: { 'Content-Type': 'application/json' },
+      body: JSON.stringify({ html, send_as: sendAs }),
+    })
+    if (!response.ok) {
+      throw await this.failed(response, `Failed to set signature: ${response.status}`, 'settings')
+    }
+    return response.json()
+  }
+
+  // rehostAttachment has the backend fetch an image attachment and upload it
+  // to the CDN, so it never passes through the browser
+  async rehostAttachment(info: GmailAttachmentInfo & { context?: { filename?: string, alt?: string } }): Promise<Asset> {
+    const response = await fetch('/api/gmail/attachments', {
+      method: 'POST',
+      credentials: 'include',
+      headers: { 'Content-Type': 'application/json' },
+      body: JSON.stringify({
+        messageId: info.messageId,
+        attachmentId: info.attachmentId,
+        filename: info.context?.filename,
+        alt: info.context?.alt,
+      }),
+    })
+    if (!response.ok) {
+      throw await this.failed(response, `Failed to rehost attachment: ${response.status}`)
+    }
+    return response.json()
   }
 }
 
@@ -4,6 +4,16 @@ export interface User {
   name: string
   picture: string
   hd: string
+  provider?: string
+  // Set while an admin is acting as this user
+  impersonator?: User
+  impersonation_expires_at?: number
+}
+
+export interface AuthProvider {
+  name: string
+  display_name: string
+  login_url: string
 }
 
 export interface Asset {
@@ -12,9 +22,33 @@ export interface Asset {
   width: number
   height: number
   bytes: number
+  original_bytes: number
   hash: string
   deduped: boolean
   key?: string
+  blurhash?: string
+  variants?: Record<string, AssetVariant>
+  expires_at?: string
+  filename?: string
+  capture?: CaptureMetadata
+}
+
+export interface CaptureMetadata {
+  format: string
+  camera?: string
+  captured_at?: string
+  color_space?: string
+  icc_profile?: boolean
+  width?: number
+  height?: number
+}
+
+export interface AssetVariant {
+  url: string
+  width: number
+  height: number
+  bytes: number
+  key: string
 }
 
 export interface TransformStats {
@@ -22,12 +56,35 @@ export interface TransformStats {
   images_rehosted: number
   styles_removed: number
   scripts_removed: number
+  empty_elements_removed: number
+  spans_unwrapped: number
+  line_breaks_removed: number
+  zero_width_chars_removed: number
+  quotes_removed: number
+  links_cleaned: number
+  mailto_links: number
+  documents_rehosted: number
+  words: number
+  read_time_minutes: number
+  bytes_saved: number
+}
+
+export interface ImageResult {
+  original_url: string
+  url: string
+  status: 'rehosted' | 'skipped' | 'unsupported' | 'failed'
+  error?: string
+  bytes_saved: number
+  deduped: boolean
 }
 
 export interface TransformResult {
   html: string
   messages: string[]
+  images: ImageResult[]
+  assets: Record<string, Asset>
   stats: TransformStats
+  already_transformed: boolean
 }
 
 export interface BatchInput {
@@ -35,7 +92,51 @@ export interface BatchInput {
   dataUri?: string
 }
 
+export interface BatchItemResult {
+  index: number
+  asset?: Asset
+  error?: string
+}
+
 export interface BatchResult {
-  assets: Asset[]
-  count: number
+  results: BatchItemResult[]
+  succeeded: number
+  failed: number
+}
+
+// A mail merge, sent from the user's mailbox to the rows of a CSV
+export interface Campaign {
+  id: string
+  owner: string
+  name: string
+  subject: string
+  html: string
+  columns: string[]
+  email_column: string
+  // The column each {{placeholder}} is filled in from
+  mapping: Record<string, string>
+  status: 'draft' | 'sending' | 'paused' | 'sent'
+  error?: string
+  created_at: string
+  updated_at: string
+  placeholders: string[]
+  unmapped: string[]
+  recipients: { pending: number; sent: number; failed: number; total: number }
+}
+
+export interface CampaignMessage {
+  row: number
+  to: string
+  subject: string
+  html: string
+  error?: string
+}
+
+export interface CampaignRecipient {
+  row: number
+  fields: Record<string, string>
+  status: 'pending' | 'sent' | 'failed'
+  error?: string
+  message_id?: string
+  sent_at?: string
 }